@@ -0,0 +1,92 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package v1beta1
+
+import (
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CapacitySummary describes PMEM usage, either of one node or of
+// the entire cluster.
+// +k8s:deepcopy-gen=true
+type CapacitySummary struct {
+	// Available is the amount of PMEM that can still be used for
+	// new volumes, as published through storage capacity tracking.
+	// Not set when that information is not available.
+	// +optional
+	Available *resource.Quantity `json:"available,omitempty"`
+	// Reserved is the total size of all provisioned volumes.
+	Reserved resource.Quantity `json:"reserved"`
+	// Volumes is the number of provisioned volumes.
+	Volumes int `json:"volumes"`
+	// Pending is the total size requested by PVCs which are
+	// waiting for their volume.
+	Pending resource.Quantity `json:"pending"`
+	// PendingVolumes is the number of PVCs which are waiting for
+	// their volume.
+	PendingVolumes int `json:"pendingVolumes"`
+}
+
+// NodeCapacity describes PMEM usage of one node.
+// +k8s:deepcopy-gen=true
+type NodeCapacity struct {
+	// Node is the name of the node.
+	Node            string `json:"node"`
+	CapacitySummary `json:",inline"`
+	// MaximumVolumeSize is the size of the largest volume that can
+	// currently be created on the node. Not set when that
+	// information is not available.
+	// +optional
+	MaximumVolumeSize *resource.Quantity `json:"maximumVolumeSize,omitempty"`
+}
+
+// CapacityReportStatus is the capacity summary maintained by the
+// PMEM-CSI controller.
+// +k8s:deepcopy-gen=true
+type CapacityReportStatus struct {
+	// LastUpdated is the time when the controller computed the summary.
+	// +nullable
+	LastUpdated metav1.Time `json:"lastUpdated,omitempty"`
+	// Total sums up all nodes and pending PVCs which are not
+	// assigned to a node yet.
+	Total CapacitySummary `json:"total"`
+	// Nodes lists all nodes with PMEM-CSI volumes, pending PVCs
+	// or published capacity.
+	// +optional
+	Nodes []NodeCapacity `json:"nodes,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PmemCSICapacityReport summarizes the PMEM capacity of one PMEM-CSI
+// deployment. It has the same name as the driver.
+// +kubebuilder:resource:path=pmemcsicapacityreports,scope=Cluster,shortName=pcr,singular=pmemcsicapacityreport
+// +kubebuilder:printcolumn:name="Available",type=string,JSONPath=`.status.total.available`
+// +kubebuilder:printcolumn:name="Reserved",type=string,JSONPath=`.status.total.reserved`
+// +kubebuilder:printcolumn:name="Pending",type=string,JSONPath=`.status.total.pending`
+// +kubebuilder:printcolumn:name="Age",type=date,JSONPath=`.metadata.creationTimestamp`
+// +kubebuilder:storageversion
+type PmemCSICapacityReport struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Status CapacityReportStatus `json:"status,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// PmemCSICapacityReportList contains a list of PmemCSICapacityReport objects
+type PmemCSICapacityReportList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []PmemCSICapacityReport `json:"items"`
+}
+
+func init() {
+	SchemeBuilder.Register(&PmemCSICapacityReport{}, &PmemCSICapacityReportList{})
+}
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
@@ -23,17 +24,38 @@ type DeviceMode string
 // Set sets the value
 func (mode *DeviceMode) Set(value string) error {
 	switch value {
-	case string(DeviceModeLVM), string(DeviceModeDirect), string(DeviceModeFake):
+	case string(DeviceModeLVM), string(DeviceModeDirect), string(DeviceModeDevdax), string(DeviceModeFake):
 		*mode = DeviceMode(value)
 	case "ndctl":
 		// For backwards-compatibility.
 		*mode = DeviceModeDirect
 	default:
-		return errors.New("invalid device manager mode")
+		customDeviceModesMutex.RLock()
+		defer customDeviceModesMutex.RUnlock()
+		if !customDeviceModes[DeviceMode(value)] {
+			return errors.New("invalid device manager mode")
+		}
+		*mode = DeviceMode(value)
 	}
 	return nil
 }
 
+var (
+	customDeviceModes      = map[DeviceMode]bool{}
+	customDeviceModesMutex sync.RWMutex
+)
+
+// RegisterCustomDeviceMode makes Set accept the mode in addition to
+// the built-in modes. It gets called when registering a device
+// manager for a driver binary which has additional device
+// managers. The PmemCSIDeployment API only supports the built-in
+// modes.
+func RegisterCustomDeviceMode(mode DeviceMode) {
+	customDeviceModesMutex.Lock()
+	defer customDeviceModesMutex.Unlock()
+	customDeviceModes[mode] = true
+}
+
 func (mode *DeviceMode) String() string {
 	return string(*mode)
 }
@@ -44,6 +66,10 @@ const (
 	DeviceModeLVM DeviceMode = "lvm"
 	// DeviceModeDirect represents 'direct' device manager
 	DeviceModeDirect DeviceMode = "direct"
+	// DeviceModeDevdax represents namespaces in devdax mode, managed
+	// like in direct mode. Such volumes are character devices which
+	// can only be used as raw block volumes.
+	DeviceModeDevdax DeviceMode = "devdax"
 	// DeviceModeFake represents a device manager for testing:
 	// volume creation and deletion is just recorded in memory,
 	// without any actual backing store. Such fake volumes cannot
@@ -82,6 +108,45 @@ const (
 	ControllerTLSSecretOpenshift = "-openshift-"
 )
 
+// StorageClassType identifies one of the StorageClasses that
+// the operator can create for a driver deployment.
+type StorageClassType string
+
+const (
+	// StorageClassFsdaxXFS is for volumes in fsdax mode formatted with XFS.
+	StorageClassFsdaxXFS StorageClassType = "fsdax-xfs"
+	// StorageClassFsdaxExt4 is for volumes in fsdax mode formatted with ext4.
+	StorageClassFsdaxExt4 StorageClassType = "fsdax-ext4"
+	// StorageClassDevdax is for raw block volumes in devdax mode.
+	StorageClassDevdax StorageClassType = "devdax"
+	// StorageClassSector is for volumes in sector mode (direct
+	// mode with usage=FileIO) formatted with ext4.
+	StorageClassSector StorageClassType = "sector"
+)
+
+// Parameters returns the parameters of the StorageClass. The keys are
+// the ones defined in pkg/pmem-csi-driver/parameters, which cannot be
+// imported here.
+func (t StorageClassType) Parameters() (map[string]string, error) {
+	switch t {
+	case StorageClassFsdaxXFS:
+		return map[string]string{"csi.storage.k8s.io/fstype": "xfs"}, nil
+	case StorageClassFsdaxExt4:
+		return map[string]string{"csi.storage.k8s.io/fstype": "ext4"}, nil
+	case StorageClassDevdax:
+		// There is no filesystem on a character device.
+		return map[string]string{"deviceMode": string(DeviceModeDevdax)}, nil
+	case StorageClassSector:
+		return map[string]string{
+			"csi.storage.k8s.io/fstype": "ext4",
+			"deviceMode":                string(DeviceModeDirect),
+			"usage":                     "FileIO",
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported storage class type %q", t)
+	}
+}
+
 // +k8s:deepcopy-gen=true
 // DeploymentSpec defines the desired state of Deployment
 type DeploymentSpec struct {
@@ -153,6 +218,15 @@ type DeploymentSpec struct {
 	// not having a running driver pod. That limit can be increased with
 	// this setting, either with a higher integer or a percentage.
 	MaxUnavailable *intstr.IntOrString `json:"maxUnavailable,omitempty"`
+	// MaxVolumesPerNode is the maximum number of PMEM volumes that
+	// Kubernetes places on each node. Unset (= zero) means no limit.
+	// +kubebuilder:validation:Minimum=0
+	MaxVolumesPerNode int64 `json:"maxVolumesPerNode,omitempty"`
+	// StorageClasses lists the StorageClasses that the operator creates
+	// for the driver. Each StorageClass is named after the deployment
+	// with the type as suffix. None are created by default.
+	// +kubebuilder:validation:items:Enum=fsdax-xfs;fsdax-ext4;devdax;sector
+	StorageClasses []StorageClassType `json:"storageClasses,omitempty"`
 }
 
 // DeploymentConditionType type for representing a deployment status condition
@@ -595,6 +669,23 @@ func (d *PmemCSIDeployment) NodeSetupName() string {
 	return d.GetHyphenedName() + "-node-setup"
 }
 
+// StorageClassName returns the name of the StorageClass
+// object of the given type used by the deployment
+func (d *PmemCSIDeployment) StorageClassName(t StorageClassType) string {
+	return d.GetHyphenedName() + "-" + string(t)
+}
+
+// HasStorageClass returns true if the StorageClass of the
+// given type is enabled for the deployment.
+func (d *PmemCSIDeployment) HasStorageClass(t StorageClassType) bool {
+	for _, enabled := range d.Spec.StorageClasses {
+		if enabled == t {
+			return true
+		}
+	}
+	return false
+}
+
 // GetOwnerReference returns self owner reference could be used by other object
 // to add this deployment to it's owner reference list.
 func (d *PmemCSIDeployment) GetOwnerReference() metav1.OwnerReference {
@@ -132,6 +132,18 @@ spec:
 			Expect(rs.Memory().Cmp(resource.MustParse("150Mi"))).Should(BeZero(), "provisioner 'memory' resource requests mismatch")
 		})
 
+		It("shall have parameters for all storage class types", func() {
+			for _, t := range []api.StorageClassType{api.StorageClassFsdaxXFS, api.StorageClassFsdaxExt4, api.StorageClassDevdax, api.StorageClassSector} {
+				parameters, err := t.Parameters()
+				Expect(err).ShouldNot(HaveOccurred(), "parameters of %s", t)
+				Expect(parameters).ShouldNot(BeEmpty(), "parameters of %s", t)
+			}
+			parameters, _ := api.StorageClassDevdax.Parameters()
+			Expect(parameters).ShouldNot(HaveKey("csi.storage.k8s.io/fstype"), "devdax has no filesystem")
+			_, err := api.StorageClassType("no-such-type").Parameters()
+			Expect(err).Should(HaveOccurred(), "unknown type")
+		})
+
 		It("should have valid json schema", func() {
 
 			crdFile := os.Getenv("REPO_ROOT") + "/deploy/crd/pmem-csi.intel.com_pmemcsideployments.yaml"
@@ -31,7 +31,7 @@ func LoadObjects(kubernetes version.Version, deviceMode api.DeviceMode) ([]unstr
 var pmemImage = regexp.MustCompile(`image: intel/pmem-csi-driver(-test)?:\S+`)
 var nameRegex = regexp.MustCompile(`(name|secretName|serviceName|serviceAccountName): pmem-csi-intel-com`)
 var labelRegex = regexp.MustCompile(`pmem-csi.intel.com/(convert-raw-namespace)`)
-var driverNameRegex = regexp.MustCompile(`(?m)(name|app\.kubernetes.io/instance): pmem-csi.intel.com$`)
+var driverNameRegex = regexp.MustCompile(`(?m)(name|audience|app\.kubernetes.io/instance): pmem-csi.intel.com$`)
 
 // LoadAndCustomizeObjects reads all objects stored in a pmem-csi.yaml reference file
 // and updates them on-the-fly according to the deployment spec, namespace and name.
@@ -44,7 +44,7 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 	// things like renaming with a simple text search/replace.
 	patchYAML := func(yaml *[]byte) {
 		// This renames the objects and labels. A hyphen is used instead of a dot,
-		// except for CSIDriver and instance label which need the exact name.
+		// except for CSIDriver, token audience and instance label which need the exact name.
 		*yaml = nameRegex.ReplaceAll(*yaml, []byte("$1: "+deployment.GetHyphenedName()))
 		*yaml = labelRegex.ReplaceAll(*yaml, []byte(deployment.Name+"/$1"))
 		*yaml = driverNameRegex.ReplaceAll(*yaml, []byte("$1: "+deployment.Name))
@@ -159,9 +159,44 @@ func LoadAndCustomizeObjects(kubernetes version.Version, deviceMode api.DeviceMo
 		return nil, err
 	}
 
+	// The optional StorageClasses are not part of the reference
+	// files.
+	for _, t := range deployment.Spec.StorageClasses {
+		obj, err := storageClassObject(deployment, t)
+		if err != nil {
+			return nil, err
+		}
+		patchUnstructured(&obj)
+		objects = append(objects, obj)
+	}
+
 	return objects, nil
 }
 
+func storageClassObject(deployment api.PmemCSIDeployment, t api.StorageClassType) (unstructured.Unstructured, error) {
+	parameters, err := t.Parameters()
+	if err != nil {
+		return unstructured.Unstructured{}, err
+	}
+	params := map[string]interface{}{}
+	for key, value := range parameters {
+		params[key] = value
+	}
+	return unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "storage.k8s.io/v1",
+			"kind":       "StorageClass",
+			"metadata": map[string]interface{}{
+				"name": deployment.StorageClassName(t),
+			},
+			"parameters":        params,
+			"provisioner":       deployment.Name,
+			"reclaimPolicy":     "Delete",
+			"volumeBindingMode": "WaitForFirstConsumer",
+		},
+	}, nil
+}
+
 func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDeployment, resources map[string]*corev1.ResourceRequirements) error {
 	outerSpec := obj.Object["spec"].(map[string]interface{})
 	template := outerSpec["template"].(map[string]interface{})
@@ -230,12 +265,18 @@ func patchPodTemplate(obj *unstructured.Unstructured, deployment api.PmemCSIDepl
 			image = deployment.Spec.NodeRegistrarImage
 		case "pmem-driver":
 			cmd := container["command"].([]interface{})
+			isNode := false
 			for i := range cmd {
 				arg := cmd[i].(string)
 				if strings.HasPrefix(arg, "-pmemPercentage=") {
 					cmd[i] = fmt.Sprintf("-pmemPercentage=%d", deployment.Spec.PMEMPercentage)
-					break
 				}
+				if arg == "-mode=node" {
+					isNode = true
+				}
+			}
+			if isNode && deployment.Spec.MaxVolumesPerNode > 0 {
+				container["command"] = append(cmd, fmt.Sprintf("-maxVolumesPerNode=%d", deployment.Spec.MaxVolumesPerNode))
 			}
 		}
 		if image != "" {
@@ -12,6 +12,7 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 
 	"github.com/intel/pmem-csi/deploy"
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
@@ -50,19 +51,27 @@ func TestLoadObjects(t *testing.T) {
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "pmem-csi.example.org",
 				},
+				Spec: api.DeploymentSpec{
+					StorageClasses: []api.StorageClassType{api.StorageClassSector},
+				},
 			}
 			objects, err = deployments.LoadAndCustomizeObjects(testCase.Kubernetes, testCase.DeviceMode, namespace, deployment)
 			if assert.NoError(t, err, "load and customize yaml") {
 				assert.NotEmpty(t, objects, "have customized objects")
 
 				for _, obj := range objects {
+					if obj.GetKind() == "StorageClass" {
+						parameters, _, _ := unstructured.NestedStringMap(obj.Object, "parameters")
+						expected, _ := api.StorageClassSector.Parameters()
+						assert.Equal(t, expected, parameters, "StorageClass parameters")
+					}
 					if obj.GetKind() == "CSIDriver" {
 						assert.Equal(t, deployment.GetName(), obj.GetName(), "CSIDriver name")
 					} else {
 						assert.Contains(t, obj.GetName(), deployment.GetHyphenedName(), "other object name")
 					}
 					switch obj.GetKind() {
-					case "CSIDriver", "ClusterRole", "ClusterRoleBinding":
+					case "CSIDriver", "ClusterRole", "ClusterRoleBinding", "StorageClass":
 						assert.Equal(t, "", obj.GetNamespace(), "non-namespaced %s namespace", obj.GetName())
 					default:
 						assert.Equal(t, namespace, obj.GetNamespace(), "non-namespaced %s namespace", obj.GetName())
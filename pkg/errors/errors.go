@@ -29,4 +29,11 @@ var (
 
 	// ErrNotEnoughSpace no space to create the device
 	NotEnoughSpace = errors.New("not enough space")
+
+	// NotSupported the device manager cannot perform the operation
+	NotSupported = errors.New("not supported")
+
+	// ReadOnly modifications are disabled, for example in the
+	// read-only inspection mode of the driver
+	ReadOnly = errors.New("read-only")
 )
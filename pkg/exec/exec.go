@@ -13,9 +13,12 @@ import (
 	"fmt"
 	"io"
 	"os/exec"
+	"path/filepath"
 	"sync"
 
 	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/tracing"
 )
 
 // RunCommand executes the command with logging through klog, with
@@ -32,6 +35,9 @@ func RunCommand(ctx context.Context, cmd string, args ...string) (string, error)
 func Run(ctx context.Context, cmd *exec.Cmd) (string, error) {
 	logger := klog.FromContext(ctx).WithValues("command", cmd.Path)
 	logger.V(4).Info("Starting command", "args", cmd.Args)
+	// Arguments and output are not recorded because they could
+	// contain sensitive data.
+	_, span := tracing.Start(ctx, "exec "+filepath.Base(cmd.Path))
 
 	r, w := io.Pipe()
 	r2, w2 := io.Pipe()
@@ -51,11 +57,19 @@ func Run(ctx context.Context, cmd *exec.Cmd) (string, error) {
 	wg.Wait()
 	logger.V(4).Info("Command terminated", "stdout-len", stdout.Len(), "combined-len", both.Len(), "error", err)
 
+	// Same for the span status, which therefore only gets the
+	// name of the binary and how it failed, like the exit status.
+	var spanErr error
+	if err != nil {
+		spanErr = fmt.Errorf("%s: %v", filepath.Base(cmd.Path), err)
+	}
+	tracing.End(span, spanErr)
+
 	switch {
 	case err != nil && both.Len() > 0:
-		err = fmt.Errorf("%q: command failed: %v\nCombined stderr/stdout output: %s", cmd, err, both.String())
+		err = fmt.Errorf("%q: command failed: %w\nCombined stderr/stdout output: %s", cmd, err, both.String())
 	case err != nil:
-		err = fmt.Errorf("%q: command failed with no output: %v", cmd, err)
+		err = fmt.Errorf("%q: command failed with no output: %w", cmd, err)
 	}
 	return stdout.String(), err
 }
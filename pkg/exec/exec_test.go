@@ -10,6 +10,11 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"k8s.io/klog/v2/ktesting"
 )
 
@@ -121,3 +126,24 @@ func TestResult(t *testing.T) {
 		})
 	}
 }
+
+func TestRunTracing(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	ctx, span := tp.Tracer("test").Start(ctx, "test")
+	defer span.End()
+	ctx = trace.ContextWithSpan(ctx, span)
+
+	_, err := RunCommand(ctx, "sh", "-c", "echo my-secret; exit 3", "my-secret")
+	require.Error(t, err, "command")
+	spans := recorder.Ended()
+	require.Len(t, spans, 1, "spans")
+	assert.Equal(t, "exec sh", spans[0].Name(), "span name")
+	assert.Equal(t, sdktrace.Status{Code: codes.Error, Description: "sh: exit status 3"}, spans[0].Status(), "span status")
+	for _, event := range spans[0].Events() {
+		for _, attr := range event.Attributes {
+			assert.NotContains(t, attr.Value.Emit(), "my-secret", "event %s", event.Name)
+		}
+	}
+}
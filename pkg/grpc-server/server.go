@@ -10,10 +10,17 @@ import (
 	"context"
 	"crypto/tls"
 	"fmt"
+	"net"
+	"os"
+	"path/filepath"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/kubernetes-csi/csi-lib-utils/metrics"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/reflection"
 	"k8s.io/klog/v2"
 
 	pmemgrpc "github.com/intel/pmem-csi/pkg/pmem-grpc"
@@ -25,23 +32,193 @@ type Service interface {
 	RegisterService(s *grpc.Server)
 }
 
+// ReflectionService provides the gRPC reflection API, which lets
+// tools like grpcurl list and call the other services of a server
+// without their proto files.
+type ReflectionService struct{}
+
+func (ReflectionService) RegisterService(s *grpc.Server) {
+	reflection.Register(s)
+}
+
+// socketCheckInterval determines how often Unix domain sockets are
+// checked. Can be changed for testing.
+var socketCheckInterval = 10 * time.Second
+
 // NonBlocking server
 type NonBlockingGRPCServer struct {
-	wg      sync.WaitGroup
-	servers []*grpc.Server
+	wg       sync.WaitGroup
+	servers  []*grpc.Server
+	opts     []grpc.ServerOption
+	stopped  chan struct{}
+	stopOnce sync.Once
+	inFlight int64
+
+	socketPermissions SocketPermissions
+}
+
+// SocketPermissions get applied to Unix domain sockets each time
+// they are created.
+type SocketPermissions struct {
+	// Mode replaces the permissions from the umask, zero keeps them.
+	Mode os.FileMode
+	// UID and GID change the owner, -1 keeps it.
+	UID, GID int
+}
+
+// DefaultSocketPermissions keeps the permissions and owner of the
+// process.
+var DefaultSocketPermissions = SocketPermissions{UID: -1, GID: -1}
+
+// Config contains the limits of all gRPC servers started by a
+// NonBlockingGRPCServer. Zero values keep the gRPC defaults.
+type Config struct {
+	// MaxConcurrentStreams limits the number of calls per
+	// connection which are active at the same time. Additional
+	// calls wait until one of them finishes.
+	MaxConcurrentStreams uint32
+	// MaxRecvMsgSize and MaxSendMsgSize limit the size of
+	// messages in bytes.
+	MaxRecvMsgSize int
+	MaxSendMsgSize int
+	// CallTimeout is the deadline of calls for which the client
+	// did not set one.
+	CallTimeout time.Duration
+	// KeepaliveMinTime is the shortest interval at which clients
+	// may send keepalive pings, clients which ping more often get
+	// disconnected. KeepalivePermitWithoutStream also allows pings
+	// while a connection has no active calls. Zero and false keep
+	// the gRPC defaults (five minutes, not allowed).
+	KeepaliveMinTime             time.Duration
+	KeepalivePermitWithoutStream bool
+	// KeepaliveTime is the time without activity after which the
+	// server pings a client, KeepaliveTimeout how long it then
+	// waits for a response before it closes the connection.
+	// Zero keeps the gRPC defaults (two hours, 20 seconds).
+	KeepaliveTime    time.Duration
+	KeepaliveTimeout time.Duration
+}
+
+// serverOptions converts the configuration into options for
+// grpc.NewServer.
+func (c Config) serverOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if c.MaxConcurrentStreams > 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(c.MaxConcurrentStreams))
+	}
+	if c.MaxRecvMsgSize > 0 {
+		opts = append(opts, grpc.MaxRecvMsgSize(c.MaxRecvMsgSize))
+	}
+	if c.MaxSendMsgSize > 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(c.MaxSendMsgSize))
+	}
+	if c.KeepaliveMinTime > 0 || c.KeepalivePermitWithoutStream {
+		opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+			MinTime:             c.KeepaliveMinTime,
+			PermitWithoutStream: c.KeepalivePermitWithoutStream,
+		}))
+	}
+	if c.KeepaliveTime > 0 || c.KeepaliveTimeout > 0 {
+		opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+			Time:    c.KeepaliveTime,
+			Timeout: c.KeepaliveTimeout,
+		}))
+	}
+	if c.CallTimeout > 0 {
+		// First, so that all other interceptors see the deadline.
+		opts = append(opts, grpc.ChainUnaryInterceptor(callTimeoutInterceptor(c.CallTimeout)))
+	}
+	return opts
+}
+
+// callTimeoutInterceptor cancels calls without deadline after the
+// timeout.
+func callTimeoutInterceptor(timeout time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return handler(ctx, req)
+	}
+}
+
+// NewNonBlockingGRPCServer creates a server which applies the
+// configuration and the options to all gRPC servers that it starts.
+func NewNonBlockingGRPCServer(config Config, opts ...grpc.ServerOption) *NonBlockingGRPCServer {
+	s := &NonBlockingGRPCServer{
+		stopped:           make(chan struct{}),
+		socketPermissions: DefaultSocketPermissions,
+	}
+	// Outermost, so that all calls get counted.
+	s.opts = append([]grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(s.countUnary),
+		grpc.ChainStreamInterceptor(s.countStream),
+	}, config.serverOptions()...)
+	s.opts = append(s.opts, opts...)
+	return s
+}
+
+func (s *NonBlockingGRPCServer) countUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	atomic.AddInt64(&s.inFlight, 1)
+	defer atomic.AddInt64(&s.inFlight, -1)
+	return handler(ctx, req)
+}
+
+func (s *NonBlockingGRPCServer) countStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	atomic.AddInt64(&s.inFlight, 1)
+	defer atomic.AddInt64(&s.inFlight, -1)
+	return handler(srv, ss)
+}
+
+// InFlight returns the number of calls which are currently being
+// processed by all gRPC servers.
+func (s *NonBlockingGRPCServer) InFlight() int {
+	return int(atomic.LoadInt64(&s.inFlight))
+}
+
+// SetSocketPermissions must be called before Start.
+func (s *NonBlockingGRPCServer) SetSocketPermissions(permissions SocketPermissions) {
+	s.socketPermissions = permissions
 }
 
-func NewNonBlockingGRPCServer() *NonBlockingGRPCServer {
-	return &NonBlockingGRPCServer{}
+// Interceptors contain additional interceptors for the server of one
+// endpoint, for example for authorization. They get called in the
+// order in which they are listed, after the interceptors in the
+// options of NewNonBlockingGRPCServer and before the logging of errors.
+type Interceptors struct {
+	Unary  []grpc.UnaryServerInterceptor
+	Stream []grpc.StreamServerInterceptor
 }
 
-func (s *NonBlockingGRPCServer) Start(ctx context.Context, endpoint, errorPrefix string, tlsConfig *tls.Config, csiMetricsManager metrics.CSIMetricsManager, services ...Service) error {
+func (i Interceptors) serverOptions() []grpc.ServerOption {
+	var opts []grpc.ServerOption
+	if len(i.Unary) > 0 {
+		opts = append(opts, grpc.ChainUnaryInterceptor(i.Unary...))
+	}
+	if len(i.Stream) > 0 {
+		opts = append(opts, grpc.ChainStreamInterceptor(i.Stream...))
+	}
+	return opts
+}
+
+// Start serves the services on the endpoint until the server gets
+// stopped.
+func (s *NonBlockingGRPCServer) Start(ctx context.Context, endpoint, errorPrefix string, tlsConfig *tls.Config, csiMetricsManager metrics.CSIMetricsManager, interceptors Interceptors, services ...Service) error {
 	if endpoint == "" {
 		return fmt.Errorf("endpoint cannot be empty")
 	}
-	rpcServer, l, err := pmemgrpc.NewServer(endpoint, errorPrefix, tlsConfig, csiMetricsManager)
+	opts := append(append([]grpc.ServerOption{}, s.opts...), interceptors.serverOptions()...)
+	rpcServer, l, err := pmemgrpc.NewServer(endpoint, errorPrefix, tlsConfig, csiMetricsManager, opts...)
 	if err != nil {
-		return nil
+		return err
+	}
+	if path := pmemgrpc.SocketPath(endpoint); path != "" {
+		if err := s.socketPermissions.apply(path); err != nil {
+			l.Close()
+			return err
+		}
 	}
 	for _, service := range services {
 		service.RegisterService(rpcServer)
@@ -49,6 +226,16 @@ func (s *NonBlockingGRPCServer) Start(ctx context.Context, endpoint, errorPrefix
 	s.servers = append(s.servers, rpcServer)
 
 	logger := klog.FromContext(ctx).WithName("GRPC-server").WithValues("endpoint", endpoint)
+	s.serve(logger, rpcServer, l)
+	if path := pmemgrpc.SocketPath(endpoint); path != "" {
+		s.wg.Add(1)
+		go s.watchSocket(ctx, logger, rpcServer, endpoint, path)
+	}
+
+	return nil
+}
+
+func (s *NonBlockingGRPCServer) serve(logger klog.Logger, rpcServer *grpc.Server, l net.Listener) {
 	s.wg.Add(1)
 	go func() {
 		defer s.wg.Done()
@@ -58,7 +245,58 @@ func (s *NonBlockingGRPCServer) Start(ctx context.Context, endpoint, errorPrefix
 		}
 		logger.V(3).Info("Stopped")
 	}()
+}
+
+// watchSocket creates the Unix domain socket again when it gets
+// removed while the server runs. This happens when the kubelet
+// plugin directory gets wiped during node maintenance. The
+// node-driver-registrar then registers the driver again, but
+// kubelet cannot connect to it unless the socket exists.
+func (s *NonBlockingGRPCServer) watchSocket(ctx context.Context, logger klog.Logger, rpcServer *grpc.Server, endpoint, path string) {
+	defer s.wg.Done()
+	ticker := time.NewTicker(socketCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.stopped:
+			return
+		case <-ticker.C:
+		}
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			continue
+		}
+		logger.Info("Socket was removed, creating it again", "path", path)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			logger.Error(err, "Creating socket directory failed")
+			continue
+		}
+		l, err := pmemgrpc.Listen(endpoint)
+		if err != nil {
+			logger.Error(err, "Listening again failed")
+			continue
+		}
+		if err := s.socketPermissions.apply(path); err != nil {
+			logger.Error(err, "Changing socket permissions failed")
+			l.Close()
+			continue
+		}
+		s.serve(logger, rpcServer, l)
+	}
+}
 
+func (p SocketPermissions) apply(path string) error {
+	if p.Mode != 0 {
+		if err := os.Chmod(path, p.Mode); err != nil {
+			return fmt.Errorf("change permissions of socket: %v", err)
+		}
+	}
+	if p.UID != -1 || p.GID != -1 {
+		if err := os.Lchown(path, p.UID, p.GID); err != nil {
+			return fmt.Errorf("change owner of socket: %v", err)
+		}
+	}
 	return nil
 }
 
@@ -67,12 +305,33 @@ func (s *NonBlockingGRPCServer) Wait() {
 }
 
 func (s *NonBlockingGRPCServer) Stop() {
+	s.stopOnce.Do(func() { close(s.stopped) })
 	for _, s := range s.servers {
 		s.GracefulStop()
 	}
 }
 
+// Shutdown stops the servers like Stop. When the context gets
+// canceled before all pending calls are done, it cancels the
+// remaining ones like ForceStop and returns the context error.
+func (s *NonBlockingGRPCServer) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.Stop()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.ForceStop()
+		<-done
+		return ctx.Err()
+	}
+}
+
 func (s *NonBlockingGRPCServer) ForceStop() {
+	s.stopOnce.Do(func() { close(s.stopped) })
 	for _, s := range s.servers {
 		s.Stop()
 	}
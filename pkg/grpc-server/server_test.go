@@ -0,0 +1,378 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
+	pmemgrpc "github.com/intel/pmem-csi/pkg/pmem-grpc"
+)
+
+type healthService struct{}
+
+func (healthService) RegisterService(s *grpc.Server) {
+	grpc_health_v1.RegisterHealthServer(s, health.NewServer())
+}
+
+func TestSocketRecreation(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	oldInterval := socketCheckInterval
+	socketCheckInterval = 10 * time.Millisecond
+	defer func() {
+		socketCheckInterval = oldInterval
+	}()
+
+	dir := filepath.Join(t.TempDir(), "plugins")
+	require.NoError(t, os.Mkdir(dir, 0755), "create socket directory")
+	path := filepath.Join(dir, "csi.sock")
+	endpoint := "unix://" + path
+
+	s := NewNonBlockingGRPCServer(Config{})
+	require.NoError(t, s.Start(ctx, endpoint, "", nil, nil, Interceptors{}, healthService{}), "start server")
+	defer func() {
+		s.ForceStop()
+		s.Wait()
+	}()
+
+	check := func(what string) {
+		conn, err := pmemgrpc.Connect(endpoint, nil)
+		require.NoError(t, err, "%s: connect", what)
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+		_, err = grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true))
+		require.NoError(t, err, "%s: health check", what)
+	}
+	check("initial socket")
+
+	// Like wiping the kubelet plugin directory.
+	require.NoError(t, os.RemoveAll(dir), "remove socket directory")
+	require.Eventually(t, func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond, "socket created again")
+	check("new socket")
+}
+
+func TestSocketPermissions(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	path := filepath.Join(t.TempDir(), "csi.sock")
+	endpoint := "unix://" + path
+
+	s := NewNonBlockingGRPCServer(Config{})
+	s.SetSocketPermissions(SocketPermissions{Mode: 0660, UID: -1, GID: os.Getgid()})
+	require.NoError(t, s.Start(ctx, endpoint, "", nil, nil, Interceptors{}, healthService{}), "start server")
+	defer func() {
+		s.ForceStop()
+		s.Wait()
+	}()
+
+	info, err := os.Stat(path)
+	require.NoError(t, err, "stat socket")
+	require.Equal(t, os.FileMode(0660), info.Mode().Perm(), "socket mode")
+	require.Equal(t, uint32(os.Getgid()), info.Sys().(*syscall.Stat_t).Gid, "socket group")
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	endpoint := "unix://" + filepath.Join(t.TempDir(), "csi.sock")
+
+	s := NewNonBlockingGRPCServer(Config{MaxRecvMsgSize: 1024})
+	require.NoError(t, s.Start(ctx, endpoint, "", nil, nil, Interceptors{}, healthService{}), "start server")
+	defer func() {
+		s.ForceStop()
+		s.Wait()
+	}()
+
+	conn, err := pmemgrpc.Connect(endpoint, nil)
+	require.NoError(t, err, "connect")
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	client := grpc_health_v1.NewHealthClient(conn)
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true))
+	require.NoError(t, err, "small request")
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: strings.Repeat("x", 2048)})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "large request: %v", err)
+}
+
+func TestCallTimeout(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	interceptor := callTimeoutInterceptor(time.Minute)
+	deadline := func(ctx context.Context) time.Time {
+		var result time.Time
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			result, _ = ctx.Deadline()
+			return nil, nil
+		})
+		require.NoError(t, err, "call")
+		return result
+	}
+
+	assert.WithinDuration(t, time.Now().Add(time.Minute), deadline(ctx), time.Second, "default deadline")
+	ctx, cancel := context.WithTimeout(ctx, time.Hour)
+	defer cancel()
+	assert.WithinDuration(t, time.Now().Add(time.Hour), deadline(ctx), time.Second, "deadline of the client")
+}
+
+func TestKeepalive(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	path := filepath.Join(t.TempDir(), "csi.sock")
+
+	s := NewNonBlockingGRPCServer(Config{KeepaliveTime: time.Second, KeepaliveTimeout: 100 * time.Millisecond})
+	require.NoError(t, s.Start(ctx, "unix://"+path, "", nil, nil, Interceptors{}, healthService{}), "start server")
+	defer func() {
+		s.ForceStop()
+		s.Wait()
+	}()
+
+	// Like a client which hangs: it sets up the HTTP/2 connection,
+	// then never answers pings.
+	conn, err := net.Dial("unix", path)
+	require.NoError(t, err, "connect")
+	defer conn.Close()
+	_, err = conn.Write([]byte("PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"))
+	require.NoError(t, err, "send preface")
+	_, err = conn.Write([]byte{0, 0, 0, 4, 0, 0, 0, 0, 0})
+	require.NoError(t, err, "send settings")
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(10*time.Second)), "set deadline")
+	_, err = io.Copy(io.Discard, conn)
+	require.NoError(t, err, "connection closed by server")
+}
+
+func TestInterceptors(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	endpoint := "unix://" + filepath.Join(t.TempDir(), "csi.sock")
+
+	var calls []string
+	interceptors := Interceptors{
+		Unary: []grpc.UnaryServerInterceptor{
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				calls = append(calls, "first")
+				return handler(ctx, req)
+			},
+			func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+				calls = append(calls, "second")
+				return nil, status.Error(codes.PermissionDenied, "not allowed")
+			},
+		},
+		Stream: []grpc.StreamServerInterceptor{
+			func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+				calls = append(calls, "stream")
+				return status.Error(codes.PermissionDenied, "not allowed")
+			},
+		},
+	}
+	s := NewNonBlockingGRPCServer(Config{})
+	require.NoError(t, s.Start(ctx, endpoint, "", nil, nil, interceptors, healthService{}), "start server")
+	defer func() {
+		s.ForceStop()
+		s.Wait()
+	}()
+
+	conn, err := pmemgrpc.Connect(endpoint, nil)
+	require.NoError(t, err, "connect")
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	client := grpc_health_v1.NewHealthClient(conn)
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true))
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "unary call: %v", err)
+	watch, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{})
+	require.NoError(t, err, "start stream")
+	_, err = watch.Recv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "stream call: %v", err)
+	assert.Equal(t, []string{"first", "second", "stream"}, calls, "interceptor calls")
+}
+
+func TestCorrelationID(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	endpoint := "unix://" + filepath.Join(t.TempDir(), "csi.sock")
+
+	s := NewNonBlockingGRPCServer(Config{})
+	require.NoError(t, s.Start(ctx, endpoint, "", nil, nil, Interceptors{}, healthService{}), "start server")
+	defer func() {
+		s.ForceStop()
+		s.Wait()
+	}()
+
+	conn, err := pmemgrpc.Connect(endpoint, nil)
+	require.NoError(t, err, "connect")
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	check := func(ctx context.Context) string {
+		var header metadata.MD
+		_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true), grpc.Header(&header))
+		require.NoError(t, err, "health check")
+		ids := header.Get(pmemgrpc.CorrelationIDKey)
+		require.Len(t, ids, 1, "correlation ID in %v", header)
+		return ids[0]
+	}
+
+	first, second := check(ctx), check(ctx)
+	assert.NotEmpty(t, first, "generated ID")
+	assert.NotEqual(t, first, second, "unique IDs")
+	assert.Equal(t, "my-call", check(metadata.AppendToOutgoingContext(ctx, pmemgrpc.CorrelationIDKey, "my-call")), "ID from client")
+	assert.NotEqual(t, "bad id", check(metadata.AppendToOutgoingContext(ctx, pmemgrpc.CorrelationIDKey, "bad id")), "invalid ID from client")
+}
+
+func TestShutdown(t *testing.T) {
+	for name, timeout := range map[string]bool{"done": false, "timeout": true} {
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			endpoint := "unix://" + filepath.Join(t.TempDir(), "csi.sock")
+
+			// Blocks calls until released or canceled.
+			release := make(chan struct{})
+			interceptors := Interceptors{
+				Unary: []grpc.UnaryServerInterceptor{
+					func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+						select {
+						case <-release:
+						case <-ctx.Done():
+						}
+						return handler(ctx, req)
+					},
+				},
+			}
+			s := NewNonBlockingGRPCServer(Config{})
+			require.NoError(t, s.Start(ctx, endpoint, "", nil, nil, interceptors, healthService{}), "start server")
+			defer func() {
+				s.ForceStop()
+				s.Wait()
+			}()
+
+			conn, err := pmemgrpc.Connect(endpoint, nil)
+			require.NoError(t, err, "connect")
+			defer conn.Close()
+			callErr := make(chan error, 1)
+			go func() {
+				ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+				defer cancel()
+				_, err := grpc_health_v1.NewHealthClient(conn).Check(ctx, &grpc_health_v1.HealthCheckRequest{}, grpc.WaitForReady(true))
+				callErr <- err
+			}()
+			require.Eventually(t, func() bool { return s.InFlight() == 1 }, 5*time.Second, time.Millisecond, "call in flight")
+
+			shutdownCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+			defer cancel()
+			if !timeout {
+				close(release)
+			}
+			err = s.Shutdown(shutdownCtx)
+			if timeout {
+				assert.Equal(t, context.DeadlineExceeded, err, "shutdown")
+				assert.Error(t, <-callErr, "canceled call")
+			} else {
+				assert.NoError(t, err, "shutdown")
+				assert.NoError(t, <-callErr, "completed call")
+			}
+			// Canceled handlers may still be returning.
+			assert.Eventually(t, func() bool { return s.InFlight() == 0 }, 5*time.Second, time.Millisecond, "no calls in flight after shutdown")
+		})
+	}
+}
+
+func TestReflection(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	endpoint := "unix://" + filepath.Join(t.TempDir(), "csi.sock")
+
+	s := NewNonBlockingGRPCServer(Config{})
+	require.NoError(t, s.Start(ctx, endpoint, "", nil, nil, Interceptors{}, healthService{}, ReflectionService{}), "start server")
+	defer func() {
+		s.ForceStop()
+		s.Wait()
+	}()
+
+	conn, err := pmemgrpc.Connect(endpoint, nil)
+	require.NoError(t, err, "connect")
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	stream, err := grpc_reflection_v1.NewServerReflectionClient(conn).ServerReflectionInfo(ctx, grpc.WaitForReady(true))
+	require.NoError(t, err, "start reflection")
+	require.NoError(t, stream.Send(&grpc_reflection_v1.ServerReflectionRequest{
+		MessageRequest: &grpc_reflection_v1.ServerReflectionRequest_ListServices{},
+	}), "list services")
+	resp, err := stream.Recv()
+	require.NoError(t, err, "receive services")
+	var names []string
+	for _, service := range resp.GetListServicesResponse().GetService() {
+		names = append(names, service.GetName())
+	}
+	assert.Contains(t, names, "grpc.health.v1.Health", "services")
+}
+
+type panickingHealth struct {
+	grpc_health_v1.UnimplementedHealthServer
+}
+
+func (panickingHealth) RegisterService(s *grpc.Server) {
+	grpc_health_v1.RegisterHealthServer(s, panickingHealth{})
+}
+
+func (panickingHealth) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if req.GetService() == "panic" {
+		var resp *grpc_health_v1.HealthCheckResponse
+		// Nil pointer dereference.
+		resp.Status = grpc_health_v1.HealthCheckResponse_SERVING
+	}
+	return &grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING}, nil
+}
+
+func TestRecovery(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	endpoint := "unix://" + filepath.Join(t.TempDir(), "csi.sock")
+	reg := prometheus.NewPedanticRegistry()
+	pmemcommon.MustRegisterGRPCMetrics(reg)
+
+	s := NewNonBlockingGRPCServer(Config{})
+	require.NoError(t, s.Start(ctx, endpoint, "", nil, nil, Interceptors{}, panickingHealth{}), "start server")
+	defer func() {
+		s.ForceStop()
+		s.Wait()
+	}()
+
+	conn, err := pmemgrpc.Connect(endpoint, nil)
+	require.NoError(t, err, "connect")
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	client := grpc_health_v1.NewHealthClient(conn)
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "panic"}, grpc.WaitForReady(true))
+	assert.Equal(t, codes.Internal, status.Code(err), "panicking call: %v", err)
+	_, err = client.Check(ctx, &grpc_health_v1.HealthCheckRequest{})
+	assert.NoError(t, err, "server still running")
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP pmem_csi_panics_total Number of gRPC calls which panicked and failed with INTERNAL instead, by method.
+# TYPE pmem_csi_panics_total counter
+pmem_csi_panics_total{method="Check"} 1
+`)), "metrics")
+}
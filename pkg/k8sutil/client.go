@@ -23,9 +23,9 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
-// NewClient connects to an API server either through KUBECONFIG (if set) or
+// NewConfig returns the REST config for an API server either through KUBECONFIG (if set) or
 // through the in-cluster env variables.
-func NewClient(qps float64, burst int) (kubernetes.Interface, error) {
+func NewConfig(qps float64, burst int) (*rest.Config, error) {
 	var config *rest.Config
 	var err error
 
@@ -39,6 +39,16 @@ func NewClient(qps float64, burst int) (kubernetes.Interface, error) {
 	}
 	config.QPS = float32(qps)
 	config.Burst = burst
+	return config, nil
+}
+
+// NewClient connects to an API server either through KUBECONFIG (if set) or
+// through the in-cluster env variables.
+func NewClient(qps float64, burst int) (kubernetes.Interface, error) {
+	config, err := NewConfig(qps, burst)
+	if err != nil {
+		return nil, err
+	}
 	client, err := kubernetes.NewForConfig(config)
 	if err != nil {
 		return nil, fmt.Errorf("create Kubernetes client: %v", err)
@@ -0,0 +1,29 @@
+package ndctl
+
+// chooseAlignment picks the alignment for a new fsdax or devdax
+// namespace. Which alignments the kernel supports depends on the
+// architecture (page and huge page sizes), so the preferred one is
+// not always available. Then the largest smaller one is used, or if
+// there is none, the smallest one. Without information from the
+// kernel, the preferred one is tried.
+func chooseAlignment(preferred uint64, supported []uint64) uint64 {
+	if len(supported) == 0 {
+		return preferred
+	}
+	var smaller, smallest uint64
+	for _, align := range supported {
+		if align == preferred {
+			return preferred
+		}
+		if align < preferred && align > smaller {
+			smaller = align
+		}
+		if smallest == 0 || align < smallest {
+			smallest = align
+		}
+	}
+	if smaller != 0 {
+		return smaller
+	}
+	return smallest
+}
@@ -16,6 +16,7 @@ type Namespace struct {
 	Name_            string
 	DeviceName_      string
 	BlockDeviceName_ string
+	CharDeviceName_  string
 	Size_            uint64
 	Overhead_        uint64
 	Mode_            ndctl.NamespaceMode
@@ -46,6 +47,10 @@ func (ns *Namespace) BlockDeviceName() string {
 	return ns.BlockDeviceName_
 }
 
+func (ns *Namespace) CharDeviceName() string {
+	return ns.CharDeviceName_
+}
+
 func (ns *Namespace) Size() uint64 {
 	return ns.Size_
 }
@@ -83,6 +88,7 @@ func (ns *Namespace) Region() ndctl.Region {
 }
 
 func (ns *Namespace) SetAltName(name string) error {
+	ns.Name_ = name
 	return nil
 }
 
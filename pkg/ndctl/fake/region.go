@@ -21,12 +21,14 @@ type Region struct {
 	Size_               uint64
 	AvailableSize_      uint64
 	MaxAvailableExtent_ uint64
+	FreeExtents_        []uint64
 	Type_               ndctl.RegionType
 	TypeName_           string
 	Enabled_            bool
 	Readonly_           bool
 	InterleaveWays_     uint64
 	RegionAlign_        uint64
+	NumaNode_           int
 
 	Mappings_   []ndctl.Mapping
 	Namespaces_ []ndctl.Namespace
@@ -55,6 +57,10 @@ func (r *Region) MaxAvailableExtent() uint64 {
 	return r.MaxAvailableExtent_
 }
 
+func (r *Region) FreeExtents() []uint64 {
+	return r.FreeExtents_
+}
+
 func (r *Region) Type() ndctl.RegionType {
 	return r.Type_
 }
@@ -111,6 +117,10 @@ func (r *Region) GetAlign() uint64 {
 	return r.RegionAlign_
 }
 
+func (r *Region) NumaNode() int {
+	return r.NumaNode_
+}
+
 func (r *Region) CreateNamespace(ctx context.Context, opts ndctl.CreateNamespaceOpts) (ndctl.Namespace, error) {
 	var err error
 	/* Set defaults */
@@ -164,7 +174,7 @@ func (r *Region) CreateNamespace(ctx context.Context, opts ndctl.CreateNamespace
 
 	/* setup_namespace */
 
-	ns := &Namespace{}
+	ns := &Namespace{Region_: r}
 
 	if ns.Type() != ndctl.IoNamespace {
 		uid, _ := uuid.NewUUID()
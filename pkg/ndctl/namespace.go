@@ -9,6 +9,7 @@ package ndctl
 import "C"
 import (
 	"fmt"
+	"path/filepath"
 
 	/* needed for nullify
 	"os"
@@ -85,6 +86,9 @@ type Namespace interface {
 	DeviceName() string
 	// BlockDeviceName returns the block device name of the namespace.
 	BlockDeviceName() string
+	// CharDeviceName returns the name of the character device of
+	// a namespace in devdax mode.
+	CharDeviceName() string
 	// Size returns the size of the device provided by the namespace.
 	Size() uint64
 	// RawSize returns the amount of PMEM used by the namespace
@@ -161,6 +165,21 @@ func (ns *namespace) BlockDeviceName() string {
 	return C.GoString(dev)
 }
 
+func (ns *namespace) CharDeviceName() string {
+	dax := C.ndctl_namespace_get_dax(ns)
+	if dax == nil {
+		return ""
+	}
+	// The device-dax instance is a child of the dax device in
+	// sysfs, with a name like dax0.0 which is not necessarily the
+	// same as the one of the parent.
+	matches, err := filepath.Glob(filepath.Join("/sys/bus/nd/devices", C.GoString(C.ndctl_dax_get_devname(dax)), "dax*.*"))
+	if err != nil || len(matches) == 0 {
+		return ""
+	}
+	return filepath.Base(matches[0])
+}
+
 func (ns *namespace) Size() uint64 {
 	var size C.ulonglong
 
@@ -415,6 +434,7 @@ func (ns *namespace) SetPfnSeed(loc MapLocation, align uint64) error {
 		return fmt.Errorf("pfn: failed to set location")
 	}
 	if align != 0 && C.ndctl_pfn_has_align(pfn) == 1 {
+		align = chooseAlignment(align, pfnAlignments(pfn))
 		if rc = C.ndctl_pfn_set_align(pfn, C.ulong(align)); rc < 0 {
 			return fmt.Errorf("pfn: failed to set alignment: %s", cErrorString(rc))
 		}
@@ -448,8 +468,10 @@ func (ns *namespace) setDaxSeed(loc MapLocation, align uint64) error {
 	if rc = C.ndctl_dax_set_location(dax, loc.toCPfnLocation()); rc < 0 {
 		return fmt.Errorf("dax: failed to set dax location")
 	}
-	/* device-dax assumes 'align' attribute present */
-	if align != 0 {
+	// Old kernels have no 'align' attribute for device-dax and
+	// then use their default alignment.
+	if align != 0 && C.ndctl_dax_has_align(dax) == 1 {
+		align = chooseAlignment(align, daxAlignments(dax))
 		if rc = C.ndctl_dax_set_align(dax, C.ulong(align)); rc < 0 {
 			return fmt.Errorf("dax: failed to set dax alignment")
 		}
@@ -467,6 +489,26 @@ func (ns *namespace) setDaxSeed(loc MapLocation, align uint64) error {
 	return nil
 }
 
+// pfnAlignments returns the alignments supported by the kernel for
+// fsdax namespaces, nil if unknown.
+func pfnAlignments(pfn *C.struct_ndctl_pfn) []uint64 {
+	var alignments []uint64
+	for i := 0; i < int(C.ndctl_pfn_get_num_alignments(pfn)); i++ {
+		alignments = append(alignments, uint64(C.ndctl_pfn_get_supported_alignment(pfn, C.int(i))))
+	}
+	return alignments
+}
+
+// daxAlignments returns the alignments supported by the kernel for
+// devdax namespaces, nil if unknown.
+func daxAlignments(dax *C.struct_ndctl_dax) []uint64 {
+	var alignments []uint64
+	for i := 0; i < int(C.ndctl_dax_get_num_alignments(dax)); i++ {
+		alignments = append(alignments, uint64(C.ndctl_dax_get_supported_alignment(dax, C.int(i))))
+	}
+	return alignments
+}
+
 func (ns *namespace) setBttSeed(sectorSize uint64) error {
 	r := (ns.Region()).(*region)
 	btt := C.ndctl_region_get_btt_seed(r)
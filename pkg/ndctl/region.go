@@ -9,6 +9,7 @@ import "C"
 import (
 	gocontext "context"
 	"fmt"
+	"sort"
 
 	"github.com/google/uuid"
 	"k8s.io/klog/v2"
@@ -38,6 +39,10 @@ type Region interface {
 	AvailableSize() uint64
 	// MaxAvailableExtent returns max available extent size in the region.
 	MaxAvailableExtent() uint64
+	// FreeExtents returns the sizes of the contiguous ranges in
+	// the region which are not used by any namespace, in address
+	// order. CreateNamespace can use only one of them.
+	FreeExtents() []uint64
 	// Type identifies the kind of region.
 	Type() RegionType
 	// TypeName returns the name for the region type.
@@ -69,6 +74,9 @@ type Region interface {
 	FsdaxAlignment() uint64
 	// GetAlign returns region alignment. 0 if unknown.
 	GetAlign() uint64
+	// NumaNode returns the NUMA node of the CPUs which are closest
+	// to the region, -1 if unknown.
+	NumaNode() int
 }
 
 type region = C.struct_ndctl_region
@@ -95,6 +103,33 @@ func (r *region) MaxAvailableExtent() uint64 {
 	return uint64(C.ndctl_region_get_max_available_extent(r))
 }
 
+func (r *region) FreeExtents() []uint64 {
+	type used struct{ start, end uint64 }
+	var ranges []used
+	for ndns := C.ndctl_namespace_get_first(r); ndns != nil; ndns = C.ndctl_namespace_get_next(ndns) {
+		size := uint64(C.ndctl_namespace_get_size(ndns))
+		resource := C.ndctl_namespace_get_resource(ndns)
+		if size == 0 || resource == C.ULLONG_MAX {
+			continue
+		}
+		ranges = append(ranges, used{uint64(resource), uint64(resource) + size})
+	}
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+
+	var extents []uint64
+	start := uint64(C.ndctl_region_get_resource(r))
+	end := start + r.Size()
+	for _, u := range append(ranges, used{end, end}) {
+		if u.start > start {
+			extents = append(extents, u.start-start)
+		}
+		if u.end > start {
+			start = u.end
+		}
+	}
+	return extents
+}
+
 func (r *region) Type() RegionType {
 	switch C.ndctl_region_get_type(r) {
 	case C.ND_DEVICE_REGION_PMEM:
@@ -155,6 +190,10 @@ func (r *region) GetAlign() uint64 {
 	return uint64(align)
 }
 
+func (r *region) NumaNode() int {
+	return int(C.ndctl_region_get_numa_node(r))
+}
+
 func (r *region) CreateNamespace(ctx gocontext.Context, opts CreateNamespaceOpts) (Namespace, error) {
 	regionName := r.DeviceName()
 	logger := klog.FromContext(ctx).WithName("CreateNamespace").WithValues("region", regionName)
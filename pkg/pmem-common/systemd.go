@@ -0,0 +1,78 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcommon
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/coreos/go-systemd/v22/activation"
+	"github.com/coreos/go-systemd/v22/daemon"
+)
+
+// SystemdPrefix selects a socket that was passed in by systemd
+// socket activation when used in an endpoint or listen address. It
+// must be followed by the FileDescriptorName of the socket unit, for
+// example "systemd://csi".
+const SystemdPrefix = "systemd://"
+
+var (
+	systemdOnce      sync.Once
+	systemdListeners map[string][]net.Listener
+	systemdErr       error
+)
+
+// IsSystemdAddress checks whether the address refers to a socket
+// from systemd.
+func IsSystemdAddress(addr string) bool {
+	return strings.HasPrefix(addr, SystemdPrefix)
+}
+
+// SystemdListener returns the listener for a socket passed in by
+// systemd. The address must have the SystemdPrefix. Each socket can
+// only be retrieved once.
+func SystemdListener(addr string) (net.Listener, error) {
+	name := strings.TrimPrefix(addr, SystemdPrefix)
+	if name == "" {
+		return nil, fmt.Errorf("%q: missing socket name", addr)
+	}
+	// The environment variables get unset on the first call,
+	// therefore all listeners must be retrieved at once.
+	systemdOnce.Do(func() {
+		systemdListeners, systemdErr = activation.ListenersWithNames()
+	})
+	if systemdErr != nil {
+		return nil, fmt.Errorf("socket activation: %v", systemdErr)
+	}
+	listeners := systemdListeners[name]
+	switch len(listeners) {
+	case 0:
+		return nil, fmt.Errorf("%q: no such socket passed in by systemd", addr)
+	case 1:
+		delete(systemdListeners, name)
+		return listeners[0], nil
+	default:
+		return nil, fmt.Errorf("%q: expected one socket, got %d", addr, len(listeners))
+	}
+}
+
+// SystemdNotifyReady tells systemd that start up is complete. It
+// does nothing when not running as a systemd service with
+// Type=notify.
+func SystemdNotifyReady() error {
+	_, err := daemon.SdNotify(false, daemon.SdNotifyReady)
+	return err
+}
+
+// SystemdNotifyStopping tells systemd that the service is shutting
+// down.
+func SystemdNotifyStopping() error {
+	_, err := daemon.SdNotify(false, daemon.SdNotifyStopping)
+	return err
+}
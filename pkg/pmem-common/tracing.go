@@ -8,10 +8,22 @@ SPDX-License-Identifier: Apache-2.0
 package pmemcommon
 
 import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"runtime/debug"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
+	"github.com/prometheus/client_golang/prometheus"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
 )
 
 // LogGRPCServer logs the server-side call information via klog.
@@ -19,7 +31,7 @@ func LogGRPCServer(ctx context.Context, req interface{}, info *grpc.UnaryServerI
 	logger := klog.FromContext(ctx)
 	values := []interface{}{"full-method", info.FullMethod}
 	if logger.V(5).Enabled() {
-		values = append(values, "request", protosanitizer.StripSecrets(req))
+		values = append(values, "request", protosanitizer.StripSecrets(stripTokens(req)))
 	}
 	logger.V(3).Info("Processing gRPC call", values...)
 	resp, err := handler(ctx, req)
@@ -31,6 +43,135 @@ func LogGRPCServer(ctx context.Context, req interface{}, info *grpc.UnaryServerI
 	return resp, err
 }
 
+var grpcPanics = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "pmem_csi_panics_total",
+		Help: "Number of gRPC calls which panicked and failed with INTERNAL instead, by method.",
+	},
+	[]string{"method"},
+)
+
+// MustRegisterGRPCMetrics adds the metrics of the recovery
+// interceptors to the registry. The caller adds labels like the node
+// name by wrapping the registry.
+func MustRegisterGRPCMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(grpcPanics)
+}
+
+// RecoverGRPCServer turns a panic of the handler into an INTERNAL
+// error, so that one broken call does not kill the whole driver. The
+// panic gets logged with the stack and the request without secrets.
+func RecoverGRPCServer(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (resp interface{}, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recovered(ctx, info.FullMethod, r, "request", protosanitizer.StripSecrets(stripTokens(req)))
+			resp = nil
+		}
+	}()
+	return handler(ctx, req)
+}
+
+// RecoverGRPCServerStream does the same as RecoverGRPCServer for
+// streaming calls.
+func RecoverGRPCServerStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = recovered(ss.Context(), info.FullMethod, r)
+		}
+	}()
+	return handler(srv, ss)
+}
+
+func recovered(ctx context.Context, fullMethod string, r interface{}, values ...interface{}) error {
+	method := fullMethod[strings.LastIndex(fullMethod, "/")+1:]
+	grpcPanics.WithLabelValues(method).Inc()
+	values = append([]interface{}{"full-method", fullMethod, "panic", fmt.Sprint(r), "stack", string(debug.Stack())}, values...)
+	klog.FromContext(ctx).Error(nil, "Recovered from panic in gRPC call", values...)
+	return status.Errorf(codes.Internal, "%s: internal error: %v", method, r)
+}
+
+// LogGRPCPayloads logs request and response of each call as indented
+// JSON, without secrets and key material. Meant for debugging, errors
+// are left to LogGRPCServer.
+func LogGRPCPayloads(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	logger := klog.FromContext(ctx)
+	logger.Info("gRPC request", "full-method", info.FullMethod, "request", PrettyPayload(req))
+	resp, err := handler(ctx, req)
+	if err == nil {
+		logger.Info("gRPC response", "full-method", info.FullMethod, "response", PrettyPayload(resp))
+	}
+	return resp, err
+}
+
+const redacted = "***stripped***"
+
+// freeFormMaps are the string maps in CSI messages which may contain
+// anything, for example parameters of a storage class.
+var freeFormMaps = map[string]bool{
+	"parameters":         true,
+	"mutable_parameters": true,
+	"volume_context":     true,
+	"publish_context":    true,
+}
+
+// sensitiveKey matches keys in free-form maps which probably have key
+// material as value.
+var sensitiveKey = regexp.MustCompile(`(?i)(secret|token|password|passphrase|credential|key$)`)
+
+// PrettyPayload formats a gRPC message as indented JSON. Secrets,
+// service account tokens and entries of free-form maps which look like
+// key material are replaced.
+func PrettyPayload(msg interface{}) string {
+	var parsed interface{}
+	if err := json.Unmarshal([]byte(protosanitizer.StripSecrets(stripTokens(msg)).String()), &parsed); err != nil {
+		return fmt.Sprintf("<<%T: %v>>", msg, err)
+	}
+	redactKeyMaterial(parsed)
+	b, err := json.MarshalIndent(parsed, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("<<%T: %v>>", msg, err)
+	}
+	return string(b)
+}
+
+func redactKeyMaterial(value interface{}) {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for key, entry := range value {
+			if entries, ok := entry.(map[string]interface{}); ok && freeFormMaps[key] {
+				for key := range entries {
+					if sensitiveKey.MatchString(key) {
+						entries[key] = redacted
+					}
+				}
+				continue
+			}
+			redactKeyMaterial(entry)
+		}
+	case []interface{}:
+		for _, entry := range value {
+			redactKeyMaterial(entry)
+		}
+	}
+}
+
+// stripTokens removes the service account tokens from a
+// NodePublishVolume request. protosanitizer only knows about the
+// secrets fields.
+func stripTokens(req interface{}) interface{} {
+	r, ok := req.(*csi.NodePublishVolumeRequest)
+	if !ok {
+		return req
+	}
+	if _, ok := r.GetVolumeContext()[parameters.ServiceAccountTokens]; !ok {
+		return req
+	}
+	// A shallow copy is enough because only the map gets replaced.
+	stripped := *r
+	stripped.VolumeContext = parameters.WithoutTokens(r.GetVolumeContext())
+	return &stripped
+}
+
 // LogGRPCClient does the same as LogGRPCServer, only on the client side.
 func LogGRPCClient(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
 	logger := klog.FromContext(ctx)
@@ -0,0 +1,45 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcommon
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestPrettyPayload(t *testing.T) {
+	req := &csi.NodePublishVolumeRequest{
+		VolumeId:   "vol-1",
+		TargetPath: "/target",
+		Secrets:    map[string]string{"passphrase": "secret-1"},
+		VolumeContext: map[string]string{
+			parameters.ServiceAccountTokens: `{"pmem-csi.intel.com":{"token":"secret-2"}}`,
+			"encryptionKey":                 "secret-3",
+			"kmsPassword":                   "secret-4",
+			"size":                          "1Gi",
+		},
+	}
+	payload := PrettyPayload(req)
+	for _, secret := range []string{"secret-1", "secret-2", "secret-3", "secret-4"} {
+		assert.NotContains(t, payload, secret, "redacted")
+	}
+	assert.Contains(t, payload, `
+  "volume_context": {
+    "csi.storage.k8s.io/serviceAccount.tokens": "***stripped***",
+    "encryptionKey": "***stripped***",
+    "kmsPassword": "***stripped***",
+    "size": "1Gi"
+  },`, "indented")
+	assert.Contains(t, payload, `"volume_id": "vol-1"`, "other fields")
+
+	// Only free-form maps get redacted.
+	assert.Contains(t, PrettyPayload(&csi.ListVolumesRequest{StartingToken: "10"}), `"starting_token": "10"`, "token field")
+}
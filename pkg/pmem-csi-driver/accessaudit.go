@@ -0,0 +1,263 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+const (
+	// accessAuditInterval is the time during which repeated opens
+	// of the same file by the same process are only recorded once.
+	accessAuditInterval = time.Minute
+
+	// accessAuditMaxSeen limits the memory used for detecting
+	// repeated opens.
+	accessAuditMaxSeen = 10000
+)
+
+// procRoot can be changed for testing.
+var procRoot = "/proc"
+
+// accessRecord is written to the audit log for each file that was
+// opened on an audited volume.
+type accessRecord struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	VolumeID string    `json:"volumeID"`
+	Path     string    `json:"path,omitempty"`
+	// PID is zero when the process is not visible to the driver,
+	// i.e. when the driver does not run in the host PID namespace.
+	PID     int32  `json:"pid,omitempty"`
+	Command string `json:"command,omitempty"`
+	PodUID  string `json:"podUID,omitempty"`
+}
+
+// accessAuditor records opens of files on audited volumes. It uses
+// one fanotify filesystem mark per volume, placed at the staging
+// mount point. Such a mark covers all bind mounts of the filesystem
+// and thus all pods using the volume.
+type accessAuditor struct {
+	sink    *auditLog
+	mutex   sync.Mutex
+	watches map[string]*accessWatch
+}
+
+type accessWatch struct {
+	file *os.File
+	done chan struct{}
+}
+
+func newAccessAuditor(sink *auditLog) *accessAuditor {
+	return &accessAuditor{
+		sink:    sink,
+		watches: map[string]*accessWatch{},
+	}
+}
+
+// watch starts auditing the filesystem mounted at the path. It does
+// nothing when the volume is already audited.
+func (a *accessAuditor) watch(ctx context.Context, volumeID, mountPoint string) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.watches[volumeID] != nil {
+		return nil
+	}
+
+	// FAN_NONBLOCK is needed to interrupt a pending Read by closing the file.
+	fd, err := unix.FanotifyInit(unix.FAN_CLASS_NOTIF|unix.FAN_CLOEXEC|unix.FAN_NONBLOCK, unix.O_RDONLY|unix.O_LARGEFILE|unix.O_CLOEXEC)
+	if err != nil {
+		return fmt.Errorf("fanotify init: %v", err)
+	}
+	if err := unix.FanotifyMark(fd, unix.FAN_MARK_ADD|unix.FAN_MARK_FILESYSTEM, unix.FAN_OPEN, unix.AT_FDCWD, mountPoint); err != nil {
+		unix.Close(fd)
+		return fmt.Errorf("fanotify mark %q: %v", mountPoint, err)
+	}
+	w := &accessWatch{
+		file: os.NewFile(uintptr(fd), "fanotify"),
+		done: make(chan struct{}),
+	}
+	a.watches[volumeID] = w
+
+	logger := klog.FromContext(ctx).WithName("access-audit").WithValues("volume-id", volumeID, "mount-point", mountPoint)
+	logger.V(3).Info("Started access auditing")
+	go func() {
+		defer close(w.done)
+		a.readEvents(logger, volumeID, w.file)
+	}()
+	return nil
+}
+
+// unwatch stops auditing the volume.
+func (a *accessAuditor) unwatch(ctx context.Context, volumeID string) {
+	a.mutex.Lock()
+	w := a.watches[volumeID]
+	delete(a.watches, volumeID)
+	a.mutex.Unlock()
+	if w == nil {
+		return
+	}
+	w.file.Close()
+	<-w.done
+	klog.FromContext(ctx).WithName("access-audit").V(3).Info("Stopped access auditing")
+}
+
+func (a *accessAuditor) readEvents(logger klog.Logger, volumeID string, file *os.File) {
+	seen := map[string]time.Time{}
+	buffer := make([]byte, 64*1024)
+	for {
+		n, err := file.Read(buffer)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				logger.Error(err, "Reading fanotify events failed")
+			}
+			return
+		}
+		events, err := parseFanotifyEvents(buffer[:n])
+		if err != nil {
+			logger.Error(err, "Parsing fanotify events failed")
+		}
+		now := time.Now()
+		if len(seen) > accessAuditMaxSeen {
+			seen = map[string]time.Time{}
+		}
+		for _, event := range events {
+			record := accessRecord{
+				Time:     now,
+				Event:    "open",
+				VolumeID: volumeID,
+				PID:      event.Pid,
+			}
+			if event.Fd >= 0 {
+				record.Path, _ = os.Readlink(fmt.Sprintf("/proc/self/fd/%d", event.Fd))
+				unix.Close(int(event.Fd))
+			}
+			if event.Mask&unix.FAN_Q_OVERFLOW != 0 {
+				record.Event = "overflow"
+			} else {
+				key := fmt.Sprintf("%d:%s", event.Pid, record.Path)
+				if last, ok := seen[key]; ok && now.Sub(last) < accessAuditInterval {
+					continue
+				}
+				seen[key] = now
+			}
+			if event.Pid > 0 {
+				record.Command, record.PodUID = processInfo(event.Pid)
+			}
+			if err := a.sink.record(record); err != nil {
+				logger.Error(err, "Recording file access failed")
+			}
+		}
+	}
+}
+
+// parseFanotifyEvents splits the data returned by a read from a
+// fanotify file descriptor into events. File descriptors of events
+// which cannot be parsed are not closed.
+func parseFanotifyEvents(data []byte) ([]unix.FanotifyEventMetadata, error) {
+	var events []unix.FanotifyEventMetadata
+	for len(data) > 0 {
+		var event unix.FanotifyEventMetadata
+		if err := binary.Read(bytes.NewReader(data), binary.NativeEndian, &event); err != nil {
+			return events, fmt.Errorf("fanotify event: %v", err)
+		}
+		if event.Vers != unix.FANOTIFY_METADATA_VERSION {
+			return events, fmt.Errorf("unsupported fanotify metadata version %d", event.Vers)
+		}
+		if event.Event_len < uint32(event.Metadata_len) || int(event.Event_len) > len(data) {
+			return events, fmt.Errorf("invalid fanotify event length %d", event.Event_len)
+		}
+		events = append(events, event)
+		data = data[event.Event_len:]
+	}
+	return events, nil
+}
+
+// podUIDRe matches the pod part of cgroup paths, with either the
+// cgroupfs ("pod<uid>") or the systemd ("pod<uid with underscores>.slice")
+// cgroup driver.
+var podUIDRe = regexp.MustCompile(`pod([0-9a-f]{8}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{4}[-_][0-9a-f]{12})`)
+
+// processInfo returns the command name and, if the process runs in a
+// Kubernetes pod, the pod UID. Both are empty if the process has
+// already terminated.
+func processInfo(pid int32) (command, podUID string) {
+	dir := filepath.Join(procRoot, fmt.Sprintf("%d", pid))
+	if comm, err := os.ReadFile(filepath.Join(dir, "comm")); err == nil {
+		command = strings.TrimSpace(string(comm))
+	}
+	file, err := os.Open(filepath.Join(dir, "cgroup"))
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if match := podUIDRe.FindStringSubmatch(scanner.Text()); match != nil {
+			podUID = strings.ReplaceAll(match[1], "_", "-")
+			return
+		}
+	}
+	return
+}
+
+// restartAccessAudit resumes auditing of volumes which were staged
+// before the driver restarted. Any mount point of the device is
+// suitable because the mark applies to the entire filesystem. It must
+// be called before the server starts handling requests.
+func (ns *nodeServer) restartAccessAudit(ctx context.Context) error {
+	logger := klog.FromContext(ctx).WithName("restartAccessAudit")
+	mountPoints, err := ns.mounter.List()
+	if err != nil {
+		return fmt.Errorf("list mount points: %v", err)
+	}
+	for id, vol := range ns.cs.pmemVolumes {
+		p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+		if err != nil || !p.GetAccessAudit() {
+			continue
+		}
+		dm, err := ns.getDeviceManagerForVolume(ctx, id)
+		if err != nil {
+			continue
+		}
+		device, err := dm.GetDevice(ctx, id)
+		if err != nil {
+			logger.Error(err, "Cannot resume access auditing, device not found", "volume-id", id)
+			continue
+		}
+		devicePath, err := filepath.EvalSymlinks(device.Path)
+		if err != nil {
+			devicePath = device.Path
+		}
+		for _, mp := range mountPoints {
+			if path, err := filepath.EvalSymlinks(mp.Device); err != nil || path != devicePath {
+				continue
+			}
+			if err := ns.auditor.watch(klog.NewContext(ctx, logger.WithValues("volume-id", id)), id, mp.Path); err != nil {
+				return fmt.Errorf("resume access auditing of volume %s: %v", id, err)
+			}
+			break
+		}
+	}
+	return nil
+}
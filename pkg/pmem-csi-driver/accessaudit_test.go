@@ -0,0 +1,129 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2/ktesting"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (*bufferCloser) Close() error {
+	return nil
+}
+
+func TestParseFanotifyEvents(t *testing.T) {
+	var data bytes.Buffer
+	for _, event := range []unix.FanotifyEventMetadata{
+		{Event_len: 24, Vers: unix.FANOTIFY_METADATA_VERSION, Metadata_len: 24, Mask: unix.FAN_OPEN, Fd: 10, Pid: 100},
+		{Event_len: 24, Vers: unix.FANOTIFY_METADATA_VERSION, Metadata_len: 24, Mask: unix.FAN_Q_OVERFLOW, Fd: unix.FAN_NOFD},
+	} {
+		require.NoError(t, binary.Write(&data, binary.NativeEndian, event), "encode event")
+	}
+	events, err := parseFanotifyEvents(data.Bytes())
+	require.NoError(t, err, "parse events")
+	require.Len(t, events, 2, "events")
+	assert.Equal(t, int32(10), events[0].Fd, "first event fd")
+	assert.Equal(t, int32(100), events[0].Pid, "first event pid")
+	assert.Equal(t, uint64(unix.FAN_Q_OVERFLOW), events[1].Mask, "second event mask")
+
+	_, err = parseFanotifyEvents(data.Bytes()[:30])
+	assert.Error(t, err, "truncated event")
+
+	var invalid bytes.Buffer
+	require.NoError(t, binary.Write(&invalid, binary.NativeEndian, unix.FanotifyEventMetadata{Event_len: 24, Vers: 1, Metadata_len: 24}), "encode event")
+	_, err = parseFanotifyEvents(invalid.Bytes())
+	assert.Error(t, err, "unsupported version")
+}
+
+func TestProcessInfo(t *testing.T) {
+	root := t.TempDir()
+	oldRoot := procRoot
+	procRoot = root
+	defer func() {
+		procRoot = oldRoot
+	}()
+
+	write := func(filename, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755), "create directory")
+		require.NoError(t, os.WriteFile(filename, []byte(content), 0644), "write file")
+	}
+	write(filepath.Join(root, "1", "comm"), "cgroupfs\n")
+	write(filepath.Join(root, "1", "cgroup"), "0::/kubepods/besteffort/pod0d6f7a1e-5a2b-4cde-8f90-123456789abc/4f1e\n")
+	write(filepath.Join(root, "2", "comm"), "systemd\n")
+	write(filepath.Join(root, "2", "cgroup"), "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod0d6f7a1e_5a2b_4cde_8f90_123456789abc.slice/cri-containerd-4f1e.scope\n")
+	write(filepath.Join(root, "3", "comm"), "host\n")
+	write(filepath.Join(root, "3", "cgroup"), "0::/system.slice/sshd.service\n")
+
+	for pid, expected := range map[int32][2]string{
+		1: {"cgroupfs", "0d6f7a1e-5a2b-4cde-8f90-123456789abc"},
+		2: {"systemd", "0d6f7a1e-5a2b-4cde-8f90-123456789abc"},
+		3: {"host", ""},
+		4: {"", ""},
+	} {
+		command, podUID := processInfo(pid)
+		assert.Equal(t, expected[0], command, "command of %d", pid)
+		assert.Equal(t, expected[1], podUID, "pod UID of %d", pid)
+	}
+}
+
+func TestAccessAuditor(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	out := &bufferCloser{}
+	auditor := newAccessAuditor(newAuditLog(out))
+
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "data")
+	require.NoError(t, os.WriteFile(filename, []byte("hello"), 0644), "create file")
+	if err := auditor.watch(ctx, "vol", dir); err != nil {
+		if errors.Is(err, unix.EPERM) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOSYS) {
+			t.Skipf("fanotify not usable: %v", err)
+		}
+		require.NoError(t, err, "watch")
+	}
+	require.NoError(t, auditor.watch(ctx, "vol", dir), "watch again")
+
+	// Opening twice is recorded once.
+	for i := 0; i < 2; i++ {
+		_, err := os.ReadFile(filename)
+		require.NoError(t, err, "read file")
+	}
+	require.Eventually(t, func() bool {
+		auditor.sink.mutex.Lock()
+		defer auditor.sink.mutex.Unlock()
+		return strings.Contains(out.String(), filename)
+	}, 5*time.Second, 10*time.Millisecond, "open recorded")
+	auditor.unwatch(ctx, "vol")
+
+	var records []accessRecord
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record accessRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &record), "decode %q", line)
+		if record.Path == filename {
+			records = append(records, record)
+		}
+	}
+	require.Len(t, records, 1, "records")
+	assert.Equal(t, "open", records[0].Event, "event")
+	assert.Equal(t, "vol", records[0].VolumeID, "volume ID")
+	assert.Equal(t, int32(os.Getpid()), records[0].PID, "PID")
+}
@@ -0,0 +1,64 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// auditLog is the sink for audit records. Each record is written as
+// one line of JSON. Records are not buffered, so they are in the
+// file even when the driver gets killed.
+type auditLog struct {
+	mutex   sync.Mutex
+	out     io.WriteCloser
+	encoder *json.Encoder
+}
+
+// openAuditLog appends to the file, which gets created if needed.
+// "-" selects stdout.
+func openAuditLog(filename string) (*auditLog, error) {
+	var out io.WriteCloser = os.Stdout
+	if filename != "-" {
+		file, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("open audit log: %v", err)
+		}
+		out = file
+	}
+	return newAuditLog(out), nil
+}
+
+func newAuditLog(out io.WriteCloser) *auditLog {
+	return &auditLog{
+		out:     out,
+		encoder: json.NewEncoder(out),
+	}
+}
+
+// record writes one record. It may be called concurrently.
+func (a *auditLog) record(record interface{}) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if err := a.encoder.Encode(record); err != nil {
+		return fmt.Errorf("write audit record: %v", err)
+	}
+	return nil
+}
+
+func (a *auditLog) Close() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.out == os.Stdout {
+		return nil
+	}
+	return a.out.Close()
+}
@@ -0,0 +1,253 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"k8s.io/klog/v2"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+const (
+	// backpressureMinDelay and backpressureMaxDelay bound the
+	// suggested retry delay.
+	backpressureMinDelay = time.Second
+	backpressureMaxDelay = 5 * time.Minute
+
+	reasonConcurrency   = "concurrency"
+	reasonDeletionQueue = "deletion-queue"
+)
+
+// limitedMethods are the calls which modify volumes and thus take
+// time and PMEM bandwidth. Everything else only reads state and
+// always gets served, otherwise a busy node would look broken.
+var limitedMethods = map[string]bool{
+	"CreateVolume":           true,
+	"DeleteVolume":           true,
+	"ControllerExpandVolume": true,
+	"CreateSnapshot":         true,
+	"DeleteSnapshot":         true,
+	"NodeStageVolume":        true,
+	"NodeUnstageVolume":      true,
+	"NodePublishVolume":      true,
+	"NodeUnpublishVolume":    true,
+	"NodeExpandVolume":       true,
+}
+
+var (
+	callsInFlightDesc = prometheus.NewDesc(
+		"pmem_csi_node_calls_in_flight",
+		"Number of CSI calls which modify volumes and currently run.",
+		nil, nil,
+	)
+	saturatedDesc = prometheus.NewDesc(
+		"pmem_csi_node_saturated",
+		"1 while the node driver rejects calls because it is saturated, 0 otherwise.",
+		nil, nil,
+	)
+	rejectedCallsDesc = prometheus.NewDesc(
+		"pmem_csi_node_rejected_calls_total",
+		"Number of CSI calls rejected with RESOURCE_EXHAUSTED because the node driver was saturated.",
+		[]string{"reason"}, nil,
+	)
+)
+
+// backpressure rejects calls while the node is saturated, with a
+// hint when to retry. The hint grows with the number of calls that
+// were rejected recently and gets randomized, so that clients which
+// retry do not all come back at the same time and keep the node
+// saturated while it recovers.
+type backpressure struct {
+	// domain is used in the ErrorInfo of rejected calls.
+	domain string
+	// maxCalls limits the calls which run concurrently, zero
+	// means no limit.
+	maxCalls int
+	// maxDeletionQueue limits the freed devices which still need
+	// to be zeroed. DeleteVolume gets rejected while it is
+	// reached. Zero means no limit.
+	maxDeletionQueue int
+	// deletionQueue returns the current length, may be nil.
+	deletionQueue func() (int, error)
+	// jitter returns a random number in [0,1), can be replaced
+	// for testing.
+	jitter func() float64
+
+	mutex    sync.Mutex
+	inFlight int
+	// average is the moving average of the duration of calls.
+	average time.Duration
+	// rejectedRecently decays each time that a call completes.
+	rejectedRecently int
+	saturated        bool
+	rejected         map[string]int64
+}
+
+func newBackpressure(domain string, maxCalls, maxDeletionQueue int) *backpressure {
+	return &backpressure{
+		domain:           domain,
+		maxCalls:         maxCalls,
+		maxDeletionQueue: maxDeletionQueue,
+		jitter:           rand.Float64,
+		rejected:         map[string]int64{},
+	}
+}
+
+// admit counts the call as running when there is room for it. The
+// returned function must be called when the call is done. Otherwise
+// it returns a ResourceExhausted error.
+func (bp *backpressure) admit(ctx context.Context, method string) (func(), error) {
+	reason := ""
+	if method == "DeleteVolume" && bp.maxDeletionQueue > 0 && bp.deletionQueue != nil {
+		length, err := bp.deletionQueue()
+		if err != nil {
+			// Not a reason to reject the call.
+			klog.FromContext(ctx).Error(err, "Failed to determine deletion queue length")
+		} else if length >= bp.maxDeletionQueue {
+			reason = reasonDeletionQueue
+		}
+	}
+
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+	if reason == "" && bp.maxCalls > 0 && bp.inFlight >= bp.maxCalls {
+		reason = reasonConcurrency
+	}
+	if reason != "" {
+		bp.saturated = true
+		bp.rejected[reason]++
+		bp.rejectedRecently++
+		delay := bp.retryDelay()
+		klog.FromContext(ctx).V(3).Info("Rejecting call, node is saturated", "method", method, "reason", reason, "in-flight", bp.inFlight, "retry-after", delay)
+		return nil, bp.exhausted(reason, delay)
+	}
+
+	bp.inFlight++
+	start := time.Now()
+	return func() {
+		bp.mutex.Lock()
+		defer bp.mutex.Unlock()
+		bp.inFlight--
+		duration := time.Since(start)
+		if bp.average == 0 {
+			bp.average = duration
+		} else {
+			bp.average = (3*bp.average + duration) / 4
+		}
+		if bp.rejectedRecently > 0 {
+			bp.rejectedRecently--
+		}
+		if bp.maxCalls == 0 || bp.inFlight < bp.maxCalls {
+			bp.saturated = false
+		}
+	}, nil
+}
+
+// retryDelay estimates when there will be room again for all calls
+// that were rejected recently. Must be called with the mutex locked.
+func (bp *backpressure) retryDelay() time.Duration {
+	parallel := bp.maxCalls
+	if parallel == 0 {
+		parallel = 1
+	}
+	delay := bp.average * time.Duration(1+bp.rejectedRecently/parallel)
+	// Between 100% and 150%, to spread out the retries.
+	delay += time.Duration(float64(delay) * bp.jitter() / 2)
+	if delay < backpressureMinDelay {
+		delay = backpressureMinDelay
+	}
+	if delay > backpressureMaxDelay {
+		delay = backpressureMaxDelay
+	}
+	return delay.Round(time.Millisecond)
+}
+
+func (bp *backpressure) exhausted(reason string, delay time.Duration) error {
+	var message string
+	switch reason {
+	case reasonConcurrency:
+		message = fmt.Sprintf("node is busy with %d calls, retry after %s", bp.inFlight, delay)
+	default:
+		message = fmt.Sprintf("node is still zeroing at least %d deleted volumes, retry after %s", bp.maxDeletionQueue, delay)
+	}
+	st := status.New(codes.ResourceExhausted, message)
+	withDetails, err := st.WithDetails(&errdetails.ErrorInfo{
+		Reason: "NODE_SATURATED",
+		Domain: bp.domain,
+		Metadata: map[string]string{
+			"reason":      reason,
+			"retry-after": delay.String(),
+		},
+	})
+	if err == nil {
+		withDetails, err = withDetails.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+	}
+	if err != nil {
+		return st.Err()
+	}
+	return withDetails.Err()
+}
+
+// intercept is a gRPC interceptor which applies the limits to the
+// calls in limitedMethods.
+func (bp *backpressure) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	if !limitedMethods[method] {
+		return handler(ctx, req)
+	}
+	done, err := bp.admit(ctx, method)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+	return handler(ctx, req)
+}
+
+// MustRegister adds the metrics to the registry, using labels to tag each sample with node and driver name.
+func (bp *backpressure) MustRegister(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		pmdmanager.NodeLabel: nodeName,
+		"driver_name":        driverName,
+	}
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(bp)
+}
+
+// Describe implements prometheus.Collector.Describe.
+func (bp *backpressure) Describe(ch chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(bp, ch)
+}
+
+// Collect implements prometheus.Collector.Collect.
+func (bp *backpressure) Collect(ch chan<- prometheus.Metric) {
+	bp.mutex.Lock()
+	defer bp.mutex.Unlock()
+
+	ch <- prometheus.MustNewConstMetric(callsInFlightDesc, prometheus.GaugeValue, float64(bp.inFlight))
+	saturated := 0.0
+	if bp.saturated {
+		saturated = 1
+	}
+	ch <- prometheus.MustNewConstMetric(saturatedDesc, prometheus.GaugeValue, saturated)
+	for _, reason := range []string{reasonConcurrency, reasonDeletionQueue} {
+		ch <- prometheus.MustNewConstMetric(rejectedCallsDesc, prometheus.CounterValue, float64(bp.rejected[reason]), reason)
+	}
+}
+
+var _ prometheus.Collector = &backpressure{}
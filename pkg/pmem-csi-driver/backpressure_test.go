@@ -0,0 +1,98 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestBackpressure(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	bp := newBackpressure("pmem-csi.intel.com", 1, 2)
+	bp.jitter = func() float64 { return 0 }
+	queueLength := 0
+	bp.deletionQueue = func() (int, error) { return queueLength, nil }
+	reg := prometheus.NewPedanticRegistry()
+	bp.MustRegister(reg, "worker", "pmem-csi.intel.com")
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	call := func(method string, handler grpc.UnaryHandler) error {
+		_, err := bp.intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/" + method}, handler)
+		return err
+	}
+
+	require.NoError(t, call("CreateVolume", ok), "no other call")
+
+	// One call blocks the next one.
+	var err error
+	require.NoError(t, call("CreateVolume", func(ctx context.Context, req interface{}) (interface{}, error) {
+		err = call("DeleteVolume", ok)
+		assert.NoError(t, call("GetCapacity", ok), "not limited")
+		assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP pmem_csi_node_calls_in_flight Number of CSI calls which modify volumes and currently run.
+# TYPE pmem_csi_node_calls_in_flight gauge
+pmem_csi_node_calls_in_flight{driver_name="pmem-csi.intel.com",node="worker"} 1
+# HELP pmem_csi_node_saturated 1 while the node driver rejects calls because it is saturated, 0 otherwise.
+# TYPE pmem_csi_node_saturated gauge
+pmem_csi_node_saturated{driver_name="pmem-csi.intel.com",node="worker"} 1
+`), "pmem_csi_node_calls_in_flight", "pmem_csi_node_saturated"), "metrics while saturated")
+		return nil, nil
+	}), "first call")
+	st := status.Convert(err)
+	assert.Equal(t, codes.ResourceExhausted, st.Code(), "code")
+	assert.Equal(t, "node is busy with 1 calls, retry after 1s", st.Message(), "message")
+	require.Len(t, st.Details(), 2, "details")
+	info := st.Details()[0].(*errdetails.ErrorInfo)
+	assert.Equal(t, "NODE_SATURATED", info.Reason, "reason")
+	assert.Equal(t, "pmem-csi.intel.com", info.Domain, "domain")
+	assert.Equal(t, reasonConcurrency, info.Metadata["reason"], "metadata")
+	assert.Equal(t, time.Second, st.Details()[1].(*errdetails.RetryInfo).RetryDelay.AsDuration(), "retry delay")
+
+	// The delay is based on how long calls take and how many
+	// got rejected.
+	bp.average = time.Minute
+	bp.jitter = func() float64 { return 0.5 }
+	bp.inFlight = 1
+	bp.rejectedRecently = 2
+	assert.Equal(t, 225*time.Second, bp.retryDelay(), "3m + 25%")
+	bp.rejectedRecently = 0
+	assert.Equal(t, 75*time.Second, bp.retryDelay(), "1m + 25%")
+	bp.inFlight = 0
+
+	// Deleting is limited by the deletion queue.
+	queueLength = 2
+	err = call("DeleteVolume", ok)
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "deletion queue full")
+	assert.NoError(t, call("CreateVolume", ok), "creating is not limited by the deletion queue")
+	queueLength = 1
+	assert.NoError(t, call("DeleteVolume", ok), "deletion queue not full")
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP pmem_csi_node_calls_in_flight Number of CSI calls which modify volumes and currently run.
+# TYPE pmem_csi_node_calls_in_flight gauge
+pmem_csi_node_calls_in_flight{driver_name="pmem-csi.intel.com",node="worker"} 0
+# HELP pmem_csi_node_rejected_calls_total Number of CSI calls rejected with RESOURCE_EXHAUSTED because the node driver was saturated.
+# TYPE pmem_csi_node_rejected_calls_total counter
+pmem_csi_node_rejected_calls_total{driver_name="pmem-csi.intel.com",node="worker",reason="concurrency"} 1
+pmem_csi_node_rejected_calls_total{driver_name="pmem-csi.intel.com",node="worker",reason="deletion-queue"} 1
+# HELP pmem_csi_node_saturated 1 while the node driver rejects calls because it is saturated, 0 otherwise.
+# TYPE pmem_csi_node_saturated gauge
+pmem_csi_node_saturated{driver_name="pmem-csi.intel.com",node="worker"} 0
+`)), "final metrics")
+}
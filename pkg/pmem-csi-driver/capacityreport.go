@@ -0,0 +1,240 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelistersv1 "k8s.io/client-go/listers/core/v1"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/rest"
+	"k8s.io/klog/v2"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+)
+
+// csiDriverNameLabel is set by external-provisioner for all
+// CSIStorageCapacity objects that it publishes.
+const csiDriverNameLabel = "csi.storage.k8s.io/drivername"
+
+// capacityReporter maintains the PmemCSICapacityReport object of
+// the driver. All information comes from informers that are shared
+// with the rescheduler, so computing the report doesn't cause
+// additional traffic.
+type capacityReporter struct {
+	driverName string
+	client     client.Client
+	pvLister   corelistersv1.PersistentVolumeLister
+	pvcLister  corelistersv1.PersistentVolumeClaimLister
+	// nil if the cluster doesn't support CSIStorageCapacity v1.
+	capacityLister storagelistersv1.CSIStorageCapacityLister
+}
+
+// newCapacityReporter must be called before starting the factory.
+func newCapacityReporter(ctx context.Context, driverName string, config *rest.Config, kubeClient kubernetes.Interface, factory informers.SharedInformerFactory) (*capacityReporter, error) {
+	logger := klog.FromContext(ctx)
+	scheme := runtime.NewScheme()
+	if err := api.SchemeBuilder.AddToScheme(scheme); err != nil {
+		return nil, fmt.Errorf("register PMEM-CSI API: %v", err)
+	}
+	c, err := client.New(config, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, fmt.Errorf("create client for capacity report: %v", err)
+	}
+	cr := &capacityReporter{
+		driverName: driverName,
+		client:     c,
+		pvLister:   factory.Core().V1().PersistentVolumes().Lister(),
+		pvcLister:  factory.Core().V1().PersistentVolumeClaims().Lister(),
+	}
+	if hasStorageCapacity(kubeClient) {
+		cr.capacityLister = factory.Storage().V1().CSIStorageCapacities().Lister()
+	} else {
+		logger.Info("CSIStorageCapacity v1 not supported, capacity report will not include available capacity")
+	}
+	return cr, nil
+}
+
+func hasStorageCapacity(kubeClient kubernetes.Interface) bool {
+	resources, err := kubeClient.Discovery().ServerResourcesForGroupVersion("storage.k8s.io/v1")
+	if err != nil {
+		return false
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == "csistoragecapacities" {
+			return true
+		}
+	}
+	return false
+}
+
+// run updates the report periodically until the context is canceled.
+func (cr *capacityReporter) run(ctx context.Context, interval time.Duration) {
+	logger := klog.FromContext(ctx).WithName("capacity-report")
+	ctx = klog.NewContext(ctx, logger)
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := cr.update(ctx); err != nil {
+			logger.Error(err, "Updating capacity report failed")
+		}
+	}, interval)
+}
+
+// update creates or updates the report object.
+func (cr *capacityReporter) update(ctx context.Context) error {
+	status, err := cr.compute(metav1.Now())
+	if err != nil {
+		return err
+	}
+	report := &api.PmemCSICapacityReport{}
+	err = cr.client.Get(ctx, client.ObjectKey{Name: cr.driverName}, report)
+	switch {
+	case apierrs.IsNotFound(err):
+		report.Name = cr.driverName
+		report.Status = *status
+		if err := cr.client.Create(ctx, report); err != nil {
+			return fmt.Errorf("create capacity report: %v", err)
+		}
+	case err != nil:
+		return fmt.Errorf("get capacity report: %v", err)
+	default:
+		report.Status = *status
+		if err := cr.client.Update(ctx, report); err != nil {
+			return fmt.Errorf("update capacity report: %v", err)
+		}
+	}
+	klog.FromContext(ctx).V(5).Info("Updated capacity report", "volumes", status.Total.Volumes, "pending-volumes", status.Total.PendingVolumes)
+	return nil
+}
+
+// compute summarizes the current cluster state.
+func (cr *capacityReporter) compute(now metav1.Time) (*api.CapacityReportStatus, error) {
+	status := &api.CapacityReportStatus{
+		LastUpdated: now,
+	}
+	nodes := map[string]*api.NodeCapacity{}
+	getNode := func(name string) *api.NodeCapacity {
+		node := nodes[name]
+		if node == nil {
+			node = &api.NodeCapacity{Node: name}
+			nodes[name] = node
+		}
+		return node
+	}
+
+	pvs, err := cr.pvLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("list PVs: %v", err)
+	}
+	for _, pv := range pvs {
+		if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != cr.driverName {
+			continue
+		}
+		size := pv.Spec.Capacity[v1.ResourceStorage]
+		status.Total.Reserved.Add(size)
+		status.Total.Volumes++
+		if name := pvNode(pv); name != "" {
+			node := getNode(name)
+			node.Reserved.Add(size)
+			node.Volumes++
+		}
+	}
+
+	pvcs, err := cr.pvcLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("list PVCs: %v", err)
+	}
+	for _, pvc := range pvcs {
+		if pvc.Status.Phase != v1.ClaimPending {
+			continue
+		}
+		if pvc.Annotations[annStorageProvisioner] != cr.driverName &&
+			pvc.Annotations[annBetaStorageProvisioner] != cr.driverName {
+			continue
+		}
+		size := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+		status.Total.Pending.Add(size)
+		status.Total.PendingVolumes++
+		if name := pvc.Annotations[annSelectedNode]; name != "" {
+			node := getNode(name)
+			node.Pending.Add(size)
+			node.PendingVolumes++
+		}
+	}
+
+	if cr.capacityLister != nil {
+		capacities, err := cr.capacityLister.List(labels.SelectorFromSet(labels.Set{csiDriverNameLabel: cr.driverName}))
+		if err != nil {
+			return nil, fmt.Errorf("list CSIStorageCapacity objects: %v", err)
+		}
+		// There is one object per node and storage class. They
+		// all describe the same PMEM, so use the maximum.
+		for _, capacity := range capacities {
+			if capacity.NodeTopology == nil || capacity.NodeTopology.MatchLabels[DriverTopologyKey] == "" {
+				continue
+			}
+			node := getNode(capacity.NodeTopology.MatchLabels[DriverTopologyKey])
+			maxQuantity(&node.Available, capacity.Capacity)
+			maxQuantity(&node.MaximumVolumeSize, capacity.MaximumVolumeSize)
+		}
+		available := resource.Quantity{}
+		for _, node := range nodes {
+			if node.Available != nil {
+				available.Add(*node.Available)
+			}
+		}
+		status.Total.Available = &available
+	}
+
+	for _, node := range nodes {
+		status.Nodes = append(status.Nodes, *node)
+	}
+	sort.Slice(status.Nodes, func(i, j int) bool {
+		return status.Nodes[i].Node < status.Nodes[j].Node
+	})
+	return status, nil
+}
+
+// pvNode returns the node that a PV was created on, as recorded in
+// its node affinity.
+func pvNode(pv *v1.PersistentVolume) string {
+	if pv.Spec.NodeAffinity == nil || pv.Spec.NodeAffinity.Required == nil {
+		return ""
+	}
+	for _, term := range pv.Spec.NodeAffinity.Required.NodeSelectorTerms {
+		for _, expr := range term.MatchExpressions {
+			if expr.Key == DriverTopologyKey &&
+				expr.Operator == v1.NodeSelectorOpIn &&
+				len(expr.Values) == 1 {
+				return expr.Values[0]
+			}
+		}
+	}
+	return ""
+}
+
+func maxQuantity(max **resource.Quantity, value *resource.Quantity) {
+	if value == nil {
+		return
+	}
+	if *max == nil || value.Cmp(**max) > 0 {
+		c := value.DeepCopy()
+		*max = &c
+	}
+}
@@ -0,0 +1,188 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	corelistersv1 "k8s.io/client-go/listers/core/v1"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2/ktesting"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+)
+
+func TestCapacityReport(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	oldKey := DriverTopologyKey
+	DriverTopologyKey = driverName + "/node"
+	defer func() {
+		DriverTopologyKey = oldKey
+	}()
+
+	pv := func(name, driver, node, size string) *v1.PersistentVolume {
+		pv := &v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: name},
+			Spec: v1.PersistentVolumeSpec{
+				Capacity: v1.ResourceList{v1.ResourceStorage: resource.MustParse(size)},
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: driver},
+				},
+			},
+		}
+		if node != "" {
+			pv.Spec.NodeAffinity = &v1.VolumeNodeAffinity{
+				Required: &v1.NodeSelector{
+					NodeSelectorTerms: []v1.NodeSelectorTerm{{
+						MatchExpressions: []v1.NodeSelectorRequirement{{
+							Key:      DriverTopologyKey,
+							Operator: v1.NodeSelectorOpIn,
+							Values:   []string{node},
+						}},
+					}},
+				},
+			}
+		}
+		return pv
+	}
+	pvc := func(name, driver, node, size string, phase v1.PersistentVolumeClaimPhase) *v1.PersistentVolumeClaim {
+		pvc := &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        name,
+				Namespace:   "default",
+				Annotations: map[string]string{annStorageProvisioner: driver},
+			},
+			Spec: v1.PersistentVolumeClaimSpec{
+				Resources: v1.VolumeResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse(size)},
+				},
+			},
+			Status: v1.PersistentVolumeClaimStatus{Phase: phase},
+		}
+		if node != "" {
+			pvc.Annotations[annSelectedNode] = node
+		}
+		return pvc
+	}
+	capacity := func(name, driver, node, available, maxSize string) *storagev1.CSIStorageCapacity {
+		a := resource.MustParse(available)
+		m := resource.MustParse(maxSize)
+		return &storagev1.CSIStorageCapacity{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "pmem-csi",
+				Labels:    map[string]string{csiDriverNameLabel: driver},
+			},
+			NodeTopology: &metav1.LabelSelector{
+				MatchLabels: map[string]string{DriverTopologyKey: node},
+			},
+			Capacity:          &a,
+			MaximumVolumeSize: &m,
+		}
+	}
+
+	pvIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	pvcIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	capacityIndexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc})
+	for _, obj := range []interface{}{
+		pv("pv-a", driverName, "node-a", "1Gi"),
+		pv("pv-b", driverName, "node-a", "2Gi"),
+		pv("pv-c", driverName, "", "1Gi"),
+		pv("pv-other", "other."+driverName, "node-a", "100Gi"),
+	} {
+		require.NoError(t, pvIndexer.Add(obj), "add PV")
+	}
+	for _, obj := range []interface{}{
+		pvc("pvc-a", driverName, "node-b", "4Gi", v1.ClaimPending),
+		pvc("pvc-b", driverName, "", "8Gi", v1.ClaimPending),
+		pvc("pvc-bound", driverName, "node-a", "1Gi", v1.ClaimBound),
+		pvc("pvc-other", "other."+driverName, "node-a", "100Gi", v1.ClaimPending),
+	} {
+		require.NoError(t, pvcIndexer.Add(obj), "add PVC")
+	}
+	for _, obj := range []interface{}{
+		capacity("cap-a-1", driverName, "node-a", "10Gi", "5Gi"),
+		capacity("cap-a-2", driverName, "node-a", "12Gi", "6Gi"),
+		capacity("cap-b", driverName, "node-b", "20Gi", "20Gi"),
+		capacity("cap-other", "other."+driverName, "node-b", "100Gi", "100Gi"),
+	} {
+		require.NoError(t, capacityIndexer.Add(obj), "add CSIStorageCapacity")
+	}
+
+	scheme := runtime.NewScheme()
+	require.NoError(t, api.SchemeBuilder.AddToScheme(scheme), "add API to scheme")
+	cr := &capacityReporter{
+		driverName:     driverName,
+		client:         fake.NewClientBuilder().WithScheme(scheme).Build(),
+		pvLister:       corelistersv1.NewPersistentVolumeLister(pvIndexer),
+		pvcLister:      corelistersv1.NewPersistentVolumeClaimLister(pvcIndexer),
+		capacityLister: storagelistersv1.NewCSIStorageCapacityLister(capacityIndexer),
+	}
+
+	quantity := func(value string) *resource.Quantity {
+		q := resource.MustParse(value)
+		return &q
+	}
+	checkQuantity := func(what string, expected string, actual resource.Quantity) {
+		e := resource.MustParse(expected)
+		assert.Equal(t, 0, e.Cmp(actual), "%s: expected %s, got %s", what, expected, actual.String())
+	}
+	check := func(status api.CapacityReportStatus) {
+		checkQuantity("total reserved", "4Gi", status.Total.Reserved)
+		assert.Equal(t, 3, status.Total.Volumes, "total volumes")
+		checkQuantity("total pending", "12Gi", status.Total.Pending)
+		assert.Equal(t, 2, status.Total.PendingVolumes, "total pending volumes")
+		if assert.NotNil(t, status.Total.Available, "total available") {
+			checkQuantity("total available", "32Gi", *status.Total.Available)
+		}
+		require.Len(t, status.Nodes, 2, "nodes")
+
+		nodeA := status.Nodes[0]
+		assert.Equal(t, "node-a", nodeA.Node, "node A")
+		checkQuantity("node A reserved", "3Gi", nodeA.Reserved)
+		assert.Equal(t, 2, nodeA.Volumes, "node A volumes")
+		assert.Equal(t, 0, nodeA.PendingVolumes, "node A pending volumes")
+		assert.Equal(t, quantity("12Gi").String(), nodeA.Available.String(), "node A available")
+		assert.Equal(t, quantity("6Gi").String(), nodeA.MaximumVolumeSize.String(), "node A maximum volume size")
+
+		nodeB := status.Nodes[1]
+		assert.Equal(t, "node-b", nodeB.Node, "node B")
+		assert.Equal(t, 0, nodeB.Volumes, "node B volumes")
+		checkQuantity("node B pending", "4Gi", nodeB.Pending)
+		assert.Equal(t, 1, nodeB.PendingVolumes, "node B pending volumes")
+		assert.Equal(t, quantity("20Gi").String(), nodeB.Available.String(), "node B available")
+	}
+
+	status, err := cr.compute(metav1.Now())
+	require.NoError(t, err, "compute")
+	check(*status)
+
+	// Once for creating, once for updating the object.
+	for i := 0; i < 2; i++ {
+		require.NoError(t, cr.update(ctx), "update #%d", i)
+		report := &api.PmemCSICapacityReport{}
+		require.NoError(t, cr.client.Get(ctx, client.ObjectKey{Name: driverName}, report), "get report #%d", i)
+		check(report.Status)
+	}
+
+	// Without storage capacity tracking.
+	cr.capacityLister = nil
+	status, err = cr.compute(metav1.Now())
+	require.NoError(t, err, "compute without capacity")
+	assert.Nil(t, status.Total.Available, "total available without capacity")
+	assert.Len(t, status.Nodes, 2, "nodes without capacity")
+}
@@ -0,0 +1,181 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// contentSource is a snapshot or volume on this node whose data
+// gets copied into a new volume.
+type contentSource struct {
+	kind       string
+	id         string
+	size       int64
+	deviceMode api.DeviceMode
+	release    func()
+}
+
+// getContentSource looks up the source of a new volume and prevents
+// its removal until release is called. The source must be on this
+// node because PMEM is local. Scheduling therefore has to ensure that
+// the new volume gets provisioned on the same node.
+func (cs *nodeControllerServer) getContentSource(ctx context.Context, source *csi.VolumeContentSource) (*contentSource, error) {
+	switch {
+	case source.GetSnapshot() != nil:
+		snapshotID := source.GetSnapshot().GetSnapshotId()
+		snapshotMutex.LockKey(snapshotID)
+		release := func() {
+			_ = snapshotMutex.UnlockKey(snapshotID)
+		}
+		snap := cs.getSnapshotByID(snapshotID)
+		if snap == nil {
+			release()
+			return nil, status.Errorf(codes.NotFound, "snapshot %q not found on node %s", snapshotID, cs.nodeID)
+		}
+		return &contentSource{
+			kind:       "snapshot",
+			id:         snap.ID,
+			size:       snap.Size,
+			deviceMode: snap.DeviceMode,
+			release:    release,
+		}, nil
+	case source.GetVolume() != nil:
+		volumeID := source.GetVolume().GetVolumeId()
+		// Not a key mutex, the caller already holds one for the new volume.
+		release, err := cs.operations.begin(ctx, volumeID, phaseCloning)
+		if err != nil {
+			return nil, err
+		}
+		vol := cs.getVolumeByID(volumeID)
+		if vol == nil {
+			release()
+			return nil, status.Errorf(codes.NotFound, "source volume %q not found on node %s", volumeID, cs.nodeID)
+		}
+		p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+		if err != nil {
+			release()
+			return nil, status.Errorf(codes.Internal, "previously stored volume parameters for volume with ID %q: %v", volumeID, err)
+		}
+		return &contentSource{
+			kind:       "volume",
+			id:         vol.ID,
+			size:       vol.Size,
+			deviceMode: p.GetDeviceMode(),
+			release:    release,
+		}, nil
+	default:
+		return nil, status.Error(codes.InvalidArgument, "unsupported volume content source")
+	}
+}
+
+// copyTo copies the content into a newly created volume.
+func (src *contentSource) copyTo(ctx context.Context, cs *nodeControllerServer, volumeID string) error {
+	dm, err := cs.deviceManager(ctx, src.deviceMode)
+	if err != nil {
+		return err
+	}
+	source, err := dm.GetDevice(ctx, src.id)
+	if err != nil {
+		return fmt.Errorf("get %s device: %v", src.kind, err)
+	}
+	targetDM, err := cs.deviceManager(ctx, cs.getVolumeDeviceMode(volumeID))
+	if err != nil {
+		return err
+	}
+	target, err := targetDM.GetDevice(ctx, volumeID)
+	if err != nil {
+		return fmt.Errorf("get volume device: %v", err)
+	}
+	return copyDevice(ctx, source, target, uint64(src.size))
+}
+
+// discardVolume removes a newly created volume whose content could
+// not be restored. The caller must hold the lock for the volume.
+func (cs *nodeControllerServer) discardVolume(ctx context.Context, volumeID string) {
+	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID)
+	dm, err := cs.deviceManager(ctx, cs.getVolumeDeviceMode(volumeID))
+	if err != nil {
+		logger.Error(err, "Removing incomplete volume failed")
+		// Keep the state, the volume still exists.
+		return
+	}
+	if err := dm.DeleteDevice(ctx, volumeID, false); err != nil {
+		logger.Error(err, "Removing incomplete volume failed")
+		// Keep the state, the volume still exists.
+		return
+	}
+	if err := cs.removeDeviceLink(volumeID); err != nil {
+		logger.Error(err, "Failed to remove device link")
+	}
+	if cs.sm != nil {
+		if err := cs.sm.Delete(volumeID); err != nil {
+			logger.Error(err, "Failed to remove volume from state")
+		}
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	delete(cs.pmemVolumes, volumeID)
+}
+
+// copyDevice copies the first size bytes from one device to another.
+// Devices without backing store are skipped.
+func copyDevice(ctx context.Context, source, target *pmdmanager.PmemDeviceInfo, size uint64) error {
+	if strings.HasPrefix(source.Path, pmdmanager.FakeDevicePathPrefix) ||
+		strings.HasPrefix(target.Path, pmdmanager.FakeDevicePathPrefix) {
+		return nil
+	}
+	if size > target.Size {
+		return fmt.Errorf("%s with %d bytes too small for %d bytes", target.Path, target.Size, size)
+	}
+
+	// Character devices of devdax volumes cannot be read or
+	// written, only mapped.
+	for _, path := range []string{source.Path, target.Path} {
+		if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			return fmt.Errorf("copying %s: devdax volumes are not supported", path)
+		}
+	}
+
+	klog.FromContext(ctx).V(4).Info("Copying device", "source", source.Path, "target", target.Path, "size", pmemlog.CapacityRef(int64(size)))
+	in, err := os.Open(source.Path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(target.Path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	n, err := io.Copy(out, io.LimitReader(in, int64(size)))
+	if err != nil {
+		return fmt.Errorf("copy %s to %s: %v", source.Path, target.Path, err)
+	}
+	if uint64(n) != size {
+		return fmt.Errorf("copy %s to %s: copied %d bytes, expected %d", source.Path, target.Path, n, size)
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("sync %s: %v", target.Path, err)
+	}
+	return nil
+}
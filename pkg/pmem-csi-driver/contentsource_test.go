@@ -0,0 +1,164 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestCopyDevice(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dir := t.TempDir()
+	source := &pmdmanager.PmemDeviceInfo{Path: filepath.Join(dir, "source"), Size: 11}
+	target := &pmdmanager.PmemDeviceInfo{Path: filepath.Join(dir, "target"), Size: 16}
+	require.NoError(t, os.WriteFile(source.Path, []byte("hello world"), 0600), "write source")
+	require.NoError(t, os.WriteFile(target.Path, []byte("xxxxxxxxxxxxxxxx"), 0600), "write target")
+
+	require.NoError(t, copyDevice(ctx, source, target, source.Size), "copy")
+	data, err := os.ReadFile(target.Path)
+	require.NoError(t, err, "read target")
+	assert.Equal(t, "hello worldxxxxx", string(data), "target content")
+
+	assert.Error(t, copyDevice(ctx, target, source, target.Size), "target too small")
+
+	fake := &pmdmanager.PmemDeviceInfo{Path: pmdmanager.FakeDevicePathPrefix + "/vol", Size: 1}
+	assert.NoError(t, copyDevice(ctx, source, fake, source.Size), "fake target")
+}
+
+func TestCloneVolume(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create volume state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+
+	capabilities := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}}
+	vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: capabilities,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume")
+
+	source := func(volumeID string) *csi.VolumeContentSource {
+		return &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: volumeID},
+			},
+		}
+	}
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:                "clone",
+		VolumeCapabilities:  capabilities,
+		VolumeContentSource: source("no-such-volume"),
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown source volume: %v", err)
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:                "clone",
+		VolumeCapabilities:  capabilities,
+		CapacityRange:       &csi.CapacityRange{LimitBytes: 1024},
+		VolumeContentSource: source(vol.Volume.VolumeId),
+	})
+	assert.Equal(t, codes.OutOfRange, status.Code(err), "too small for source: %v", err)
+
+	clone, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:                "clone",
+		VolumeCapabilities:  capabilities,
+		VolumeContentSource: source(vol.Volume.VolumeId),
+	})
+	require.NoError(t, err, "clone volume")
+	assert.NotEqual(t, vol.Volume.VolumeId, clone.Volume.VolumeId, "new volume")
+	assert.Equal(t, vol.Volume.CapacityBytes, clone.Volume.CapacityBytes, "clone size")
+	assert.Equal(t, vol.Volume.AccessibleTopology, clone.Volume.AccessibleTopology, "same node")
+	assert.Equal(t, source(vol.Volume.VolumeId), clone.Volume.ContentSource, "content source")
+
+	// The source is not busy anymore.
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.Volume.VolumeId})
+	require.NoError(t, err, "delete source volume")
+}
+
+// otherDeviceMode is a second fake device manager. All instances
+// share the same devices, like the real device managers do.
+const otherDeviceMode = api.DeviceMode("fake-other")
+
+var (
+	otherDM     pmdmanager.PmemDeviceManager
+	otherDMOnce sync.Once
+)
+
+func registerOtherDeviceMode(t *testing.T) pmdmanager.PmemDeviceManager {
+	otherDMOnce.Do(func() {
+		_, ctx := ktesting.NewTestContext(t)
+		dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+		require.NoError(t, err, "create other fake device manager")
+		otherDM = dm
+		pmdmanager.Register(otherDeviceMode, func(ctx context.Context, pmemPercentage uint, opts pmdmanager.Options) (pmdmanager.PmemDeviceManager, error) {
+			return otherDM, nil
+		})
+	})
+	return otherDM
+}
+
+func TestCloneVolumeOtherDeviceMode(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	other := registerOtherDeviceMode(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create volume state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+
+	capabilities := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}}
+	vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: capabilities,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume")
+
+	clone, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "clone",
+		VolumeCapabilities: capabilities,
+		Parameters:         map[string]string{parameters.DeviceMode: string(otherDeviceMode)},
+		VolumeContentSource: &csi.VolumeContentSource{
+			Type: &csi.VolumeContentSource_Volume{
+				Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: vol.Volume.VolumeId},
+			},
+		},
+	})
+	require.NoError(t, err, "clone volume")
+	_, err = other.GetDevice(ctx, clone.Volume.VolumeId)
+	assert.NoError(t, err, "clone in other device manager")
+	_, err = dm.GetDevice(ctx, clone.Volume.VolumeId)
+	assert.Error(t, err, "clone not in default device manager")
+
+	cs.discardVolume(ctx, clone.Volume.VolumeId)
+	_, err = other.GetDevice(ctx, clone.Volume.VolumeId)
+	assert.Error(t, err, "discarded clone removed from other device manager")
+	assert.Nil(t, cs.getVolumeByID(clone.Volume.VolumeId), "discarded clone removed from state")
+}
@@ -12,8 +12,11 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"slices"
+	"sort"
 	"strconv"
 	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
@@ -24,6 +27,7 @@ import (
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	pmemerr "github.com/intel/pmem-csi/pkg/errors"
 	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
@@ -37,15 +41,39 @@ type nodeVolume struct {
 	ID     string            `json:"id"`
 	Size   int64             `json:"size"`
 	Params map[string]string `json:"parameters"`
+	// Writer is the target path where the volume is published
+	// with SINGLE_NODE_SINGLE_WRITER access mode, if any.
+	Writer string `json:"writer,omitempty"`
+	// Staged describes how the volume was staged, if it is.
+	Staged *stagedVolume `json:"staged,omitempty"`
+	// RootPermissionsApplied is true once the mode and owner from
+	// the parameters were set on the root directory.
+	RootPermissionsApplied bool `json:"rootPermissionsApplied,omitempty"`
 }
 
 type nodeControllerServer struct {
 	*DefaultControllerServer
-	nodeID      string
-	dm          pmdmanager.PmemDeviceManager
-	sm          pmemstate.StateManager
-	pmemVolumes map[string]*nodeVolume // map of reqID:nodeVolume
-	mutex       sync.Mutex             // lock for pmemVolumes
+	nodeID        string
+	dm            pmdmanager.PmemDeviceManager
+	sm            pmemstate.StateManager
+	snapshotState pmemstate.StateManager   // snapshot records, nil if snapshots are not supported
+	dmOptions     pmdmanager.Options       // used for device managers of other modes than dm
+	deviceLinkDir string                   // directory with a symlink per volume, empty if disabled
+	pmemVolumes   map[string]*nodeVolume   // map of reqID:nodeVolume
+	pmemSnapshots map[string]*nodeSnapshot // map of snapshot ID:nodeSnapshot
+	mutex         sync.Mutex               // lock for pmemVolumes and pmemSnapshots
+	operations    *volumeOperations        // serializes operations which modify a volume
+	trash         pmemstate.StateManager   // deleted volumes which can still be restored, nil if not supported
+	retention     time.Duration            // how long deleted volumes stay in the trash, zero deletes them immediately
+	populator     *volumePopulator         // fills volumes with populateFrom parameter, nil if not supported
+	scrubber      *scrubber                // zeroes devices of deleted volumes in the background, nil if not supported
+	keys          keyProvider              // passphrases of encrypted volumes, nil takes them from the secrets
+	// deleted versions of a volume ID which stay in the trash, zero keeps all
+	maxTrashedPerVolume int
+	// parameters which users must not set, nil allows all
+	deniedParameters map[string]bool
+	// filesystem usage from NodeGetVolumeStats for the metrics data
+	usage volumeUsage
 }
 
 var _ csi.ControllerServer = &nodeControllerServer{}
@@ -53,21 +81,38 @@ var _ grpcserver.Service = &nodeControllerServer{}
 
 var nodeVolumeMutex = keymutex.NewHashed(-1)
 
-func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.PmemDeviceManager, sm pmemstate.StateManager) *nodeControllerServer {
+func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.PmemDeviceManager, sm, snapshotState pmemstate.StateManager, deviceLinkDir string, dmOptions pmdmanager.Options) *nodeControllerServer {
 	ctx, logger := pmemlog.WithName(ctx, "NewNodeControllerServer")
 
 	serverCaps := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
 		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
+		csi.ControllerServiceCapability_RPC_LIST_VOLUMES_PUBLISHED_NODES,
+		csi.ControllerServiceCapability_RPC_GET_VOLUME,
+		csi.ControllerServiceCapability_RPC_VOLUME_CONDITION,
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+	}
+	if snapshotState != nil {
+		serverCaps = append(serverCaps,
+			csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+			csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		)
 	}
 
 	ncs := &nodeControllerServer{
 		DefaultControllerServer: NewDefaultControllerServer(serverCaps),
 		nodeID:                  nodeID,
 		dm:                      dm,
+		dmOptions:               dmOptions,
 		sm:                      sm,
+		snapshotState:           snapshotState,
+		deviceLinkDir:           deviceLinkDir,
 		pmemVolumes:             map[string]*nodeVolume{},
+		pmemSnapshots:           map[string]*nodeSnapshot{},
+		operations:              newVolumeOperations(),
 	}
 
 	// Restore provisioned volumes from state.
@@ -97,15 +142,17 @@ func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.P
 			}
 
 			found := false
+			devicePath := ""
 			if v.GetDeviceMode() != dm.GetMode() {
-				dm, err := pmdmanager.New(ctx, v.GetDeviceMode(), 0)
+				dm, err := ncs.deviceManager(ctx, v.GetDeviceMode())
 				if err != nil {
 					logger.Error(err, "Failed to initialize device manager for state volume", "volume-id", id, "device-mode", v.GetDeviceMode())
 					continue
 				}
 
-				if _, err := dm.GetDevice(ctx, id); err == nil {
+				if device, err := dm.GetDevice(ctx, id); err == nil {
 					found = true
+					devicePath = device.Path
 				} else if !errors.Is(err, pmemerr.DeviceNotFound) {
 					logger.Error(err, "Failed to fetch device for state volume", "volume-id", id, "device-mode", v.GetDeviceMode())
 					// Let's ignore this volume
@@ -116,6 +163,7 @@ func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.P
 				for _, devInfo := range devices {
 					if devInfo.VolumeId == id {
 						found = true
+						devicePath = devInfo.Path
 						break
 					}
 				}
@@ -123,6 +171,9 @@ func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.P
 
 			if found {
 				ncs.pmemVolumes[id] = vol
+				if err := ncs.updateDeviceLink(id, devicePath); err != nil {
+					logger.Error(err, "Failed to update device link", "volume-id", id)
+				}
 			} else {
 				// if not found in DeviceManager's list, add to cleanupList
 				cleanupList = append(cleanupList, id)
@@ -130,10 +181,17 @@ func NewNodeControllerServer(ctx context.Context, nodeID string, dm pmdmanager.P
 		}
 
 		for _, id := range cleanupList {
-			if err := sm.Delete(id); err != nil {
+			// In read-only mode, stale entries are kept.
+			if err := sm.Delete(id); err != nil && !errors.Is(err, pmemerr.ReadOnly) {
 				logger.Error(err, "Failed to remove stale volume from state", "volume-id", id)
 			}
 		}
+		if err := ncs.pruneDeviceLinks(ncs.pmemVolumes); err != nil {
+			logger.Error(err, "Failed to remove stale device links")
+		}
+	}
+	if snapshotState != nil {
+		ncs.restoreSnapshots(ctx)
 	}
 
 	return ncs
@@ -160,26 +218,72 @@ func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
 	}
 
+	if err := cs.checkDeniedParameters(req.GetParameters()); err != nil {
+		return nil, err
+	}
 	p, err := parameters.Parse(parameters.CreateVolumeOrigin, req.GetParameters())
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, "persistent volume: "+err.Error())
 	}
+	if err := cs.checkPopulate(p, req); err != nil {
+		return nil, err
+	}
+	if p.GetEncryption() != parameters.EncryptionNone && req.GetVolumeContentSource() != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "parameter %q: encrypted volumes cannot be created from a snapshot or volume", parameters.Encryption)
+	}
 
 	nodeVolumeMutex.LockKey(req.Name)
 	defer func() {
 		_ = nodeVolumeMutex.UnlockKey(req.Name)
 	}()
 
+	capacity := req.GetCapacityRange()
+	var src *contentSource
+	if source := req.GetVolumeContentSource(); source != nil {
+		src, err = cs.getContentSource(ctx, source)
+		if err != nil {
+			return nil, err
+		}
+		defer src.release()
+		if limit := capacity.GetLimitBytes(); limit != 0 && limit < src.size {
+			return nil, status.Errorf(codes.OutOfRange, "%s size %d exceeds volume size limit %d", src.kind, src.size, limit)
+		}
+		if capacity.GetRequiredBytes() < src.size {
+			capacity = &csi.CapacityRange{
+				RequiredBytes: src.size,
+				LimitBytes:    capacity.GetLimitBytes(),
+			}
+		}
+	}
+	// Content only gets copied into new volumes.
+	exists := cs.getVolumeByName(req.Name) != nil
+
 	volumeID, size, err := cs.createVolumeInternal(ctx,
 		p,
 		req.Name,
 		req.GetVolumeCapabilities(),
-		req.GetCapacityRange(),
+		capacity,
+		req.GetSecrets(),
+		cs.numaNodesFromRequirements(req.GetAccessibilityRequirements()),
 	)
 	if err != nil {
 		// This is already a status error.
 		return nil, err
 	}
+	if src != nil && !exists {
+		progressFromContext(ctx).setStage("copying " + src.kind)
+		if err := src.copyTo(ctx, cs, volumeID); err != nil {
+			cs.discardVolume(ctx, volumeID)
+			return nil, status.Errorf(codes.Internal, "copy content of %s %q: %v", src.kind, src.id, err)
+		}
+	}
+	if p.GetPopulateFrom() != "" && !exists {
+		progressFromContext(ctx).setStage("populating")
+		if err := cs.populateVolume(ctx, volumeID, p, req.GetVolumeCapabilities()); err != nil {
+			cs.discardVolume(ctx, volumeID)
+			return nil, status.Errorf(codes.Internal, "populate volume from %q: %v", p.GetPopulateFrom(), err)
+		}
+	}
 
 	topology = append(topology, &csi.Topology{
 		Segments: map[string]string{
@@ -188,7 +292,11 @@ func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 	})
 
 	// Prepare the volume context. Including the name is useful for logging.
+	// The device link is meant for tools outside of Kubernetes.
 	p.Name = &req.Name
+	if link := cs.deviceLink(volumeID); link != "" {
+		p.DeviceLink = &link
+	}
 	volumeContext := p.ToContext()
 
 	resp = &csi.CreateVolumeResponse{
@@ -197,6 +305,7 @@ func (cs *nodeControllerServer) CreateVolume(ctx context.Context, req *csi.Creat
 			CapacityBytes:      size,
 			AccessibleTopology: topology,
 			VolumeContext:      volumeContext,
+			ContentSource:      req.GetVolumeContentSource(),
 		},
 	}
 
@@ -212,6 +321,8 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 	volumeName string,
 	volumeCapabilities []*csi.VolumeCapability,
 	capacity *csi.CapacityRange,
+	secrets parameters.Secrets,
+	numaNodes pmdmanager.NUMANodes,
 ) (volumeID string, actual int64, statusErr error) {
 	logger := klog.FromContext(ctx).WithValues("volume-name", volumeName)
 	ctx = klog.NewContext(ctx, logger)
@@ -228,6 +339,10 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 			statusErr = status.Error(codes.AlreadyExists, fmt.Sprintf("smaller volume with the same name %q already exists", volumeName))
 			return
 		}
+		if p.DeviceMode != nil && vol.Params[parameters.DeviceMode] != string(*p.DeviceMode) {
+			statusErr = status.Errorf(codes.AlreadyExists, "volume with the same name %q already exists with device mode %s", volumeName, vol.Params[parameters.DeviceMode])
+			return
+		}
 		// Use existing volume, it's the one the caller asked
 		// for earlier (idempotent call):
 		volumeID = vol.ID
@@ -237,7 +352,7 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 
 	volumeID = generateVolumeID(volumeName)
 	logger = logger.WithValues("volume-id", volumeID)
-	logger.V(4).Info("Creating new volume", "minimum-size", pmemlog.CapacityRef(asked), "maximum-size", pmemlog.CapacityRef(capacity.GetLimitBytes()))
+	logger.V(4).Info("Creating new volume", "minimum-size", pmemlog.CapacityRef(asked), "maximum-size", pmemlog.CapacityRef(capacity.GetLimitBytes()), "secret-keys", secrets.Keys())
 	ctx = klog.NewContext(ctx, logger)
 
 	// Check do we have entry with newly generated VolumeID already
@@ -250,10 +365,76 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 		return
 	}
 
-	// Set which device manager was used to create the volume
+	// An expansion request for the new volume must wait until it
+	// exists.
+	end, err := cs.operations.begin(ctx, volumeID, phaseCreating)
+	if err != nil {
+		statusErr = err
+		return
+	}
+	defer end()
+
+	// The StorageClass may ask for a device mode other than the
+	// default one of the driver. Set which device manager was used
+	// to create the volume, it is needed again for all other
+	// operations on it.
 	mode := cs.dm.GetMode()
+	if p.DeviceMode != nil {
+		mode = *p.DeviceMode
+	}
+	// Custom device managers which were linked into the driver
+	// binary are supported, the fake one only as default.
+	if mode != cs.dm.GetMode() && (mode == api.DeviceModeFake || !slices.Contains(pmdmanager.Registered(), mode)) {
+		statusErr = status.Errorf(codes.InvalidArgument, "device mode %s not supported for volumes", mode)
+		return
+	}
+	if mode == api.DeviceModeDevdax {
+		// There is no filesystem on a character device.
+		for _, capability := range volumeCapabilities {
+			if capability.GetBlock() == nil {
+				statusErr = status.Error(codes.InvalidArgument, "devdax volumes only support raw block access")
+				return
+			}
+		}
+	}
+	var passphrase string
+	if p.GetEncryption() != parameters.EncryptionNone {
+		for _, capability := range volumeCapabilities {
+			if capability.GetBlock() != nil {
+				statusErr = status.Error(codes.InvalidArgument, "encrypted volumes only support filesystem access")
+				return
+			}
+		}
+		passphrase, statusErr = cs.keyProvider().createKey(ctx, volumeID, secrets)
+		if statusErr != nil {
+			return
+		}
+	}
+	if p.GetEnforceSize() {
+		// Checked here instead of failing later in NodeStageVolume.
+		for _, capability := range volumeCapabilities {
+			if mount := capability.GetMount(); mount != nil && mount.GetFsType() != "xfs" {
+				fsType := mount.GetFsType()
+				if fsType == "" {
+					fsType = defaultFilesystem + " (the default)"
+				}
+				statusErr = status.Errorf(codes.InvalidArgument, "parameter %q needs csi.storage.k8s.io/fstype: xfs, not %s", parameters.EnforceSize, fsType)
+				return
+			}
+		}
+	}
 	p.DeviceMode = &mode
+	dm, err := cs.deviceManager(ctx, mode)
+	if err != nil {
+		statusErr = status.Errorf(codes.FailedPrecondition, "initialize device manager for mode %s: %v", mode, err)
+		return
+	}
 
+	if p.GetEnforceSize() && asked > 0 {
+		// The device may become larger, the filesystem must
+		// not.
+		p.Size = &asked
+	}
 	vol := &nodeVolume{
 		ID:     volumeID,
 		Size:   asked,
@@ -277,16 +458,44 @@ func (cs *nodeControllerServer) createVolumeInternal(ctx context.Context,
 			}
 		}()
 	}
-	actualSize, err := cs.dm.CreateDevice(ctx, volumeID, uint64(asked), p.GetUsage())
+	progressFromContext(ctx).setStage("creating device")
+	actualSize, err := cs.createDevice(ctx, dm, volumeID, asked, p, numaNodes)
 	if err != nil {
 		code := codes.Internal
-		if errors.Is(err, pmemerr.NotEnoughSpace) {
+		switch {
+		case errors.Is(err, pmemerr.NotEnoughSpace):
 			code = codes.ResourceExhausted
+		case errors.Is(err, pmemerr.NotSupported):
+			code = codes.InvalidArgument
 		}
 		statusErr = status.Errorf(code, "device creation failed: %v", err)
 		return
 	}
 	actual = int64(actualSize)
+	if passphrase != "" {
+		progressFromContext(ctx).setStage("formatting for encryption")
+		device, err := dm.GetDevice(ctx, volumeID)
+		if err == nil {
+			err = luksFormat(ctx, device.Path, passphrase)
+		}
+		if err != nil {
+			if err := dm.DeleteDevice(ctx, volumeID, false); err != nil {
+				logger.Error(err, "Deleting unencrypted device failed")
+			}
+			statusErr = status.Errorf(codes.Internal, "encrypt volume: %v", err)
+			return
+		}
+	}
+	if cs.deviceLinkDir != "" {
+		device, err := dm.GetDevice(ctx, volumeID)
+		if err == nil {
+			err = cs.updateDeviceLink(volumeID, device.Path)
+		}
+		if err != nil {
+			// Not fatal, the volume itself is usable.
+			logger.Error(err, "Creating device link failed")
+		}
+	}
 	if vol.Size != actual {
 		// Update volume size and store that persistently.
 		vol.Size = actual
@@ -326,6 +535,12 @@ func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 	nodeVolumeMutex.LockKey(volumeID)
 	defer nodeVolumeMutex.UnlockKey(volumeID) //nolint: errcheck
 
+	end, err := cs.operations.begin(ctx, volumeID, phaseDeleting)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
 	logger.V(4).Info("Starting to delete volume")
 	vol := cs.getVolumeByID(volumeID)
 	if vol == nil {
@@ -340,26 +555,59 @@ func (cs *nodeControllerServer) DeleteVolume(ctx context.Context, req *csi.Delet
 		return nil, status.Errorf(codes.Internal, "previously stored volume parameters for volume with ID %q: %v", volumeID, err)
 	}
 
-	dm := cs.dm
-	if dm.GetMode() != p.GetDeviceMode() {
-		dm, err = pmdmanager.New(ctx, p.GetDeviceMode(), 0)
-		if err != nil {
-			return nil, status.Errorf(codes.Internal, "failed to initialize device manager for volume with ID %q and mode %s: %v", volumeID, p.GetDeviceMode(), err)
+	dm, err := cs.deviceManager(ctx, p.GetDeviceMode())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to initialize device manager for volume with ID %q and mode %s: %v", volumeID, p.GetDeviceMode(), err)
+	}
+	if p.GetEncryption() != parameters.EncryptionNone {
+		// Normally already closed by NodeUnstageVolume.
+		if err := luksClose(ctx, volumeID); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 
-	if err := dm.DeleteDevice(ctx, req.VolumeId, p.GetEraseAfter()); err != nil {
+	trashed := false
+	if cs.trash != nil && cs.retention > 0 && p.GetPersistency() != parameters.PersistencyEphemeral {
+		err := cs.moveToTrash(ctx, dm, vol)
+		switch {
+		case err == nil:
+			trashed = true
+		case errors.Is(err, pmemerr.NotSupported):
+			logger.Info("Volume cannot be moved to the trash, erasing it", "device-mode", dm.GetMode(), "reason", err.Error())
+		default:
+			return nil, status.Errorf(codes.Internal, "Failed to move volume to trash: %s", err.Error())
+		}
+	}
+	if !trashed && p.GetErasePolicy() == parameters.EraseCrypto {
+		if err := cryptoErase(ctx, dm, req.VolumeId); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to delete volume: %s", err.Error())
+		}
+	}
+	if trashed {
+		// Gets erased or restored later.
+	} else if p.GetEraseAfter() && cs.freeDevice(ctx, dm, req.VolumeId, vol.Size) {
+		// Gets zeroed in the background.
+	} else if err := dm.DeleteDevice(ctx, req.VolumeId, p.GetEraseAfter()); err != nil {
 		if errors.Is(err, pmemerr.DeviceInUse) {
 			return nil, status.Errorf(codes.FailedPrecondition, err.Error())
 		}
 		return nil, status.Errorf(codes.Internal, "Failed to delete volume: %s", err.Error())
 	}
+	if err := cs.removeDeviceLink(req.VolumeId); err != nil {
+		logger.Error(err, "Failed to remove device link")
+	}
+	if !trashed && p.GetEncryption() != parameters.EncryptionNone {
+		if err := cs.keyProvider().deleteKey(ctx, req.VolumeId); err != nil {
+			logger.Error(err, "Failed to delete encryption key")
+		}
+	}
 	if cs.sm != nil {
 		if err := cs.sm.Delete(req.VolumeId); err != nil {
 			logger.Error(err, "Failed to remove volume from state")
 		}
 	}
 
+	cs.usage.forget(req.VolumeId)
 	cs.mutex.Lock()
 	defer cs.mutex.Unlock()
 	delete(cs.pmemVolumes, req.VolumeId)
@@ -383,7 +631,7 @@ func (cs *nodeControllerServer) ValidateVolumeCapabilities(ctx context.Context,
 		return nil, status.Error(codes.NotFound, "Volume not created by this controller")
 	}
 	for _, cap := range req.VolumeCapabilities {
-		if cap.GetAccessMode().GetMode() != csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER {
+		if !supportedAccessModes[cap.GetAccessMode().GetMode()] {
 			return &csi.ValidateVolumeCapabilitiesResponse{
 				Confirmed: nil,
 				Message:   "Driver does not support '" + cap.AccessMode.Mode.String() + "' mode",
@@ -403,14 +651,17 @@ func (cs *nodeControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 		return nil, err
 	}
 
+	// Copy from map into array for pagination. Sorting ensures
+	// that the order is the same for all calls.
 	cs.mutex.Lock()
-	defer cs.mutex.Unlock()
-
-	// Copy from map into array for pagination.
 	vols := make([]*nodeVolume, 0, len(cs.pmemVolumes))
 	for _, vol := range cs.pmemVolumes {
 		vols = append(vols, vol)
 	}
+	cs.mutex.Unlock()
+	sort.Slice(vols, func(i, j int) bool {
+		return vols[i].ID < vols[j].ID
+	})
 
 	// Code originally copied from https://github.com/kubernetes-csi/csi-test/blob/f14e3d32125274e0c3a3a5df380e1f89ff7c132b/mock/service/controller.go#L309-L365
 
@@ -455,12 +706,23 @@ func (cs *nodeControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 			maxEntries)
 	)
 
+	// Devices get listed once per device manager.
+	devices := map[api.DeviceMode]map[string]bool{}
 	for i = 0; i < len(entries); i++ {
 		vol := vols[j]
+		mode := cs.volumeDeviceMode(vol)
+		if devices[mode] == nil {
+			names, err := cs.deviceNames(ctx, mode)
+			if err != nil {
+				return nil, err
+			}
+			devices[mode] = names
+		}
 		entries[i] = &csi.ListVolumesResponse_Entry{
-			Volume: &csi.Volume{
-				VolumeId:      vol.ID,
-				CapacityBytes: vol.Size,
+			Volume: cs.csiVolume(vol),
+			Status: &csi.ListVolumesResponse_VolumeStatus{
+				PublishedNodeIds: []string{cs.nodeID},
+				VolumeCondition:  volumeCondition(devices[mode][vol.ID]),
 			},
 		}
 		j++
@@ -478,13 +740,24 @@ func (cs *nodeControllerServer) ListVolumes(ctx context.Context, req *csi.ListVo
 }
 
 func (cs *nodeControllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
+	// Volumes created by this instance are only accessible on this
+	// node. A request without topology, for example for a storage
+	// class with immediate binding, gets the capacity of the node
+	// because that is where such a volume would be created.
+	if nodeID, ok := req.GetAccessibleTopology().GetSegments()[DriverTopologyKey]; ok && nodeID != cs.nodeID {
+		return &csi.GetCapacityResponse{
+			MaximumVolumeSize: wrapperspb.Int64(0),
+		}, nil
+	}
+
 	cap, err := cs.dm.GetCapacity(ctx)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 
 	return &csi.GetCapacityResponse{
-		AvailableCapacity: int64(cap.Available),
+		// Freed devices get released when needed.
+		AvailableCapacity: int64(cap.Available) + cs.scrubber.freedCapacity(cs.dm.GetMode()),
 		// This is what Kubernetes >= 1.21 will use.
 		MaximumVolumeSize: wrapperspb.Int64(int64(cap.MaxVolumeSize)),
 	}, nil
@@ -510,12 +783,190 @@ func (cs *nodeControllerServer) getVolumeByName(volumeName string) *nodeVolume {
 	return nil
 }
 
-func (cs *nodeControllerServer) ControllerExpandVolume(context.Context, *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (cs *nodeControllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID)
+	ctx = klog.NewContext(ctx, logger)
+
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME); err != nil {
+		return nil, err
+	}
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if req.GetCapacityRange() == nil {
+		return nil, status.Error(codes.InvalidArgument, "Capacity range missing in request")
+	}
+
+	// Kubernetes may ask for the expansion while the volume is
+	// still being created or staged. That is not an error, the
+	// expansion simply happens afterwards.
+	end, err := cs.operations.begin(ctx, volumeID, phaseExpanding)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	vol := cs.getVolumeByID(volumeID)
+	if vol == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %q not found", volumeID)
+	}
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "previously stored volume parameters for volume with ID %q: %v", volumeID, err)
+	}
+	// Only filesystems need to be grown on the node.
+	nodeExpansionRequired := req.GetVolumeCapability().GetBlock() == nil
+
+	asked := req.GetCapacityRange().GetRequiredBytes()
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit != 0 && limit < vol.Size {
+		return nil, status.Errorf(codes.OutOfRange, "volume with size %d cannot shrink to limit %d", vol.Size, limit)
+	}
+	// With enforceSize, the size of the filesystem grows with the
+	// request even when the device is already large enough.
+	enforce := p.GetEnforceSize() && asked > p.GetSize()
+	if asked <= vol.Size {
+		if enforce {
+			cs.mutex.Lock()
+			defer cs.mutex.Unlock()
+			vol.Params[parameters.Size] = fmt.Sprintf("%d", asked)
+			if cs.sm != nil {
+				if err := cs.sm.Create(volumeID, vol); err != nil {
+					return nil, status.Error(codes.Internal, "store state: "+err.Error())
+				}
+			}
+		}
+		// Nothing else to do.
+		return &csi.ControllerExpandVolumeResponse{
+			CapacityBytes:         vol.Size,
+			NodeExpansionRequired: nodeExpansionRequired,
+		}, nil
+	}
+
+	dm, err := cs.deviceManager(ctx, p.GetDeviceMode())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to initialize device manager for volume with ID %q and mode %s: %v", volumeID, p.GetDeviceMode(), err)
+	}
+	logger.V(4).Info("Expanding volume", "old-size", pmemlog.CapacityRef(vol.Size), "new-size", pmemlog.CapacityRef(asked))
+	actualSize, err := dm.ResizeDevice(ctx, volumeID, uint64(asked))
+	if err != nil {
+		code := codes.Internal
+		switch {
+		case errors.Is(err, pmemerr.NotEnoughSpace):
+			code = codes.ResourceExhausted
+		case errors.Is(err, pmemerr.NotSupported):
+			code = codes.FailedPrecondition
+		}
+		return nil, status.Errorf(code, "device expansion failed: %v", err)
+	}
+	if limit := req.GetCapacityRange().GetLimitBytes(); limit != 0 && int64(actualSize) > limit {
+		// Can't be undone, so just log it.
+		logger.Error(nil, "Expanded volume exceeds size limit", "size", pmemlog.CapacityRef(int64(actualSize)), "limit", pmemlog.CapacityRef(limit))
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	vol.Size = int64(actualSize)
+	if enforce {
+		vol.Params[parameters.Size] = fmt.Sprintf("%d", asked)
+	}
+	if cs.sm != nil {
+		if err := cs.sm.Create(volumeID, vol); err != nil {
+			// Same situation as in createVolumeInternal: the
+			// device was modified, so proceed.
+			logger.Error(err, "Updating state with new volume size failed")
+		}
+	}
+	logger.V(4).Info("Expanded volume", "size", pmemlog.CapacityRef(vol.Size))
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         vol.Size,
+		NodeExpansionRequired: nodeExpansionRequired,
+	}, nil
+}
+
+func (cs *nodeControllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_GET_VOLUME); err != nil {
+		return nil, err
+	}
+	volumeID := req.GetVolumeId()
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	vol := cs.getVolumeByID(volumeID)
+	if vol == nil {
+		return nil, status.Errorf(codes.NotFound, "no volume found with volume id %q", volumeID)
+	}
+	dm, err := cs.deviceManager(ctx, cs.volumeDeviceMode(vol))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "device manager for volume: %v", err)
+	}
+	_, err = dm.GetDevice(ctx, volumeID)
+	if err != nil && !errors.Is(err, pmemerr.DeviceNotFound) {
+		return nil, status.Errorf(codes.Internal, "get device: %v", err)
+	}
+	return &csi.ControllerGetVolumeResponse{
+		Volume: cs.csiVolume(vol),
+		Status: &csi.ControllerGetVolumeResponse_VolumeStatus{
+			PublishedNodeIds: []string{cs.nodeID},
+			VolumeCondition:  volumeCondition(err == nil),
+		},
+	}, nil
 }
 
-func (cs *nodeControllerServer) ControllerGetVolume(context.Context, *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+// csiVolume describes a volume for ListVolumes and ControllerGetVolume.
+// Volumes are only accessible on the node where they were created and
+// considered published there because that node is also the one
+// which stages and publishes them.
+func (cs *nodeControllerServer) csiVolume(vol *nodeVolume) *csi.Volume {
+	return &csi.Volume{
+		VolumeId:      vol.ID,
+		CapacityBytes: vol.Size,
+		AccessibleTopology: []*csi.Topology{{
+			Segments: map[string]string{
+				DriverTopologyKey: cs.nodeID,
+			},
+		}},
+	}
+}
+
+// volumeDeviceMode returns the mode selected for the volume when
+// creating it, which may be empty for the default mode.
+func (cs *nodeControllerServer) volumeDeviceMode(vol *nodeVolume) api.DeviceMode {
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+	if err != nil {
+		return ""
+	}
+	return p.GetDeviceMode()
+}
+
+// deviceNames returns the IDs of all volumes which have a device.
+func (cs *nodeControllerServer) deviceNames(ctx context.Context, mode api.DeviceMode) (map[string]bool, error) {
+	dm, err := cs.deviceManager(ctx, mode)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "device manager for mode %q: %v", mode, err)
+	}
+	devices, err := dm.ListDevices(ctx)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "list devices: %v", err)
+	}
+	names := map[string]bool{}
+	for _, device := range devices {
+		names[device.VolumeId] = true
+	}
+	return names, nil
+}
+
+func volumeCondition(haveDevice bool) *csi.VolumeCondition {
+	if !haveDevice {
+		return &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  "device of the volume is missing, the namespace or logical volume might have been removed",
+		}
+	}
+	return &csi.VolumeCondition{
+		Message: "volume is healthy",
+	}
 }
 
 func generateVolumeID(name string) string {
@@ -0,0 +1,205 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestVolumeDeviceMode(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create volume state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+
+	request := func(name, mode string) *csi.CreateVolumeRequest {
+		req := &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			}},
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		}
+		if mode != "" {
+			req.Parameters = map[string]string{parameters.DeviceMode: mode}
+		}
+		return req
+	}
+
+	vol, err := cs.CreateVolume(ctx, request("vol", string(api.DeviceModeFake)))
+	require.NoError(t, err, "create volume")
+	assert.Equal(t, string(api.DeviceModeFake), vol.Volume.VolumeContext[parameters.DeviceMode], "device mode in volume context")
+	assert.Equal(t, string(api.DeviceModeFake), cs.getVolumeByID(vol.Volume.VolumeId).Params[parameters.DeviceMode], "stored device mode")
+
+	_, err = cs.CreateVolume(ctx, request("vol", ""))
+	assert.NoError(t, err, "idempotent create without device mode")
+	_, err = cs.CreateVolume(ctx, request("vol", string(api.DeviceModeDirect)))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "different device mode: %v", err)
+	_, err = cs.CreateVolume(ctx, request("other", "foo"))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "invalid device mode: %v", err)
+	_, err = cs.CreateVolume(ctx, request("other", string(api.DeviceModeDevdax)))
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "devdax with filesystem: %v", err)
+
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.Volume.VolumeId})
+	require.NoError(t, err, "delete volume")
+}
+
+func TestGetCapacityTopology(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	cs := NewNodeControllerServer(ctx, "node", dm, nil, nil, "", pmdmanager.Options{})
+	DriverTopologyKey = driverName + "/node"
+
+	for name, tc := range map[string]struct {
+		topology      *csi.Topology
+		expectNothing bool
+	}{
+		"no topology":   {},
+		"this node":     {topology: &csi.Topology{Segments: map[string]string{DriverTopologyKey: "node"}}},
+		"other segment": {topology: &csi.Topology{Segments: map[string]string{"zone": "a"}}},
+		"other node":    {topology: &csi.Topology{Segments: map[string]string{DriverTopologyKey: "other"}}, expectNothing: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			resp, err := cs.GetCapacity(ctx, &csi.GetCapacityRequest{AccessibleTopology: tc.topology})
+			require.NoError(t, err, "get capacity")
+			if tc.expectNothing {
+				assert.Zero(t, resp.AvailableCapacity, "available")
+				assert.Zero(t, resp.MaximumVolumeSize.GetValue(), "maximum volume size")
+			} else {
+				assert.NotZero(t, resp.AvailableCapacity, "available")
+				assert.NotZero(t, resp.MaximumVolumeSize.GetValue(), "maximum volume size")
+			}
+		})
+	}
+}
+
+func TestListAndGetVolumes(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create volume state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+
+	var volumeIDs []string
+	for _, name := range []string{"vol-c", "vol-a", "vol-b"} {
+		vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			}},
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		})
+		require.NoError(t, err, "create volume %s", name)
+		volumeIDs = append(volumeIDs, vol.Volume.VolumeId)
+	}
+	missing := volumeIDs[0]
+	require.NoError(t, dm.DeleteDevice(ctx, missing, false), "remove device behind the back of the driver")
+
+	var listed []string
+	token := ""
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, len(volumeIDs), "too many pages")
+		resp, err := cs.ListVolumes(ctx, &csi.ListVolumesRequest{MaxEntries: 1, StartingToken: token})
+		require.NoError(t, err, "list volumes")
+		require.Len(t, resp.Entries, 1, "entries")
+		entry := resp.Entries[0]
+		listed = append(listed, entry.Volume.VolumeId)
+		assert.Equal(t, []string{"node"}, entry.Status.PublishedNodeIds, "published nodes of %s", entry.Volume.VolumeId)
+		assert.Equal(t, entry.Volume.VolumeId == missing, entry.Status.VolumeCondition.Abnormal, "condition of %s: %s", entry.Volume.VolumeId, entry.Status.VolumeCondition.Message)
+		token = resp.NextToken
+		if token == "" {
+			break
+		}
+	}
+	assert.ElementsMatch(t, volumeIDs, listed, "listed volumes")
+	assert.IsIncreasing(t, listed, "sorted volumes")
+
+	_, err = cs.ListVolumes(ctx, &csi.ListVolumesRequest{StartingToken: "invalid-token"})
+	assert.Equal(t, codes.Aborted, status.Code(err), "invalid token: %v", err)
+
+	for _, volumeID := range volumeIDs {
+		resp, err := cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: volumeID})
+		require.NoError(t, err, "get volume %s", volumeID)
+		assert.Equal(t, volumeID, resp.Volume.VolumeId, "volume ID")
+		assert.Equal(t, int64(1024*1024), resp.Volume.CapacityBytes, "capacity of %s", volumeID)
+		assert.Equal(t, []string{"node"}, resp.Status.PublishedNodeIds, "published nodes of %s", volumeID)
+		assert.Equal(t, volumeID == missing, resp.Status.VolumeCondition.Abnormal, "condition of %s: %s", volumeID, resp.Status.VolumeCondition.Message)
+	}
+	_, err = cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{VolumeId: "no-such-volume"})
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown volume: %v", err)
+	_, err = cs.ControllerGetVolume(ctx, &csi.ControllerGetVolumeRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "missing volume ID: %v", err)
+}
+
+func TestEnforceSize(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create volume state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	ns := NewNodeServer(cs, t.TempDir())
+
+	capability := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs"}},
+	}
+	vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		Parameters:         map[string]string{parameters.EnforceSize: "true"},
+	})
+	require.NoError(t, err, "create volume")
+	_, err = parameters.Parse(parameters.PersistentVolumeOrigin, vol.Volume.VolumeContext)
+	require.NoError(t, err, "volume context")
+	volumeID := vol.Volume.VolumeId
+	assert.Equal(t, int64(1024*1024), ns.enforcedSize(volumeID), "initial size")
+
+	_, err = cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:         volumeID,
+		CapacityRange:    &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024},
+		VolumeCapability: capability,
+	})
+	require.NoError(t, err, "expand volume")
+	assert.Equal(t, int64(2*1024*1024), ns.enforcedSize(volumeID), "expanded size")
+
+	vol, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "other",
+		VolumeCapabilities: []*csi.VolumeCapability{capability},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+	})
+	require.NoError(t, err, "create other volume")
+	assert.Equal(t, int64(0), ns.enforcedSize(vol.Volume.VolumeId), "not enforced")
+
+	for _, fsType := range []string{"", "ext4"} {
+		_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: "ext4-" + fsType,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+			}},
+			CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+			Parameters:    map[string]string{parameters.EnforceSize: "true"},
+		})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err), "fstype %q: %v", fsType, err)
+	}
+}
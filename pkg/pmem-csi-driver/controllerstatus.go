@@ -0,0 +1,274 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/ptr"
+
+	"github.com/intel/pmem-csi/pkg/k8sutil"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+// controllerStatusSuffix gets appended to the metrics path for the
+// JSON description of the controller replicas.
+const controllerStatusSuffix = "/controller"
+
+// heartbeatLabel is set on the heartbeat Lease objects of the
+// controller replicas. The value is the name of the Lease for leader
+// election, which identifies the driver.
+const heartbeatLabel = "pmem-csi.intel.com/controller-heartbeat"
+
+// staleHeartbeat is how old a heartbeat must be before the active
+// replica deletes it. Replicas get new names after an upgrade, so
+// their Lease objects would accumulate otherwise.
+const staleHeartbeat = 10 * time.Minute
+
+var (
+	controllerActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pmem_controller_active",
+			Help: "1 while this controller replica runs the rescheduler and the other controller components, 0 while it waits as hot spare.",
+		},
+	)
+	controllerHeartbeat = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "pmem_controller_heartbeat_timestamp_seconds",
+			Help: "Time of the last successful heartbeat of this controller replica, in seconds since the Unix epoch.",
+		},
+	)
+)
+
+// MustRegisterControllerMetrics adds the metrics of the controller
+// status to the registry, using a label to tag each sample with the
+// driver name.
+func MustRegisterControllerMetrics(reg prometheus.Registerer, driverName string) {
+	reg = prometheus.WrapRegistererWith(prometheus.Labels{"driver_name": driverName}, reg)
+	reg.MustRegister(controllerActive)
+	reg.MustRegister(controllerHeartbeat)
+}
+
+// controllerStatus tracks which controller replica is active. With
+// heartbeats, each replica renews its own Lease object, so every
+// replica can list all of them.
+type controllerStatus struct {
+	client    kubernetes.Interface
+	namespace string
+	identity  string
+	// leaseName is the name of the Lease for leader election,
+	// which is also the prefix of the heartbeat Lease objects.
+	leaseName      string
+	leaderElection bool
+	// heartbeatInterval is zero when heartbeats are disabled.
+	heartbeatInterval time.Duration
+	active            atomic.Bool
+}
+
+// controllerReplica describes one replica in the status.
+type controllerReplica struct {
+	Identity  string       `json:"identity"`
+	Heartbeat *metav1.Time `json:"heartbeat,omitempty"`
+	// Alive is false when the replica missed several heartbeats.
+	Alive  bool `json:"alive"`
+	Leader bool `json:"leader,omitempty"`
+}
+
+// controllerStatusReport is what the status endpoint returns.
+type controllerStatusReport struct {
+	Identity       string `json:"identity"`
+	Active         bool   `json:"active"`
+	LeaderElection bool   `json:"leaderElection"`
+	// Leader is empty without leader election, then all replicas
+	// are active.
+	Leader   string              `json:"leader,omitempty"`
+	Replicas []controllerReplica `json:"replicas,omitempty"`
+}
+
+// newControllerStatus creates the status for the controller replica
+// which runs in this process.
+func (csid *csiDriver) newControllerStatus() (*controllerStatus, error) {
+	client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+	if err != nil {
+		return nil, fmt.Errorf("connect to apiserver: %v", err)
+	}
+	identity, err := os.Hostname()
+	if err != nil {
+		return nil, fmt.Errorf("controller identity: %v", err)
+	}
+	return &controllerStatus{
+		client:            client,
+		namespace:         csid.leaderElectionNamespace(),
+		identity:          identity,
+		leaseName:         leaseName(csid.cfg.DriverName),
+		leaderElection:    csid.cfg.leaderElection,
+		heartbeatInterval: csid.cfg.controllerHeartbeatInterval,
+	}, nil
+}
+
+// setActive records whether the controller components run in this
+// replica.
+func (st *controllerStatus) setActive(active bool) {
+	st.active.Store(active)
+	if active {
+		controllerActive.Set(1)
+	} else {
+		controllerActive.Set(0)
+	}
+}
+
+func (st *controllerStatus) heartbeatLeaseName() string {
+	return st.leaseName + "-" + st.identity
+}
+
+// run renews the heartbeat periodically until the context is
+// canceled. Failures only get logged.
+func (st *controllerStatus) run(ctx context.Context) {
+	logger := klog.FromContext(ctx).WithName("controller-heartbeat")
+	ctx = klog.NewContext(ctx, logger)
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := st.heartbeat(ctx); err != nil {
+			logger.Error(err, "Heartbeat failed")
+		}
+	}, st.heartbeatInterval)
+}
+
+func (st *controllerStatus) heartbeat(ctx context.Context) error {
+	leases := st.client.CoordinationV1().Leases(st.namespace)
+	now := metav1.NewMicroTime(time.Now())
+	lease, err := leases.Get(ctx, st.heartbeatLeaseName(), metav1.GetOptions{})
+	switch {
+	case apierrs.IsNotFound(err):
+		lease = &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      st.heartbeatLeaseName(),
+				Namespace: st.namespace,
+				Labels:    map[string]string{heartbeatLabel: st.leaseName},
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity: ptr.To(st.identity),
+				// Three missed heartbeats mark the replica as dead.
+				LeaseDurationSeconds: ptr.To(int32(3 * st.heartbeatInterval / time.Second)),
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}
+		if _, err := leases.Create(ctx, lease, metav1.CreateOptions{}); err != nil {
+			return fmt.Errorf("create Lease: %v", err)
+		}
+	case err != nil:
+		return fmt.Errorf("get Lease: %v", err)
+	default:
+		lease.Spec.RenewTime = &now
+		if _, err := leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("update Lease: %v", err)
+		}
+	}
+	controllerHeartbeat.Set(float64(now.UnixNano()) / float64(time.Second))
+	klog.FromContext(ctx).V(5).Info("Renewed heartbeat", "lease", pmemlog.KObj(lease))
+
+	if st.active.Load() {
+		return st.removeStaleHeartbeats(ctx)
+	}
+	return nil
+}
+
+func (st *controllerStatus) listHeartbeats(ctx context.Context) ([]coordinationv1.Lease, error) {
+	list, err := st.client.CoordinationV1().Leases(st.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labels.Set{heartbeatLabel: st.leaseName}.String(),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("list Lease objects: %v", err)
+	}
+	return list.Items, nil
+}
+
+func (st *controllerStatus) removeStaleHeartbeats(ctx context.Context) error {
+	leases, err := st.listHeartbeats(ctx)
+	if err != nil {
+		return err
+	}
+	for _, lease := range leases {
+		if lease.Name == st.heartbeatLeaseName() ||
+			lease.Spec.RenewTime != nil && time.Since(lease.Spec.RenewTime.Time) < staleHeartbeat {
+			continue
+		}
+		if err := st.client.CoordinationV1().Leases(st.namespace).Delete(ctx, lease.Name, metav1.DeleteOptions{}); err != nil && !apierrs.IsNotFound(err) {
+			return fmt.Errorf("delete stale Lease %s: %v", lease.Name, err)
+		}
+		klog.FromContext(ctx).V(3).Info("Removed stale heartbeat", "lease", pmemlog.KObj(&lease))
+	}
+	return nil
+}
+
+// report collects the current status.
+func (st *controllerStatus) report(ctx context.Context) (*controllerStatusReport, error) {
+	report := &controllerStatusReport{
+		Identity:       st.identity,
+		Active:         st.active.Load(),
+		LeaderElection: st.leaderElection,
+	}
+	if st.leaderElection {
+		lease, err := st.client.CoordinationV1().Leases(st.namespace).Get(ctx, st.leaseName, metav1.GetOptions{})
+		switch {
+		case err == nil:
+			report.Leader = ptr.Deref(lease.Spec.HolderIdentity, "")
+		case !apierrs.IsNotFound(err):
+			return nil, fmt.Errorf("get Lease: %v", err)
+		}
+	}
+	if st.heartbeatInterval == 0 {
+		return report, nil
+	}
+	leases, err := st.listHeartbeats(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, lease := range leases {
+		replica := controllerReplica{
+			Identity: ptr.Deref(lease.Spec.HolderIdentity, ""),
+		}
+		if renewTime := lease.Spec.RenewTime; renewTime != nil {
+			replica.Heartbeat = &metav1.Time{Time: renewTime.Time}
+			duration := time.Duration(ptr.Deref(lease.Spec.LeaseDurationSeconds, 0)) * time.Second
+			replica.Alive = time.Since(renewTime.Time) < duration
+		}
+		replica.Leader = st.leaderElection && replica.Identity == report.Leader
+		report.Replicas = append(report.Replicas, replica)
+	}
+	sort.Slice(report.Replicas, func(i, j int) bool {
+		return report.Replicas[i].Identity < report.Replicas[j].Identity
+	})
+	return report, nil
+}
+
+func (st *controllerStatus) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	report, err := st.report(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
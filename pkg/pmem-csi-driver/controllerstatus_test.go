@@ -0,0 +1,90 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+	"k8s.io/utils/ptr"
+)
+
+func TestControllerStatus(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	reg := prometheus.NewPedanticRegistry()
+	MustRegisterControllerMetrics(reg, driverName)
+
+	name := leaseName(driverName)
+	lease := func(name, holder string, renewed time.Time) *coordinationv1.Lease {
+		renewTime := metav1.NewMicroTime(renewed)
+		return &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "pmem-csi",
+			},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       ptr.To(holder),
+				LeaseDurationSeconds: ptr.To(int32(30)),
+				RenewTime:            &renewTime,
+			},
+		}
+	}
+	spare := lease(name+"-replica-2", "replica-2", time.Now().Add(-time.Minute))
+	spare.Labels = map[string]string{heartbeatLabel: name}
+	gone := lease(name+"-replica-0", "replica-0", time.Now().Add(-time.Hour))
+	gone.Labels = map[string]string{heartbeatLabel: name}
+	client := fake.NewSimpleClientset(lease(name, "replica-1", time.Now()), spare, gone)
+	st := &controllerStatus{
+		client:            client,
+		namespace:         "pmem-csi",
+		identity:          "replica-1",
+		leaseName:         name,
+		leaderElection:    true,
+		heartbeatInterval: 10 * time.Second,
+	}
+
+	st.setActive(false)
+	require.NoError(t, st.heartbeat(ctx), "first heartbeat")
+	require.NoError(t, st.heartbeat(ctx), "second heartbeat")
+	assert.Equal(t, float64(0), testutil.ToFloat64(controllerActive), "inactive")
+	assert.InDelta(t, float64(time.Now().Unix()), testutil.ToFloat64(controllerHeartbeat), 10, "heartbeat timestamp")
+	leases, err := st.listHeartbeats(ctx)
+	require.NoError(t, err, "list heartbeats")
+	assert.Len(t, leases, 3, "stale heartbeat kept while inactive")
+
+	st.setActive(true)
+	assert.Equal(t, float64(1), testutil.ToFloat64(controllerActive), "active")
+	require.NoError(t, st.heartbeat(ctx), "heartbeat while active")
+
+	rec := httptest.NewRecorder()
+	st.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics"+controllerStatusSuffix, nil))
+	require.Equal(t, http.StatusOK, rec.Code, "status")
+	var report controllerStatusReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report), "decode status")
+	assert.Equal(t, "replica-1", report.Identity, "identity")
+	assert.True(t, report.Active, "active")
+	assert.True(t, report.LeaderElection, "leader election")
+	assert.Equal(t, "replica-1", report.Leader, "leader")
+	require.Len(t, report.Replicas, 2, "replicas without the stale one")
+	assert.Equal(t, "replica-1", report.Replicas[0].Identity, "first replica")
+	assert.True(t, report.Replicas[0].Alive, "first replica alive")
+	assert.True(t, report.Replicas[0].Leader, "first replica is leader")
+	assert.Equal(t, "replica-2", report.Replicas[1].Identity, "second replica")
+	assert.False(t, report.Replicas[1].Alive, "second replica missed heartbeats")
+	assert.False(t, report.Replicas[1].Leader, "second replica is spare")
+}
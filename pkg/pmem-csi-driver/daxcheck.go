@@ -0,0 +1,128 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// DAXCheck determines what the node driver does when a volume which
+// was mounted with "-o dax" ends up without DAX. The kernel silently
+// falls back to normal page cache based IO when the device or
+// filesystem do not support DAX.
+type DAXCheck string
+
+const (
+	// Do not check.
+	DAXCheckOff DAXCheck = "off"
+	// Log a warning and emit an event, but publish the volume.
+	DAXCheckWarn DAXCheck = "warn"
+	// Fail NodePublishVolume.
+	DAXCheckFail DAXCheck = "fail"
+)
+
+func (check *DAXCheck) Set(value string) error {
+	switch value {
+	case string(DAXCheckOff), string(DAXCheckWarn), string(DAXCheckFail):
+		*check = DAXCheck(value)
+	default:
+		// The flag package will add the value to the final output, no need to do it here.
+		return errors.New("invalid DAX check")
+	}
+	return nil
+}
+
+func (check *DAXCheck) String() string {
+	return string(*check)
+}
+
+// daxInactiveReason is the reason of the event which is emitted when
+// a volume was published without DAX.
+const daxInactiveReason = "DAXInactive"
+
+// mountInfoPath can be replaced by tests.
+var mountInfoPath = "/proc/self/mountinfo"
+
+// daxEnabled checks whether the filesystem mounted at the path uses
+// DAX. The mount options in /proc/self/mountinfo are authoritative:
+// ext4 and xfs drop the dax option when they turn off DAX. Checking
+// STATX_ATTR_DAX of individual files is not needed because PMEM-CSI
+// mounts with "dax" respectively "dax=always", which applies to all
+// files of the filesystem. The per-file attribute only differs for
+// "dax=inode", and statx only reports it on Linux >= 5.8.
+func daxEnabled(path string) (bool, error) {
+	info, err := mounts.find(path)
+	if err != nil {
+		return false, err
+	}
+	if info == nil {
+		return false, fmt.Errorf("%s is not mounted", path)
+	}
+	for _, options := range [][]string{info.SuperOptions, info.MountOptions} {
+		for _, option := range options {
+			if option == "dax" || option == "dax=always" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// checkDAX applies the DAX check policy to a volume which was mounted
+// with DAX at the target path. It returns a status error if the
+// volume must not be published.
+func (ns *nodeServer) checkDAX(ctx context.Context, volumeID, targetPath string, volumeContext map[string]string) error {
+	if ns.daxCheck == DAXCheckOff || ns.daxCheck == "" {
+		return nil
+	}
+	logger := klog.FromContext(ctx)
+	enabled, err := daxEnabled(targetPath)
+	if err != nil {
+		return status.Errorf(codes.Internal, "check DAX: %v", err)
+	}
+	if enabled {
+		logger.V(5).Info("DAX is active", "target-path", targetPath)
+		return nil
+	}
+	if ns.daxCheck == DAXCheckFail {
+		return status.Errorf(codes.FailedPrecondition, "volume %s was mounted without DAX at %s, the kernel does not support DAX for it", volumeID, targetPath)
+	}
+	logger.Info("WARNING: volume was mounted without DAX", "volume-id", volumeID, "target-path", targetPath)
+	if ns.recorder != nil {
+		ns.recorder.Eventf(daxEventObject(ns.cs.nodeID, volumeContext), v1.EventTypeWarning, daxInactiveReason,
+			"Volume %s was mounted without DAX, the kernel fell back to page cache based IO.", volumeID)
+	}
+	return nil
+}
+
+// daxEventObject returns the pod which uses the volume if kubelet
+// provided the pod info, otherwise the node.
+func daxEventObject(nodeName string, volumeContext map[string]string) *v1.ObjectReference {
+	if name, namespace := volumeContext[parameters.PodName], volumeContext[parameters.PodNamespace]; name != "" && namespace != "" {
+		return &v1.ObjectReference{
+			Kind:      "Pod",
+			Name:      name,
+			Namespace: namespace,
+			UID:       k8stypes.UID(volumeContext[parameters.PodUID]),
+		}
+	}
+	return &v1.ObjectReference{
+		Kind: "Node",
+		Name: nodeName,
+		UID:  k8stypes.UID(nodeName),
+	}
+}
@@ -0,0 +1,69 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestCheckDAX(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	require.NoError(t, os.WriteFile(mountInfo, []byte(`22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 22 259:2 / /var/lib/kubelet/dax rw,relatime shared:20 - ext4 /dev/pmem0 rw,dax=always
+41 22 259:3 / /var/lib/kubelet/nodax rw,relatime shared:21 - ext4 /dev/pmem1 rw
+42 22 259:4 / /var/lib/kubelet/olddax rw,relatime shared:22 - xfs /dev/pmem2 rw,attr2,dax,inode64
+`), 0644), "write mountinfo")
+	defer func(path string) { mountInfoPath = path }(mountInfoPath)
+	mountInfoPath = mountInfo
+
+	for path, expected := range map[string]bool{
+		"/var/lib/kubelet/dax":    true,
+		"/var/lib/kubelet/nodax":  false,
+		"/var/lib/kubelet/olddax": true,
+	} {
+		enabled, err := daxEnabled(path)
+		require.NoError(t, err, path)
+		assert.Equal(t, expected, enabled, path)
+	}
+	_, err := daxEnabled("/var/lib/kubelet/unknown")
+	assert.Error(t, err, "not mounted")
+
+	recorder := record.NewFakeRecorder(10)
+	ns := &nodeServer{cs: &nodeControllerServer{nodeID: "worker"}, daxCheck: DAXCheckWarn, recorder: recorder}
+	podInfo := map[string]string{
+		parameters.PodName:      "app",
+		parameters.PodNamespace: "default",
+	}
+	assert.NoError(t, ns.checkDAX(ctx, "vol-1", "/var/lib/kubelet/dax", podInfo), "DAX active")
+	assert.Empty(t, recorder.Events, "no event for DAX")
+	assert.NoError(t, ns.checkDAX(ctx, "vol-2", "/var/lib/kubelet/nodax", podInfo), "warn")
+	if assert.Len(t, recorder.Events, 1, "event") {
+		assert.Contains(t, <-recorder.Events, "Warning DAXInactive Volume vol-2 was mounted without DAX", "event")
+	}
+
+	ns.daxCheck = DAXCheckFail
+	err = ns.checkDAX(ctx, "vol-2", "/var/lib/kubelet/nodax", podInfo)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "fail")
+
+	ns.daxCheck = DAXCheckOff
+	assert.NoError(t, ns.checkDAX(ctx, "vol-2", "/var/lib/kubelet/unknown", podInfo), "off")
+
+	assert.Equal(t, "Pod", daxEventObject("worker", podInfo).Kind, "pod info")
+	assert.Equal(t, "Node", daxEventObject("worker", nil).Kind, "no pod info")
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// parseDeniedParameters converts the -deniedParameters value. Each
+// entry must be a parameter that users can set, otherwise a typo
+// would silently allow the parameter that was meant to be denied.
+func parseDeniedParameters(value string) (map[string]bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	denied := map[string]bool{}
+	for _, key := range strings.Split(value, ",") {
+		key = strings.TrimSpace(key)
+		if !parameters.IsValid(parameters.CreateVolumeOrigin, key) &&
+			!parameters.IsValid(parameters.EphemeralVolumeOrigin, key) {
+			return nil, fmt.Errorf("denied parameters: %q is not a volume parameter", key)
+		}
+		denied[key] = true
+	}
+	return denied, nil
+}
+
+// checkDeniedParameters rejects storage class parameters or ephemeral
+// volume attributes which are denied by the driver configuration.
+func (cs *nodeControllerServer) checkDeniedParameters(params map[string]string) error {
+	var keys []string
+	for key := range params {
+		if cs.deniedParameters[key] {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	sort.Strings(keys)
+	return status.Errorf(codes.InvalidArgument, "parameter %q is not allowed by the configuration of the PMEM-CSI driver", keys[0])
+}
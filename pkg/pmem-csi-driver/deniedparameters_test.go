@@ -0,0 +1,41 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestDeniedParameters(t *testing.T) {
+	denied, err := parseDeniedParameters("")
+	require.NoError(t, err, "empty")
+	assert.Nil(t, denied, "empty")
+
+	denied, err = parseDeniedParameters("populateFrom, kataContainers,size")
+	require.NoError(t, err, "parse")
+	assert.Equal(t, map[string]bool{parameters.PopulateFrom: true, parameters.KataContainers: true, parameters.Size: true}, denied, "parsed")
+
+	_, err = parseDeniedParameters("populatefrom")
+	assert.Error(t, err, "typo")
+	_, err = parseDeniedParameters("deviceLink")
+	assert.Error(t, err, "internal parameter")
+
+	cs := &nodeControllerServer{}
+	assert.NoError(t, cs.checkDeniedParameters(map[string]string{parameters.PopulateFrom: "image"}), "nothing denied")
+	cs.deniedParameters = denied
+	assert.NoError(t, cs.checkDeniedParameters(map[string]string{parameters.EraseAfter: "true"}), "allowed parameter")
+	err = cs.checkDeniedParameters(map[string]string{parameters.EraseAfter: "true", parameters.PopulateFrom: "image", parameters.KataContainers: "true"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "denied parameter")
+	assert.Contains(t, err.Error(), `"kataContainers"`, "first denied parameter")
+}
@@ -0,0 +1,90 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// deviceLink returns the path of the symlink for a volume, or an
+// empty string if the driver does not maintain symlinks.
+func (cs *nodeControllerServer) deviceLink(volumeID string) string {
+	if cs.deviceLinkDir == "" {
+		return ""
+	}
+	return filepath.Join(cs.deviceLinkDir, volumeID)
+}
+
+// updateDeviceLink ensures that the symlink for a volume points
+// towards the device. The device path of a volume is not guaranteed
+// to be the same after a reboot, which is why the links must be
+// refreshed whenever the driver starts.
+func (cs *nodeControllerServer) updateDeviceLink(volumeID, devicePath string) error {
+	link := cs.deviceLink(volumeID)
+	if link == "" || strings.HasPrefix(devicePath, pmdmanager.FakeDevicePathPrefix) {
+		return nil
+	}
+	if target, err := os.Readlink(link); err == nil && target == devicePath {
+		return nil
+	}
+	if err := os.MkdirAll(cs.deviceLinkDir, 0755); err != nil {
+		return fmt.Errorf("create device link directory: %v", err)
+	}
+	// Replace atomically, a link might already exist.
+	tmp := link + ".tmp"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove temporary device link: %v", err)
+	}
+	if err := os.Symlink(devicePath, tmp); err != nil {
+		return fmt.Errorf("create device link: %v", err)
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		return fmt.Errorf("rename device link: %v", err)
+	}
+	return nil
+}
+
+// removeDeviceLink removes the symlink for a volume, if there is one.
+func (cs *nodeControllerServer) removeDeviceLink(volumeID string) error {
+	link := cs.deviceLink(volumeID)
+	if link == "" {
+		return nil
+	}
+	if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("remove device link: %v", err)
+	}
+	return nil
+}
+
+// pruneDeviceLinks removes all entries in the device link directory
+// which do not belong to one of the given volumes.
+func (cs *nodeControllerServer) pruneDeviceLinks(volumes map[string]*nodeVolume) error {
+	if cs.deviceLinkDir == "" {
+		return nil
+	}
+	entries, err := os.ReadDir(cs.deviceLinkDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("read device link directory: %v", err)
+	}
+	for _, entry := range entries {
+		if _, ok := volumes[entry.Name()]; ok {
+			continue
+		}
+		if err := os.Remove(filepath.Join(cs.deviceLinkDir, entry.Name())); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("remove stale device link: %v", err)
+		}
+	}
+	return nil
+}
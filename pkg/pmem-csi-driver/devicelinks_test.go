@@ -0,0 +1,53 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+func TestDeviceLinks(t *testing.T) {
+	cs := &nodeControllerServer{deviceLinkDir: filepath.Join(t.TempDir(), "links")}
+	link := cs.deviceLink("vol-1")
+	assert.Equal(t, filepath.Join(cs.deviceLinkDir, "vol-1"), link, "link path")
+
+	require.NoError(t, cs.updateDeviceLink("vol-1", "/dev/pmem0.1"), "create link")
+	target, err := os.Readlink(link)
+	require.NoError(t, err, "read link")
+	assert.Equal(t, "/dev/pmem0.1", target, "initial target")
+
+	require.NoError(t, cs.updateDeviceLink("vol-1", "/dev/pmem0.2"), "update link")
+	target, err = os.Readlink(link)
+	require.NoError(t, err, "read link")
+	assert.Equal(t, "/dev/pmem0.2", target, "updated target")
+
+	require.NoError(t, cs.updateDeviceLink("vol-2", "/dev/pmem0.3"), "create second link")
+	require.NoError(t, cs.pruneDeviceLinks(map[string]*nodeVolume{"vol-2": {}}), "prune")
+	_, err = os.Lstat(link)
+	assert.True(t, os.IsNotExist(err), "stale link removed")
+
+	require.NoError(t, cs.removeDeviceLink("vol-2"), "remove link")
+	require.NoError(t, cs.removeDeviceLink("vol-2"), "remove link again")
+	_, err = os.Lstat(cs.deviceLink("vol-2"))
+	assert.True(t, os.IsNotExist(err), "link removed")
+
+	require.NoError(t, cs.updateDeviceLink("vol-3", pmdmanager.FakeDevicePathPrefix+"/vol-3"), "fake device")
+	_, err = os.Lstat(cs.deviceLink("vol-3"))
+	assert.True(t, os.IsNotExist(err), "no link for fake device")
+
+	disabled := &nodeControllerServer{}
+	assert.Empty(t, disabled.deviceLink("vol-1"), "disabled")
+	assert.NoError(t, disabled.updateDeviceLink("vol-1", "/dev/pmem0.1"), "update while disabled")
+	assert.NoError(t, disabled.pruneDeviceLinks(nil), "prune while disabled")
+}
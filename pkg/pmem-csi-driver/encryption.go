@@ -0,0 +1,134 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// Encrypted volumes have a LUKS2 header on the LV or namespace. The
+// filesystem is created on and mounted from the dm-crypt mapping,
+// which gets opened in NodeStageVolume (persistent volumes) or
+// NodePublishVolume (ephemeral volumes) and closed again when the
+// volume is unstaged or deleted. The passphrase is passed to
+// cryptsetup via stdin so that it never shows up in the command line
+// or the log output.
+
+// cryptDeviceName returns the name of the dm-crypt mapping for the
+// volume. The prefix avoids a clash with the names of striped LVM
+// volumes, which are the same as the volume ID.
+func cryptDeviceName(volumeID string) string {
+	return "pmem-crypt-" + volumeID
+}
+
+// cryptDevicePath returns where the mapping of the volume shows up
+// once it is open.
+func cryptDevicePath(volumeID string) string {
+	return filepath.Join(mapperDir, cryptDeviceName(volumeID))
+}
+
+// encryptionPassphrase returns the passphrase from the secrets of a
+// CSI call or an InvalidArgument status error if there is none.
+func encryptionPassphrase(secrets parameters.Secrets) (string, error) {
+	passphrase := secrets[parameters.EncryptionPassphrase]
+	if passphrase == "" {
+		return "", status.Errorf(codes.InvalidArgument, "encrypted volume: secret key %q missing", parameters.EncryptionPassphrase)
+	}
+	return passphrase, nil
+}
+
+// runCryptsetup runs cryptsetup with the passphrase as key file on
+// stdin.
+func runCryptsetup(ctx context.Context, passphrase string, args ...string) error {
+	cmd := exec.Command("cryptsetup", args...)
+	cmd.Stdin = strings.NewReader(passphrase)
+	_, err := pmemexec.Run(ctx, cmd)
+	return err
+}
+
+// luksFormat writes a new LUKS2 header to the device. All previous
+// content becomes inaccessible.
+func luksFormat(ctx context.Context, devicePath, passphrase string) error {
+	klog.FromContext(ctx).V(3).Info("Formatting encrypted device", "device", devicePath)
+	if err := runCryptsetup(ctx, passphrase, "luksFormat", "--type", "luks2", "--batch-mode", "--key-file=-", devicePath); err != nil {
+		return fmt.Errorf("format %s for encryption: %v", devicePath, err)
+	}
+	return nil
+}
+
+// luksOpen opens the mapping for the volume and returns the path of
+// the decrypted device. It is idempotent.
+func luksOpen(ctx context.Context, devicePath, volumeID, passphrase string) (string, error) {
+	path := cryptDevicePath(volumeID)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	name := cryptDeviceName(volumeID)
+	klog.FromContext(ctx).V(3).Info("Opening encrypted device", "device", devicePath, "crypt-device", name)
+	if err := runCryptsetup(ctx, passphrase, "open", "--type", "luks2", "--key-file=-", devicePath, name); err != nil {
+		return "", fmt.Errorf("open encrypted device %s: %v", devicePath, err)
+	}
+	return path, nil
+}
+
+// luksClose closes the mapping of the volume, if it is open.
+func luksClose(ctx context.Context, volumeID string) error {
+	if _, err := os.Stat(cryptDevicePath(volumeID)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	name := cryptDeviceName(volumeID)
+	klog.FromContext(ctx).V(3).Info("Closing encrypted device", "crypt-device", name)
+	if _, err := pmemexec.RunCommand(ctx, "cryptsetup", "close", name); err != nil {
+		return fmt.Errorf("close encrypted device %s: %v", name, err)
+	}
+	return nil
+}
+
+// luksResize grows an open mapping after its device was expanded. The
+// passphrase is optional, cryptsetup only needs it when the volume key
+// is not available in the kernel keyring.
+func luksResize(ctx context.Context, volumeID, passphrase string) error {
+	name := cryptDeviceName(volumeID)
+	klog.FromContext(ctx).V(3).Info("Resizing encrypted device", "crypt-device", name)
+	args := []string{"resize", name}
+	if passphrase != "" {
+		args = append(args, "--key-file=-")
+	}
+	if err := runCryptsetup(ctx, passphrase, args...); err != nil {
+		return fmt.Errorf("resize encrypted device %s: %v", name, err)
+	}
+	return nil
+}
+
+// cryptoErase wipes all keyslots in the LUKS header of the device,
+// which makes the encrypted content unreadable without having to
+// overwrite it. The mapping must be closed.
+func cryptoErase(ctx context.Context, dm pmdmanager.PmemDeviceManager, name string) error {
+	device, err := dm.GetDevice(ctx, name)
+	if err != nil {
+		return err
+	}
+	klog.FromContext(ctx).V(3).Info("Erasing encryption keys", "device", device.Path)
+	if _, err := pmemexec.RunCommand(ctx, "cryptsetup", "erase", "--batch-mode", device.Path); err != nil {
+		return fmt.Errorf("erase encryption keys of %s: %v", device.Path, err)
+	}
+	return nil
+}
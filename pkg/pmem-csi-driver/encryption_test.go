@@ -0,0 +1,42 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestEncryption(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	assert.Equal(t, "pmem-crypt-vol-1", cryptDeviceName("vol-1"), "mapping name")
+	assert.NotEqual(t, "vol-1", cryptDeviceName("vol-1"), "differs from striped volume name")
+
+	_, err := encryptionPassphrase(parameters.Secrets{"key": "value"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "missing passphrase")
+	passphrase, err := encryptionPassphrase(parameters.Secrets{parameters.EncryptionPassphrase: "secret"})
+	require.NoError(t, err, "passphrase")
+	assert.Equal(t, "secret", passphrase, "passphrase")
+
+	defer func(dir string) { mapperDir = dir }(mapperDir)
+	mapperDir = t.TempDir()
+	assert.NoError(t, luksClose(ctx, "vol-1"), "not open")
+	require.NoError(t, os.WriteFile(filepath.Join(mapperDir, "pmem-crypt-vol-1"), nil, 0644), "fake mapping")
+	path, err := luksOpen(ctx, "/dev/pmem0", "vol-1", "secret")
+	require.NoError(t, err, "already open")
+	assert.Equal(t, filepath.Join(mapperDir, "pmem-crypt-vol-1"), path, "mapping path")
+}
@@ -0,0 +1,133 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// requestProgress records how far a gRPC call got. When the call
+// fails because it ran out of time, the error then tells the caller
+// where the time went instead of being a bare DeadlineExceeded.
+type requestProgress struct {
+	mutex         sync.Mutex
+	start         time.Time
+	stage         string
+	queuePosition int
+	estimatedWait time.Duration
+}
+
+type progressKey struct{}
+
+func withProgress(ctx context.Context) (context.Context, *requestProgress) {
+	p := &requestProgress{start: time.Now(), stage: "started"}
+	return context.WithValue(ctx, progressKey{}, p), p
+}
+
+// progressFromContext returns nil when the call is not tracked. All
+// methods can be called for nil.
+func progressFromContext(ctx context.Context) *requestProgress {
+	p, _ := ctx.Value(progressKey{}).(*requestProgress)
+	return p
+}
+
+// setStage records that the call is now doing something else. While
+// it runs, it is no longer queued.
+func (p *requestProgress) setStage(stage string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stage = stage
+	p.queuePosition = 0
+	p.estimatedWait = 0
+}
+
+// queued records that the call waits for other calls. Position one
+// is the next one to run, estimatedWait zero means unknown.
+func (p *requestProgress) queued(stage string, position int, estimatedWait time.Duration) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.stage = stage
+	p.queuePosition = position
+	p.estimatedWait = estimatedWait
+}
+
+// annotate adds the progress to the message and, as ErrorInfo and
+// RetryInfo, to the details of the status.
+func (p *requestProgress) annotate(err error, domain string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	st := status.Convert(err)
+	elapsed := time.Since(p.start).Round(time.Millisecond)
+	info := &errdetails.ErrorInfo{
+		Reason: strings.ToUpper(strings.ReplaceAll(st.Code().String(), " ", "_")),
+		Domain: domain,
+		Metadata: map[string]string{
+			"stage":   p.stage,
+			"elapsed": elapsed.String(),
+		},
+	}
+	progress := []string{"stage: " + p.stage, "elapsed: " + elapsed.String()}
+	if p.queuePosition > 0 {
+		info.Metadata["queue-position"] = fmt.Sprintf("%d", p.queuePosition)
+		progress = append(progress, fmt.Sprintf("queue position: %d", p.queuePosition))
+	}
+	var retry *errdetails.RetryInfo
+	if p.estimatedWait > 0 {
+		wait := p.estimatedWait.Round(time.Millisecond)
+		info.Metadata["estimated-wait"] = wait.String()
+		progress = append(progress, "estimated wait: "+wait.String())
+		retry = &errdetails.RetryInfo{RetryDelay: durationpb.New(wait)}
+	}
+
+	annotated := status.New(st.Code(), fmt.Sprintf("%s (%s)", st.Message(), strings.Join(progress, ", ")))
+	withDetails, detailsErr := annotated.WithDetails(info)
+	if retry != nil && detailsErr == nil {
+		withDetails, detailsErr = withDetails.WithDetails(retry)
+	}
+	if detailsErr != nil {
+		return annotated.Err()
+	}
+	return withDetails.Err()
+}
+
+// errorDetailsInterceptor tracks the progress of each call and
+// annotates errors of calls which ran out of time or were aborted
+// while waiting for other calls.
+func errorDetailsInterceptor(domain string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, progress := withProgress(ctx)
+		resp, err := handler(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+		switch status.Code(err) {
+		case codes.DeadlineExceeded, codes.Aborted, codes.Canceled:
+		default:
+			if ctx.Err() == nil {
+				return resp, err
+			}
+		}
+		return resp, progress.annotate(err, domain)
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestErrorDetails(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ops := newVolumeOperations()
+	intercept := errorDetailsInterceptor("pmem-csi.intel.com")
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ControllerExpandVolume"}
+
+	end, err := ops.begin(ctx, "vol", phaseCreating)
+	require.NoError(t, err, "begin creating")
+	defer end()
+	ops.mutex.Lock()
+	ops.durations[phaseCreating] = time.Hour
+	ops.mutex.Unlock()
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = intercept(timeoutCtx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		end, err := ops.begin(ctx, "vol", phaseExpanding)
+		if err != nil {
+			return nil, err
+		}
+		end()
+		return nil, nil
+	})
+	st := status.Convert(err)
+	assert.Equal(t, codes.Aborted, st.Code(), "code")
+	assert.Contains(t, st.Message(), "stage: waiting for creating, ", "message")
+	assert.Contains(t, st.Message(), "queue position: 1", "message")
+	var errorInfo *errdetails.ErrorInfo
+	var retryInfo *errdetails.RetryInfo
+	for _, detail := range st.Details() {
+		switch detail := detail.(type) {
+		case *errdetails.ErrorInfo:
+			errorInfo = detail
+		case *errdetails.RetryInfo:
+			retryInfo = detail
+		}
+	}
+	require.NotNil(t, errorInfo, "error info")
+	assert.Equal(t, "ABORTED", errorInfo.Reason, "reason")
+	assert.Equal(t, "pmem-csi.intel.com", errorInfo.Domain, "domain")
+	assert.Equal(t, "waiting for creating", errorInfo.Metadata["stage"], "stage")
+	assert.Equal(t, "1", errorInfo.Metadata["queue-position"], "queue position")
+	require.NotNil(t, retryInfo, "retry info")
+	assert.Greater(t, retryInfo.RetryDelay.AsDuration(), 59*time.Minute, "retry delay")
+
+	// Other errors are returned as they are.
+	_, err = intercept(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		progressFromContext(ctx).setStage("creating device")
+		return nil, status.Error(codes.ResourceExhausted, "not enough space")
+	})
+	assert.Equal(t, status.Error(codes.ResourceExhausted, "not enough space"), err, "unrelated error")
+
+	// Running out of time in some stage.
+	_, err = intercept(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		progressFromContext(ctx).setStage("formatting")
+		return nil, status.Error(codes.DeadlineExceeded, "mkfs timed out")
+	})
+	st = status.Convert(err)
+	assert.Equal(t, codes.DeadlineExceeded, st.Code(), "code")
+	assert.Contains(t, st.Message(), "mkfs timed out (stage: formatting, elapsed: ", "message")
+	require.Len(t, st.Details(), 1, "details")
+	assert.Equal(t, "formatting", st.Details()[0].(*errdetails.ErrorInfo).Metadata["stage"], "stage")
+}
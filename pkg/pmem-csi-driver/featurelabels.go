@@ -0,0 +1,83 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// featureLabelInterval determines how often the node labels get
+// checked. Features only change when kernel modules or tools get
+// installed, so this can be long.
+const featureLabelInterval = 10 * time.Minute
+
+// featureLabelPrefix gets appended to the driver name. The feature
+// name follows.
+const featureLabelPrefix = "/feature-"
+
+// featureLabels sets one label per optional feature on the node
+// object, so that workloads which depend on a feature can be
+// scheduled onto nodes where it is available. Nodes with different
+// kernels then can run the same driver.
+type featureLabels struct {
+	client     kubernetes.Interface
+	fp         *featureProber
+	driverName string
+	nodeName   string
+}
+
+// update patches the node labels if necessary.
+func (fl *featureLabels) update(ctx context.Context) error {
+	node, err := fl.client.CoreV1().Nodes().Get(ctx, fl.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get node: %v", err)
+	}
+	labels := map[string]string{}
+	for name, status := range fl.fp.probe().Features {
+		key := fl.driverName + featureLabelPrefix + name
+		value := strconv.FormatBool(status.Available)
+		if node.Labels[key] != value {
+			labels[key] = value
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": labels,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("encode patch: %v", err)
+	}
+	if _, err := fl.client.CoreV1().Nodes().Patch(ctx, fl.nodeName, k8stypes.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("patch node: %v", err)
+	}
+	klog.FromContext(ctx).V(3).Info("Updated feature labels", "node", fl.nodeName, "labels", labels)
+	return nil
+}
+
+// run keeps the labels up-to-date in the background. Failures only
+// get logged because the driver works without the labels.
+func (fl *featureLabels) run(ctx context.Context) {
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := fl.update(ctx); err != nil {
+			klog.FromContext(ctx).Error(err, "Updating feature labels failed", "node", fl.nodeName)
+		}
+	}, featureLabelInterval)
+}
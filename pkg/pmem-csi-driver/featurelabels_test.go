@@ -0,0 +1,58 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+func TestFeatureLabels(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	client := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: "worker",
+			Labels: map[string]string{
+				"foo":                             "bar",
+				"pmem-csi/feature-snapshots":      "true",
+				"other-driver/feature-encryption": "true",
+			},
+		},
+	})
+	fl := &featureLabels{
+		client:     client,
+		fp:         newFeatureProber(NewNodeControllerServer(ctx, "worker", dm, nil, nil, "", pmdmanager.Options{})),
+		driverName: "pmem-csi",
+		nodeName:   "worker",
+	}
+
+	require.NoError(t, fl.update(ctx), "update labels")
+	node, err := client.CoreV1().Nodes().Get(ctx, "worker", metav1.GetOptions{})
+	require.NoError(t, err, "get node")
+	assert.Equal(t, "bar", node.Labels["foo"], "unrelated label")
+	assert.Equal(t, "true", node.Labels["other-driver/feature-encryption"], "other driver")
+	// No snapshot state.
+	assert.Equal(t, "false", node.Labels["pmem-csi/feature-snapshots"], "snapshots")
+	assert.Equal(t, "true", node.Labels["pmem-csi/feature-expansion"], "expansion")
+	for name := range fl.fp.probe().Features {
+		assert.Contains(t, node.Labels, "pmem-csi/feature-"+name, "label for %s", name)
+	}
+
+	fl.nodeName = "no-such-node"
+	assert.Error(t, fl.update(ctx), "missing node")
+}
@@ -0,0 +1,165 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+)
+
+// featuresSuffix gets appended to the metrics path for the JSON
+// description of the optional features that are available on the
+// node.
+const featuresSuffix = "/features"
+
+// The names of optional features. They are part of the API, do not
+// change them!
+const (
+	featureSnapshots  = "snapshots"
+	featureExpansion  = "expansion"
+	featureEncryption = "encryption"
+	featureDevdax     = "devdax"
+	featureSector     = "sector"
+	// Whether devdax namespaces get created with huge page
+	// alignment or the default of the kernel.
+	featureDaxAlignment = "daxAlignment"
+)
+
+// lookPath can be replaced for testing.
+var lookPath = exec.LookPath
+
+// daxBusPath exists when the kernel supports device-dax. Can be
+// replaced for testing.
+var daxBusPath = "/sys/bus/dax"
+
+// bttDriverPath exists when the kernel supports sector mode. Can be
+// replaced for testing.
+var bttDriverPath = "/sys/bus/nd/drivers/nd_btt"
+
+// ndDevicesPath has the seed devices of the regions, which have an
+// align attribute when the kernel supports choosing the alignment.
+// Can be replaced for testing.
+var ndDevicesPath = "/sys/bus/nd/devices"
+
+// featureStatus tells whether a feature can be used and if not, why.
+type featureStatus struct {
+	Available bool   `json:"available"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// nodeFeatures is what the node driver reports.
+type nodeFeatures struct {
+	Node       string                   `json:"node"`
+	DeviceMode api.DeviceMode           `json:"deviceMode"`
+	Kernel     string                   `json:"kernel,omitempty"`
+	Features   map[string]featureStatus `json:"features"`
+}
+
+// featureProber checks the node each time it gets asked because
+// the kernel modules or tools might change while the driver runs.
+type featureProber struct {
+	cs *nodeControllerServer
+}
+
+func newFeatureProber(cs *nodeControllerServer) *featureProber {
+	return &featureProber{cs: cs}
+}
+
+func (fp *featureProber) probe() nodeFeatures {
+	mode := fp.cs.dm.GetMode()
+	features := nodeFeatures{
+		Node:       fp.cs.nodeID,
+		DeviceMode: mode,
+		Features: map[string]featureStatus{
+			featureSnapshots:    fp.snapshots(),
+			featureExpansion:    expansion(mode),
+			featureEncryption:   notImplemented(),
+			featureDevdax:       devdax(),
+			featureSector:       sector(mode),
+			featureDaxAlignment: daxAlignment(),
+		},
+	}
+	var uname unix.Utsname
+	if err := unix.Uname(&uname); err == nil {
+		features.Kernel = unix.ByteSliceToString(uname.Release[:])
+	}
+	return features
+}
+
+func (fp *featureProber) snapshots() featureStatus {
+	if fp.cs.snapshotState == nil {
+		return featureStatus{Reason: "no state directory for snapshots"}
+	}
+	// Snapshots are full copies, which works in all modes.
+	return featureStatus{Available: true}
+}
+
+// expansion is about the volumes created with the default device mode
+// of the driver.
+func expansion(mode api.DeviceMode) featureStatus {
+	switch mode {
+	case api.DeviceModeLVM:
+		if _, err := lookPath("lvextend"); err != nil {
+			return featureStatus{Reason: "lvextend: " + err.Error()}
+		}
+		return featureStatus{Available: true}
+	case api.DeviceModeDirect:
+		return featureStatus{Reason: "namespaces cannot be resized"}
+	default:
+		return featureStatus{Available: true}
+	}
+}
+
+// devdax volumes are namespaces, so they can also be created by a
+// driver in LVM mode.
+func devdax() featureStatus {
+	if _, err := os.Stat(daxBusPath); err != nil {
+		return featureStatus{Reason: "kernel without device-dax support: " + err.Error()}
+	}
+	return featureStatus{Available: true}
+}
+
+// sector namespaces are only used by volumes with usage=FileIO in
+// direct mode. LVM mode always puts volume groups on fsdax namespaces.
+func sector(mode api.DeviceMode) featureStatus {
+	if mode != api.DeviceModeDirect {
+		return featureStatus{Reason: "only supported in direct mode"}
+	}
+	if _, err := os.Stat(bttDriverPath); err != nil {
+		return featureStatus{Reason: "kernel without BTT support: " + err.Error()}
+	}
+	return featureStatus{Available: true}
+}
+
+// daxAlignment checks the dax seed devices. Without the align
+// attribute (old kernels), devdax volumes still work, just without
+// huge pages.
+func daxAlignment() featureStatus {
+	matches, err := filepath.Glob(filepath.Join(ndDevicesPath, "dax*", "align"))
+	if err != nil || len(matches) == 0 {
+		return featureStatus{Reason: "kernel without device-dax alignment control"}
+	}
+	return featureStatus{Available: true}
+}
+
+func notImplemented() featureStatus {
+	return featureStatus{Reason: "not implemented by this version of PMEM-CSI"}
+}
+
+func (fp *featureProber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(fp.probe()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestFeatures(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	snapshotState, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create snapshot state")
+
+	get := func(fp *featureProber) nodeFeatures {
+		recorder := httptest.NewRecorder()
+		fp.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics/features", nil))
+		assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"), "content type")
+		var features nodeFeatures
+		require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &features), "decode response")
+		return features
+	}
+
+	features := get(newFeatureProber(NewNodeControllerServer(ctx, "node", dm, nil, snapshotState, "", pmdmanager.Options{})))
+	assert.Equal(t, "node", features.Node, "node")
+	assert.Equal(t, api.DeviceModeFake, features.DeviceMode, "device mode")
+	assert.NotEmpty(t, features.Kernel, "kernel")
+	assert.Equal(t, featureStatus{Available: true}, features.Features[featureSnapshots], "snapshots")
+	assert.Equal(t, featureStatus{Available: true}, features.Features[featureExpansion], "expansion")
+	for _, name := range []string{featureEncryption, featureSector} {
+		assert.False(t, features.Features[name].Available, "%s available", name)
+		assert.NotEmpty(t, features.Features[name].Reason, "%s reason", name)
+	}
+
+	features = get(newFeatureProber(NewNodeControllerServer(ctx, "node", dm, nil, nil, "", pmdmanager.Options{})))
+	assert.False(t, features.Features[featureSnapshots].Available, "snapshots without state")
+
+	oldLookPath := lookPath
+	defer func() {
+		lookPath = oldLookPath
+	}()
+	found := true
+	lookPath = func(file string) (string, error) {
+		if !found {
+			return "", errors.New("not found")
+		}
+		return "/sbin/" + file, nil
+	}
+	assert.Equal(t, featureStatus{Available: true}, expansion(api.DeviceModeLVM), "LVM expansion")
+	found = false
+	assert.Equal(t, featureStatus{Reason: "lvextend: not found"}, expansion(api.DeviceModeLVM), "LVM expansion without lvextend")
+	assert.False(t, expansion(api.DeviceModeDirect).Available, "direct expansion")
+
+	oldDaxBusPath := daxBusPath
+	defer func() {
+		daxBusPath = oldDaxBusPath
+	}()
+	daxBusPath = t.TempDir()
+	assert.Equal(t, featureStatus{Available: true}, devdax(), "devdax")
+	daxBusPath = filepath.Join(daxBusPath, "no-such-dir")
+	assert.False(t, devdax().Available, "devdax without dax bus")
+
+	oldBttDriverPath := bttDriverPath
+	defer func() {
+		bttDriverPath = oldBttDriverPath
+	}()
+	bttDriverPath = t.TempDir()
+	assert.Equal(t, featureStatus{Available: true}, sector(api.DeviceModeDirect), "sector")
+	assert.False(t, sector(api.DeviceModeLVM).Available, "sector in LVM mode")
+	bttDriverPath = filepath.Join(bttDriverPath, "no-such-dir")
+	assert.False(t, sector(api.DeviceModeDirect).Available, "sector without BTT driver")
+
+	oldNdDevicesPath := ndDevicesPath
+	defer func() {
+		ndDevicesPath = oldNdDevicesPath
+	}()
+	ndDevicesPath = t.TempDir()
+	assert.False(t, daxAlignment().Available, "dax alignment without seed")
+	require.NoError(t, os.Mkdir(filepath.Join(ndDevicesPath, "dax0.1"), 0700), "create seed")
+	assert.False(t, daxAlignment().Available, "dax alignment without align attribute")
+	require.NoError(t, os.WriteFile(filepath.Join(ndDevicesPath, "dax0.1", "align"), []byte("2097152\n"), 0600), "create align attribute")
+	assert.Equal(t, featureStatus{Available: true}, daxAlignment(), "dax alignment")
+}
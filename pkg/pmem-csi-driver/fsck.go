@@ -0,0 +1,117 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// fsckCommand returns the command which checks or repairs an
+// unmounted filesystem.
+func fsckCommand(fsType string, policy parameters.FsckPolicy, devicePath string) (string, []string, error) {
+	switch fsType {
+	case "ext4":
+		if policy == parameters.FsckRepair {
+			// -p repairs everything that can be repaired
+			// without asking.
+			return "fsck.ext4", []string{"-p", devicePath}, nil
+		}
+		return "fsck.ext4", []string{"-n", devicePath}, nil
+	case "xfs":
+		if policy == parameters.FsckRepair {
+			return "xfs_repair", []string{devicePath}, nil
+		}
+		return "xfs_repair", []string{"-n", devicePath}, nil
+	default:
+		return "", nil, fmt.Errorf("filesystem check not supported for %q", fsType)
+	}
+}
+
+// fsckSucceeded interprets the exit code of the command returned by
+// fsckCommand. repaired is true if problems were found and fixed.
+func fsckSucceeded(fsType string, policy parameters.FsckPolicy, exitCode int) (ok, repaired bool) {
+	switch {
+	case exitCode == 0:
+		return true, false
+	case fsType == "ext4" && policy == parameters.FsckRepair:
+		// 1 = errors corrected, 2 = errors corrected, reboot
+		// needed. The latter only matters for the root
+		// filesystem.
+		return exitCode == 1 || exitCode == 2, true
+	default:
+		return false, false
+	}
+}
+
+// fsckNeedsLogReplay is true if the command returned by fsckCommand
+// refused to run because the filesystem has a dirty log. xfs_repair
+// exits with 2 in that case, both with and without -n. The log gets
+// replayed by mounting the filesystem. xfs_repair -L would zero it
+// instead and lose the last metadata updates, therefore that is never
+// done automatically.
+func fsckNeedsLogReplay(fsType string, exitCode int) bool {
+	return fsType == "xfs" && exitCode == 2
+}
+
+// checkFilesystem applies the fsck policy to the unmounted filesystem
+// on the device. It returns a status error if the filesystem must not
+// be mounted. replayLog gets called once when the log must be replayed
+// before the filesystem can be checked.
+func checkFilesystem(ctx context.Context, devicePath, fsType string, policy parameters.FsckPolicy, replayLog func(ctx context.Context) error) error {
+	ctx, logger := pmemlog.WithName(ctx, "checkFilesystem")
+	if policy == parameters.FsckSkip {
+		return nil
+	}
+	cmd, args, err := fsckCommand(fsType, policy, devicePath)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	logger.V(3).Info("Checking filesystem", "device", devicePath, "fs-type", fsType, "policy", policy)
+	exitCode, err := runFsck(ctx, cmd, args)
+	if err == nil && fsckNeedsLogReplay(fsType, exitCode) {
+		logger.Info("Replaying filesystem log before checking", "device", devicePath, "fs-type", fsType)
+		if err := replayLog(ctx); err != nil {
+			return status.Errorf(codes.FailedPrecondition, "filesystem on %s has a dirty log which cannot be replayed: %v", devicePath, err)
+		}
+		exitCode, err = runFsck(ctx, cmd, args)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "check filesystem: %v", err)
+	}
+	ok, repaired := fsckSucceeded(fsType, policy, exitCode)
+	if !ok {
+		return status.Errorf(codes.FailedPrecondition, "filesystem on %s has errors (fsck policy %q): %s exited with %d", devicePath, policy, cmd, exitCode)
+	}
+	if repaired {
+		logger.Info("Repaired filesystem", "device", devicePath, "fs-type", fsType)
+	}
+	return nil
+}
+
+// runFsck returns the exit code of the command. The error is only set
+// if the command could not be run at all.
+func runFsck(ctx context.Context, cmd string, args []string) (int, error) {
+	_, err := pmemexec.RunCommand(ctx, cmd, args...)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return 0, err
+		}
+		return exitErr.ExitCode(), nil
+	}
+	return 0, nil
+}
@@ -0,0 +1,54 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestFsck(t *testing.T) {
+	cmd, args, err := fsckCommand("ext4", parameters.FsckCheck, "/dev/pmem0")
+	require.NoError(t, err, "ext4 check")
+	assert.Equal(t, "fsck.ext4", cmd, "ext4 check")
+	assert.Equal(t, []string{"-n", "/dev/pmem0"}, args, "ext4 check")
+	cmd, args, err = fsckCommand("xfs", parameters.FsckRepair, "/dev/pmem0")
+	require.NoError(t, err, "xfs repair")
+	assert.Equal(t, "xfs_repair", cmd, "xfs repair")
+	assert.Equal(t, []string{"/dev/pmem0"}, args, "xfs repair")
+	_, _, err = fsckCommand("btrfs", parameters.FsckCheck, "/dev/pmem0")
+	assert.Error(t, err, "unsupported filesystem")
+
+	for _, tc := range []struct {
+		fsType   string
+		policy   parameters.FsckPolicy
+		exitCode int
+		ok       bool
+		repaired bool
+	}{
+		{"ext4", parameters.FsckCheck, 0, true, false},
+		{"ext4", parameters.FsckCheck, 4, false, false},
+		{"ext4", parameters.FsckRepair, 1, true, true},
+		{"ext4", parameters.FsckRepair, 4, false, true},
+		{"xfs", parameters.FsckCheck, 1, false, false},
+		{"xfs", parameters.FsckRepair, 2, false, false},
+	} {
+		ok, repaired := fsckSucceeded(tc.fsType, tc.policy, tc.exitCode)
+		assert.Equal(t, tc.ok, ok, "%+v: ok", tc)
+		if ok {
+			assert.Equal(t, tc.repaired, repaired, "%+v: repaired", tc)
+		}
+	}
+
+	assert.True(t, fsckNeedsLogReplay("xfs", 2), "xfs dirty log")
+	assert.False(t, fsckNeedsLogReplay("xfs", 1), "xfs errors")
+	assert.False(t, fsckNeedsLogReplay("ext4", 2), "ext4 repaired")
+}
@@ -0,0 +1,159 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// healthWatchInterval determines how often the gRPC health service
+// checks the health for Watch calls. Can be changed for testing.
+var healthWatchInterval = 10 * time.Second
+
+// grpcHealthServices are the services for which the gRPC health
+// service reports the status, in addition to the overall status ("").
+var grpcHealthServices = map[string]bool{
+	"":                  true,
+	"csi.v1.Identity":   true,
+	"csi.v1.Controller": true,
+	"csi.v1.Node":       true,
+}
+
+// healthChecker serves /healthz and /readyz on the metrics server.
+// It also implements the standard gRPC health service.
+type healthChecker struct {
+	grpc_health_v1.UnimplementedHealthServer
+
+	// ready is set once the driver has initialized its device
+	// manager and serves CSI calls on its socket, until it shuts
+	// down.
+	ready atomic.Bool
+	// check is called for /healthz, nil if there is nothing to
+	// check.
+	check func(ctx context.Context) error
+
+	mutex sync.Mutex
+	// readyChanged gets closed when ready changes.
+	readyChanged chan struct{}
+}
+
+func (hc *healthChecker) setReady(ready bool) {
+	hc.ready.Store(ready)
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	if hc.readyChanged != nil {
+		close(hc.readyChanged)
+		hc.readyChanged = nil
+	}
+}
+
+// changed returns a channel which gets closed by the next setReady.
+func (hc *healthChecker) changed() <-chan struct{} {
+	hc.mutex.Lock()
+	defer hc.mutex.Unlock()
+	if hc.readyChanged == nil {
+		hc.readyChanged = make(chan struct{})
+	}
+	return hc.readyChanged
+}
+
+func (hc *healthChecker) readyz(w http.ResponseWriter, r *http.Request) {
+	if !hc.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (hc *healthChecker) healthz(w http.ResponseWriter, r *http.Request) {
+	if hc.check != nil {
+		if err := hc.check(r.Context()); err != nil {
+			klog.FromContext(r.Context()).Error(err, "Health check failed")
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+func (hc *healthChecker) RegisterService(s *grpc.Server) {
+	grpc_health_v1.RegisterHealthServer(s, hc)
+}
+
+// servingStatus combines readiness and the health check. The
+// health check is only called while ready.
+func (hc *healthChecker) servingStatus(ctx context.Context) grpc_health_v1.HealthCheckResponse_ServingStatus {
+	if !hc.ready.Load() {
+		return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	}
+	if hc.check != nil {
+		if err := hc.check(ctx); err != nil {
+			klog.FromContext(ctx).Error(err, "Health check failed")
+			return grpc_health_v1.HealthCheckResponse_NOT_SERVING
+		}
+	}
+	return grpc_health_v1.HealthCheckResponse_SERVING
+}
+
+// Check implements grpc_health_v1.HealthServer.Check.
+func (hc *healthChecker) Check(ctx context.Context, req *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if !grpcHealthServices[req.GetService()] {
+		return nil, status.Errorf(codes.NotFound, "unknown service %q", req.GetService())
+	}
+	return &grpc_health_v1.HealthCheckResponse{Status: hc.servingStatus(ctx)}, nil
+}
+
+// Watch implements grpc_health_v1.HealthServer.Watch. It sends the
+// status each time it changes. The call ends when the driver shuts
+// down, because it would prevent stopping the gRPC server otherwise.
+func (hc *healthChecker) Watch(req *grpc_health_v1.HealthCheckRequest, stream grpc_health_v1.Health_WatchServer) error {
+	ctx := stream.Context()
+	servingStatus := func() grpc_health_v1.HealthCheckResponse_ServingStatus {
+		if !grpcHealthServices[req.GetService()] {
+			// Unknown services never become known.
+			return grpc_health_v1.HealthCheckResponse_SERVICE_UNKNOWN
+		}
+		return hc.servingStatus(ctx)
+	}
+
+	ticker := time.NewTicker(healthWatchInterval)
+	defer ticker.Stop()
+	wasReady := false
+	last := grpc_health_v1.HealthCheckResponse_UNKNOWN
+	for {
+		changed := hc.changed()
+		ready := hc.ready.Load()
+		current := servingStatus()
+		if current != last {
+			if err := stream.Send(&grpc_health_v1.HealthCheckResponse{Status: current}); err != nil {
+				return err
+			}
+			last = current
+		}
+		if wasReady && !ready {
+			return status.Error(codes.Unavailable, "driver shuts down")
+		}
+		wasReady = wasReady || ready
+		select {
+		case <-ctx.Done():
+			return status.FromContextError(ctx.Err()).Err()
+		case <-changed:
+		case <-ticker.C:
+		}
+	}
+}
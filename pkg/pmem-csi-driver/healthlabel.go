@@ -0,0 +1,86 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+)
+
+// healthLabelInterval determines how often the node driver checks
+// its device manager for the health label.
+const healthLabelInterval = time.Minute
+
+// healthLabelSuffix gets appended to the driver name.
+const healthLabelSuffix = "/healthy"
+
+// healthLabel returns the key of the node label which tells whether
+// the PMEM of a node is usable.
+func healthLabel(driverName string) string {
+	return driverName + healthLabelSuffix
+}
+
+// healthLabeler sets the health label on the node object, so that
+// the controller can reschedule pending PVCs away from nodes where
+// PMEM is unusable.
+type healthLabeler struct {
+	client     kubernetes.Interface
+	check      func(ctx context.Context) error
+	driverName string
+	nodeName   string
+}
+
+// update patches the node label if necessary.
+func (hl *healthLabeler) update(ctx context.Context) error {
+	logger := klog.FromContext(ctx)
+	healthy := true
+	if err := hl.check(ctx); err != nil {
+		logger.Error(err, "Health check failed", "node", hl.nodeName)
+		healthy = false
+	}
+	node, err := hl.client.CoreV1().Nodes().Get(ctx, hl.nodeName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get node: %v", err)
+	}
+	key := healthLabel(hl.driverName)
+	value := strconv.FormatBool(healthy)
+	if node.Labels[key] == value {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": map[string]string{key: value},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("encode patch: %v", err)
+	}
+	if _, err := hl.client.CoreV1().Nodes().Patch(ctx, hl.nodeName, k8stypes.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return fmt.Errorf("patch node: %v", err)
+	}
+	logger.V(2).Info("Updated health label", "node", hl.nodeName, "healthy", healthy)
+	return nil
+}
+
+// run keeps the label up-to-date in the background. Failures only get
+// logged.
+func (hl *healthLabeler) run(ctx context.Context) {
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := hl.update(ctx); err != nil {
+			klog.FromContext(ctx).Error(err, "Updating health label failed", "node", hl.nodeName)
+		}
+	}, healthLabelInterval)
+}
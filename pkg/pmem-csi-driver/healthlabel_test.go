@@ -0,0 +1,52 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestHealthLabel(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	client := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:   "worker",
+			Labels: map[string]string{"foo": "bar"},
+		},
+	})
+	var checkErr error
+	hl := &healthLabeler{
+		client:     client,
+		check:      func(context.Context) error { return checkErr },
+		driverName: "pmem-csi",
+		nodeName:   "worker",
+	}
+	label := func() string {
+		node, err := client.CoreV1().Nodes().Get(ctx, "worker", metav1.GetOptions{})
+		require.NoError(t, err, "get node")
+		assert.Equal(t, "bar", node.Labels["foo"], "unrelated label")
+		return node.Labels["pmem-csi/healthy"]
+	}
+
+	require.NoError(t, hl.update(ctx), "update healthy")
+	assert.Equal(t, "true", label(), "healthy")
+	checkErr = errors.New("vgs failure")
+	require.NoError(t, hl.update(ctx), "update unhealthy")
+	assert.Equal(t, "false", label(), "unhealthy")
+
+	hl.nodeName = "no-such-node"
+	assert.Error(t, hl.update(ctx), "missing node")
+}
@@ -0,0 +1,87 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	coreinformersv1 "k8s.io/client-go/informers/core/v1"
+	storageinformersv1 "k8s.io/client-go/informers/storage/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// informerSelectors restricts which objects of one type get watched.
+type informerSelectors struct {
+	labels string
+	fields string
+}
+
+func (is informerSelectors) empty() bool {
+	return is.labels == "" && is.fields == ""
+}
+
+func (is informerSelectors) validate(what string) error {
+	if _, err := labels.Parse(is.labels); err != nil {
+		return fmt.Errorf("%s label selector: %v", what, err)
+	}
+	if _, err := fields.ParseSelector(is.fields); err != nil {
+		return fmt.Errorf("%s field selector: %v", what, err)
+	}
+	return nil
+}
+
+func (is informerSelectors) tweak(options *metav1.ListOptions) {
+	options.LabelSelector = is.labels
+	options.FieldSelector = is.fields
+}
+
+// filterInformers replaces the PVC, PV and StorageClass informers of
+// the factory with informers that only watch the selected objects.
+// All users of the factory then get the filtered informers and
+// listers. It must be called before anything else requests those
+// informers from the factory.
+func (csid *csiDriver) filterInformers(factory informers.SharedInformerFactory) error {
+	pvcSelectors := csid.cfg.pvcSelectors
+	pvSelectors := csid.cfg.pvSelectors
+	scSelectors := csid.cfg.storageClassSelectors
+	if err := pvcSelectors.validate("PVC"); err != nil {
+		return err
+	}
+	if err := pvSelectors.validate("PV"); err != nil {
+		return err
+	}
+	if err := scSelectors.validate("StorageClass"); err != nil {
+		return err
+	}
+
+	// Same indexers as in the default informers.
+	namespaceIndexers := cache.Indexers{cache.NamespaceIndex: cache.MetaNamespaceIndexFunc}
+	if !pvcSelectors.empty() {
+		factory.InformerFor(&v1.PersistentVolumeClaim{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return coreinformersv1.NewFilteredPersistentVolumeClaimInformer(client, metav1.NamespaceAll, resync, namespaceIndexers, pvcSelectors.tweak)
+		})
+	}
+	if !pvSelectors.empty() {
+		factory.InformerFor(&v1.PersistentVolume{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return coreinformersv1.NewFilteredPersistentVolumeInformer(client, resync, namespaceIndexers, pvSelectors.tweak)
+		})
+	}
+	if !scSelectors.empty() {
+		factory.InformerFor(&storagev1.StorageClass{}, func(client kubernetes.Interface, resync time.Duration) cache.SharedIndexInformer {
+			return storageinformersv1.NewFilteredStorageClassInformer(client, resync, namespaceIndexers, scSelectors.tweak)
+		})
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestFilterInformers(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	selected := map[string]string{"pmem": "true"}
+	client := fake.NewSimpleClientset(
+		&v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "pmem", Namespace: "default", Labels: selected}},
+		&v1.PersistentVolumeClaim{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "default"}},
+		&v1.PersistentVolume{ObjectMeta: metav1.ObjectMeta{Name: "pv"}},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "pmem", Labels: selected}},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+	)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	csid := &csiDriver{cfg: Config{
+		pvcSelectors:          informerSelectors{labels: "pmem=true"},
+		storageClassSelectors: informerSelectors{labels: "pmem=true"},
+	}}
+	require.NoError(t, csid.filterInformers(factory), "filter informers")
+	pvcLister := factory.Core().V1().PersistentVolumeClaims().Lister()
+	pvLister := factory.Core().V1().PersistentVolumes().Lister()
+	scLister := factory.Storage().V1().StorageClasses().Lister()
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+
+	pvcs, err := pvcLister.PersistentVolumeClaims("default").List(labels.Everything())
+	require.NoError(t, err, "list PVCs")
+	if assert.Len(t, pvcs, 1, "PVCs") {
+		assert.Equal(t, "pmem", pvcs[0].Name, "PVC")
+	}
+	classes, err := scLister.List(labels.Everything())
+	require.NoError(t, err, "list storage classes")
+	if assert.Len(t, classes, 1, "storage classes") {
+		assert.Equal(t, "pmem", classes[0].Name, "storage class")
+	}
+	pvs, err := pvLister.List(labels.Everything())
+	require.NoError(t, err, "list PVs")
+	assert.Len(t, pvs, 1, "unfiltered PVs")
+
+	csid.cfg.pvSelectors.fields = "spec.phase in (Bound)"
+	assert.Error(t, csid.filterInformers(informers.NewSharedInformerFactory(client, 0)), "invalid field selector")
+}
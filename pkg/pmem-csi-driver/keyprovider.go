@@ -0,0 +1,316 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// keyProvider manages the passphrases of encrypted volumes. Errors
+// are status errors.
+type keyProvider interface {
+	// createKey returns the passphrase for formatting a new
+	// volume. Calling it again for the same volume returns the
+	// same passphrase.
+	createKey(ctx context.Context, volumeID string, secrets parameters.Secrets) (string, error)
+	// getKey returns the passphrase for opening the volume.
+	getKey(ctx context.Context, volumeID string, secrets parameters.Secrets) (string, error)
+	// deleteKey gets called once the volume is gone for good.
+	deleteKey(ctx context.Context, volumeID string) error
+	// forgetKey drops a cached passphrase, for example because
+	// opening the volume failed with it after a key rotation.
+	forgetKey(volumeID string)
+}
+
+// KeyProviderType selects the keyProvider via the -keyProvider parameter.
+type KeyProviderType string
+
+const (
+	// The passphrase is in the secrets of the CSI calls.
+	KeyProviderSecret KeyProviderType = "secret"
+	// Passphrases are generated by the driver and stored in a
+	// HashiCorp Vault KV version 2 secrets engine.
+	KeyProviderVault KeyProviderType = "vault"
+)
+
+func (k *KeyProviderType) Set(value string) error {
+	switch value {
+	case string(KeyProviderSecret), string(KeyProviderVault):
+		*k = KeyProviderType(value)
+	default:
+		// The flag package will add the value to the final output, no need to do it here.
+		return errors.New("invalid key provider")
+	}
+	return nil
+}
+
+func (k *KeyProviderType) String() string {
+	return string(*k)
+}
+
+// keyProvider returns the configured key provider, the secrets of the
+// CSI calls by default.
+func (cs *nodeControllerServer) keyProvider() keyProvider {
+	if cs.keys != nil {
+		return cs.keys
+	}
+	return secretKeys{}
+}
+
+// secretKeys takes the passphrase from the Kubernetes secret that is
+// referenced by the storage class or pod.
+type secretKeys struct{}
+
+func (secretKeys) createKey(ctx context.Context, volumeID string, secrets parameters.Secrets) (string, error) {
+	return encryptionPassphrase(secrets)
+}
+
+func (secretKeys) getKey(ctx context.Context, volumeID string, secrets parameters.Secrets) (string, error) {
+	return encryptionPassphrase(secrets)
+}
+
+func (secretKeys) deleteKey(ctx context.Context, volumeID string) error {
+	return nil
+}
+
+func (secretKeys) forgetKey(volumeID string) {}
+
+// vaultKeys stores one random passphrase per volume under
+// <mount>/data/<prefix>/<volume ID> in Vault. Passphrases are cached
+// for a while to avoid contacting Vault for each publish operation.
+type vaultKeys struct {
+	address   string // https://vault.example.com:8200
+	tokenFile string // re-read for each request, tokens may get renewed
+	mount     string // mount point of the KV secrets engine
+	prefix    string // path below the mount point
+	client    *http.Client
+	cacheTTL  time.Duration
+
+	mutex sync.Mutex
+	cache map[string]cachedKey
+}
+
+type cachedKey struct {
+	passphrase string
+	expires    time.Time
+}
+
+// vaultKeyLength is the number of random bytes in a generated
+// passphrase.
+const vaultKeyLength = 32
+
+// errNoKey is returned by vaultKeys.getCached when Vault has no passphrase
+// for the volume.
+var errNoKey = errors.New("no key")
+
+func newVaultKeys(address, tokenFile, mount, prefix, caFile string, cacheTTL time.Duration) (*vaultKeys, error) {
+	if address == "" || tokenFile == "" {
+		return nil, errors.New("key provider vault needs -vaultAddress and -vaultTokenFile")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read Vault CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in Vault CA file %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &vaultKeys{
+		address:   strings.TrimSuffix(address, "/"),
+		tokenFile: tokenFile,
+		mount:     strings.Trim(mount, "/"),
+		prefix:    strings.Trim(prefix, "/"),
+		client:    &http.Client{Transport: transport, Timeout: 30 * time.Second},
+		cacheTTL:  cacheTTL,
+		cache:     map[string]cachedKey{},
+	}, nil
+}
+
+func (v *vaultKeys) createKey(ctx context.Context, volumeID string, secrets parameters.Secrets) (string, error) {
+	passphrase, err := v.getCached(ctx, volumeID)
+	if err == nil {
+		return passphrase, nil
+	}
+	if !errors.Is(err, errNoKey) {
+		return "", status.Errorf(codes.Unavailable, "get key from Vault: %v", err)
+	}
+	passphrase, err = generateKey()
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "generate key: %v", err)
+	}
+	klog.FromContext(ctx).V(3).Info("Storing new key in Vault", "volume-id", volumeID)
+	// Fails when another call stored a key in the meantime.
+	if err := v.write(ctx, volumeID, passphrase, map[string]int{"cas": 0}); err != nil {
+		return "", status.Errorf(codes.Unavailable, "store key in Vault: %v", err)
+	}
+	return passphrase, nil
+}
+
+// replaceKey stores a new version of the passphrase after rotating
+// the key of the volume.
+func (v *vaultKeys) replaceKey(ctx context.Context, volumeID, passphrase string) error {
+	klog.FromContext(ctx).V(3).Info("Replacing key in Vault", "volume-id", volumeID)
+	if err := v.write(ctx, volumeID, passphrase, nil); err != nil {
+		return status.Errorf(codes.Unavailable, "store key in Vault: %v", err)
+	}
+	return nil
+}
+
+func (v *vaultKeys) write(ctx context.Context, volumeID, passphrase string, options map[string]int) error {
+	secret := map[string]interface{}{
+		"data": map[string]string{parameters.EncryptionPassphrase: passphrase},
+	}
+	if options != nil {
+		secret["options"] = options
+	}
+	body, _ := json.Marshal(secret)
+	if _, err := v.do(ctx, http.MethodPost, v.url("data", volumeID), body); err != nil {
+		return err
+	}
+	v.store(volumeID, passphrase)
+	return nil
+}
+
+func (v *vaultKeys) getKey(ctx context.Context, volumeID string, secrets parameters.Secrets) (string, error) {
+	passphrase, err := v.getCached(ctx, volumeID)
+	switch {
+	case errors.Is(err, errNoKey):
+		return "", status.Errorf(codes.FailedPrecondition, "no key for volume %s in Vault", volumeID)
+	case err != nil:
+		return "", status.Errorf(codes.Unavailable, "get key from Vault: %v", err)
+	}
+	return passphrase, nil
+}
+
+func (v *vaultKeys) deleteKey(ctx context.Context, volumeID string) error {
+	v.forgetKey(volumeID)
+	klog.FromContext(ctx).V(3).Info("Deleting key in Vault", "volume-id", volumeID)
+	// The metadata endpoint removes all versions.
+	if _, err := v.do(ctx, http.MethodDelete, v.url("metadata", volumeID), nil); err != nil {
+		return status.Errorf(codes.Unavailable, "delete key in Vault: %v", err)
+	}
+	return nil
+}
+
+func (v *vaultKeys) forgetKey(volumeID string) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.cache, volumeID)
+}
+
+// getCached returns the cached passphrase or reads it from Vault.
+func (v *vaultKeys) getCached(ctx context.Context, volumeID string) (string, error) {
+	v.mutex.Lock()
+	cached, ok := v.cache[volumeID]
+	v.mutex.Unlock()
+	if ok && time.Now().Before(cached.expires) {
+		return cached.passphrase, nil
+	}
+	data, err := v.do(ctx, http.MethodGet, v.url("data", volumeID), nil)
+	if err != nil {
+		return "", err
+	}
+	var secret struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &secret); err != nil {
+		return "", fmt.Errorf("decode response: %v", err)
+	}
+	passphrase := secret.Data.Data[parameters.EncryptionPassphrase]
+	if passphrase == "" {
+		return "", errNoKey
+	}
+	v.store(volumeID, passphrase)
+	return passphrase, nil
+}
+
+func (v *vaultKeys) store(volumeID, passphrase string) {
+	if v.cacheTTL <= 0 {
+		return
+	}
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.cache[volumeID] = cachedKey{passphrase: passphrase, expires: time.Now().Add(v.cacheTTL)}
+}
+
+// generateKey returns a random passphrase.
+func generateKey() (string, error) {
+	key := make([]byte, vaultKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+func (v *vaultKeys) url(kind, volumeID string) string {
+	path := []string{v.address, "v1", v.mount, kind}
+	if v.prefix != "" {
+		path = append(path, v.prefix)
+	}
+	return strings.Join(append(path, volumeID), "/")
+}
+
+// do sends one request to Vault. The response body is not included in
+// errors because it might contain a passphrase.
+func (v *vaultKeys) do(ctx context.Context, method, url string, body []byte) ([]byte, error) {
+	token, err := os.ReadFile(v.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("read token: %v", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", strings.TrimSpace(string(token)))
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusNotFound && method == http.MethodGet:
+		return nil, errNoKey
+	case resp.StatusCode == http.StatusNotFound && method == http.MethodDelete:
+		return nil, nil
+	case resp.StatusCode/100 != 2:
+		return nil, fmt.Errorf("%s %s: %s", method, url, resp.Status)
+	}
+	return data, nil
+}
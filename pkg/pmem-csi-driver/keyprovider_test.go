@@ -0,0 +1,174 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// fakeVault implements the subset of the KV version 2 API that is
+// used by vaultKeys.
+type fakeVault struct {
+	mutex   sync.Mutex
+	secrets map[string]map[string]string
+	gets    int
+}
+
+func (f *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if r.Header.Get("X-Vault-Token") != "my-token" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/v1/secret/data/"), "/v1/secret/metadata/")
+	switch r.Method {
+	case http.MethodGet:
+		f.gets++
+		data, ok := f.secrets[name]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]interface{}{"data": data}})
+	case http.MethodPost:
+		var secret struct {
+			Data    map[string]string `json:"data"`
+			Options map[string]int    `json:"options"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&secret); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if cas, ok := secret.Options["cas"]; ok && cas == 0 && f.secrets[name] != nil {
+			// check-and-set fails because the secret exists
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		f.secrets[name] = secret.Data
+	case http.MethodDelete:
+		delete(f.secrets, name)
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestVaultKeys(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	vault := &fakeVault{secrets: map[string]map[string]string{}}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("my-token\n"), 0600), "write token")
+
+	keys, err := newVaultKeys(server.URL, tokenFile, "secret", "/pmem-csi/", "", time.Hour)
+	require.NoError(t, err, "create provider")
+
+	_, err = keys.getKey(ctx, "vol-1", nil)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "no key yet")
+
+	passphrase, err := keys.createKey(ctx, "vol-1", nil)
+	require.NoError(t, err, "create key")
+	assert.Len(t, passphrase, 2*vaultKeyLength, "passphrase length")
+	assert.Equal(t, passphrase, vault.secrets["pmem-csi/vol-1"][parameters.EncryptionPassphrase], "stored in Vault")
+	again, err := keys.createKey(ctx, "vol-1", nil)
+	require.NoError(t, err, "create key again")
+	assert.Equal(t, passphrase, again, "idempotent")
+
+	gets := vault.gets
+	key, err := keys.getKey(ctx, "vol-1", nil)
+	require.NoError(t, err, "get key")
+	assert.Equal(t, passphrase, key, "key")
+	assert.Equal(t, gets, vault.gets, "cached")
+
+	// A new provider has to fetch the key.
+	keys2, err := newVaultKeys(server.URL, tokenFile, "secret", "pmem-csi", "", 0)
+	require.NoError(t, err, "create second provider")
+	key, err = keys2.getKey(ctx, "vol-1", nil)
+	require.NoError(t, err, "get key without cache")
+	assert.Equal(t, passphrase, key, "key without cache")
+
+	require.NoError(t, keys.replaceKey(ctx, "vol-1", "new-passphrase"), "replace key")
+	assert.Equal(t, "new-passphrase", vault.secrets["pmem-csi/vol-1"][parameters.EncryptionPassphrase], "replaced in Vault")
+	key, err = keys.getKey(ctx, "vol-1", nil)
+	require.NoError(t, err, "get replaced key")
+	assert.Equal(t, "new-passphrase", key, "replaced key")
+
+	require.NoError(t, keys.deleteKey(ctx, "vol-1"), "delete key")
+	assert.Empty(t, vault.secrets, "deleted in Vault")
+	require.NoError(t, keys.deleteKey(ctx, "vol-1"), "delete key again")
+	_, err = keys.getKey(ctx, "vol-1", nil)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "key deleted")
+
+	require.NoError(t, os.WriteFile(tokenFile, []byte("other-token"), 0600), "replace token")
+	_, err = keys2.getKey(ctx, "vol-2", nil)
+	assert.Equal(t, codes.Unavailable, status.Code(err), "wrong token")
+
+	_, err = newVaultKeys("", tokenFile, "secret", "", "", 0)
+	assert.Error(t, err, "no address")
+}
+
+func TestOpenAfterKeyRotation(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	vault := &fakeVault{secrets: map[string]map[string]string{}}
+	server := httptest.NewServer(vault)
+	defer server.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("my-token"), 0600), "write token")
+	keys, err := newVaultKeys(server.URL, tokenFile, "secret", "pmem-csi", "", time.Hour)
+	require.NoError(t, err, "create provider")
+
+	// The rotate-key mode runs in a different process and
+	// replaces the key in Vault, not in the cache of the driver.
+	keys.store("vol-1", "old-passphrase")
+	vault.secrets["pmem-csi/vol-1"] = map[string]string{parameters.EncryptionPassphrase: "new-passphrase"}
+
+	// cryptsetup only accepts the new passphrase.
+	defer func(dir string) { mapperDir = dir }(mapperDir)
+	mapperDir = t.TempDir()
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "cryptsetup"), []byte(`#!/bin/sh
+read -r passphrase
+[ "$passphrase" = new-passphrase ] || exit 2
+touch "`+mapperDir+`/$6"
+`), 0755), "write fake cryptsetup")
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	ns := &nodeServer{cs: &nodeControllerServer{keys: keys}}
+	device, err := ns.openEncryptedDevice(ctx, &pmdmanager.PmemDeviceInfo{Path: "/dev/pmem0"}, "vol-1", nil)
+	require.NoError(t, err, "open with rotated key")
+	assert.Equal(t, cryptDevicePath("vol-1"), device.Path, "mapping")
+	passphrase, err := keys.getKey(ctx, "vol-1", nil)
+	require.NoError(t, err, "get key")
+	assert.Equal(t, "new-passphrase", passphrase, "cache updated")
+}
+
+func TestSecretKeys(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	cs := &nodeControllerServer{}
+	passphrase, err := cs.keyProvider().getKey(ctx, "vol-1", parameters.Secrets{parameters.EncryptionPassphrase: "secret"})
+	require.NoError(t, err, "get key")
+	assert.Equal(t, "secret", passphrase, "passphrase")
+	_, err = cs.keyProvider().createKey(ctx, "vol-1", nil)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err), "no secret")
+}
@@ -0,0 +1,106 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/k8sutil"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+
+	serviceAccountNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// runLeaderElection starts the controller only while this instance
+// holds the Lease object of the driver. Hot spares do not create
+// informers, which reduces the load on the apiserver in large
+// clusters. Losing the lease cancels the context, so the controller
+// restarts as a hot spare.
+func (csid *csiDriver) runLeaderElection(ctx context.Context, cancel func()) error {
+	logger := klog.FromContext(ctx).WithName("leader-election")
+	client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+	if err != nil {
+		return fmt.Errorf("connect to apiserver: %v", err)
+	}
+	identity := csid.controllerStatus.identity
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      csid.controllerStatus.leaseName,
+			Namespace: csid.controllerStatus.namespace,
+		},
+		Client: client.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+	le, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		// A hot spare can take over immediately when the
+		// leader shuts down.
+		ReleaseOnCancel: true,
+		Name:            lock.LeaseMeta.Name,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(ctx context.Context) {
+				logger.Info("Became leader, starting controller", "lease", pmemlog.KRef(lock.LeaseMeta.Namespace, lock.LeaseMeta.Name))
+				if err := csid.startController(ctx, cancel); err != nil {
+					logger.Error(err, "Starting controller failed")
+					cancel()
+				}
+			},
+			OnStoppedLeading: func() {
+				logger.Info("No longer the leader", "identity", identity)
+				cancel()
+			},
+			OnNewLeader: func(leader string) {
+				logger.V(3).Info("Current leader", "leader", leader)
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("leader election: %v", err)
+	}
+	logger.Info("Waiting for leadership", "lease", pmemlog.KRef(lock.LeaseMeta.Namespace, lock.LeaseMeta.Name), "identity", identity)
+	go le.Run(ctx)
+	return nil
+}
+
+// leaseName derives a valid object name from the driver name.
+func leaseName(driverName string) string {
+	return strings.ReplaceAll(driverName, ".", "-") + "-controller"
+}
+
+// leaderElectionNamespace returns the configured namespace or the one
+// that the pod runs in.
+func (csid *csiDriver) leaderElectionNamespace() string {
+	if csid.cfg.leaderElectionNamespace != "" {
+		return csid.cfg.leaderElectionNamespace
+	}
+	if data, err := os.ReadFile(serviceAccountNamespaceFile); err == nil {
+		if namespace := strings.TrimSpace(string(data)); namespace != "" {
+			return namespace
+		}
+	}
+	return "default"
+}
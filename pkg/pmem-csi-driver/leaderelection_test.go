@@ -0,0 +1,23 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+func TestLeaderElection(t *testing.T) {
+	name := leaseName("pmem-csi.intel.com")
+	assert.Equal(t, "pmem-csi-intel-com-controller", name, "lease name")
+	assert.Empty(t, validation.IsDNS1123Label(name), "valid lease name")
+
+	csid := &csiDriver{cfg: Config{leaderElectionNamespace: "pmem-csi"}}
+	assert.Equal(t, "pmem-csi", csid.leaderElectionNamespace(), "configured namespace")
+}
@@ -11,6 +11,7 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"time"
 
 	"k8s.io/klog/v2"
 
@@ -21,8 +22,12 @@ import (
 
 var (
 	config = Config{
-		Mode:          Node,
-		DeviceManager: api.DeviceModeLVM,
+		Mode:               Node,
+		DeviceManager:      api.DeviceModeLVM,
+		sizeMismatchPolicy: TrustDevice,
+		daxCheck:           DAXCheckWarn,
+		schedulerScoring:   SchedulerScoringBinPack,
+		keyProvider:        KeyProviderSecret,
 	}
 	showVersion = flag.Bool("version", false, "Show release version and exit")
 	logFormat   = logger.NewFlag()
@@ -33,29 +38,140 @@ func init() {
 	/* generic options */
 	flag.StringVar(&config.DriverName, "drivername", "pmem-csi.intel.com", "name of the driver")
 	flag.StringVar(&config.NodeID, "nodeid", "nodeid", "node id")
-	flag.StringVar(&config.Endpoint, "endpoint", "unix:///tmp/pmem-csi.sock", "PMEM CSI endpoint")
+	flag.StringVar(&config.Endpoint, "endpoint", "unix:///tmp/pmem-csi.sock", "PMEM CSI endpoint, systemd://<name> selects a socket passed in by systemd socket activation")
 	flag.Var(&config.Mode, "mode", "driver run mode")
+	flag.StringVar(&config.endpointMode, "endpointMode", "", "permissions (like 0660) of the Unix domain socket for -endpoint, empty uses the umask of the process")
+	flag.StringVar(&config.endpointOwner, "endpointOwner", "", "user name or ID which owns the Unix domain socket for -endpoint, empty keeps the user of the process")
+	flag.StringVar(&config.endpointGroup, "endpointGroup", "", "group name or ID of the Unix domain socket for -endpoint, empty keeps the group of the process")
+	flag.StringVar(&config.tcpEndpoint, "tcpEndpoint", "", "node, inspect: additional endpoint (like tcp://:10000) where the CSI services are available with mutual TLS for components outside of the pod, disabled by default (needs endpointCertFile, endpointKeyFile, endpointClientCAFile)")
+	flag.StringVar(&config.endpointCertFile, "endpointCertFile", "", "PEM file with the certificate for -tcpEndpoint")
+	flag.StringVar(&config.endpointKeyFile, "endpointKeyFile", "", "PEM file with the private key for -endpointCertFile")
+	flag.StringVar(&config.endpointClientCAFile, "endpointClientCAFile", "", "PEM file with the CA certificates for verifying clients of -tcpEndpoint")
+	flag.StringVar(&config.endpointClientName, "endpointClientName", "", "common name which client certificates for -tcpEndpoint must have, empty accepts all certificates signed by the CA")
+	flag.UintVar(&config.grpcMaxConcurrentStreams, "grpcMaxConcurrentStreams", 0, "maximum number of gRPC calls per connection which run at the same time, additional calls wait, zero uses the gRPC default (no limit)")
+	flag.Var(&config.grpcMaxMessageSize, "grpcMaxMessageSize", "maximum size (like 4Mi) of gRPC messages which the driver receives or sends, zero uses the gRPC default (4Mi for received messages)")
+	flag.DurationVar(&config.grpcCallTimeout, "grpcCallTimeout", 0, "deadline for gRPC calls where the client did not set one, zero waits forever")
+	flag.DurationVar(&config.grpcKeepaliveMinTime, "grpcKeepaliveMinTime", 5*time.Second, "shortest interval at which gRPC clients may send keepalive pings, clients which ping more often get disconnected, zero uses the gRPC default (5m)")
+	flag.BoolVar(&config.grpcKeepalivePermitWithoutStream, "grpcKeepalivePermitWithoutStream", true, "allow keepalive pings from gRPC clients also while they have no active calls")
+	flag.DurationVar(&config.grpcKeepaliveTime, "grpcKeepaliveTime", time.Minute, "time without activity after which the driver pings a gRPC client, zero uses the gRPC default (2h)")
+	flag.DurationVar(&config.grpcKeepaliveTimeout, "grpcKeepaliveTimeout", 20*time.Second, "how long the driver waits for the response to a keepalive ping before it closes the connection, zero uses the gRPC default (20s)")
+	flag.DurationVar(&config.drainPeriod, "drainPeriod", time.Second, "how long the driver keeps serving gRPC calls after the termination signal, which gives sidecars time to shut down before the socket gets closed")
+	flag.DurationVar(&config.drainTimeout, "drainTimeout", 20*time.Second, "how long gRPC calls which are still pending after -drainPeriod may continue before they get canceled, zero waits for them forever")
+	flag.BoolVar(&config.grpcReflection, "grpcReflection", false, "node, inspect: serve the gRPC reflection API on -endpoint, which lets tools like grpcurl list and call the CSI services without proto files, for troubleshooting only")
+	flag.BoolVar(&config.grpcLogPayloads, "grpcLogPayloads", false, "log requests and responses of all gRPC calls as indented JSON, with secrets, service account tokens and parameters which look like key material replaced, for debugging only")
 	flag.Float64Var(&config.KubeAPIQPS, "kube-api-qps", 5, "QPS to use while communicating with the Kubernetes apiserver. Defaults to 5.0.")
 	flag.IntVar(&config.KubeAPIBurst, "kube-api-burst", 10, "Burst to use while communicating with the Kubernetes apiserver. Defaults to 10.")
 
 	/* metrics options */
-	flag.StringVar(&config.metricsListen, "metricsListen", "", "listen address (like :8001) for prometheus metrics endpoint, disabled by default")
+	flag.StringVar(&config.metricsListen, "metricsListen", "", "listen address (like :8001 or systemd://<name>) for prometheus metrics endpoint, disabled by default")
 	flag.StringVar(&config.metricsPath, "metricsPath", "/metrics", "The HTTP path where prometheus metrics will be exposed. Default is `/metrics`.")
+	flag.StringVar(&config.metricsCertFile, "metricsCertFile", "", "PEM file with the certificate for serving the metrics endpoint over TLS, empty serves plain HTTP")
+	flag.StringVar(&config.metricsKeyFile, "metricsKeyFile", "", "PEM file with the private key for -metricsCertFile")
+	flag.StringVar(&config.metricsClientCAFile, "metricsClientCAFile", "", "PEM file with the CA certificates for verifying clients of the metrics endpoint, enables mutual TLS, empty accepts all clients")
+	flag.StringVar(&config.metricsTenantTokens, "metricsTenantTokens", "", "JSON file with a map from bearer token to Kubernetes namespace, enables the tenant-scoped view of per-volume metrics under <metricsPath>/tenant")
+	flag.StringVar(&config.logVerbosityToken, "logVerbosityToken", "", "file with a bearer token which enables reading (GET) and changing (PUT) the log verbosity at runtime under /debug/flags/v on the metrics server, disabled by default")
+	flag.UintVar(&config.operationLogSize, "operationLogSize", 100, "node: number of recent CSI operations which are listed as JSON under <metricsPath>/operations, 0 disables the list")
+	flag.BoolVar(&config.bandwidthMetrics, "bandwidthMetrics", false, "node: report PMEM read/write bandwidth per socket, needs uncore perf events (CAP_PERFMON or kernel.perf_event_paranoid <= 0)")
+	flag.StringVar(&config.pprofListen, "pprof-listen", "", "listen address (like :6060) for the net/http/pprof profiling endpoints under /debug/pprof, localhost unless a host is given, disabled by default")
+	flag.StringVar(&config.tracingEndpoint, "tracingEndpoint", "", "address (like otel-collector:4317) of an OpenTelemetry collector which receives traces of the CSI calls via OTLP gRPC, disabled by default")
+	flag.IntVar(&config.tracingSamplingRatePerMillion, "tracingSamplingRatePerMillion", 1000000, "number of CSI calls per million which get traced when the caller did not decide already, by default all of them")
 
 	/* Controller mode options */
 	flag.Var(&config.nodeSelector, "nodeSelector", "controller: reschedule PVCs with a selected node where PMEM-CSI is not meant to run because the node does not have these labels (represented as JSON map)")
+	flag.StringVar(&config.rescheduleDriverNames, "rescheduleDriverNames", "", "controller: comma-separated list of additional driver names whose PVCs also get rescheduled, for example while renaming the driver")
+	flag.BoolVar(&config.rescheduleUnusableNodes, "rescheduleUnusableNodes", false, "controller: also reschedule PVCs with a selected node where PMEM-CSI runs, but the <drivername>/healthy label is false or all CSIStorageCapacity objects report zero capacity")
+	flag.BoolVar(&config.reschedulerDryRun, "rescheduler-dry-run", false, "controller: log and count PVCs which would get rescheduled without removing their selected node annotation")
+	flag.StringVar(&config.pvcSelectors.labels, "pvcLabelSelector", "", "controller: only watch PVCs with these labels (like pmem=true), PVCs without them do not get rescheduled and are ignored by the capacity report and scheduler extender")
+	flag.StringVar(&config.pvcSelectors.fields, "pvcFieldSelector", "", "controller: only watch PVCs with these fields (like metadata.namespace!=kube-system)")
+	flag.StringVar(&config.pvSelectors.labels, "pvLabelSelector", "", "controller: only watch PVs with these labels")
+	flag.StringVar(&config.pvSelectors.fields, "pvFieldSelector", "", "controller: only watch PVs with these fields")
+	flag.StringVar(&config.storageClassSelectors.labels, "storageClassLabelSelector", "", "controller: only watch storage classes with these labels, PVCs of other classes are treated like PVCs of other drivers")
+	flag.StringVar(&config.storageClassSelectors.fields, "storageClassFieldSelector", "", "controller: only watch storage classes with these fields (only metadata.name is supported by the apiserver)")
+	flag.DurationVar(&config.capacityReportInterval, "capacityReportInterval", 0, "controller: how often to update the PmemCSICapacityReport object named after the driver, zero disables the report (needs the CRD and permission to update the object)")
+	flag.BoolVar(&config.leaderElection, "leader-election", false, "controller: only run the controller in the instance which holds a Lease object named after the driver, other instances wait as hot spares without watching the apiserver")
+	flag.DurationVar(&config.controllerHeartbeatInterval, "controllerHeartbeatInterval", 0, "controller: how often each replica renews a Lease object with its heartbeat, which gets listed under <metricsPath>/controller, zero disables heartbeats (needs permission to get, list, create, update and delete leases)")
+	flag.StringVar(&config.leaderElectionNamespace, "leader-election-namespace", "", "controller: namespace of the Lease object for -leader-election, defaults to the namespace of the pod")
+	flag.StringVar(&config.schedulerListen, "schedulerListen", "", "controller: listen address (like :8000) for the scheduler extender, which filters out nodes without enough PMEM for the pending volumes of a pod, disabled by default")
+	flag.DurationVar(&config.pmemResourceInterval, "pmemResourceInterval", 0, "controller: how often to publish the PMEM of each node as extended resource <drivername>/pmem in the node status, also enables the webhook under /pod/mutate on the -schedulerListen server which adds requests for that resource to pods with PMEM-CSI volumes, zero disables both (needs CSIStorageCapacity and permission to patch node status)")
+	flag.Var(&config.schedulerScoring, "schedulerScoring", "controller: how the scheduler extender ranks nodes where the PMEM-CSI volumes of a pod fit: 'binpack' prefers nodes with the least PMEM left, 'spread' those with the most")
+	flag.StringVar(&config.schedulerCertFile, "schedulerCertFile", "", "controller: PEM file with the certificate for serving the scheduler extender over TLS, empty serves plain HTTP")
+	flag.StringVar(&config.schedulerKeyFile, "schedulerKeyFile", "", "controller: PEM file with the private key for -schedulerCertFile")
+	flag.StringVar(&config.schedulerClientCAFile, "schedulerClientCAFile", "", "controller: PEM file with the CA certificates for verifying the kube-scheduler, enables mutual TLS, empty accepts all clients")
 
 	/* Node mode options */
-	flag.Var(&config.DeviceManager, "deviceManager", "node: device manager to use to manage pmem devices, supported types: 'lvm' or 'direct' (= 'ndctl')")
+	flag.Var(&config.DeviceManager, "deviceManager", "node: device manager to use to manage pmem devices, supported types: 'lvm', 'direct' (= 'ndctl') or a device manager that was added to a custom driver binary")
 	flag.StringVar(&config.StateBasePath, "statePath", "", "node: directory path where to persist the state of the driver, defaults to /var/lib/<drivername>")
+	flag.Var(&config.stateNamespaceSize, "stateNamespaceSize", "node: size (like 1Gi) of an fsdax namespace which the driver creates, formats and mounts on the state directory, so the state is stored on PMEM together with the volumes, zero (the default) keeps the state on the directory as it is")
+	flag.StringVar(&config.deviceLinkDir, "deviceLinkDir", "", "node: directory where a symlink named after the volume ID is maintained for each volume while the driver runs, for example /dev/pmem-csi, empty (the default) disables the symlinks")
+	flag.Var(&config.sizeMismatchPolicy, "sizeMismatchPolicy", "node: what to do on startup when the stored size of a volume differs from its device: 'trust-device' updates the stored size, 'trust-state' grows devices which are too small, 'fail' refuses to start")
+	flag.Int64Var(&config.maxVolumesPerNode, "maxVolumesPerNode", 0, "node: maximum number of volumes that Kubernetes places on the node, zero means no limit")
+	flag.Var(&config.daxCheck, "daxCheck", "node: what to do when a volume with usage AppDirect ends up mounted without DAX: 'warn' logs a warning and emits an event, 'fail' fails NodePublishVolume, 'off' disables the check")
+	flag.BoolVar(&config.volumeEvents, "volumeEvents", true, "node: emit a warning event for the PVC (or PV, or pod of an ephemeral volume) when creating, staging or publishing a volume fails, needs permission to create events")
+	flag.StringVar(&config.allowedMountFlags, "allowedMountFlags", DefaultAllowedMountFlags, "node: comma-separated list of mount flags (like noatime or context) which may be used in volume capabilities, flags with a value are matched with and without it, empty allows all flags")
+	flag.BoolVar(&config.numaTopology, "numaTopology", false, "node: report a <drivername>/numa-<node>=true topology segment for each NUMA node with PMEM, for volumes which must be local to certain NUMA nodes")
+	flag.UintVar(&config.maxConcurrentCalls, "maxConcurrentCalls", 0, "node: maximum number of CSI calls which modify volumes and run at the same time, additional calls fail with RESOURCE_EXHAUSTED and a retry hint, zero means no limit")
+	flag.Var(&config.maxConcurrentCallsPerMethod, "maxConcurrentCallsPerMethod", "node: comma-separated <method>=<n> (like CreateVolume=2,NodePublishVolume=4) for CSI calls which modify volumes, additional calls of a method wait until one of the running calls finishes or their deadline expires, empty means no limits")
+	flag.UintVar(&config.maxDeletionQueue, "maxDeletionQueue", 0, "node: maximum number of deleted volumes which wait for zeroing in the background before DeleteVolume fails with RESOURCE_EXHAUSTED and a retry hint, zero means no limit")
+	flag.DurationVar(&config.trashRetention, "trashRetention", 0, "node: how long deleted volumes are kept in the trash, where they can be restored with the undelete-volume mode, before they get erased, zero erases them immediately")
+	flag.IntVar(&config.trashMaxPerVolume, "trashMaxPerVolume", 3, "node: how many deleted versions of the same volume ID are kept in the trash, older ones get erased before their retention period is over, zero keeps all")
+	flag.DurationVar(&config.stateCompactionInterval, "stateCompactionInterval", 24*time.Hour, "node: how often the node driver removes checksums of deleted volumes and compacts its state database, zero disables that")
+	flag.DurationVar(&config.orphanCleanupInterval, "orphanCleanupInterval", time.Hour, "node: how often the node driver unmounts mount points in its mount directory and closes dm-crypt devices which belong to no volume, zero disables that")
+	flag.BoolVar(&config.orphanCleanupDryRun, "orphanCleanupDryRun", false, "node: only log and count orphaned mount points and dm-crypt devices instead of removing them")
+	flag.StringVar(&config.containerdAddress, "containerdAddress", "", "node: containerd socket used for pulling images when volumes are created with populateFrom=<image>, empty disables images as source (tarball URLs are always supported)")
+	flag.Var(&config.scrubRate, "scrubRate", "node: how many bytes per second (like 100Mi) are written when zeroing the devices of deleted volumes in the background, which then get reused for new volumes, zero erases them while deleting the volume")
+	flag.Var(&config.keyProvider, "keyProvider", "node: where the passphrases of encrypted volumes come from: 'secret' expects them in the secrets referenced by the storage class or pod, 'vault' generates them and stores them in HashiCorp Vault")
+	flag.StringVar(&config.vaultAddress, "vaultAddress", "", "node: URL of the Vault server (like https://vault.example.com:8200) for -keyProvider=vault")
+	flag.StringVar(&config.vaultTokenFile, "vaultTokenFile", "", "node: file with the Vault token for -keyProvider=vault, read again for each request")
+	flag.StringVar(&config.vaultCAFile, "vaultCAFile", "", "node: PEM file with the CA certificates for verifying the Vault server, empty uses the system certificates")
+	flag.StringVar(&config.vaultKVMount, "vaultKVMount", "secret", "node: mount point of the KV version 2 secrets engine where volume keys are stored")
+	flag.StringVar(&config.vaultKVPrefix, "vaultKVPrefix", "pmem-csi", "node: path below the mount point where volume keys are stored, one secret per volume ID")
+	flag.DurationVar(&config.keyCacheTTL, "keyCacheTTL", 5*time.Minute, "node: how long keys fetched from Vault are kept in memory, zero disables caching")
+	flag.StringVar(&config.deniedParameters, "deniedParameters", "", "node: comma-separated list of volume parameters (like populateFrom,kataContainers) which storage classes and ephemeral volumes must not use, volumes with them fail with INVALID_ARGUMENT")
+	flag.StringVar(&config.publishAuthorizationURL, "publishAuthorizationURL", "", "node: URL of a webhook which gets asked whether a pod may use a volume before publishing it, with the service account token of the pod for the driver name as audience, empty disables the check")
+	flag.StringVar(&config.publishAuthorizationCAFile, "publishAuthorizationCAFile", "", "node: PEM file with the CA certificates for verifying the -publishAuthorizationURL server, empty uses the system certificates")
+	flag.StringVar(&config.operationAuditLog, "operationAuditLog", "", "node: file where each call which creates, deletes, stages, unstages, publishes or unpublishes a volume gets recorded as JSON line with caller, parameters and result, '-' selects stdout, empty disables the operation audit log")
+	flag.StringVar(&config.accessAuditLog, "accessAuditLog", "", "node: file where opens of files on volumes with accessAudit=true get recorded as JSON lines, '-' selects stdout, empty disables access auditing")
+	flag.BoolVar(&config.healthLabel, "healthLabel", false, "node: set a <drivername>/healthy=true|false label on the node with the result of the device manager health check, needs permission to patch the node object")
+	flag.BoolVar(&config.featureLabels, "featureLabels", false, "node: set a <drivername>/feature-<name>=true|false label on the node for each optional feature, needs permission to patch the node object")
 	flag.UintVar(&config.PmemPercentage, "pmemPercentage", 100, "node: percentage of space to be used by the driver in each PMEM region")
+	flag.StringVar(&config.regions, "regions", "", "node: comma-separated list of PMEM regions (like region0,region2) where the driver creates namespaces and volume groups, empty allows all regions")
+	flag.StringVar(&config.excludeRegions, "excludeRegions", "", "node: comma-separated list of PMEM regions which the driver must not use, for example because other tools own them")
+	flag.UintVar(&config.lvmThinOvercommit, "lvmThinOvercommit", 0, "node: provision LVM volumes from a thin pool per region and allow volumes with up to this percentage (at least 100) of the pool size in total, zero disables thin provisioning")
+	flag.UintVar(&config.lvmThinThreshold, "lvmThinThreshold", 80, "node: emit a warning event for the node when a thin pool is filled to this percentage, zero disables the event")
+
+	/* Failure injection options for node mode, not for normal operation */
+	flag.Var(&config.simulateMaxCapacity, "simulateMaxCapacity", "node: pretend that the node has at most this much PMEM (like 10Gi), zero disables the limit")
+	flag.UintVar(&config.simulateCreateFailures, "simulateCreateFailures", 0, "node: percentage of volume creation calls which fail as if the node was out of space")
+	flag.StringVar(&config.simulateNodes, "simulateNodes", "", "node: comma-separated list of node IDs where the simulation is active, empty selects all nodes")
+
+	/* Verify mode options */
+	flag.BoolVar(&config.recordChecksums, "recordChecksums", false, "verify-volumes: record new checksums for all volumes instead of verifying them against the ones recorded earlier")
+
+	/* Undelete mode options */
+	flag.StringVar(&config.volumeID, "volumeID", "", "undelete-volume: ID of the volume that the node driver is asked to restore from the trash, empty lists the volumes in the trash; rotate-key: ID of the encrypted volume")
+
+	/* State export and import options */
+	flag.StringVar(&config.stateFile, "stateFile", "-", "export-state, import-state: JSON file with the state of the node, '-' writes to stdout or reads from stdin")
+
+	/* Key rotation options */
+	flag.StringVar(&config.oldPassphraseFile, "oldPassphraseFile", "", "rotate-key: file with the current passphrase of the volume, for -keyProvider=secret")
+	flag.StringVar(&config.newPassphraseFile, "newPassphraseFile", "", "rotate-key: file with the new passphrase of the volume, for -keyProvider=secret")
+
+	/* System RAM conversion options */
+	flag.StringVar(&config.systemRAMNamespaces, "systemRAMNamespaces", "", "convert-to-system-ram: comma-separated list of namespaces (device names like namespace0.0 or names) which get used as system RAM, empty selects all raw namespaces and all devdax namespaces without name")
+
+	/* Profile mode options */
+	flag.StringVar(&config.profileConfigMap, "profileConfigMap", "", "apply-profile: <namespace>/<name> of the ConfigMap with the provisioning profiles, keyed by node name or \"default\"")
+
+	/* Rename mode options */
+	flag.StringVar(&config.oldDriverName, "oldDriverName", "", "rename-driver: name under which the driver ran before")
+	flag.StringVar(&config.oldStatePath, "oldStatePath", "", "rename-driver: state directory of the driver under the old name, defaults to /var/lib/<oldDriverName>")
 
 	// These options no longer have an effect. They don't get removed to
 	// keep old deployments working when upgrading only the image.
 	flag.String("caFile", "ca.pem", "Root CA certificate file to use for verifying clients (optional, can be empty) - DEPRECATED!")
 	flag.String("certFile", "pmem-controller.pem", "SSL certificate file to be used by the PMEM-CSI controller - DEPRECATED!")
 	flag.String("keyFile", "pmem-controller-key.pem", "Private key file associated with the certificate - DEPRECATED!")
-	flag.String("schedulerListen", "", "controller: HTTPS listen address (like :8000) for scheduler extender and mutating webhook, disabled by default (needs caFile, certFile, keyFile) - DEPRECATED!")
 	flag.String("insecureSchedulerListen", "", "controller: HTTP listen address (like :8001) for scheduler extender and mutating webhook, disabled by default (does not use TLS config) - DEPRECATED!")
 
 	klog.InitFlags(nil)
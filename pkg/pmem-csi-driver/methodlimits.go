@@ -0,0 +1,154 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// MethodLimits maps CSI methods to the maximum number of calls of
+// that method which run at the same time. As flag value it is a
+// comma-separated list of <method>=<n>.
+type MethodLimits map[string]int
+
+func (limits *MethodLimits) String() string {
+	var parts []string
+	for method, limit := range *limits {
+		parts = append(parts, fmt.Sprintf("%s=%d", method, limit))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (limits *MethodLimits) Set(value string) error {
+	result := MethodLimits{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		method, limit, ok := strings.Cut(part, "=")
+		if !ok {
+			return fmt.Errorf("%q: must be <method>=<limit>", part)
+		}
+		if !limitedMethods[method] {
+			return fmt.Errorf("%q: only calls which modify volumes can be limited", method)
+		}
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("%q: limit must be a positive number", part)
+		}
+		result[method] = n
+	}
+	*limits = result
+	return nil
+}
+
+// methodLimiter lets calls of a method wait while the maximum number
+// of calls of that method are running. Unlike the backpressure it
+// does not reject calls, they wait until it is their turn or their
+// deadline expires.
+type methodLimiter struct {
+	// slots has one channel per limited method, with the limit as
+	// capacity.
+	slots map[string]chan struct{}
+
+	inFlight *prometheus.GaugeVec
+	queued   *prometheus.GaugeVec
+	wait     *prometheus.HistogramVec
+}
+
+func newMethodLimiter(limits MethodLimits) *methodLimiter {
+	ml := &methodLimiter{
+		slots: map[string]chan struct{}{},
+		inFlight: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "pmem_csi_node_method_calls_in_flight",
+				Help: "Number of CSI calls which currently run, for methods with a limit.",
+			},
+			[]string{"method"},
+		),
+		queued: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: "pmem_csi_node_method_calls_queued",
+				Help: "Number of CSI calls which wait because the limit for their method is reached.",
+			},
+			[]string{"method"},
+		),
+		wait: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    "pmem_csi_node_method_queue_wait_seconds",
+				Help:    "Time that CSI calls waited before they could run, for methods with a limit.",
+				Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+			},
+			[]string{"method"},
+		),
+	}
+	for method, limit := range limits {
+		ml.slots[method] = make(chan struct{}, limit)
+		// Export zero values right away.
+		ml.inFlight.WithLabelValues(method)
+		ml.queued.WithLabelValues(method)
+	}
+	return ml
+}
+
+// intercept is a gRPC interceptor which applies the limits.
+func (ml *methodLimiter) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	slots, ok := ml.slots[method]
+	if !ok {
+		return handler(ctx, req)
+	}
+	start := time.Now()
+	select {
+	case slots <- struct{}{}:
+	default:
+		logger := klog.FromContext(ctx)
+		logger.V(3).Info("Waiting for other calls of the same method", "method", method, "limit", cap(slots))
+		ml.queued.WithLabelValues(method).Inc()
+		select {
+		case slots <- struct{}{}:
+			ml.queued.WithLabelValues(method).Dec()
+		case <-ctx.Done():
+			ml.queued.WithLabelValues(method).Dec()
+			ml.wait.WithLabelValues(method).Observe(time.Since(start).Seconds())
+			return nil, status.Errorf(status.FromContextError(ctx.Err()).Code(), "gave up waiting for one of %d other %s calls to finish after %s: %v", cap(slots), method, time.Since(start).Round(time.Millisecond), ctx.Err())
+		}
+	}
+	ml.wait.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	ml.inFlight.WithLabelValues(method).Inc()
+	defer func() {
+		ml.inFlight.WithLabelValues(method).Dec()
+		<-slots
+	}()
+	return handler(ctx, req)
+}
+
+// MustRegister adds the metrics to the registry, using labels to tag each sample with node and driver name.
+func (ml *methodLimiter) MustRegister(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		pmdmanager.NodeLabel: nodeName,
+		"driver_name":        driverName,
+	}
+	reg = prometheus.WrapRegistererWith(labels, reg)
+	reg.MustRegister(ml.inFlight)
+	reg.MustRegister(ml.queued)
+	reg.MustRegister(ml.wait)
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestMethodLimitsFlag(t *testing.T) {
+	var limits MethodLimits
+	require.NoError(t, limits.Set("CreateVolume=2, NodePublishVolume=4"), "parse")
+	assert.Equal(t, MethodLimits{"CreateVolume": 2, "NodePublishVolume": 4}, limits, "parsed")
+	assert.Equal(t, "CreateVolume=2,NodePublishVolume=4", limits.String(), "string")
+
+	for _, value := range []string{"CreateVolume", "CreateVolume=0", "CreateVolume=x", "GetCapacity=1", "NoSuchMethod=1"} {
+		assert.Error(t, limits.Set(value), value)
+	}
+}
+
+func TestMethodLimiter(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ml := newMethodLimiter(MethodLimits{"CreateVolume": 1})
+	reg := prometheus.NewPedanticRegistry()
+	ml.MustRegister(reg, "worker", "pmem-csi.intel.com")
+	ok := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	call := func(ctx context.Context, method string, handler grpc.UnaryHandler) error {
+		_, err := ml.intercept(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/" + method}, handler)
+		return err
+	}
+
+	require.NoError(t, call(ctx, "CreateVolume", ok), "no other call")
+
+	// The first call blocks the second one until it returns.
+	release := make(chan struct{})
+	running := make(chan struct{})
+	first := make(chan error, 1)
+	go func() {
+		first <- call(ctx, "CreateVolume", func(ctx context.Context, req interface{}) (interface{}, error) {
+			close(running)
+			<-release
+			return nil, nil
+		})
+	}()
+	<-running
+	assert.NoError(t, call(ctx, "DeleteVolume", ok), "not limited")
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	err := call(timeoutCtx, "CreateVolume", ok)
+	assert.Equal(t, codes.DeadlineExceeded, status.Code(err), "call with deadline: %v", err)
+
+	second := make(chan error, 1)
+	go func() {
+		second <- call(ctx, "CreateVolume", ok)
+	}()
+	require.Eventually(t, func() bool {
+		return testutil.ToFloat64(ml.queued.WithLabelValues("CreateVolume")) == 1
+	}, 5*time.Second, time.Millisecond, "second call queued")
+	assert.Equal(t, 1.0, testutil.ToFloat64(ml.inFlight.WithLabelValues("CreateVolume")), "running calls")
+	close(release)
+	assert.NoError(t, <-first, "first call")
+	assert.NoError(t, <-second, "second call")
+	assert.Equal(t, 0.0, testutil.ToFloat64(ml.queued.WithLabelValues("CreateVolume")), "queued calls")
+	assert.Equal(t, 0.0, testutil.ToFloat64(ml.inFlight.WithLabelValues("CreateVolume")), "running calls")
+	count, err := testutil.GatherAndCount(reg, "pmem_csi_node_method_queue_wait_seconds")
+	require.NoError(t, err, "gather")
+	assert.Equal(t, 1, count, "wait histograms")
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultAllowedMountFlags is the default for the -allowedMountFlags
+// parameter. It covers the generic flags and those ext4 and xfs flags
+// which are useful for PMEM volumes. Flags which change how the mount
+// itself is done (remount, move, bind, ...) are set by the driver
+// where needed and not allowed in the volume capability.
+var DefaultAllowedMountFlags = strings.Join([]string{
+	// generic
+	"ro", "rw", "sync", "async", "dirsync",
+	"atime", "noatime", "relatime", "norelatime", "strictatime", "nostrictatime", "diratime", "nodiratime", "lazytime", "nolazytime",
+	"dev", "nodev", "suid", "nosuid", "exec", "noexec",
+	// SELinux, passed by kubelet when the CSIDriver enables seLinuxMount
+	"context", "fscontext", "defcontext", "rootcontext",
+	// DAX
+	"dax", "nodax",
+	// ext4 and xfs
+	"discard", "nodiscard", "barrier", "nobarrier", "errors", "data", "commit",
+	"quota", "noquota", "usrquota", "grpquota", "prjquota", "uquota", "gquota", "pquota",
+	"inode32", "inode64", "nouuid", "largeio", "nolargeio", "allocsize", "logbufs", "logbsize",
+}, ",")
+
+// mountFlagConflicts groups flags which set the same property. Two
+// flags with different values for the same property contradict each
+// other.
+var mountFlagConflicts = map[string]struct{ property, value string }{
+	"ro":         {"ro", "true"},
+	"rw":         {"ro", "false"},
+	"dax":        {"dax", "always"},
+	"dax=always": {"dax", "always"},
+	"dax=inode":  {"dax", "inode"},
+	"dax=never":  {"dax", "never"},
+	"nodax":      {"dax", "never"},
+}
+
+// isSELinuxMountFlag is true for flags which set the SELinux context of
+// all files in the filesystem. Kubelet then does not need to relabel
+// each file, which would take a long time for large volumes.
+func isSELinuxMountFlag(flag string) bool {
+	name, _, _ := strings.Cut(flag, "=")
+	switch name {
+	case "context", "fscontext", "defcontext", "rootcontext":
+		return true
+	default:
+		return false
+	}
+}
+
+// parseAllowedMountFlags turns the comma-separated list into the
+// allow-list for checkMountFlags. An empty list allows all flags.
+func parseAllowedMountFlags(flags string) map[string]bool {
+	var allowed map[string]bool
+	for _, flag := range strings.Split(flags, ",") {
+		if flag := strings.TrimSpace(flag); flag != "" {
+			if allowed == nil {
+				allowed = map[string]bool{}
+			}
+			allowed[flag] = true
+		}
+	}
+	return allowed
+}
+
+// checkMountFlags validates the requested flags from a volume
+// capability against the allow-list and then looks for contradicting
+// flags in all flags of the mount, i.e. including the ones that the
+// driver adds itself. A flag is allowed when it is in the list, either
+// as it is or by its name without the "=<value>" part.
+func checkMountFlags(allowed map[string]bool, requested, flags []string) error {
+	if allowed != nil {
+		for _, flag := range requested {
+			name, _, _ := strings.Cut(flag, "=")
+			if !allowed[flag] && !allowed[name] {
+				return fmt.Errorf("mount flag %q not allowed", flag)
+			}
+		}
+	}
+	set := map[string]string{}
+	for _, flag := range flags {
+		conflict, ok := mountFlagConflicts[flag]
+		if !ok {
+			continue
+		}
+		if other, ok := set[conflict.property]; ok && mountFlagConflicts[other].value != conflict.value {
+			return fmt.Errorf("mount flags %q and %q contradict each other", other, flag)
+		}
+		set[conflict.property] = flag
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckMountFlags(t *testing.T) {
+	allowed := parseAllowedMountFlags(DefaultAllowedMountFlags)
+	testcases := map[string]struct {
+		allowed   map[string]bool
+		requested []string
+		added     []string
+		err       string
+	}{
+		"none": {
+			allowed: allowed,
+		},
+		"allowed": {
+			allowed:   allowed,
+			requested: []string{"noatime", "nodev"},
+			added:     []string{"dax", "bind"},
+		},
+		"with value": {
+			allowed:   allowed,
+			requested: []string{`context="system_u:object_r:container_file_t:s0:c1,c2"`, "errors=remount-ro"},
+		},
+		"not allowed": {
+			allowed:   allowed,
+			requested: []string{"noatime", "remount"},
+			err:       `mount flag "remount" not allowed`,
+		},
+		"exact value": {
+			allowed:   parseAllowedMountFlags("data=ordered"),
+			requested: []string{"data=writeback"},
+			err:       `mount flag "data=writeback" not allowed`,
+		},
+		"all allowed": {
+			allowed:   parseAllowedMountFlags(""),
+			requested: []string{"remount"},
+		},
+		"dax and nodax": {
+			allowed:   allowed,
+			requested: []string{"nodax"},
+			added:     []string{"dax"},
+			err:       `mount flags "nodax" and "dax" contradict each other`,
+		},
+		"dax twice": {
+			allowed:   allowed,
+			requested: []string{"dax=always"},
+			added:     []string{"dax"},
+		},
+		"ro and rw": {
+			allowed:   allowed,
+			requested: []string{"rw"},
+			added:     []string{"bind", "ro"},
+			err:       `mount flags "rw" and "ro" contradict each other`,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			requested := tc.requested
+			err := checkMountFlags(tc.allowed, requested, append(requested, tc.added...))
+			if tc.err != "" {
+				assert.EqualError(t, err, tc.err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/mount-utils"
+)
+
+// mountTable caches the parsed mount table of the driver. On a node
+// with many pods /proc/self/mountinfo is large, and publishing a
+// volume reads it several times. The kernel reports each change of
+// the mount table as POLLPRI on an open /proc/self/mountinfo, so the
+// cached copy only gets parsed again when needed. Other files, like
+// the ones used by tests, are parsed each time.
+type mountTable struct {
+	mutex sync.Mutex
+	path  string
+	// file is kept open to get notified about changes, nil when
+	// that is not possible.
+	file  *os.File
+	valid bool
+	infos []mount.MountInfo
+}
+
+var mounts = &mountTable{}
+
+// list returns all entries of the mount table at mountInfoPath. The
+// result must not be modified.
+func (mt *mountTable) list() ([]mount.MountInfo, error) {
+	mt.mutex.Lock()
+	defer mt.mutex.Unlock()
+
+	if mt.path != mountInfoPath {
+		if mt.file != nil {
+			mt.file.Close()
+			mt.file = nil
+		}
+		mt.path = mountInfoPath
+		mt.valid = false
+		if strings.HasPrefix(mt.path, "/proc/") {
+			// Opened before parsing, so changes in between
+			// are not missed.
+			if file, err := os.Open(mt.path); err == nil {
+				mt.file = file
+			}
+		}
+	}
+	if mt.valid && !mt.changed() {
+		return mt.infos, nil
+	}
+	infos, err := mount.ParseMountInfo(mt.path)
+	if err != nil {
+		return nil, err
+	}
+	mt.infos = infos
+	mt.valid = mt.file != nil
+	return infos, nil
+}
+
+// changed checks for and resets a pending change notification.
+func (mt *mountTable) changed() bool {
+	fds := []unix.PollFd{{Fd: int32(mt.file.Fd()), Events: unix.POLLPRI}}
+	n, err := unix.Poll(fds, 0)
+	return err != nil || n > 0 && fds[0].Revents&(unix.POLLPRI|unix.POLLERR) != 0
+}
+
+// find returns the mount which is visible at the path, nil if the
+// path is not a mount point.
+func (mt *mountTable) find(path string) (*mount.MountInfo, error) {
+	infos, err := mt.list()
+	if err != nil {
+		return nil, err
+	}
+	path = filepath.Clean(path)
+	// The last entry for the path is the one that is visible.
+	for i := len(infos) - 1; i >= 0; i-- {
+		if infos[i].MountPoint == path {
+			info := infos[i]
+			return &info, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMountTable(t *testing.T) {
+	defer func(path string) { mountInfoPath = path }(mountInfoPath)
+
+	// A file which does not support change notifications gets
+	// parsed each time.
+	mountInfoPath = filepath.Join(t.TempDir(), "mountinfo")
+	require.NoError(t, os.WriteFile(mountInfoPath, []byte(`22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 22 259:2 / /mnt rw,relatime shared:20 - ext4 /dev/pmem0 rw
+`), 0644), "write mountinfo")
+	mt := &mountTable{}
+	info, err := mt.find("/mnt/")
+	require.NoError(t, err, "find /mnt")
+	if assert.NotNil(t, info, "/mnt mounted") {
+		assert.Equal(t, "/dev/pmem0", info.Source, "source")
+	}
+	require.NoError(t, os.WriteFile(mountInfoPath, []byte(`22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 22 259:2 / /mnt rw,relatime shared:20 - ext4 /dev/pmem0 rw
+41 22 259:3 / /mnt rw,relatime shared:21 - xfs /dev/pmem1 rw
+`), 0644), "update mountinfo")
+	info, err = mt.find("/mnt")
+	require.NoError(t, err, "find /mnt again")
+	if assert.NotNil(t, info, "/mnt still mounted") {
+		assert.Equal(t, "/dev/pmem1", info.Source, "source of the visible mount")
+	}
+	info, err = mt.find("/tmp")
+	require.NoError(t, err, "find /tmp")
+	assert.Nil(t, info, "/tmp not mounted")
+
+	// The real mount table only gets parsed again after a change.
+	// Other processes on the host may change it in between, so
+	// try a few times.
+	mountInfoPath = "/proc/self/mountinfo"
+	cached := false
+	for i := 0; i < 10 && !cached; i++ {
+		first, err := mt.list()
+		require.NoError(t, err, "list mounts")
+		require.NotNil(t, mt.file, "watching for changes")
+		second, err := mt.list()
+		require.NoError(t, err, "list mounts again")
+		cached = &first[0] == &second[0]
+	}
+	assert.True(t, cached, "cached")
+}
@@ -10,6 +10,7 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -19,9 +20,10 @@ import (
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
 	"k8s.io/utils/keymutex"
-	"k8s.io/utils/mount"
 
 	pmemerr "github.com/intel/pmem-csi/pkg/errors"
 	pmemexec "github.com/intel/pmem-csi/pkg/exec"
@@ -61,6 +63,22 @@ type nodeServer struct {
 
 	// A directory for additional mount points.
 	mountDirectory string
+
+	// Records file accesses on volumes with access auditing, nil if disabled.
+	auditor *accessAuditor
+
+	// Reported in NodeGetInfo, zero means no limit.
+	maxVolumesPerNode int64
+	// numaTopology adds the NUMA nodes of the PMEM to the topology.
+	numaTopology bool
+	// daxCheck determines what happens when DAX is not active after mounting.
+	daxCheck DAXCheck
+	// allowedMountFlags limits the flags in volume capabilities, nil allows all.
+	allowedMountFlags map[string]bool
+	// recorder is used for events about volumes, nil if disabled.
+	recorder record.EventRecorder
+	// authorizer decides whether a pod may use a volume, nil if disabled.
+	authorizer *publishAuthorizer
 }
 
 var _ csi.NodeServer = &nodeServer{}
@@ -77,6 +95,34 @@ func NewNodeServer(cs *nodeControllerServer, mountDirectory string) *nodeServer
 					},
 				},
 			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+					},
+				},
+			},
+			{
+				Type: &csi.NodeServiceCapability_Rpc{
+					Rpc: &csi.NodeServiceCapability_RPC{
+						Type: csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+					},
+				},
+			},
 		},
 		cs:             cs,
 		mounter:        mount.New(""),
@@ -89,13 +135,21 @@ func (ns *nodeServer) RegisterService(rpcServer *grpc.Server) {
 }
 
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
+	segments := map[string]string{}
+	if ns.numaTopology {
+		numaNodes, err := ns.cs.dm.GetNUMANodes(ctx)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "get NUMA nodes: %v", err)
+		}
+		segments = numaTopology(numaNodes)
+	}
+	segments[DriverTopologyKey] = ns.cs.nodeID
 	return &csi.NodeGetInfoResponse{
 		NodeId: ns.cs.nodeID,
 		AccessibleTopology: &csi.Topology{
-			Segments: map[string]string{
-				DriverTopologyKey: ns.cs.nodeID,
-			},
+			Segments: segments,
 		},
+		MaxVolumesPerNode: ns.maxVolumesPerNode,
 	}, nil
 }
 
@@ -105,10 +159,6 @@ func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetC
 	}, nil
 }
 
-func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
-}
-
 func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
 	volumeID := req.GetVolumeId()
 	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID)
@@ -148,7 +198,8 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		"read-only", readOnly,
 		"mount-flags", mountFlags,
 		"fs-type", fsType,
-		"volume-context", volumeContext,
+		"volume-context", parameters.WithoutTokens(volumeContext),
+		"secret-keys", parameters.Secrets(req.GetSecrets()).Keys(),
 	)
 
 	// Kubernetes v1.16+ would request ephemeral volumes via VolumeContext
@@ -171,8 +222,17 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		ephemeral = device == nil && !ok && len(srcPath) == 0
 	}
 
+	if ns.authorizer != nil {
+		if err := ns.authorizer.authorize(ctx, req, ephemeral); err != nil {
+			return nil, err
+		}
+	}
+
 	var volumeParameters parameters.Volume
 	if ephemeral {
+		if err := ns.cs.checkDeniedParameters(req.GetVolumeContext()); err != nil {
+			return nil, err
+		}
 		v, err := parameters.Parse(parameters.EphemeralVolumeOrigin, req.GetVolumeContext())
 		if err != nil {
 			return nil, status.Error(codes.InvalidArgument, "ephemeral inline volume parameters: "+err.Error())
@@ -213,6 +273,9 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	if readOnly {
 		mountFlags = append(mountFlags, "ro")
 	}
+	if err := checkMountFlags(ns.allowedMountFlags, req.GetVolumeCapability().GetMount().GetMountFlags(), mountFlags); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	rawBlock := false
 	switch req.VolumeCapability.GetAccessType().(type) {
@@ -226,6 +289,16 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 
 		notMnt, err := mount.IsNotMountPoint(ns.mounter, targetPath)
+		if mount.IsCorruptedMnt(err) {
+			// For example a filesystem which was mounted
+			// while its device got removed. Mounting
+			// again below replaces it.
+			logger.Info("Unmounting corrupted mount at target path", "err", err)
+			if err := ns.mounter.Unmount(targetPath); err != nil {
+				return nil, status.Errorf(codes.Internal, "unmount corrupted target path: %v", err)
+			}
+			notMnt, err = true, nil
+		}
 		if err != nil && !os.IsNotExist(err) {
 			return nil, status.Error(codes.Internal, "validate target path: "+err.Error())
 		}
@@ -237,21 +310,19 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			//    VolumeCapability/fsType (if present in request) must match used fsType.
 			// 3) Readonly MUST match
 			// If there is mismatch of any of above, we return ALREADY_EXISTS error.
-			mpList, err := ns.mounter.List()
+			info, err := mounts.find(targetPath)
 			if err != nil {
 				return nil, status.Errorf(codes.Internal, "Failed to fetch existing mount details while checking %q: %v", targetPath, err)
 			}
-			for i := len(mpList) - 1; i >= 0; i-- {
-				if mpList[i].Path == targetPath {
-					logger.V(5).Info("Found mounted filesystem",
-						"mount-options", mpList[i].Opts,
-						"fs-type", mpList[i].Type,
-					)
-					if (fsType == "" || mpList[i].Type == fsType) && findMountFlags(mountFlags, mpList[i].Opts) {
-						logger.V(3).Info("Parameters match existing filesystem, done")
-						return &csi.NodePublishVolumeResponse{}, nil
-					}
-					break
+			if info != nil {
+				opts := append(append([]string{}, info.MountOptions...), info.SuperOptions...)
+				logger.V(5).Info("Found mounted filesystem",
+					"mount-options", opts,
+					"fs-type", info.FsType,
+				)
+				if (fsType == "" || info.FsType == fsType) && findMountFlags(mountFlags, opts) {
+					logger.V(3).Info("Parameters match existing filesystem, done")
+					return &csi.NodePublishVolumeResponse{}, nil
 				}
 			}
 			logger.V(3).Info("Parameters do not match existing filesystem, bailing out")
@@ -259,11 +330,20 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 	}
 
+	if !ephemeral {
+		if err := ns.acquireSingleWriter(ctx, volumeID, targetPath, req.GetVolumeCapability().GetAccessMode().GetMode()); err != nil {
+			return nil, err
+		}
+	}
+
 	if rawBlock && volumeParameters.GetKataContainers() {
 		// We cannot pass block devices with DAX semantic into QEMU.
 		// TODO: add validation of CreateVolumeRequest.VolumeCapabilities and already detect the problem there.
 		return nil, status.Error(codes.InvalidArgument, "raw block volumes are incompatible with Kata Containers")
 	}
+	if rawBlock && volumeParameters.HasRootPermissions() {
+		return nil, status.Errorf(codes.InvalidArgument, "raw block volumes have no filesystem for %q, %q and %q", parameters.RootMode, parameters.RootUID, parameters.RootGID)
+	}
 
 	// We always (bind) mount. This is not strictly necessary for
 	// Kata Containers and persistent volumes because we could use
@@ -282,9 +362,35 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 		hostMount = filepath.Join(ns.mountDirectory, req.GetVolumeId())
 	}
+	if rawBlock && readOnly {
+		roPath, err := createReadOnlyDevice(ctx, srcPath, targetPath)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		srcPath = roPath
+	}
 	if err := ns.mount(ctx, srcPath, hostMount, mountFlags, rawBlock); err != nil {
+		if rawBlock && readOnly {
+			if err := removeReadOnlyDevice(ctx, targetPath); err != nil {
+				logger.Error(err, "Removing read-only device failed")
+			}
+		}
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if !rawBlock && readOnly {
+		ro, err := mountedReadOnly(hostMount)
+		if err == nil && !ro {
+			err = errors.New("mounted writable")
+		}
+		if err != nil {
+			// Unmount, otherwise a retry would find the
+			// mounted volume and succeed.
+			if err := ns.mounter.Unmount(hostMount); err != nil {
+				logger.Error(err, "Unmounting writable volume failed", "target-path", hostMount)
+			}
+			return nil, status.Errorf(codes.Internal, "check read-only mount at %s: %v", hostMount, err)
+		}
+	}
 
 	if ephemeral && fsType == "xfs" {
 		if err := xfs.ConfigureFS(hostMount); err != nil {
@@ -292,7 +398,35 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		}
 	}
 
+	if !rawBlock && !volumeParameters.GetKataContainers() && volumeParameters.GetUsage() == parameters.UsageAppDirect {
+		if err := ns.checkDAX(ctx, volumeID, hostMount, req.GetVolumeContext()); err != nil {
+			// Unmount, otherwise a retry would find the
+			// mounted volume and succeed.
+			if err := ns.mounter.Unmount(hostMount); err != nil {
+				logger.Error(err, "Unmounting volume without DAX failed", "target-path", hostMount)
+			}
+			return nil, err
+		}
+	}
+
 	if !volumeParameters.GetKataContainers() {
+		// A read-only bind mount cannot be modified, but the
+		// staged filesystem underneath can.
+		rootPath := hostMount
+		if readOnly && !ephemeral {
+			rootPath = srcPath
+		}
+		if !readOnly || !ephemeral {
+			if err := ns.applyRootPermissions(ctx, volumeID, ephemeral, volumeParameters, rootPath); err != nil {
+				// Unmount, otherwise a retry would find the
+				// mounted volume and succeed.
+				if err := ns.mounter.Unmount(hostMount); err != nil {
+					logger.Error(err, "Unmounting volume failed", "target-path", hostMount)
+				}
+				return nil, err
+			}
+		}
+
 		// A normal volume, return early.
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
@@ -350,9 +484,21 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}
 
 	// TODO: Try to mount with dax first, fall back to mount without it if not supported.
-	if err := ns.mount(ctx, loopDev, targetPath, []string{}, false); err != nil {
+	var loopMountFlags []string
+	if readOnly {
+		loopMountFlags = append(loopMountFlags, "ro")
+	}
+	if err := ns.mount(ctx, loopDev, targetPath, loopMountFlags, false); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
+	if !readOnly {
+		if err := ns.applyRootPermissions(ctx, volumeID, ephemeral, volumeParameters, targetPath); err != nil {
+			if err := ns.mounter.Unmount(targetPath); err != nil {
+				logger.Error(err, "Unmounting volume failed", "target-path", targetPath)
+			}
+			return nil, err
+		}
+	}
 
 	return &csi.NodePublishVolumeResponse{}, nil
 }
@@ -398,6 +544,11 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	// Check if the target path is really a mount point. If it's not a mount point *and* we don't
 	// have such a volume, then we are done.
 	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	if mount.IsCorruptedMnt(err) {
+		// Still mounted, unmounting works.
+		logger.Info("Target path is a corrupted mount", "err", err)
+		notMnt, err = false, nil
+	}
 	if (notMnt || err != nil && !os.IsNotExist(err)) && vol == nil {
 		logger.V(3).Info("Target path is not a mount point, no such volume -> done")
 		return &csi.NodeUnpublishVolumeResponse{}, nil
@@ -442,6 +593,9 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 			return nil, err
 		}
 	}
+	if err := removeReadOnlyDevice(ctx, targetPath); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
 
 	err = os.Remove(targetPath)
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
@@ -449,6 +603,10 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	}
 	logger.V(5).Info("Target path removed with harmless error or no error", "error", err)
 
+	if err := ns.releaseSingleWriter(ctx, vol, targetPath); err != nil {
+		return nil, err
+	}
+
 	if p.GetPersistency() == parameters.PersistencyEphemeral {
 		if _, err := ns.cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.ID}); err != nil {
 			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to delete ephemeral volume %s: %s", volumeID, err.Error()))
@@ -514,21 +672,30 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
 	}
 
+	v, err := parameters.Parse(parameters.PersistentVolumeOrigin, req.GetVolumeContext())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, "persistent volume context: "+err.Error())
+	}
+
 	// We should do nothing for block device usage
 	switch req.VolumeCapability.GetAccessType().(type) {
 	case *csi.VolumeCapability_Block:
+		if v.GetAccessAudit() {
+			return nil, status.Error(codes.InvalidArgument, "access auditing is not supported for raw block volumes")
+		}
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
-
+	if v.GetAccessAudit() && ns.auditor == nil {
+		return nil, status.Error(codes.FailedPrecondition, "access auditing is requested for the volume, but not enabled in the driver")
+	}
 	requestedFsType := req.GetVolumeCapability().GetMount().GetFsType()
 	if requestedFsType == "" {
 		// Default to ext4 filesystem
 		requestedFsType = defaultFilesystem
 	}
-
-	v, err := parameters.Parse(parameters.PersistentVolumeOrigin, req.GetVolumeContext())
-	if err != nil {
-		return nil, status.Error(codes.InvalidArgument, "persistent volume context: "+err.Error())
+	if v.GetEnforceSize() && requestedFsType != "xfs" {
+		// Normally rejected by CreateVolume already.
+		return nil, status.Errorf(codes.InvalidArgument, "parameter %q needs fstype xfs, volume is staged with %s", parameters.EnforceSize, requestedFsType)
 	}
 
 	// Serialize by VolumeId
@@ -537,11 +704,27 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		_ = volumeMutex.UnlockKey(req.GetVolumeId())
 	}()
 
+	end, err := ns.cs.operations.begin(ctx, volumeID, phaseStaging)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
 	mountOptions := req.GetVolumeCapability().GetMount().GetMountFlags()
 	logger.V(3).Info("Staging volume",
 		"fs-type", requestedFsType,
 		"mount-options", mountOptions,
+		"secret-keys", parameters.Secrets(req.GetSecrets()).Keys(),
 	)
+	if v.GetUsage() == parameters.UsageAppDirect {
+		mountOptions = append(mountOptions, daxMountFlag)
+	}
+	if v.GetEnforceSize() {
+		mountOptions = append(mountOptions, xfs.MountOption)
+	}
+	if err := checkMountFlags(ns.allowedMountFlags, req.GetVolumeCapability().GetMount().GetMountFlags(), mountOptions); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
 	if err != nil {
@@ -555,6 +738,11 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		}
 		return nil, status.Errorf(codes.Internal, "failed to get device details for volume id %q: %v", volumeID, err)
 	}
+	if v.GetEncryption() != parameters.EncryptionNone {
+		if device, err = ns.openEncryptedDevice(ctx, device, volumeID, req.GetSecrets()); err != nil {
+			return nil, err
+		}
+	}
 
 	// Check does devicepath already contain a filesystem?
 	existingFsType, err := determineFilesystemType(ctx, device.Path)
@@ -567,19 +755,32 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		// Is existing filesystem type same as requested?
 		if existingFsType == requestedFsType {
 			logger.V(4).Info("Skipping mkfs as file system already exists on device", "device", device.Path)
+			// A retry may find the filesystem already mounted,
+			// it must not get checked then.
+			if notMnt, err := ns.mounter.IsLikelyNotMountPoint(stagingtargetPath); v.GetFsckPolicy() != parameters.FsckSkip && (notMnt || os.IsNotExist(err)) {
+				progressFromContext(ctx).setStage("checking filesystem")
+				replayLog := func(ctx context.Context) error {
+					// Mounting replays the log, the real mount then
+					// happens after the check.
+					if err := ns.mount(ctx, device.Path, stagingtargetPath, nil, false /* raw block */); err != nil {
+						return err
+					}
+					return ns.mounter.Unmount(stagingtargetPath)
+				}
+				if err := checkFilesystem(ctx, device.Path, existingFsType, v.GetFsckPolicy(), replayLog); err != nil {
+					return nil, err
+				}
+			}
 		} else {
 			return nil, status.Error(codes.AlreadyExists, "File system with different type exists")
 		}
 	} else {
-		if err = ns.provisionDevice(ctx, device, requestedFsType); err != nil {
+		progressFromContext(ctx).setStage("formatting")
+		if err = provisionDevice(ctx, device, requestedFsType, mkfsOptions(v, requestedFsType)); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 
-	if v.GetUsage() == parameters.UsageAppDirect {
-		mountOptions = append(mountOptions, daxMountFlag)
-	}
-
 	if err = ns.mount(ctx, device.Path, stagingtargetPath, mountOptions, false /* raw block */); err != nil {
 		return nil, status.Error(codes.Internal, err.Error())
 	}
@@ -590,6 +791,27 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		}
 	}
 
+	if size := ns.enforcedSize(volumeID); size > 0 {
+		if err := xfs.LimitSize(ctx, stagingtargetPath, size); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if v.GetAccessAudit() {
+		if err := ns.auditor.watch(ctx, volumeID, stagingtargetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if err := ns.cs.setStaged(ctx, volumeID, &stagedVolume{
+		StagingTargetPath: stagingtargetPath,
+		FsType:            requestedFsType,
+		MountFlags:        req.GetVolumeCapability().GetMount().GetMountFlags(),
+		VolumeContext:     req.GetVolumeContext(),
+	}); err != nil {
+		return nil, err
+	}
+
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
@@ -613,7 +835,15 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		_ = volumeMutex.UnlockKey(volumeID)
 	}()
 
+	end, err := ns.cs.operations.begin(ctx, volumeID, phaseUnstaging)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
 	logger.V(3).Info("Unstage volume")
+	// The usage is only known while the volume is mounted.
+	ns.cs.usage.forget(volumeID)
 	dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
 	if err != nil {
 		return nil, err
@@ -629,24 +859,113 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 	}
 
 	// Find out device name for mounted path
-	mountedDev, _, err := mount.GetDeviceNameFromMount(ns.mounter, stagingtargetPath)
+	info, err := mounts.find(stagingtargetPath)
 	if err != nil {
-		return nil, err
+		return nil, status.Errorf(codes.Internal, "check staging target path: %v", err)
 	}
-	if mountedDev == "" {
+	if info == nil {
 		logger.Info("No device name found for staging target path, skipping unmount")
+		if err := ns.cs.setStaged(ctx, volumeID, nil); err != nil {
+			return nil, err
+		}
 		return &csi.NodeUnstageVolumeResponse{}, nil
 	}
-	logger.V(3).Info("Unmounting", "device", mountedDev)
+	if ns.auditor != nil {
+		ns.auditor.unwatch(ctx, volumeID)
+	}
+	logger.V(3).Info("Unmounting", "device", info.Source)
 	if err := ns.mounter.Unmount(stagingtargetPath); err != nil {
 		return nil, err
 	}
+	if err := luksClose(ctx, volumeID); err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if err := ns.cs.setStaged(ctx, volumeID, nil); err != nil {
+		return nil, err
+	}
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeExpandVolume(context.Context, *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID, "volume-path", volumePath)
+	ctx = klog.NewContext(ctx, logger)
+
+	// Check arguments
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+
+	// Staging might still be in progress, in which case the
+	// filesystem gets grown once it is mounted.
+	end, err := ns.cs.operations.begin(ctx, volumeID, phaseExpandingFS)
+	if err != nil {
+		return nil, err
+	}
+	defer end()
+
+	dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
+	if err != nil {
+		return nil, err
+	}
+	device, err := dm.GetDevice(ctx, volumeID)
+	if err != nil {
+		if errors.Is(err, pmemerr.DeviceNotFound) {
+			return nil, status.Errorf(codes.NotFound, "no device found with volume id %q: %v", volumeID, err)
+		}
+		return nil, status.Errorf(codes.Internal, "failed to get device details for volume id %q: %v", volumeID, err)
+	}
+	resp := &csi.NodeExpandVolumeResponse{
+		CapacityBytes: int64(device.Size),
+	}
+	if req.GetVolumeCapability().GetBlock() != nil {
+		// Nothing to do, the device itself was already expanded.
+		return resp, nil
+	}
+	if _, err := os.Stat(cryptDevicePath(volumeID)); err == nil {
+		// The filesystem is on the mapping, which must grow first.
+		// Only needed by cryptsetup in some cases, therefore
+		// errors are ignored.
+		passphrase, _ := ns.cs.keyProvider().getKey(ctx, volumeID, req.GetSecrets())
+		if err := luksResize(ctx, volumeID, passphrase); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		encrypted := *device
+		encrypted.Path = cryptDevicePath(volumeID)
+		device = &encrypted
+	}
+
+	fsType, err := determineFilesystemType(ctx, device.Path)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	logger.V(3).Info("Expanding filesystem", "device", device.Path, "fs-type", fsType, "size", pmemlog.CapacityRef(int64(device.Size)))
+	switch fsType {
+	case "ext4":
+		_, err = pmemexec.RunCommand(ctx, "resize2fs", device.Path)
+	case "xfs":
+		// Only works for mounted filesystems.
+		_, err = pmemexec.RunCommand(ctx, "xfs_growfs", volumePath)
+	case "":
+		// Not formatted yet, mkfs will use the entire device.
+	default:
+		return nil, status.Errorf(codes.FailedPrecondition, "unsupported filesystem type %q", fsType)
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "expand %s filesystem: %v", fsType, err)
+	}
+	if size := ns.enforcedSize(volumeID); size > 0 && fsType == "xfs" {
+		if err := xfs.LimitSize(ctx, volumePath, size); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	return resp, nil
 }
 
 // createEphemeralDevice creates new pmem device for given req.
@@ -658,12 +977,18 @@ func (ns *nodeServer) createEphemeralDevice(ctx context.Context, req *csi.NodePu
 	// be set. Fix that here.
 	ephemeral := parameters.PersistencyEphemeral
 	p.Persistency = &ephemeral
+	// Stored so that the volume can be found again when it was
+	// not unpublished.
+	targetPath := req.GetTargetPath()
+	p.TargetPath = &targetPath
 
 	// Create new device, using the same code that the normal CreateVolume also uses,
 	// so internally this volume will be tracked like persistent volumes.
 	volumeID, _, err := ns.cs.createVolumeInternal(ctx, p, req.GetVolumeId(),
 		[]*csi.VolumeCapability{req.VolumeCapability},
 		&csi.CapacityRange{RequiredBytes: p.GetSize()},
+		req.GetSecrets(),
+		nil,
 	)
 	if err != nil {
 		// This is already a status error.
@@ -674,18 +999,88 @@ func (ns *nodeServer) createEphemeralDevice(ctx context.Context, req *csi.NodePu
 	if err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("ephemeral inline volume: device not found after creating volume %q: %v", volumeID, err))
 	}
+	if p.GetEncryption() != parameters.EncryptionNone {
+		if device, err = ns.openEncryptedDevice(ctx, device, volumeID, req.GetSecrets()); err != nil {
+			return nil, err
+		}
+	}
 
 	// Create filesystem
-	if err := ns.provisionDevice(ctx, device, req.GetVolumeCapability().GetMount().GetFsType()); err != nil {
+	fsType := req.GetVolumeCapability().GetMount().GetFsType()
+	if fsType == "" {
+		fsType = defaultFilesystem
+	}
+	if err := provisionDevice(ctx, device, fsType, mkfsOptions(p, fsType)); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("ephemeral inline volume: failed to create filesystem: %v", err))
 	}
 
 	return device, nil
 }
 
+// openEncryptedDevice opens the mapping of an encrypted volume with
+// the passphrase from the key provider and returns a copy of the
+// device with the path of the mapping. On failure it returns one of
+// status errors.
+func (ns *nodeServer) openEncryptedDevice(ctx context.Context, device *pmdmanager.PmemDeviceInfo, volumeID string, secrets parameters.Secrets) (*pmdmanager.PmemDeviceInfo, error) {
+	keys := ns.cs.keyProvider()
+	passphrase, err := keys.getKey(ctx, volumeID, secrets)
+	if err != nil {
+		return nil, err
+	}
+	path, err := luksOpen(ctx, device.Path, volumeID, passphrase)
+	if err != nil {
+		// The cached passphrase may be outdated because the
+		// key was rotated in the meantime. Try once more with
+		// the current one.
+		keys.forgetKey(volumeID)
+		if current, keyErr := keys.getKey(ctx, volumeID, secrets); keyErr == nil && current != passphrase {
+			klog.FromContext(ctx).V(3).Info("Opening encrypted device failed, retrying with the current key", "err", err)
+			path, err = luksOpen(ctx, device.Path, volumeID, current)
+		}
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	encrypted := *device
+	encrypted.Path = path
+	return &encrypted, nil
+}
+
+// cleanupEphemeralVolumes deletes ephemeral inline volumes which
+// kubelet will never unpublish because it has already removed the
+// directory of the volume, for example because the pod was deleted
+// while the node was down. Volumes where that directory still exists
+// are kept, kubelet will publish them again or unpublish them. It must
+// be called before the server starts handling requests.
+func (ns *nodeServer) cleanupEphemeralVolumes(ctx context.Context) {
+	logger := klog.FromContext(ctx).WithName("cleanupEphemeralVolumes")
+	var ids []string
+	for id, vol := range ns.cs.pmemVolumes {
+		p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+		if err != nil || p.GetPersistency() != parameters.PersistencyEphemeral {
+			continue
+		}
+		// Not known for volumes created by older releases.
+		targetPath := p.GetTargetPath()
+		if targetPath == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.Dir(targetPath)); !os.IsNotExist(err) {
+			continue
+		}
+		logger.Info("Deleting ephemeral inline volume of removed pod", "volume-id", id, "target-path", targetPath)
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if _, err := ns.cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: id}); err != nil {
+			logger.Error(err, "Deleting ephemeral inline volume failed", "volume-id", id)
+		}
+	}
+}
+
 // provisionDevice initializes the device with requested filesystem.
 // It can be called multiple times for the same device (idempotent).
-func (ns *nodeServer) provisionDevice(ctx context.Context, device *pmdmanager.PmemDeviceInfo, fsType string) error {
+func provisionDevice(ctx context.Context, device *pmdmanager.PmemDeviceInfo, fsType string, options []parameters.MkfsOption) error {
 	ctx, logger := pmemlog.WithName(ctx, "provisionDevice")
 
 	if fsType == "" {
@@ -707,21 +1102,27 @@ func (ns *nodeServer) provisionDevice(ctx context.Context, device *pmdmanager.Pm
 		return status.Error(codes.AlreadyExists, "File system with different type exists")
 	}
 	cmd := ""
-	var args []string
+	var defaults []parameters.MkfsOption
+	var force string
 	// hard-code block size to 4k to avoid smaller values and trouble to dax mount option
 	switch fsType {
 	case "ext4":
 		cmd = "mkfs.ext4"
-		args = []string{"-b", "4096", "-E", "stride=512,stripe_width=512", "-F", device.Path}
+		defaults = []parameters.MkfsOption{{Flag: "-b", Value: "4096"}, {Flag: "-E", Value: "stride=512,stripe_width=512"}}
+		force = "-F"
 	case "xfs":
 		cmd = "mkfs.xfs"
 		// reflink=0: reflink and DAX are mutually exclusive
 		// (http://man7.org/linux/man-pages/man8/mkfs.xfs.8.html).
 		// su=2m,sw=1: use 2MB-aligned and -sized block allocations
-		args = []string{"-b", "size=4096", "-m", "reflink=0", "-d", "su=2m,sw=1", "-f", device.Path}
+		defaults = []parameters.MkfsOption{{Flag: "-b", Value: "size=4096"}, {Flag: "-m", Value: "reflink=0"}, {Flag: "-d", Value: "su=2m,sw=1"}}
+		force = "-f"
 	default:
 		return fmt.Errorf("Unsupported filesystem '%s'. Supported filesystems types: 'xfs', 'ext4'", fsType)
 	}
+	args := mkfsArgs(defaults, options)
+	args = append(args, force, device.Path)
+	logger.V(3).Info("Creating filesystem", "fs-type", fsType, "args", args)
 
 	output, err := pmemexec.RunCommand(ctx, cmd, args...)
 	if err != nil {
@@ -731,9 +1132,79 @@ func (ns *nodeServer) provisionDevice(ctx context.Context, device *pmdmanager.Pm
 	return nil
 }
 
+// mkfsOptions returns the options from the volume parameters,
+// including the label of the new filesystem.
+func mkfsOptions(v parameters.Volume, fsType string) []parameters.MkfsOption {
+	options := v.GetMkfsOptions(fsType)
+	if label := v.GetFilesystemLabel(fsType); label != "" {
+		options = append(options, parameters.MkfsOption{Flag: "-L", Value: label})
+	}
+	return options
+}
+
+// mkfsArgs combines the default options of PMEM-CSI with the ones
+// from the volume parameters. mkfs.xfs rejects flags which are given
+// more than once, therefore a flag from the parameters gets merged
+// with the default for the same flag: when the default is a list of
+// sub-options like "reflink=0", the sub-options from the parameters
+// replace the default ones with the same name and the others are kept.
+// Otherwise the flag from the parameters replaces the default.
+func mkfsArgs(defaults, options []parameters.MkfsOption) []string {
+	defaultValues := map[string]string{}
+	for _, option := range defaults {
+		defaultValues[option.Flag] = option.Value
+	}
+	overridden := map[string]bool{}
+	for _, option := range options {
+		overridden[option.Flag] = true
+	}
+	var args []string
+	for _, option := range defaults {
+		if !overridden[option.Flag] {
+			args = append(args, option.Args()...)
+		}
+	}
+	for _, option := range options {
+		if defaultValue, ok := defaultValues[option.Flag]; ok {
+			option.Value = mergeSubOptions(defaultValue, option.Value)
+		}
+		args = append(args, option.Args()...)
+	}
+	return args
+}
+
+// mergeSubOptions adds those sub-options of the default which are not
+// set in the value. Both must be comma-separated lists with at least
+// one name=value pair, otherwise the value is returned unchanged.
+func mergeSubOptions(defaultValue, value string) string {
+	if !strings.Contains(defaultValue, "=") || !strings.Contains(value, "=") {
+		return value
+	}
+	isSet := map[string]bool{}
+	for _, subOption := range strings.Split(value, ",") {
+		name, _, _ := strings.Cut(subOption, "=")
+		isSet[name] = true
+	}
+	merged := []string{value}
+	for _, subOption := range strings.Split(defaultValue, ",") {
+		name, _, _ := strings.Cut(subOption, "=")
+		if !isSet[name] {
+			merged = append(merged, subOption)
+		}
+	}
+	return strings.Join(merged, ",")
+}
+
 // mount creates the target path (parent must exist) and mounts the source there. It is idempotent.
 func (ns *nodeServer) mount(ctx context.Context, sourcePath, targetPath string, mountOptions []string, rawBlock bool) error {
 	notMnt, err := ns.mounter.IsLikelyNotMountPoint(targetPath)
+	if mount.IsCorruptedMnt(err) {
+		klog.FromContext(ctx).Info("Unmounting corrupted mount", "target-path", targetPath, "err", err)
+		if err := ns.mounter.Unmount(targetPath); err != nil {
+			return fmt.Errorf("unmount corrupted mount at %s: %v", targetPath, err)
+		}
+		notMnt, err = true, nil
+	}
 	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("failed to determine if '%s' is a valid mount point: %s", targetPath, err.Error())
 	}
@@ -758,21 +1229,33 @@ func (ns *nodeServer) mount(ctx context.Context, sourcePath, targetPath string,
 		}
 	}
 
-	// We supposed to use "mount" package - ns.mounter.Mount()
-	// but it seems not supporting -c "canonical" option, so do it with exec()
-	// added -c makes canonical mount, resulting in mounted path matching what LV thinks is lvpath.
-	args := []string{"-c"}
-	if len(mountOptions) != 0 {
-		args = append(args, "-o", strings.Join(mountOptions, ","))
-	}
-	args = append(args, sourcePath, targetPath)
-	if _, err := pmemexec.RunCommand(ctx, "mount", args...); err != nil {
+	// -c (--no-canonicalize) records the source as given, which keeps the
+	// mounted path matching what LV thinks is lvpath. Bind mounts with
+	// options get remounted by the mounter, which also works with old
+	// versions of mount.
+	logger := klog.FromContext(ctx)
+	logger.V(5).Info("Mounting", "source", sourcePath, "target-path", targetPath, "mount-options", mountOptions)
+	if err := ns.mounter.MountSensitiveWithoutSystemdWithMountFlags(sourcePath, targetPath, "", mountOptions, nil, []string{"-c"}); err != nil {
 		return fmt.Errorf("mount filesystem failed: %s", err.Error())
 	}
 
 	return nil
 }
 
+// enforcedSize returns the size to which the filesystem of the volume
+// is limited with a project quota, zero if it is not limited.
+func (ns *nodeServer) enforcedSize(volumeID string) int64 {
+	vol := ns.cs.getVolumeByID(volumeID)
+	if vol == nil {
+		return 0
+	}
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+	if err != nil || !p.GetEnforceSize() {
+		return 0
+	}
+	return p.GetSize()
+}
+
 // getDeviceManagerForVolume checks the stored volume parametes for the
 // given id and returns the device manager which creates that volume.
 // NOT_FOUND is returned when the volume does not exist.
@@ -788,58 +1271,50 @@ func (ns *nodeServer) getDeviceManagerForVolume(ctx context.Context, id string)
 		return nil, fmt.Errorf("failed to parse volume parameters for volume %q: %v", id, err)
 	}
 
-	dm := ns.cs.dm
-	if v.GetDeviceMode() != dm.GetMode() {
-		dm, err = pmdmanager.New(ctx, v.GetDeviceMode(), 0)
-		if err != nil {
-			return nil, fmt.Errorf("failed to initialize device manager for volume %q, volume mode %q: %v", id, v.GetDeviceMode(), err)
-		}
+	dm, err := ns.cs.deviceManager(ctx, v.GetDeviceMode())
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize device manager for volume %q, volume mode %q: %v", id, v.GetDeviceMode(), err)
 	}
-
 	return dm, nil
 }
 
-// This is based on function used in LV-CSI driver
+// determineFilesystemType returns the type of the filesystem on the
+// device, an empty string if there is none. blkid probes the device
+// itself instead of relying on udev, which is often not up-to-date
+// after erasing a device. Content which blkid recognizes without
+// knowing a filesystem type, like a partition table, is an error
+// because such a device must never get formatted.
 func determineFilesystemType(ctx context.Context, devicePath string) (string, error) {
 	if devicePath == "" {
 		return "", fmt.Errorf("null device path")
 	}
-	// Use `file -bsL` to determine whether any filesystem type is detected.
-	// If a filesystem is detected (ie., the output is not "data", we use
-	// `blkid` to determine what the filesystem is. We use `blkid` as `file`
-	// has inconvenient output.
-	// We do *not* use `lsblk` as that requires udev to be up-to-date which
-	// is often not the case when a device is erased using `dd`.
-	output, err := pmemexec.RunCommand(ctx, "file", "-bsL", devicePath)
+	output, err := pmemexec.RunCommand(ctx, "blkid", "-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", devicePath)
 	if err != nil {
-		return "", err
-	}
-	if strings.TrimSpace(output) == "data" {
-		// No filesystem detected.
-		return "", nil
-	}
-	// Some filesystem was detected, use blkid to figure out what it is.
-	output, err = pmemexec.RunCommand(ctx, "blkid", "-c", "/dev/null", "-o", "full", devicePath)
-	if err != nil {
-		return "", err
-	}
-	if len(output) == 0 {
-		return "", fmt.Errorf("no device information for %s", devicePath)
-	}
-
-	// expected output format from blkid:
-	// devicepath: UUID="<uuid>" TYPE="<filesystem type>"
-	attrs := strings.Split(string(output), ":")
-	if len(attrs) != 2 {
-		return "", fmt.Errorf("Can not parse blkid output: %s", output)
-	}
-	for _, field := range strings.Fields(attrs[1]) {
-		attr := strings.Split(field, "=")
-		if len(attr) == 2 && attr[0] == "TYPE" {
-			return strings.Trim(attr[1], "\""), nil
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && exitErr.ExitCode() == 2 {
+			// Nothing found.
+			return "", nil
+		}
+		return "", fmt.Errorf("determine filesystem type of %s: %v", devicePath, err)
+	}
+	var fsType, ptType string
+	for _, line := range strings.Split(output, "\n") {
+		key, value, _ := strings.Cut(strings.TrimSpace(line), "=")
+		switch key {
+		case "TYPE":
+			fsType = value
+		case "PTTYPE":
+			ptType = value
 		}
 	}
-	return "", fmt.Errorf("no filesystem type detected for %s", devicePath)
+	switch {
+	case ptType != "":
+		return "", fmt.Errorf("%s contains a %s partition table", devicePath, ptType)
+	case fsType == "":
+		return "", fmt.Errorf("no filesystem type detected for %s", devicePath)
+	}
+	klog.FromContext(ctx).V(5).Info("Determined filesystem type", "device", devicePath, "fs-type", fsType)
+	return fsType, nil
 }
 
 // findMountFlags finds existence of all flags in findIn array
@@ -850,6 +1325,12 @@ func findMountFlags(flags []string, findIn []string) bool {
 		if f == "bind" {
 			continue
 		}
+		// SELinux contexts are a property of the
+		// superblock and reported in a different format,
+		// so they are not compared either.
+		if isSELinuxMountFlag(f) {
+			continue
+		}
 		found := false
 		for _, fIn := range findIn {
 			if f == "dax=always" && fIn == "dax" ||
@@ -0,0 +1,153 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestCleanupEphemeralVolumes(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create volume state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+
+	pods := t.TempDir()
+	create := func(name string, ephemeral bool) string {
+		p := parameters.Volume{}
+		if ephemeral {
+			persistency := parameters.PersistencyEphemeral
+			targetPath := filepath.Join(pods, name, "mount")
+			require.NoError(t, os.MkdirAll(filepath.Dir(targetPath), 0755), "create volume directory")
+			p.Persistency = &persistency
+			p.TargetPath = &targetPath
+		}
+		volumeID, _, err := cs.createVolumeInternal(ctx, p, name,
+			[]*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			}},
+			&csi.CapacityRange{RequiredBytes: 1024 * 1024},
+			nil,
+			nil,
+		)
+		require.NoError(t, err, "create volume %s", name)
+		return volumeID
+	}
+	removed := create("removed-pod", true)
+	running := create("running-pod", true)
+	persistent := create("persistent", false)
+	require.NoError(t, os.RemoveAll(filepath.Join(pods, "removed-pod")), "remove pod directory")
+
+	// As after a restart of the driver.
+	cs = NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	ns := NewNodeServer(cs, t.TempDir())
+	ns.cleanupEphemeralVolumes(ctx)
+
+	assert.Nil(t, cs.getVolumeByID(removed), "volume of removed pod")
+	_, err = dm.GetDevice(ctx, removed)
+	assert.Error(t, err, "device of removed pod")
+	assert.NotNil(t, cs.getVolumeByID(running), "volume of running pod")
+	assert.NotNil(t, cs.getVolumeByID(persistent), "persistent volume")
+}
+
+func TestNodeGetInfo(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	cs := NewNodeControllerServer(ctx, "node", dm, nil, nil, "", pmdmanager.Options{})
+	ns := NewNodeServer(cs, t.TempDir())
+
+	info, err := ns.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	require.NoError(t, err, "NodeGetInfo")
+	assert.Equal(t, "node", info.NodeId, "node ID")
+	assert.Equal(t, int64(0), info.MaxVolumesPerNode, "default volume limit")
+
+	ns.maxVolumesPerNode = 10
+	info, err = ns.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	require.NoError(t, err, "NodeGetInfo")
+	assert.Equal(t, int64(10), info.MaxVolumesPerNode, "volume limit")
+}
+
+func TestMkfsArgs(t *testing.T) {
+	defaults := []parameters.MkfsOption{{Flag: "-b", Value: "size=4096"}, {Flag: "-m", Value: "reflink=0"}}
+	assert.Equal(t, []string{"-b", "size=4096", "-m", "reflink=0"}, mkfsArgs(defaults, nil), "defaults")
+
+	options, err := parameters.ParseMkfsOptions("xfs", "-m crc=1,reflink=0 -K")
+	require.NoError(t, err, "parse options")
+	assert.Equal(t, []string{"-b", "size=4096", "-m", "crc=1,reflink=0", "-K"}, mkfsArgs(defaults, options), "override")
+
+	options, err = parameters.ParseMkfsOptions("xfs", "-m crc=1 -b size=4096")
+	require.NoError(t, err, "parse options")
+	assert.Equal(t, []string{"-m", "crc=1,reflink=0", "-b", "size=4096"}, mkfsArgs(defaults, options), "merge")
+
+	ext4Defaults := []parameters.MkfsOption{{Flag: "-b", Value: "4096"}, {Flag: "-E", Value: "stride=512,stripe_width=512"}}
+	options, err = parameters.ParseMkfsOptions("ext4", "-E stride=256,nodiscard -b 4096")
+	require.NoError(t, err, "parse options")
+	assert.Equal(t, []string{"-E", "stride=256,nodiscard,stripe_width=512", "-b", "4096"}, mkfsArgs(ext4Defaults, options), "ext4")
+}
+
+func TestFindMountFlags(t *testing.T) {
+	opts := []string{"rw", "relatime", "dax=always"}
+	assert.True(t, findMountFlags([]string{"dax", "bind"}, opts), "dax")
+	assert.False(t, findMountFlags([]string{"ro", "bind"}, opts), "ro")
+	assert.True(t, findMountFlags([]string{`context="system_u:object_r:container_file_t:s0:c1,c2"`, "bind"}, opts), "SELinux context")
+}
+
+func TestDetermineFilesystemType(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	// The fake blkid prints what the device file contains, the
+	// exit code is in the first line.
+	bin := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "blkid"), []byte(`#!/bin/sh
+for device; do :; done
+code=$(head -n 1 "$device")
+tail -n +2 "$device"
+exit $code
+`), 0755), "write fake blkid")
+	t.Setenv("PATH", bin+":"+os.Getenv("PATH"))
+
+	devices := t.TempDir()
+	for name, tc := range map[string]struct {
+		blkid          string
+		expectedFsType string
+		expectedError  string
+	}{
+		"ext4":                {blkid: "0\nTYPE=ext4\n", expectedFsType: "ext4"},
+		"luks":                {blkid: "0\nTYPE=crypto_LUKS\n", expectedFsType: "crypto_LUKS"},
+		"empty":               {blkid: "2\n"},
+		"partitioned":         {blkid: "0\nPTTYPE=gpt\n", expectedError: "contains a gpt partition table"},
+		"partitioned-with-fs": {blkid: "0\nTYPE=vfat\nPTTYPE=dos\n", expectedError: "contains a dos partition table"},
+		"unknown":             {blkid: "0\n", expectedError: "no filesystem type detected"},
+		"failure":             {blkid: "4\n", expectedError: "exit status 4"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			device := filepath.Join(devices, name)
+			require.NoError(t, os.WriteFile(device, []byte(tc.blkid), 0644), "write device")
+			fsType, err := determineFilesystemType(ctx, device)
+			if tc.expectedError != "" {
+				assert.ErrorContains(t, err, tc.expectedError, "error")
+				return
+			}
+			require.NoError(t, err, "determine filesystem type")
+			assert.Equal(t, tc.expectedFsType, fsType, "filesystem type")
+		})
+	}
+}
@@ -0,0 +1,67 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// DriverNUMATopologyPrefix gets the NUMA node appended. A node can
+// have PMEM on more than one NUMA node, therefore there is one
+// topology segment with value "true" per NUMA node instead of a
+// single segment with the NUMA node as value.
+var DriverNUMATopologyPrefix = ""
+
+// numaTopology returns the topology segments for the NUMA nodes.
+func numaTopology(nodes pmdmanager.NUMANodes) map[string]string {
+	segments := map[string]string{}
+	for _, node := range nodes {
+		segments[DriverNUMATopologyPrefix+strconv.Itoa(node)] = "true"
+	}
+	return segments
+}
+
+// numaNodesFromRequirements determines which NUMA nodes may be used
+// for a new volume on this node. A volume may be created on NUMA
+// nodes which are set in one of the requisite topologies (the
+// preferred ones if there are no requisite ones) of this node. The
+// result is empty if there is no such restriction.
+func (cs *nodeControllerServer) numaNodesFromRequirements(req *csi.TopologyRequirement) pmdmanager.NUMANodes {
+	topologies := req.GetRequisite()
+	if len(topologies) == 0 {
+		topologies = req.GetPreferred()
+	}
+	var numaNodes pmdmanager.NUMANodes
+	for _, topology := range topologies {
+		segments := topology.GetSegments()
+		if nodeID, ok := segments[DriverTopologyKey]; ok && nodeID != cs.nodeID {
+			continue
+		}
+		restricted := false
+		for key, value := range segments {
+			if !strings.HasPrefix(key, DriverNUMATopologyPrefix) || value != "true" {
+				continue
+			}
+			node, err := strconv.Atoi(strings.TrimPrefix(key, DriverNUMATopologyPrefix))
+			if err != nil {
+				continue
+			}
+			restricted = true
+			numaNodes = append(numaNodes, node)
+		}
+		if !restricted {
+			// Any PMEM of the node is okay.
+			return nil
+		}
+	}
+	return numaNodes
+}
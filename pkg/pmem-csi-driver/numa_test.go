@@ -0,0 +1,110 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestNUMATopology(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	oldKey, oldPrefix := DriverTopologyKey, DriverNUMATopologyPrefix
+	DriverTopologyKey, DriverNUMATopologyPrefix = driverName+"/node", driverName+"/numa-"
+	defer func() {
+		DriverTopologyKey, DriverNUMATopologyPrefix = oldKey, oldPrefix
+	}()
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	ns := NewNodeServer(cs, t.TempDir())
+
+	info, err := ns.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	require.NoError(t, err, "NodeGetInfo")
+	assert.Equal(t, map[string]string{DriverTopologyKey: "node"}, info.AccessibleTopology.Segments, "default topology")
+	ns.numaTopology = true
+	info, err = ns.NodeGetInfo(ctx, &csi.NodeGetInfoRequest{})
+	require.NoError(t, err, "NodeGetInfo")
+	assert.Equal(t, map[string]string{DriverTopologyKey: "node", driverName + "/numa-0": "true"}, info.AccessibleTopology.Segments, "NUMA topology")
+
+	topology := func(segments ...string) *csi.Topology {
+		t := &csi.Topology{Segments: map[string]string{}}
+		for i := 0; i < len(segments); i += 2 {
+			t.Segments[segments[i]] = segments[i+1]
+		}
+		return t
+	}
+	testcases := map[string]struct {
+		req      *csi.TopologyRequirement
+		expected pmdmanager.NUMANodes
+	}{
+		"none": {},
+		"node": {
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topology(DriverTopologyKey, "node")},
+			},
+		},
+		"one": {
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{topology(DriverTopologyKey, "node", driverName+"/numa-1", "true")},
+			},
+			expected: pmdmanager.NUMANodes{1},
+		},
+		"preferred": {
+			req: &csi.TopologyRequirement{
+				Preferred: []*csi.Topology{topology(driverName+"/numa-1", "true")},
+			},
+			expected: pmdmanager.NUMANodes{1},
+		},
+		"several": {
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					topology(driverName+"/numa-0", "true", driverName+"/numa-2", "false"),
+					topology(DriverTopologyKey, "other-node"),
+					topology(driverName+"/numa-1", "true"),
+				},
+			},
+			expected: pmdmanager.NUMANodes{0, 1},
+		},
+		"unrestricted-topology": {
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{
+					topology(driverName+"/numa-0", "true"),
+					topology(DriverTopologyKey, "node"),
+				},
+			},
+		},
+	}
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, cs.numaNodesFromRequirements(tc.req))
+		})
+	}
+
+	// The fake device manager only has NUMA node 0.
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "remote",
+		VolumeCapabilities: []*csi.VolumeCapability{{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}},
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		AccessibilityRequirements: &csi.TopologyRequirement{
+			Requisite: []*csi.Topology{topology(driverName+"/numa-1", "true")},
+		},
+	})
+	assert.Equal(t, codes.ResourceExhausted, status.Code(err), "volume on other NUMA node")
+}
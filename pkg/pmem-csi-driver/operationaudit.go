@@ -0,0 +1,126 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// operationRecord is written to the operation audit log for each
+// call which creates, deletes, publishes or unpublishes a volume.
+// Secrets are never part of it.
+type operationRecord struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	VolumeID  string    `json:"volumeID,omitempty"`
+	// Name is the name that CreateVolume was called with.
+	Name       string            `json:"name,omitempty"`
+	TargetPath string            `json:"targetPath,omitempty"`
+	Parameters map[string]string `json:"parameters,omitempty"`
+	Caller     operationCaller   `json:"caller"`
+	Duration   float64           `json:"durationSeconds"`
+	Result     string            `json:"result"`
+	Error      string            `json:"error,omitempty"`
+}
+
+// operationCaller identifies who triggered a call as far as the
+// driver can tell. On the Unix domain socket the direct caller is
+// always the kubelet or a sidecar, therefore the Kubernetes objects
+// on whose behalf they act are recorded too.
+type operationCaller struct {
+	// Address of the gRPC peer.
+	Address string `json:"address,omitempty"`
+	// Common name of the client certificate on the TCP endpoint.
+	Certificate  string `json:"certificate,omitempty"`
+	PVCName      string `json:"pvcName,omitempty"`
+	PVCNamespace string `json:"pvcNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodUID       string `json:"podUID,omitempty"`
+}
+
+// operationAuditor is a gRPC interceptor which writes an
+// operationRecord for each volume lifecycle call.
+type operationAuditor struct {
+	sink *auditLog
+}
+
+func newOperationAuditor(sink *auditLog) *operationAuditor {
+	return &operationAuditor{sink: sink}
+}
+
+func (oa *operationAuditor) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	var record operationRecord
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		record.Name = r.GetName()
+		record.Parameters = r.GetParameters()
+	case *csi.DeleteVolumeRequest:
+	case *csi.NodeStageVolumeRequest:
+		record.TargetPath = r.GetStagingTargetPath()
+		record.Parameters = r.GetVolumeContext()
+	case *csi.NodeUnstageVolumeRequest:
+		record.TargetPath = r.GetStagingTargetPath()
+	case *csi.NodePublishVolumeRequest:
+		record.TargetPath = r.GetTargetPath()
+		record.Parameters = parameters.WithoutTokens(r.GetVolumeContext())
+	case *csi.NodeUnpublishVolumeRequest:
+		record.TargetPath = r.GetTargetPath()
+	default:
+		return handler(ctx, req)
+	}
+
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	record.Time = start
+	record.Operation = info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+	record.VolumeID = operationVolumeID(req, resp)
+	record.Caller = operationCallerFrom(ctx, record.Parameters)
+	record.Duration = time.Since(start).Seconds()
+	record.Result = status.Code(err).String()
+	if err != nil {
+		record.Error = err.Error()
+	}
+	if err := oa.sink.record(record); err != nil {
+		// The call itself is done, only the record is missing.
+		klog.FromContext(ctx).Error(err, "Operation audit failed", "operation", record.Operation, "volume-id", record.VolumeID)
+	}
+	return resp, err
+}
+
+// operationCallerFrom collects the caller identity from the gRPC peer
+// and the metadata that Kubernetes adds to the parameters or volume
+// context.
+func operationCallerFrom(ctx context.Context, params map[string]string) operationCaller {
+	caller := operationCaller{
+		PVCName:      params[parameters.PVCName],
+		PVCNamespace: params[parameters.PVCNamespace],
+		PodName:      params[parameters.PodName],
+		PodNamespace: params[parameters.PodNamespace],
+		PodUID:       params[parameters.PodUID],
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		if p.Addr != nil {
+			caller.Address = p.Addr.String()
+		}
+		if tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.PeerCertificates) > 0 {
+			caller.Certificate = tlsInfo.State.PeerCertificates[0].Subject.CommonName
+		}
+	}
+	return caller
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestOperationAuditor(t *testing.T) {
+	out := &bufferCloser{}
+	auditor := newOperationAuditor(newAuditLog(out))
+	call := func(ctx context.Context, method string, req, resp interface{}, err error) {
+		info := &grpc.UnaryServerInfo{FullMethod: method}
+		_, _ = auditor.intercept(ctx, req, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return resp, err
+		})
+	}
+
+	ctx := peer.NewContext(context.Background(), &peer.Peer{
+		Addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1234},
+		AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{Subject: pkix.Name{CommonName: "debug-tool"}}},
+		}},
+	})
+	call(ctx, "/csi.v1.Controller/CreateVolume",
+		&csi.CreateVolumeRequest{
+			Name:       "pvc-1",
+			Parameters: map[string]string{"eraseafter": "true", parameters.PVCName: "claim", parameters.PVCNamespace: "default"},
+			Secrets:    map[string]string{parameters.EncryptionPassphrase: "secret"},
+		},
+		&csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "vol-1"}}, nil)
+	call(context.Background(), "/csi.v1.Node/NodePublishVolume",
+		&csi.NodePublishVolumeRequest{
+			VolumeId:      "vol-1",
+			TargetPath:    "/target",
+			VolumeContext: map[string]string{parameters.PodName: "pod", parameters.PodNamespace: "default", parameters.PodUID: "1234"},
+		},
+		nil, status.Error(codes.Internal, "mount failed"))
+	call(context.Background(), "/csi.v1.Node/NodeGetCapabilities", &csi.NodeGetCapabilitiesRequest{}, &csi.NodeGetCapabilitiesResponse{}, nil)
+	call(context.Background(), "/csi.v1.Controller/DeleteVolume", &csi.DeleteVolumeRequest{VolumeId: "vol-1"}, &csi.DeleteVolumeResponse{}, nil)
+
+	assert.NotContains(t, out.String(), "secret", "secrets not recorded")
+	var records []operationRecord
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var record operationRecord
+		require.NoError(t, json.Unmarshal([]byte(line), &record), "decode %q", line)
+		records = append(records, record)
+	}
+	require.Len(t, records, 3, "only lifecycle operations recorded")
+
+	assert.Equal(t, "CreateVolume", records[0].Operation, "create operation")
+	assert.Equal(t, "vol-1", records[0].VolumeID, "create volume ID")
+	assert.Equal(t, "pvc-1", records[0].Name, "create name")
+	assert.Equal(t, "true", records[0].Parameters["eraseafter"], "create parameters")
+	assert.Equal(t, operationCaller{Address: "10.0.0.1:1234", Certificate: "debug-tool", PVCName: "claim", PVCNamespace: "default"}, records[0].Caller, "create caller")
+	assert.Equal(t, codes.OK.String(), records[0].Result, "create result")
+
+	assert.Equal(t, "NodePublishVolume", records[1].Operation, "publish operation")
+	assert.Equal(t, "/target", records[1].TargetPath, "publish target")
+	assert.Equal(t, operationCaller{PodName: "pod", PodNamespace: "default", PodUID: "1234"}, records[1].Caller, "publish caller")
+	assert.Equal(t, codes.Internal.String(), records[1].Result, "publish result")
+	assert.Contains(t, records[1].Error, "mount failed", "publish error")
+
+	assert.Equal(t, "DeleteVolume", records[2].Operation, "delete operation")
+	assert.Equal(t, "vol-1", records[2].VolumeID, "delete volume ID")
+}
@@ -0,0 +1,113 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// operationLogSuffix gets appended to the metrics path for the JSON
+// dump of recent operations.
+const operationLogSuffix = "/operations"
+
+// operation describes one completed gRPC call.
+type operation struct {
+	Time     time.Time `json:"time"`
+	Method   string    `json:"method"`
+	VolumeID string    `json:"volumeID,omitempty"`
+	Duration float64   `json:"durationSeconds"`
+	Result   string    `json:"result"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// operationLog keeps the most recent operations in a ring buffer,
+// for triage in clusters where the driver logs are not accessible.
+type operationLog struct {
+	mutex      sync.Mutex
+	operations []operation
+	next       int
+	full       bool
+}
+
+func newOperationLog(size uint) *operationLog {
+	return &operationLog{
+		operations: make([]operation, size),
+	}
+}
+
+func (ol *operationLog) add(op operation) {
+	ol.mutex.Lock()
+	defer ol.mutex.Unlock()
+	ol.operations[ol.next] = op
+	ol.next = (ol.next + 1) % len(ol.operations)
+	if ol.next == 0 {
+		ol.full = true
+	}
+}
+
+// list returns all recorded operations, oldest first.
+func (ol *operationLog) list() []operation {
+	ol.mutex.Lock()
+	defer ol.mutex.Unlock()
+	if !ol.full {
+		return append([]operation{}, ol.operations[:ol.next]...)
+	}
+	return append(append([]operation{}, ol.operations[ol.next:]...), ol.operations[:ol.next]...)
+}
+
+// intercept is a gRPC interceptor which records each call.
+func (ol *operationLog) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, "/grpc.health.v1.Health/") {
+		// Probes would push out the CSI calls.
+		return handler(ctx, req)
+	}
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	op := operation{
+		Time:     start,
+		Method:   info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:],
+		VolumeID: operationVolumeID(req, resp),
+		Duration: time.Since(start).Seconds(),
+		Result:   status.Code(err).String(),
+	}
+	if err != nil {
+		op.Error = err.Error()
+	}
+	ol.add(op)
+	return resp, err
+}
+
+// operationVolumeID returns the ID of the volume that a call was
+// about, if there is one.
+func operationVolumeID(req, resp interface{}) string {
+	switch r := req.(type) {
+	case interface{ GetVolumeId() string }:
+		return r.GetVolumeId()
+	case interface{ GetSourceVolumeId() string }:
+		return r.GetSourceVolumeId()
+	}
+	if r, ok := resp.(*csi.CreateVolumeResponse); ok {
+		return r.GetVolume().GetVolumeId()
+	}
+	return ""
+}
+
+func (ol *operationLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ol.list()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,65 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestOperationLog(t *testing.T) {
+	ol := newOperationLog(3)
+	assert.Empty(t, ol.list(), "initial list")
+
+	for i := 0; i < 5; i++ {
+		ol.add(operation{Method: fmt.Sprintf("op-%d", i)})
+	}
+	var methods []string
+	for _, op := range ol.list() {
+		methods = append(methods, op.Method)
+	}
+	assert.Equal(t, []string{"op-2", "op-3", "op-4"}, methods, "most recent operations")
+
+	ol = newOperationLog(10)
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/DeleteVolume"}
+	_, err := ol.intercept(context.Background(), &csi.DeleteVolumeRequest{VolumeId: "vol-1"}, info,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, status.Error(codes.FailedPrecondition, "in use")
+		})
+	assert.Error(t, err, "error from handler")
+	info = &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	_, err = ol.intercept(context.Background(), &csi.CreateVolumeRequest{Name: "pvc-1"}, info,
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "vol-2"}}, nil
+		})
+	assert.NoError(t, err, "success from handler")
+
+	recorder := httptest.NewRecorder()
+	ol.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics/operations", nil))
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"), "content type")
+	var ops []operation
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &ops), "decode response")
+	require.Len(t, ops, 2, "recorded operations")
+	assert.Equal(t, "DeleteVolume", ops[0].Method, "first method")
+	assert.Equal(t, "vol-1", ops[0].VolumeID, "first volume")
+	assert.Equal(t, codes.FailedPrecondition.String(), ops[0].Result, "first result")
+	assert.NotEmpty(t, ops[0].Error, "first error")
+	assert.Equal(t, "CreateVolume", ops[1].Method, "second method")
+	assert.Equal(t, "vol-2", ops[1].VolumeID, "second volume")
+	assert.Equal(t, codes.OK.String(), ops[1].Result, "second result")
+	assert.Empty(t, ops[1].Error, "second error")
+}
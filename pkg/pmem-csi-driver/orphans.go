@@ -0,0 +1,202 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	"github.com/intel/pmem-csi/pkg/volumepathhandler"
+)
+
+// Kinds of orphans, used as metrics label.
+const (
+	// A mount point in the mount directory of the driver, used for
+	// Kata Containers, of a volume which no longer exists.
+	orphanMount = "mount"
+	// A dm-crypt mapping which is not mounted and belongs to a
+	// volume which no longer exists or is not staged.
+	orphanCryptDevice = "crypt-device"
+)
+
+var (
+	orphans = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pmem_csi_node_orphans",
+			Help: "Number of mount points and dm-crypt devices without a volume which uses them, by kind (mount, crypt-device), as of the most recent orphan cleanup.",
+		},
+		[]string{"kind"},
+	)
+	orphansRemoved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmem_csi_node_orphans_removed_total",
+			Help: "Number of orphaned mount points and dm-crypt devices which were removed, by kind. Stays zero in dry-run mode.",
+		},
+		[]string{"kind"},
+	)
+)
+
+// MustRegisterOrphanMetrics adds the metrics of the orphan cleanup to
+// the registry, using labels to tag each sample with node and driver
+// name.
+func MustRegisterOrphanMetrics(reg prometheus.Registerer, nodeName, driverName string) {
+	reg = prometheus.WrapRegistererWith(prometheus.Labels{
+		pmdmanager.NodeLabel: nodeName,
+		"driver_name":        driverName,
+	}, reg)
+	reg.MustRegister(orphans)
+	reg.MustRegister(orphansRemoved)
+}
+
+// runOrphanCleanup removes orphans right away and then periodically
+// in the background. In dry-run mode, it only logs and counts them.
+func (ns *nodeServer) runOrphanCleanup(ctx context.Context, interval time.Duration, dryRun bool) {
+	logger := klog.FromContext(ctx).WithName("orphan-cleanup")
+	ctx = klog.NewContext(ctx, logger)
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		ns.cleanupOrphans(ctx, dryRun)
+	}, interval)
+}
+
+// cleanupOrphans handles mount points before dm-crypt devices because
+// removing a mount point may leave its device unused. Failures only
+// get logged, the next run tries again.
+func (ns *nodeServer) cleanupOrphans(ctx context.Context, dryRun bool) {
+	logger := klog.FromContext(ctx)
+	found := map[string]int{}
+
+	if ns.mountDirectory != "" {
+		infos, err := mounts.list()
+		if err != nil {
+			logger.Error(err, "Failed to list mounts")
+			return
+		}
+		mountDirectory := filepath.Clean(ns.mountDirectory)
+		for _, info := range infos {
+			if filepath.Dir(info.MountPoint) != mountDirectory {
+				continue
+			}
+			if ns.cleanupOrphanedMount(ctx, filepath.Base(info.MountPoint), info.MountPoint, dryRun) {
+				found[orphanMount]++
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(mapperDir)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Error(err, "Failed to list device mapper devices")
+		return
+	}
+	prefix := cryptDeviceName("")
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		if ns.cleanupOrphanedCryptDevice(ctx, strings.TrimPrefix(entry.Name(), prefix), dryRun) {
+			found[orphanCryptDevice]++
+		}
+	}
+
+	for _, kind := range []string{orphanMount, orphanCryptDevice} {
+		orphans.WithLabelValues(kind).Set(float64(found[kind]))
+	}
+	logger.V(3).Info("Checked for orphans", "mounts", found[orphanMount], "crypt-devices", found[orphanCryptDevice], "dry-run", dryRun)
+}
+
+// cleanupOrphanedMount unmounts and removes the mount point if the
+// volume does not exist. It returns true for an orphan.
+func (ns *nodeServer) cleanupOrphanedMount(ctx context.Context, volumeID, mountPoint string, dryRun bool) bool {
+	volumeMutex.LockKey(volumeID)
+	defer func() {
+		_ = volumeMutex.UnlockKey(volumeID)
+	}()
+	if ns.cs.getVolumeByID(volumeID) != nil {
+		return false
+	}
+	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID, "mountpoint", mountPoint)
+	if dryRun {
+		logger.Info("Found orphaned mount point")
+		return true
+	}
+	logger.Info("Removing orphaned mount point")
+	// The Kata Containers image file of the volume may still be
+	// attached to a loop device.
+	handler := volumepathhandler.VolumePathHandler{}
+	if err := handler.DetachFileDevice(ctx, filepath.Join(mountPoint, kataContainersImageFilename)); err != nil {
+		logger.Error(err, "Failed to remove loop device of orphaned mount point")
+		return true
+	}
+	if err := ns.mounter.Unmount(mountPoint); err != nil {
+		logger.Error(err, "Failed to unmount orphaned mount point")
+		return true
+	}
+	if err := os.Remove(mountPoint); err != nil && !os.IsNotExist(err) {
+		logger.Error(err, "Failed to remove orphaned mount point")
+		return true
+	}
+	orphansRemoved.WithLabelValues(orphanMount).Inc()
+	return true
+}
+
+// cleanupOrphanedCryptDevice closes the dm-crypt mapping of the
+// volume if it is not mounted and the volume does not exist or is
+// not staged. Ephemeral volumes are mounted while they are published.
+// It returns true for an orphan.
+func (ns *nodeServer) cleanupOrphanedCryptDevice(ctx context.Context, volumeID string, dryRun bool) bool {
+	// NodePublishVolume locks ephemeral volumes under the volume
+	// ID from kubelet, which is the name of the volume, and opens
+	// the mapping before mounting it. Only one key gets locked,
+	// two keys might map to the same hashed mutex.
+	lockKey := volumeID
+	if vol := ns.cs.getVolumeByID(volumeID); vol != nil {
+		if p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params); err == nil &&
+			p.GetPersistency() == parameters.PersistencyEphemeral && p.GetName() != "" {
+			lockKey = p.GetName()
+		}
+	}
+	volumeMutex.LockKey(lockKey)
+	defer func() {
+		_ = volumeMutex.UnlockKey(lockKey)
+	}()
+	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID, "crypt-device", cryptDeviceName(volumeID))
+	if vol := ns.cs.getVolumeByID(volumeID); vol != nil && vol.Staged != nil {
+		return false
+	}
+	// Checked while holding the lock because the mapping gets
+	// opened before it is mounted.
+	infos, err := mounts.list()
+	if err != nil {
+		logger.Error(err, "Failed to list mounts")
+		return false
+	}
+	path := cryptDevicePath(volumeID)
+	for _, info := range infos {
+		if info.Source == path {
+			return false
+		}
+	}
+	if dryRun {
+		logger.Info("Found orphaned dm-crypt device")
+		return true
+	}
+	logger.Info("Closing orphaned dm-crypt device")
+	if err := luksClose(ctx, volumeID); err != nil {
+		logger.Error(err, "Failed to close orphaned dm-crypt device")
+		return true
+	}
+	orphansRemoved.WithLabelValues(orphanCryptDevice).Inc()
+	return true
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+	"k8s.io/mount-utils"
+	"k8s.io/utils/keymutex"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestCleanupOrphans(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	mountDirectory := t.TempDir()
+	for _, name := range []string{"orphan", "kept"} {
+		require.NoError(t, os.Mkdir(filepath.Join(mountDirectory, name), 0755), "create mount point")
+	}
+	devices := t.TempDir()
+	for _, volumeID := range []string{"deleted", "staged", "ephemeral", "unstaged"} {
+		require.NoError(t, os.WriteFile(filepath.Join(devices, cryptDeviceName(volumeID)), nil, 0644), "create device")
+	}
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	require.NoError(t, os.WriteFile(mountInfo, []byte(fmt.Sprintf(`22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 22 259:2 / %[1]s/orphan rw,relatime shared:20 - ext4 /dev/pmem0 rw
+41 22 259:3 / %[1]s/kept rw,relatime shared:21 - ext4 /dev/pmem1 rw
+42 22 253:0 / /var/lib/kubelet/pods/1234/volumes/kubernetes.io~csi/data/mount rw,relatime shared:22 - ext4 %[2]s/pmem-crypt-ephemeral rw
+`, mountDirectory, devices)), 0644), "write mountinfo")
+	defer func(path string) { mountInfoPath = path }(mountInfoPath)
+	mountInfoPath = mountInfo
+	defer func(dir string) { mapperDir = dir }(mapperDir)
+	mapperDir = devices
+
+	cs := &nodeControllerServer{
+		pmemVolumes: map[string]*nodeVolume{
+			"kept":      {ID: "kept"},
+			"staged":    {ID: "staged", Staged: &stagedVolume{StagingTargetPath: "/var/lib/kubelet/plugins/staging"}},
+			"ephemeral": {ID: "ephemeral"},
+			"unstaged":  {ID: "unstaged"},
+		},
+	}
+	mounter := mount.NewFakeMounter([]mount.MountPoint{
+		{Path: filepath.Join(mountDirectory, "orphan")},
+		{Path: filepath.Join(mountDirectory, "kept")},
+	})
+	ns := &nodeServer{cs: cs, mounter: mounter, mountDirectory: mountDirectory}
+	removed := testutil.ToFloat64(orphansRemoved.WithLabelValues(orphanMount))
+
+	ns.cleanupOrphans(ctx, true /* dry run */)
+	assert.Equal(t, 1.0, testutil.ToFloat64(orphans.WithLabelValues(orphanMount)), "orphaned mounts")
+	assert.Equal(t, 2.0, testutil.ToFloat64(orphans.WithLabelValues(orphanCryptDevice)), "orphaned crypt devices")
+	assert.Empty(t, mounter.GetLog(), "mount operations in dry-run mode")
+	assert.DirExists(t, filepath.Join(mountDirectory, "orphan"), "mount point in dry-run mode")
+
+	// Closing crypt devices needs cryptsetup.
+	mapperDir = t.TempDir()
+	ns.cleanupOrphans(ctx, false /* dry run */)
+	assert.Equal(t, []mount.FakeAction{{Action: mount.FakeActionUnmount, Target: filepath.Join(mountDirectory, "orphan")}}, mounter.GetLog(), "mount operations")
+	assert.NoDirExists(t, filepath.Join(mountDirectory, "orphan"), "orphaned mount point")
+	assert.DirExists(t, filepath.Join(mountDirectory, "kept"), "mount point of existing volume")
+	assert.Equal(t, removed+1, testutil.ToFloat64(orphansRemoved.WithLabelValues(orphanMount)), "removed mounts")
+	assert.Equal(t, 0.0, testutil.ToFloat64(orphans.WithLabelValues(orphanCryptDevice)), "orphaned crypt devices")
+}
+
+func TestCleanupOrphanedCryptDeviceDuringPublish(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	require.NoError(t, os.WriteFile(mountInfo, []byte("22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"), 0644), "write mountinfo")
+	defer func(path string) { mountInfoPath = path }(mountInfoPath)
+	mountInfoPath = mountInfo
+	devices := t.TempDir()
+	defer func(dir string) { mapperDir = dir }(mapperDir)
+	mapperDir = devices
+
+	// The volume ID of an ephemeral volume differs from the one
+	// that kubelet uses in NodePublishVolume.
+	const kubeletVolumeID, volumeID = "csi-1234", "pmem-5678"
+	cs := &nodeControllerServer{
+		pmemVolumes: map[string]*nodeVolume{
+			volumeID: {ID: volumeID, Params: map[string]string{
+				parameters.Name:             kubeletVolumeID,
+				parameters.PersistencyModel: string(parameters.PersistencyEphemeral),
+			}},
+		},
+	}
+	ns := &nodeServer{cs: cs}
+
+	// With one mutex per CPU, both volume IDs might share one.
+	defer func(m keymutex.KeyMutex) { volumeMutex = m }(volumeMutex)
+	volumeMutex = keymutex.NewHashed(1024)
+
+	// NodePublishVolume has opened the mapping, but not mounted it yet.
+	volumeMutex.LockKey(kubeletVolumeID)
+	done := make(chan bool, 1)
+	go func() {
+		done <- ns.cleanupOrphanedCryptDevice(ctx, volumeID, true /* dry run */)
+	}()
+	select {
+	case <-done:
+		t.Fatal("cleanup did not wait for NodePublishVolume")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.NoError(t, os.WriteFile(mountInfo, []byte(fmt.Sprintf(`22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+42 22 253:0 / /var/lib/kubelet/pods/1234/volumes/kubernetes.io~csi/data/mount rw,relatime shared:22 - ext4 %s rw
+`, cryptDevicePath(volumeID))), 0644), "write mountinfo")
+	require.NoError(t, volumeMutex.UnlockKey(kubeletVolumeID), "unlock")
+	assert.False(t, <-done, "mounted mapping is not an orphan")
+}
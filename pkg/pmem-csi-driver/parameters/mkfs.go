@@ -0,0 +1,140 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package parameters
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mkfsFlags lists the flags which may be used in the options for
+// a filesystem type. The value is true for flags that take an
+// argument. Flags which select the device, force overwriting, read
+// input files or turn mkfs into a dry run are set by PMEM-CSI itself
+// or make no sense for a new volume and therefore are not allowed.
+var mkfsFlags = map[string]map[string]bool{
+	"ext4": {
+		"-b": true,
+		"-C": true,
+		"-E": true,
+		"-g": true,
+		"-G": true,
+		"-i": true,
+		"-I": true,
+		"-j": false,
+		"-J": true,
+		"-m": true,
+		"-N": true,
+		"-O": true,
+		"-T": true,
+	},
+	"xfs": {
+		"-b": true,
+		"-d": true,
+		"-i": true,
+		"-K": false,
+		"-l": true,
+		"-m": true,
+		"-n": true,
+		"-s": true,
+	},
+}
+
+// MkfsOption is one flag of mkfs, optionally with its argument.
+type MkfsOption struct {
+	Flag  string
+	Value string
+}
+
+// Args returns the command line arguments for the option.
+func (o MkfsOption) Args() []string {
+	if o.Value == "" {
+		return []string{o.Flag}
+	}
+	return []string{o.Flag, o.Value}
+}
+
+// SubOption returns the value of a sub-option in a comma-separated
+// list of name=value pairs like "crc=1,reflink=0".
+func (o MkfsOption) SubOption(name string) (string, bool) {
+	for _, subOption := range strings.Split(o.Value, ",") {
+		if n, value, _ := strings.Cut(subOption, "="); n == name {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// ParseMkfsOptions splits the options for the filesystem type at
+// white space and checks them against the allowed flags. Quoting is
+// not supported because the options are never passed through a
+// shell.
+func ParseMkfsOptions(fsType, options string) ([]MkfsOption, error) {
+	flags, ok := mkfsFlags[fsType]
+	if !ok {
+		return nil, fmt.Errorf("unsupported filesystem type %q", fsType)
+	}
+	var result []MkfsOption
+	fields := strings.Fields(options)
+	for i := 0; i < len(fields); i++ {
+		flag := fields[i]
+		hasValue, ok := flags[flag]
+		if !ok {
+			return nil, fmt.Errorf("%s option %q not allowed", fsType, flag)
+		}
+		option := MkfsOption{Flag: flag}
+		if hasValue {
+			i++
+			if i >= len(fields) || strings.HasPrefix(fields[i], "-") {
+				return nil, fmt.Errorf("%s option %q needs a value", fsType, flag)
+			}
+			option.Value = fields[i]
+		}
+		result = append(result, option)
+	}
+	return result, nil
+}
+
+// CheckDAXOptions rejects options which prevent mounting the new
+// filesystem with DAX. The kernel only supports DAX when the block
+// size matches the page size and, for xfs, without reflink. It would
+// silently fall back to the page cache otherwise.
+func CheckDAXOptions(fsType string, options []MkfsOption) error {
+	pageSize := os.Getpagesize()
+	for _, option := range options {
+		switch {
+		case fsType == "ext4" && option.Flag == "-b":
+			if size, err := parseSize(option.Value); err != nil || size != pageSize {
+				return fmt.Errorf("%s option \"-b %s\" not supported with DAX, the block size must be the page size %d", fsType, option.Value, pageSize)
+			}
+		case fsType == "xfs" && option.Flag == "-b":
+			if value, ok := option.SubOption("size"); ok {
+				if size, err := parseSize(value); err != nil || size != pageSize {
+					return fmt.Errorf("%s option \"-b %s\" not supported with DAX, the block size must be the page size %d", fsType, option.Value, pageSize)
+				}
+			}
+		case fsType == "xfs" && option.Flag == "-m":
+			if value, ok := option.SubOption("reflink"); ok && value != "0" {
+				return fmt.Errorf("%s option \"-m %s\" not supported with DAX, reflink and DAX are mutually exclusive", fsType, option.Value)
+			}
+		}
+	}
+	return nil
+}
+
+// parseSize accepts a number of bytes, optionally with the k suffix
+// for KiB that mkfs also accepts.
+func parseSize(value string) (int, error) {
+	factor := 1
+	if trimmed := strings.TrimSuffix(strings.ToLower(value), "k"); trimmed != strings.ToLower(value) {
+		value, factor = trimmed, 1024
+	}
+	size, err := strconv.Atoi(value)
+	return size * factor, err
+}
@@ -18,21 +18,62 @@ import (
 type Persistency string
 type Origin int
 type Usage string
+type FsckPolicy string
+type EncryptionType string
+type ErasePolicy string
+type RootApplyPolicy string
 
 // Beware of API and backwards-compatibility breaking when changing these string constants!
 const (
 	EraseAfter       = "eraseafter"
+	EraseAfterDelete = "eraseAfterDelete"
 	KataContainers   = "kataContainers"
 	Name             = "name"
 	PersistencyModel = "persistencyModel"
 	Size             = "size"
 	DeviceMode       = "deviceMode"
+	AccessAudit      = "accessAudit"
+	PopulateFrom     = "populateFrom"
+	SectorSize       = "sectorSize"
+	Stripes          = "stripes"
+	Ext4Options      = "ext4.options"
+	XFSOptions       = "xfs.options"
+	XFSReflink       = "xfs.reflink"
+	Fsck             = "fsckPolicy"
+	EnforceSize      = "enforceSize"
+	Encryption       = "encryption"
+	RootMode         = "rootMode"
+	RootUID          = "rootUID"
+	RootGID          = "rootGID"
+	RootApply        = "rootApply"
+
+	EraseNone   ErasePolicy = "none"
+	EraseZero   ErasePolicy = "zero"
+	EraseCrypto ErasePolicy = "crypto"
+
+	EncryptionNone  EncryptionType = "none"
+	EncryptionLUKS2 EncryptionType = "luks2"
+
+	RootApplyFirstPublish RootApplyPolicy = "firstPublish"
+	RootApplyEveryPublish RootApplyPolicy = "everyPublish"
+
+	FsckSkip   FsckPolicy = "skip"
+	FsckCheck  FsckPolicy = "check"
+	FsckRepair FsckPolicy = "repair"
 
 	// Added in PMEM-CSI 1.1.0.
 	UsageModel           = "usage"
 	UsageAppDirect Usage = "AppDirect"
 	UsageFileIO    Usage = "FileIO"
 
+	// Added to the volume context by CreateVolume if the driver
+	// maintains symlinks for its volumes.
+	DeviceLink = "deviceLink"
+
+	// Stored for ephemeral inline volumes, for cleaning up
+	// volumes which were not unpublished.
+	TargetPath = "targetPath"
+
 	// Kubernetes v1.16+ adds this key to NodePublishRequest.VolumeContext
 	// while provisioning ephemeral volume.
 	Ephemeral = "csi.storage.k8s.io/ephemeral"
@@ -40,6 +81,24 @@ const (
 	// Additional, unknown parameters that are okay.
 	PodInfoPrefix = "csi.storage.k8s.io/"
 
+	// Added to the CreateVolume parameters by the external-provisioner
+	// with --extra-create-metadata.
+	PVCName      = "csi.storage.k8s.io/pvc/name"
+	PVCNamespace = "csi.storage.k8s.io/pvc/namespace"
+	PVName       = "csi.storage.k8s.io/pv/name"
+
+	// Added to NodePublishRequest.VolumeContext by kubelet because
+	// the CSIDriver object enables podInfoOnMount.
+	PodName      = "csi.storage.k8s.io/pod.name"
+	PodNamespace = "csi.storage.k8s.io/pod.namespace"
+	PodUID       = "csi.storage.k8s.io/pod.uid"
+
+	// Added to NodePublishRequest.VolumeContext by kubelet when the
+	// CSIDriver object has tokenRequests. The value is a JSON map
+	// from audience to token and expiration time. It must never be
+	// logged.
+	ServiceAccountTokens = "csi.storage.k8s.io/serviceAccount.tokens"
+
 	// Added by https://github.com/kubernetes-csi/external-provisioner/blob/feb67766f5e6af7db5c03ac0f0b16255f696c350/pkg/controller/controller.go#L584
 	ProvisionerID = "storage.kubernetes.io/csiProvisionerIdentity"
 
@@ -61,20 +120,52 @@ const (
 // valid is a whitelist of which parameters are valid in which context.
 var valid = map[Origin][]string{
 	// Parameters from Kubernetes and users for a persistent volume.
-	CreateVolumeOrigin: []string{
+	// The secret references normally get removed by the external-provisioner,
+	// but are tolerated in case that they get passed through.
+	CreateVolumeOrigin: append([]string{
+		AccessAudit,
+		DeviceMode,
 		EraseAfter,
+		EraseAfterDelete,
 		KataContainers,
 		UsageModel,
 		PersistencyModel,
-	},
+		PopulateFrom,
+		SectorSize,
+		Stripes,
+		Ext4Options,
+		XFSOptions,
+		XFSReflink,
+		Fsck,
+		EnforceSize,
+		Encryption,
+		RootMode,
+		RootUID,
+		RootGID,
+		RootApply,
+
+		PVCName,
+		PVCNamespace,
+		PVName,
+	}, secretReferences...),
 
 	// Parameters from Kubernetes and users.
 	EphemeralVolumeOrigin: []string{
 		EraseAfter,
+		EraseAfterDelete,
 		KataContainers,
 		UsageModel,
 		PodInfoPrefix,
+		SectorSize,
 		Size,
+		Ext4Options,
+		XFSOptions,
+		XFSReflink,
+		Encryption,
+		RootMode,
+		RootUID,
+		RootGID,
+		RootApply,
 	},
 
 	// The volume context prepared by CreateVolume. We replicate
@@ -83,12 +174,29 @@ var valid = map[Origin][]string{
 	// doesn't) and add the volume name for logging purposes.
 	// Kubernetes adds pod info and provisioner ID.
 	PersistentVolumeOrigin: []string{
+		AccessAudit,
+		DeviceMode,
 		EraseAfter,
+		EraseAfterDelete,
 		KataContainers,
 		PersistencyModel,
+		PopulateFrom,
+		SectorSize,
+		Stripes,
 		UsageModel,
+		Ext4Options,
+		XFSOptions,
+		XFSReflink,
+		Fsck,
+		EnforceSize,
+		Encryption,
+		RootMode,
+		RootUID,
+		RootGID,
+		RootApply,
 
 		Name,
+		DeviceLink,
 		PodInfoPrefix,
 		ProvisionerID,
 	},
@@ -97,12 +205,31 @@ var valid = map[Origin][]string{
 	// which is handled separately.
 	NodeVolumeOrigin: []string{
 		EraseAfter,
+		EraseAfterDelete,
 		KataContainers,
 		UsageModel,
 		Name,
 		PersistencyModel,
 		Size,
 		DeviceMode,
+		TargetPath,
+		AccessAudit,
+		PopulateFrom,
+		SectorSize,
+		Stripes,
+		Ext4Options,
+		XFSOptions,
+		XFSReflink,
+		Fsck,
+		EnforceSize,
+		Encryption,
+		RootMode,
+		RootUID,
+		RootGID,
+		RootApply,
+		PVCName,
+		PVCNamespace,
+		PVName,
 	},
 }
 
@@ -112,17 +239,99 @@ var valid = map[Origin][]string{
 // the default.
 type Volume struct {
 	EraseAfter     *bool
+	ErasePolicy    *ErasePolicy
 	KataContainers *bool
 	Name           *string
 	Persistency    *Persistency
 	Size           *int64
 	DeviceMode     *api.DeviceMode
 	Usage          *Usage
+	DeviceLink     *string
+	TargetPath     *string
+	AccessAudit    *bool
+	PopulateFrom   *string
+	SectorSize     *int64
+	Stripes        *int64
+	Ext4Options    *string
+	XFSOptions     *string
+	XFSReflink     *bool
+	FsckPolicy     *FsckPolicy
+	EnforceSize    *bool
+	Encryption     *EncryptionType
+	RootMode       *uint32
+	RootUID        *uint32
+	RootGID        *uint32
+	RootApply      *RootApplyPolicy
+	PVCName        *string
+	PVCNamespace   *string
+	PVName         *string
 }
 
 // VolumeContext represents the same settings as a string map.
 type VolumeContext map[string]string
 
+// WithoutTokens returns a copy of the volume context where the
+// service account tokens are replaced, for logging it.
+func WithoutTokens(volumeContext map[string]string) map[string]string {
+	if _, ok := volumeContext[ServiceAccountTokens]; !ok {
+		return volumeContext
+	}
+	result := make(map[string]string, len(volumeContext))
+	for key, value := range volumeContext {
+		result[key] = value
+	}
+	result[ServiceAccountTokens] = "***stripped***"
+	return result
+}
+
+// IsValid checks whether the key may be used in a string map of the
+// origin.
+func IsValid(origin Origin, key string) bool {
+	for _, validKey := range valid[origin] {
+		if validKey == key ||
+			strings.HasPrefix(key, PodInfoPrefix) && validKey == PodInfoPrefix {
+			return true
+		}
+	}
+	return false
+}
+
+// invalidKeyError includes the valid key in the error if the invalid
+// one looks like a typo of it.
+func invalidKeyError(origin Origin, key string) error {
+	for _, validKey := range valid[origin] {
+		if validKey == PodInfoPrefix {
+			continue
+		}
+		if strings.EqualFold(validKey, key) ||
+			len(key) >= 5 && editDistance(strings.ToLower(validKey), strings.ToLower(key)) <= 2 {
+			return fmt.Errorf("parameter %q invalid in this context, did you mean %q?", key, validKey)
+		}
+	}
+	return fmt.Errorf("parameter %q invalid in this context", key)
+}
+
+// editDistance returns the Levenshtein distance of the two strings.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
 // Parse converts the string map that PMEM-CSI is given
 // in CreateVolume (master and node) and NodePublishVolume. Depending
 // on the origin of the string map, different keys are valid. An
@@ -130,24 +339,71 @@ type VolumeContext map[string]string
 // combinations of parameters.
 func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 	var result Volume
-	validKeys := valid[origin]
 	for key, value := range stringmap {
-		valid := false
-		for _, validKey := range validKeys {
-			if validKey == key ||
-				strings.HasPrefix(key, PodInfoPrefix) && validKey == PodInfoPrefix {
-				valid = true
-				break
-			}
-		}
-		if !valid {
-			return result, fmt.Errorf("parameter %q invalid in this context", key)
+		if !IsValid(origin, key) {
+			return result, invalidKeyError(origin, key)
 		}
 
 		value := value // Ensure that we get a new instance in case that we take the address below.
 		switch key {
 		case Name:
 			result.Name = &value
+		case DeviceLink:
+			result.DeviceLink = &value
+		case TargetPath:
+			result.TargetPath = &value
+		case PopulateFrom:
+			if value == "" {
+				return result, fmt.Errorf("parameter %q: empty value", key)
+			}
+			result.PopulateFrom = &value
+		case SectorSize:
+			s, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as int64: %v", key, value, err)
+			}
+			if s != 512 && s != 4096 {
+				return result, fmt.Errorf("parameter %q: must be 512 or 4096: %d", key, s)
+			}
+			result.SectorSize = &s
+		case Stripes:
+			s, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as int64: %v", key, value, err)
+			}
+			if s < 1 {
+				return result, fmt.Errorf("parameter %q: must be at least 1: %d", key, s)
+			}
+			result.Stripes = &s
+		case Ext4Options:
+			if _, err := ParseMkfsOptions("ext4", value); err != nil {
+				return result, fmt.Errorf("parameter %q: %v", key, err)
+			}
+			result.Ext4Options = &value
+		case XFSOptions:
+			if _, err := ParseMkfsOptions("xfs", value); err != nil {
+				return result, fmt.Errorf("parameter %q: %v", key, err)
+			}
+			result.XFSOptions = &value
+		case XFSReflink:
+			var b bool
+			switch value {
+			case "on":
+				b = true
+			case "off":
+				b = false
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value: %s", key, value)
+			}
+			result.XFSReflink = &b
+		case Fsck:
+			f := FsckPolicy(value)
+			switch f {
+			case FsckSkip, FsckCheck, FsckRepair:
+				result.FsckPolicy = &f
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value: %s", key, value)
+			}
 		case PersistencyModel:
 			p := Persistency(value)
 			switch p {
@@ -193,6 +449,62 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 				return result, fmt.Errorf("parameter %q: failed to parse %q as boolean: %v", key, value, err)
 			}
 			result.EraseAfter = &b
+		case EraseAfterDelete:
+			e := ErasePolicy(value)
+			switch e {
+			case EraseNone, EraseZero, EraseCrypto:
+				result.ErasePolicy = &e
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value: %s", key, value)
+			}
+		case Encryption:
+			e := EncryptionType(value)
+			switch e {
+			case EncryptionNone, EncryptionLUKS2:
+				result.Encryption = &e
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value: %s", key, value)
+			}
+		case RootMode:
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 07777 {
+				return result, fmt.Errorf("parameter %q: must be an octal file mode like 0770: %q", key, value)
+			}
+			m := uint32(mode)
+			result.RootMode = &m
+		case RootUID, RootGID:
+			// 2^32-1 is the same as -1 for chown, which leaves
+			// the id unchanged.
+			id, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || id == 1<<32-1 {
+				return result, fmt.Errorf("parameter %q: must be a numeric id: %q", key, value)
+			}
+			i := uint32(id)
+			if key == RootUID {
+				result.RootUID = &i
+			} else {
+				result.RootGID = &i
+			}
+		case RootApply:
+			r := RootApplyPolicy(value)
+			switch r {
+			case RootApplyFirstPublish, RootApplyEveryPublish:
+				result.RootApply = &r
+			default:
+				return result, fmt.Errorf("parameter %q: unknown value: %s", key, value)
+			}
+		case EnforceSize:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as boolean: %v", key, value, err)
+			}
+			result.EnforceSize = &b
+		case AccessAudit:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return result, fmt.Errorf("parameter %q: failed to parse %q as boolean: %v", key, value, err)
+			}
+			result.AccessAudit = &b
 		case Ephemeral:
 			b, err := strconv.ParseBool(value)
 			if err != nil {
@@ -208,6 +520,12 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 				return result, fmt.Errorf("parameter %q: failed to parse %q as DeviceMode: %v", key, value, err)
 			}
 			result.DeviceMode = &mode
+		case PVCName:
+			result.PVCName = &value
+		case PVCNamespace:
+			result.PVCNamespace = &value
+		case PVName:
+			result.PVName = &value
 		case ProvisionerID:
 		default:
 			if !strings.HasPrefix(key, PodInfoPrefix) {
@@ -225,6 +543,69 @@ func Parse(origin Origin, stringmap map[string]string) (Volume, error) {
 		return result, fmt.Errorf("Kata Container support and usage %q are mutually exclusive", result.GetUsage())
 	}
 
+	if result.SectorSize != nil && result.GetUsage() != UsageFileIO {
+		return result, fmt.Errorf("parameter %q is only supported for usage %q", SectorSize, UsageFileIO)
+	}
+
+	if result.GetStripes() > 1 && result.DeviceMode != nil && result.GetDeviceMode() != api.DeviceModeLVM {
+		return result, fmt.Errorf("parameter %q is only supported for device mode %q", Stripes, api.DeviceModeLVM)
+	}
+
+	if result.GetDeviceMode() == api.DeviceModeDevdax {
+		if result.GetUsage() != UsageAppDirect {
+			return result, fmt.Errorf("device mode %q and usage %q are mutually exclusive", api.DeviceModeDevdax, result.GetUsage())
+		}
+		if result.GetKataContainers() {
+			return result, fmt.Errorf("device mode %q and Kata Container support are mutually exclusive", api.DeviceModeDevdax)
+		}
+	}
+
+	if result.ErasePolicy != nil {
+		if result.EraseAfter != nil && *result.EraseAfter != (*result.ErasePolicy != EraseNone) {
+			return result, fmt.Errorf("parameter %q contradicts parameter %q", EraseAfterDelete, EraseAfter)
+		}
+		if *result.ErasePolicy == EraseCrypto && result.GetEncryption() == EncryptionNone {
+			return result, fmt.Errorf("parameter %q: %q needs an encrypted volume", EraseAfterDelete, EraseCrypto)
+		}
+	}
+
+	if result.GetEncryption() != EncryptionNone {
+		// dm-crypt does not support DAX.
+		if result.GetUsage() != UsageFileIO {
+			return result, fmt.Errorf("parameter %q: encryption and DAX are mutually exclusive, usage %q is required", Encryption, UsageFileIO)
+		}
+		if result.PopulateFrom != nil {
+			return result, fmt.Errorf("parameters %q and %q are mutually exclusive", Encryption, PopulateFrom)
+		}
+	}
+
+	if result.RootApply != nil && !result.HasRootPermissions() {
+		return result, fmt.Errorf("parameter %q needs at least one of %q, %q and %q", RootApply, RootMode, RootUID, RootGID)
+	}
+
+	if result.XFSReflink != nil {
+		if *result.XFSReflink && result.GetUsage() == UsageAppDirect {
+			return result, fmt.Errorf("parameter %q: reflink and DAX are mutually exclusive, usage %q is required", XFSReflink, UsageFileIO)
+		}
+		if result.XFSOptions != nil {
+			// Already validated above.
+			options, _ := ParseMkfsOptions("xfs", *result.XFSOptions)
+			for _, option := range options {
+				if value, ok := option.SubOption("reflink"); option.Flag == "-m" && ok && (value != "0") != *result.XFSReflink {
+					return result, fmt.Errorf("parameter %q contradicts reflink=%s in parameter %q", XFSReflink, value, XFSOptions)
+				}
+			}
+		}
+	}
+
+	if result.GetUsage() == UsageAppDirect {
+		for key, fsType := range map[string]string{Ext4Options: "ext4", XFSOptions: "xfs"} {
+			if err := CheckDAXOptions(fsType, result.GetMkfsOptions(fsType)); err != nil {
+				return result, fmt.Errorf("parameter %q: %v", key, err)
+			}
+		}
+	}
+
 	return result, nil
 }
 
@@ -244,6 +625,9 @@ func (v Volume) ToContext() VolumeContext {
 	if v.EraseAfter != nil {
 		result[EraseAfter] = fmt.Sprintf("%v", *v.EraseAfter)
 	}
+	if v.ErasePolicy != nil {
+		result[EraseAfterDelete] = string(*v.ErasePolicy)
+	}
 	if v.Name != nil {
 		result[Name] = *v.Name
 	}
@@ -262,15 +646,89 @@ func (v Volume) ToContext() VolumeContext {
 	if v.Usage != nil {
 		result[UsageModel] = string(*v.Usage)
 	}
+	if v.DeviceLink != nil {
+		result[DeviceLink] = *v.DeviceLink
+	}
+	if v.TargetPath != nil {
+		result[TargetPath] = *v.TargetPath
+	}
+	if v.AccessAudit != nil {
+		result[AccessAudit] = fmt.Sprintf("%v", *v.AccessAudit)
+	}
+	if v.PopulateFrom != nil {
+		result[PopulateFrom] = *v.PopulateFrom
+	}
+	if v.SectorSize != nil {
+		result[SectorSize] = fmt.Sprintf("%d", *v.SectorSize)
+	}
+	if v.Stripes != nil {
+		result[Stripes] = fmt.Sprintf("%d", *v.Stripes)
+	}
+	if v.Ext4Options != nil {
+		result[Ext4Options] = *v.Ext4Options
+	}
+	if v.XFSOptions != nil {
+		result[XFSOptions] = *v.XFSOptions
+	}
+	if v.XFSReflink != nil {
+		if *v.XFSReflink {
+			result[XFSReflink] = "on"
+		} else {
+			result[XFSReflink] = "off"
+		}
+	}
+	if v.FsckPolicy != nil {
+		result[Fsck] = string(*v.FsckPolicy)
+	}
+	if v.EnforceSize != nil {
+		result[EnforceSize] = fmt.Sprintf("%v", *v.EnforceSize)
+	}
+	if v.Encryption != nil {
+		result[Encryption] = string(*v.Encryption)
+	}
+	if v.RootMode != nil {
+		result[RootMode] = fmt.Sprintf("%04o", *v.RootMode)
+	}
+	if v.RootUID != nil {
+		result[RootUID] = fmt.Sprintf("%d", *v.RootUID)
+	}
+	if v.RootGID != nil {
+		result[RootGID] = fmt.Sprintf("%d", *v.RootGID)
+	}
+	if v.RootApply != nil {
+		result[RootApply] = string(*v.RootApply)
+	}
+	if v.PVCName != nil {
+		result[PVCName] = *v.PVCName
+	}
+	if v.PVCNamespace != nil {
+		result[PVCNamespace] = *v.PVCNamespace
+	}
+	if v.PVName != nil {
+		result[PVName] = *v.PVName
+	}
 
 	return result
 }
 
+// GetEraseAfter is true if the device must be overwritten with zeroes
+// when deleting the volume.
 func (v Volume) GetEraseAfter() bool {
-	if v.EraseAfter != nil {
-		return *v.EraseAfter
+	return v.GetErasePolicy() == EraseZero
+}
+
+// GetErasePolicy determines how data gets destroyed when deleting the
+// volume. Without the eraseAfterDelete parameter, the older
+// eraseafter parameter chooses between zeroing and doing nothing.
+func (v Volume) GetErasePolicy() ErasePolicy {
+	switch {
+	case v.ErasePolicy != nil:
+		return *v.ErasePolicy
+	case v.EraseAfter != nil && !*v.EraseAfter:
+		return EraseNone
+	default:
+		return EraseZero
 	}
-	return true
 }
 
 func (v Volume) GetPersistency() Persistency {
@@ -315,3 +773,166 @@ func (v Volume) GetUsage() Usage {
 	}
 	return UsageAppDirect
 }
+
+func (v Volume) GetDeviceLink() string {
+	if v.DeviceLink != nil {
+		return *v.DeviceLink
+	}
+	return ""
+}
+
+func (v Volume) GetTargetPath() string {
+	if v.TargetPath != nil {
+		return *v.TargetPath
+	}
+	return ""
+}
+
+func (v Volume) GetAccessAudit() bool {
+	if v.AccessAudit != nil {
+		return *v.AccessAudit
+	}
+	return false
+}
+
+func (v Volume) GetPopulateFrom() string {
+	if v.PopulateFrom != nil {
+		return *v.PopulateFrom
+	}
+	return ""
+}
+
+// GetSectorSize returns the sector size for namespaces in sector
+// mode, zero for the default.
+func (v Volume) GetSectorSize() int64 {
+	if v.SectorSize != nil {
+		return *v.SectorSize
+	}
+	return 0
+}
+
+// GetStripes returns the number of regions that the volume is
+// striped across, one if not striped.
+func (v Volume) GetStripes() int64 {
+	if v.Stripes != nil {
+		return *v.Stripes
+	}
+	return 1
+}
+
+// GetMkfsOptions returns the additional options for creating a
+// filesystem of the given type, nil if there are none.
+func (v Volume) GetMkfsOptions(fsType string) []MkfsOption {
+	var options *string
+	switch fsType {
+	case "ext4":
+		options = v.Ext4Options
+	case "xfs":
+		options = v.XFSOptions
+	}
+	var result []MkfsOption
+	if options != nil {
+		// Already validated by Parse.
+		result, _ = ParseMkfsOptions(fsType, *options)
+	}
+	if fsType == "xfs" && v.XFSReflink != nil {
+		reflink := "reflink=0"
+		if *v.XFSReflink {
+			reflink = "reflink=1"
+		}
+		for i, option := range result {
+			if option.Flag == "-m" {
+				if _, ok := option.SubOption("reflink"); !ok {
+					result[i].Value += "," + reflink
+				}
+				return result
+			}
+		}
+		result = append(result, MkfsOption{Flag: "-m", Value: reflink})
+	}
+	return result
+}
+
+// GetXFSReflink returns true if reflink is requested for a new xfs
+// filesystem.
+func (v Volume) GetXFSReflink() bool {
+	if v.XFSReflink != nil {
+		return *v.XFSReflink
+	}
+	return false
+}
+
+// GetFsckPolicy returns what to do with an existing filesystem
+// before mounting it.
+func (v Volume) GetFsckPolicy() FsckPolicy {
+	if v.FsckPolicy != nil {
+		return *v.FsckPolicy
+	}
+	return FsckSkip
+}
+
+// GetEnforceSize returns true if the filesystem of the volume must not
+// store more data than the requested size, even when the device is
+// larger.
+func (v Volume) GetEnforceSize() bool {
+	if v.EnforceSize != nil {
+		return *v.EnforceSize
+	}
+	return false
+}
+
+// GetEncryption returns how the content of the volume is encrypted.
+func (v Volume) GetEncryption() EncryptionType {
+	if v.Encryption != nil {
+		return *v.Encryption
+	}
+	return EncryptionNone
+}
+
+// HasRootPermissions is true if the mode or the owner of the root
+// directory of the filesystem is configured.
+func (v Volume) HasRootPermissions() bool {
+	return v.RootMode != nil || v.RootUID != nil || v.RootGID != nil
+}
+
+// GetRootApply returns when the configured mode and owner get applied
+// to the root directory of the filesystem.
+func (v Volume) GetRootApply() RootApplyPolicy {
+	if v.RootApply != nil {
+		return *v.RootApply
+	}
+	return RootApplyFirstPublish
+}
+
+// maxLabelLength is the maximum length of a label for each
+// filesystem type.
+var maxLabelLength = map[string]int{
+	"ext4": 16,
+	"xfs":  12,
+}
+
+// GetFilesystemLabel returns a label which identifies the PVC or PV of
+// the volume, empty if neither is known. It gets truncated to what the
+// filesystem type supports.
+func (v Volume) GetFilesystemLabel(fsType string) string {
+	var label string
+	switch {
+	case v.PVCName != nil && v.PVCNamespace != nil:
+		label = *v.PVCNamespace + "/" + *v.PVCName
+	case v.PVName != nil:
+		label = *v.PVName
+	}
+	max, ok := maxLabelLength[fsType]
+	if !ok || len(label) <= max {
+		return label
+	}
+	if v.PVCName != nil {
+		// The name alone is more useful than a truncated
+		// namespace.
+		label = *v.PVCName
+	}
+	if len(label) > max {
+		label = label[:max]
+	}
+	return label
+}
@@ -8,21 +8,42 @@ package parameters
 
 import (
 	"fmt"
+	"os"
 	"strings"
 	"testing"
 
 	"k8s.io/apimachinery/pkg/api/resource"
 
 	"github.com/stretchr/testify/assert"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 )
 
 func TestParameters(t *testing.T) {
 	yes := true
+	no := false
 	normal := PersistencyNormal
 	gig := "1Gi"
 	gigNum := int64(1 * 1024 * 1024 * 1024)
 	appDirect := UsageAppDirect
 	fileIO := UsageFileIO
+	luks2 := EncryptionLUKS2
+	eraseCrypto := EraseCrypto
+	link := "/dev/pmem-csi/pvc-1234"
+	image := "registry.example.com/datasets/reference:v1"
+	direct := api.DeviceModeDirect
+	devdax := api.DeviceModeDevdax
+	sector4k := int64(4096)
+	twoStripes := int64(2)
+	ext4Options := fmt.Sprintf("-b %d -O ^has_journal", os.Getpagesize())
+	ext4SmallBlocks := "-b 1024"
+	xfsCRC := "-m crc=1"
+	fsckRepair := FsckRepair
+	mib := int64(1024 * 1024)
+	mode2770 := uint32(02770)
+	uid1000 := uint32(1000)
+	gid2000 := uint32(2000)
+	everyPublish := RootApplyEveryPublish
 
 	tests := []struct {
 		name       string
@@ -70,6 +91,187 @@ func TestParameters(t *testing.T) {
 			},
 			err: "parameter \"foo\" invalid in this context",
 		},
+		{
+			name:   "typo-case",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				"eraseAfter": "true",
+			},
+			err: "parameter \"eraseAfter\" invalid in this context, did you mean \"eraseafter\"?",
+		},
+		{
+			name:   "typo-letters",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				"kataContainer": "true",
+			},
+			err: "parameter \"kataContainer\" invalid in this context, did you mean \"kataContainers\"?",
+		},
+
+		// Device link.
+		{
+			name:   "device-link",
+			origin: PersistentVolumeOrigin,
+			stringmap: VolumeContext{
+				DeviceLink: link,
+			},
+			parameters: Volume{
+				DeviceLink: &link,
+			},
+		},
+		{
+			name:   "invalid-device-link-create",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				DeviceLink: link,
+			},
+			err: "parameter \"deviceLink\" invalid in this context",
+		},
+
+		// Target path of ephemeral volumes.
+		{
+			name:   "target-path",
+			origin: NodeVolumeOrigin,
+			stringmap: VolumeContext{
+				TargetPath: link,
+			},
+			parameters: Volume{
+				TargetPath: &link,
+			},
+		},
+		{
+			name:   "invalid-target-path-ephemeral",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				TargetPath: link,
+				Size:       gig,
+			},
+			err: "parameter \"targetPath\" invalid in this context",
+		},
+
+		// Access auditing.
+		{
+			name:   "access-audit-create",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				AccessAudit: "true",
+			},
+			parameters: Volume{
+				AccessAudit: &yes,
+			},
+		},
+		{
+			name:   "invalid-access-audit-ephemeral",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				AccessAudit: "true",
+				Size:        gig,
+			},
+			err: "parameter \"accessAudit\" invalid in this context",
+		},
+		{
+			name:   "invalid-access-audit-value",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				AccessAudit: "maybe",
+			},
+			err: "parameter \"accessAudit\": failed to parse \"maybe\" as boolean: strconv.ParseBool: parsing \"maybe\": invalid syntax",
+		},
+
+		// Populating volumes.
+		{
+			name:   "populate-from-create",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				PopulateFrom: image,
+			},
+			parameters: Volume{
+				PopulateFrom: &image,
+			},
+		},
+		{
+			name:   "invalid-populate-from-ephemeral",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				PopulateFrom: image,
+				Size:         gig,
+			},
+			err: "parameter \"populateFrom\" invalid in this context",
+		},
+		{
+			name:   "invalid-populate-from-empty",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				PopulateFrom: "",
+			},
+			err: "parameter \"populateFrom\": empty value",
+		},
+
+		// Device mode values.
+		{
+			name:   "device-mode-create",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				DeviceMode: "direct",
+			},
+			parameters: Volume{
+				DeviceMode: &direct,
+			},
+		},
+		{
+			name:   "device-mode-persistent",
+			origin: PersistentVolumeOrigin,
+			stringmap: VolumeContext{
+				DeviceMode: "direct",
+			},
+			parameters: Volume{
+				DeviceMode: &direct,
+			},
+		},
+		{
+			name:   "device-mode-devdax",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				DeviceMode: "devdax",
+			},
+			parameters: Volume{
+				DeviceMode: &devdax,
+			},
+		},
+		{
+			name:   "invalid-device-mode-devdax-usage",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				DeviceMode: "devdax",
+				UsageModel: "FileIO",
+			},
+			err: "device mode \"devdax\" and usage \"FileIO\" are mutually exclusive",
+		},
+		{
+			name:   "invalid-device-mode-devdax-kata-containers",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				DeviceMode:     "devdax",
+				KataContainers: "true",
+			},
+			err: "device mode \"devdax\" and Kata Container support are mutually exclusive",
+		},
+		{
+			name:   "invalid-device-mode",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				DeviceMode: "foo",
+			},
+			err: "parameter \"deviceMode\": failed to parse \"foo\" as DeviceMode: invalid device manager mode",
+		},
+		{
+			name:   "invalid-device-mode-ephemeral",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				DeviceMode: "direct",
+			},
+			err: "parameter \"deviceMode\" invalid in this context",
+		},
 
 		// Usage values.
 		{
@@ -109,6 +311,324 @@ func TestParameters(t *testing.T) {
 				Usage: &fileIO,
 			},
 		},
+		{
+			name:   "valid-sector-size",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				UsageModel: "FileIO",
+				SectorSize: "4096",
+			},
+			parameters: Volume{
+				Usage:      &fileIO,
+				SectorSize: &sector4k,
+			},
+		},
+		{
+			name:   "invalid-sector-size",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				UsageModel: "FileIO",
+				SectorSize: "1024",
+			},
+			err: "parameter \"sectorSize\": must be 512 or 4096: 1024",
+		},
+		{
+			name:   "invalid-sector-size-usage",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				SectorSize: "512",
+			},
+			err: "parameter \"sectorSize\" is only supported for usage \"FileIO\"",
+		},
+		{
+			name:   "valid-stripes",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Stripes: "2",
+			},
+			parameters: Volume{
+				Stripes: &twoStripes,
+			},
+		},
+		{
+			name:   "invalid-stripes",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Stripes: "0",
+			},
+			err: "parameter \"stripes\": must be at least 1: 0",
+		},
+		{
+			name:   "invalid-stripes-device-mode",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Stripes:    "2",
+				DeviceMode: "direct",
+			},
+			err: "parameter \"stripes\" is only supported for device mode \"lvm\"",
+		},
+		{
+			name:   "valid-ext4-options",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Ext4Options: ext4Options,
+			},
+			parameters: Volume{
+				Ext4Options: &ext4Options,
+			},
+		},
+		{
+			name:   "invalid-xfs-option",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				XFSOptions: "-f /dev/sda",
+			},
+			err: "parameter \"xfs.options\": xfs option \"-f\" not allowed",
+		},
+		{
+			name:   "ext4-block-size-without-dax",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Ext4Options: "-b 1024",
+				UsageModel:  string(UsageFileIO),
+			},
+			parameters: Volume{
+				Ext4Options: &ext4SmallBlocks,
+				Usage:       &fileIO,
+			},
+		},
+		{
+			name:   "ext4-block-size-with-dax",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Ext4Options: "-b 1024",
+			},
+			err: fmt.Sprintf("parameter \"ext4.options\": ext4 option \"-b 1024\" not supported with DAX, the block size must be the page size %d", os.Getpagesize()),
+		},
+		{
+			name:   "xfs-block-size-with-dax",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				XFSOptions: "-b size=1k",
+				UsageModel: string(UsageAppDirect),
+			},
+			err: fmt.Sprintf("parameter \"xfs.options\": xfs option \"-b size=1k\" not supported with DAX, the block size must be the page size %d", os.Getpagesize()),
+		},
+		{
+			name:   "xfs-reflink-with-dax",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				XFSOptions: "-m crc=1,reflink=1",
+			},
+			err: "parameter \"xfs.options\": xfs option \"-m crc=1,reflink=1\" not supported with DAX, reflink and DAX are mutually exclusive",
+		},
+		{
+			name:   "valid-fsck-policy",
+			origin: PersistentVolumeOrigin,
+			stringmap: VolumeContext{
+				Fsck: "repair",
+			},
+			parameters: Volume{
+				FsckPolicy: &fsckRepair,
+			},
+		},
+		{
+			name:   "valid-enforce-size",
+			origin: NodeVolumeOrigin,
+			stringmap: VolumeContext{
+				EnforceSize: "true",
+				Size:        "1048576",
+			},
+			parameters: Volume{
+				EnforceSize: &yes,
+				Size:        &mib,
+			},
+		},
+		{
+			name:   "root-permissions",
+			origin: PersistentVolumeOrigin,
+			stringmap: VolumeContext{
+				RootMode:  "2770",
+				RootUID:   "1000",
+				RootGID:   "2000",
+				RootApply: "everyPublish",
+			},
+			parameters: Volume{
+				RootMode:  &mode2770,
+				RootUID:   &uid1000,
+				RootGID:   &gid2000,
+				RootApply: &everyPublish,
+			},
+		},
+		{
+			name:   "invalid-root-mode",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				RootMode: "rwx",
+			},
+			err: "parameter \"rootMode\": must be an octal file mode like 0770: \"rwx\"",
+		},
+		{
+			name:   "invalid-root-uid",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				Size:    gig,
+				RootUID: "-1",
+			},
+			err: "parameter \"rootUID\": must be a numeric id: \"-1\"",
+		},
+		{
+			name:   "root-apply-without-permissions",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				RootApply: "firstPublish",
+			},
+			err: "parameter \"rootApply\" needs at least one of \"rootMode\", \"rootUID\" and \"rootGID\"",
+		},
+		{
+			name:   "invalid-fsck-policy",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Fsck: "always",
+			},
+			err: "parameter \"fsckPolicy\": unknown value: always",
+		},
+		{
+			name:   "xfs-reflink",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				XFSReflink: "on",
+				XFSOptions: "-m crc=1",
+				UsageModel: string(UsageFileIO),
+			},
+			parameters: Volume{
+				XFSReflink: &yes,
+				XFSOptions: &xfsCRC,
+				Usage:      &fileIO,
+			},
+		},
+		{
+			name:   "xfs-reflink-off",
+			origin: NodeVolumeOrigin,
+			stringmap: VolumeContext{
+				XFSReflink: "off",
+			},
+			parameters: Volume{
+				XFSReflink: &no,
+			},
+		},
+		{
+			name:   "invalid-xfs-reflink",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				XFSReflink: "true",
+			},
+			err: "parameter \"xfs.reflink\": unknown value: true",
+		},
+		{
+			name:   "xfs-reflink-dax",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				XFSReflink: "on",
+			},
+			err: "parameter \"xfs.reflink\": reflink and DAX are mutually exclusive, usage \"FileIO\" is required",
+		},
+		{
+			name:   "xfs-reflink-contradiction",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				XFSReflink: "on",
+				XFSOptions: "-m reflink=0",
+				UsageModel: string(UsageFileIO),
+			},
+			err: "parameter \"xfs.reflink\" contradicts reflink=0 in parameter \"xfs.options\"",
+		},
+		{
+			name:   "encryption",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Encryption: "luks2",
+				UsageModel: string(UsageFileIO),
+			},
+			parameters: Volume{
+				Encryption: &luks2,
+				Usage:      &fileIO,
+			},
+		},
+		{
+			name:   "invalid-encryption",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Encryption: "aes",
+			},
+			err: "parameter \"encryption\": unknown value: aes",
+		},
+		{
+			name:   "encryption-dax",
+			origin: EphemeralVolumeOrigin,
+			stringmap: VolumeContext{
+				Encryption: "luks2",
+				Size:       "1Gi",
+			},
+			err: "parameter \"encryption\": encryption and DAX are mutually exclusive, usage \"FileIO\" is required",
+		},
+		{
+			name:   "encryption-populate",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				Encryption:   "luks2",
+				UsageModel:   string(UsageFileIO),
+				PopulateFrom: "http://example.com/data.tar",
+			},
+			err: "parameters \"encryption\" and \"populateFrom\" are mutually exclusive",
+		},
+		{
+			name:   "erase-crypto",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				EraseAfterDelete: "crypto",
+				Encryption:       "luks2",
+				UsageModel:       string(UsageFileIO),
+			},
+			parameters: Volume{
+				ErasePolicy: &eraseCrypto,
+				Encryption:  &luks2,
+				Usage:       &fileIO,
+			},
+		},
+		{
+			name:   "erase-crypto-unencrypted",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				EraseAfterDelete: "crypto",
+			},
+			err: "parameter \"eraseAfterDelete\": \"crypto\" needs an encrypted volume",
+		},
+		{
+			name:   "erase-contradiction",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				EraseAfterDelete: "zero",
+				EraseAfter:       "false",
+			},
+			err: "parameter \"eraseAfterDelete\" contradicts parameter \"eraseafter\"",
+		},
+		{
+			name:   "invalid-erase-policy",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				EraseAfterDelete: "shred",
+			},
+			err: "parameter \"eraseAfterDelete\": unknown value: shred",
+		},
+		{
+			name:   "missing-xfs-option-value",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				XFSOptions: "-m -K",
+			},
+			err: "parameter \"xfs.options\": xfs option \"-m\" needs a value",
+		},
 
 		// Parse errors for size.
 		{
@@ -128,6 +648,24 @@ func TestParameters(t *testing.T) {
 			err: "parameter \"size\": failed to parse \"foo\" as int64: quantities must match the regular expression '^([+-]?[0-9.]+)([eEinumkKMGTP]*[-+]?[0-9]*)$'",
 		},
 
+		// Secret references from the storage class.
+		{
+			name:   "secret-references",
+			origin: CreateVolumeOrigin,
+			stringmap: VolumeContext{
+				NodeStageSecretName:      "pmem-key",
+				NodeStageSecretNamespace: "default",
+			},
+		},
+		{
+			name:   "invalid-secret-reference-node",
+			origin: NodeVolumeOrigin,
+			stringmap: VolumeContext{
+				NodeStageSecretName: "pmem-key",
+			},
+			err: "parameter \"csi.storage.k8s.io/node-stage-secret-name\" invalid in this context",
+		},
+
 		// Legacy state files.
 		{
 			name:   "model-none",
@@ -179,3 +717,78 @@ func TestParameters(t *testing.T) {
 		})
 	}
 }
+
+func TestXFSReflinkOptions(t *testing.T) {
+	on, off := true, false
+	crc := "-m crc=1 -K"
+	explicit := "-m reflink=1"
+	for name, tc := range map[string]struct {
+		v        Volume
+		expected []MkfsOption
+	}{
+		"unset":    {v: Volume{XFSOptions: &crc}, expected: []MkfsOption{{Flag: "-m", Value: "crc=1"}, {Flag: "-K"}}},
+		"on":       {v: Volume{XFSReflink: &on}, expected: []MkfsOption{{Flag: "-m", Value: "reflink=1"}}},
+		"merged":   {v: Volume{XFSReflink: &off, XFSOptions: &crc}, expected: []MkfsOption{{Flag: "-m", Value: "crc=1,reflink=0"}, {Flag: "-K"}}},
+		"explicit": {v: Volume{XFSReflink: &on, XFSOptions: &explicit}, expected: []MkfsOption{{Flag: "-m", Value: "reflink=1"}}},
+	} {
+		assert.Equal(t, tc.expected, tc.v.GetMkfsOptions("xfs"), name)
+		assert.Empty(t, tc.v.GetMkfsOptions("ext4"), name+": ext4")
+	}
+}
+
+func TestPVCMetadata(t *testing.T) {
+	metadata := VolumeContext{
+		PVCName:      "data",
+		PVCNamespace: "default",
+		PVName:       "pvc-7d832419",
+	}
+	for _, origin := range []Origin{CreateVolumeOrigin, PersistentVolumeOrigin, NodeVolumeOrigin} {
+		p, err := Parse(origin, metadata)
+		if assert.NoError(t, err, "origin %d", origin) {
+			assert.Equal(t, "data", *p.PVCName, "origin %d: PVC name", origin)
+			assert.Equal(t, "default", *p.PVCNamespace, "origin %d: PVC namespace", origin)
+			assert.Equal(t, "pvc-7d832419", *p.PVName, "origin %d: PV name", origin)
+			assert.Equal(t, metadata, p.ToContext(), "origin %d: re-encoded volume context", origin)
+		}
+	}
+	_, err := Parse(EphemeralVolumeOrigin, VolumeContext{Size: "1Gi", PVCName: "data"})
+	assert.NoError(t, err, "ephemeral volumes tolerate pod info keys")
+}
+
+func TestFilesystemLabel(t *testing.T) {
+	str := func(s string) *string { return &s }
+	assert.Equal(t, "", Volume{}.GetFilesystemLabel("ext4"), "no metadata")
+	assert.Equal(t, "default/data", Volume{PVCName: str("data"), PVCNamespace: str("default")}.GetFilesystemLabel("xfs"), "PVC")
+	assert.Equal(t, "pvc-7d832419", Volume{PVName: str("pvc-7d832419-3341-8f96")}.GetFilesystemLabel("xfs"), "truncated PV")
+	assert.Equal(t, "database-0", Volume{PVCName: str("database-0"), PVCNamespace: str("production")}.GetFilesystemLabel("ext4"), "PVC name only")
+	assert.Equal(t, "database-0-p", Volume{PVCName: str("database-0-primary"), PVCNamespace: str("production")}.GetFilesystemLabel("xfs"), "truncated PVC name")
+}
+
+func TestSecrets(t *testing.T) {
+	secrets := Secrets{
+		"passphrase": "foo",
+		"key":        "bar",
+	}
+	assert.Equal(t, []string{"key", "passphrase"}, secrets.Keys(), "keys")
+}
+
+func TestErasePolicy(t *testing.T) {
+	yes, no := true, false
+	none, crypto := EraseNone, EraseCrypto
+	assert.Equal(t, EraseZero, Volume{}.GetErasePolicy(), "default")
+	assert.Equal(t, EraseZero, Volume{EraseAfter: &yes}.GetErasePolicy(), "eraseafter=true")
+	assert.Equal(t, EraseNone, Volume{EraseAfter: &no}.GetErasePolicy(), "eraseafter=false")
+	assert.Equal(t, EraseNone, Volume{ErasePolicy: &none}.GetErasePolicy(), "none")
+	assert.False(t, Volume{ErasePolicy: &crypto}.GetEraseAfter(), "no zeroing for crypto")
+}
+
+func TestWithoutTokens(t *testing.T) {
+	volumeContext := map[string]string{PodName: "pod"}
+	assert.Equal(t, volumeContext, WithoutTokens(volumeContext), "no tokens")
+
+	volumeContext[ServiceAccountTokens] = `{"audience":{"token":"my-token"}}`
+	stripped := WithoutTokens(volumeContext)
+	assert.NotContains(t, stripped[ServiceAccountTokens], "my-token", "token stripped")
+	assert.Equal(t, "pod", stripped[PodName], "other values kept")
+	assert.Contains(t, volumeContext[ServiceAccountTokens], "my-token", "original unmodified")
+}
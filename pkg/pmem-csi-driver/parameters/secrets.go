@@ -0,0 +1,56 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package parameters
+
+import (
+	"sort"
+)
+
+// Secret references in a storage class as defined by the Kubernetes CSI
+// conventions
+// (https://kubernetes-csi.github.io/docs/secrets-and-credentials-storage-class.html).
+// They are resolved by the CO, which then passes the secret content
+// in the secrets field of the corresponding CSI call.
+const (
+	ProvisionerSecretName      = "csi.storage.k8s.io/provisioner-secret-name"
+	ProvisionerSecretNamespace = "csi.storage.k8s.io/provisioner-secret-namespace"
+	NodeStageSecretName        = "csi.storage.k8s.io/node-stage-secret-name"
+	NodeStageSecretNamespace   = "csi.storage.k8s.io/node-stage-secret-namespace"
+	NodePublishSecretName      = "csi.storage.k8s.io/node-publish-secret-name"
+	NodePublishSecretNamespace = "csi.storage.k8s.io/node-publish-secret-namespace"
+)
+
+// EncryptionPassphrase is the key in the secrets under which the
+// passphrase of an encrypted volume is expected.
+const EncryptionPassphrase = "encryptionPassphrase"
+
+// secretReferences lists all secret references that may appear in
+// CreateVolume parameters.
+var secretReferences = []string{
+	ProvisionerSecretName,
+	ProvisionerSecretNamespace,
+	NodeStageSecretName,
+	NodeStageSecretNamespace,
+	NodePublishSecretName,
+	NodePublishSecretNamespace,
+}
+
+// Secrets contains the key/value pairs from the secrets field of
+// CreateVolume, NodeStageVolume or NodePublishVolume. The values
+// must never be logged.
+type Secrets map[string]string
+
+// Keys returns the sorted keys, which is all that may be logged
+// about secrets.
+func (s Secrets) Keys() []string {
+	keys := make([]string, 0, len(s))
+	for key := range s {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -12,27 +12,39 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"math"
 	"net"
 	"net/http"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"os/user"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"k8s.io/apimachinery/pkg/api/resource"
 	"k8s.io/client-go/informers"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
 	"k8s.io/klog/v2"
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
 	"github.com/intel/pmem-csi/pkg/k8sutil"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
 	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemgrpc "github.com/intel/pmem-csi/pkg/pmem-grpc"
 	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
 	"github.com/intel/pmem-csi/pkg/types"
 	"github.com/kubernetes-csi/csi-lib-utils/metrics"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 )
 
 const (
@@ -45,7 +57,7 @@ type DriverMode string
 
 func (mode *DriverMode) Set(value string) error {
 	switch value {
-	case string(Node), string(Controller), string(ForceConvertRawNamespaces):
+	case string(Node), string(Controller), string(ForceConvertRawNamespaces), string(VerifyVolumes), string(UndeleteVolume), string(ConvertToSystemRAM), string(RenameDriver), string(ApplyProfile), string(Inspect), string(RotateKey), string(RebuildState), string(ExportState), string(ImportState):
 		*mode = DriverMode(value)
 	default:
 		// The flag package will add the value to the final output, no need to do it here.
@@ -67,6 +79,27 @@ const (
 	Controller DriverMode = "webhooks"
 	// Convert each raw namespace into fsdax.
 	ForceConvertRawNamespaces = "force-convert-raw-namespaces"
+	// Record or verify checksums of all volumes on the node, for example
+	// before and after replacing a DIMM.
+	VerifyVolumes DriverMode = "verify-volumes"
+	// List the volumes in the trash or ask the node driver to restore one.
+	UndeleteVolume DriverMode = "undelete-volume"
+	// Turn namespaces into system RAM for memory tiering.
+	ConvertToSystemRAM DriverMode = "convert-to-system-ram"
+	// Prepare a node for running the driver under a different name.
+	RenameDriver DriverMode = "rename-driver"
+	// Create the namespaces described by the provisioning profile of the node.
+	ApplyProfile DriverMode = "apply-profile"
+	// Node driver which only serves calls that do not modify anything.
+	Inspect DriverMode = "inspect"
+	// Replace the passphrase of an encrypted volume.
+	RotateKey DriverMode = "rotate-key"
+	// Restore the state of the volumes on the node from the devices.
+	RebuildState DriverMode = "rebuild-state"
+	// Write the state of the node as JSON.
+	ExportState DriverMode = "export-state"
+	// Store the state from an export on the node.
+	ImportState DriverMode = "import-state"
 )
 
 var (
@@ -109,6 +142,13 @@ type Config struct {
 	Version string
 	// PmemPercentage percentage of space to be used by the driver in each PMEM region
 	PmemPercentage uint
+	// comma-separated regions which may or must not be used, empty allows all
+	regions        string
+	excludeRegions string
+	// over-commit percentage of LVM thin pools, zero for thick volumes
+	lvmThinOvercommit uint
+	// thin pool usage in percent which triggers an event, zero disables it
+	lvmThinThreshold uint
 
 	// KubeAPIQPS is the average rate of requests to the Kubernetes API server,
 	// enforced locally in client-go.
@@ -120,15 +160,179 @@ type Config struct {
 
 	// parameters for rescheduler and raw namespace conversion
 	nodeSelector types.NodeSelector
+	// additional driver names handled by the rescheduler
+	rescheduleDriverNames string
+	// only log and count PVCs which would get rescheduled
+	reschedulerDryRun bool
+	// also reschedule PVCs of nodes with unhealthy or exhausted PMEM
+	rescheduleUnusableNodes bool
+	// restrict the informers of the controller, empty watches everything
+	pvcSelectors          informerSelectors
+	pvSelectors           informerSelectors
+	storageClassSelectors informerSelectors
+	// interval for updating the PmemCSICapacityReport, zero disables it
+	capacityReportInterval time.Duration
+	// run the controller only in the instance which holds the lease
+	leaderElection          bool
+	leaderElectionNamespace string
+	// how often each controller replica renews its heartbeat Lease, zero disables it
+	controllerHeartbeatInterval time.Duration
+	// HTTP server for the scheduler extender, disabled when empty
+	schedulerListen       string
+	schedulerCertFile     string
+	schedulerKeyFile      string
+	schedulerClientCAFile string
+	// how the scheduler extender ranks nodes
+	schedulerScoring SchedulerScoring
+	// interval for publishing PMEM as extended resource of nodes,
+	// zero disables it and the pod mutation webhook
+	pmemResourceInterval time.Duration
+
+	// size of the namespace for the state directory, zero leaves the directory as it is
+	stateNamespaceSize resource.QuantityValue
+	// directory where the node driver maintains a symlink for each volume
+	deviceLinkDir string
+	// what to do when stored volume size and device size differ
+	sizeMismatchPolicy SizeMismatchPolicy
+	// how long deleted volumes can be restored, zero disables the trash
+	trashRetention time.Duration
+	// deleted versions of a volume ID which are kept in the trash, zero keeps all
+	trashMaxPerVolume int
+	// how often the state gets compacted, zero disables it
+	stateCompactionInterval time.Duration
+	// how often the node driver removes orphaned mount points and dm-crypt devices, zero disables it
+	orphanCleanupInterval time.Duration
+	// only log and count orphans
+	orphanCleanupDryRun bool
+	// bytes per second for zeroing freed devices, zero zeroes them while deleting
+	scrubRate resource.QuantityValue
+	// volume limit reported in NodeGetInfo, zero means no limit
+	maxVolumesPerNode int64
+	// report the NUMA nodes of the PMEM as topology
+	numaTopology bool
+	// what to do when DAX is not active after mounting
+	daxCheck DAXCheck
+	// emit events for the PVC, PV or pod when volume operations fail
+	volumeEvents bool
+	// comma-separated flags allowed in volume capabilities, empty allows all
+	allowedMountFlags string
+	// limits for rejecting calls with RESOURCE_EXHAUSTED, zero disables them
+	maxConcurrentCalls uint
+	maxDeletionQueue   uint
+	// limits per method for queueing calls, empty disables them
+	maxConcurrentCallsPerMethod MethodLimits
+	// containerd socket for populating volumes from images, empty disables that
+	containerdAddress string
+
+	// failure injection on selected nodes
+	simulateMaxCapacity    resource.QuantityValue
+	simulateCreateFailures uint
+	simulateNodes          string
+
+	// record instead of verify checksums in VerifyVolumes mode
+	recordChecksums bool
+	// volume to restore in UndeleteVolume mode, empty lists the trash,
+	// or the volume whose key gets replaced in RotateKey mode
+	volumeID string
+	// JSON file written in ExportState mode and read in ImportState mode, "-" for stdout or stdin
+	stateFile string
+	// current and new passphrase in RotateKey mode with the secret key provider
+	oldPassphraseFile string
+	newPassphraseFile string
+	// namespaces used as system RAM in ConvertToSystemRAM mode, empty selects all unnamed ones
+	systemRAMNamespaces string
+	// previous driver name and its state directory in RenameDriver mode
+	oldDriverName string
+	oldStatePath  string
+	// <namespace>/<name> of the ConfigMap with profiles in ApplyProfile mode
+	profileConfigMap string
+
+	// mode (octal), owner and group (name or numeric ID) of the
+	// Unix domain socket for Endpoint, empty keeps the defaults
+	endpointMode  string
+	endpointOwner string
+	endpointGroup string
+	// additional gRPC endpoint on a TCP address, always with
+	// mutual TLS
+	tcpEndpoint          string
+	endpointCertFile     string
+	endpointKeyFile      string
+	endpointClientCAFile string
+	endpointClientName   string
+	// limits of the gRPC servers, zero keeps the gRPC defaults
+	grpcMaxConcurrentStreams uint
+	grpcMaxMessageSize       resource.QuantityValue
+	grpcCallTimeout          time.Duration
+	// keepalive enforcement for clients and pings of idle clients
+	grpcKeepaliveMinTime             time.Duration
+	grpcKeepalivePermitWithoutStream bool
+	grpcKeepaliveTime                time.Duration
+	grpcKeepaliveTimeout             time.Duration
+	// how long the socket stays open after the termination signal
+	// and how long pending calls may continue after that
+	drainPeriod  time.Duration
+	drainTimeout time.Duration
+	// serve the gRPC reflection API on the CSI endpoint
+	grpcReflection bool
+	// log requests and responses without secrets
+	grpcLogPayloads bool
 
 	// parameters for Prometheus metrics
 	metricsListen string
 	metricsPath   string
+	// TLS for the metrics endpoint, plain HTTP without certificate
+	metricsCertFile     string
+	metricsKeyFile      string
+	metricsClientCAFile string
+	// file with tokens for the tenant-scoped metrics view
+	metricsTenantTokens string
+	// file with the token for changing the log verbosity
+	logVerbosityToken string
+	// number of recent operations served next to the metrics data
+	operationLogSize uint
+	// sample PMEM bandwidth with perf events
+	bandwidthMetrics bool
+	// net/http/pprof server, disabled when empty
+	pprofListen string
+	// OTLP gRPC collector for traces, disabled when empty
+	tracingEndpoint               string
+	tracingSamplingRatePerMillion int
+	// source of passphrases for encrypted volumes
+	keyProvider    KeyProviderType
+	vaultAddress   string
+	vaultTokenFile string
+	vaultCAFile    string
+	vaultKVMount   string
+	vaultKVPrefix  string
+	keyCacheTTL    time.Duration
+	// file for records of file accesses on volumes with access auditing
+	accessAuditLog string
+	// file for records of volume lifecycle operations
+	operationAuditLog string
+	// comma-separated volume parameters which users must not set
+	deniedParameters string
+	// webhook which authorizes NodePublishVolume with the pod token
+	publishAuthorizationURL    string
+	publishAuthorizationCAFile string
+	// publish the available features as node labels
+	featureLabels bool
+	// publish the result of the health check as node label
+	healthLabel bool
 }
 
 type csiDriver struct {
-	cfg       Config
-	gatherers prometheus.Gatherers
+	cfg            Config
+	gatherers      prometheus.Gatherers
+	operations     *operationLog
+	operationAudit *operationAuditor
+	features       *featureProber
+	backpressure   *backpressure
+	methodLimiter  *methodLimiter
+	tracerProvider trace.TracerProvider
+	health         *healthChecker
+	volumeEvents   *volumeEvents
+	// controllerStatus is only set in controller mode.
+	controllerStatus *controllerStatus
 }
 
 func GetCSIDriver(cfg Config) (*csiDriver, error) {
@@ -138,14 +342,20 @@ func GetCSIDriver(cfg Config) (*csiDriver, error) {
 	if cfg.Endpoint == "" {
 		return nil, errors.New("CSI endpoint configuration option missing")
 	}
-	if cfg.Mode == Node && cfg.NodeID == "" {
+	if (cfg.Mode == Node || cfg.Mode == RenameDriver || cfg.Mode == ApplyProfile || cfg.Mode == Inspect) && cfg.NodeID == "" {
 		return nil, errors.New("node ID configuration option missing")
 	}
-	if cfg.Mode == Node && cfg.StateBasePath == "" {
+	if cfg.Mode == Node && cfg.DeviceManager == api.DeviceModeDirect && cfg.trashRetention > 0 {
+		// A namespace in the trash would keep the volume ID as
+		// its name and collide with a new volume of the same name.
+		return nil, errors.New("-trashRetention is not supported in direct mode because namespaces cannot be renamed")
+	}
+	if (cfg.Mode == Node || cfg.Mode == VerifyVolumes || cfg.Mode == UndeleteVolume || cfg.Mode == RenameDriver || cfg.Mode == Inspect || cfg.Mode == RotateKey || cfg.Mode == RebuildState || cfg.Mode == ExportState || cfg.Mode == ImportState) && cfg.StateBasePath == "" {
 		cfg.StateBasePath = "/var/lib/" + cfg.DriverName
 	}
 
 	DriverTopologyKey = cfg.DriverName + "/node"
+	DriverNUMATopologyPrefix = cfg.DriverName + "/numa-"
 
 	// Should GetCSIDriver get called more than once per process,
 	// all of them will record their version.
@@ -161,11 +371,37 @@ func GetCSIDriver(cfg Config) (*csiDriver, error) {
 		// (https://povilasv.me/prometheus-go-metrics/) are included,
 		// which may be useful.
 		gatherers: prometheus.Gatherers{prometheus.DefaultGatherer},
+		health:    &healthChecker{},
 	}, nil
 }
 
 func (csid *csiDriver) Run(ctx context.Context) error {
-	s := grpcserver.NewNonBlockingGRPCServer()
+	// Closed after stopping the server, the server may still
+	// record operations until then.
+	closeAudit, err := csid.openOperationAudit()
+	if err != nil {
+		return err
+	}
+	defer closeAudit()
+	stopTracing, err := csid.startTracing(ctx)
+	if err != nil {
+		return err
+	}
+	defer stopTracing()
+	grpcConfig, err := csid.grpcServerConfig()
+	if err != nil {
+		return err
+	}
+	opts := append(csid.tracingServerOptions(), csid.serverOptions()...)
+	if csid.cfg.grpcLogPayloads {
+		opts = append(opts, grpc.ChainUnaryInterceptor(pmemcommon.LogGRPCPayloads))
+	}
+	s := grpcserver.NewNonBlockingGRPCServer(grpcConfig, opts...)
+	permissions, err := parseSocketPermissions(csid.cfg.endpointMode, csid.cfg.endpointOwner, csid.cfg.endpointGroup)
+	if err != nil {
+		return err
+	}
+	s.SetSocketPermissions(permissions)
 	// Ensure that the server is stopped before we return.
 	defer func() {
 		s.ForceStop()
@@ -177,93 +413,33 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 
 	switch csid.cfg.Mode {
 	case Controller:
-		client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+		status, err := csid.newControllerStatus()
 		if err != nil {
-			return fmt.Errorf("connect to apiserver: %v", err)
-		}
-
-		// A factory for all namespaces.
-		globalFactory := informers.NewSharedInformerFactory(client, resyncPeriod)
-		pvcInformer := globalFactory.Core().V1().PersistentVolumeClaims().Informer()
-		scInformer := globalFactory.Storage().V1().StorageClasses().Informer()
-		pvInformer := globalFactory.Core().V1().PersistentVolumes().Informer()
-		csiNodeLister := globalFactory.Storage().V1().CSINodes().Lister()
-
-		var pcp *pmemCSIProvisioner
-		if csid.cfg.nodeSelector != nil {
-			serverVersion, err := client.Discovery().ServerVersion()
-			if err != nil {
-				return fmt.Errorf("discover server version: %v", err)
-			}
-
-			// Create rescheduler. This has to be done before starting the factory
-			// because it will indirectly add a new index.
-			//
-			// We don't use leader election. The shared factories are running
-			// anyway, so we don't avoid traffic when hot spares are idle. Quite
-			// the opposite, the leader election itself causes additional traffic.
-			//
-			// There's also no downside to running the deschedule check multiple
-			// times. In the worst case, multiple instances will determine at exactly
-			// the same time that it's time to reschedule and try to unset the annotation.
-			// One of them will succeed, the others will get a conflict error and then
-			// notice that nothing is left to do on their retry.
-			pcp = newRescheduler(ctx,
-				csid.cfg.DriverName,
-				client, pvcInformer, scInformer, pvInformer, csiNodeLister,
-				csid.cfg.nodeSelector,
-				serverVersion.GitVersion)
-		}
-
-		// Now that all informers and indices are created we can run the factory.
-		globalFactory.Start(ctx.Done())
-		cacheSyncResult := globalFactory.WaitForCacheSync(ctx.Done())
-		logger.V(5).Info("Synchronized caches", "cache-sync-result", cacheSyncResult)
-		for t, v := range cacheSyncResult {
-			if !v {
-				return fmt.Errorf("failed to sync informer for type %v", t)
-			}
+			return err
 		}
-
-		if pcp != nil {
-			pcp.startRescheduler(ctx, cancel)
+		csid.controllerStatus = status
+		MustRegisterControllerMetrics(prometheus.DefaultRegisterer, csid.cfg.DriverName)
+		status.setActive(false)
+		if csid.cfg.controllerHeartbeatInterval > 0 {
+			status.run(ctx)
 		}
-	case Node:
-		dm, err := pmdmanager.New(ctx, csid.cfg.DeviceManager, csid.cfg.PmemPercentage)
-		if err != nil {
+		if csid.cfg.leaderElection {
+			if err := csid.runLeaderElection(ctx, cancel); err != nil {
+				return err
+			}
+		} else if err := csid.startController(ctx, cancel); err != nil {
 			return err
 		}
-		sm, err := pmemstate.NewFileState(csid.cfg.StateBasePath)
+	case Node:
+		stop, err := csid.startNode(ctx, s)
 		if err != nil {
 			return err
 		}
-
-		// On the csi.sock endpoint we gather statistics for incoming
-		// CSI method calls like any other CSI driver.
-		cmm := metrics.NewCSIMetricsManagerWithOptions(csid.cfg.DriverName,
-			metrics.WithProcessStartTime(false),
-			metrics.WithSubsystem(metrics.SubsystemPlugin),
-		)
-		csid.gatherers = append(csid.gatherers, cmm.GetRegistry())
-
-		// Create GRPC servers
-		ids := NewIdentityServer(csid.cfg.DriverName, csid.cfg.Version)
-		cs := NewNodeControllerServer(ctx, csid.cfg.NodeID, dm, sm)
-		ns := NewNodeServer(cs, filepath.Clean(csid.cfg.StateBasePath)+"/mount")
-
-		services := []grpcserver.Service{ids, ns, cs}
-		if err := s.Start(ctx, csid.cfg.Endpoint, csid.cfg.NodeID, nil, cmm, services...); err != nil {
+		defer stop()
+	case Inspect:
+		if err := csid.startInspect(ctx, s); err != nil {
 			return err
 		}
-
-		// Also collect metrics data via the device manager.
-		pmdmanager.CapacityCollector{PmemDeviceCapacity: dm}.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
-
-		capacity, err := dm.GetCapacity(ctx)
-		if err != nil {
-			return fmt.Errorf("get initial capacity: %v", err)
-		}
-		logger.Info("PMEM-CSI ready.", "capacity", capacity)
 	case ForceConvertRawNamespaces:
 		client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
 		if err != nil {
@@ -285,6 +461,67 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		// isn't supported for DaemonSets
 		// (https://github.com/kubernetes/kubernetes/issues/24725).
 		logger.Info("Raw namespace conversion is done, waiting for termination signal.")
+	case ConvertToSystemRAM:
+		client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+		if err != nil {
+			return fmt.Errorf("connect to apiserver: %v", err)
+		}
+
+		var namespaces []string
+		for _, namespace := range strings.Split(csid.cfg.systemRAMNamespaces, ",") {
+			if namespace := strings.TrimSpace(namespace); namespace != "" {
+				namespaces = append(namespaces, namespace)
+			}
+		}
+		if err := pmdmanager.ConvertToSystemRAM(ctx, client, csid.cfg.DriverName, namespaces, csid.cfg.NodeID); err != nil {
+			return err
+		}
+
+		// Same reason for waiting as for ForceConvertRawNamespaces.
+		logger.Info("Conversion to system RAM is done, waiting for termination signal.")
+	case VerifyVolumes:
+		// This is a one-shot operation. The exit code tells the
+		// admin whether all volumes are okay.
+		return csid.verifyVolumes(ctx)
+	case UndeleteVolume:
+		// Also a one-shot operation.
+		return csid.undeleteVolume(ctx, os.Stdout)
+	case RotateKey:
+		// Also a one-shot operation, in the node driver
+		// container.
+		return csid.rotateKey(ctx)
+	case RebuildState:
+		// Also a one-shot operation, before the node driver
+		// starts.
+		return csid.rebuildState(ctx)
+	case ExportState:
+		// Also a one-shot operation, which may run next to
+		// the node driver.
+		return csid.exportState(ctx, os.Stdout)
+	case ImportState:
+		// Also a one-shot operation, before the node driver
+		// starts.
+		return csid.importState(ctx, os.Stdin)
+	case RenameDriver:
+		// Also a one-shot operation, running before the node
+		// driver starts with the new name.
+		client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+		if err != nil {
+			return fmt.Errorf("connect to apiserver: %v", err)
+		}
+		return csid.renameDriver(ctx, client)
+	case ApplyProfile:
+		// Also a one-shot operation, for example in an init
+		// container of the node driver.
+		parts := strings.Split(csid.cfg.profileConfigMap, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return fmt.Errorf("profile ConfigMap must be given as <namespace>/<name>, got %q", csid.cfg.profileConfigMap)
+		}
+		client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+		if err != nil {
+			return fmt.Errorf("connect to apiserver: %v", err)
+		}
+		return pmdmanager.ApplyProfile(ctx, client, parts[0], parts[1], csid.cfg.NodeID)
 	default:
 		return fmt.Errorf("Unsupported device mode '%v", csid.cfg.Mode)
 	}
@@ -295,32 +532,794 @@ func (csid *csiDriver) Run(ctx context.Context) error {
 		if err != nil {
 			return err
 		}
-		logger.Info("Prometheus endpoint started.", "endpoint", fmt.Sprintf("http://%s%s", addr, csid.cfg.metricsPath))
+		scheme := "http"
+		if csid.cfg.metricsCertFile != "" {
+			scheme = "https"
+		}
+		logger.Info("Prometheus endpoint started.", "endpoint", fmt.Sprintf("%s://%s%s", scheme, addr, csid.cfg.metricsPath))
+	}
+	if csid.cfg.pprofListen != "" {
+		addr, err := csid.startPprof(ctx, cancel)
+		if err != nil {
+			return err
+		}
+		logger.Info("Profiling endpoint started.", "endpoint", fmt.Sprintf("http://%s/debug/pprof/", addr))
+	}
+
+	csid.health.setReady(true)
+	// Only has an effect when running as systemd service.
+	if err := pmemcommon.SystemdNotifyReady(); err != nil {
+		logger.Error(err, "Notifying systemd failed")
 	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	drain := false
 	select {
 	case sig := <-c:
-		logger.Info("Caught signal, terminating.", "signal", sig)
-		// We sleep briefly to give sidecars a chance to shut down cleanly
-		// before we close the CSI socket and force them to shut down
-		// abnormally, because the latter causes lots of debug output
-		// due to usage of klog.Fatal (https://github.com/intel/pmem-csi/issues/856).
-		time.Sleep(time.Second)
+		logger.Info("Caught signal, terminating.", "signal", sig, "in-flight-calls", s.InFlight())
+		drain = true
 	case <-ctx.Done():
 		// The scheduler HTTP server must have failed (to start).
 		// We quit directly in that case.
 	}
 
+	csid.health.setReady(false)
+	if err := pmemcommon.SystemdNotifyStopping(); err != nil {
+		logger.Error(err, "Notifying systemd failed")
+	}
+
+	if drain {
+		// We wait to give sidecars a chance to shut down cleanly
+		// before we close the CSI socket and force them to shut down
+		// abnormally, because the latter causes lots of debug output
+		// due to usage of klog.Fatal (https://github.com/intel/pmem-csi/issues/856).
+		time.Sleep(csid.cfg.drainPeriod)
+	}
+
 	// Here (in contrast to the s.ForceStop() above) we let the gRPC server finish
-	// its work on any pending call.
-	s.Stop()
+	// its work on any pending call, within limits.
+	shutdownCtx := context.Background()
+	if csid.cfg.drainTimeout > 0 {
+		var cancelShutdown func()
+		shutdownCtx, cancelShutdown = context.WithTimeout(shutdownCtx, csid.cfg.drainTimeout)
+		defer cancelShutdown()
+	}
+	if inFlight := s.InFlight(); inFlight > 0 {
+		logger.Info("Waiting for pending calls", "in-flight-calls", inFlight, "timeout", csid.cfg.drainTimeout)
+	}
+	if err := s.Shutdown(shutdownCtx); err != nil {
+		logger.Info("Canceled pending calls", "timeout", csid.cfg.drainTimeout)
+	}
 	s.Wait()
 
 	return nil
 }
 
+// startController creates the informers and starts the components of
+// the controller which are enabled. Errors at runtime cancel the
+// context.
+func (csid *csiDriver) startController(ctx context.Context, cancel func()) error {
+	logger := klog.FromContext(ctx)
+	client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+	if err != nil {
+		return fmt.Errorf("connect to apiserver: %v", err)
+	}
+
+	// A factory for all namespaces.
+	globalFactory := informers.NewSharedInformerFactory(client, resyncPeriod)
+	if err := csid.filterInformers(globalFactory); err != nil {
+		return err
+	}
+	pvcInformer := globalFactory.Core().V1().PersistentVolumeClaims().Informer()
+	scInformer := globalFactory.Storage().V1().StorageClasses().Informer()
+	pvInformer := globalFactory.Core().V1().PersistentVolumes().Informer()
+	csiNodeLister := globalFactory.Storage().V1().CSINodes().Lister()
+
+	var cr *capacityReporter
+	if csid.cfg.capacityReportInterval > 0 {
+		restConfig, err := k8sutil.NewConfig(config.KubeAPIQPS, config.KubeAPIBurst)
+		if err != nil {
+			return fmt.Errorf("connect to apiserver: %v", err)
+		}
+		cr, err = newCapacityReporter(ctx, csid.cfg.DriverName, restConfig, client, globalFactory)
+		if err != nil {
+			return err
+		}
+	}
+
+	var pcp *pmemCSIProvisioner
+	if csid.cfg.nodeSelector != nil {
+		serverVersion, err := client.Discovery().ServerVersion()
+		if err != nil {
+			return fmt.Errorf("discover server version: %v", err)
+		}
+
+		// Create rescheduler. This has to be done before starting the factory
+		// because it will indirectly add a new index.
+		//
+		// Leader election is optional (-leader-election). Without it, the
+		// shared factories of hot spares are running anyway, so there is
+		// no downside to running the deschedule check multiple
+		// times. In the worst case, multiple instances will determine at exactly
+		// the same time that it's time to reschedule and try to unset the annotation.
+		// One of them will succeed, the others will get a conflict error and then
+		// notice that nothing is left to do on their retry.
+		var capacityLister storagelistersv1.CSIStorageCapacityLister
+		if csid.cfg.rescheduleUnusableNodes && hasStorageCapacity(client) {
+			capacityLister = globalFactory.Storage().V1().CSIStorageCapacities().Lister()
+		}
+		pcp = newRescheduler(ctx,
+			csid.rescheduleDriverNames(),
+			client, pvcInformer, scInformer, pvInformer, csiNodeLister, capacityLister,
+			csid.cfg.nodeSelector,
+			csid.cfg.reschedulerDryRun,
+			csid.cfg.rescheduleUnusableNodes,
+			serverVersion.GitVersion)
+		if err := pcp.watchDriverRemovals(globalFactory.Storage().V1().CSINodes().Informer()); err != nil {
+			return fmt.Errorf("watch CSINode objects: %v", err)
+		}
+		MustRegisterReschedulerMetrics(prometheus.DefaultRegisterer, csid.cfg.DriverName)
+	}
+
+	var se *schedulerExtender
+	if csid.cfg.schedulerListen != "" {
+		se = newSchedulerExtender(ctx, csid.cfg.DriverName, csid.cfg.schedulerScoring, client, globalFactory)
+	}
+	var nr *nodeResources
+	if csid.cfg.pmemResourceInterval > 0 {
+		nr, err = newNodeResources(csid.cfg.DriverName, client, globalFactory)
+		if err != nil {
+			return err
+		}
+		if se != nil {
+			se.resourceName = nr.resourceName
+		}
+	}
+
+	// Now that all informers and indices are created we can run the factory.
+	globalFactory.Start(ctx.Done())
+	cacheSyncResult := globalFactory.WaitForCacheSync(ctx.Done())
+	logger.V(5).Info("Synchronized caches", "cache-sync-result", cacheSyncResult)
+	for t, v := range cacheSyncResult {
+		if !v {
+			return fmt.Errorf("failed to sync informer for type %v", t)
+		}
+	}
+
+	if pcp != nil {
+		pcp.startRescheduler(ctx, cancel)
+	}
+	if cr != nil {
+		cr.run(ctx, csid.cfg.capacityReportInterval)
+	}
+	if nr != nil {
+		nr.run(ctx, csid.cfg.pmemResourceInterval)
+	}
+	if se != nil {
+		if _, err := csid.startScheduler(ctx, cancel, se); err != nil {
+			return err
+		}
+	}
+	csid.controllerStatus.setActive(true)
+	return nil
+}
+
+// serverOptions returns the options for the gRPC server of the mode.
+func (csid *csiDriver) serverOptions() []grpc.ServerOption {
+	switch csid.cfg.Mode {
+	case Node:
+		var interceptors []grpc.UnaryServerInterceptor
+		if csid.operationAudit != nil {
+			// Outermost, so that it records the final result,
+			// including rejected calls.
+			interceptors = append(interceptors, csid.operationAudit.intercept)
+		}
+		if csid.cfg.operationLogSize > 0 {
+			csid.operations = newOperationLog(csid.cfg.operationLogSize)
+			interceptors = append(interceptors, csid.operations.intercept)
+		}
+		if csid.cfg.volumeEvents {
+			// Also sees the annotated errors.
+			csid.volumeEvents = &volumeEvents{}
+			interceptors = append(interceptors, csid.volumeEvents.intercept)
+		}
+		// Inside the operation log, so that it records the annotated errors.
+		interceptors = append(interceptors, errorDetailsInterceptor(csid.cfg.DriverName))
+		// Calls which wait for other calls of the same method do
+		// not count as running yet.
+		csid.methodLimiter = newMethodLimiter(csid.cfg.maxConcurrentCallsPerMethod)
+		interceptors = append(interceptors, csid.methodLimiter.intercept)
+		// Rejected calls get logged, but not annotated.
+		interceptors = append(interceptors, csid.setupBackpressure())
+		return []grpc.ServerOption{grpc.ChainUnaryInterceptor(interceptors...)}
+	case Inspect:
+		return []grpc.ServerOption{grpc.ChainUnaryInterceptor(readOnlyInterceptor)}
+	default:
+		return nil
+	}
+}
+
+// openOperationAudit opens the operation audit log in node mode, if
+// one is configured. The returned function closes it.
+func (csid *csiDriver) openOperationAudit() (func(), error) {
+	if csid.cfg.Mode != Node || csid.cfg.operationAuditLog == "" {
+		return func() {}, nil
+	}
+	sink, err := openAuditLog(csid.cfg.operationAuditLog)
+	if err != nil {
+		return nil, err
+	}
+	csid.operationAudit = newOperationAuditor(sink)
+	return func() { sink.Close() }, nil
+}
+
+// setupBackpressure creates the limits for concurrent calls and
+// returns the interceptor which enforces them.
+func (csid *csiDriver) setupBackpressure() grpc.UnaryServerInterceptor {
+	csid.backpressure = newBackpressure(csid.cfg.DriverName, int(csid.cfg.maxConcurrentCalls), int(csid.cfg.maxDeletionQueue))
+	return csid.backpressure.intercept
+}
+
+// startNode brings up the node driver and starts serving CSI calls.
+// The returned function must be called when the driver stops.
+func (csid *csiDriver) startNode(ctx context.Context, s *grpcserver.NonBlockingGRPCServer) (stop func(), finalErr error) {
+	logger := klog.FromContext(ctx)
+	var cleanup []func()
+	stop = func() {
+		for i := len(cleanup) - 1; i >= 0; i-- {
+			cleanup[i]()
+		}
+	}
+	defer func() {
+		if finalErr != nil {
+			stop()
+		}
+	}()
+
+	// The state namespace must exist before the device manager
+	// uses the remaining space.
+	if err := csid.setupStateNamespace(ctx); err != nil {
+		return nil, err
+	}
+	dm, err := pmdmanager.New(ctx, csid.cfg.DeviceManager, csid.cfg.PmemPercentage, csid.deviceManagerOptions())
+	if err != nil {
+		return nil, err
+	}
+	if sim := csid.simulation(); sim.Enabled() {
+		logger.Info("WARNING: simulation of capacity exhaustion is active", "max-capacity", pmemlog.CapacityRef(int64(sim.MaxCapacity)), "create-failure-percentage", sim.CreateFailurePercentage)
+		dm, err = pmdmanager.NewSimulation(dm, sim)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Only the node driver modifies the volume and snapshot
+	// state while it runs, so they can be cached. The trash is
+	// also modified by the undelete-volume mode.
+	sm, err := pmemstate.NewDBState(csid.cfg.StateBasePath)
+	if err != nil {
+		return nil, err
+	}
+	sm = pmemstate.NewCached(pmemstate.NewInstrumented(sm, "volumes"))
+	snapshotState, err := pmemstate.NewDBState(filepath.Join(csid.cfg.StateBasePath, snapshotDirectory))
+	if err != nil {
+		return nil, err
+	}
+	snapshotState = pmemstate.NewCached(pmemstate.NewInstrumented(snapshotState, "snapshots"))
+
+	// On the csi.sock endpoint we gather statistics for incoming
+	// CSI method calls like any other CSI driver.
+	cmm := csid.newCSIMetricsManager()
+
+	// Create GRPC servers
+	ids := NewIdentityServer(csid.cfg.DriverName, csid.cfg.Version)
+	cs := NewNodeControllerServer(ctx, csid.cfg.NodeID, dm, sm, snapshotState, csid.cfg.deviceLinkDir, csid.deviceManagerOptions())
+	if err := cs.reconcileVolumeSizes(ctx, csid.cfg.sizeMismatchPolicy); err != nil {
+		return nil, err
+	}
+	if err := csid.startTrash(ctx, cs); err != nil {
+		return nil, err
+	}
+	if err := csid.startScrubber(ctx, cs); err != nil {
+		return nil, err
+	}
+	if csid.cfg.stateCompactionInterval > 0 {
+		cs.runStateCompaction(ctx, csid.cfg.StateBasePath, csid.cfg.stateCompactionInterval)
+	}
+	csid.setupPopulator(cs)
+	if err := csid.setupKeyProvider(cs); err != nil {
+		return nil, err
+	}
+	if cs.deniedParameters, err = parseDeniedParameters(csid.cfg.deniedParameters); err != nil {
+		return nil, err
+	}
+	if err := csid.startFeatureLabels(ctx, cs); err != nil {
+		return nil, err
+	}
+	ns := csid.newNodeServer(cs)
+	if csid.cfg.publishAuthorizationURL != "" {
+		// The CSIDriver object requests tokens with the
+		// driver name as audience.
+		if ns.authorizer, err = newPublishAuthorizer(csid.cfg.publishAuthorizationURL, csid.cfg.publishAuthorizationCAFile, csid.cfg.DriverName); err != nil {
+			return nil, err
+		}
+	}
+	cleanup = append(cleanup, csid.setupDAXEvents(ctx, ns))
+	cleanup = append(cleanup, csid.setupVolumeEvents(ctx, cs))
+	ns.cleanupEphemeralVolumes(ctx)
+	closeAudit, err := csid.startAccessAudit(ctx, ns)
+	if err != nil {
+		return nil, err
+	}
+	cleanup = append(cleanup, closeAudit)
+	ns.restoreStagedVolumes(ctx)
+	if csid.cfg.orphanCleanupInterval > 0 {
+		ns.runOrphanCleanup(ctx, csid.cfg.orphanCleanupInterval, csid.cfg.orphanCleanupDryRun)
+	}
+
+	services := []grpcserver.Service{ids, ns, cs, csid.health}
+	if err := s.Start(ctx, csid.cfg.Endpoint, csid.cfg.NodeID, nil, cmm, grpcserver.Interceptors{}, csid.csiEndpointServices(services)...); err != nil {
+		return nil, err
+	}
+	if err := csid.startTCPEndpoint(ctx, s, cmm, services...); err != nil {
+		return nil, err
+	}
+
+	// Also collect metrics data via the device manager.
+	pmdmanager.CapacityCollector{PmemDeviceCapacity: dm}.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+	pmdmanager.MustRegisterLatencyMetrics(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+	if fragmentation, ok := pmdmanager.As[pmdmanager.Fragmentation](dm); ok {
+		pmdmanager.FragmentationCollector{Fragmentation: fragmentation}.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+	}
+	if checker, ok := pmdmanager.As[pmdmanager.HealthChecker](dm); ok {
+		csid.health.check = checker.CheckHealth
+	}
+	if err := csid.startHealthLabel(ctx); err != nil {
+		return nil, err
+	}
+	volumeCollector{cs: cs}.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+	MustRegisterStateMetrics(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+	MustRegisterOrphanMetrics(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+	csid.backpressure.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+	csid.mustRegisterGRPCMetrics()
+	csid.methodLimiter.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+	csid.setupBandwidthMetrics(ctx)
+
+	stopMonitor, err := csid.startThinPoolMonitor(ctx, dm)
+	if err != nil {
+		return nil, err
+	}
+	cleanup = append(cleanup, stopMonitor)
+
+	capacity, err := dm.GetCapacity(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get initial capacity: %v", err)
+	}
+	logger.Info("PMEM-CSI ready.", "capacity", capacity)
+	return stop, nil
+}
+
+// startInspect is the same as startNode, minus everything that
+// modifies PMEM, the state or mounts.
+func (csid *csiDriver) startInspect(ctx context.Context, s *grpcserver.NonBlockingGRPCServer) error {
+	logger := klog.FromContext(ctx)
+	dm, err := pmdmanager.New(ctx, csid.cfg.DeviceManager, csid.cfg.PmemPercentage, csid.deviceManagerOptions())
+	if err != nil {
+		return err
+	}
+	sm, err := pmemstate.OpenReadOnly(csid.cfg.StateBasePath)
+	if err != nil {
+		return err
+	}
+	snapshotState, err := pmemstate.OpenReadOnly(filepath.Join(csid.cfg.StateBasePath, snapshotDirectory))
+	if err != nil {
+		return err
+	}
+
+	cmm := csid.newCSIMetricsManager()
+	ids := NewIdentityServer(csid.cfg.DriverName, csid.cfg.Version)
+	cs := NewNodeControllerServer(ctx, csid.cfg.NodeID, dm, sm, snapshotState, "", csid.deviceManagerOptions())
+	ns := csid.newNodeServer(cs)
+
+	services := []grpcserver.Service{ids, ns, cs, csid.health}
+	if err := s.Start(ctx, csid.cfg.Endpoint, csid.cfg.NodeID, nil, cmm, grpcserver.Interceptors{}, csid.csiEndpointServices(services)...); err != nil {
+		return err
+	}
+	if err := csid.startTCPEndpoint(ctx, s, cmm, services...); err != nil {
+		return err
+	}
+	pmdmanager.CapacityCollector{PmemDeviceCapacity: dm}.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+	pmdmanager.MustRegisterLatencyMetrics(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+	if fragmentation, ok := pmdmanager.As[pmdmanager.Fragmentation](dm); ok {
+		pmdmanager.FragmentationCollector{Fragmentation: fragmentation}.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+	}
+	if checker, ok := pmdmanager.As[pmdmanager.HealthChecker](dm); ok {
+		csid.health.check = checker.CheckHealth
+	}
+	csid.mustRegisterGRPCMetrics()
+
+	capacity, err := dm.GetCapacity(ctx)
+	if err != nil {
+		return fmt.Errorf("get initial capacity: %v", err)
+	}
+	logger.Info("PMEM-CSI ready for read-only inspection.", "capacity", capacity)
+	return nil
+}
+
+// csiEndpointServices adds the reflection service to the services if
+// enabled with -grpcReflection. Only the CSI endpoint gets it, because
+// it is meant for troubleshooting inside the pod.
+func (csid *csiDriver) csiEndpointServices(services []grpcserver.Service) []grpcserver.Service {
+	if !csid.cfg.grpcReflection {
+		return services
+	}
+	return append(append([]grpcserver.Service{}, services...), grpcserver.ReflectionService{})
+}
+
+// mustRegisterGRPCMetrics adds the metrics of the CSI gRPC server to
+// the default registry, using labels to tag each sample with node and
+// driver name.
+func (csid *csiDriver) mustRegisterGRPCMetrics() {
+	pmemcommon.MustRegisterGRPCMetrics(prometheus.WrapRegistererWith(prometheus.Labels{
+		pmdmanager.NodeLabel: csid.cfg.NodeID,
+		"driver_name":        csid.cfg.DriverName,
+	}, prometheus.DefaultRegisterer))
+}
+
+// grpcServerConfig converts the -grpc* values.
+func (csid *csiDriver) grpcServerConfig() (grpcserver.Config, error) {
+	config := grpcserver.Config{
+		MaxConcurrentStreams:         uint32(csid.cfg.grpcMaxConcurrentStreams),
+		CallTimeout:                  csid.cfg.grpcCallTimeout,
+		KeepaliveMinTime:             csid.cfg.grpcKeepaliveMinTime,
+		KeepalivePermitWithoutStream: csid.cfg.grpcKeepalivePermitWithoutStream,
+		KeepaliveTime:                csid.cfg.grpcKeepaliveTime,
+		KeepaliveTimeout:             csid.cfg.grpcKeepaliveTimeout,
+	}
+	if csid.cfg.grpcMaxConcurrentStreams > math.MaxUint32 {
+		return config, fmt.Errorf("gRPC max concurrent streams %d too large", csid.cfg.grpcMaxConcurrentStreams)
+	}
+	if csid.cfg.grpcCallTimeout < 0 {
+		return config, fmt.Errorf("negative gRPC call timeout %s", csid.cfg.grpcCallTimeout)
+	}
+	if csid.cfg.grpcKeepaliveMinTime < 0 || csid.cfg.grpcKeepaliveTime < 0 || csid.cfg.grpcKeepaliveTimeout < 0 {
+		return config, errors.New("negative gRPC keepalive interval")
+	}
+	size := csid.cfg.grpcMaxMessageSize.Value()
+	if size < 0 || size > math.MaxInt32 {
+		return config, fmt.Errorf("gRPC max message size %s must be between zero and 2Gi", csid.cfg.grpcMaxMessageSize.String())
+	}
+	config.MaxRecvMsgSize = int(size)
+	config.MaxSendMsgSize = int(size)
+	return config, nil
+}
+
+// parseSocketPermissions converts the -endpointMode, -endpointOwner
+// and -endpointGroup values.
+func parseSocketPermissions(mode, owner, group string) (grpcserver.SocketPermissions, error) {
+	permissions := grpcserver.DefaultSocketPermissions
+	if mode != "" {
+		value, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || value == 0 || value > 0777 {
+			return permissions, fmt.Errorf("socket mode must be octal permissions like 0660, got %q", mode)
+		}
+		permissions.Mode = os.FileMode(value)
+	}
+	if owner != "" {
+		uid, err := strconv.Atoi(owner)
+		if err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return permissions, fmt.Errorf("socket owner: %v", err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		permissions.UID = uid
+	}
+	if group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return permissions, fmt.Errorf("socket group: %v", err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		permissions.GID = gid
+	}
+	return permissions, nil
+}
+
+// startTCPEndpoint serves the services also on the TCP endpoint, if
+// one is configured. Plain TCP is not supported because the CSI
+// calls are not authenticated otherwise.
+func (csid *csiDriver) startTCPEndpoint(ctx context.Context, s *grpcserver.NonBlockingGRPCServer, cmm metrics.CSIMetricsManager, services ...grpcserver.Service) error {
+	if csid.cfg.tcpEndpoint == "" {
+		return nil
+	}
+	if !strings.HasPrefix(csid.cfg.tcpEndpoint, "tcp://") {
+		return fmt.Errorf("TCP endpoint must be given as tcp://<address>, got %q", csid.cfg.tcpEndpoint)
+	}
+	if csid.cfg.endpointCertFile == "" || csid.cfg.endpointKeyFile == "" || csid.cfg.endpointClientCAFile == "" {
+		return errors.New("-tcpEndpoint needs -endpointCertFile, -endpointKeyFile and -endpointClientCAFile")
+	}
+	config, err := loadServerTLSConfig(ctx, csid.cfg.endpointCertFile, csid.cfg.endpointKeyFile, csid.cfg.endpointClientCAFile, csid.cfg.endpointClientName)
+	if err != nil {
+		return fmt.Errorf("TCP endpoint TLS: %v", err)
+	}
+	return s.Start(ctx, csid.cfg.tcpEndpoint, csid.cfg.NodeID, config, cmm, grpcserver.Interceptors{}, services...)
+}
+
+// newCSIMetricsManager creates the metrics for CSI calls and adds
+// them to the metrics of the driver.
+func (csid *csiDriver) newCSIMetricsManager() metrics.CSIMetricsManager {
+	cmm := metrics.NewCSIMetricsManagerWithOptions(csid.cfg.DriverName,
+		metrics.WithProcessStartTime(false),
+		metrics.WithSubsystem(metrics.SubsystemPlugin),
+	)
+	csid.gatherers = append(csid.gatherers, cmm.GetRegistry())
+	return cmm
+}
+
+// newNodeServer creates the node server with the settings that are
+// shared by node and inspect mode.
+func (csid *csiDriver) newNodeServer(cs *nodeControllerServer) *nodeServer {
+	ns := NewNodeServer(cs, filepath.Clean(csid.cfg.StateBasePath)+"/mount")
+	ns.maxVolumesPerNode = csid.cfg.maxVolumesPerNode
+	ns.numaTopology = csid.cfg.numaTopology
+	ns.allowedMountFlags = parseAllowedMountFlags(csid.cfg.allowedMountFlags)
+	return ns
+}
+
+// startTrash processes deleted volumes. Volumes which are in the
+// trash already get processed even when the trash is disabled now.
+func (csid *csiDriver) startTrash(ctx context.Context, cs *nodeControllerServer) error {
+	trash, err := pmemstate.NewDBState(filepath.Join(csid.cfg.StateBasePath, trashDirectory))
+	if err != nil {
+		return err
+	}
+	cs.trash = pmemstate.NewInstrumented(trash, "trash")
+	cs.retention = csid.cfg.trashRetention
+	cs.maxTrashedPerVolume = csid.cfg.trashMaxPerVolume
+	cs.runTrash(ctx)
+	return nil
+}
+
+// startScrubber erases deleted volumes in the background if enabled.
+// Pending erasures then count against the deletion queue.
+func (csid *csiDriver) startScrubber(ctx context.Context, cs *nodeControllerServer) error {
+	scrub, err := pmemstate.NewDBState(filepath.Join(csid.cfg.StateBasePath, scrubDirectory))
+	if err != nil {
+		return err
+	}
+	cs.scrubber = newScrubber(pmemstate.NewInstrumented(scrub, "scrub"), csid.cfg.scrubRate.Value())
+	cs.runScrubber(ctx)
+	if cs.scrubber.enabled() {
+		csid.backpressure.deletionQueue = cs.scrubber.pending
+	}
+	return nil
+}
+
+// setupPopulator configures how volumes get filled from images.
+func (csid *csiDriver) setupPopulator(cs *nodeControllerServer) {
+	cs.populator = &volumePopulator{
+		workDir:           filepath.Join(csid.cfg.StateBasePath, "populate"),
+		containerdAddress: csid.cfg.containerdAddress,
+	}
+}
+
+// setupKeyProvider configures where the passphrases of encrypted
+// volumes come from.
+func (csid *csiDriver) setupKeyProvider(cs *nodeControllerServer) error {
+	if csid.cfg.keyProvider != KeyProviderVault {
+		return nil
+	}
+	keys, err := newVaultKeys(csid.cfg.vaultAddress, csid.cfg.vaultTokenFile, csid.cfg.vaultKVMount, csid.cfg.vaultKVPrefix, csid.cfg.vaultCAFile, csid.cfg.keyCacheTTL)
+	if err != nil {
+		return err
+	}
+	cs.keys = keys
+	return nil
+}
+
+// startFeatureLabels probes the features of the node and, if enabled,
+// publishes them as node labels.
+func (csid *csiDriver) startFeatureLabels(ctx context.Context, cs *nodeControllerServer) error {
+	csid.features = newFeatureProber(cs)
+	if !csid.cfg.featureLabels {
+		return nil
+	}
+	client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+	if err != nil {
+		return fmt.Errorf("connect to apiserver: %v", err)
+	}
+	fl := &featureLabels{
+		client:     client,
+		fp:         csid.features,
+		driverName: csid.cfg.DriverName,
+		nodeName:   csid.cfg.NodeID,
+	}
+	fl.run(ctx)
+	return nil
+}
+
+// startHealthLabel publishes the result of the health check as node
+// label, if enabled.
+func (csid *csiDriver) startHealthLabel(ctx context.Context) error {
+	if !csid.cfg.healthLabel {
+		return nil
+	}
+	if csid.health.check == nil {
+		klog.FromContext(ctx).Info("Device manager has no health check, not setting the health label")
+		return nil
+	}
+	client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+	if err != nil {
+		return fmt.Errorf("connect to apiserver: %v", err)
+	}
+	hl := &healthLabeler{
+		client:     client,
+		check:      csid.health.check,
+		driverName: csid.cfg.DriverName,
+		nodeName:   csid.cfg.NodeID,
+	}
+	hl.run(ctx)
+	return nil
+}
+
+// setupDAXEvents configures the DAX check of the node server. The
+// returned function stops sending events.
+func (csid *csiDriver) setupDAXEvents(ctx context.Context, ns *nodeServer) func() {
+	ns.daxCheck = csid.cfg.daxCheck
+	if ns.daxCheck != DAXCheckWarn {
+		return func() {}
+	}
+	// Events are optional, the warning also gets logged.
+	client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+	if err != nil {
+		klog.FromContext(ctx).Info("No events for volumes without DAX", "reason", err.Error())
+		return func() {}
+	}
+	broadcaster, recorder := newEventRecorder(client, csid.cfg.DriverName, csid.cfg.NodeID)
+	ns.recorder = recorder
+	return broadcaster.Shutdown
+}
+
+// setupVolumeEvents connects the interceptor for failed volume
+// operations to the apiserver, if enabled. The returned function stops
+// sending events.
+func (csid *csiDriver) setupVolumeEvents(ctx context.Context, cs *nodeControllerServer) func() {
+	if csid.volumeEvents == nil {
+		return func() {}
+	}
+	csid.volumeEvents.cs = cs
+	// Events are optional, the errors also get logged.
+	client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+	if err != nil {
+		klog.FromContext(ctx).Info("No events for failed volume operations", "reason", err.Error())
+		return func() {}
+	}
+	broadcaster, recorder := newEventRecorder(client, csid.cfg.DriverName, csid.cfg.NodeID)
+	csid.volumeEvents.recorder = recorder
+	return broadcaster.Shutdown
+}
+
+// startAccessAudit resumes auditing of published volumes if enabled.
+// The returned function closes the audit log.
+func (csid *csiDriver) startAccessAudit(ctx context.Context, ns *nodeServer) (func(), error) {
+	if csid.cfg.accessAuditLog == "" {
+		return func() {}, nil
+	}
+	sink, err := openAuditLog(csid.cfg.accessAuditLog)
+	if err != nil {
+		return nil, err
+	}
+	ns.auditor = newAccessAuditor(sink)
+	if err := ns.restartAccessAudit(ctx); err != nil {
+		sink.Close()
+		return nil, err
+	}
+	return func() { sink.Close() }, nil
+}
+
+// setupBandwidthMetrics registers the optional PMEM bandwidth
+// metrics. The driver works without them.
+func (csid *csiDriver) setupBandwidthMetrics(ctx context.Context) {
+	if !csid.cfg.bandwidthMetrics {
+		return
+	}
+	bc, err := pmdmanager.NewBandwidthCollector(ctx)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "PMEM bandwidth metrics not available")
+		return
+	}
+	bc.MustRegister(prometheus.DefaultRegisterer, csid.cfg.NodeID, csid.cfg.DriverName)
+}
+
+// startThinPoolMonitor emits events when LVM thin pools run full, if
+// the device manager has them and overcommitting is enabled. The
+// returned function stops sending events.
+func (csid *csiDriver) startThinPoolMonitor(ctx context.Context, dm pmdmanager.PmemDeviceManager) (func(), error) {
+	pools, ok := pmdmanager.As[pmdmanager.ThinPools](dm)
+	if !ok || csid.cfg.lvmThinOvercommit == 0 || csid.cfg.lvmThinThreshold == 0 {
+		return func() {}, nil
+	}
+	client, err := k8sutil.NewClient(config.KubeAPIQPS, config.KubeAPIBurst)
+	if err != nil {
+		return nil, fmt.Errorf("connect to apiserver: %v", err)
+	}
+	broadcaster, recorder := newEventRecorder(client, csid.cfg.DriverName, csid.cfg.NodeID)
+	newThinPoolMonitor(pools, csid.cfg.lvmThinThreshold, recorder, csid.cfg.NodeID).run(ctx)
+	return broadcaster.Shutdown, nil
+}
+
+// simulation returns the simulation settings for the current node.
+func (csid *csiDriver) simulation() pmdmanager.Simulation {
+	if csid.cfg.simulateNodes != "" {
+		selected := false
+		for _, node := range strings.Split(csid.cfg.simulateNodes, ",") {
+			if strings.TrimSpace(node) == csid.cfg.NodeID {
+				selected = true
+				break
+			}
+		}
+		if !selected {
+			return pmdmanager.Simulation{}
+		}
+	}
+	return pmdmanager.Simulation{
+		MaxCapacity:             uint64(csid.cfg.simulateMaxCapacity.Value()),
+		CreateFailurePercentage: csid.cfg.simulateCreateFailures,
+	}
+}
+
+// deviceManagerOptions returns the options for all device managers of
+// the driver instance.
+func (csid *csiDriver) deviceManagerOptions() pmdmanager.Options {
+	return pmdmanager.Options{
+		// Inspect mode must not change anything.
+		ReadOnly:         csid.cfg.Mode == Inspect,
+		ThinProvisioning: pmdmanager.ThinProvisioning{Overcommit: csid.cfg.lvmThinOvercommit},
+		Regions:          csid.regionSelection(),
+	}
+}
+
+// regionSelection returns the regions which may be used by device
+// managers.
+func (csid *csiDriver) regionSelection() pmdmanager.RegionSelection {
+	var rs pmdmanager.RegionSelection
+	for _, region := range strings.Split(csid.cfg.regions, ",") {
+		if region := strings.TrimSpace(region); region != "" {
+			rs.Allow = append(rs.Allow, region)
+		}
+	}
+	for _, region := range strings.Split(csid.cfg.excludeRegions, ",") {
+		if region := strings.TrimSpace(region); region != "" {
+			rs.Deny = append(rs.Deny, region)
+		}
+	}
+	return rs
+}
+
+// rescheduleDriverNames returns the driver name followed by the
+// additional names configured for the rescheduler, without duplicates.
+func (csid *csiDriver) rescheduleDriverNames() []string {
+	driverNames := []string{csid.cfg.DriverName}
+	if csid.cfg.rescheduleDriverNames == "" {
+		return driverNames
+	}
+	seen := map[string]bool{csid.cfg.DriverName: true}
+	for _, driverName := range strings.Split(csid.cfg.rescheduleDriverNames, ",") {
+		driverName = strings.TrimSpace(driverName)
+		if driverName == "" || seen[driverName] {
+			continue
+		}
+		seen[driverName] = true
+		driverNames = append(driverNames, driverName)
+	}
+	return driverNames
+}
+
 // startMetrics starts the HTTPS server for the Prometheus endpoint, if one is configured.
 // Error handling is the same as for startScheduler.
 func (csid *csiDriver) startMetrics(ctx context.Context, cancel func()) (string, error) {
@@ -332,17 +1331,110 @@ func (csid *csiDriver) startMetrics(ctx context.Context, cancel func()) (string,
 		),
 	)
 	mux.Handle(csid.cfg.metricsPath+"/simple", promhttp.HandlerFor(simpleMetrics, promhttp.HandlerOpts{}))
-	return csid.startHTTPSServer(ctx, cancel, csid.cfg.metricsListen, mux)
+	mux.HandleFunc("/healthz", csid.health.healthz)
+	mux.HandleFunc("/readyz", csid.health.readyz)
+	if csid.cfg.metricsTenantTokens != "" {
+		tokens, err := loadTenantTokens(csid.cfg.metricsTenantTokens)
+		if err != nil {
+			return "", err
+		}
+		mux.Handle(csid.cfg.metricsPath+tenantMetricsSuffix, tenantMetricsHandler(csid.gatherers, tokens))
+	}
+	if csid.cfg.logVerbosityToken != "" {
+		token, err := loadVerbosityToken(csid.cfg.logVerbosityToken)
+		if err != nil {
+			return "", err
+		}
+		mux.Handle(verbosityPath, verbosityHandler(token))
+	}
+	if csid.operations != nil {
+		mux.Handle(csid.cfg.metricsPath+operationLogSuffix, csid.operations)
+	}
+	if csid.features != nil {
+		mux.Handle(csid.cfg.metricsPath+featuresSuffix, csid.features)
+	}
+	if csid.controllerStatus != nil {
+		mux.Handle(csid.cfg.metricsPath+controllerStatusSuffix, csid.controllerStatus)
+	}
+	config, err := loadServerTLSConfig(ctx, csid.cfg.metricsCertFile, csid.cfg.metricsKeyFile, csid.cfg.metricsClientCAFile, "")
+	if err != nil {
+		return "", fmt.Errorf("metrics TLS: %v", err)
+	}
+	return csid.startHTTPSServer(ctx, cancel, csid.cfg.metricsListen, config, mux)
+}
+
+// startPprof starts the HTTP server for the net/http/pprof handlers.
+// They reveal internals of the process and can slow it down, therefore
+// the server only listens on localhost unless the address includes a
+// host. Error handling is the same as for startMetrics.
+func (csid *csiDriver) startPprof(ctx context.Context, cancel func()) (string, error) {
+	listen := csid.cfg.pprofListen
+	if strings.HasPrefix(listen, ":") {
+		listen = "localhost" + listen
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	return csid.startHTTPSServer(ctx, cancel, listen, nil, mux)
+}
+
+// startScheduler starts the HTTP server for the scheduler extender
+// and the pod mutation webhook.
+// Error handling is the same as for startMetrics.
+func (csid *csiDriver) startScheduler(ctx context.Context, cancel func(), se *schedulerExtender) (string, error) {
+	mux := http.NewServeMux()
+	mux.Handle("/filter", instrumentScheduler("filter", http.HandlerFunc(se.filter)))
+	mux.Handle("/prioritize", instrumentScheduler("prioritize", http.HandlerFunc(se.prioritize)))
+	if se.resourceName != "" {
+		mux.Handle("/pod/mutate", instrumentScheduler("mutate", http.HandlerFunc(se.mutatePod)))
+	}
+	MustRegisterSchedulerMetrics(prometheus.DefaultRegisterer, csid.cfg.DriverName)
+	config, err := loadServerTLSConfig(ctx, csid.cfg.schedulerCertFile, csid.cfg.schedulerKeyFile, csid.cfg.schedulerClientCAFile, "")
+	if err != nil {
+		return "", fmt.Errorf("scheduler TLS: %v", err)
+	}
+	return csid.startHTTPSServer(ctx, cancel, csid.cfg.schedulerListen, config, mux)
+}
+
+// loadServerTLSConfig returns the TLS configuration for an HTTPS or
+// gRPC server, nil without certificate. With a CA file, clients must
+// present a certificate signed by it and, if a client name is given,
+// issued for that name.
+func loadServerTLSConfig(ctx context.Context, certFile, keyFile, clientCAFile, clientName string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		if clientCAFile != "" {
+			return nil, errors.New("client CA file needs a certificate and key file")
+		}
+		return nil, nil
+	}
+	config, err := pmemgrpc.LoadServerTLS(ctx, clientCAFile, certFile, keyFile, clientName)
+	if err != nil {
+		return nil, err
+	}
+	if clientCAFile != "" {
+		getConfig := config.GetConfigForClient
+		config.GetConfigForClient = func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			config, err := getConfig(info)
+			if err != nil {
+				return nil, err
+			}
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+			return config, nil
+		}
+	}
+	return config, nil
 }
 
 // startHTTPSServer contains the common logic for starting and
 // stopping an HTTPS server.  Returns an error or the address that can
 // be used in Dial("tcp") to reach the server (useful for testing when
 // "listen" does not include a port).
-func (csid *csiDriver) startHTTPSServer(ctx context.Context, cancel func(), listen string, handler http.Handler) (string, error) {
+func (csid *csiDriver) startHTTPSServer(ctx context.Context, cancel func(), listen string, config *tls.Config, handler http.Handler) (string, error) {
 	name := "HTTP server"
 	logger := klog.FromContext(ctx).WithName(name).WithValues("listen", listen)
-	var config *tls.Config
 	server := http.Server{
 		Addr: listen,
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -351,13 +1443,21 @@ func (csid *csiDriver) startHTTPSServer(ctx context.Context, cancel func(), list
 		}),
 		TLSConfig: config,
 	}
-	listener, err := net.Listen("tcp", listen)
+	var listener net.Listener
+	var err error
+	if pmemcommon.IsSystemdAddress(listen) {
+		listener, err = pmemcommon.SystemdListener(listen)
+	} else {
+		listener, err = net.Listen("tcp", listen)
+	}
 	if err != nil {
 		return "", fmt.Errorf("listen on TCP address %q: %v", listen, err)
 	}
-	tcpListener := listener.(*net.TCPListener)
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
 	go func() {
-		defer tcpListener.Close()
+		defer listener.Close()
 
 		if err := server.Serve(listener); err != http.ErrServerClosed {
 			logger.Error(err, "Failed")
@@ -372,6 +1472,6 @@ func (csid *csiDriver) startHTTPSServer(ctx context.Context, cancel func(), list
 		server.Close()
 	}()
 
-	logger.V(3).Info("Started", "addr", tcpListener.Addr())
-	return tcpListener.Addr().String(), nil
+	logger.V(3).Info("Started", "addr", listener.Addr())
+	return listener.Addr().String(), nil
 }
@@ -9,13 +9,38 @@ package pmemcsidriver
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/big"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/klog/v2/ktesting"
+
+	grpcserver "github.com/intel/pmem-csi/pkg/grpc-server"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemgrpc "github.com/intel/pmem-csi/pkg/pmem-grpc"
 )
 
 func TestMetrics(t *testing.T) {
@@ -70,6 +95,302 @@ build_info{version="foo-bar-test"} 1
 	}
 }
 
+func TestHealth(t *testing.T) {
+	pmemd, err := GetCSIDriver(Config{
+		Mode:          Controller,
+		DriverName:    "pmem-csi",
+		NodeID:        "testnode",
+		Endpoint:      "unused",
+		Version:       "foo-bar-test",
+		metricsPath:   "/metrics",
+		metricsListen: "127.0.0.1:",
+	})
+	require.NoError(t, err, "get PMEM-CSI driver")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, err := pmemd.startMetrics(ctx, cancel)
+	require.NoError(t, err, "start server")
+	get := func(path string) (*http.Response, error) {
+		return http.Get(fmt.Sprintf("http://%s%s", addr, path))
+	}
+
+	resp, err := get("/readyz")
+	checkResponse(t, &http.Response{StatusCode: 503}, resp, err, "not ready")
+	pmemd.health.setReady(true)
+	resp, err = get("/readyz")
+	checkResponse(t, &http.Response{StatusCode: 200}, resp, err, "ready")
+
+	resp, err = get("/healthz")
+	checkResponse(t, &http.Response{StatusCode: 200}, resp, err, "nothing to check")
+	pmemd.health.check = func(ctx context.Context) error {
+		return errors.New("vgs failure")
+	}
+	resp, err = get("/healthz")
+	checkResponse(t, &http.Response{StatusCode: 500, Body: ioutil.NopCloser(bytes.NewBufferString("vgs failure"))}, resp, err, "unhealthy")
+}
+
+func TestGRPCHealth(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	oldInterval := healthWatchInterval
+	healthWatchInterval = 10 * time.Millisecond
+	defer func() {
+		healthWatchInterval = oldInterval
+	}()
+	endpoint := "unix://" + filepath.Join(t.TempDir(), "csi.sock")
+	var healthErr atomic.Value
+	healthErr.Store("")
+	hc := &healthChecker{
+		check: func(ctx context.Context) error {
+			if msg := healthErr.Load().(string); msg != "" {
+				return errors.New(msg)
+			}
+			return nil
+		},
+	}
+	s := grpcserver.NewNonBlockingGRPCServer(grpcserver.Config{})
+	require.NoError(t, s.Start(ctx, endpoint, "", nil, nil, grpcserver.Interceptors{}, hc), "start server")
+	defer func() {
+		s.ForceStop()
+		s.Wait()
+	}()
+	conn, err := pmemgrpc.Connect(endpoint, nil)
+	require.NoError(t, err, "connect")
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	client := grpc_health_v1.NewHealthClient(conn)
+	check := func(service string) (grpc_health_v1.HealthCheckResponse_ServingStatus, error) {
+		resp, err := client.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: service}, grpc.WaitForReady(true))
+		return resp.GetStatus(), err
+	}
+
+	watch, err := client.Watch(ctx, &grpc_health_v1.HealthCheckRequest{Service: "csi.v1.Node"})
+	require.NoError(t, err, "watch")
+	recv := func() grpc_health_v1.HealthCheckResponse_ServingStatus {
+		resp, err := watch.Recv()
+		require.NoError(t, err, "receive status")
+		return resp.GetStatus()
+	}
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, recv(), "watch before ready")
+
+	st, err := check("")
+	require.NoError(t, err, "check")
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, st, "not ready")
+	hc.setReady(true)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, recv(), "watch when ready")
+	st, err = check("csi.v1.Node")
+	require.NoError(t, err, "check")
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, st, "ready")
+	_, err = check("no-such-service")
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown service: %v", err)
+
+	healthErr.Store("vgs failure")
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, recv(), "watch when unhealthy")
+	healthErr.Store("")
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, recv(), "watch when healthy again")
+
+	hc.setReady(false)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_NOT_SERVING, recv(), "watch when shutting down")
+	_, err = watch.Recv()
+	assert.Equal(t, codes.Unavailable, status.Code(err), "watch ends: %v", err)
+}
+
+func TestPprof(t *testing.T) {
+	pmemd, err := GetCSIDriver(Config{
+		Mode:        Controller,
+		DriverName:  "pmem-csi",
+		NodeID:      "testnode",
+		Endpoint:    "unused",
+		Version:     "foo-bar-test",
+		pprofListen: ":0",
+	})
+	require.NoError(t, err, "get PMEM-CSI driver")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, err := pmemd.startPprof(ctx, cancel)
+	require.NoError(t, err, "start server")
+	host, _, err := net.SplitHostPort(addr)
+	require.NoError(t, err, "split address")
+	assert.True(t, net.ParseIP(host).IsLoopback(), "localhost by default, got %s", addr)
+
+	resp, err := http.Get(fmt.Sprintf("http://%s/debug/pprof/goroutine?debug=1", addr))
+	checkResponse(t, &http.Response{StatusCode: 200}, resp, err, "goroutine profile")
+}
+
+func TestMetricsTLS(t *testing.T) {
+	certs := newTestCertificates(t)
+	path := "/metrics"
+	pmemd, err := GetCSIDriver(Config{
+		Mode:                Controller,
+		DriverName:          "pmem-csi",
+		NodeID:              "testnode",
+		Endpoint:            "unused",
+		Version:             "foo-bar-test",
+		metricsPath:         path,
+		metricsListen:       "127.0.0.1:",
+		metricsCertFile:     certs.serverCert,
+		metricsKeyFile:      certs.serverKey,
+		metricsClientCAFile: certs.ca,
+	})
+	require.NoError(t, err, "get PMEM-CSI driver")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	addr, err := pmemd.startMetrics(ctx, cancel)
+	require.NoError(t, err, "start server")
+	url := fmt.Sprintf("https://%s%s", addr, path)
+
+	get := func(config *tls.Config) (*http.Response, error) {
+		tr := &http.Transport{TLSClientConfig: config}
+		defer tr.CloseIdleConnections()
+		return (&http.Client{Transport: tr}).Get(url)
+	}
+	resp, err := get(certs.clientConfig(t, true))
+	checkResponse(t, &http.Response{StatusCode: 200}, resp, err, "with client certificate")
+	_, err = get(certs.clientConfig(t, false))
+	assert.Error(t, err, "without client certificate")
+	resp, err = http.Get(fmt.Sprintf("http://%s%s", addr, path))
+	checkResponse(t, &http.Response{StatusCode: 400}, resp, err, "plain HTTP")
+
+	_, err = loadServerTLSConfig(ctx, "", "", certs.ca, "")
+	assert.Error(t, err, "CA without certificate")
+	config, err := loadServerTLSConfig(ctx, "", "", "", "")
+	require.NoError(t, err, "no TLS")
+	assert.Nil(t, config, "no TLS")
+}
+
+func TestTCPEndpoint(t *testing.T) {
+	certs := newTestCertificates(t)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err, "find free port")
+	addr := listener.Addr().String()
+	listener.Close()
+
+	start := func(t *testing.T, clientName string) *grpcserver.NonBlockingGRPCServer {
+		pmemd, err := GetCSIDriver(Config{
+			Mode:                 Node,
+			DriverName:           "pmem-csi",
+			NodeID:               "testnode",
+			Endpoint:             "unused",
+			Version:              "v0.0.0",
+			tcpEndpoint:          "tcp://" + addr,
+			endpointCertFile:     certs.serverCert,
+			endpointKeyFile:      certs.serverKey,
+			endpointClientCAFile: certs.ca,
+			endpointClientName:   clientName,
+		})
+		require.NoError(t, err, "get PMEM-CSI driver")
+		_, ctx := ktesting.NewTestContext(t)
+		s := grpcserver.NewNonBlockingGRPCServer(grpcserver.Config{})
+		ids := NewIdentityServer("pmem-csi", "v0.0.0")
+		require.NoError(t, pmemd.startTCPEndpoint(ctx, s, pmemd.newCSIMetricsManager(), ids), "start endpoint")
+		t.Cleanup(func() {
+			s.ForceStop()
+			s.Wait()
+		})
+		return s
+	}
+	call := func(t *testing.T, config *tls.Config) error {
+		conn, err := pmemgrpc.Connect("tcp://"+addr, config)
+		require.NoError(t, err, "connect")
+		defer conn.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_, err = csi.NewIdentityClient(conn).GetPluginInfo(ctx, &csi.GetPluginInfoRequest{})
+		return err
+	}
+
+	t.Run("any-client", func(t *testing.T) {
+		start(t, "")
+		assert.NoError(t, call(t, certs.clientConfig(t, true)), "with client certificate")
+		assert.Error(t, call(t, certs.clientConfig(t, false)), "without client certificate")
+	})
+	t.Run("client-name", func(t *testing.T) {
+		start(t, "other")
+		assert.Error(t, call(t, certs.clientConfig(t, true)), "wrong client name")
+	})
+
+	for name, cfg := range map[string]Config{
+		"no-certificate": {tcpEndpoint: "tcp://" + addr, endpointClientCAFile: certs.ca},
+		"no-client-ca":   {tcpEndpoint: "tcp://" + addr, endpointCertFile: certs.serverCert, endpointKeyFile: certs.serverKey},
+		"no-scheme":      {tcpEndpoint: addr, endpointCertFile: certs.serverCert, endpointKeyFile: certs.serverKey, endpointClientCAFile: certs.ca},
+	} {
+		_, ctx := ktesting.NewTestContext(t)
+		pmemd := &csiDriver{cfg: cfg}
+		assert.Error(t, pmemd.startTCPEndpoint(ctx, grpcserver.NewNonBlockingGRPCServer(grpcserver.Config{}), nil), name)
+	}
+}
+
+// testCertificates contains the files of a CA and of a server and
+// client certificate signed by it. The server certificate is for
+// 127.0.0.1.
+type testCertificates struct {
+	ca, serverCert, serverKey, clientCert, clientKey string
+}
+
+func newTestCertificates(t *testing.T) testCertificates {
+	dir := t.TempDir()
+	write := func(name, blockType string, data []byte) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: data}), 0600), "write %s", name)
+		return path
+	}
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err, "generate CA key")
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	require.NoError(t, err, "create CA")
+	caCert, err := x509.ParseCertificate(caDER)
+	require.NoError(t, err, "parse CA")
+
+	sign := func(name string, serial int64, usage x509.ExtKeyUsage) (string, string) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		require.NoError(t, err, "generate %s key", name)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			Subject:      pkix.Name{CommonName: name},
+			DNSNames:     []string{name},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		}
+		der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, caKey)
+		require.NoError(t, err, "create %s certificate", name)
+		keyDER, err := x509.MarshalECPrivateKey(key)
+		require.NoError(t, err, "marshal %s key", name)
+		return write(name+".pem", "CERTIFICATE", der), write(name+"-key.pem", "EC PRIVATE KEY", keyDER)
+	}
+	certs := testCertificates{ca: write("ca.pem", "CERTIFICATE", caDER)}
+	certs.serverCert, certs.serverKey = sign("server", 2, x509.ExtKeyUsageServerAuth)
+	certs.clientCert, certs.clientKey = sign("client", 3, x509.ExtKeyUsageClientAuth)
+	return certs
+}
+
+// clientConfig trusts the CA and optionally presents the client
+// certificate.
+func (c testCertificates) clientConfig(t *testing.T, withCert bool) *tls.Config {
+	ca, err := os.ReadFile(c.ca)
+	require.NoError(t, err, "read CA")
+	pool := x509.NewCertPool()
+	require.True(t, pool.AppendCertsFromPEM(ca), "add CA")
+	config := &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	if withCert {
+		cert, err := tls.LoadX509KeyPair(c.clientCert, c.clientKey)
+		require.NoError(t, err, "load client certificate")
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config
+}
+
 func checkResponse(t *testing.T, expected, actual *http.Response, err error, what string) {
 	if assert.NoError(t, err, what) {
 		defer actual.Body.Close()
@@ -86,3 +407,68 @@ func checkResponse(t *testing.T, expected, actual *http.Response, err error, wha
 		}
 	}
 }
+
+func TestDeviceManagerOptions(t *testing.T) {
+	csid := &csiDriver{cfg: Config{Mode: Node, lvmThinOvercommit: 200, regions: "region0, region1", excludeRegions: "region1"}}
+	assert.Equal(t, pmdmanager.Options{
+		ThinProvisioning: pmdmanager.ThinProvisioning{Overcommit: 200},
+		Regions: pmdmanager.RegionSelection{
+			Allow: []string{"region0", "region1"},
+			Deny:  []string{"region1"},
+		},
+	}, csid.deviceManagerOptions(), "node")
+
+	csid.cfg.Mode = Inspect
+	assert.True(t, csid.deviceManagerOptions().ReadOnly, "inspect")
+}
+
+func TestParseSocketPermissions(t *testing.T) {
+	permissions, err := parseSocketPermissions("", "", "")
+	require.NoError(t, err, "defaults")
+	assert.Equal(t, grpcserver.DefaultSocketPermissions, permissions, "defaults")
+
+	permissions, err = parseSocketPermissions("0660", "1000", "root")
+	require.NoError(t, err, "parse")
+	assert.Equal(t, grpcserver.SocketPermissions{Mode: 0660, UID: 1000, GID: 0}, permissions, "parsed")
+
+	for _, mode := range []string{"rw", "0", "1777", "999"} {
+		_, err := parseSocketPermissions(mode, "", "")
+		assert.Error(t, err, "mode %q", mode)
+	}
+	_, err = parseSocketPermissions("", "no-such-user", "")
+	assert.Error(t, err, "unknown user")
+	_, err = parseSocketPermissions("", "", "no-such-group")
+	assert.Error(t, err, "unknown group")
+}
+
+func TestGRPCServerConfig(t *testing.T) {
+	csid := &csiDriver{cfg: Config{
+		grpcMaxConcurrentStreams: 10,
+		grpcMaxMessageSize:       resource.QuantityValue{Quantity: resource.MustParse("16Mi")},
+		grpcCallTimeout:          time.Minute,
+		grpcKeepaliveMinTime:     5 * time.Second,
+		grpcKeepaliveTime:        time.Minute,
+	}}
+	config, err := csid.grpcServerConfig()
+	require.NoError(t, err, "parse")
+	assert.Equal(t, grpcserver.Config{
+		MaxConcurrentStreams: 10,
+		MaxRecvMsgSize:       16 * 1024 * 1024,
+		MaxSendMsgSize:       16 * 1024 * 1024,
+		CallTimeout:          time.Minute,
+		KeepaliveMinTime:     5 * time.Second,
+		KeepaliveTime:        time.Minute,
+	}, config, "parsed")
+
+	for _, size := range []string{"-1", "3Gi"} {
+		csid := &csiDriver{cfg: Config{grpcMaxMessageSize: resource.QuantityValue{Quantity: resource.MustParse(size)}}}
+		_, err := csid.grpcServerConfig()
+		assert.Error(t, err, "message size %s", size)
+	}
+	csid = &csiDriver{cfg: Config{grpcCallTimeout: -time.Second}}
+	_, err = csid.grpcServerConfig()
+	assert.Error(t, err, "negative timeout")
+	csid = &csiDriver{cfg: Config{grpcKeepaliveTime: -time.Second}}
+	_, err = csid.grpcServerConfig()
+	assert.Error(t, err, "negative keepalive")
+}
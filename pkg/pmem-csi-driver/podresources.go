@@ -0,0 +1,201 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+// PMEMResourceName returns the name of the extended resource which
+// represents the PMEM of the driver, in bytes.
+func PMEMResourceName(driverName string) v1.ResourceName {
+	return v1.ResourceName(driverName + "/pmem")
+}
+
+// mutatePod handles AdmissionReview requests for new pods. It adds the
+// sum of the sizes of all PMEM-CSI volumes of a pod as request for the
+// extended resource to the first container, so that the scheduler
+// only picks nodes where those volumes fit in total. Errors do not
+// block the pod, the webhook then just doesn't change it.
+func (se *schedulerExtender) mutatePod(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var review admissionv1.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil || review.Request == nil {
+		http.Error(w, fmt.Sprintf("decode admission review: %v", err), http.StatusBadRequest)
+		return
+	}
+	review.Response = se.admitPod(r.Context(), review.Request)
+	review.Request = nil
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(&review); err != nil {
+		klog.FromContext(r.Context()).Error(err, "Encoding admission review failed")
+	}
+}
+
+func (se *schedulerExtender) admitPod(ctx context.Context, req *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	logger := klog.FromContext(ctx).WithName("pod-mutation")
+	response := &admissionv1.AdmissionResponse{
+		UID:     req.UID,
+		Allowed: true,
+	}
+	var pod v1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		response.Warnings = []string{fmt.Sprintf("PMEM-CSI: decode pod: %v", err)}
+		return response
+	}
+	if pod.Namespace == "" {
+		// Not set yet for pods created by controllers.
+		pod.Namespace = req.Namespace
+	}
+	// Without a name (generateName), the PVCs of generic ephemeral
+	// volumes are not found and their templates get used.
+	logger = logger.WithValues("pod", pmemlog.KObj(&pod))
+	if len(pod.Spec.Containers) == 0 {
+		return response
+	}
+	sizes, err := se.podVolumeSizes(&pod, true)
+	if err != nil {
+		logger.Error(err, "Determining PMEM volumes failed")
+		response.Warnings = []string{fmt.Sprintf("PMEM-CSI: %v", err)}
+		return response
+	}
+	var sum int64
+	for _, size := range sizes {
+		sum += size
+	}
+	if sum == 0 {
+		return response
+	}
+
+	// Extended resources must have the same request and limit.
+	resources := pod.Spec.Containers[0].Resources.DeepCopy()
+	quantity := *resource.NewQuantity(sum, resource.BinarySI)
+	if resources.Requests == nil {
+		resources.Requests = v1.ResourceList{}
+	}
+	if resources.Limits == nil {
+		resources.Limits = v1.ResourceList{}
+	}
+	resources.Requests[se.resourceName] = quantity
+	resources.Limits[se.resourceName] = quantity
+	patch, err := json.Marshal([]map[string]interface{}{{
+		"op":    "add",
+		"path":  "/spec/containers/0/resources",
+		"value": resources,
+	}})
+	if err != nil {
+		response.Warnings = []string{fmt.Sprintf("PMEM-CSI: encode patch: %v", err)}
+		return response
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	response.Patch = patch
+	response.PatchType = &patchType
+	logger.V(3).Info("Added PMEM request", "resource", se.resourceName, "size", quantity.String())
+	return response
+}
+
+// nodeResources publishes the usable PMEM of each node as capacity
+// of the extended resource in the node status. The kubelet then adds
+// it to the allocatable resources. Usable PMEM is what is still
+// available for new volumes plus what existing volumes use, because
+// pods request the size of all of their volumes.
+type nodeResources struct {
+	resourceName v1.ResourceName
+	client       kubernetes.Interface
+	// reporter computes the per-node values, it does not need a
+	// client for the report object.
+	reporter *capacityReporter
+	// published remembers what was set, to avoid needless updates.
+	published map[string]int64
+}
+
+// newNodeResources must be called before starting the factory. It
+// needs CSIStorageCapacity.
+func newNodeResources(driverName string, kubeClient kubernetes.Interface, factory informers.SharedInformerFactory) (*nodeResources, error) {
+	if !hasStorageCapacity(kubeClient) {
+		return nil, errors.New("PMEM extended resource needs CSIStorageCapacity v1")
+	}
+	return &nodeResources{
+		resourceName: PMEMResourceName(driverName),
+		client:       kubeClient,
+		reporter: &capacityReporter{
+			driverName:     driverName,
+			pvLister:       factory.Core().V1().PersistentVolumes().Lister(),
+			pvcLister:      factory.Core().V1().PersistentVolumeClaims().Lister(),
+			capacityLister: factory.Storage().V1().CSIStorageCapacities().Lister(),
+		},
+		published: map[string]int64{},
+	}, nil
+}
+
+// run updates the node status periodically until the context is
+// canceled.
+func (nr *nodeResources) run(ctx context.Context, interval time.Duration) {
+	logger := klog.FromContext(ctx).WithName("node-resources")
+	ctx = klog.NewContext(ctx, logger)
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		if err := nr.update(ctx); err != nil {
+			logger.Error(err, "Updating PMEM resources of nodes failed")
+		}
+	}, interval)
+}
+
+func (nr *nodeResources) update(ctx context.Context) error {
+	status, err := nr.reporter.compute(metav1.Now())
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, node := range status.Nodes {
+		if node.Available == nil {
+			// Not a node with PMEM-CSI.
+			continue
+		}
+		usable := node.Available.Value() + node.Reserved.Value()
+		if published, ok := nr.published[node.Node]; ok && published == usable {
+			continue
+		}
+		patch, err := json.Marshal(map[string]interface{}{
+			"status": map[string]interface{}{
+				"capacity": map[v1.ResourceName]string{
+					nr.resourceName: fmt.Sprintf("%d", usable),
+				},
+			},
+		})
+		if err != nil {
+			return fmt.Errorf("encode patch: %v", err)
+		}
+		if _, err := nr.client.CoreV1().Nodes().Patch(ctx, node.Node, k8stypes.StrategicMergePatchType, patch, metav1.PatchOptions{}, "status"); err != nil {
+			errs = append(errs, fmt.Errorf("patch status of node %s: %v", node.Node, err))
+			continue
+		}
+		nr.published[node.Node] = usable
+		klog.FromContext(ctx).V(3).Info("Published PMEM capacity", "node", node.Node, "capacity", pmemlog.CapacityRef(usable))
+	}
+	return errors.Join(errs...)
+}
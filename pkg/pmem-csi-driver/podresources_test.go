@@ -0,0 +1,181 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestPodResources(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	DriverTopologyKey = driverName + "/node"
+	pmemClass := "pmem-csi-sc"
+	available := resource.MustParse("6Gi")
+	reserved := resource.MustParse("4Gi")
+	objects := []runtime.Object{
+		&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "worker-1"}},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: pmemClass}, Provisioner: driverName},
+		&v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: "data", Namespace: "default"},
+			Spec: v1.PersistentVolumeClaimSpec{
+				StorageClassName: &pmemClass,
+				VolumeName:       "pv-data",
+				Resources: v1.VolumeResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceStorage: reserved},
+				},
+			},
+		},
+		&v1.PersistentVolume{
+			ObjectMeta: metav1.ObjectMeta{Name: "pv-data"},
+			Spec: v1.PersistentVolumeSpec{
+				Capacity: v1.ResourceList{v1.ResourceStorage: reserved},
+				PersistentVolumeSource: v1.PersistentVolumeSource{
+					CSI: &v1.CSIPersistentVolumeSource{Driver: driverName},
+				},
+				NodeAffinity: &v1.VolumeNodeAffinity{
+					Required: &v1.NodeSelector{
+						NodeSelectorTerms: []v1.NodeSelectorTerm{{
+							MatchExpressions: []v1.NodeSelectorRequirement{{
+								Key:      DriverTopologyKey,
+								Operator: v1.NodeSelectorOpIn,
+								Values:   []string{"worker-1"},
+							}},
+						}},
+					},
+				},
+			},
+		},
+		&storagev1.CSIStorageCapacity{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "capacity-worker-1",
+				Namespace: "pmem-csi",
+				Labels:    map[string]string{csiDriverNameLabel: driverName},
+			},
+			NodeTopology:     &metav1.LabelSelector{MatchLabels: map[string]string{DriverTopologyKey: "worker-1"}},
+			StorageClassName: pmemClass,
+			Capacity:         &available,
+		},
+	}
+	client := fake.NewSimpleClientset(objects...)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	resourceName := PMEMResourceName(driverName)
+	se := &schedulerExtender{
+		driverName:   driverName,
+		pvcLister:    factory.Core().V1().PersistentVolumeClaims().Lister(),
+		scLister:     factory.Storage().V1().StorageClasses().Lister(),
+		resourceName: resourceName,
+	}
+	nr := &nodeResources{
+		resourceName: resourceName,
+		client:       client,
+		reporter: &capacityReporter{
+			driverName:     driverName,
+			pvLister:       factory.Core().V1().PersistentVolumes().Lister(),
+			pvcLister:      factory.Core().V1().PersistentVolumeClaims().Lister(),
+			capacityLister: factory.Storage().V1().CSIStorageCapacities().Lister(),
+		},
+		published: map[string]int64{},
+	}
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+
+	// The node gets available plus reserved PMEM.
+	require.NoError(t, nr.update(ctx), "update node resources")
+	node, err := client.CoreV1().Nodes().Get(ctx, "worker-1", metav1.GetOptions{})
+	require.NoError(t, err, "get node")
+	capacity := node.Status.Capacity[resourceName]
+	assert.Equal(t, int64(10<<30), capacity.Value(), "node capacity")
+
+	// The pod requests the bound PVC and the ephemeral volume.
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "app-"},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name: "app",
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("1")},
+				},
+			}},
+			Volumes: []v1.Volume{
+				{Name: "data", VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: "data"}}},
+				{Name: "scratch", VolumeSource: v1.VolumeSource{Ephemeral: &v1.EphemeralVolumeSource{
+					VolumeClaimTemplate: &v1.PersistentVolumeClaimTemplate{Spec: v1.PersistentVolumeClaimSpec{
+						StorageClassName: &pmemClass,
+						Resources: v1.VolumeResourceRequirements{
+							Requests: v1.ResourceList{v1.ResourceStorage: resource.MustParse("1Gi")},
+						},
+					}},
+				}}},
+			},
+		},
+	}
+	raw, err := json.Marshal(pod)
+	require.NoError(t, err, "encode pod")
+	review := admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       k8stypes.UID("1234"),
+			Namespace: "default",
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	}
+	body, err := json.Marshal(review)
+	require.NoError(t, err, "encode review")
+	rec := httptest.NewRecorder()
+	se.mutatePod(rec, httptest.NewRequest(http.MethodPost, "/pod/mutate", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code, "mutate")
+	var result admissionv1.AdmissionReview
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result), "decode review")
+	require.NotNil(t, result.Response, "response")
+	assert.Equal(t, k8stypes.UID("1234"), result.Response.UID, "UID")
+	assert.True(t, result.Response.Allowed, "allowed")
+	require.NotNil(t, result.Response.PatchType, "patch type")
+
+	var patch []struct {
+		Op    string                  `json:"op"`
+		Path  string                  `json:"path"`
+		Value v1.ResourceRequirements `json:"value"`
+	}
+	require.NoError(t, json.Unmarshal(result.Response.Patch, &patch), "decode patch")
+	require.Len(t, patch, 1, "patch")
+	assert.Equal(t, "add", patch[0].Op, "op")
+	assert.Equal(t, "/spec/containers/0/resources", patch[0].Path, "path")
+	resources := patch[0].Value
+	request := resources.Requests[resourceName]
+	limit := resources.Limits[resourceName]
+	assert.Equal(t, int64(5<<30), request.Value(), "request")
+	assert.Equal(t, int64(5<<30), limit.Value(), "limit")
+	assert.Contains(t, resources.Requests, v1.ResourceCPU, "other requests")
+
+	// Pods without PMEM volumes are not modified.
+	response := se.admitPod(ctx, &admissionv1.AdmissionRequest{
+		Object: runtime.RawExtension{Raw: []byte(`{"spec":{"containers":[{"name":"app"}]}}`)},
+	})
+	assert.True(t, response.Allowed, "allowed without volumes")
+	assert.Nil(t, response.Patch, "no patch without volumes")
+}
@@ -0,0 +1,226 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// containerdNamespace is where images for volumes get pulled to.
+// It is the one used by the kubelet, so its image garbage collection
+// also removes them.
+const containerdNamespace = "k8s.io"
+
+// volumePopulator fills new volumes with the content of a tarball or
+// container image.
+type volumePopulator struct {
+	// directory for temporary mount points
+	workDir string
+	// containerd socket, empty if images are not supported
+	containerdAddress string
+}
+
+// isTarball distinguishes tarball URLs from image references.
+func isTarball(from string) bool {
+	for _, prefix := range []string{"http://", "https://", "file://"} {
+		if strings.HasPrefix(from, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPopulate rejects a populateFrom parameter which cannot be
+// handled before any volume gets created.
+func (cs *nodeControllerServer) checkPopulate(p parameters.Volume, req *csi.CreateVolumeRequest) error {
+	from := p.GetPopulateFrom()
+	if from == "" {
+		return nil
+	}
+	if req.GetVolumeContentSource() != nil {
+		return status.Errorf(codes.InvalidArgument, "parameter %q and a volume content source are mutually exclusive", parameters.PopulateFrom)
+	}
+	for _, capability := range req.GetVolumeCapabilities() {
+		if capability.GetBlock() != nil {
+			return status.Errorf(codes.InvalidArgument, "parameter %q is not supported for raw block volumes", parameters.PopulateFrom)
+		}
+	}
+	if cs.populator == nil {
+		return status.Errorf(codes.FailedPrecondition, "parameter %q is not supported by the driver", parameters.PopulateFrom)
+	}
+	if !isTarball(from) && cs.populator.containerdAddress == "" {
+		return status.Errorf(codes.FailedPrecondition, "populating volumes from container images is not enabled in the driver")
+	}
+	return nil
+}
+
+// populateVolume creates the filesystem on a new volume and fills it.
+func (cs *nodeControllerServer) populateVolume(ctx context.Context, volumeID string, p parameters.Volume, capabilities []*csi.VolumeCapability) error {
+	logger := klog.FromContext(ctx).WithValues("populate-from", p.GetPopulateFrom())
+	ctx = klog.NewContext(ctx, logger)
+
+	dm, err := cs.deviceManager(ctx, cs.getVolumeDeviceMode(volumeID))
+	if err != nil {
+		return err
+	}
+	device, err := dm.GetDevice(ctx, volumeID)
+	if err != nil {
+		return fmt.Errorf("get volume device: %v", err)
+	}
+	if strings.HasPrefix(device.Path, pmdmanager.FakeDevicePathPrefix) {
+		return nil
+	}
+	fsType := ""
+	for _, capability := range capabilities {
+		if fsType = capability.GetMount().GetFsType(); fsType != "" {
+			break
+		}
+	}
+	if fsType == "" {
+		fsType = defaultFilesystem
+	}
+	if err := provisionDevice(ctx, device, fsType, mkfsOptions(p, fsType)); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(cs.populator.workDir, 0700); err != nil {
+		return fmt.Errorf("create work directory: %v", err)
+	}
+	mountPoint := filepath.Join(cs.populator.workDir, volumeID)
+	if err := os.Mkdir(mountPoint, 0700); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("create mount point: %v", err)
+	}
+	defer os.Remove(mountPoint)
+	if _, err := pmemexec.RunCommand(ctx, "mount", "-c", device.Path, mountPoint); err != nil {
+		return fmt.Errorf("mount volume: %v", err)
+	}
+	defer func() {
+		if _, err := pmemexec.RunCommand(ctx, "umount", mountPoint); err != nil {
+			logger.Error(err, "Unmounting populated volume failed")
+		}
+	}()
+
+	logger.V(3).Info("Populating volume")
+	if err := cs.populator.populate(ctx, p.GetPopulateFrom(), mountPoint); err != nil {
+		return err
+	}
+	logger.V(3).Info("Populated volume")
+	return nil
+}
+
+// getVolumeDeviceMode returns the device mode that was chosen for
+// the volume when creating it.
+func (cs *nodeControllerServer) getVolumeDeviceMode(volumeID string) (mode api.DeviceMode) {
+	if vol := cs.getVolumeByID(volumeID); vol != nil {
+		p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+		if err == nil {
+			mode = p.GetDeviceMode()
+		}
+	}
+	return
+}
+
+// populate copies the content into the directory.
+func (vp *volumePopulator) populate(ctx context.Context, from, dir string) error {
+	if !isTarball(from) {
+		return vp.populateFromImage(ctx, from, dir)
+	}
+	var in io.ReadCloser
+	if strings.HasPrefix(from, "file://") {
+		file, err := os.Open(strings.TrimPrefix(from, "file://"))
+		if err != nil {
+			return err
+		}
+		in = file
+	} else {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, from, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return fmt.Errorf("download %s: %s", from, resp.Status)
+		}
+		in = resp.Body
+	}
+	defer in.Close()
+	return extractTarball(ctx, in, dir)
+}
+
+// extractTarball unpacks a plain or gzip-compressed tar archive.
+// GNU tar takes care of members which would end up outside of the
+// directory.
+func extractTarball(ctx context.Context, in io.Reader, dir string) error {
+	buffered := bufio.NewReader(in)
+	var archive io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("decompress tarball: %v", err)
+		}
+		defer gz.Close()
+		archive = gz
+	}
+	cmd := exec.CommandContext(ctx, "tar", "--extract", "--numeric-owner", "--file=-", "--directory="+dir)
+	cmd.Stdin = archive
+	if _, err := pmemexec.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("extract tarball: %v", err)
+	}
+	return nil
+}
+
+// populateFromImage pulls the image with containerd and copies the
+// content of its root filesystem.
+func (vp *volumePopulator) populateFromImage(ctx context.Context, image, dir string) error {
+	ctr := func(args ...string) error {
+		_, err := pmemexec.RunCommand(ctx, "ctr", append([]string{"--address", vp.containerdAddress, "--namespace", containerdNamespace}, args...)...)
+		return err
+	}
+	if err := ctr("images", "pull", image); err != nil {
+		return fmt.Errorf("pull image: %v", err)
+	}
+	rootfs := dir + ".rootfs"
+	if err := os.Mkdir(rootfs, 0700); err != nil && !os.IsExist(err) {
+		return fmt.Errorf("create image mount point: %v", err)
+	}
+	defer os.Remove(rootfs)
+	if err := ctr("images", "mount", image, rootfs); err != nil {
+		return fmt.Errorf("mount image: %v", err)
+	}
+	defer func() {
+		if err := ctr("images", "unmount", "--rm", rootfs); err != nil {
+			klog.FromContext(ctx).Error(err, "Unmounting image failed")
+		}
+	}()
+	if _, err := pmemexec.RunCommand(ctx, "cp", "--archive", rootfs+"/.", dir); err != nil {
+		return fmt.Errorf("copy image content: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestPopulateTarball(t *testing.T) {
+	files := map[string]string{
+		"hello.txt":        "hello world\n",
+		"data/nested.txt":  "nested\n",
+		"../escape.txt":    "must not be written\n",
+		"/absolute/x.txt":  "must not be written either\n",
+		"data/another.txt": "another\n",
+	}
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}), "header %s", name)
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err, "content %s", name)
+	}
+	require.NoError(t, tw.Close(), "close tar")
+	var compressed bytes.Buffer
+	gw := gzip.NewWriter(&compressed)
+	_, err := gw.Write(archive.Bytes())
+	require.NoError(t, err, "compress")
+	require.NoError(t, gw.Close(), "close gzip")
+
+	for name, data := range map[string][]byte{"plain": archive.Bytes(), "gzip": compressed.Bytes()} {
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			tmp := t.TempDir()
+			tarball := filepath.Join(tmp, "content.tar")
+			require.NoError(t, os.WriteFile(tarball, data, 0644), "write tarball")
+			dir := filepath.Join(tmp, "volume")
+			require.NoError(t, os.Mkdir(dir, 0755), "create target")
+
+			vp := &volumePopulator{workDir: tmp}
+			// GNU tar skips the dangerous members and then reports an error.
+			_ = vp.populate(ctx, "file://"+tarball, dir)
+			for _, name := range []string{"hello.txt", "data/nested.txt", "data/another.txt"} {
+				content, err := os.ReadFile(filepath.Join(dir, name))
+				if assert.NoError(t, err, "read %s", name) {
+					assert.Equal(t, files[name], string(content), "content of %s", name)
+				}
+			}
+			assert.NoFileExists(t, filepath.Join(tmp, "escape.txt"), "member outside of the volume")
+			assert.NoFileExists(t, "/absolute/x.txt", "absolute member")
+		})
+	}
+}
+
+func TestPopulateCreateVolume(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create volume state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+
+	mount := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	create := func(from string, capability *csi.VolumeCapability, source *csi.VolumeContentSource) error {
+		_, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:                "vol",
+			Parameters:          map[string]string{parameters.PopulateFrom: from},
+			VolumeCapabilities:  []*csi.VolumeCapability{capability},
+			CapacityRange:       &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+			VolumeContentSource: source,
+		})
+		return err
+	}
+	image := "registry.example.com/datasets/reference:v1"
+	tarball := "https://example.com/datasets/reference.tar.gz"
+
+	assert.Equal(t, codes.FailedPrecondition, status.Code(create(tarball, mount, nil)), "not supported")
+
+	cs.populator = &volumePopulator{workDir: t.TempDir()}
+	assert.Equal(t, codes.FailedPrecondition, status.Code(create(image, mount, nil)), "images not enabled")
+	assert.Equal(t, codes.InvalidArgument, status.Code(create(tarball, block, nil)), "raw block")
+	source := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "other"}},
+	}
+	assert.Equal(t, codes.InvalidArgument, status.Code(create(tarball, mount, source)), "content source")
+
+	// Fake devices cannot be written to, so content is skipped.
+	cs.populator.containerdAddress = "/run/containerd/containerd.sock"
+	require.NoError(t, create(image, mount, nil), "create volume")
+	vol := cs.getVolumeByName("vol")
+	require.NotNil(t, vol, "volume")
+	assert.Equal(t, image, vol.Params[parameters.PopulateFrom], "stored parameter")
+}
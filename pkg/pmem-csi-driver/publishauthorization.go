@@ -0,0 +1,154 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// publishReview is sent to the authorization webhook before a volume
+// gets published for a pod. The token proves the identity of the pod
+// and can be used by the webhook for requests on behalf of the pod,
+// for example to a key management service.
+type publishReview struct {
+	VolumeID     string `json:"volumeID"`
+	Ephemeral    bool   `json:"ephemeral"`
+	ReadOnly     bool   `json:"readOnly"`
+	PodName      string `json:"podName"`
+	PodNamespace string `json:"podNamespace"`
+	PodUID       string `json:"podUID"`
+	Token        string `json:"token"`
+}
+
+// publishDecision is the response of the webhook.
+type publishDecision struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// publishAuthorizer sends a publishReview to a webhook and fails
+// NodePublishVolume unless the webhook allows it.
+type publishAuthorizer struct {
+	url      string
+	audience string // of the service account token
+	client   *http.Client
+}
+
+func newPublishAuthorizer(url, caFile, audience string) (*publishAuthorizer, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read publish authorization CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in publish authorization CA file %s", caFile)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+	return &publishAuthorizer{
+		url:      url,
+		audience: audience,
+		client:   &http.Client{Transport: transport, Timeout: 30 * time.Second},
+	}, nil
+}
+
+// authorize returns nil or a status error.
+func (pa *publishAuthorizer) authorize(ctx context.Context, req *csi.NodePublishVolumeRequest, ephemeral bool) error {
+	volumeContext := req.GetVolumeContext()
+	token, err := podToken(volumeContext, pa.audience)
+	if err != nil {
+		return status.Errorf(codes.InvalidArgument, "service account token: %v", err)
+	}
+	if token == "" {
+		return status.Errorf(codes.FailedPrecondition, "no service account token for audience %q in the volume context, the CSIDriver object must request it with tokenRequests", pa.audience)
+	}
+	review := publishReview{
+		VolumeID:     req.GetVolumeId(),
+		Ephemeral:    ephemeral,
+		ReadOnly:     req.GetReadonly(),
+		PodName:      volumeContext[parameters.PodName],
+		PodNamespace: volumeContext[parameters.PodNamespace],
+		PodUID:       volumeContext[parameters.PodUID],
+		Token:        token,
+	}
+	logger := klog.FromContext(ctx).WithValues("pod", klog.KRef(review.PodNamespace, review.PodName))
+	logger.V(3).Info("Authorizing publish")
+	decision, err := pa.send(ctx, review)
+	if err != nil {
+		// kubelet will try again.
+		return status.Errorf(codes.Unavailable, "publish authorization: %v", err)
+	}
+	if !decision.Allowed {
+		logger.Info("Publish denied", "reason", decision.Reason)
+		return status.Errorf(codes.PermissionDenied, "pod %s/%s may not use volume %s: %s", review.PodNamespace, review.PodName, review.VolumeID, decision.Reason)
+	}
+	return nil
+}
+
+// send does not include the response body in errors because it could
+// echo the token.
+func (pa *publishAuthorizer) send(ctx context.Context, review publishReview) (*publishDecision, error) {
+	body, _ := json.Marshal(review)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, pa.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := pa.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("webhook: %s", resp.Status)
+	}
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	decision := &publishDecision{}
+	if err := json.Unmarshal(data, decision); err != nil {
+		return nil, fmt.Errorf("decode webhook response: %v", err)
+	}
+	return decision, nil
+}
+
+// podToken returns the service account token for the audience from
+// the volume context, empty if kubelet did not provide one.
+func podToken(volumeContext map[string]string, audience string) (string, error) {
+	value, ok := volumeContext[parameters.ServiceAccountTokens]
+	if !ok {
+		return "", nil
+	}
+	var tokens map[string]struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal([]byte(value), &tokens); err != nil {
+		// The error from the decoder might contain parts of a token.
+		return "", errors.New("invalid JSON")
+	}
+	return tokens[audience].Token, nil
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestPodToken(t *testing.T) {
+	token, err := podToken(map[string]string{}, "pmem-csi.intel.com")
+	require.NoError(t, err, "no tokens")
+	assert.Empty(t, token, "no tokens")
+
+	volumeContext := map[string]string{
+		parameters.ServiceAccountTokens: `{"pmem-csi.intel.com":{"token":"my-token","expirationTimestamp":"2021-01-01T00:00:00Z"},"other":{"token":"other-token"}}`,
+	}
+	token, err = podToken(volumeContext, "pmem-csi.intel.com")
+	require.NoError(t, err, "tokens")
+	assert.Equal(t, "my-token", token, "token for audience")
+	token, err = podToken(volumeContext, "unknown")
+	require.NoError(t, err, "tokens")
+	assert.Empty(t, token, "token for other audience")
+
+	_, err = podToken(map[string]string{parameters.ServiceAccountTokens: `{"a":"secret-token`}, "a")
+	require.Error(t, err, "invalid JSON")
+	assert.NotContains(t, err.Error(), "secret-token", "error must not contain token")
+}
+
+func TestPublishAuthorizer(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	var reviews []publishReview
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var review publishReview
+		if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		reviews = append(reviews, review)
+		switch review.PodNamespace {
+		case "broken":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "allowed":
+			_ = json.NewEncoder(w).Encode(publishDecision{Allowed: true})
+		default:
+			_ = json.NewEncoder(w).Encode(publishDecision{Reason: "namespace not trusted"})
+		}
+	}))
+	defer server.Close()
+
+	authorizer, err := newPublishAuthorizer(server.URL, "", "pmem-csi.intel.com")
+	require.NoError(t, err, "create authorizer")
+	request := func(namespace string, withToken bool) *csi.NodePublishVolumeRequest {
+		req := &csi.NodePublishVolumeRequest{
+			VolumeId: "vol-1",
+			Readonly: true,
+			VolumeContext: map[string]string{
+				parameters.PodName:      "pod",
+				parameters.PodNamespace: namespace,
+				parameters.PodUID:       "1234",
+			},
+		}
+		if withToken {
+			req.VolumeContext[parameters.ServiceAccountTokens] = `{"pmem-csi.intel.com":{"token":"my-token"}}`
+		}
+		return req
+	}
+
+	require.NoError(t, authorizer.authorize(ctx, request("allowed", true), true), "allowed")
+	require.Len(t, reviews, 1, "reviews")
+	assert.Equal(t, publishReview{VolumeID: "vol-1", Ephemeral: true, ReadOnly: true, PodName: "pod", PodNamespace: "allowed", PodUID: "1234", Token: "my-token"}, reviews[0], "review")
+
+	err = authorizer.authorize(ctx, request("denied", true), false)
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "denied")
+	assert.Contains(t, err.Error(), "namespace not trusted", "reason")
+	assert.Equal(t, codes.Unavailable, status.Code(authorizer.authorize(ctx, request("broken", true), false)), "webhook failure")
+	assert.Equal(t, codes.FailedPrecondition, status.Code(authorizer.authorize(ctx, request("allowed", false), false)), "no token")
+	assert.Len(t, reviews, 3, "no review without token")
+}
@@ -0,0 +1,46 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// readOnlyMethods are the calls which get served in inspection
+// mode. They neither modify PMEM nor the state of the driver.
+var readOnlyMethods = map[string]bool{
+	"/csi.v1.Identity/GetPluginInfo":                true,
+	"/csi.v1.Identity/GetPluginCapabilities":        true,
+	"/csi.v1.Identity/Probe":                        true,
+	"/csi.v1.Controller/ControllerGetCapabilities":  true,
+	"/csi.v1.Controller/GetCapacity":                true,
+	"/csi.v1.Controller/ListVolumes":                true,
+	"/csi.v1.Controller/ControllerGetVolume":        true,
+	"/csi.v1.Controller/ListSnapshots":              true,
+	"/csi.v1.Controller/ValidateVolumeCapabilities": true,
+	"/csi.v1.Node/NodeGetCapabilities":              true,
+	"/csi.v1.Node/NodeGetInfo":                      true,
+	"/csi.v1.Node/NodeGetVolumeStats":               true,
+	"/grpc.health.v1.Health/Check":                  true,
+}
+
+// readOnlyInterceptor refuses all calls which are not known to be
+// read-only, including calls that get added to the CSI spec later.
+func readOnlyInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !readOnlyMethods[info.FullMethod] {
+		method := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+		klog.FromContext(ctx).V(3).Info("Refusing call in read-only inspection mode", "method", info.FullMethod)
+		return nil, status.Errorf(codes.FailedPrecondition, "%s: driver runs in read-only inspection mode", method)
+	}
+	return handler(ctx, req)
+}
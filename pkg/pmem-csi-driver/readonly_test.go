@@ -0,0 +1,46 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestReadOnlyInterceptor(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return "done", nil
+	}
+	for method, allowed := range map[string]bool{
+		"/csi.v1.Identity/Probe":            true,
+		"/csi.v1.Controller/GetCapacity":    true,
+		"/csi.v1.Controller/ListVolumes":    true,
+		"/csi.v1.Node/NodeGetVolumeStats":   true,
+		"/csi.v1.Controller/CreateVolume":   false,
+		"/csi.v1.Controller/DeleteVolume":   false,
+		"/csi.v1.Node/NodePublishVolume":    false,
+		"/csi.v1.Controller/SomeFutureCall": false,
+	} {
+		t.Run(method, func(t *testing.T) {
+			resp, err := readOnlyInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+			if allowed {
+				assert.NoError(t, err, "call")
+				assert.Equal(t, "done", resp, "response")
+			} else {
+				assert.Equal(t, codes.FailedPrecondition, status.Code(err), "call should have been refused, got: %v", err)
+				assert.Nil(t, resp, "response")
+			}
+		})
+	}
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+)
+
+// A read-only bind mount does not prevent writes to a device node,
+// therefore raw block volumes which are published read-only get a
+// read-only device mapper device of their own. It covers the whole
+// device and exists as long as the volume is published at the target
+// path. The device itself remains writable for other publications.
+
+// mapperDir can be replaced by tests.
+var mapperDir = "/dev/mapper"
+
+// readOnlyDeviceName derives the name of the read-only device from the
+// target path, which is unique per publication and also known in
+// NodeUnpublishVolume.
+func readOnlyDeviceName(targetPath string) string {
+	return fmt.Sprintf("pmem-csi-ro-%x", sha256.Sum256([]byte(filepath.Clean(targetPath))))[:44]
+}
+
+// createReadOnlyDevice returns the path of a read-only device for the
+// target path which maps the entire device. It is idempotent.
+func createReadOnlyDevice(ctx context.Context, devicePath, targetPath string) (string, error) {
+	name := readOnlyDeviceName(targetPath)
+	path := filepath.Join(mapperDir, name)
+	if _, err := os.Stat(path); err == nil {
+		return path, nil
+	}
+	sectors, err := pmemexec.RunCommand(ctx, "blockdev", "--getsz", devicePath)
+	if err != nil {
+		return "", fmt.Errorf("determine size of %s: %v", devicePath, err)
+	}
+	table := fmt.Sprintf("0 %s linear %s 0", strings.TrimSpace(sectors), devicePath)
+	klog.FromContext(ctx).V(3).Info("Creating read-only device", "device", devicePath, "read-only-device", name)
+	if _, err := pmemexec.RunCommand(ctx, "dmsetup", "create", name, "--readonly", "--table", table); err != nil {
+		return "", fmt.Errorf("create read-only device for %s: %v", devicePath, err)
+	}
+	return path, nil
+}
+
+// removeReadOnlyDevice removes the read-only device of the target
+// path, if there is one.
+func removeReadOnlyDevice(ctx context.Context, targetPath string) error {
+	name := readOnlyDeviceName(targetPath)
+	if _, err := os.Stat(filepath.Join(mapperDir, name)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	klog.FromContext(ctx).V(3).Info("Removing read-only device", "read-only-device", name)
+	if _, err := pmemexec.RunCommand(ctx, "dmsetup", "remove", name); err != nil {
+		return fmt.Errorf("remove read-only device %s: %v", name, err)
+	}
+	return nil
+}
+
+// mountedReadOnly checks whether the filesystem mounted at the path
+// rejects writes. Bind mounts become read-only with a remount, which
+// might silently not have happened.
+func mountedReadOnly(path string) (bool, error) {
+	info, err := mounts.find(path)
+	if err != nil {
+		return false, err
+	}
+	if info == nil {
+		return false, fmt.Errorf("%s is not mounted", path)
+	}
+	for _, options := range [][]string{info.MountOptions, info.SuperOptions} {
+		for _, option := range options {
+			if option == "ro" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
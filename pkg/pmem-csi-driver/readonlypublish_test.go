@@ -0,0 +1,57 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestReadOnlyPublish(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+
+	name := readOnlyDeviceName("/var/lib/kubelet/pods/1/volumes/vol-1")
+	assert.Equal(t, name, readOnlyDeviceName("/var/lib/kubelet/pods/1/volumes/vol-1/"), "clean path")
+	assert.NotEqual(t, name, readOnlyDeviceName("/var/lib/kubelet/pods/2/volumes/vol-1"), "unique per target path")
+	// Device mapper names are limited to 127 characters.
+	assert.Less(t, len(name), 128, "name length")
+
+	defer func(dir string) { mapperDir = dir }(mapperDir)
+	mapperDir = t.TempDir()
+	assert.NoError(t, removeReadOnlyDevice(ctx, "/var/lib/kubelet/pods/1/volumes/vol-1"), "no device")
+	require.NoError(t, os.WriteFile(filepath.Join(mapperDir, name), nil, 0644), "fake device")
+	path, err := createReadOnlyDevice(ctx, "/dev/pmem0", "/var/lib/kubelet/pods/1/volumes/vol-1")
+	require.NoError(t, err, "existing device")
+	assert.Equal(t, filepath.Join(mapperDir, name), path, "device path")
+
+	mountInfo := filepath.Join(t.TempDir(), "mountinfo")
+	require.NoError(t, os.WriteFile(mountInfo, []byte(`22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+40 22 259:2 / /var/lib/kubelet/ro ro,relatime shared:20 - ext4 /dev/pmem0 rw,dax=always
+41 22 259:3 / /var/lib/kubelet/rw rw,relatime shared:21 - ext4 /dev/pmem1 rw
+42 22 259:4 / /var/lib/kubelet/overmounted ro,relatime shared:22 - ext4 /dev/pmem2 rw
+43 22 259:4 / /var/lib/kubelet/overmounted rw,relatime shared:22 - ext4 /dev/pmem2 rw
+`), 0644), "write mountinfo")
+	defer func(path string) { mountInfoPath = path }(mountInfoPath)
+	mountInfoPath = mountInfo
+
+	for path, expected := range map[string]bool{
+		"/var/lib/kubelet/ro":          true,
+		"/var/lib/kubelet/rw":          false,
+		"/var/lib/kubelet/overmounted": false,
+	} {
+		ro, err := mountedReadOnly(path)
+		require.NoError(t, err, path)
+		assert.Equal(t, expected, ro, path)
+	}
+	_, err = mountedReadOnly("/var/lib/kubelet/unknown")
+	assert.Error(t, err, "not mounted")
+}
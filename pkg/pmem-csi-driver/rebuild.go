@@ -0,0 +1,174 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// deviceKind is what the name of a device tells about it.
+type deviceKind string
+
+const (
+	// A persistent volume, named by generateVolumeID.
+	deviceVolume deviceKind = "volume"
+	// An ephemeral inline volume, named after the volume ID that
+	// kubelet generates. Its pod is gone when the state is lost.
+	deviceEphemeral deviceKind = "ephemeral volume"
+	// A snapshot with the default name of the external-snapshotter.
+	// The source volume is not recorded on the device.
+	deviceSnapshot deviceKind = "snapshot"
+	// A deleted volume in the trash or in the queue of the scrubber.
+	deviceDeleted deviceKind = "deleted volume"
+	// Not created by PMEM-CSI, for example the namespaces which
+	// back the volume groups in LVM mode.
+	deviceForeign deviceKind = "foreign"
+)
+
+var (
+	volumeIDRegex    = regexp.MustCompile(`^.{0,6}-[0-9a-f]{56}$`)
+	ephemeralIDRegex = regexp.MustCompile(`^csi-[0-9a-f]{64}$`)
+	snapshotIDRegex  = regexp.MustCompile(`^snapsh-[0-9a-f]{56}$`)
+	deletedIDRegex   = regexp.MustCompile(`^(trash|scrub)-[0-9a-f]{56}$`)
+)
+
+// kindOfDevice applies the naming conventions. The more specific
+// checks must come first because those names also match
+// volumeIDRegex.
+func kindOfDevice(id string) deviceKind {
+	switch {
+	case deletedIDRegex.MatchString(id):
+		return deviceDeleted
+	case snapshotIDRegex.MatchString(id):
+		return deviceSnapshot
+	case ephemeralIDRegex.MatchString(id):
+		return deviceEphemeral
+	case volumeIDRegex.MatchString(id):
+		return deviceVolume
+	default:
+		return deviceForeign
+	}
+}
+
+// rebuildState implements the rebuild-state mode. It adds an entry to
+// the state for each persistent volume on the node which is missing
+// there, for example after reinstalling the OS of a node. Nothing on
+// the node and no existing entry gets modified. The node driver must
+// not be running at the same time.
+func (csid *csiDriver) rebuildState(ctx context.Context) error {
+	ctx, logger := pmemlog.WithName(ctx, "rebuildState")
+
+	sm, err := pmemstate.NewDBState(csid.cfg.StateBasePath)
+	if err != nil {
+		return err
+	}
+	// Zero percentage because nothing must be changed on the node.
+	dm, err := pmdmanager.New(ctx, csid.cfg.DeviceManager, 0, csid.deviceManagerOptions())
+	if err != nil {
+		return fmt.Errorf("initialize device manager for mode %q: %v", csid.cfg.DeviceManager, err)
+	}
+	restored, err := rebuildVolumes(ctx, dm, sm)
+	if err != nil {
+		return err
+	}
+	logger.Info("Rebuilding the state is done", "restored", restored)
+	return nil
+}
+
+// rebuildVolumes returns the number of restored volumes.
+func rebuildVolumes(ctx context.Context, dm pmdmanager.PmemDeviceManager, sm pmemstate.StateManager) (int, error) {
+	logger := klog.FromContext(ctx)
+	ids, err := sm.GetAll()
+	if err != nil {
+		return 0, err
+	}
+	known := map[string]bool{}
+	for _, id := range ids {
+		known[id] = true
+	}
+	devices, err := dm.ListDevices(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("list devices: %v", err)
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].VolumeId < devices[j].VolumeId
+	})
+
+	restored := 0
+	for _, device := range devices {
+		id := device.VolumeId
+		logger := logger.WithValues("volume-id", id)
+		kind := kindOfDevice(id)
+		switch {
+		case known[id]:
+			logger.V(3).Info("Volume is in the state")
+			continue
+		case kind == deviceForeign:
+			logger.V(3).Info("Device not created by PMEM-CSI", "path", device.Path)
+			continue
+		case kind != deviceVolume:
+			// Nothing uses it anymore or the information for
+			// the state is missing. The admin has to decide
+			// whether to remove it.
+			logger.Info("Device not restored", "path", device.Path, "kind", kind)
+			continue
+		}
+
+		vol, err := rebuildVolume(ctx, dm.GetMode(), device)
+		if err != nil {
+			return restored, fmt.Errorf("volume %s: %v", id, err)
+		}
+		if err := sm.Create(id, vol); err != nil {
+			return restored, fmt.Errorf("volume %s: %v", id, err)
+		}
+		logger.Info("Restored volume", "size", pmemlog.CapacityRef(vol.Size), "parameters", vol.Params)
+		restored++
+	}
+	return restored, nil
+}
+
+// rebuildVolume creates the state of a volume from its device. The
+// original name and most parameters are unknown, which is okay
+// because the node driver only depends on the device mode and size.
+// Encryption gets detected because the volume cannot be staged
+// without it.
+func rebuildVolume(ctx context.Context, mode api.DeviceMode, device *pmdmanager.PmemDeviceInfo) (*nodeVolume, error) {
+	size := int64(device.Size)
+	persistency := parameters.PersistencyNormal
+	p := parameters.Volume{
+		DeviceMode:  &mode,
+		Size:        &size,
+		Persistency: &persistency,
+	}
+	if mode != api.DeviceModeDevdax && !strings.HasPrefix(device.Path, pmdmanager.FakeDevicePathPrefix) {
+		fsType, err := determineFilesystemType(ctx, device.Path)
+		if err != nil {
+			return nil, fmt.Errorf("detect content of %s: %v", device.Path, err)
+		}
+		if fsType == "crypto_LUKS" {
+			encryption := parameters.EncryptionLUKS2
+			p.Encryption = &encryption
+		}
+	}
+	return &nodeVolume{
+		ID:     device.VolumeId,
+		Size:   size,
+		Params: p.ToContext(),
+	}, nil
+}
@@ -0,0 +1,95 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestKindOfDevice(t *testing.T) {
+	testcases := map[string]deviceKind{
+		generateVolumeID("pvc-1234"):              deviceVolume,
+		generateVolumeID("vol"):                   deviceVolume,
+		generateVolumeID("snapshot-1234"):         deviceSnapshot,
+		"csi-" + strings.Repeat("0a", 32):         deviceEphemeral,
+		trashDeviceName("pvc-1234", time.Now()):   deviceDeleted,
+		scrubDeviceName("pvc-1234", time.Now()):   deviceDeleted,
+		"pmem-csi":                                deviceForeign,
+		"pvc-12-" + strings.Repeat("x", 56):       deviceForeign,
+		"pvc-1234-" + strings.Repeat("0", 56):     deviceForeign,
+		"csi-" + strings.Repeat("0", 63):          deviceForeign,
+		"trash-" + strings.Repeat("0", 55) + "/x": deviceForeign,
+	}
+	for id, expected := range testcases {
+		assert.Equal(t, expected, kindOfDevice(id), id)
+	}
+}
+
+func TestRebuildVolumes(t *testing.T) {
+	const size = 1024 * 1024
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewDBState(t.TempDir())
+	require.NoError(t, err, "create state")
+
+	known := generateVolumeID("pvc-known")
+	lost := generateVolumeID("pvc-lost")
+	for _, id := range []string{
+		known,
+		lost,
+		generateVolumeID("snapshot-1"),
+		"csi-" + strings.Repeat("0a", 32),
+		trashDeviceName(known, time.Now()),
+		"pmem-csi",
+	} {
+		_, err := dm.CreateDevice(ctx, id, size, parameters.UsageAppDirect, 0, nil)
+		require.NoError(t, err, "create device %s", id)
+	}
+	knownVolume := &nodeVolume{ID: known, Size: size, Params: map[string]string{
+		parameters.DeviceMode: string(api.DeviceModeFake),
+		parameters.Name:       "pvc-known",
+	}}
+	require.NoError(t, sm.Create(known, knownVolume), "store known volume")
+
+	restored, err := rebuildVolumes(ctx, dm, sm)
+	require.NoError(t, err, "rebuild")
+	assert.Equal(t, 1, restored, "restored volumes")
+	ids, err := sm.GetAll()
+	require.NoError(t, err, "list state")
+	assert.ElementsMatch(t, []string{known, lost}, ids, "volumes in state")
+
+	vol := &nodeVolume{}
+	require.NoError(t, sm.Get(known, vol), "get known volume")
+	assert.Equal(t, knownVolume, vol, "known volume unchanged")
+	require.NoError(t, sm.Get(lost, vol), "get restored volume")
+	assert.Equal(t, int64(size), vol.Size, "size")
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+	require.NoError(t, err, "parse parameters")
+	assert.Equal(t, api.DeviceModeFake, p.GetDeviceMode(), "device mode")
+	assert.Equal(t, parameters.PersistencyNormal, p.GetPersistency(), "persistency")
+	assert.Equal(t, parameters.EncryptionNone, p.GetEncryption(), "encryption")
+
+	// The node driver then uses the restored volume.
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	assert.NotNil(t, cs.getVolumeByID(lost), "restored volume in node driver")
+
+	restored, err = rebuildVolumes(ctx, dm, sm)
+	require.NoError(t, err, "rebuild again")
+	assert.Equal(t, 0, restored, "restored volumes the second time")
+}
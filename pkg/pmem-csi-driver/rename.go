@@ -0,0 +1,219 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	storagev1 "k8s.io/api/storage/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// renameDriver implements the rename-driver mode. It prepares a
+// node for running the driver under a new name:
+//   - the state directory of the old name gets moved,
+//   - paths with the old name in the stored volumes get updated,
+//   - labels of the node with the old name as prefix get copied,
+//   - the CSIDriver object gets copied.
+//
+// The volumes themselves do not depend on the driver name: LVM volume
+// groups, logical volumes and namespaces are named after regions and
+// volume IDs. The old node labels are kept because the node affinity
+// of existing PersistentVolumes refers to them.
+//
+// This must run while the node driver is stopped and the node is
+// drained. It can be repeated when it fails.
+func (csid *csiDriver) renameDriver(ctx context.Context, client kubernetes.Interface) error {
+	ctx, logger := pmemlog.WithName(ctx, "renameDriver")
+	oldName, newName := csid.cfg.oldDriverName, csid.cfg.DriverName
+	if oldName == "" {
+		return errors.New("old driver name configuration option missing")
+	}
+	if oldName == newName {
+		return fmt.Errorf("old and new driver name are the same: %s", newName)
+	}
+	oldStatePath := csid.cfg.oldStatePath
+	if oldStatePath == "" {
+		oldStatePath = "/var/lib/" + oldName
+	}
+
+	if err := moveState(ctx, oldStatePath, csid.cfg.StateBasePath); err != nil {
+		return fmt.Errorf("move state directory: %v", err)
+	}
+	if err := renameInVolumes(ctx, csid.cfg.StateBasePath, oldName, newName); err != nil {
+		return fmt.Errorf("update volumes: %v", err)
+	}
+	if client != nil {
+		if err := copyNodeLabels(ctx, client, csid.cfg.NodeID, oldName, newName); err != nil {
+			return fmt.Errorf("copy labels of node %s: %v", csid.cfg.NodeID, err)
+		}
+		if err := copyCSIDriver(ctx, client, oldName, newName); err != nil {
+			return fmt.Errorf("copy CSIDriver %s: %v", oldName, err)
+		}
+	}
+	logger.Info("Driver renaming is done", "old-driver-name", oldName, "new-driver-name", newName)
+	return nil
+}
+
+// moveState does nothing when the old directory is already gone
+// or is the same as the new one.
+func moveState(ctx context.Context, oldPath, newPath string) error {
+	logger := klog.FromContext(ctx)
+	if filepath.Clean(oldPath) == filepath.Clean(newPath) {
+		logger.V(3).Info("State directory remains the same", "path", newPath)
+		return nil
+	}
+	if _, err := os.Stat(oldPath); os.IsNotExist(err) {
+		logger.V(3).Info("No old state directory", "path", oldPath)
+		return nil
+	}
+	if _, err := os.Stat(newPath); err == nil {
+		return fmt.Errorf("both %s and %s exist, remove one of them", oldPath, newPath)
+	}
+
+	// Mounts below the old directory, like those of ephemeral
+	// volumes, would break.
+	mounts, err := mount.New("").List()
+	if err != nil {
+		return fmt.Errorf("list mounts: %v", err)
+	}
+	for _, mnt := range mounts {
+		if strings.HasPrefix(mnt.Path, filepath.Clean(oldPath)+"/") {
+			return fmt.Errorf("%s is still mounted, drain the node first", mnt.Path)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newPath), 0750); err != nil {
+		return err
+	}
+	if err := os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+	logger.Info("Moved state directory", "old-path", oldPath, "new-path", newPath)
+	return nil
+}
+
+// renameInVolumes replaces the old driver name where it is a
+// directory in the stored paths, for example in the staging
+// directories that kubelet creates per driver.
+func renameInVolumes(ctx context.Context, statePath, oldName, newName string) error {
+	sm, err := pmemstate.NewDBState(statePath)
+	if err != nil {
+		return err
+	}
+	ids, err := sm.GetAll()
+	if err != nil {
+		return err
+	}
+	rename := func(value string) string {
+		return strings.ReplaceAll(value, "/"+oldName+"/", "/"+newName+"/")
+	}
+	for _, id := range ids {
+		vol := &nodeVolume{}
+		if err := sm.Get(id, vol); err != nil {
+			return err
+		}
+		before, err := json.Marshal(vol)
+		if err != nil {
+			return err
+		}
+		for key, value := range vol.Params {
+			vol.Params[key] = rename(value)
+		}
+		vol.Writer = rename(vol.Writer)
+		after, err := json.Marshal(vol)
+		if err != nil {
+			return err
+		}
+		if string(before) == string(after) {
+			continue
+		}
+		// Create overwrites the existing entry.
+		if err := sm.Create(id, vol); err != nil {
+			return err
+		}
+		klog.FromContext(ctx).V(3).Info("Updated volume", "volume-id", id)
+	}
+	return nil
+}
+
+// copyNodeLabels adds a label with the new prefix for each label with
+// the old one, like the topology label.
+func copyNodeLabels(ctx context.Context, client kubernetes.Interface, nodeName, oldName, newName string) error {
+	node, err := client.CoreV1().Nodes().Get(ctx, nodeName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	labels := map[string]string{}
+	for key, value := range node.Labels {
+		if suffix := strings.TrimPrefix(key, oldName+"/"); suffix != key {
+			newKey := newName + "/" + suffix
+			if _, ok := node.Labels[newKey]; !ok {
+				labels[newKey] = value
+			}
+		}
+	}
+	if len(labels) == 0 {
+		return nil
+	}
+	patch, err := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels": labels,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := client.CoreV1().Nodes().Patch(ctx, nodeName, k8stypes.MergePatchType, patch, metav1.PatchOptions{}); err != nil {
+		return err
+	}
+	klog.FromContext(ctx).Info("Copied node labels", "node", nodeName, "labels", labels)
+	return nil
+}
+
+// copyCSIDriver creates the CSIDriver object for the new name with
+// the same settings, unless it already exists.
+func copyCSIDriver(ctx context.Context, client kubernetes.Interface, oldName, newName string) error {
+	old, err := client.StorageV1().CSIDrivers().Get(ctx, oldName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		klog.FromContext(ctx).V(3).Info("No CSIDriver object for old name", "driver-name", oldName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	csiDriver := &storagev1.CSIDriver{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        newName,
+			Labels:      old.Labels,
+			Annotations: old.Annotations,
+		},
+		Spec: old.Spec,
+	}
+	if _, err := client.StorageV1().CSIDrivers().Create(ctx, csiDriver, metav1.CreateOptions{}); err != nil {
+		if apierrors.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	}
+	klog.FromContext(ctx).Info("Created CSIDriver object", "driver-name", newName)
+	return nil
+}
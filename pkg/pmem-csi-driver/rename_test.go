@@ -0,0 +1,102 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestRenameDriver(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	tmp := t.TempDir()
+	oldPath := filepath.Join(tmp, "old-driver")
+	newPath := filepath.Join(tmp, "lib", "new-driver")
+	sm, err := pmemstate.NewFileState(oldPath)
+	require.NoError(t, err, "create old state")
+	writer := "/var/lib/kubelet/plugins/kubernetes.io/csi/old-driver/abc/globalmount"
+	require.NoError(t, sm.Create("vol", &nodeVolume{
+		ID:     "vol",
+		Size:   1024,
+		Params: map[string]string{"stagingPath": writer, "other": "old-driver"},
+		Writer: writer,
+	}), "create volume")
+
+	attachRequired := false
+	client := fake.NewSimpleClientset(
+		&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "worker",
+				Labels: map[string]string{
+					"foo":             "bar",
+					"old-driver/node": "worker",
+					"new-driver/node": "already-set",
+					"old-driver/pmem": "true",
+				},
+			},
+		},
+		&storagev1.CSIDriver{
+			ObjectMeta: metav1.ObjectMeta{Name: "old-driver"},
+			Spec:       storagev1.CSIDriverSpec{AttachRequired: &attachRequired},
+		},
+	)
+	csid := &csiDriver{cfg: Config{
+		DriverName:    "new-driver",
+		NodeID:        "worker",
+		StateBasePath: newPath,
+		oldDriverName: "old-driver",
+		oldStatePath:  oldPath,
+	}}
+
+	require.NoError(t, csid.renameDriver(ctx, client), "rename")
+	_, err = os.Stat(oldPath)
+	assert.True(t, os.IsNotExist(err), "old state directory removed")
+	sm, err = pmemstate.NewDBState(newPath)
+	require.NoError(t, err, "open new state")
+	vol := &nodeVolume{}
+	require.NoError(t, sm.Get("vol", vol), "get volume")
+	newWriter := "/var/lib/kubelet/plugins/kubernetes.io/csi/new-driver/abc/globalmount"
+	assert.Equal(t, newWriter, vol.Writer, "writer")
+	assert.Equal(t, newWriter, vol.Params["stagingPath"], "path parameter")
+	assert.Equal(t, "old-driver", vol.Params["other"], "unrelated parameter")
+
+	node, err := client.CoreV1().Nodes().Get(ctx, "worker", metav1.GetOptions{})
+	require.NoError(t, err, "get node")
+	assert.Equal(t, map[string]string{
+		"foo":             "bar",
+		"old-driver/node": "worker",
+		"new-driver/node": "already-set",
+		"old-driver/pmem": "true",
+		"new-driver/pmem": "true",
+	}, node.Labels, "labels")
+	csiDriver, err := client.StorageV1().CSIDrivers().Get(ctx, "new-driver", metav1.GetOptions{})
+	require.NoError(t, err, "get new CSIDriver")
+	assert.Equal(t, &attachRequired, csiDriver.Spec.AttachRequired, "spec")
+
+	// Running again is harmless.
+	require.NoError(t, csid.renameDriver(ctx, client), "rename again")
+
+	// Both state directories must not exist.
+	require.NoError(t, os.Mkdir(oldPath, 0700), "recreate old state")
+	assert.Error(t, csid.renameDriver(ctx, client), "conflicting state")
+
+	csid.cfg.oldDriverName = "new-driver"
+	assert.Error(t, csid.renameDriver(ctx, client), "same name")
+	csid.cfg.oldDriverName = ""
+	assert.Error(t, csid.renameDriver(ctx, client), "no old name")
+}
@@ -16,6 +16,7 @@ import (
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/client-go/kubernetes"
 	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
 	"k8s.io/client-go/tools/cache"
@@ -25,6 +26,9 @@ import (
 
 const (
 	annSelectedNode = "volume.kubernetes.io/selected-node"
+
+	annStorageProvisioner     = "volume.kubernetes.io/storage-provisioner"
+	annBetaStorageProvisioner = "volume.beta.kubernetes.io/storage-provisioner"
 )
 
 // newRescheduler creates an instance of
@@ -33,31 +37,50 @@ const (
 // PMEM-CSI node driver running and triggers re-scheduling of those
 // PVCs by removing the "selected node" annotation. It never
 // provisions volumes. That is handled by the node instances.
+//
+// The first driver name is the one the lib runs as. PVCs for the
+// other names are handled the same way, which is useful when several
+// PMEM-CSI deployments coexist or while renaming the driver.
+//
+// In dry-run mode, PVCs which would get rescheduled are only logged
+// and counted.
+//
+// With rescheduleUnusable, PVCs also get rescheduled when the driver
+// runs on the node, but its PMEM is unhealthy or exhausted. The
+// capacity lister is nil when the cluster does not support
+// CSIStorageCapacity.
 func newRescheduler(ctx context.Context,
-	driverName string,
+	driverNames []string,
 	client kubernetes.Interface,
 	pvcInformer cache.SharedIndexInformer,
 	scInformer cache.SharedIndexInformer,
 	pvInformer cache.SharedIndexInformer,
 	csiNodeLister storagelistersv1.CSINodeLister,
+	capacityLister storagelistersv1.CSIStorageCapacityLister,
 	nodeSelector types.NodeSelector,
+	dryRun bool,
+	rescheduleUnusable bool,
 	serverGitVersion string) *pmemCSIProvisioner {
 	provisionerOptions := []func(*controller.ProvisionController) error{
 		controller.LeaderElection(false),
 		controller.ClaimsInformer(pvcInformer),
 		controller.ClassesInformer(scInformer),
 		controller.VolumesInformer(pvInformer),
+		controller.AdditionalProvisionerNames(driverNames[1:]),
 	}
 
 	pcp := &pmemCSIProvisioner{
-		driverName:    driverName,
-		nodeSelector:  nodeSelector,
-		csiNodeLister: csiNodeLister,
+		driverNames:        driverNames,
+		nodeSelector:       nodeSelector,
+		csiNodeLister:      csiNodeLister,
+		capacityLister:     capacityLister,
+		dryRun:             dryRun,
+		rescheduleUnusable: rescheduleUnusable,
 	}
 
 	provisionController := controller.NewProvisionController(
-		client,
-		driverName,
+		conflictCountingClient{client},
+		driverNames[0],
 		pcp,
 		serverGitVersion,
 		provisionerOptions...,
@@ -68,10 +91,14 @@ func newRescheduler(ctx context.Context,
 }
 
 type pmemCSIProvisioner struct {
-	driverName          string
+	driverNames         []string
 	nodeSelector        types.NodeSelector
 	csiNodeLister       storagelistersv1.CSINodeLister
+	capacityLister      storagelistersv1.CSIStorageCapacityLister
 	provisionController *controller.ProvisionController
+	removals            driverRemovals
+	dryRun              bool
+	rescheduleUnusable  bool
 }
 
 var _ controller.Qualifier = &pmemCSIProvisioner{}
@@ -98,7 +125,8 @@ func (pcp *pmemCSIProvisioner) startRescheduler(ctx context.Context, cancel func
 func (pcp *pmemCSIProvisioner) ShouldProvision(ctx context.Context, pvc *v1.PersistentVolumeClaim) bool {
 	l := klog.FromContext(ctx)
 
-	reschedule, err := pcp.shouldReschedule(ctx, pvc, nil)
+	reason, err := pcp.shouldReschedule(ctx, pvc, nil)
+	reschedule := reason != ""
 	if err != nil {
 		// Something went wrong. We have to allow the lib to
 		// start working on this PVC, otherwise users will
@@ -106,6 +134,7 @@ func (pcp *pmemCSIProvisioner) ShouldProvision(ctx context.Context, pvc *v1.Pers
 		l.Error(err, "deprovision check failed")
 		reschedule = true
 	}
+	examined("csinode", reschedule, err)
 	return reschedule
 }
 
@@ -113,13 +142,24 @@ func (pcp *pmemCSIProvisioner) ShouldProvision(ctx context.Context, pvc *v1.Pers
 // Despite the name, the only outcome is "no change" (= leave PVC unmodified)
 // or "reschedule" (= remove selected node annotation).
 func (pcp *pmemCSIProvisioner) Provision(ctx context.Context, opts controller.ProvisionOptions) (*v1.PersistentVolume, controller.ProvisioningState, error) {
-	reschedule, err := pcp.shouldReschedule(ctx, opts.PVC, opts.SelectedNode)
+	reason, err := pcp.shouldReschedule(ctx, opts.PVC, opts.SelectedNode)
+	reschedule := reason != ""
+	examined("node", reschedule, err)
 	if err != nil {
 		return nil, controller.ProvisioningNoChange, fmt.Errorf("deprovision check failed: %v", err)
 	}
+	if reschedule && pcp.dryRun {
+		klog.FromContext(ctx).Info("Dry run, not rescheduling PVC", "pvc", pmemlog.KObj(opts.PVC), "node", pmemlog.KObj(opts.SelectedNode), "reason", reason)
+		reschedulerDryRunReschedules.Inc()
+		return nil, controller.ProvisioningNoChange, &controller.IgnoredError{
+			Reason: fmt.Sprintf("dry run: would reschedule PVC %s/%s because it is assigned to node %s which %s",
+				opts.PVC.Namespace, opts.PVC.Name, opts.SelectedNode.Name, reason),
+		}
+	}
 	if reschedule {
-		return nil, controller.ProvisioningReschedule, fmt.Errorf("reschedule PVC %s/%s because it is assigned to node %s which has no PMEM-CSI driver",
-			opts.PVC.Namespace, opts.PVC.Name, opts.SelectedNode.Name)
+		pcp.observeReschedule(opts.PVC.Annotations[annSelectedNode])
+		return nil, controller.ProvisioningReschedule, fmt.Errorf("reschedule PVC %s/%s because it is assigned to node %s which %s",
+			opts.PVC.Namespace, opts.PVC.Name, opts.SelectedNode.Name, reason)
 	}
 	if opts.SelectedNode != nil {
 		err = &controller.IgnoredError{
@@ -149,7 +189,9 @@ func (pcp *pmemCSIProvisioner) SupportsBlock(context.Context) bool {
 	return true
 }
 
-func (pcp *pmemCSIProvisioner) shouldReschedule(ctx context.Context, pvc *v1.PersistentVolumeClaim, node *v1.Node) (bool, error) {
+// shouldReschedule returns why the PVC needs to be rescheduled, empty
+// if it doesn't.
+func (pcp *pmemCSIProvisioner) shouldReschedule(ctx context.Context, pvc *v1.PersistentVolumeClaim, node *v1.Node) (string, error) {
 	l := klog.FromContext(ctx).WithName("ShouldReschedulePVC").WithValues("pvc", pmemlog.KObj(pvc))
 	if node != nil {
 		l = l.WithValues("node", pmemlog.KObj(node))
@@ -163,7 +205,7 @@ func (pcp *pmemCSIProvisioner) shouldReschedule(ctx context.Context, pvc *v1.Per
 	if selectedNode == "" {
 		// No need to reschedule.
 		l.V(5).Info("no need to reschedule, no selected node")
-		return false, nil
+		return "", nil
 	}
 
 	// We have to be absolutely certain that the PVC is not going
@@ -190,34 +232,123 @@ func (pcp *pmemCSIProvisioner) shouldReschedule(ctx context.Context, pvc *v1.Per
 	// called more often. Such a cluster setup should better be
 	// avoided.
 	driverIsRunning := false
+	driverNames := pcp.pvcDriverNames(pvc)
 	csiNode, err := pcp.csiNodeLister.Get(selectedNode)
 	switch {
 	case err == nil:
-		driverIsRunning = hasDriver(csiNode, pcp.driverName)
+		driverIsRunning = hasDriver(csiNode, driverNames)
 	case apierrs.IsNotFound(err):
 		driverIsRunning = false
 	default:
-		return false, fmt.Errorf("retrieve CSINode %s: %v", selectedNode, err)
+		return "", fmt.Errorf("retrieve CSINode %s: %v", selectedNode, err)
+	}
+	if driverIsRunning && pcp.rescheduleUnusable {
+		// The node driver fails to create the volume in both
+		// cases, so it is safe to take the PVC away from it.
+		reason, err := pcp.unusable(selectedNode, node, driverNames)
+		if err != nil {
+			return "", err
+		}
+		l.V(3).Info("result", "reschedule", reason != "", "driverIsRunning", driverIsRunning, "reason", reason)
+		return reason, nil
 	}
 	if node == nil {
 		// Decide only based on CSINode.
 		reschedule := !driverIsRunning
 		l.V(3).Info("result", "reschedule", reschedule, "driverIsRunning", driverIsRunning)
-		return reschedule, nil
+		if reschedule {
+			return reasonNoDriver, nil
+		}
+		return "", nil
 	}
 
 	driverMightRun := pcp.nodeSelector.MatchesLabels(node.Labels)
 
 	reschedule := !driverMightRun && !driverIsRunning
 	l.V(3).Info("result", "reschedule", reschedule, "driverMightRun", driverMightRun, "driverIsRunning", driverIsRunning)
-	return reschedule, nil
+	if reschedule {
+		return reasonNoDriver, nil
+	}
+	return "", nil
 }
 
-func hasDriver(csiNode *storagev1.CSINode, driverName string) bool {
-	for _, driver := range csiNode.Spec.Drivers {
-		if driver.Name == driverName {
+// Reasons for rescheduling, completing "assigned to node xyz which...".
+const (
+	reasonNoDriver   = "has no PMEM-CSI driver"
+	reasonUnhealthy  = "has unhealthy PMEM"
+	reasonNoCapacity = "has no PMEM left"
+)
+
+// unusable checks whether the driver on the node cannot create
+// volumes. The node object is only available in the final check. A
+// node is exhausted when all CSIStorageCapacity objects of the driver
+// for it report zero capacity.
+func (pcp *pmemCSIProvisioner) unusable(nodeName string, node *v1.Node, driverNames []string) (string, error) {
+	if node != nil {
+		for _, driverName := range driverNames {
+			if node.Labels[healthLabel(driverName)] == "false" {
+				return reasonUnhealthy, nil
+			}
+		}
+	}
+	if pcp.capacityLister == nil {
+		return "", nil
+	}
+	capacities, err := pcp.capacityLister.List(labels.Everything())
+	if err != nil {
+		return "", fmt.Errorf("list CSIStorageCapacity objects: %v", err)
+	}
+	reported := false
+	for _, capacity := range capacities {
+		// Each driver name has its own topology key.
+		driverName := capacity.Labels[csiDriverNameLabel]
+		if !isDriverName(driverName, driverNames) ||
+			capacity.NodeTopology == nil ||
+			capacity.NodeTopology.MatchLabels[driverName+"/node"] != nodeName {
+			continue
+		}
+		if capacity.Capacity != nil && capacity.Capacity.Sign() > 0 {
+			return "", nil
+		}
+		reported = true
+	}
+	if reported {
+		return reasonNoCapacity, nil
+	}
+	return "", nil
+}
+
+func isDriverName(name string, driverNames []string) bool {
+	for _, driverName := range driverNames {
+		if name == driverName {
 			return true
 		}
 	}
 	return false
 }
+
+// pvcDriverNames returns the driver which is meant to provision the
+// PVC. If that is unknown, all drivers are candidates.
+func (pcp *pmemCSIProvisioner) pvcDriverNames(pvc *v1.PersistentVolumeClaim) []string {
+	provisioner := pvc.Annotations[annStorageProvisioner]
+	if provisioner == "" {
+		provisioner = pvc.Annotations[annBetaStorageProvisioner]
+	}
+	for _, driverName := range pcp.driverNames {
+		if driverName == provisioner {
+			return []string{driverName}
+		}
+	}
+	return pcp.driverNames
+}
+
+func hasDriver(csiNode *storagev1.CSINode, driverNames []string) bool {
+	for _, driver := range csiNode.Spec.Drivers {
+		for _, driverName := range driverNames {
+			if driver.Name == driverName {
+				return true
+			}
+		}
+	}
+	return false
+}
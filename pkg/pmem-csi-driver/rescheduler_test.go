@@ -10,11 +10,16 @@ import (
 	"errors"
 	"testing"
 
+	"github.com/stretchr/testify/require"
 	v1 "k8s.io/api/core/v1"
 	storagev1 "k8s.io/api/storage/v1"
 	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/runtime/schema"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/client-go/tools/cache"
 	"k8s.io/klog/v2/ktesting"
 	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
 
@@ -22,12 +27,18 @@ import (
 )
 
 type testcase struct {
+	driverNames   []string
+	provisioner   string
 	driverName    string
 	haveCSIDriver bool
 	haveCSINode   bool
 	selectedNode  string
 	nodeLabels    map[string]string
 	nodeSelector  types.NodeSelector
+	// rescheduleUnusable enables the checks of the health label
+	// and the capacity, which is not published when empty.
+	rescheduleUnusable bool
+	capacity           string
 
 	expectError                bool
 	expectReschedulePreCheck   bool
@@ -113,6 +124,48 @@ func TestRescheduler(t *testing.T) {
 			expectReschedulePreCheck:   false,
 			expectRescheduleFinalCheck: false,
 		},
+		"additional-driver": {
+			driverNames:   []string{driverName, "other." + driverName},
+			driverName:    "other." + driverName,
+			haveCSIDriver: true,
+			haveCSINode:   true,
+			selectedNode:  nodeName,
+			nodeSelector: types.NodeSelector{
+				nodeLabelName: nodeLabelValue,
+			},
+			nodeLabels: map[string]string{
+				nodeLabelName: nodeLabelValue,
+			},
+		},
+		"additional-driver-provisioner": {
+			driverNames:   []string{driverName, "other." + driverName},
+			provisioner:   "other." + driverName,
+			driverName:    "other." + driverName,
+			haveCSIDriver: true,
+			haveCSINode:   true,
+			selectedNode:  nodeName,
+			nodeSelector: types.NodeSelector{
+				nodeLabelName: nodeLabelValue,
+			},
+			nodeLabels: map[string]string{
+				nodeLabelName: nodeLabelValue,
+			},
+		},
+		"additional-driver-not-running": {
+			driverNames:   []string{driverName, "other." + driverName},
+			provisioner:   "other." + driverName,
+			driverName:    driverName,
+			haveCSIDriver: true,
+			haveCSINode:   true,
+			selectedNode:  nodeName,
+			nodeSelector: types.NodeSelector{
+				nodeLabelName: nodeLabelValue,
+			},
+			nodeLabels: map[string]string{},
+
+			expectReschedulePreCheck:   true,
+			expectRescheduleFinalCheck: true,
+		},
 		"reschedule": {
 			driverName:    driverName,
 			haveCSIDriver: false,
@@ -128,24 +181,74 @@ func TestRescheduler(t *testing.T) {
 		},
 	}
 
+	unusable := func(nodeLabels map[string]string, capacity string) testcase {
+		return testcase{
+			driverName:    driverName,
+			haveCSIDriver: true,
+			haveCSINode:   true,
+			selectedNode:  nodeName,
+			nodeSelector: types.NodeSelector{
+				nodeLabelName: nodeLabelValue,
+			},
+			nodeLabels:         nodeLabels,
+			rescheduleUnusable: true,
+			capacity:           capacity,
+		}
+	}
+	tc := unusable(map[string]string{nodeLabelName: nodeLabelValue, healthLabel(driverName): "false"}, "")
+	tc.expectRescheduleFinalCheck = true
+	testcases["unhealthy"] = tc
+	tc = unusable(map[string]string{nodeLabelName: nodeLabelValue, healthLabel(driverName): "true"}, "")
+	testcases["healthy"] = tc
+	tc = unusable(map[string]string{nodeLabelName: nodeLabelValue}, "0")
+	tc.expectReschedulePreCheck = true
+	tc.expectRescheduleFinalCheck = true
+	testcases["exhausted"] = tc
+	tc = unusable(map[string]string{nodeLabelName: nodeLabelValue}, "1Gi")
+	testcases["capacity-left"] = tc
+	tc = unusable(map[string]string{nodeLabelName: nodeLabelValue, healthLabel(driverName): "false"}, "0")
+	tc.rescheduleUnusable = false
+	testcases["unusable-disabled"] = tc
+
 	for name, tc := range testcases {
 		t.Run(name, func(t *testing.T) {
 			_, ctx := ktesting.NewTestContext(t)
+			driverNames := tc.driverNames
+			if driverNames == nil {
+				driverNames = []string{driverName}
+			}
 			pcp := pmemCSIProvisioner{
-				driverName:   driverName,
+				driverNames:  driverNames,
 				nodeSelector: tc.nodeSelector,
 				csiNodeLister: fakeCSINodeLister{
 					driverName:    tc.driverName,
 					haveCSIDriver: tc.haveCSIDriver,
 					haveCSINode:   tc.haveCSINode,
 				},
+				rescheduleUnusable: tc.rescheduleUnusable,
+			}
+			if tc.capacity != "" {
+				indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+				quantity := resource.MustParse(tc.capacity)
+				require.NoError(t, indexer.Add(&storagev1.CSIStorageCapacity{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:      "capacity",
+						Namespace: "pmem-csi",
+						Labels:    map[string]string{csiDriverNameLabel: driverName},
+					},
+					NodeTopology: &metav1.LabelSelector{MatchLabels: map[string]string{driverName + "/node": nodeName}},
+					Capacity:     &quantity,
+				}), "add capacity")
+				pcp.capacityLister = storagelistersv1.NewCSIStorageCapacityLister(indexer)
 			}
 
 			pvc := &v1.PersistentVolumeClaim{}
+			pvc.Annotations = map[string]string{}
 			if tc.selectedNode != "" {
-				pvc.Annotations = map[string]string{
-					annSelectedNode: tc.selectedNode,
-				}
+				pvc.Annotations[annSelectedNode] = tc.selectedNode
+			}
+			if tc.provisioner != "" {
+				pvc.Annotations[annStorageProvisioner] = tc.provisioner
 			}
 
 			if pcp.ShouldProvision(ctx, pvc) != tc.expectReschedulePreCheck {
@@ -0,0 +1,186 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	corev1client "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+var (
+	reschedulerExamined = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmem_rescheduler_pvcs_examined_total",
+			Help: "Number of checks whether a PVC must be rescheduled, by check (csinode before the lib works on the PVC, node with the selected node) and result (keep, reschedule, error).",
+		},
+		[]string{"check", "result"},
+	)
+	reschedulerReschedules = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pmem_rescheduler_reschedules_total",
+			Help: "Number of decisions to remove the selected node annotation of a PVC.",
+		},
+	)
+	reschedulerDryRunReschedules = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pmem_rescheduler_dry_run_reschedules_total",
+			Help: "Number of decisions to reschedule a PVC which were not carried out because of the dry-run mode.",
+		},
+	)
+	reschedulerConflicts = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "pmem_rescheduler_pvc_update_conflicts_total",
+			Help: "Number of PVC updates which failed with a conflict and get retried, for example because another controller instance removed the annotation first.",
+		},
+	)
+	reschedulerDelay = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "pmem_rescheduler_reschedule_delay_seconds",
+			Help: "Time from the removal of the driver from a node (CSINode object) until the decision to reschedule a PVC that was assigned to that node.",
+			// From a few seconds to several hours.
+			Buckets: prometheus.ExponentialBuckets(1, 3, 10),
+		},
+	)
+)
+
+// MustRegisterReschedulerMetrics adds the metrics of the rescheduler
+// to the registry, using a label to tag each sample with the driver
+// name.
+func MustRegisterReschedulerMetrics(reg prometheus.Registerer, driverName string) {
+	reg = prometheus.WrapRegistererWith(prometheus.Labels{"driver_name": driverName}, reg)
+	reg.MustRegister(reschedulerExamined)
+	reg.MustRegister(reschedulerReschedules)
+	reg.MustRegister(reschedulerDryRunReschedules)
+	reg.MustRegister(reschedulerConflicts)
+	reg.MustRegister(reschedulerDelay)
+}
+
+func examined(check string, reschedule bool, err error) {
+	result := "keep"
+	switch {
+	case err != nil:
+		result = "error"
+	case reschedule:
+		result = "reschedule"
+	}
+	reschedulerExamined.WithLabelValues(check, result).Inc()
+}
+
+// driverRemovals remembers when the driver disappeared from a node.
+type driverRemovals struct {
+	mutex sync.Mutex
+	nodes map[string]time.Time
+}
+
+func (dr *driverRemovals) set(nodeName string, removed bool) {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	if !removed {
+		delete(dr.nodes, nodeName)
+		return
+	}
+	if dr.nodes == nil {
+		dr.nodes = map[string]time.Time{}
+	}
+	if _, ok := dr.nodes[nodeName]; !ok {
+		dr.nodes[nodeName] = time.Now()
+	}
+}
+
+func (dr *driverRemovals) get(nodeName string) (time.Time, bool) {
+	dr.mutex.Lock()
+	defer dr.mutex.Unlock()
+	removed, ok := dr.nodes[nodeName]
+	return removed, ok
+}
+
+// watchDriverRemovals tracks the CSINode objects for the reschedule
+// delay. Nodes which never had the driver are not tracked.
+func (pcp *pmemCSIProvisioner) watchDriverRemovals(csiNodeInformer cache.SharedIndexInformer) error {
+	_, err := csiNodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			if csiNode, ok := obj.(*storagev1.CSINode); ok && hasDriver(csiNode, pcp.driverNames) {
+				pcp.removals.set(csiNode.Name, false)
+			}
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			oldCSINode, ok := oldObj.(*storagev1.CSINode)
+			if !ok {
+				return
+			}
+			newCSINode, ok := newObj.(*storagev1.CSINode)
+			if !ok {
+				return
+			}
+			switch {
+			case hasDriver(newCSINode, pcp.driverNames):
+				pcp.removals.set(newCSINode.Name, false)
+			case hasDriver(oldCSINode, pcp.driverNames):
+				pcp.removals.set(newCSINode.Name, true)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			if csiNode, ok := obj.(*storagev1.CSINode); ok && hasDriver(csiNode, pcp.driverNames) {
+				pcp.removals.set(csiNode.Name, true)
+			}
+		},
+	})
+	return err
+}
+
+// observeReschedule counts a reschedule decision for a PVC that was
+// assigned to the node.
+func (pcp *pmemCSIProvisioner) observeReschedule(nodeName string) {
+	reschedulerReschedules.Inc()
+	if removed, ok := pcp.removals.get(nodeName); ok {
+		reschedulerDelay.Observe(time.Since(removed).Seconds())
+	}
+}
+
+// conflictCountingClient counts conflicts when the lib updates a PVC
+// to remove the annotation. The lib itself only logs them and
+// retries later.
+type conflictCountingClient struct {
+	kubernetes.Interface
+}
+
+func (c conflictCountingClient) CoreV1() corev1client.CoreV1Interface {
+	return conflictCountingCoreV1{c.Interface.CoreV1()}
+}
+
+type conflictCountingCoreV1 struct {
+	corev1client.CoreV1Interface
+}
+
+func (c conflictCountingCoreV1) PersistentVolumeClaims(namespace string) corev1client.PersistentVolumeClaimInterface {
+	return conflictCountingPVCs{c.CoreV1Interface.PersistentVolumeClaims(namespace)}
+}
+
+type conflictCountingPVCs struct {
+	corev1client.PersistentVolumeClaimInterface
+}
+
+func (c conflictCountingPVCs) Update(ctx context.Context, pvc *v1.PersistentVolumeClaim, opts metav1.UpdateOptions) (*v1.PersistentVolumeClaim, error) {
+	result, err := c.PersistentVolumeClaimInterface.Update(ctx, pvc, opts)
+	if apierrs.IsConflict(err) {
+		reschedulerConflicts.Inc()
+	}
+	return result, err
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/klog/v2/ktesting"
+	"sigs.k8s.io/sig-storage-lib-external-provisioner/v6/controller"
+
+	"github.com/intel/pmem-csi/pkg/types"
+)
+
+func TestReschedulerMetrics(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	reg := prometheus.NewPedanticRegistry()
+	MustRegisterReschedulerMetrics(reg, driverName)
+
+	csiNode := &storagev1.CSINode{
+		ObjectMeta: metav1.ObjectMeta{Name: nodeName},
+		Spec: storagev1.CSINodeSpec{
+			Drivers: []storagev1.CSINodeDriver{{Name: driverName}},
+		},
+	}
+	client := fake.NewSimpleClientset(csiNode)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	pcp := &pmemCSIProvisioner{
+		driverNames:   []string{driverName},
+		nodeSelector:  types.NodeSelector{nodeLabelName: nodeLabelValue},
+		csiNodeLister: factory.Storage().V1().CSINodes().Lister(),
+	}
+	require.NoError(t, pcp.watchDriverRemovals(factory.Storage().V1().CSINodes().Informer()), "watch")
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+
+	pvc := &v1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{annSelectedNode: nodeName},
+		},
+	}
+	oldExamined := testutil.ToFloat64(reschedulerExamined.WithLabelValues("csinode", "keep"))
+	assert.False(t, pcp.ShouldProvision(ctx, pvc), "driver is running")
+	assert.Equal(t, oldExamined+1, testutil.ToFloat64(reschedulerExamined.WithLabelValues("csinode", "keep")), "examined")
+	_, removed := pcp.removals.get(nodeName)
+	assert.False(t, removed, "driver not removed yet")
+
+	// The driver gets removed from the node.
+	csiNode = csiNode.DeepCopy()
+	csiNode.Spec.Drivers = nil
+	_, err := client.StorageV1().CSINodes().Update(ctx, csiNode, metav1.UpdateOptions{})
+	require.NoError(t, err, "update CSINode")
+	require.Eventually(t, func() bool {
+		_, removed := pcp.removals.get(nodeName)
+		return removed
+	}, 10*time.Second, 10*time.Millisecond, "driver removal")
+
+	oldReschedules := testutil.ToFloat64(reschedulerReschedules)
+	oldDelay := sampleCount(t, reschedulerDelay)
+	_, state, _ := pcp.Provision(ctx, controller.ProvisionOptions{
+		PVC:          pvc,
+		SelectedNode: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}},
+	})
+	assert.Equal(t, controller.ProvisioningReschedule, state, "reschedule")
+	assert.Equal(t, oldReschedules+1, testutil.ToFloat64(reschedulerReschedules), "reschedules")
+	assert.Equal(t, oldDelay+1, sampleCount(t, reschedulerDelay), "delay")
+
+	// In dry-run mode, the PVC is left alone.
+	pcp.dryRun = true
+	oldDryRun := testutil.ToFloat64(reschedulerDryRunReschedules)
+	_, state, err = pcp.Provision(ctx, controller.ProvisionOptions{
+		PVC:          pvc,
+		SelectedNode: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: nodeName}},
+	})
+	assert.Equal(t, controller.ProvisioningNoChange, state, "dry run")
+	assert.IsType(t, &controller.IgnoredError{}, err, "dry run")
+	assert.Equal(t, oldDryRun+1, testutil.ToFloat64(reschedulerDryRunReschedules), "dry-run reschedules")
+	assert.Equal(t, oldReschedules+1, testutil.ToFloat64(reschedulerReschedules), "no reschedules in dry-run mode")
+
+	// Removing the annotation runs into a conflict.
+	client.PrependReactor("update", "persistentvolumeclaims", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrs.NewConflict(schema.GroupResource{Resource: "persistentvolumeclaims"}, "pvc", nil)
+	})
+	oldConflicts := testutil.ToFloat64(reschedulerConflicts)
+	_, err = conflictCountingClient{client}.CoreV1().PersistentVolumeClaims("default").Update(ctx, pvc, metav1.UpdateOptions{})
+	assert.True(t, apierrs.IsConflict(err), "conflict")
+	assert.Equal(t, oldConflicts+1, testutil.ToFloat64(reschedulerConflicts), "conflicts")
+}
+
+func sampleCount(t *testing.T, histogram prometheus.Histogram) uint64 {
+	var m dto.Metric
+	require.NoError(t, histogram.Write(&m), "write histogram")
+	return m.GetHistogram().GetSampleCount()
+}
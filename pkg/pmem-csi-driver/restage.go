@@ -0,0 +1,107 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// stagedVolume is what NodeStageVolume needs to stage a volume again
+// without kubelet. Secrets are not part of it, encrypted volumes can
+// only be restored with a key provider.
+type stagedVolume struct {
+	StagingTargetPath string            `json:"stagingTargetPath"`
+	FsType            string            `json:"fsType"`
+	MountFlags        []string          `json:"mountFlags,omitempty"`
+	VolumeContext     map[string]string `json:"volumeContext,omitempty"`
+}
+
+// setStaged must be called while holding the volumeMutex for the
+// volume. It records (staged != nil) or forgets (staged == nil) the
+// staging of the volume in the volume state. Volumes which are not in
+// the state get ignored.
+func (cs *nodeControllerServer) setStaged(ctx context.Context, volumeID string, staged *stagedVolume) error {
+	vol := cs.getVolumeByID(volumeID)
+	if vol == nil {
+		return nil
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if vol.Staged == nil && staged == nil {
+		return nil
+	}
+	vol.Staged = staged
+	if cs.sm != nil {
+		if err := cs.sm.Create(vol.ID, vol); err != nil {
+			return status.Errorf(codes.Internal, "record staging of volume: %v", err)
+		}
+	}
+	klog.FromContext(ctx).V(4).Info("Updated staging", "staged", staged != nil)
+	return nil
+}
+
+// restoreStagedVolumes stages all volumes again which were staged
+// before a reboot of the node, which opens the mappings of encrypted
+// volumes and mounts the filesystems. Then kubelet only has to
+// publish the volumes to start the pods. Volumes which cannot be
+// restored, for example encrypted volumes which get their passphrase
+// from the secrets, are left to kubelet, it stages them again when
+// they are needed. The staging of volumes where kubelet has removed
+// the staging directory is forgotten. It must be called after
+// cleanupEphemeralVolumes and before the server starts handling
+// requests.
+func (ns *nodeServer) restoreStagedVolumes(ctx context.Context) {
+	logger := klog.FromContext(ctx).WithName("restoreStagedVolumes")
+	ctx = klog.NewContext(ctx, logger)
+	staged := map[string]stagedVolume{}
+	ns.cs.mutex.Lock()
+	for id, vol := range ns.cs.pmemVolumes {
+		if vol.Staged != nil {
+			staged[id] = *vol.Staged
+		}
+	}
+	ns.cs.mutex.Unlock()
+
+	for id, s := range staged {
+		logger := logger.WithValues("volume-id", id, "staging-target-path", s.StagingTargetPath)
+		ctx := klog.NewContext(ctx, logger)
+		if _, err := os.Stat(filepath.Dir(s.StagingTargetPath)); os.IsNotExist(err) {
+			logger.Info("Forgetting staging of volume, kubelet has removed the staging directory")
+			if err := ns.cs.setStaged(ctx, id, nil); err != nil {
+				logger.Error(err, "Forgetting staging failed")
+			}
+			continue
+		}
+		if notMnt, err := ns.mounter.IsLikelyNotMountPoint(s.StagingTargetPath); err == nil && !notMnt {
+			logger.V(3).Info("Volume is still staged")
+			continue
+		}
+		logger.Info("Staging volume again")
+		if _, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          id,
+			StagingTargetPath: s.StagingTargetPath,
+			VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Mount{
+					Mount: &csi.VolumeCapability_MountVolume{
+						FsType:     s.FsType,
+						MountFlags: s.MountFlags,
+					},
+				},
+			},
+			VolumeContext: s.VolumeContext,
+		}); err != nil {
+			logger.Info("Staging volume again failed, leaving it to kubelet", "err", err)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+	"k8s.io/mount-utils"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestRestoreStagedVolumes(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create volume state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+
+	pvs := t.TempDir()
+	create := func(name string) (string, string) {
+		volumeID, _, err := cs.createVolumeInternal(ctx, parameters.Volume{}, name,
+			[]*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			}},
+			&csi.CapacityRange{RequiredBytes: 1024 * 1024},
+			nil,
+			nil,
+		)
+		require.NoError(t, err, "create volume %s", name)
+		stagingPath := filepath.Join(pvs, name, "globalmount")
+		require.NoError(t, os.MkdirAll(stagingPath, 0755), "create staging directory")
+		require.NoError(t, cs.setStaged(ctx, volumeID, &stagedVolume{
+			StagingTargetPath: stagingPath,
+			FsType:            "xfs",
+			VolumeContext:     map[string]string{parameters.Encryption: string(parameters.EncryptionLUKS2)},
+		}), "record staging of %s", name)
+		return volumeID, stagingPath
+	}
+	removed, _ := create("removed")
+	mounted, mountedPath := create("mounted")
+	encrypted, _ := create("encrypted")
+	unstaged, _ := create("unstaged")
+	require.NoError(t, cs.setStaged(ctx, unstaged, nil), "forget staging")
+	require.NoError(t, os.RemoveAll(filepath.Join(pvs, "removed")), "remove PV directory")
+
+	// As after a reboot of the node.
+	cs = NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	ns := NewNodeServer(cs, t.TempDir())
+	ns.mounter = mount.NewFakeMounter([]mount.MountPoint{{Path: mountedPath}})
+	ns.restoreStagedVolumes(ctx)
+
+	assert.Nil(t, cs.getVolumeByID(removed).Staged, "volume with removed staging directory")
+	assert.NotNil(t, cs.getVolumeByID(mounted).Staged, "volume which is still mounted")
+	// Without a key provider, the passphrase is only available
+	// when kubelet stages the volume.
+	assert.NotNil(t, cs.getVolumeByID(encrypted).Staged, "encrypted volume")
+	assert.Nil(t, cs.getVolumeByID(unstaged).Staged, "unstaged volume")
+	assert.Empty(t, ns.mounter.(*mount.FakeMounter).GetLog(), "mount operations")
+
+	stored := &nodeVolume{}
+	require.NoError(t, sm.Get(removed, stored), "get volume state")
+	assert.Nil(t, stored.Staged, "stored staging of volume with removed staging directory")
+}
@@ -0,0 +1,84 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"fmt"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// applyRootPermissions must be called while holding the volumeMutex
+// for the volume. It sets mode and owner of the root directory of the
+// mounted filesystem at path as configured in the volume parameters.
+// For persistent volumes that happens once unless the parameters ask
+// for it on every publish, ephemeral volumes always get a new
+// filesystem.
+func (ns *nodeServer) applyRootPermissions(ctx context.Context, volumeID string, ephemeral bool, p parameters.Volume, path string) error {
+	if !p.HasRootPermissions() {
+		return nil
+	}
+	logger := klog.FromContext(ctx)
+	var vol *nodeVolume
+	if !ephemeral {
+		vol = ns.cs.getVolumeByID(volumeID)
+		if vol != nil && vol.RootPermissionsApplied && p.GetRootApply() == parameters.RootApplyFirstPublish {
+			logger.V(5).Info("Root permissions already applied", "path", path)
+			return nil
+		}
+	}
+
+	// -1 leaves the uid or gid unchanged.
+	uid, gid := -1, -1
+	if p.RootUID != nil {
+		uid = int(*p.RootUID)
+	}
+	if p.RootGID != nil {
+		gid = int(*p.RootGID)
+	}
+	if uid != -1 || gid != -1 {
+		if err := unix.Lchown(path, uid, gid); err != nil {
+			return status.Errorf(codes.Internal, "change owner of volume root: %v", err)
+		}
+	}
+	// After chown because that clears the setuid and setgid bits.
+	mode := "unchanged"
+	if p.RootMode != nil {
+		if err := unix.Chmod(path, *p.RootMode); err != nil {
+			return status.Errorf(codes.Internal, "change mode of volume root: %v", err)
+		}
+		mode = fmt.Sprintf("%04o", *p.RootMode)
+	}
+	logger.V(3).Info("Applied root permissions", "path", path, "uid", uid, "gid", gid, "mode", mode)
+
+	if vol != nil {
+		return ns.cs.setRootPermissionsApplied(ctx, vol)
+	}
+	return nil
+}
+
+func (cs *nodeControllerServer) setRootPermissionsApplied(ctx context.Context, vol *nodeVolume) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if vol.RootPermissionsApplied {
+		return nil
+	}
+	vol.RootPermissionsApplied = true
+	if cs.sm != nil {
+		if err := cs.sm.Create(vol.ID, vol); err != nil {
+			return status.Errorf(codes.Internal, "record root permissions of volume: %v", err)
+		}
+	}
+	klog.FromContext(ctx).V(4).Info("Recorded root permissions")
+	return nil
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestApplyRootPermissions(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create volume state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	ns := &nodeServer{cs: cs}
+	volumeID, _, err := cs.createVolumeInternal(ctx, parameters.Volume{}, "vol",
+		[]*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		}},
+		&csi.CapacityRange{RequiredBytes: 1024 * 1024},
+		nil,
+		nil,
+	)
+	require.NoError(t, err, "create volume")
+
+	root := t.TempDir()
+	mode := func() uint32 {
+		var st unix.Stat_t
+		require.NoError(t, unix.Stat(root, &st), "stat root")
+		return st.Mode & 07777
+	}
+	// Changing the group to our own group is permitted without
+	// privileges.
+	gid := uint32(os.Getgid())
+	m2770 := uint32(02770)
+	p := parameters.Volume{RootMode: &m2770, RootGID: &gid}
+	require.NoError(t, ns.applyRootPermissions(ctx, volumeID, false, p, root), "first publish")
+	assert.Equal(t, uint32(02770), mode(), "mode after first publish")
+	stored := &nodeVolume{}
+	require.NoError(t, sm.Get(volumeID, stored), "stored volume")
+	assert.True(t, stored.RootPermissionsApplied, "recorded in state")
+
+	require.NoError(t, os.Chmod(root, 0700), "change mode")
+	require.NoError(t, ns.applyRootPermissions(ctx, volumeID, false, p, root), "second publish")
+	assert.Equal(t, uint32(0700), mode(), "mode only set at first publish")
+
+	always := parameters.RootApplyEveryPublish
+	p.RootApply = &always
+	require.NoError(t, ns.applyRootPermissions(ctx, volumeID, false, p, root), "publish with everyPublish")
+	assert.Equal(t, uint32(02770), mode(), "mode set again")
+
+	require.NoError(t, os.Chmod(root, 0700), "change mode")
+	p.RootApply = nil
+	require.NoError(t, ns.applyRootPermissions(ctx, "ephemeral", true, p, root), "ephemeral volume")
+	assert.Equal(t, uint32(02770), mode(), "mode of ephemeral volume")
+}
@@ -0,0 +1,146 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// rotateKey implements the rotate-key mode. The new passphrase gets
+// added to a free LUKS keyslot before the old one is removed, so the
+// volume stays accessible when something fails in between. The
+// volume key which encrypts the data does not change, therefore the
+// volume may remain in use.
+func (csid *csiDriver) rotateKey(ctx context.Context) error {
+	ctx, logger := pmemlog.WithName(ctx, "rotateKey")
+	volumeID := csid.cfg.volumeID
+	if volumeID == "" {
+		return errors.New("-volumeID is required")
+	}
+	logger = logger.WithValues("volume-id", volumeID)
+	ctx = klog.NewContext(ctx, logger)
+
+	sm, err := pmemstate.NewDBState(csid.cfg.StateBasePath)
+	if err != nil {
+		return err
+	}
+	vol := &nodeVolume{}
+	if err := sm.Get(volumeID, vol); err != nil {
+		return fmt.Errorf("volume %s: %v", volumeID, err)
+	}
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+	if err != nil {
+		return fmt.Errorf("parse volume parameters: %v", err)
+	}
+	if p.GetEncryption() == parameters.EncryptionNone {
+		return fmt.Errorf("volume %s is not encrypted", volumeID)
+	}
+	// Zero percentage because nothing but the keyslots get changed.
+	dm, err := pmdmanager.New(ctx, p.GetDeviceMode(), 0, csid.deviceManagerOptions())
+	if err != nil {
+		return fmt.Errorf("initialize device manager for mode %q: %v", p.GetDeviceMode(), err)
+	}
+	device, err := dm.GetDevice(ctx, volumeID)
+	if err != nil {
+		return err
+	}
+
+	var vault *vaultKeys
+	var oldPassphrase, newPassphrase string
+	switch csid.cfg.keyProvider {
+	case KeyProviderVault:
+		vault, err = newVaultKeys(csid.cfg.vaultAddress, csid.cfg.vaultTokenFile, csid.cfg.vaultKVMount, csid.cfg.vaultKVPrefix, csid.cfg.vaultCAFile, 0)
+		if err != nil {
+			return err
+		}
+		if oldPassphrase, err = vault.getKey(ctx, volumeID, nil); err != nil {
+			return err
+		}
+		if newPassphrase, err = generateKey(); err != nil {
+			return fmt.Errorf("generate key: %v", err)
+		}
+	default:
+		if csid.cfg.oldPassphraseFile == "" || csid.cfg.newPassphraseFile == "" {
+			return errors.New("-oldPassphraseFile and -newPassphraseFile are required for -keyProvider=secret")
+		}
+		if oldPassphrase, err = readPassphrase(csid.cfg.oldPassphraseFile); err != nil {
+			return err
+		}
+		if newPassphrase, err = readPassphrase(csid.cfg.newPassphraseFile); err != nil {
+			return err
+		}
+	}
+	if oldPassphrase == newPassphrase {
+		return errors.New("new passphrase is the same as the current one")
+	}
+
+	if err := luksAddKey(ctx, device.Path, oldPassphrase, newPassphrase); err != nil {
+		return err
+	}
+	if vault != nil {
+		if err := vault.replaceKey(ctx, volumeID, newPassphrase); err != nil {
+			// The old passphrase remains valid.
+			return err
+		}
+	}
+	logger.V(3).Info("Removing old passphrase", "device", device.Path)
+	if err := runCryptsetup(ctx, oldPassphrase, "luksRemoveKey", "--key-file=-", device.Path); err != nil {
+		return fmt.Errorf("remove old passphrase of %s: %v", device.Path, err)
+	}
+	logger.Info("Key rotated")
+	return nil
+}
+
+// readPassphrase reads a passphrase from a file, without a trailing
+// newline.
+func readPassphrase(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("read passphrase: %v", err)
+	}
+	passphrase := strings.TrimSuffix(string(data), "\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase file %s is empty", path)
+	}
+	return passphrase, nil
+}
+
+// luksAddKey adds the new passphrase to a free keyslot. The old one
+// is passed via stdin, the new one via a pipe, neither of them are in
+// the command line.
+func luksAddKey(ctx context.Context, devicePath, oldPassphrase, newPassphrase string) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	go func() {
+		defer w.Close()
+		_, _ = w.WriteString(newPassphrase)
+	}()
+	klog.FromContext(ctx).V(3).Info("Adding new passphrase", "device", devicePath)
+	cmd := exec.Command("cryptsetup", "luksAddKey", "--key-file=-", devicePath, "/dev/fd/3")
+	cmd.Stdin = strings.NewReader(oldPassphrase)
+	cmd.ExtraFiles = []*os.File{r}
+	if _, err := pmemexec.Run(ctx, cmd); err != nil {
+		return fmt.Errorf("add new passphrase to %s: %v", devicePath, err)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+)
+
+func TestRotateKey(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	stateDir := t.TempDir()
+	sm, err := pmemstate.NewFileState(stateDir)
+	require.NoError(t, err, "create state")
+	require.NoError(t, sm.Create("vol-1", &nodeVolume{ID: "vol-1", Size: 1024, Params: map[string]string{}}), "store volume")
+
+	csid := &csiDriver{cfg: Config{Mode: RotateKey, StateBasePath: stateDir, keyProvider: KeyProviderSecret}}
+	assert.EqualError(t, csid.rotateKey(ctx), "-volumeID is required")
+	csid.cfg.volumeID = "vol-1"
+	assert.EqualError(t, csid.rotateKey(ctx), "volume vol-1 is not encrypted")
+	csid.cfg.volumeID = "vol-2"
+	assert.Error(t, csid.rotateKey(ctx), "unknown volume")
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "passphrase")
+	require.NoError(t, os.WriteFile(path, []byte("secret\n"), 0600), "write passphrase")
+	passphrase, err := readPassphrase(path)
+	require.NoError(t, err, "read passphrase")
+	assert.Equal(t, "secret", passphrase, "without newline")
+	require.NoError(t, os.WriteFile(path, []byte("\n"), 0600), "write empty passphrase")
+	_, err = readPassphrase(path)
+	assert.Error(t, err, "empty passphrase")
+	_, err = readPassphrase(filepath.Join(dir, "no-such-file"))
+	assert.Error(t, err, "missing file")
+}
@@ -0,0 +1,356 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	v1 "k8s.io/api/core/v1"
+	apierrs "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelistersv1 "k8s.io/client-go/listers/core/v1"
+	storagelistersv1 "k8s.io/client-go/listers/storage/v1"
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// extenderArgs and extenderFilterResult are the JSON messages of the
+// kube-scheduler extender API (k8s.io/kube-scheduler/extender/v1),
+// limited to the fields that the filter needs.
+type extenderArgs struct {
+	Pod *v1.Pod `json:"pod"`
+	// Nodes is set unless the extender is configured as
+	// nodeCacheCapable, then only NodeNames are sent.
+	Nodes     *v1.NodeList `json:"nodes,omitempty"`
+	NodeNames *[]string    `json:"nodenames,omitempty"`
+}
+
+type extenderFilterResult struct {
+	Nodes       *v1.NodeList      `json:"nodes,omitempty"`
+	NodeNames   *[]string         `json:"nodenames,omitempty"`
+	FailedNodes map[string]string `json:"failedNodes,omitempty"`
+	Error       string            `json:"error,omitempty"`
+}
+
+var (
+	schedulerRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "scheduler_request_duration_seconds",
+			Help: "Latencies for PMEM-CSI scheduler HTTP requests by operation and method.",
+		},
+		[]string{"operation", "method"},
+	)
+	schedulerInFlightRequests = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "scheduler_in_flight_requests",
+			Help: "Currently pending PMEM-CSI scheduler HTTP requests.",
+		},
+	)
+	schedulerRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "scheduler_requests_total",
+			Help: "Number of HTTP requests to the PMEM-CSI scheduler, regardless of operation and method.",
+		},
+		nil,
+	)
+	schedulerResponseSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "scheduler_response_size_bytes",
+			Help:    "Histogram of response sizes for PMEM-CSI scheduler requests, regardless of operation and method.",
+			Buckets: prometheus.ExponentialBuckets(100, 10, 6),
+		},
+		nil,
+	)
+)
+
+// MustRegisterSchedulerMetrics adds the metrics of the scheduler
+// HTTP server to the registry, using a label to tag each sample with
+// the driver name.
+func MustRegisterSchedulerMetrics(reg prometheus.Registerer, driverName string) {
+	reg = prometheus.WrapRegistererWith(prometheus.Labels{"driver_name": driverName}, reg)
+	reg.MustRegister(schedulerRequestDuration)
+	reg.MustRegister(schedulerInFlightRequests)
+	reg.MustRegister(schedulerRequests)
+	reg.MustRegister(schedulerResponseSize)
+}
+
+// instrumentScheduler records the scheduler metrics for a handler.
+func instrumentScheduler(operation string, handler http.Handler) http.Handler {
+	duration := schedulerRequestDuration.MustCurryWith(prometheus.Labels{"operation": operation})
+	return promhttp.InstrumentHandlerInFlight(schedulerInFlightRequests,
+		promhttp.InstrumentHandlerDuration(duration,
+			promhttp.InstrumentHandlerCounter(schedulerRequests,
+				promhttp.InstrumentHandlerResponseSize(schedulerResponseSize, handler))))
+}
+
+// schedulerExtender implements the filter and prioritize calls of a
+// kube-scheduler extender. It rejects nodes which do not have enough
+// PMEM for the volumes that still need to be created for a pod and
+// ranks the remaining ones. Like the capacity report, it only uses
+// informers.
+type schedulerExtender struct {
+	driverName string
+	pvcLister  corelistersv1.PersistentVolumeClaimLister
+	scLister   storagelistersv1.StorageClassLister
+	// nil if the cluster doesn't support CSIStorageCapacity v1.
+	capacityLister storagelistersv1.CSIStorageCapacityLister
+	// resourceName is the extended resource which the pod mutation
+	// webhook adds, empty if disabled.
+	resourceName v1.ResourceName
+	// scoring is used by prioritize.
+	scoring SchedulerScoring
+}
+
+// newSchedulerExtender must be called before starting the factory.
+func newSchedulerExtender(ctx context.Context, driverName string, scoring SchedulerScoring, kubeClient kubernetes.Interface, factory informers.SharedInformerFactory) *schedulerExtender {
+	se := &schedulerExtender{
+		driverName: driverName,
+		scoring:    scoring,
+		pvcLister:  factory.Core().V1().PersistentVolumeClaims().Lister(),
+		scLister:   factory.Storage().V1().StorageClasses().Lister(),
+	}
+	if hasStorageCapacity(kubeClient) {
+		se.capacityLister = factory.Storage().V1().CSIStorageCapacities().Lister()
+	} else {
+		klog.FromContext(ctx).Info("CSIStorageCapacity v1 not supported, scheduler extender accepts all nodes")
+	}
+	return se
+}
+
+// filter handles POST requests with extenderArgs.
+func (se *schedulerExtender) filter(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var args extenderArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, fmt.Sprintf("decode extender arguments: %v", err), http.StatusBadRequest)
+		return
+	}
+	result := se.filterNodes(r.Context(), &args)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		klog.FromContext(r.Context()).Error(err, "Encoding filter result failed")
+	}
+}
+
+// filterNodes keeps those nodes which have enough capacity. Errors
+// are reported to the scheduler in the result.
+func (se *schedulerExtender) filterNodes(ctx context.Context, args *extenderArgs) *extenderFilterResult {
+	logger := klog.FromContext(ctx).WithName("scheduler-extender")
+	result := &extenderFilterResult{FailedNodes: map[string]string{}}
+	if args.Pod == nil {
+		result.Error = "pod missing"
+		return result
+	}
+	logger = logger.WithValues("pod", pmemlog.KObj(args.Pod))
+	sizes, err := se.podVolumeSizes(args.Pod, false)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	var capacities map[string]nodeCapacity
+	if len(sizes) > 0 && se.capacityLister != nil {
+		capacities, err = se.nodeCapacities(args.Pod)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+	}
+	fits := func(nodeName string) bool {
+		if capacities == nil {
+			return true
+		}
+		reason := capacities[nodeName].fits(sizes)
+		if reason != "" {
+			result.FailedNodes[nodeName] = reason
+			return false
+		}
+		return true
+	}
+
+	if args.NodeNames != nil {
+		nodeNames := []string{}
+		for _, nodeName := range *args.NodeNames {
+			if fits(nodeName) {
+				nodeNames = append(nodeNames, nodeName)
+			}
+		}
+		result.NodeNames = &nodeNames
+	} else if args.Nodes != nil {
+		nodes := &v1.NodeList{}
+		for _, node := range args.Nodes.Items {
+			if fits(node.Name) {
+				nodes.Items = append(nodes.Items, node)
+			}
+		}
+		result.Nodes = nodes
+	}
+	logger.V(5).Info("Filtered nodes", "volume-sizes", sizes, "failed-nodes", result.FailedNodes)
+	return result
+}
+
+// podVolumeSizes returns the sizes of the PMEM-CSI volumes which
+// still need to be created for the pod: unbound PVCs, PVCs of generic
+// ephemeral volumes which were not created yet, and CSI ephemeral
+// inline volumes. includeBound adds the sizes of bound PVCs.
+func (se *schedulerExtender) podVolumeSizes(pod *v1.Pod, includeBound bool) ([]int64, error) {
+	var sizes []int64
+	for _, volume := range pod.Spec.Volumes {
+		var claimName string
+		switch {
+		case volume.PersistentVolumeClaim != nil:
+			claimName = volume.PersistentVolumeClaim.ClaimName
+		case volume.Ephemeral != nil:
+			claimName = pod.Name + "-" + volume.Name
+		case volume.CSI != nil && volume.CSI.Driver == se.driverName:
+			value := volume.CSI.VolumeAttributes[parameters.Size]
+			if value == "" {
+				continue
+			}
+			quantity, err := resource.ParseQuantity(value)
+			if err != nil {
+				return nil, fmt.Errorf("volume %q: parameter %q: %v", volume.Name, parameters.Size, err)
+			}
+			sizes = append(sizes, quantity.Value())
+			continue
+		default:
+			continue
+		}
+
+		var spec *v1.PersistentVolumeClaimSpec
+		pvc, err := se.pvcLister.PersistentVolumeClaims(pod.Namespace).Get(claimName)
+		switch {
+		case err == nil:
+			if pvc.Spec.VolumeName != "" && !includeBound {
+				// Already bound.
+				continue
+			}
+			spec = &pvc.Spec
+		case apierrs.IsNotFound(err) && volume.Ephemeral != nil && volume.Ephemeral.VolumeClaimTemplate != nil:
+			spec = &volume.Ephemeral.VolumeClaimTemplate.Spec
+		case apierrs.IsNotFound(err):
+			// The scheduler waits for the PVC.
+			continue
+		default:
+			return nil, fmt.Errorf("get PVC %s/%s: %v", pod.Namespace, claimName, err)
+		}
+		if spec.StorageClassName == nil || *spec.StorageClassName == "" {
+			continue
+		}
+		sc, err := se.scLister.Get(*spec.StorageClassName)
+		if err != nil {
+			if apierrs.IsNotFound(err) {
+				continue
+			}
+			return nil, fmt.Errorf("get storage class %s: %v", *spec.StorageClassName, err)
+		}
+		if sc.Provisioner != se.driverName {
+			continue
+		}
+		size := spec.Resources.Requests[v1.ResourceStorage]
+		sizes = append(sizes, size.Value())
+	}
+	return sizes, nil
+}
+
+// nodeCapacity is what a node can still provide for new volumes.
+type nodeCapacity struct {
+	// available and maximumVolumeSize are nil when unknown.
+	available         *resource.Quantity
+	maximumVolumeSize *resource.Quantity
+	// pending is the sum of the sizes of PVCs for other pods which
+	// are assigned to the node and not provisioned yet.
+	pending int64
+}
+
+// fits returns an empty string if all volumes fit onto the node,
+// otherwise the reason why not.
+func (nc nodeCapacity) fits(sizes []int64) string {
+	if nc.available == nil {
+		return "no PMEM capacity reported for the node"
+	}
+	var sum int64
+	for _, size := range sizes {
+		if nc.maximumVolumeSize != nil && size > nc.maximumVolumeSize.Value() {
+			return fmt.Sprintf("volume of %s is larger than the maximum volume size %s", pmemlog.CapacityRef(size), pmemlog.CapacityRef(nc.maximumVolumeSize.Value()))
+		}
+		sum += size
+	}
+	if available := nc.available.Value() - nc.pending; sum > available {
+		return fmt.Sprintf("volumes need %s, only %s PMEM available", pmemlog.CapacityRef(sum), pmemlog.CapacityRef(available))
+	}
+	return ""
+}
+
+// nodeCapacities collects the capacity of all nodes from the
+// CSIStorageCapacity objects of the driver.
+func (se *schedulerExtender) nodeCapacities(pod *v1.Pod) (map[string]nodeCapacity, error) {
+	capacities, err := se.capacityLister.List(labels.SelectorFromSet(labels.Set{csiDriverNameLabel: se.driverName}))
+	if err != nil {
+		return nil, fmt.Errorf("list CSIStorageCapacity objects: %v", err)
+	}
+	nodes := map[string]nodeCapacity{}
+	// There is one object per node and storage class. They all
+	// describe the same PMEM, so use the maximum.
+	for _, capacity := range capacities {
+		if capacity.NodeTopology == nil || capacity.NodeTopology.MatchLabels[DriverTopologyKey] == "" {
+			continue
+		}
+		nodeName := capacity.NodeTopology.MatchLabels[DriverTopologyKey]
+		node := nodes[nodeName]
+		maxQuantity(&node.available, capacity.Capacity)
+		maxQuantity(&node.maximumVolumeSize, capacity.MaximumVolumeSize)
+		nodes[nodeName] = node
+	}
+
+	// CSIStorageCapacity only gets updated after provisioning.
+	pvcs, err := se.pvcLister.List(labels.Everything())
+	if err != nil {
+		return nil, fmt.Errorf("list PVCs: %v", err)
+	}
+	for _, pvc := range pvcs {
+		if pvc.Status.Phase != v1.ClaimPending || pvc.Namespace == pod.Namespace && isPodVolume(pod, pvc.Name) {
+			continue
+		}
+		if pvc.Annotations[annStorageProvisioner] != se.driverName &&
+			pvc.Annotations[annBetaStorageProvisioner] != se.driverName {
+			continue
+		}
+		nodeName := pvc.Annotations[annSelectedNode]
+		if node, ok := nodes[nodeName]; ok {
+			size := pvc.Spec.Resources.Requests[v1.ResourceStorage]
+			node.pending += size.Value()
+			nodes[nodeName] = node
+		}
+	}
+	return nodes, nil
+}
+
+// isPodVolume checks whether the pod uses the PVC.
+func isPodVolume(pod *v1.Pod, claimName string) bool {
+	for _, volume := range pod.Spec.Volumes {
+		switch {
+		case volume.PersistentVolumeClaim != nil && volume.PersistentVolumeClaim.ClaimName == claimName,
+			volume.Ephemeral != nil && pod.Name+"-"+volume.Name == claimName:
+			return true
+		}
+	}
+	return false
+}
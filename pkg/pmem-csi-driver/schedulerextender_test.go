@@ -0,0 +1,176 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	v1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestSchedulerExtender(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	DriverTopologyKey = driverName + "/node"
+	pmemClass := "pmem-csi-sc"
+	otherClass := "other-sc"
+	gi := resource.MustParse("1Gi")
+	capacity := func(node string, available, maximum string) *storagev1.CSIStorageCapacity {
+		a := resource.MustParse(available)
+		m := resource.MustParse(maximum)
+		return &storagev1.CSIStorageCapacity{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "capacity-" + node,
+				Namespace: "pmem-csi",
+				Labels:    map[string]string{csiDriverNameLabel: driverName},
+			},
+			NodeTopology:      &metav1.LabelSelector{MatchLabels: map[string]string{DriverTopologyKey: node}},
+			StorageClassName:  pmemClass,
+			Capacity:          &a,
+			MaximumVolumeSize: &m,
+		}
+	}
+	pvc := func(name, class string, size resource.Quantity) *v1.PersistentVolumeClaim {
+		return &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "default"},
+			Spec: v1.PersistentVolumeClaimSpec{
+				StorageClassName: &class,
+				Resources: v1.VolumeResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceStorage: size},
+				},
+			},
+			Status: v1.PersistentVolumeClaimStatus{Phase: v1.ClaimPending},
+		}
+	}
+	bound := pvc("bound", pmemClass, resource.MustParse("100Gi"))
+	bound.Spec.VolumeName = "pv-bound"
+	pending := pvc("pending-elsewhere", pmemClass, resource.MustParse("3Gi"))
+	pending.Annotations = map[string]string{annStorageProvisioner: driverName, annSelectedNode: "worker-2"}
+
+	objects := []runtime.Object{
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: pmemClass}, Provisioner: driverName},
+		&storagev1.StorageClass{ObjectMeta: metav1.ObjectMeta{Name: otherClass}, Provisioner: "other.example.com"},
+		pvc("data", pmemClass, resource.MustParse("2Gi")),
+		pvc("logs", pmemClass, gi),
+		pvc("other", otherClass, resource.MustParse("100Gi")),
+		bound,
+		pending,
+		capacity("worker-1", "10Gi", "10Gi"),
+		capacity("worker-2", "5Gi", "5Gi"),
+		capacity("worker-3", "10Gi", "1Gi"),
+		capacity("worker-5", "7Gi", "7Gi"),
+	}
+	client := fake.NewSimpleClientset(objects...)
+	factory := informers.NewSharedInformerFactory(client, 0)
+	se := &schedulerExtender{
+		driverName:     driverName,
+		pvcLister:      factory.Core().V1().PersistentVolumeClaims().Lister(),
+		scLister:       factory.Storage().V1().StorageClasses().Lister(),
+		capacityLister: factory.Storage().V1().CSIStorageCapacities().Lister(),
+	}
+	factory.Start(ctx.Done())
+	factory.WaitForCacheSync(ctx.Done())
+
+	claim := func(name string) v1.Volume {
+		return v1.Volume{Name: name, VolumeSource: v1.VolumeSource{PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: name}}}
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.PodSpec{
+			Volumes: []v1.Volume{
+				claim("data"),
+				claim("logs"),
+				claim("other"),
+				claim("bound"),
+				{Name: "scratch", VolumeSource: v1.VolumeSource{Ephemeral: &v1.EphemeralVolumeSource{
+					VolumeClaimTemplate: &v1.PersistentVolumeClaimTemplate{Spec: pvc("", pmemClass, gi).Spec},
+				}}},
+				{Name: "inline", VolumeSource: v1.VolumeSource{CSI: &v1.CSIVolumeSource{
+					Driver:           driverName,
+					VolumeAttributes: map[string]string{parameters.Size: "1Gi"},
+				}}},
+			},
+		},
+	}
+	sizes, err := se.podVolumeSizes(pod, false)
+	require.NoError(t, err, "pod volume sizes")
+	assert.Equal(t, []int64{2 * gi.Value(), gi.Value(), gi.Value(), gi.Value()}, sizes, "pod volume sizes")
+	sizes, err = se.podVolumeSizes(pod, true)
+	require.NoError(t, err, "pod volume sizes with bound PVC")
+	assert.Equal(t, []int64{2 * gi.Value(), gi.Value(), 100 * gi.Value(), gi.Value(), gi.Value()}, sizes, "pod volume sizes with bound PVC")
+
+	nodeNames := []string{"worker-1", "worker-2", "worker-3", "worker-4"}
+	body, err := json.Marshal(extenderArgs{Pod: pod, NodeNames: &nodeNames})
+	require.NoError(t, err, "encode args")
+	rec := httptest.NewRecorder()
+	se.filter(rec, httptest.NewRequest(http.MethodPost, "/filter", bytes.NewReader(body)))
+	require.Equal(t, http.StatusOK, rec.Code, "filter")
+	var result extenderFilterResult
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &result), "decode result")
+	assert.Empty(t, result.Error, "error")
+	if assert.NotNil(t, result.NodeNames, "node names") {
+		assert.Equal(t, []string{"worker-1"}, *result.NodeNames, "suitable nodes")
+	}
+	assert.Equal(t, map[string]string{
+		"worker-2": "volumes need 5Gi, only 2Gi PMEM available",
+		"worker-3": "volume of 2Gi is larger than the maximum volume size 1Gi",
+		"worker-4": "no PMEM capacity reported for the node",
+	}, result.FailedNodes, "failed nodes")
+
+	// Pods without PMEM volumes fit everywhere.
+	nodes := &v1.NodeList{Items: []v1.Node{{ObjectMeta: metav1.ObjectMeta{Name: "worker-4"}}}}
+	result = *se.filterNodes(ctx, &extenderArgs{Pod: &v1.Pod{}, Nodes: nodes})
+	assert.Equal(t, nodes, result.Nodes, "no volumes")
+	assert.Empty(t, result.FailedNodes, "no volumes")
+
+	rec = httptest.NewRecorder()
+	se.filter(rec, httptest.NewRequest(http.MethodGet, "/filter", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code, "GET")
+
+	// 5Gi are left on worker-1, 2Gi on worker-5.
+	nodeNames = append(nodeNames, "worker-5")
+	for scoring, expected := range map[SchedulerScoring][]int64{
+		SchedulerScoringBinPack: {1, 0, 0, 0, 6},
+		SchedulerScoringSpread:  {10, 0, 0, 0, 4},
+	} {
+		se.scoring = scoring
+		body, err := json.Marshal(extenderArgs{Pod: pod, NodeNames: &nodeNames})
+		require.NoError(t, err, "encode args")
+		rec := httptest.NewRecorder()
+		se.prioritize(rec, httptest.NewRequest(http.MethodPost, "/prioritize", bytes.NewReader(body)))
+		require.Equal(t, http.StatusOK, rec.Code, "prioritize")
+		var priorities []extenderHostPriority
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &priorities), "decode priorities")
+		var scores []int64
+		for i, priority := range priorities {
+			assert.Equal(t, nodeNames[i], priority.Host, "host")
+			scores = append(scores, priority.Score)
+		}
+		assert.Equal(t, expected, scores, "%s scores", scoring)
+	}
+	priorities, err := se.prioritizeNodes(ctx, &extenderArgs{Pod: &v1.Pod{}, Nodes: nodes})
+	require.NoError(t, err, "prioritize without volumes")
+	assert.Equal(t, []extenderHostPriority{{Host: "worker-4"}}, priorities, "no volumes")
+}
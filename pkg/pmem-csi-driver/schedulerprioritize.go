@@ -0,0 +1,152 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+// SchedulerScoring determines how the prioritize call of the
+// scheduler extender ranks nodes which have enough PMEM for a pod.
+type SchedulerScoring string
+
+const (
+	// Prefer nodes with the least PMEM left after creating the
+	// volumes, which keeps large chunks free on other nodes.
+	SchedulerScoringBinPack SchedulerScoring = "binpack"
+	// Prefer nodes with the most PMEM left, which spreads volumes
+	// evenly.
+	SchedulerScoringSpread SchedulerScoring = "spread"
+)
+
+func (scoring *SchedulerScoring) Set(value string) error {
+	switch value {
+	case string(SchedulerScoringBinPack), string(SchedulerScoringSpread):
+		*scoring = SchedulerScoring(value)
+	default:
+		// The flag package will add the value to the final output, no need to do it here.
+		return errors.New("invalid scheduler scoring")
+	}
+	return nil
+}
+
+func (scoring *SchedulerScoring) String() string {
+	return string(*scoring)
+}
+
+// maxExtenderPriority is the highest score that the scheduler accepts
+// from an extender.
+const maxExtenderPriority = 10
+
+// extenderHostPriority is one entry of the HostPriorityList that the
+// prioritize call returns. The scheduler API has no JSON tags for it.
+type extenderHostPriority struct {
+	Host  string
+	Score int64
+}
+
+// prioritize handles POST requests with extenderArgs.
+func (se *schedulerExtender) prioritize(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	var args extenderArgs
+	if err := json.NewDecoder(r.Body).Decode(&args); err != nil {
+		http.Error(w, fmt.Sprintf("decode extender arguments: %v", err), http.StatusBadRequest)
+		return
+	}
+	priorities, err := se.prioritizeNodes(r.Context(), &args)
+	if err != nil {
+		// The API has no field for errors.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(priorities); err != nil {
+		klog.FromContext(r.Context()).Error(err, "Encoding priorities failed")
+	}
+}
+
+// prioritizeNodes scores the nodes by the PMEM that they have left
+// after creating the volumes of the pod. Nodes where the volumes do
+// not fit get zero. For pods without PMEM-CSI volumes all nodes get
+// zero, so none of them is preferred.
+func (se *schedulerExtender) prioritizeNodes(ctx context.Context, args *extenderArgs) ([]extenderHostPriority, error) {
+	logger := klog.FromContext(ctx).WithName("scheduler-extender")
+	if args.Pod == nil {
+		return nil, errors.New("pod missing")
+	}
+	logger = logger.WithValues("pod", pmemlog.KObj(args.Pod))
+	var nodeNames []string
+	if args.NodeNames != nil {
+		nodeNames = *args.NodeNames
+	} else if args.Nodes != nil {
+		for _, node := range args.Nodes.Items {
+			nodeNames = append(nodeNames, node.Name)
+		}
+	}
+	priorities := make([]extenderHostPriority, len(nodeNames))
+	for i, nodeName := range nodeNames {
+		priorities[i].Host = nodeName
+	}
+
+	sizes, err := se.podVolumeSizes(args.Pod, false)
+	if err != nil {
+		return nil, err
+	}
+	if len(sizes) == 0 || se.capacityLister == nil {
+		return priorities, nil
+	}
+	capacities, err := se.nodeCapacities(args.Pod)
+	if err != nil {
+		return nil, err
+	}
+	var sum int64
+	for _, size := range sizes {
+		sum += size
+	}
+
+	// Scores are relative to the node with the most PMEM left.
+	remaining := make([]int64, len(nodeNames))
+	var maxRemaining int64
+	for i, nodeName := range nodeNames {
+		capacity := capacities[nodeName]
+		if capacity.fits(sizes) != "" {
+			remaining[i] = -1
+			continue
+		}
+		remaining[i] = capacity.available.Value() - capacity.pending - sum
+		if remaining[i] > maxRemaining {
+			maxRemaining = remaining[i]
+		}
+	}
+	// Nodes where the volumes fit get at least 1.
+	for i := range priorities {
+		switch {
+		case remaining[i] < 0:
+			continue
+		case maxRemaining == 0:
+			priorities[i].Score = maxExtenderPriority
+		case se.scoring == SchedulerScoringSpread:
+			priorities[i].Score = 1 + (maxExtenderPriority-1)*remaining[i]/maxRemaining
+		default:
+			priorities[i].Score = 1 + (maxExtenderPriority-1)*(maxRemaining-remaining[i])/maxRemaining
+		}
+	}
+	logger.V(5).Info("Prioritized nodes", "volume-sizes", sizes, "scoring", se.scoring, "priorities", priorities)
+	return priorities, nil
+}
@@ -0,0 +1,434 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+const (
+	// scrubDirectory is the sub-directory of the state directory
+	// where freed devices are recorded until they get released.
+	scrubDirectory = "scrub"
+
+	// scrubCheckInterval is how often the node driver looks for
+	// freed devices which still need to be zeroed.
+	scrubCheckInterval = 10 * time.Second
+
+	// scrubChunkSize is how much gets written at once.
+	scrubChunkSize = 1024 * 1024
+
+	// scrubMaxOverhead is how much larger than requested, in
+	// percent, a zeroed device may be when reusing it for a new
+	// volume.
+	scrubMaxOverhead = 10
+)
+
+// scrubbedDevice is stored for each freed device under its name.
+type scrubbedDevice struct {
+	Device     string         `json:"device"`
+	DeviceMode api.DeviceMode `json:"deviceMode"`
+	Size       int64          `json:"size"`
+	Freed      time.Time      `json:"freed"`
+	// Zeroed is set once the entire device contains only zeroes.
+	Zeroed bool `json:"zeroed,omitempty"`
+}
+
+// scrubber zeroes the devices of deleted volumes in the background
+// and hands them out again for new volumes.
+type scrubber struct {
+	state pmemstate.StateManager
+	// bytes per second, zero disables the scrubber
+	rate int64
+
+	// mutex protects the state and busy.
+	mutex sync.Mutex
+	// busy is the device which is currently being zeroed.
+	busy string
+}
+
+func newScrubber(state pmemstate.StateManager, rate int64) *scrubber {
+	return &scrubber{state: state, rate: rate}
+}
+
+// enabled is true if deleted volumes are meant to be zeroed by the
+// scrubber.
+func (s *scrubber) enabled() bool {
+	return s != nil && s.rate > 0
+}
+
+// scrubDeviceName returns a name for a freed device which is as long
+// as a volume ID and does not conflict with any volume.
+func scrubDeviceName(device string, freed time.Time) string {
+	hasher := sha256.New224()
+	hasher.Write([]byte(device + "@" + freed.UTC().Format(time.RFC3339Nano)))
+	return "scrub-" + hex.EncodeToString(hasher.Sum(nil))
+}
+
+// free renames the device and queues it for zeroing. It fails
+// with NotSupported if the device manager cannot rename devices.
+func (s *scrubber) free(ctx context.Context, dm pmdmanager.PmemDeviceManager, device string, size int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	entry := scrubbedDevice{
+		Device:     scrubDeviceName(device, now),
+		DeviceMode: dm.GetMode(),
+		Size:       size,
+		Freed:      now,
+	}
+	// As for the trash, recording the entry first ensures that the
+	// device does not get leaked.
+	if err := s.state.Create(entry.Device, &entry); err != nil {
+		return fmt.Errorf("record freed device: %v", err)
+	}
+	if err := dm.RenameDevice(ctx, device, entry.Device); err != nil {
+		if err := s.state.Delete(entry.Device); err != nil {
+			klog.FromContext(ctx).Error(err, "Failed to remove scrub entry")
+		}
+		return fmt.Errorf("rename device: %w", err)
+	}
+	klog.FromContext(ctx).V(3).Info("Queued device for zeroing", "device", entry.Device)
+	return nil
+}
+
+// freeDevice hands the device of a deleted volume over to the
+// scrubber. If that is not possible, the caller must erase it.
+func (cs *nodeControllerServer) freeDevice(ctx context.Context, dm pmdmanager.PmemDeviceManager, device string, size int64) bool {
+	if !cs.scrubber.enabled() {
+		return false
+	}
+	// Thin volumes get deleted directly, DeleteDevice knows that
+	// they must not be zeroed.
+	if pools, ok := pmdmanager.As[pmdmanager.ThinPools](dm); ok {
+		thin, err := pools.IsThinDevice(ctx, device)
+		if err != nil {
+			klog.FromContext(ctx).Error(err, "Checking for thin volume failed, erasing immediately", "device", device)
+			return false
+		}
+		if thin {
+			klog.FromContext(ctx).V(3).Info("Not zeroing thin volume in the background", "device", device)
+			return false
+		}
+	}
+	err := cs.scrubber.free(ctx, dm, device, size)
+	switch {
+	case err == nil:
+		return true
+	case errors.Is(err, pmemerr.NotSupported):
+	default:
+		klog.FromContext(ctx).Error(err, "Zeroing in the background failed, erasing immediately", "device", device)
+	}
+	return false
+}
+
+// createDevice prefers a zeroed device over creating a new one and
+// releases freed devices when running out of space. Zeroed devices
+// are not reused when the NUMA nodes are restricted because it is
+// unknown where they are.
+func (cs *nodeControllerServer) createDevice(ctx context.Context, dm pmdmanager.PmemDeviceManager, volumeID string, size int64, p parameters.Volume, numaNodes pmdmanager.NUMANodes) (uint64, error) {
+	usage, sectorSize := p.GetUsage(), uint64(p.GetSectorSize())
+	if stripes := p.GetStripes(); stripes > 1 {
+		sd, ok := pmdmanager.As[pmdmanager.StripedDevices](dm)
+		if !ok {
+			return 0, fmt.Errorf("device mode %q cannot stripe volumes: %w", dm.GetMode(), pmemerr.NotSupported)
+		}
+		// Freed devices are not striped, so they cannot be reused.
+		return sd.CreateStripedDevice(ctx, volumeID, uint64(size), int(stripes), numaNodes)
+	}
+	if !cs.scrubber.enabled() {
+		return dm.CreateDevice(ctx, volumeID, uint64(size), usage, sectorSize, numaNodes)
+	}
+	if len(numaNodes) == 0 {
+		if actual, ok := cs.scrubber.reuse(ctx, dm, volumeID, size); ok {
+			return uint64(actual), nil
+		}
+	}
+	actual, err := dm.CreateDevice(ctx, volumeID, uint64(size), usage, sectorSize, numaNodes)
+	if errors.Is(err, pmemerr.NotEnoughSpace) && cs.releaseFreedDevices(ctx, dm.GetMode()) {
+		actual, err = dm.CreateDevice(ctx, volumeID, uint64(size), usage, sectorSize, numaNodes)
+	}
+	return actual, err
+}
+
+// reuse renames a zeroed device to the volume ID if there is one
+// which is large enough and not much larger. It returns the size
+// of the device.
+func (s *scrubber) reuse(ctx context.Context, dm pmdmanager.PmemDeviceManager, volumeID string, size int64) (int64, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := s.entries()
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to list freed devices")
+		return 0, false
+	}
+	var best *scrubbedDevice
+	for _, entry := range entries {
+		if !entry.Zeroed ||
+			entry.DeviceMode != dm.GetMode() ||
+			entry.Size < size ||
+			entry.Size > size+size*scrubMaxOverhead/100 {
+			continue
+		}
+		if best == nil || entry.Size < best.Size {
+			best = entry
+		}
+	}
+	if best == nil {
+		return 0, false
+	}
+	if err := dm.RenameDevice(ctx, best.Device, volumeID); err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to reuse zeroed device", "device", best.Device)
+		return 0, false
+	}
+	if err := s.state.Delete(best.Device); err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to remove scrub entry", "device", best.Device)
+	}
+	klog.FromContext(ctx).V(3).Info("Reusing zeroed device", "device", best.Device, "size", pmemlog.CapacityRef(best.Size))
+	return best.Size, true
+}
+
+// releaseFreedDevices deletes all freed devices of the mode (all
+// modes if empty) which are not currently being zeroed. Devices
+// which are not zeroed yet get erased first. It returns true if any
+// device was deleted.
+func (cs *nodeControllerServer) releaseFreedDevices(ctx context.Context, mode api.DeviceMode) bool {
+	s := cs.scrubber
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	logger := klog.FromContext(ctx)
+	entries, err := s.entries()
+	if err != nil {
+		logger.Error(err, "Failed to list freed devices")
+		return false
+	}
+	released := false
+	for _, entry := range entries {
+		if entry.Device == s.busy || (mode != "" && entry.DeviceMode != mode) {
+			continue
+		}
+		dm, err := cs.deviceManager(ctx, entry.DeviceMode)
+		if err != nil {
+			logger.Error(err, "Failed to initialize device manager", "device-mode", entry.DeviceMode)
+			continue
+		}
+		if err := dm.DeleteDevice(ctx, entry.Device, !entry.Zeroed); err != nil {
+			logger.Error(err, "Failed to delete freed device", "device", entry.Device)
+			continue
+		}
+		if err := s.state.Delete(entry.Device); err != nil {
+			logger.Error(err, "Failed to remove scrub entry", "device", entry.Device)
+		}
+		logger.V(3).Info("Released freed device", "device", entry.Device, "zeroed", entry.Zeroed)
+		released = true
+	}
+	return released
+}
+
+// freedCapacity is the size of all freed devices of the mode. That
+// space is available for new volumes.
+func (s *scrubber) freedCapacity(mode api.DeviceMode) int64 {
+	if s == nil {
+		return 0
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := s.entries()
+	if err != nil {
+		return 0
+	}
+	var size int64
+	for _, entry := range entries {
+		if entry.DeviceMode == mode {
+			size += entry.Size
+		}
+	}
+	return size
+}
+
+// runScrubber processes freed devices in the background. If the
+// scrubber is disabled, devices which were left over by a previous
+// run get released once.
+func (cs *nodeControllerServer) runScrubber(ctx context.Context) {
+	logger := klog.FromContext(ctx).WithName("scrubber")
+	ctx = klog.NewContext(ctx, logger)
+	if !cs.scrubber.enabled() {
+		go cs.releaseFreedDevices(ctx, "")
+		return
+	}
+	go wait.UntilWithContext(ctx, cs.processScrub, scrubCheckInterval)
+}
+
+// processScrub zeroes all freed devices which are not zeroed yet,
+// oldest first.
+func (cs *nodeControllerServer) processScrub(ctx context.Context) {
+	s := cs.scrubber
+	logger := klog.FromContext(ctx)
+	for {
+		entry := s.next(ctx)
+		if entry == nil {
+			return
+		}
+		logger := logger.WithValues("device", entry.Device)
+		ctx := klog.NewContext(ctx, logger)
+		err := cs.zeroDevice(ctx, entry)
+		s.done(ctx, entry, err)
+		if err != nil {
+			// Tried again next time.
+			logger.Error(err, "Failed to zero device")
+			return
+		}
+		logger.V(3).Info("Zeroed device", "size", pmemlog.CapacityRef(entry.Size))
+	}
+}
+
+// pending returns the number of freed devices which still need to be
+// zeroed.
+func (s *scrubber) pending() (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := s.entries()
+	if err != nil {
+		return 0, err
+	}
+	pending := 0
+	for _, entry := range entries {
+		if !entry.Zeroed {
+			pending++
+		}
+	}
+	return pending, nil
+}
+
+// next marks the oldest device which needs to be zeroed as busy.
+func (s *scrubber) next(ctx context.Context) *scrubbedDevice {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	entries, err := s.entries()
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to list freed devices")
+		return nil
+	}
+	for _, entry := range entries {
+		if !entry.Zeroed {
+			s.busy = entry.Device
+			return entry
+		}
+	}
+	return nil
+}
+
+// done records the outcome of zeroing the busy device.
+func (s *scrubber) done(ctx context.Context, entry *scrubbedDevice, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.busy = ""
+	if err != nil {
+		return
+	}
+	entry.Zeroed = true
+	if err := s.state.Create(entry.Device, entry); err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to update scrub entry")
+	}
+}
+
+// zeroDevice overwrites the device with zeroes, at most with the
+// configured rate.
+func (cs *nodeControllerServer) zeroDevice(ctx context.Context, entry *scrubbedDevice) error {
+	dm, err := cs.deviceManager(ctx, entry.DeviceMode)
+	if err != nil {
+		return fmt.Errorf("initialize device manager for mode %s: %v", entry.DeviceMode, err)
+	}
+	device, err := dm.GetDevice(ctx, entry.Device)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(device.Path, pmdmanager.FakeDevicePathPrefix) {
+		return nil
+	}
+
+	// O_EXCL ensures that the device is not in use.
+	out, err := os.OpenFile(device.Path, os.O_WRONLY|unix.O_EXCL, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zeroes := make([]byte, scrubChunkSize)
+	start := time.Now()
+	for written := uint64(0); written < device.Size; {
+		chunk := zeroes
+		if remaining := device.Size - written; remaining < uint64(len(chunk)) {
+			chunk = chunk[:remaining]
+		}
+		n, err := out.Write(chunk)
+		written += uint64(n)
+		if err != nil {
+			return fmt.Errorf("write %s at offset %d: %v", device.Path, written, err)
+		}
+
+		// Sleep until the average rate is not higher than
+		// configured.
+		due := start.Add(time.Duration(float64(written) / float64(cs.scrubber.rate) * float64(time.Second)))
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Until(due)):
+		}
+	}
+	if err := out.Sync(); err != nil {
+		return fmt.Errorf("sync %s: %v", device.Path, err)
+	}
+	return nil
+}
+
+// entries returns all freed devices, sorted by the time when they
+// were freed. Must be called while holding the mutex.
+func (s *scrubber) entries() ([]*scrubbedDevice, error) {
+	names, err := s.state.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var entries []*scrubbedDevice
+	for _, name := range names {
+		entry := &scrubbedDevice{}
+		if err := s.state.Get(name, entry); err != nil {
+			return nil, fmt.Errorf("scrub entry %s: %v", name, err)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Freed.Before(entries[j].Freed)
+	})
+	return entries, nil
+}
@@ -0,0 +1,194 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+const gib = 1024 * 1024 * 1024
+
+func TestScrubber(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	stateDir := t.TempDir()
+	sm, err := pmemstate.NewFileState(stateDir)
+	require.NoError(t, err, "create volume state")
+	scrub, err := pmemstate.NewFileState(filepath.Join(stateDir, scrubDirectory))
+	require.NoError(t, err, "create scrub state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	cs.scrubber = newScrubber(scrub, gib)
+
+	create := func(name string, size int64) string {
+		vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: name,
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+			}},
+			CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+		})
+		require.NoError(t, err, "create volume %s", name)
+		return vol.Volume.VolumeId
+	}
+	remove := func(volumeID string) {
+		_, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+		require.NoError(t, err, "delete volume %s", volumeID)
+	}
+	entries := func() []*scrubbedDevice {
+		cs.scrubber.mutex.Lock()
+		defer cs.scrubber.mutex.Unlock()
+		entries, err := cs.scrubber.entries()
+		require.NoError(t, err, "list freed devices")
+		return entries
+	}
+	devices := func() int {
+		devices, err := dm.ListDevices(ctx)
+		require.NoError(t, err, "list devices")
+		return len(devices)
+	}
+	available := func() int64 {
+		resp, err := cs.GetCapacity(ctx, &csi.GetCapacityRequest{})
+		require.NoError(t, err, "get capacity")
+		return resp.AvailableCapacity
+	}
+	total := available()
+
+	volumeID := create("vol", 300*gib)
+	remove(volumeID)
+	freed := entries()
+	require.Len(t, freed, 1, "freed devices")
+	assert.False(t, freed[0].Zeroed, "zeroed before processing")
+	assert.Equal(t, 1, devices(), "device kept")
+	assert.Equal(t, total, available(), "freed device counts as available")
+
+	// A new volume does not get a device which is not zeroed yet.
+	volumeID = create("vol2", 300*gib)
+	assert.Equal(t, 2, devices(), "new device")
+	remove(volumeID)
+	cs.processScrub(ctx)
+	for _, entry := range entries() {
+		assert.True(t, entry.Zeroed, "%s zeroed", entry.Device)
+	}
+
+	// Now one of them gets reused.
+	volumeID = create("vol3", 290*gib)
+	assert.Equal(t, 2, devices(), "reused device")
+	assert.Len(t, entries(), 1, "freed devices after reuse")
+	vol := cs.getVolumeByID(volumeID)
+	require.NotNil(t, vol, "reused volume")
+	assert.Equal(t, int64(300*gib), vol.Size, "size of reused volume")
+
+	// Not enough space for a new volume without releasing the
+	// freed device.
+	create("vol4", 500*gib)
+	assert.Empty(t, entries(), "freed devices after running out of space")
+	assert.Equal(t, 2, devices(), "devices after running out of space")
+}
+
+// thinDM pretends that all devices are thin volumes.
+type thinDM struct {
+	pmdmanager.PmemDeviceManager
+	flushed []string
+}
+
+func (dm *thinDM) GetThinPoolUsage(ctx context.Context) (map[string]float64, error) {
+	return nil, nil
+}
+
+func (dm *thinDM) IsThinDevice(ctx context.Context, name string) (bool, error) {
+	return true, nil
+}
+
+func (dm *thinDM) DeleteDevice(ctx context.Context, name string, flush bool) error {
+	if flush {
+		dm.flushed = append(dm.flushed, name)
+	}
+	return dm.PmemDeviceManager.DeleteDevice(ctx, name, flush)
+}
+
+func TestScrubberThinVolume(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	fake, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	dm := &thinDM{PmemDeviceManager: fake}
+	stateDir := t.TempDir()
+	sm, err := pmemstate.NewFileState(stateDir)
+	require.NoError(t, err, "create volume state")
+	scrub, err := pmemstate.NewFileState(filepath.Join(stateDir, scrubDirectory))
+	require.NoError(t, err, "create scrub state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	cs.scrubber = newScrubber(scrub, gib)
+
+	vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "thin",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		CapacityRange: &csi.CapacityRange{RequiredBytes: gib},
+	})
+	require.NoError(t, err, "create volume")
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.Volume.VolumeId})
+	require.NoError(t, err, "delete volume")
+
+	cs.scrubber.mutex.Lock()
+	entries, err := cs.scrubber.entries()
+	cs.scrubber.mutex.Unlock()
+	require.NoError(t, err, "list freed devices")
+	assert.Empty(t, entries, "thin volume not queued for zeroing")
+	// DeleteDevice of the LVM device manager skips the flush
+	// for thin volumes.
+	assert.Equal(t, []string{vol.Volume.VolumeId}, dm.flushed, "deleted directly")
+	devices, err := fake.ListDevices(ctx)
+	require.NoError(t, err, "list devices")
+	assert.Empty(t, devices, "device removed")
+}
+
+// fileDM stores all devices in the same file.
+type fileDM struct {
+	pmdmanager.PmemDeviceManager
+	path string
+	size uint64
+}
+
+func (dm fileDM) GetDevice(ctx context.Context, name string) (*pmdmanager.PmemDeviceInfo, error) {
+	return &pmdmanager.PmemDeviceInfo{VolumeId: name, Path: dm.path, Size: dm.size}, nil
+}
+
+func TestZeroDevice(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	fake, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	size := 4 * 1024 * 1024
+	path := filepath.Join(t.TempDir(), "device")
+	require.NoError(t, os.WriteFile(path, bytes.Repeat([]byte{0xff}, size), 0600), "create device file")
+	cs := NewNodeControllerServer(ctx, "node", fileDM{fake, path, uint64(size)}, nil, nil, "", pmdmanager.Options{})
+	cs.scrubber = newScrubber(nil, int64(size)*4)
+
+	start := time.Now()
+	require.NoError(t, cs.zeroDevice(ctx, &scrubbedDevice{Device: "dev", DeviceMode: api.DeviceModeFake}), "zero device")
+	assert.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond, "rate limit")
+	content, err := os.ReadFile(path)
+	require.NoError(t, err, "read device file")
+	assert.Equal(t, make([]byte, size), content, "content")
+}
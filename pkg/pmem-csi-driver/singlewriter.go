@@ -0,0 +1,79 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// supportedAccessModes are all modes which limit usage of a volume to
+// a single node. The driver advertises SINGLE_NODE_MULTI_WRITER,
+// therefore Kubernetes uses SINGLE_NODE_MULTI_WRITER instead of
+// SINGLE_NODE_WRITER for ReadWriteOnce and SINGLE_NODE_SINGLE_WRITER
+// for ReadWriteOncePod.
+var supportedAccessModes = map[csi.VolumeCapability_AccessMode_Mode]bool{
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER:        true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER: true,
+	csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER:  true,
+}
+
+// acquireSingleWriter must be called while holding the volumeMutex
+// for the volume, before publishing it. It rejects the request if
+// the volume is already published elsewhere with
+// SINGLE_NODE_SINGLE_WRITER. If the request itself uses that mode,
+// the target path gets recorded in the volume state, which ensures
+// that the check also works after a driver restart.
+func (ns *nodeServer) acquireSingleWriter(ctx context.Context, volumeID, targetPath string, mode csi.VolumeCapability_AccessMode_Mode) error {
+	vol := ns.cs.getVolumeByID(volumeID)
+	if vol == nil {
+		return status.Errorf(codes.NotFound, "no volume found with volume id %q", volumeID)
+	}
+	if vol.Writer != "" && vol.Writer != targetPath {
+		if _, err := os.Stat(vol.Writer); err == nil {
+			return status.Errorf(codes.FailedPrecondition, "volume is already published at %q with SINGLE_NODE_SINGLE_WRITER access mode", vol.Writer)
+		}
+		// The target path was removed without
+		// NodeUnpublishVolume, for example together with
+		// the pod directory.
+		klog.FromContext(ctx).V(3).Info("Ignoring stale single writer", "writer", vol.Writer)
+	}
+	if mode == csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER {
+		return ns.cs.setWriter(ctx, vol, targetPath)
+	}
+	return nil
+}
+
+// releaseSingleWriter must be called while holding the volumeMutex
+// for the volume, after unpublishing it.
+func (ns *nodeServer) releaseSingleWriter(ctx context.Context, vol *nodeVolume, targetPath string) error {
+	if vol.Writer != targetPath {
+		return nil
+	}
+	return ns.cs.setWriter(ctx, vol, "")
+}
+
+func (cs *nodeControllerServer) setWriter(ctx context.Context, vol *nodeVolume, targetPath string) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if vol.Writer == targetPath {
+		return nil
+	}
+	vol.Writer = targetPath
+	if cs.sm != nil {
+		if err := cs.sm.Create(vol.ID, vol); err != nil {
+			return status.Errorf(codes.Internal, "record single writer of volume: %v", err)
+		}
+	}
+	klog.FromContext(ctx).V(4).Info("Updated single writer", "writer", targetPath)
+	return nil
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestSingleWriter(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create volume state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	ns := NewNodeServer(cs, t.TempDir())
+
+	vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER},
+		}},
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume")
+	volumeID := vol.Volume.VolumeId
+
+	pods := t.TempDir()
+	targetPath := func(pod string) string {
+		path := filepath.Join(pods, pod, "mount")
+		require.NoError(t, os.MkdirAll(path, 0755), "create target path")
+		return path
+	}
+	first := targetPath("first")
+	second := targetPath("second")
+	const singleWriter = csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER
+	const multiWriter = csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER
+
+	require.NoError(t, ns.acquireSingleWriter(ctx, volumeID, first, singleWriter), "first pod")
+	require.NoError(t, ns.acquireSingleWriter(ctx, volumeID, first, singleWriter), "first pod again")
+	err = ns.acquireSingleWriter(ctx, volumeID, second, singleWriter)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "second pod: %v", err)
+	err = ns.acquireSingleWriter(ctx, volumeID, second, multiWriter)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "second pod without single writer: %v", err)
+
+	// As after a restart of the driver.
+	cs = NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	ns = NewNodeServer(cs, t.TempDir())
+	err = ns.acquireSingleWriter(ctx, volumeID, second, singleWriter)
+	assert.Equal(t, codes.FailedPrecondition, status.Code(err), "second pod after restart: %v", err)
+
+	require.NoError(t, ns.releaseSingleWriter(ctx, cs.getVolumeByID(volumeID), first), "unpublish first pod")
+	require.NoError(t, ns.acquireSingleWriter(ctx, volumeID, second, singleWriter), "second pod after unpublish")
+
+	// The target path of the second pod disappears without unpublishing.
+	require.NoError(t, os.RemoveAll(filepath.Join(pods, "second")), "remove second pod")
+	require.NoError(t, ns.acquireSingleWriter(ctx, volumeID, first, singleWriter), "first pod after removing second pod")
+
+	err = ns.acquireSingleWriter(ctx, "no-such-volume", first, singleWriter)
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown volume: %v", err)
+}
@@ -0,0 +1,339 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/klog/v2"
+	"k8s.io/utils/keymutex"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// snapshotDirectory is the sub-directory of the state directory
+// where snapshots are recorded.
+const snapshotDirectory = "snapshots"
+
+// snapshotMutex serializes operations per snapshot ID. When also
+// locking a volume, the volume must be locked first.
+var snapshotMutex = keymutex.NewHashed(-1)
+
+// nodeSnapshot is a full copy of a volume at the time when the
+// snapshot was taken. Copy-on-write snapshots are not supported
+// because neither LVM snapshots nor namespaces support DAX.
+type nodeSnapshot struct {
+	ID             string         `json:"id"`
+	Name           string         `json:"name"`
+	SourceVolumeID string         `json:"sourceVolumeID"`
+	Size           int64          `json:"size"`
+	DeviceMode     api.DeviceMode `json:"deviceMode"`
+	Usage          string         `json:"usage"`
+	SectorSize     int64          `json:"sectorSize,omitempty"`
+	EraseAfter     bool           `json:"eraseAfter"`
+	CreationTime   time.Time      `json:"creationTime"`
+}
+
+func (snap *nodeSnapshot) toCSI() *csi.Snapshot {
+	return &csi.Snapshot{
+		SnapshotId:     snap.ID,
+		SourceVolumeId: snap.SourceVolumeID,
+		SizeBytes:      snap.Size,
+		CreationTime:   timestamppb.New(snap.CreationTime),
+		// The data gets copied before CreateSnapshot returns.
+		ReadyToUse: true,
+	}
+}
+
+// restoreSnapshots loads the snapshot state and removes entries
+// for which no device exists anymore.
+func (cs *nodeControllerServer) restoreSnapshots(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	ids, err := cs.snapshotState.GetAll()
+	if err != nil {
+		logger.Error(err, "Failed to load snapshot state")
+		return
+	}
+	for _, id := range ids {
+		snap := &nodeSnapshot{}
+		if err := cs.snapshotState.Get(id, snap); err != nil {
+			logger.Error(err, "Failed to retrieve snapshot info from persistent state", "snapshot-id", id)
+			continue
+		}
+		dm, err := cs.deviceManager(ctx, snap.DeviceMode)
+		if err != nil {
+			logger.Error(err, "Failed to initialize device manager for snapshot", "snapshot-id", id, "device-mode", snap.DeviceMode)
+			continue
+		}
+		if _, err := dm.GetDevice(ctx, id); err != nil {
+			if errors.Is(err, pmemerr.DeviceNotFound) {
+				if err := cs.snapshotState.Delete(id); err != nil && !errors.Is(err, pmemerr.ReadOnly) {
+					logger.Error(err, "Failed to remove stale snapshot from state", "snapshot-id", id)
+				}
+			} else {
+				logger.Error(err, "Failed to fetch device for snapshot", "snapshot-id", id)
+			}
+			continue
+		}
+		cs.pmemSnapshots[id] = snap
+	}
+}
+
+// deviceManager returns a device manager for the mode, which is the
+// default one if the mode is the same.
+func (cs *nodeControllerServer) deviceManager(ctx context.Context, mode api.DeviceMode) (pmdmanager.PmemDeviceManager, error) {
+	if mode == "" || mode == cs.dm.GetMode() {
+		return cs.dm, nil
+	}
+	return pmdmanager.New(ctx, mode, 0, cs.dmOptions)
+}
+
+func (cs *nodeControllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (*csi.CreateSnapshotResponse, error) {
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		return nil, err
+	}
+	if req.GetName() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Name missing in request")
+	}
+	if req.GetSourceVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "Source volume ID missing in request")
+	}
+	if cs.snapshotState == nil {
+		return nil, status.Error(codes.FailedPrecondition, "snapshots need a state directory")
+	}
+
+	snapshotID := generateVolumeID(req.GetName())
+	logger := klog.FromContext(ctx).WithValues("snapshot-name", req.GetName(), "snapshot-id", snapshotID, "volume-id", req.GetSourceVolumeId())
+	ctx = klog.NewContext(ctx, logger)
+
+	// The source volume must not get deleted while copying it.
+	nodeVolumeMutex.LockKey(req.GetSourceVolumeId())
+	defer func() {
+		_ = nodeVolumeMutex.UnlockKey(req.GetSourceVolumeId())
+	}()
+	snapshotMutex.LockKey(snapshotID)
+	defer func() {
+		_ = snapshotMutex.UnlockKey(snapshotID)
+	}()
+
+	if snap := cs.getSnapshotByID(snapshotID); snap != nil {
+		if snap.SourceVolumeID != req.GetSourceVolumeId() {
+			return nil, status.Errorf(codes.AlreadyExists, "snapshot with the same name %q for a different volume already exists", req.GetName())
+		}
+		// Idempotent call.
+		return &csi.CreateSnapshotResponse{Snapshot: snap.toCSI()}, nil
+	}
+
+	vol := cs.getVolumeByID(req.GetSourceVolumeId())
+	if vol == nil {
+		return nil, status.Errorf(codes.NotFound, "source volume %q not found", req.GetSourceVolumeId())
+	}
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "previously stored volume parameters for volume with ID %q: %v", vol.ID, err)
+	}
+	dm, err := cs.deviceManager(ctx, p.GetDeviceMode())
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to initialize device manager for volume with ID %q and mode %s: %v", vol.ID, p.GetDeviceMode(), err)
+	}
+	source, err := dm.GetDevice(ctx, vol.ID)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "get source device: %v", err)
+	}
+
+	// Snapshots of encrypted volumes cannot be crypto-erased,
+	// therefore they get zeroed unless erasing is disabled.
+	snap := &nodeSnapshot{
+		ID:             snapshotID,
+		Name:           req.GetName(),
+		SourceVolumeID: vol.ID,
+		Size:           vol.Size,
+		DeviceMode:     dm.GetMode(),
+		Usage:          string(p.GetUsage()),
+		SectorSize:     p.GetSectorSize(),
+		EraseAfter:     p.GetErasePolicy() != parameters.EraseNone,
+		CreationTime:   time.Now(),
+	}
+	logger.V(4).Info("Creating new snapshot", "size", pmemlog.CapacityRef(snap.Size))
+
+	// Same approach as for volumes: state first, then the device.
+	if err := cs.snapshotState.Create(snapshotID, snap); err != nil {
+		return nil, status.Error(codes.Internal, "store state: "+err.Error())
+	}
+	created := false
+	defer func() {
+		if created {
+			return
+		}
+		if err := cs.snapshotState.Delete(snapshotID); err != nil {
+			logger.Error(err, "Removing snapshot from persistent state failed")
+		}
+	}()
+
+	actualSize, err := dm.CreateDevice(ctx, snapshotID, uint64(snap.Size), parameters.Usage(snap.Usage), uint64(snap.SectorSize), nil)
+	if err != nil {
+		code := codes.Internal
+		if errors.Is(err, pmemerr.NotEnoughSpace) {
+			code = codes.ResourceExhausted
+		}
+		return nil, status.Errorf(code, "snapshot device creation failed: %v", err)
+	}
+	target, err := dm.GetDevice(ctx, snapshotID)
+	if err == nil {
+		err = copyDevice(ctx, source, target, uint64(snap.Size))
+	}
+	if err != nil {
+		if err := dm.DeleteDevice(ctx, snapshotID, false); err != nil {
+			logger.Error(err, "Removing incomplete snapshot device failed")
+		}
+		return nil, status.Errorf(codes.Internal, "copy volume data: %v", err)
+	}
+	if actualSize > uint64(snap.Size) {
+		snap.Size = int64(actualSize)
+		if err := cs.snapshotState.Create(snapshotID, snap); err != nil {
+			logger.Error(err, "Updating state with new snapshot size failed")
+		}
+	}
+	created = true
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.pmemSnapshots[snapshotID] = snap
+	logger.V(4).Info("Created new snapshot")
+
+	return &csi.CreateSnapshotResponse{Snapshot: snap.toCSI()}, nil
+}
+
+func (cs *nodeControllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (*csi.DeleteSnapshotResponse, error) {
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT); err != nil {
+		return nil, err
+	}
+	snapshotID := req.GetSnapshotId()
+	if snapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Snapshot ID missing in request")
+	}
+	logger := klog.FromContext(ctx).WithValues("snapshot-id", snapshotID)
+	ctx = klog.NewContext(ctx, logger)
+
+	snapshotMutex.LockKey(snapshotID)
+	defer snapshotMutex.UnlockKey(snapshotID) //nolint: errcheck
+
+	snap := cs.getSnapshotByID(snapshotID)
+	if snap == nil {
+		// Already deleted.
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+	dm, err := cs.deviceManager(ctx, snap.DeviceMode)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to initialize device manager for snapshot with ID %q and mode %s: %v", snapshotID, snap.DeviceMode, err)
+	}
+	if err := dm.DeleteDevice(ctx, snapshotID, snap.EraseAfter); err != nil {
+		if errors.Is(err, pmemerr.DeviceInUse) {
+			return nil, status.Errorf(codes.FailedPrecondition, err.Error())
+		}
+		return nil, status.Errorf(codes.Internal, "Failed to delete snapshot: %s", err.Error())
+	}
+	if err := cs.snapshotState.Delete(snapshotID); err != nil {
+		logger.Error(err, "Failed to remove snapshot from state")
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	delete(cs.pmemSnapshots, snapshotID)
+
+	logger.V(4).Info("Snapshot deleted")
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *nodeControllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if err := cs.ValidateControllerServiceRequest(csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS); err != nil {
+		return nil, err
+	}
+
+	cs.mutex.Lock()
+	snaps := make([]*nodeSnapshot, 0, len(cs.pmemSnapshots))
+	for _, snap := range cs.pmemSnapshots {
+		if req.GetSnapshotId() != "" && snap.ID != req.GetSnapshotId() ||
+			req.GetSourceVolumeId() != "" && snap.SourceVolumeID != req.GetSourceVolumeId() {
+			continue
+		}
+		snaps = append(snaps, snap)
+	}
+	cs.mutex.Unlock()
+
+	// Sorting ensures that the starting token refers to the same
+	// entry in repeated calls.
+	sort.Slice(snaps, func(i, j int) bool {
+		return snaps[i].ID < snaps[j].ID
+	})
+
+	var (
+		ulenSnaps     = int32(len(snaps))
+		maxEntries    = req.MaxEntries
+		startingToken int32
+	)
+
+	if v := req.StartingToken; v != "" {
+		i, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			return nil, status.Errorf(
+				codes.Aborted,
+				"startingToken=%d !< int32=%d",
+				startingToken, math.MaxUint32)
+		}
+		startingToken = int32(i)
+	}
+
+	if startingToken > ulenSnaps {
+		return nil, status.Errorf(
+			codes.Aborted,
+			"startingToken=%d > len(snapshots)=%d",
+			startingToken, ulenSnaps)
+	}
+
+	rem := ulenSnaps - startingToken
+	if maxEntries == 0 || maxEntries > rem {
+		maxEntries = rem
+	}
+
+	entries := make([]*csi.ListSnapshotsResponse_Entry, maxEntries)
+	for i := range entries {
+		entries[i] = &csi.ListSnapshotsResponse_Entry{
+			Snapshot: snaps[startingToken+int32(i)].toCSI(),
+		}
+	}
+
+	var nextToken string
+	if n := startingToken + maxEntries; n < ulenSnaps {
+		nextToken = fmt.Sprintf("%d", n)
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+func (cs *nodeControllerServer) getSnapshotByID(snapshotID string) *nodeSnapshot {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return cs.pmemSnapshots[snapshotID]
+}
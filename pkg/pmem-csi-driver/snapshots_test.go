@@ -0,0 +1,102 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestSnapshots(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dir := t.TempDir()
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(dir)
+	require.NoError(t, err, "create volume state")
+	snapshotState, err := pmemstate.NewFileState(filepath.Join(dir, snapshotDirectory))
+	require.NoError(t, err, "create snapshot state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, snapshotState, "", pmdmanager.Options{})
+
+	capabilities := []*csi.VolumeCapability{{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+	}}
+	vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:               "vol",
+		VolumeCapabilities: capabilities,
+		CapacityRange:      &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume")
+	volumeID := vol.Volume.VolumeId
+
+	_, err = cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: "no-such-volume"})
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown source volume: %v", err)
+
+	snap, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: volumeID})
+	require.NoError(t, err, "create snapshot")
+	assert.Equal(t, volumeID, snap.Snapshot.SourceVolumeId, "source volume")
+	assert.Equal(t, vol.Volume.CapacityBytes, snap.Snapshot.SizeBytes, "snapshot size")
+	assert.True(t, snap.Snapshot.ReadyToUse, "ready to use")
+	snapshotID := snap.Snapshot.SnapshotId
+
+	again, err := cs.CreateSnapshot(ctx, &csi.CreateSnapshotRequest{Name: "snap", SourceVolumeId: volumeID})
+	require.NoError(t, err, "create snapshot again")
+	assert.Equal(t, snapshotID, again.Snapshot.SnapshotId, "idempotent snapshot ID")
+
+	list, err := cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SourceVolumeId: volumeID})
+	require.NoError(t, err, "list snapshots")
+	if assert.Len(t, list.Entries, 1, "snapshots for volume") {
+		assert.Equal(t, snapshotID, list.Entries[0].Snapshot.SnapshotId, "listed snapshot")
+	}
+	list, err = cs.ListSnapshots(ctx, &csi.ListSnapshotsRequest{SnapshotId: "no-such-snapshot"})
+	require.NoError(t, err, "list unknown snapshot")
+	assert.Empty(t, list.Entries, "unknown snapshot")
+
+	// The snapshot survives a restart.
+	restarted := NewNodeControllerServer(ctx, "node", dm, sm, snapshotState, "", pmdmanager.Options{})
+	assert.NotNil(t, restarted.getSnapshotByID(snapshotID), "restored snapshot")
+
+	source := &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Snapshot{
+			Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: snapshotID},
+		},
+	}
+	_, err = cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:                "too-small",
+		VolumeCapabilities:  capabilities,
+		CapacityRange:       &csi.CapacityRange{LimitBytes: 1024},
+		VolumeContentSource: source,
+	})
+	assert.Equal(t, codes.OutOfRange, status.Code(err), "too small for snapshot: %v", err)
+	restored, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name:                "restored",
+		VolumeCapabilities:  capabilities,
+		VolumeContentSource: source,
+	})
+	require.NoError(t, err, "restore snapshot")
+	assert.Equal(t, snap.Snapshot.SizeBytes, restored.Volume.CapacityBytes, "restored volume size")
+	assert.Equal(t, source, restored.Volume.ContentSource, "content source")
+
+	_, err = cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	require.NoError(t, err, "delete snapshot")
+	_, err = cs.DeleteSnapshot(ctx, &csi.DeleteSnapshotRequest{SnapshotId: snapshotID})
+	require.NoError(t, err, "delete snapshot again")
+	ids, err := snapshotState.GetAll()
+	require.NoError(t, err, "get snapshot state")
+	assert.Empty(t, ids, "snapshot state")
+}
@@ -0,0 +1,148 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+var (
+	stateRecords = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pmem_state_records",
+			Help: "Number of records in each part of the node state (volumes, snapshots, trash, scrub, checksums), as of the most recent compaction.",
+		},
+		[]string{"store"},
+	)
+	stateDatabaseBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "pmem_state_database_bytes",
+			Help: "Size of the database file of each part of the node state after the most recent compaction.",
+		},
+		[]string{"store"},
+	)
+	statePrunedRecords = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmem_state_pruned_records_total",
+			Help: "Number of records which were removed because they belong to volumes that no longer exist (checksums) or exceed the deleted versions that are kept per volume (trash).",
+		},
+		[]string{"store"},
+	)
+)
+
+// MustRegisterStateMetrics adds the metrics of the state compaction
+// and of the state operations to the registry, using labels to tag
+// each sample with node and driver name.
+func MustRegisterStateMetrics(reg prometheus.Registerer, nodeName, driverName string) {
+	reg = prometheus.WrapRegistererWith(prometheus.Labels{
+		pmdmanager.NodeLabel: nodeName,
+		"driver_name":        driverName,
+	}, reg)
+	reg.MustRegister(stateRecords)
+	reg.MustRegister(stateDatabaseBytes)
+	reg.MustRegister(statePrunedRecords)
+	pmemstate.MustRegisterMetrics(reg)
+}
+
+// stateStore is one part of the state, stored in a sub-directory of
+// the state directory.
+type stateStore struct {
+	name string
+	dir  string
+	sm   pmemstate.StateManager
+}
+
+// runStateCompaction compacts the state right away and then
+// periodically in the background.
+func (cs *nodeControllerServer) runStateCompaction(ctx context.Context, statePath string, interval time.Duration) {
+	logger := klog.FromContext(ctx).WithName("state-compaction")
+	ctx = klog.NewContext(ctx, logger)
+	go wait.UntilWithContext(ctx, func(ctx context.Context) {
+		cs.compactState(ctx, statePath)
+	}, interval)
+}
+
+// compactState removes records of volumes which no longer exist, then
+// gives back the space of deleted records and updates the metrics.
+// Failures only get logged, the next run tries again.
+func (cs *nodeControllerServer) compactState(ctx context.Context, statePath string) {
+	logger := klog.FromContext(ctx)
+	stores := []stateStore{
+		{name: "volumes", sm: cs.sm},
+		{name: "snapshots", dir: snapshotDirectory, sm: cs.snapshotState},
+		{name: "trash", dir: trashDirectory, sm: cs.trash},
+	}
+	if cs.scrubber != nil {
+		stores = append(stores, stateStore{name: "scrub", dir: scrubDirectory, sm: cs.scrubber.state})
+	}
+	// Checksums only exist after using the verify-volumes mode,
+	// which records them in a different process.
+	if _, err := os.Stat(filepath.Join(statePath, checksumDirectory)); err == nil {
+		checksums, err := pmemstate.NewDBState(filepath.Join(statePath, checksumDirectory))
+		if err != nil {
+			logger.Error(err, "Failed to open checksums")
+		} else {
+			checksums = pmemstate.NewInstrumented(checksums, "checksums")
+			cs.pruneChecksums(ctx, checksums)
+			stores = append(stores, stateStore{name: "checksums", dir: checksumDirectory, sm: checksums})
+		}
+	}
+
+	for _, store := range stores {
+		if store.sm == nil {
+			continue
+		}
+		logger := logger.WithValues("store", store.name)
+		if compactor, ok := store.sm.(pmemstate.Compactor); ok {
+			if err := compactor.Compact(); err != nil {
+				logger.Error(err, "Failed to compact state")
+			}
+		}
+		ids, err := store.sm.GetAll()
+		if err != nil {
+			logger.Error(err, "Failed to list state")
+			continue
+		}
+		stateRecords.WithLabelValues(store.name).Set(float64(len(ids)))
+		if info, err := os.Stat(filepath.Join(statePath, store.dir, pmemstate.DBFile)); err == nil {
+			stateDatabaseBytes.WithLabelValues(store.name).Set(float64(info.Size()))
+		}
+		logger.V(3).Info("Compacted state", "records", len(ids))
+	}
+}
+
+// pruneChecksums removes the checksums of volumes which no longer
+// exist. verify-volumes only does that when recording checksums.
+func (cs *nodeControllerServer) pruneChecksums(ctx context.Context, checksums pmemstate.StateManager) {
+	logger := klog.FromContext(ctx)
+	ids, err := checksums.GetAll()
+	if err != nil {
+		logger.Error(err, "Failed to list checksums")
+		return
+	}
+	for _, id := range ids {
+		if cs.getVolumeByID(id) != nil {
+			continue
+		}
+		if err := checksums.Delete(id); err != nil {
+			logger.Error(err, "Failed to remove checksum", "volume-id", id)
+			continue
+		}
+		statePrunedRecords.WithLabelValues("checksums").Inc()
+		logger.V(3).Info("Removed checksum of deleted volume", "volume-id", id)
+	}
+}
@@ -0,0 +1,79 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestCompactState(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	stateDir := t.TempDir()
+	sm, err := pmemstate.NewDBState(stateDir)
+	require.NoError(t, err, "create volume state")
+	trash, err := pmemstate.NewDBState(filepath.Join(stateDir, trashDirectory))
+	require.NoError(t, err, "create trash state")
+	checksums, err := pmemstate.NewDBState(filepath.Join(stateDir, checksumDirectory))
+	require.NoError(t, err, "create checksums")
+	for _, id := range []string{"vol-1", "vol-2"} {
+		require.NoError(t, checksums.Create(id, volumeChecksum{Size: 1024}), "store checksum %s", id)
+	}
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	cs.trash = trash
+	vol := &nodeVolume{ID: "vol-1"}
+	require.NoError(t, sm.Create(vol.ID, vol), "store volume")
+	cs.pmemVolumes[vol.ID] = vol
+	pruned := testutil.ToFloat64(statePrunedRecords.WithLabelValues("checksums"))
+
+	cs.compactState(ctx, stateDir)
+	ids, err := checksums.GetAll()
+	require.NoError(t, err, "list checksums")
+	assert.Equal(t, []string{"vol-1"}, ids, "checksum of the deleted volume removed")
+	assert.Equal(t, pruned+1, testutil.ToFloat64(statePrunedRecords.WithLabelValues("checksums")), "pruned checksums")
+	assert.Equal(t, 1.0, testutil.ToFloat64(stateRecords.WithLabelValues("volumes")), "volume records")
+	assert.Equal(t, 0.0, testutil.ToFloat64(stateRecords.WithLabelValues("trash")), "trash records")
+	assert.Equal(t, 1.0, testutil.ToFloat64(stateRecords.WithLabelValues("checksums")), "checksum records")
+	assert.Greater(t, testutil.ToFloat64(stateDatabaseBytes.WithLabelValues("volumes")), 0.0, "volume database size")
+
+	stored := &nodeVolume{}
+	require.NoError(t, sm.Get(vol.ID, stored), "volume after compaction")
+	assert.Equal(t, vol, stored, "stored volume")
+}
+
+func TestExcessTrash(t *testing.T) {
+	now := time.Now()
+	entry := func(volumeID string, age time.Duration, restore bool) *trashedVolume {
+		return &trashedVolume{
+			Volume:  nodeVolume{ID: volumeID},
+			Deleted: now.Add(-age),
+			Restore: restore,
+		}
+	}
+	entries := map[string]*trashedVolume{
+		"a-1": entry("a", 1*time.Hour, false),
+		"a-2": entry("a", 2*time.Hour, false),
+		"a-3": entry("a", 3*time.Hour, true),
+		"a-4": entry("a", 4*time.Hour, false),
+		"b-1": entry("b", 1*time.Hour, false),
+	}
+	assert.Empty(t, excessTrash(entries, 0), "no limit")
+	assert.Equal(t, map[string]bool{"a-4": true}, excessTrash(entries, 2), "restore request kept")
+	assert.Equal(t, map[string]bool{"a-2": true, "a-4": true}, excessTrash(entries, 1), "one per volume")
+}
@@ -0,0 +1,175 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// stateExport is the JSON document that the export-state mode writes
+// and the import-state mode reads. Entries are stored as they are in
+// the state, keyed by their ID.
+type stateExport struct {
+	// NodeID is informational, import does not check it because
+	// it is also used to move volumes to a different node.
+	NodeID    string                     `json:"nodeID,omitempty"`
+	Volumes   map[string]json.RawMessage `json:"volumes"`
+	Snapshots map[string]json.RawMessage `json:"snapshots,omitempty"`
+	Trash     map[string]json.RawMessage `json:"trash,omitempty"`
+	Scrub     map[string]json.RawMessage `json:"scrub,omitempty"`
+	Checksums map[string]json.RawMessage `json:"checksums,omitempty"`
+}
+
+// stateStores maps the sub-directories of the state directory to
+// their part of the export.
+func (export *stateExport) stateStores() map[string]*map[string]json.RawMessage {
+	return map[string]*map[string]json.RawMessage{
+		"":                &export.Volumes,
+		snapshotDirectory: &export.Snapshots,
+		trashDirectory:    &export.Trash,
+		scrubDirectory:    &export.Scrub,
+		checksumDirectory: &export.Checksums,
+	}
+}
+
+// exportState implements the export-state mode.
+func (csid *csiDriver) exportState(ctx context.Context, stdout io.Writer) error {
+	ctx, _ = pmemlog.WithName(ctx, "exportState")
+	if csid.cfg.stateFile == "-" {
+		return exportState(ctx, csid.cfg.StateBasePath, csid.cfg.NodeID, stdout)
+	}
+	file, err := os.OpenFile(csid.cfg.stateFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := exportState(ctx, csid.cfg.StateBasePath, csid.cfg.NodeID, file); err != nil {
+		file.Close() //nolint: errcheck
+		return err
+	}
+	return file.Close()
+}
+
+// importState implements the import-state mode.
+func (csid *csiDriver) importState(ctx context.Context, stdin io.Reader) error {
+	ctx, _ = pmemlog.WithName(ctx, "importState")
+	if csid.cfg.stateFile == "-" {
+		return importState(ctx, csid.cfg.StateBasePath, stdin)
+	}
+	file, err := os.Open(csid.cfg.stateFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close() //nolint: errcheck
+	return importState(ctx, csid.cfg.StateBasePath, file)
+}
+
+// exportState writes all entries of the state directory. It does not
+// modify the state, so it may run while the node driver is running,
+// for example for a support bundle.
+func exportState(ctx context.Context, stateBasePath, nodeID string, out io.Writer) error {
+	logger := klog.FromContext(ctx)
+	export := &stateExport{NodeID: nodeID}
+	for dir, entries := range export.stateStores() {
+		path := filepath.Join(stateBasePath, dir)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			// Sub-directories only exist when the feature
+			// was used.
+			continue
+		}
+		sm, err := pmemstate.OpenReadOnly(path)
+		if err != nil {
+			return err
+		}
+		ids, err := sm.GetAll()
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			var value json.RawMessage
+			if err := sm.Get(id, &value); err != nil {
+				return err
+			}
+			if *entries == nil {
+				*entries = map[string]json.RawMessage{}
+			}
+			(*entries)[id] = value
+		}
+		logger.V(3).Info("Exported state", "directory", dir, "entries", len(ids))
+	}
+	if export.Volumes == nil {
+		// Always present, even when empty.
+		export.Volumes = map[string]json.RawMessage{}
+	}
+	data, err := json.MarshalIndent(export, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode state: %v", err)
+	}
+	if _, err := out.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("write state: %v", err)
+	}
+	logger.Info("State exported", "volumes", len(export.Volumes))
+	return nil
+}
+
+// importState stores all entries of an export in the state directory.
+// Entries with the same ID get replaced, other entries are kept. The
+// whole export gets checked before anything is stored. The node
+// driver must not be running because it only reads the state when
+// it starts.
+func importState(ctx context.Context, stateBasePath string, in io.Reader) error {
+	logger := klog.FromContext(ctx)
+	export := &stateExport{}
+	decoder := json.NewDecoder(in)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(export); err != nil {
+		return fmt.Errorf("decode state: %v", err)
+	}
+	for id, value := range export.Volumes {
+		vol := &nodeVolume{}
+		if err := json.Unmarshal(value, vol); err != nil {
+			return fmt.Errorf("volume %s: %v", id, err)
+		}
+		if vol.ID != id {
+			return fmt.Errorf("volume %s: entry has ID %q", id, vol.ID)
+		}
+		if _, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params); err != nil {
+			return fmt.Errorf("volume %s: %v", id, err)
+		}
+	}
+
+	if err := os.MkdirAll(stateBasePath, 0750); err != nil {
+		return err
+	}
+	for dir, entries := range export.stateStores() {
+		if len(*entries) == 0 {
+			continue
+		}
+		sm, err := pmemstate.NewDBState(filepath.Join(stateBasePath, dir))
+		if err != nil {
+			return err
+		}
+		for id, value := range *entries {
+			if err := sm.Create(id, value); err != nil {
+				return err
+			}
+		}
+		logger.V(3).Info("Imported state", "directory", dir, "entries", len(*entries))
+	}
+	logger.Info("State imported", "node", export.NodeID, "volumes", len(export.Volumes))
+	return nil
+}
@@ -0,0 +1,99 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestExportImportState(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	vol := &nodeVolume{ID: "vol-1", Size: 1024, Params: map[string]string{
+		parameters.DeviceMode: string(api.DeviceModeLVM),
+		parameters.Name:       "pvc-1",
+	}}
+	snap := &nodeSnapshot{ID: "snap-1", SourceVolumeID: vol.ID, Size: 1024, DeviceMode: api.DeviceModeLVM}
+
+	oldDir := t.TempDir()
+	sm, err := pmemstate.NewDBState(oldDir)
+	require.NoError(t, err, "create state")
+	require.NoError(t, sm.Create(vol.ID, vol), "store volume")
+	snapshotState, err := pmemstate.NewDBState(filepath.Join(oldDir, snapshotDirectory))
+	require.NoError(t, err, "create snapshot state")
+	require.NoError(t, snapshotState.Create(snap.ID, snap), "store snapshot")
+
+	var out bytes.Buffer
+	require.NoError(t, exportState(ctx, oldDir, "node-1", &out), "export")
+	export := &stateExport{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), export), "decode export")
+	assert.Equal(t, "node-1", export.NodeID, "node ID")
+	assert.Len(t, export.Volumes, 1, "volumes")
+	assert.Len(t, export.Snapshots, 1, "snapshots")
+	assert.Empty(t, export.Trash, "trash")
+
+	// Import into a state directory which does not exist yet.
+	newDir := filepath.Join(t.TempDir(), "state")
+	require.NoError(t, importState(ctx, newDir, bytes.NewReader(out.Bytes())), "import")
+	sm, err = pmemstate.NewDBState(newDir)
+	require.NoError(t, err, "open imported state")
+	imported := &nodeVolume{}
+	require.NoError(t, sm.Get(vol.ID, imported), "get imported volume")
+	assert.Equal(t, vol, imported, "imported volume")
+	snapshotState, err = pmemstate.NewDBState(filepath.Join(newDir, snapshotDirectory))
+	require.NoError(t, err, "open imported snapshot state")
+	importedSnap := &nodeSnapshot{}
+	require.NoError(t, snapshotState.Get(snap.ID, importedSnap), "get imported snapshot")
+	assert.Equal(t, snap.SourceVolumeID, importedSnap.SourceVolumeID, "imported snapshot")
+
+	// Exporting again produces the same document.
+	var again bytes.Buffer
+	require.NoError(t, exportState(ctx, newDir, "node-1", &again), "export imported state")
+	assert.Equal(t, out.String(), again.String(), "export after import")
+
+	for name, tc := range map[string]struct {
+		input       string
+		expectedErr string
+	}{
+		"unknown-field": {
+			input:       `{"volumes": {}, "foo": {}}`,
+			expectedErr: `decode state: json: unknown field "foo"`,
+		},
+		"wrong-id": {
+			input:       `{"volumes": {"vol-2": {"id": "vol-1", "size": 1, "parameters": {}}}}`,
+			expectedErr: `volume vol-2: entry has ID "vol-1"`,
+		},
+		"invalid-parameter": {
+			input:       `{"volumes": {"vol-2": {"id": "vol-2", "size": 1, "parameters": {"foo": "bar"}}}}`,
+			expectedErr: `volume vol-2: parameter "foo" invalid in this context`,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			dir := t.TempDir()
+			err := importState(ctx, dir, strings.NewReader(tc.input))
+			require.Error(t, err, "import")
+			assert.Contains(t, err.Error(), tc.expectedErr, "error")
+			sm, err := pmemstate.NewDBState(dir)
+			require.NoError(t, err, "open state")
+			ids, err := sm.GetAll()
+			require.NoError(t, err, "list state")
+			assert.Empty(t, ids, "nothing imported")
+		})
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// stateFilesystem is the file system of the state namespace.
+const stateFilesystem = "ext4"
+
+// setupStateNamespace ensures that the state directory is on the state
+// namespace when that is enabled.
+func (csid *csiDriver) setupStateNamespace(ctx context.Context) error {
+	size := csid.cfg.stateNamespaceSize.Value()
+	if size == 0 {
+		return nil
+	}
+	if size < 0 {
+		return fmt.Errorf("negative state namespace size %s", csid.cfg.stateNamespaceSize.String())
+	}
+	ctx, _ = pmemlog.WithName(ctx, "setupStateNamespace")
+	device, err := pmdmanager.EnsureStateNamespace(ctx, uint64(size), csid.regionSelection())
+	if err != nil {
+		return fmt.Errorf("state namespace: %v", err)
+	}
+	return mountState(ctx, mount.New(""), device, csid.cfg.StateBasePath)
+}
+
+// mountState mounts the device on the state directory, on top of other
+// mounts, unless it is mounted there already. The device gets
+// formatted if it has no file system yet. The content of a state
+// directory which is not on the device yet gets moved onto it, as long
+// as the device is empty.
+func mountState(ctx context.Context, mounter mount.Interface, device, statePath string) error {
+	logger := klog.FromContext(ctx)
+	statePath = filepath.Clean(statePath)
+
+	mounts, err := mounter.List()
+	if err != nil {
+		return fmt.Errorf("list mounts: %v", err)
+	}
+	// The state directory itself usually is a mount point, for
+	// example the bind mount of the host directory into the
+	// container. The last mount is the one on top.
+	top := ""
+	for _, mnt := range mounts {
+		if filepath.Clean(mnt.Path) == statePath {
+			top = mnt.Device
+		}
+	}
+	if top == device {
+		logger.V(3).Info("State namespace is mounted", "device", device, "path", statePath)
+		return nil
+	}
+
+	if err := provisionDevice(ctx, &pmdmanager.PmemDeviceInfo{Path: device}, stateFilesystem, nil); err != nil {
+		return fmt.Errorf("format state namespace %s: %v", device, err)
+	}
+	if err := os.MkdirAll(statePath, 0750); err != nil {
+		return err
+	}
+	entries, err := os.ReadDir(statePath)
+	if err != nil {
+		return err
+	}
+	if len(entries) > 0 {
+		// Files of mounted volumes must not be copied.
+		for _, mnt := range mounts {
+			if strings.HasPrefix(mnt.Path, statePath+"/") {
+				return fmt.Errorf("%s is still mounted, drain the node before moving the state onto the state namespace", mnt.Path)
+			}
+		}
+		if err := moveStateOnto(ctx, device, statePath, entries); err != nil {
+			return fmt.Errorf("move %s onto the state namespace %s: %v", statePath, device, err)
+		}
+	}
+
+	if _, err := pmemexec.RunCommand(ctx, "mount", "-c", device, statePath); err != nil {
+		return fmt.Errorf("mount state namespace %s: %v", device, err)
+	}
+	logger.Info("Mounted state namespace", "device", device, "path", statePath)
+	return nil
+}
+
+// moveStateOnto copies the state directory into the file system of the
+// device via a temporary mount point, then removes the copied entries
+// from that directory. A device which already has content of its own is
+// left alone, because either that or the directory content would get
+// lost.
+func moveStateOnto(ctx context.Context, device, statePath string, entries []os.DirEntry) (finalErr error) {
+	logger := klog.FromContext(ctx)
+	tmp, err := os.MkdirTemp("", "pmem-csi-state-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp) //nolint: errcheck
+	if _, err := pmemexec.RunCommand(ctx, "mount", "-c", device, tmp); err != nil {
+		return err
+	}
+	defer func() {
+		if _, err := pmemexec.RunCommand(ctx, "umount", tmp); err != nil && finalErr == nil {
+			finalErr = err
+		}
+	}()
+
+	existing, err := os.ReadDir(tmp)
+	if err != nil {
+		return err
+	}
+	for _, entry := range existing {
+		if entry.Name() != "lost+found" {
+			return fmt.Errorf("both contain files, remove the content of one of them")
+		}
+	}
+	if _, err := pmemexec.RunCommand(ctx, "cp", "-a", statePath+"/.", tmp); err != nil {
+		return err
+	}
+	if _, err := pmemexec.RunCommand(ctx, "sync", "-f", tmp); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(statePath, entry.Name())); err != nil {
+			return err
+		}
+	}
+	logger.Info("Moved state onto state namespace", "device", device, "path", statePath, "entries", len(entries))
+	return nil
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/klog/v2/ktesting"
+	"k8s.io/mount-utils"
+)
+
+func TestMountState(t *testing.T) {
+	for name, mounts := range map[string][]string{
+		"mounted": {"/dev/pmem0.1"},
+		// The host directory is mounted in the container.
+		"on-top": {"/dev/sda1", "/dev/pmem0.1"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			var mps []mount.MountPoint
+			for _, device := range mounts {
+				mps = append(mps, mount.MountPoint{
+					Device: device,
+					Path:   "/var/lib/pmem-csi.intel.com",
+					Type:   stateFilesystem,
+				})
+			}
+			mounter := mount.NewFakeMounter(mps)
+			// Nothing gets executed when the state namespace
+			// is mounted already.
+			err := mountState(ctx, mounter, "/dev/pmem0.1", "/var/lib/pmem-csi.intel.com/")
+			assert.NoError(t, err, "mount state")
+			assert.Empty(t, mounter.GetLog(), "mount calls")
+		})
+	}
+}
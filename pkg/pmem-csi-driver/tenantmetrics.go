@@ -0,0 +1,120 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const (
+	// NamespaceLabel is the label on per-volume metrics (see
+	// volumeCollector) which identifies the Kubernetes namespace
+	// of the PVC.
+	NamespaceLabel = "namespace"
+
+	// tenantMetricsSuffix gets appended to the metrics path for
+	// the tenant-scoped view.
+	tenantMetricsSuffix = "/tenant"
+)
+
+// tenantTokens maps a bearer token to the Kubernetes namespace whose
+// metrics may be seen with that token.
+type tenantTokens map[string]string
+
+// loadTenantTokens reads a JSON file with a map from token to namespace.
+func loadTenantTokens(filename string) (tenantTokens, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("read tenant tokens: %v", err)
+	}
+	var tokens tenantTokens
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("parse tenant tokens from %q: %v", filename, err)
+	}
+	for token, namespace := range tokens {
+		if token == "" || namespace == "" {
+			return nil, fmt.Errorf("tenant tokens in %q: empty token or namespace", filename)
+		}
+	}
+	return tokens, nil
+}
+
+// lookup returns the namespace for the token. All tokens get compared
+// in constant time to avoid leaking information through timing.
+func (tt tenantTokens) lookup(token string) (string, bool) {
+	var namespace string
+	found := false
+	for t, ns := range tt {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			namespace = ns
+			found = true
+		}
+	}
+	return namespace, found
+}
+
+// tenantMetricsHandler serves only those samples which have the
+// namespace label set to the namespace that belongs to the bearer
+// token of the request.
+func tenantMetricsHandler(gatherer prometheus.Gatherer, tokens tenantTokens) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The scheme is required, a bare token is not accepted.
+		token, isBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		namespace, ok := tokens.lookup(token)
+		if !isBearer || token == "" || !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		promhttp.HandlerFor(namespaceGatherer{gatherer: gatherer, namespace: namespace}, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
+
+// namespaceGatherer filters the output of another gatherer.
+type namespaceGatherer struct {
+	gatherer  prometheus.Gatherer
+	namespace string
+}
+
+var _ prometheus.Gatherer = namespaceGatherer{}
+
+// Gather implements prometheus.Gatherer.Gather.
+func (ng namespaceGatherer) Gather() ([]*dto.MetricFamily, error) {
+	mfs, err := ng.gatherer.Gather()
+	var result []*dto.MetricFamily
+	for _, mf := range mfs {
+		var metrics []*dto.Metric
+		for _, m := range mf.Metric {
+			if hasLabel(m, NamespaceLabel, ng.namespace) {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) > 0 {
+			mf.Metric = metrics
+			result = append(result, mf)
+		}
+	}
+	return result, err
+}
+
+func hasLabel(m *dto.Metric, name, value string) bool {
+	for _, label := range m.Label {
+		if label.GetName() == name {
+			return label.GetValue() == value
+		}
+	}
+	return false
+}
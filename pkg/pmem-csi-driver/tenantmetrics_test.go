@@ -0,0 +1,93 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestTenantMetrics(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	cs := &nodeControllerServer{
+		pmemVolumes: map[string]*nodeVolume{
+			"vol-a": {
+				ID:   "vol-a",
+				Size: 1024 * 1024,
+				Params: map[string]string{
+					parameters.PVName:       "pv-a",
+					parameters.PVCNamespace: "tenant-a",
+					parameters.PVCName:      "pvc-a",
+				},
+			},
+			"vol-b": {
+				ID:   "vol-b",
+				Size: 2 * 1024 * 1024,
+				Params: map[string]string{
+					parameters.PVName:       "pv-b",
+					parameters.PVCNamespace: "tenant-b",
+					parameters.PVCName:      "pvc-b",
+				},
+			},
+		},
+	}
+	volumeCollector{cs: cs}.MustRegister(registry, "worker", "pmem-csi.intel.com")
+	handler := tenantMetricsHandler(registry, tenantTokens{"token-a": "tenant-a"})
+
+	cases := map[string]struct {
+		authorization string
+		statusCode    int
+		contains      string
+		notContains   string
+	}{
+		"no-token": {
+			statusCode: http.StatusUnauthorized,
+		},
+		"no-scheme": {
+			authorization: "token-a",
+			statusCode:    http.StatusUnauthorized,
+		},
+		"wrong-scheme": {
+			authorization: "Basic token-a",
+			statusCode:    http.StatusUnauthorized,
+		},
+		"wrong-token": {
+			authorization: "Bearer token-b",
+			statusCode:    http.StatusUnauthorized,
+		},
+		"okay": {
+			authorization: "Bearer token-a",
+			statusCode:    http.StatusOK,
+			contains:      `pmem_volume_size_bytes{driver_name="pmem-csi.intel.com",namespace="tenant-a",node="worker",persistentvolume="pv-a",persistentvolumeclaim="pvc-a",volume_id="vol-a"} 1.048576e+06`,
+			notContains:   `vol-b`,
+		},
+	}
+	for n, c := range cases {
+		t.Run(n, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/metrics/tenant", nil)
+			if c.authorization != "" {
+				req.Header.Set("Authorization", c.authorization)
+			}
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, req)
+			assert.Equal(t, c.statusCode, recorder.Code, "status code")
+			body := recorder.Body.String()
+			if c.contains != "" {
+				assert.Contains(t, body, c.contains, "body")
+			}
+			if c.notContains != "" {
+				assert.NotContains(t, body, c.notContains, "body")
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"sort"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// thinPoolCheckInterval determines how often the usage of thin pools
+// gets checked.
+const thinPoolCheckInterval = time.Minute
+
+// thinPoolThresholdReason is the reason of the event which is emitted
+// for the node when a thin pool fills up.
+const thinPoolThresholdReason = "ThinPoolThresholdExceeded"
+
+// thinPoolMonitor warns about thin pools which are fuller than the
+// threshold. Writes to volumes in a full pool fail, so an
+// administrator must free space or add PMEM before that happens.
+type thinPoolMonitor struct {
+	pools     pmdmanager.ThinPools
+	threshold float64
+	recorder  record.EventRecorder
+	node      *v1.ObjectReference
+
+	// exceeded contains the volume groups for which the event was
+	// emitted. The event gets emitted again after the usage went
+	// below the threshold and then exceeded it again.
+	exceeded map[string]bool
+}
+
+// newEventRecorder creates a recorder for events of the node driver.
+func newEventRecorder(client kubernetes.Interface, driverName, nodeName string) (record.EventBroadcaster, record.EventRecorder) {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: driverName, Host: nodeName})
+	return broadcaster, recorder
+}
+
+func newThinPoolMonitor(pools pmdmanager.ThinPools, threshold uint, recorder record.EventRecorder, nodeName string) *thinPoolMonitor {
+	return &thinPoolMonitor{
+		pools:     pools,
+		threshold: float64(threshold),
+		recorder:  recorder,
+		node: &v1.ObjectReference{
+			Kind: "Node",
+			Name: nodeName,
+			// Events for nodes must use the node name as UID,
+			// otherwise "kubectl describe node" does not show
+			// them.
+			UID: k8stypes.UID(nodeName),
+		},
+		exceeded: map[string]bool{},
+	}
+}
+
+// check emits an event for each pool which exceeds the threshold.
+func (m *thinPoolMonitor) check(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	usage, err := m.pools.GetThinPoolUsage(ctx)
+	if err != nil {
+		logger.Error(err, "Checking thin pools failed")
+		return
+	}
+	var vgNames []string
+	for vgName := range usage {
+		vgNames = append(vgNames, vgName)
+	}
+	sort.Strings(vgNames)
+	for _, vgName := range vgNames {
+		percent := usage[vgName]
+		switch {
+		case percent >= m.threshold && !m.exceeded[vgName]:
+			m.exceeded[vgName] = true
+			logger.Info("Thin pool exceeds threshold", "vg", vgName, "data-percent", percent, "threshold", m.threshold)
+			m.recorder.Eventf(m.node, v1.EventTypeWarning, thinPoolThresholdReason,
+				"Thin pool in volume group %s is %.1f%% full, threshold is %.0f%%.", vgName, percent, m.threshold)
+		case percent < m.threshold && m.exceeded[vgName]:
+			delete(m.exceeded, vgName)
+			logger.Info("Thin pool below threshold again", "vg", vgName, "data-percent", percent, "threshold", m.threshold)
+		}
+	}
+}
+
+// run checks the pools in the background.
+func (m *thinPoolMonitor) run(ctx context.Context) {
+	go wait.UntilWithContext(ctx, m.check, thinPoolCheckInterval)
+}
@@ -0,0 +1,60 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/ktesting"
+)
+
+type fakeThinPools map[string]float64
+
+func (f fakeThinPools) GetThinPoolUsage(ctx context.Context) (map[string]float64, error) {
+	return f, nil
+}
+
+func (f fakeThinPools) IsThinDevice(ctx context.Context, name string) (bool, error) {
+	return false, nil
+}
+
+func TestThinPoolMonitor(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	pools := fakeThinPools{"vg0": 10, "vg1": 85}
+	recorder := record.NewFakeRecorder(10)
+	m := newThinPoolMonitor(pools, 80, recorder, "node")
+
+	events := func() []string {
+		var events []string
+		for {
+			select {
+			case event := <-recorder.Events:
+				events = append(events, event)
+			default:
+				return events
+			}
+		}
+	}
+
+	m.check(ctx)
+	assert.Equal(t, []string{"Warning ThinPoolThresholdExceeded Thin pool in volume group vg1 is 85.0% full, threshold is 80%."}, events(), "first check")
+	m.check(ctx)
+	assert.Empty(t, events(), "no repeated event")
+
+	pools["vg1"] = 50
+	m.check(ctx)
+	assert.Empty(t, events(), "below threshold")
+	pools["vg0"], pools["vg1"] = 90, 95
+	m.check(ctx)
+	assert.Equal(t, []string{
+		"Warning ThinPoolThresholdExceeded Thin pool in volume group vg0 is 90.0% full, threshold is 80%.",
+		"Warning ThinPoolThresholdExceeded Thin pool in volume group vg1 is 95.0% full, threshold is 80%.",
+	}, events(), "threshold exceeded again")
+}
@@ -0,0 +1,86 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.17.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"k8s.io/component-base/tracing"
+	tracingapi "k8s.io/component-base/tracing/api/v1"
+	"k8s.io/klog/v2"
+
+	pmemtracing "github.com/intel/pmem-csi/pkg/tracing"
+)
+
+// startTracing creates the tracer provider which exports spans to
+// the configured OTLP endpoint. The returned function flushes spans
+// which were not sent yet.
+func (csid *csiDriver) startTracing(ctx context.Context) (func(), error) {
+	if csid.cfg.tracingEndpoint == "" {
+		return func() {}, nil
+	}
+	rate := int32(csid.cfg.tracingSamplingRatePerMillion)
+	config := &tracingapi.TracingConfiguration{
+		Endpoint:               &csid.cfg.tracingEndpoint,
+		SamplingRatePerMillion: &rate,
+	}
+	tp, err := tracing.NewProvider(ctx, config, nil, []resource.Option{
+		resource.WithAttributes(
+			semconv.ServiceName("pmem-csi-driver"),
+			semconv.ServiceVersion(csid.cfg.Version),
+			semconv.HostName(csid.cfg.NodeID),
+			attribute.String("pmem-csi.driver-name", csid.cfg.DriverName),
+			attribute.String("pmem-csi.mode", string(csid.cfg.Mode)),
+		),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("tracing: %v", err)
+	}
+	csid.tracerProvider = tp
+	logger := klog.FromContext(ctx)
+	return func() {
+		// ctx is usually canceled already.
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			logger.Error(err, "Flushing traces failed")
+		}
+	}, nil
+}
+
+// tracingServerOptions create a span for each gRPC call. Sidecars
+// which trace their calls pass the parent span in the gRPC metadata.
+func (csid *csiDriver) tracingServerOptions() []grpc.ServerOption {
+	if csid.tracerProvider == nil {
+		return nil
+	}
+	return []grpc.ServerOption{
+		grpc.StatsHandler(otelgrpc.NewServerHandler(
+			otelgrpc.WithTracerProvider(csid.tracerProvider),
+			otelgrpc.WithPropagators(tracing.Propagators()),
+		)),
+		grpc.ChainUnaryInterceptor(traceVolumeID),
+	}
+}
+
+// traceVolumeID adds the volume ID to the span of the call, if there
+// is one. For CreateVolume it is only known after the call.
+func traceVolumeID(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if volumeID := operationVolumeID(req, resp); volumeID != "" {
+		trace.SpanFromContext(ctx).SetAttributes(pmemtracing.VolumeID(volumeID))
+	}
+	return resp, err
+}
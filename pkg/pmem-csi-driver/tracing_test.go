@@ -0,0 +1,45 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+	"k8s.io/klog/v2/ktesting"
+
+	pmemtracing "github.com/intel/pmem-csi/pkg/tracing"
+)
+
+func TestTraceVolumeID(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+
+	ctx, span := tp.Tracer("test").Start(ctx, "CreateVolume")
+	_, err := traceVolumeID(ctx, &csi.CreateVolumeRequest{Name: "pvc-1"}, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		// Nested spans use the same provider.
+		_, nested := pmemtracing.Start(ctx, "CreateDevice", pmemtracing.VolumeID("vol-1"))
+		pmemtracing.End(nested, nil)
+		return &csi.CreateVolumeResponse{Volume: &csi.Volume{VolumeId: "vol-1"}}, nil
+	})
+	require.NoError(t, err, "call")
+	span.End()
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 2, "spans")
+	assert.Equal(t, "CreateDevice", spans[0].Name(), "nested span")
+	assert.Equal(t, span.SpanContext().SpanID(), spans[0].Parent().SpanID(), "parent of nested span")
+	assert.Contains(t, spans[1].Attributes(), pmemtracing.VolumeID("vol-1"), "volume ID of call")
+}
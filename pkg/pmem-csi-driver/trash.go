@@ -0,0 +1,367 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+const (
+	// trashDirectory is the sub-directory of the state directory
+	// where deleted volumes are recorded while they are in the trash.
+	trashDirectory = "trash"
+
+	// trashCheckInterval is how often the node driver looks for
+	// expired volumes and restore requests.
+	trashCheckInterval = 10 * time.Second
+
+	// undeletePollInterval is how often the undelete-volume mode
+	// checks whether the node driver has restored the volume.
+	undeletePollInterval = time.Second
+)
+
+// trashedVolume is stored for each volume in the trash, under the
+// name of its device.
+type trashedVolume struct {
+	Volume nodeVolume `json:"volume"`
+	// Device is the name of the device while the volume is in the
+	// trash. It is the volume ID if the device manager cannot
+	// rename devices.
+	Device  string    `json:"device"`
+	Deleted time.Time `json:"deleted"`
+	Expires time.Time `json:"expires"`
+	// Restore gets set by the undelete-volume mode. The node driver
+	// then moves the volume back.
+	Restore bool `json:"restore,omitempty"`
+	// RestoreError explains why the last restore request failed.
+	RestoreError string `json:"restoreError,omitempty"`
+}
+
+// trashDeviceName returns a name for the device of a deleted volume
+// which is as long as a volume ID and does not conflict with a volume
+// that gets created later with the same name.
+func trashDeviceName(volumeID string, deleted time.Time) string {
+	hasher := sha256.New224()
+	hasher.Write([]byte(volumeID + "@" + deleted.UTC().Format(time.RFC3339Nano)))
+	return "trash-" + hex.EncodeToString(hasher.Sum(nil))
+}
+
+// moveToTrash renames the device of the volume and records it in the
+// trash. The caller then removes the volume from the normal state.
+// Device managers which cannot rename devices (direct mode) fail with
+// pmemerr.NotSupported.
+func (cs *nodeControllerServer) moveToTrash(ctx context.Context, dm pmdmanager.PmemDeviceManager, vol *nodeVolume) error {
+	logger := klog.FromContext(ctx)
+	now := time.Now()
+	entry := trashedVolume{
+		Volume:  *vol,
+		Device:  trashDeviceName(vol.ID, now),
+		Deleted: now,
+		Expires: now.Add(cs.retention),
+	}
+	entry.Volume.Writer = ""
+
+	// Recording the entry first ensures that the device does not
+	// get leaked when the driver gets killed after renaming it.
+	if err := cs.trash.Create(entry.Device, &entry); err != nil {
+		return fmt.Errorf("record volume in trash: %v", err)
+	}
+	err := dm.RenameDevice(ctx, vol.ID, entry.Device)
+	switch {
+	case err == nil:
+	default:
+		if err := cs.trash.Delete(entry.Device); err != nil {
+			logger.Error(err, "Failed to remove trash entry")
+		}
+		// NotSupported gets passed through. A device which keeps
+		// its name would block the volume ID for new volumes.
+		return fmt.Errorf("rename device: %w", err)
+	}
+	logger.V(3).Info("Moved volume to trash", "device", entry.Device, "expires", entry.Expires)
+	return nil
+}
+
+// runTrash processes the trash in the background.
+func (cs *nodeControllerServer) runTrash(ctx context.Context) {
+	logger := klog.FromContext(ctx).WithName("trash")
+	ctx = klog.NewContext(ctx, logger)
+	go wait.UntilWithContext(ctx, cs.processTrash, trashCheckInterval)
+}
+
+// processTrash restores volumes for which the admin has requested
+// that and erases volumes whose retention period is over or which
+// exceed the number of deleted versions per volume ID.
+func (cs *nodeControllerServer) processTrash(ctx context.Context) {
+	logger := klog.FromContext(ctx)
+	names, err := cs.trash.GetAll()
+	if err != nil {
+		logger.Error(err, "Failed to list trash")
+		return
+	}
+	entries := map[string]*trashedVolume{}
+	for _, name := range names {
+		entry := &trashedVolume{}
+		if err := cs.trash.Get(name, entry); err != nil {
+			logger.Error(err, "Failed to retrieve trash entry", "device", name)
+			continue
+		}
+		entries[name] = entry
+	}
+	excess := excessTrash(entries, cs.maxTrashedPerVolume)
+	now := time.Now()
+	for _, name := range names {
+		entry, ok := entries[name]
+		if !ok {
+			continue
+		}
+		logger := logger.WithValues("device", name)
+		ctx := klog.NewContext(ctx, logger)
+		switch {
+		case entry.Restore:
+			if err := cs.restoreFromTrash(ctx, name, entry); err != nil {
+				logger.Error(err, "Failed to restore volume", "volume-id", entry.Volume.ID)
+				entry.Restore = false
+				entry.RestoreError = err.Error()
+				if err := cs.trash.Create(name, entry); err != nil {
+					logger.Error(err, "Failed to update trash entry")
+				}
+				continue
+			}
+			logger.Info("Restored volume", "volume-id", entry.Volume.ID)
+		case !now.Before(entry.Expires) || excess[name]:
+			if err := cs.eraseFromTrash(ctx, name, entry); err != nil {
+				// Tried again next time.
+				logger.Error(err, "Failed to erase volume", "volume-id", entry.Volume.ID)
+				continue
+			}
+			if excess[name] {
+				statePrunedRecords.WithLabelValues("trash").Inc()
+			}
+			logger.V(3).Info("Erased volume", "volume-id", entry.Volume.ID, "excess", excess[name])
+		}
+	}
+}
+
+// excessTrash returns the names of the entries which are older than
+// the most recently deleted max entries with the same volume ID. Entries
+// which are meant to be restored are always kept. Zero keeps all.
+func excessTrash(entries map[string]*trashedVolume, max int) map[string]bool {
+	excess := map[string]bool{}
+	if max <= 0 {
+		return excess
+	}
+	byVolume := map[string][]string{}
+	for name, entry := range entries {
+		byVolume[entry.Volume.ID] = append(byVolume[entry.Volume.ID], name)
+	}
+	for _, names := range byVolume {
+		sort.Slice(names, func(i, j int) bool {
+			return entries[names[i]].Deleted.After(entries[names[j]].Deleted)
+		})
+		kept := 0
+		for _, name := range names {
+			if kept < max || entries[name].Restore {
+				kept++
+				continue
+			}
+			excess[name] = true
+		}
+	}
+	return excess
+}
+
+func (cs *nodeControllerServer) eraseFromTrash(ctx context.Context, name string, entry *trashedVolume) error {
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, entry.Volume.Params)
+	if err != nil {
+		return fmt.Errorf("previously stored volume parameters: %v", err)
+	}
+	dm, err := cs.deviceManager(ctx, p.GetDeviceMode())
+	if err != nil {
+		return fmt.Errorf("initialize device manager for mode %s: %v", p.GetDeviceMode(), err)
+	}
+	if p.GetErasePolicy() == parameters.EraseCrypto {
+		if err := cryptoErase(ctx, dm, entry.Device); err != nil {
+			return err
+		}
+	}
+	if !p.GetEraseAfter() || !cs.freeDevice(ctx, dm, entry.Device, entry.Volume.Size) {
+		if err := dm.DeleteDevice(ctx, entry.Device, p.GetEraseAfter()); err != nil {
+			return err
+		}
+	}
+	if p.GetEncryption() != parameters.EncryptionNone {
+		if err := cs.keyProvider().deleteKey(ctx, entry.Volume.ID); err != nil {
+			klog.FromContext(ctx).Error(err, "Failed to delete encryption key", "volume-id", entry.Volume.ID)
+		}
+	}
+	return cs.trash.Delete(name)
+}
+
+func (cs *nodeControllerServer) restoreFromTrash(ctx context.Context, name string, entry *trashedVolume) error {
+	volumeID := entry.Volume.ID
+	nodeVolumeMutex.LockKey(volumeID)
+	defer nodeVolumeMutex.UnlockKey(volumeID) //nolint: errcheck
+
+	if cs.getVolumeByID(volumeID) != nil {
+		return errors.New("a volume with the same ID exists")
+	}
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, entry.Volume.Params)
+	if err != nil {
+		return fmt.Errorf("previously stored volume parameters: %v", err)
+	}
+	dm, err := cs.deviceManager(ctx, p.GetDeviceMode())
+	if err != nil {
+		return fmt.Errorf("initialize device manager for mode %s: %v", p.GetDeviceMode(), err)
+	}
+
+	// As in CreateVolume, the state gets written before the device
+	// appears under the volume ID.
+	vol := entry.Volume
+	if err := cs.sm.Create(volumeID, &vol); err != nil {
+		return fmt.Errorf("store state: %v", err)
+	}
+	if entry.Device != volumeID {
+		if err := dm.RenameDevice(ctx, entry.Device, volumeID); err != nil {
+			if err := cs.sm.Delete(volumeID); err != nil {
+				klog.FromContext(ctx).Error(err, "Removing volume from persistent state failed")
+			}
+			return fmt.Errorf("rename device: %v", err)
+		}
+	}
+	if device, err := dm.GetDevice(ctx, volumeID); err == nil {
+		if err := cs.updateDeviceLink(volumeID, device.Path); err != nil {
+			klog.FromContext(ctx).Error(err, "Creating device link failed")
+		}
+	}
+	if err := cs.trash.Delete(name); err != nil {
+		klog.FromContext(ctx).Error(err, "Failed to remove trash entry")
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	cs.pmemVolumes[volumeID] = &vol
+	return nil
+}
+
+// undeleteVolume implements the undelete-volume mode. Without a
+// volume ID it lists the content of the trash.
+func (csid *csiDriver) undeleteVolume(ctx context.Context, out io.Writer) error {
+	ctx, _ = pmemlog.WithName(ctx, "undeleteVolume")
+	trash, err := pmemstate.NewDBState(filepath.Join(csid.cfg.StateBasePath, trashDirectory))
+	if err != nil {
+		return err
+	}
+	if csid.cfg.volumeID == "" {
+		return listTrash(trash, out)
+	}
+	return requestUndelete(ctx, trash, csid.cfg.volumeID, 3*trashCheckInterval)
+}
+
+// listTrash prints one line per volume in the trash, sorted by
+// the time when they were deleted.
+func listTrash(trash pmemstate.StateManager, out io.Writer) error {
+	entries, err := getTrash(trash)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "VOLUME ID\tNAME\tSIZE\tDELETED\tEXPIRES")
+	for _, entry := range entries {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+			entry.Volume.ID,
+			entry.Volume.Params[parameters.Name],
+			pmemlog.CapacityRef(entry.Volume.Size),
+			entry.Deleted.Format(time.RFC3339),
+			entry.Expires.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+// requestUndelete asks the node driver to restore the most recently
+// deleted volume with the ID and waits for it to do so.
+func requestUndelete(ctx context.Context, trash pmemstate.StateManager, volumeID string, timeout time.Duration) error {
+	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID)
+	entries, err := getTrash(trash)
+	if err != nil {
+		return err
+	}
+	var entry *trashedVolume
+	for _, e := range entries {
+		if e.Volume.ID == volumeID {
+			entry = e
+		}
+	}
+	if entry == nil {
+		return fmt.Errorf("volume %s not found in trash", volumeID)
+	}
+	entry.Restore = true
+	entry.RestoreError = ""
+	if err := trash.Create(entry.Device, entry); err != nil {
+		return fmt.Errorf("request restore: %v", err)
+	}
+	logger.Info("Requested restore", "device", entry.Device)
+
+	var restoreErr error
+	err = wait.PollUntilContextTimeout(ctx, undeletePollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		current := &trashedVolume{}
+		if err := trash.Get(entry.Device, current); err != nil {
+			// No longer in the trash.
+			return true, nil
+		}
+		if current.RestoreError != "" {
+			restoreErr = errors.New(current.RestoreError)
+			return true, nil
+		}
+		return false, nil
+	})
+	switch {
+	case restoreErr != nil:
+		return fmt.Errorf("restore volume %s: %v", volumeID, restoreErr)
+	case err != nil:
+		return fmt.Errorf("volume %s not restored yet, the request remains pending until the node driver handles it: %v", volumeID, err)
+	}
+	logger.Info("Volume restored")
+	return nil
+}
+
+// getTrash returns all entries, sorted by the time when they were
+// deleted.
+func getTrash(trash pmemstate.StateManager) ([]*trashedVolume, error) {
+	names, err := trash.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	var entries []*trashedVolume
+	for _, name := range names {
+		entry := &trashedVolume{}
+		if err := trash.Get(name, entry); err != nil {
+			return nil, fmt.Errorf("trash entry %s: %v", name, err)
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Deleted.Before(entries[j].Deleted)
+	})
+	return entries, nil
+}
@@ -0,0 +1,208 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// noRenameDM behaves like the device manager for direct mode.
+type noRenameDM struct {
+	pmdmanager.PmemDeviceManager
+}
+
+func (noRenameDM) RenameDevice(ctx context.Context, name, newName string) error {
+	return fmt.Errorf("rename %s: %w", name, pmemerr.NotSupported)
+}
+
+func TestTrash(t *testing.T) {
+	for name, rename := range map[string]bool{"rename": true, "no-rename": false} {
+		t.Run(name, func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+			require.NoError(t, err, "create fake device manager")
+			if !rename {
+				dm = noRenameDM{dm}
+			}
+			stateDir := t.TempDir()
+			sm, err := pmemstate.NewFileState(stateDir)
+			require.NoError(t, err, "create volume state")
+			trash, err := pmemstate.NewFileState(filepath.Join(stateDir, trashDirectory))
+			require.NoError(t, err, "create trash state")
+			cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+			cs.trash = trash
+			cs.retention = time.Hour
+
+			create := func(name string) string {
+				vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+					Name: name,
+					VolumeCapabilities: []*csi.VolumeCapability{{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+					}},
+					CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+				})
+				require.NoError(t, err, "create volume %s", name)
+				return vol.Volume.VolumeId
+			}
+			remove := func(volumeID string) {
+				_, err := cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: volumeID})
+				require.NoError(t, err, "delete volume %s", volumeID)
+			}
+			undelete := func(volumeID string) error {
+				result := make(chan error)
+				go func() {
+					result <- requestUndelete(ctx, trash, volumeID, 10*time.Second)
+				}()
+				for {
+					select {
+					case err := <-result:
+						return err
+					case <-time.After(100 * time.Millisecond):
+						cs.processTrash(ctx)
+					}
+				}
+			}
+			deviceNames := func() []string {
+				devices, err := dm.ListDevices(ctx)
+				require.NoError(t, err, "list devices")
+				var names []string
+				for _, device := range devices {
+					names = append(names, device.VolumeId)
+				}
+				return names
+			}
+
+			volumeID := create("vol")
+			remove(volumeID)
+			assert.Nil(t, cs.getVolumeByID(volumeID), "volume hidden")
+			ids, err := sm.GetAll()
+			require.NoError(t, err, "list state")
+			assert.Empty(t, ids, "state")
+			if !rename {
+				// Without renaming, the volume cannot be kept
+				// without blocking its ID and gets erased.
+				assert.Empty(t, deviceNames(), "device erased")
+				entries, err := getTrash(trash)
+				require.NoError(t, err, "get trash")
+				assert.Empty(t, entries, "trash")
+				assert.Equal(t, volumeID, create("vol"), "volume ID of new volume")
+				return
+			}
+			assert.NotContains(t, deviceNames(), volumeID, "device renamed")
+			var out bytes.Buffer
+			require.NoError(t, listTrash(trash, &out), "list trash")
+			assert.Contains(t, out.String(), volumeID, "trash listing")
+
+			// Nothing expired yet.
+			cs.processTrash(ctx)
+			assert.Len(t, deviceNames(), 1, "devices after processing trash")
+
+			require.NoError(t, undelete(volumeID), "undelete")
+			require.NotNil(t, cs.getVolumeByID(volumeID), "volume restored")
+			assert.Equal(t, []string{volumeID}, deviceNames(), "device restored")
+			require.NoError(t, sm.Get(volumeID, &nodeVolume{}), "state restored")
+			entries, err := getTrash(trash)
+			require.NoError(t, err, "get trash")
+			assert.Empty(t, entries, "trash after restore")
+
+			err = requestUndelete(ctx, trash, volumeID, time.Second)
+			assert.Error(t, err, "undelete volume which is not in the trash")
+
+			// The same volume gets created again while the old one is in the trash.
+			remove(volumeID)
+			assert.Equal(t, volumeID, create("vol"), "volume ID of new volume")
+			err = undelete(volumeID)
+			if assert.Error(t, err, "undelete while volume exists") {
+				assert.Contains(t, err.Error(), "same ID exists", "undelete error")
+			}
+
+			// Expire all entries.
+			remove(volumeID)
+			entries, err = getTrash(trash)
+			require.NoError(t, err, "get trash")
+			require.NotEmpty(t, entries, "trash before expiration")
+			for _, entry := range entries {
+				entry.Expires = time.Now().Add(-time.Second)
+				require.NoError(t, trash.Create(entry.Device, entry), "update trash entry")
+			}
+			cs.processTrash(ctx)
+			assert.Empty(t, deviceNames(), "devices after expiration")
+			entries, err = getTrash(trash)
+			require.NoError(t, err, "get trash")
+			assert.Empty(t, entries, "trash after expiration")
+		})
+	}
+}
+
+func TestTrashDisabled(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	stateDir := t.TempDir()
+	sm, err := pmemstate.NewFileState(stateDir)
+	require.NoError(t, err, "create volume state")
+	trash, err := pmemstate.NewFileState(filepath.Join(stateDir, trashDirectory))
+	require.NoError(t, err, "create trash state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	cs.trash = trash
+
+	vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume")
+	_, err = cs.DeleteVolume(ctx, &csi.DeleteVolumeRequest{VolumeId: vol.Volume.VolumeId})
+	require.NoError(t, err, "delete volume")
+	_, err = dm.GetDevice(ctx, vol.Volume.VolumeId)
+	assert.True(t, errors.Is(err, pmemerr.DeviceNotFound), "device deleted: %v", err)
+	entries, err := getTrash(trash)
+	require.NoError(t, err, "get trash")
+	assert.Empty(t, entries, "trash")
+
+	var out bytes.Buffer
+	require.NoError(t, listTrash(trash, &out), "list trash")
+	assert.Equal(t, 1, strings.Count(out.String(), "\n"), "only header in listing:\n%s", out.String())
+}
+
+func TestTrashDirectMode(t *testing.T) {
+	cfg := Config{
+		Mode:           Node,
+		DriverName:     "pmem-csi",
+		NodeID:         "testnode",
+		Endpoint:       "unused",
+		DeviceManager:  api.DeviceModeDirect,
+		trashRetention: time.Hour,
+	}
+	_, err := GetCSIDriver(cfg)
+	assert.Error(t, err, "trash in direct mode")
+
+	cfg.DeviceManager = api.DeviceModeLVM
+	_, err = GetCSIDriver(cfg)
+	assert.NoError(t, err, "trash in LVM mode")
+}
@@ -0,0 +1,73 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"k8s.io/component-base/logs"
+	"k8s.io/klog/v2"
+)
+
+// verbosityPath is where the log verbosity can be read and changed,
+// the same path as in Kubernetes components.
+const verbosityPath = "/debug/flags/v"
+
+// loadVerbosityToken reads the bearer token which is required for
+// changing the log verbosity.
+func loadVerbosityToken(filename string) (string, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return "", fmt.Errorf("read verbosity token: %v", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("verbosity token in %q: empty", filename)
+	}
+	return token, nil
+}
+
+// verbosityHandler returns the current klog verbosity for GET and
+// changes it to the number in the body for PUT. Both need the bearer
+// token.
+func verbosityHandler(token string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		actual, isBearer := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !isBearer || subtle.ConstantTimeCompare([]byte(actual), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			fmt.Fprintln(w, flag.Lookup("v").Value.String())
+		case http.MethodPut:
+			body, err := io.ReadAll(io.LimitReader(r.Body, 100))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			old := flag.Lookup("v").Value.String()
+			msg, err := logs.GlogSetter(strings.TrimSpace(string(body)))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			klog.FromContext(r.Context()).Info("Changed log verbosity", "old", old, "new", flag.Lookup("v").Value.String(), "remote-address", r.RemoteAddr)
+			fmt.Fprint(w, msg)
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, "only GET and PUT are supported", http.StatusMethodNotAllowed)
+		}
+	})
+}
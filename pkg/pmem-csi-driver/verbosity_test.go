@@ -0,0 +1,62 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"flag"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerbosity(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(filename, []byte("secret\n"), 0600), "write token")
+	token, err := loadVerbosityToken(filename)
+	require.NoError(t, err, "load token")
+	assert.Equal(t, "secret", token, "token")
+	require.NoError(t, os.WriteFile(filename, []byte("\n"), 0600), "write empty token")
+	_, err = loadVerbosityToken(filename)
+	assert.Error(t, err, "empty token")
+
+	v := flag.Lookup("v").Value
+	old := v.String()
+	defer func() { _ = v.Set(old) }()
+	require.NoError(t, v.Set("2"), "initial verbosity")
+
+	handler := verbosityHandler(token)
+	do := func(method, authorization, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, verbosityPath, strings.NewReader(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPut, "", "5").Code, "no token")
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPut, "secret", "5").Code, "no scheme")
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodPut, "Bearer wrong", "5").Code, "wrong token")
+	assert.Equal(t, "2", v.String(), "unchanged")
+
+	rec := do(http.MethodGet, "Bearer secret", "")
+	assert.Equal(t, http.StatusOK, rec.Code, "get")
+	assert.Equal(t, "2\n", rec.Body.String(), "get")
+
+	assert.Equal(t, http.StatusBadRequest, do(http.MethodPut, "Bearer secret", "high").Code, "invalid level")
+	assert.Equal(t, http.StatusOK, do(http.MethodPut, "Bearer secret", "5\n").Code, "put")
+	assert.Equal(t, "5", v.String(), "changed")
+
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPost, "Bearer secret", "5").Code, "post")
+}
@@ -0,0 +1,196 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+// checksumDirectory is the sub-directory of the state directory
+// where the verify-volumes mode stores checksums.
+const checksumDirectory = "checksums"
+
+// volumeChecksum is what gets stored for each volume.
+type volumeChecksum struct {
+	SHA256   string    `json:"sha256"`
+	Size     uint64    `json:"size"`
+	Recorded time.Time `json:"recorded"`
+}
+
+// verifyVolumes computes a checksum of the content of each volume on
+// the node and either records it or compares it against the one that
+// was recorded earlier. This only produces meaningful results when
+// no application writes to the volumes, i.e. the node must be drained
+// before recording checksums and must stay drained until they have
+// been verified.
+//
+// An error is returned if any volume has a different content than
+// before or could not be checked.
+func (csid *csiDriver) verifyVolumes(ctx context.Context) error {
+	ctx, logger := pmemlog.WithName(ctx, "verifyVolumes")
+
+	sm, err := pmemstate.NewDBState(csid.cfg.StateBasePath)
+	if err != nil {
+		return err
+	}
+	checksums, err := pmemstate.NewDBState(filepath.Join(csid.cfg.StateBasePath, checksumDirectory))
+	if err != nil {
+		return err
+	}
+	ids, err := sm.GetAll()
+	if err != nil {
+		return err
+	}
+
+	// Device managers get created with zero percentage because
+	// nothing must be changed on the node.
+	dms := map[string]pmdmanager.PmemDeviceManager{}
+	var failed []string
+	for _, id := range ids {
+		logger := logger.WithValues("volume-id", id)
+		result, err := verifyVolume(ctx, sm, checksums, dms, csid.deviceManagerOptions(), id, csid.cfg.recordChecksums)
+		if err != nil {
+			logger.Error(err, "Volume check failed")
+			failed = append(failed, id)
+			continue
+		}
+		logger.Info("Volume checked", "result", result)
+		if result == checksumCorrupted {
+			failed = append(failed, id)
+		}
+	}
+
+	if csid.cfg.recordChecksums {
+		// Remove checksums of volumes which no longer exist.
+		recorded, err := checksums.GetAll()
+		if err != nil {
+			return err
+		}
+		for _, id := range recorded {
+			if !contains(ids, id) {
+				if err := checksums.Delete(id); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	logger.Info("Volume verification is done", "volumes", len(ids), "failed", len(failed))
+	if len(failed) > 0 {
+		return fmt.Errorf("verification failed for volumes: %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+type checksumResult string
+
+const (
+	checksumRecorded  checksumResult = "recorded"
+	checksumOkay      checksumResult = "okay"
+	checksumCorrupted checksumResult = "corrupted"
+	checksumSkipped   checksumResult = "skipped"
+)
+
+func verifyVolume(ctx context.Context, sm, checksums pmemstate.StateManager, dms map[string]pmdmanager.PmemDeviceManager, opts pmdmanager.Options, id string, record bool) (checksumResult, error) {
+	vol := &nodeVolume{}
+	if err := sm.Get(id, vol); err != nil {
+		return "", err
+	}
+	p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+	if err != nil {
+		return "", fmt.Errorf("parse volume parameters: %v", err)
+	}
+	mode := p.GetDeviceMode()
+	dm := dms[string(mode)]
+	if dm == nil {
+		dm, err = pmdmanager.New(ctx, mode, 0, opts)
+		if err != nil {
+			return "", fmt.Errorf("initialize device manager for mode %q: %v", mode, err)
+		}
+		dms[string(mode)] = dm
+	}
+	device, err := dm.GetDevice(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(device.Path, pmdmanager.FakeDevicePathPrefix) {
+		// No content that could be checked.
+		return checksumSkipped, nil
+	}
+
+	klog.FromContext(ctx).V(3).Info("Computing checksum", "volume-id", id, "device", device.Path, "size", pmemlog.CapacityRef(int64(device.Size)))
+	sum, err := computeChecksum(device.Path, device.Size)
+	if err != nil {
+		return "", err
+	}
+	current := volumeChecksum{
+		SHA256:   sum,
+		Size:     device.Size,
+		Recorded: time.Now(),
+	}
+
+	var previous volumeChecksum
+	err = checksums.Get(id, &previous)
+	switch {
+	case record || errors.Is(err, os.ErrNotExist):
+		if err := checksums.Create(id, current); err != nil {
+			return "", err
+		}
+		return checksumRecorded, nil
+	case err != nil:
+		return "", err
+	case previous.SHA256 != current.SHA256 || previous.Size != current.Size:
+		return checksumCorrupted, nil
+	default:
+		return checksumOkay, nil
+	}
+}
+
+// computeChecksum returns the hex-encoded SHA-256 sum of the first
+// size bytes of the file.
+func computeChecksum(path string, size uint64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hasher := sha256.New()
+	n, err := io.Copy(hasher, io.LimitReader(f, int64(size)))
+	if err != nil {
+		return "", fmt.Errorf("read %s: %v", path, err)
+	}
+	if uint64(n) != size {
+		return "", fmt.Errorf("read %s: got %d bytes, expected %d", path, n, size)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+func contains(list []string, value string) bool {
+	for _, entry := range list {
+		if entry == value {
+			return true
+		}
+	}
+	return false
+}
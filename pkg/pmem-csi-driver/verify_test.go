@@ -0,0 +1,30 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestComputeChecksum(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "volume")
+	require.NoError(t, os.WriteFile(path, []byte("hello world, plus some trailing data"), 0600), "write file")
+
+	sum, err := computeChecksum(path, uint64(len("hello world")))
+	if assert.NoError(t, err, "checksum of prefix") {
+		// echo -n "hello world" | sha256sum
+		assert.Equal(t, "b94d27b9934d3e08a52e52d7da7dabfac484efe37a5380ee9088f7ace2efcde9", sum, "checksum")
+	}
+
+	_, err = computeChecksum(path, 1024)
+	assert.Error(t, err, "file smaller than size")
+}
@@ -0,0 +1,180 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+	"k8s.io/mount-utils"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// sysfsBlockRoot can be changed for testing.
+var sysfsBlockRoot = "/sys/class/block"
+
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volumeID := req.GetVolumeId()
+	volumePath := req.GetVolumePath()
+	logger := klog.FromContext(ctx).WithValues("volume-id", volumeID, "volume-path", volumePath)
+	ctx = klog.NewContext(ctx, logger)
+
+	if volumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+	if volumePath == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume path missing in request")
+	}
+	dm, err := ns.getDeviceManagerForVolume(ctx, volumeID)
+	if err != nil {
+		// Already a status error for unknown volumes.
+		return nil, err
+	}
+	info, err := os.Stat(volumePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, status.Errorf(codes.NotFound, "volume path %q not found", volumePath)
+		}
+		return nil, status.Errorf(codes.Internal, "volume path: %v", err)
+	}
+
+	resp := &csi.NodeGetVolumeStatsResponse{
+		VolumeCondition: &csi.VolumeCondition{},
+	}
+	var problems []string
+	device, err := dm.GetDevice(ctx, volumeID)
+	switch {
+	case errors.Is(err, pmemerr.DeviceNotFound):
+		problems = append(problems, "device of the volume is missing, the namespace or logical volume might have been removed")
+	case err != nil:
+		return nil, status.Errorf(codes.Internal, "get device: %v", err)
+	case strings.HasPrefix(device.Path, pmdmanager.FakeDevicePathPrefix):
+		// No media, nothing to check.
+	default:
+		sectors, err := badBlocks(device.Path)
+		if err != nil {
+			// Not all devices report bad blocks.
+			logger.V(3).Info("Checking for bad blocks failed", "device", device.Path, "error", err)
+		} else if sectors > 0 {
+			problems = append(problems, fmt.Sprintf("%d bad sector(s) reported for device %s", sectors, device.Path))
+		}
+	}
+
+	if info.IsDir() {
+		notMnt, err := ns.mounter.IsLikelyNotMountPoint(volumePath)
+		switch {
+		case mount.IsCorruptedMnt(err):
+			problems = append(problems, fmt.Sprintf("volume mount is corrupted: %v", err))
+		case err != nil:
+			return nil, status.Errorf(codes.Internal, "check mount point: %v", err)
+		case notMnt:
+			problems = append(problems, "volume is published, but not mounted")
+		default:
+			var stat unix.Statfs_t
+			if err := unix.Statfs(volumePath, &stat); err != nil {
+				return nil, status.Errorf(codes.Internal, "statfs: %v", err)
+			}
+			bsize := int64(stat.Bsize)
+			resp.Usage = []*csi.VolumeUsage{
+				{
+					Unit:      csi.VolumeUsage_BYTES,
+					Total:     int64(stat.Blocks) * bsize,
+					Available: int64(stat.Bavail) * bsize,
+					Used:      int64(stat.Blocks-stat.Bfree) * bsize,
+				},
+				{
+					Unit:      csi.VolumeUsage_INODES,
+					Total:     int64(stat.Files),
+					Available: int64(stat.Ffree),
+					Used:      int64(stat.Files - stat.Ffree),
+				},
+			}
+			ns.cs.usage.set(volumeID, resp.Usage)
+		}
+	} else if device != nil {
+		// Raw block volume, only the size is known.
+		resp.Usage = []*csi.VolumeUsage{{
+			Unit:  csi.VolumeUsage_BYTES,
+			Total: int64(device.Size),
+		}}
+	}
+
+	if len(problems) > 0 {
+		resp.VolumeCondition.Abnormal = true
+		resp.VolumeCondition.Message = strings.Join(problems, "; ")
+		logger.V(3).Info("Volume is abnormal", "condition", resp.VolumeCondition.Message)
+	} else {
+		resp.VolumeCondition.Message = "volume is healthy"
+	}
+	return resp, nil
+}
+
+// badBlocks returns the number of bad sectors that the kernel knows
+// about for the block device, in the same way as "ndctl list --media-errors".
+// For device mapper devices (LVM volumes) the underlying PMEM devices
+// get checked. Those may also have bad blocks outside of the volume.
+func badBlocks(devicePath string) (uint64, error) {
+	dev, err := filepath.EvalSymlinks(devicePath)
+	if err != nil {
+		return 0, err
+	}
+	dir := filepath.Join(sysfsBlockRoot, filepath.Base(dev))
+	slaves, err := filepath.Glob(filepath.Join(dir, "slaves", "*"))
+	if err != nil {
+		return 0, err
+	}
+	if len(slaves) == 0 {
+		return readBadBlocks(filepath.Join(dir, "badblocks"))
+	}
+	var total uint64
+	for _, slave := range slaves {
+		sectors, err := readBadBlocks(filepath.Join(slave, "badblocks"))
+		if err != nil {
+			return 0, err
+		}
+		total += sectors
+	}
+	return total, nil
+}
+
+// readBadBlocks parses a sysfs badblocks file, which has one line
+// with "<first sector> <number of sectors>" per range of bad sectors.
+func readBadBlocks(filename string) (uint64, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	var total uint64
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		sectors, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%s: %v", filename, err)
+		}
+		total += sectors
+	}
+	return total, scanner.Err()
+}
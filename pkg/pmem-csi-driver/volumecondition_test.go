@@ -0,0 +1,130 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+	"k8s.io/mount-utils"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestBadBlocks(t *testing.T) {
+	root := t.TempDir()
+	oldRoot := sysfsBlockRoot
+	sysfsBlockRoot = root
+	defer func() {
+		sysfsBlockRoot = oldRoot
+	}()
+
+	write := func(filename, content string) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(filename), 0755), "create directory")
+		require.NoError(t, os.WriteFile(filename, []byte(content), 0644), "write file")
+	}
+	write(filepath.Join(root, "pmem0", "badblocks"), "")
+	write(filepath.Join(root, "pmem1", "badblocks"), "8 8\n1024 1\n")
+	write(filepath.Join(root, "dm-0", "slaves", "pmem1", "badblocks"), "8 8\n")
+	write(filepath.Join(root, "dm-0", "slaves", "pmem2", "badblocks"), "16 2\n")
+
+	for name, expected := range map[string]uint64{
+		"pmem0": 0,
+		"pmem1": 9,
+		"dm-0":  10,
+	} {
+		dev := filepath.Join(t.TempDir(), name)
+		write(dev, "")
+		sectors, err := badBlocks(dev)
+		if assert.NoError(t, err, name) {
+			assert.Equal(t, expected, sectors, name)
+		}
+	}
+	dev := filepath.Join(t.TempDir(), "pmem3")
+	write(dev, "")
+	_, err := badBlocks(dev)
+	assert.Error(t, err, "no badblocks file")
+}
+
+func TestVolumeCondition(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create volume state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+	ns := NewNodeServer(cs, t.TempDir())
+
+	vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		}},
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume")
+	volumeID := vol.Volume.VolumeId
+	volumePath := t.TempDir()
+
+	stats := func() (*csi.NodeGetVolumeStatsResponse, error) {
+		return ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+			VolumeId:   volumeID,
+			VolumePath: volumePath,
+		})
+	}
+
+	ns.mounter = mount.NewFakeMounter(nil)
+	resp, err := stats()
+	require.NoError(t, err, "not mounted")
+	assert.True(t, resp.VolumeCondition.Abnormal, "not mounted: %s", resp.VolumeCondition.Message)
+	assert.Contains(t, resp.VolumeCondition.Message, "not mounted")
+
+	ns.mounter = mount.NewFakeMounter([]mount.MountPoint{{Path: volumePath}})
+	resp, err = stats()
+	require.NoError(t, err, "mounted")
+	assert.False(t, resp.VolumeCondition.Abnormal, "mounted: %s", resp.VolumeCondition.Message)
+	require.Len(t, resp.Usage, 2, "usage")
+	assert.Equal(t, csi.VolumeUsage_BYTES, resp.Usage[0].Unit, "bytes")
+	assert.NotZero(t, resp.Usage[0].Total, "total bytes")
+	assert.Equal(t, csi.VolumeUsage_INODES, resp.Usage[1].Unit, "inodes")
+
+	mounter := mount.NewFakeMounter([]mount.MountPoint{{Path: volumePath}})
+	mounter.MountCheckErrors = map[string]error{volumePath: &os.PathError{Op: "stat", Path: volumePath, Err: syscall.EIO}}
+	ns.mounter = mounter
+	resp, err = stats()
+	require.NoError(t, err, "corrupted mount")
+	assert.True(t, resp.VolumeCondition.Abnormal, "corrupted mount: %s", resp.VolumeCondition.Message)
+	assert.Contains(t, resp.VolumeCondition.Message, "volume mount is corrupted")
+	ns.mounter = mount.NewFakeMounter([]mount.MountPoint{{Path: volumePath}})
+
+	require.NoError(t, dm.DeleteDevice(ctx, volumeID, false), "remove device behind the back of the driver")
+	resp, err = stats()
+	require.NoError(t, err, "missing device")
+	assert.True(t, resp.VolumeCondition.Abnormal, "missing device: %s", resp.VolumeCondition.Message)
+	assert.Contains(t, resp.VolumeCondition.Message, "device of the volume is missing")
+
+	_, err = ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   volumeID,
+		VolumePath: filepath.Join(volumePath, "no-such-path"),
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown path: %v", err)
+	_, err = ns.NodeGetVolumeStats(ctx, &csi.NodeGetVolumeStatsRequest{
+		VolumeId:   "no-such-volume",
+		VolumePath: volumePath,
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown volume: %v", err)
+}
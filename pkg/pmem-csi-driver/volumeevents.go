@@ -0,0 +1,117 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// volumeEvents emits a warning event for the PVC, PV or pod of a
+// volume when creating, staging or publishing it fails, so that
+// users see the reason without access to the driver logs.
+type volumeEvents struct {
+	// recorder and cs get set by startNode before the server
+	// accepts calls. Without a recorder, no events are emitted.
+	recorder record.EventRecorder
+	cs       *nodeControllerServer
+}
+
+func (ve *volumeEvents) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err == nil || ve.recorder == nil {
+		return resp, err
+	}
+	s := status.Convert(err)
+	if s.Code() == codes.Aborted {
+		// Another operation for the volume is in progress,
+		// the call gets retried.
+		return resp, err
+	}
+	var reason string
+	var ref *v1.ObjectReference
+	switch r := req.(type) {
+	case *csi.CreateVolumeRequest:
+		reason = "CreateVolumeFailed"
+		ref = claimRef(r.GetParameters())
+	case *csi.NodeStageVolumeRequest:
+		reason = "NodeStageVolumeFailed"
+		ref = claimRef(ve.volumeParameters(r.GetVolumeId()))
+	case *csi.NodePublishVolumeRequest:
+		reason = "NodePublishVolumeFailed"
+		ref = claimRef(ve.volumeParameters(r.GetVolumeId()))
+		if ref == nil {
+			// Ephemeral volumes only have a pod.
+			ref = podRef(r.GetVolumeContext())
+		}
+	}
+	if ref != nil {
+		ve.recorder.Event(ref, v1.EventTypeWarning, reason, s.Message())
+	}
+	return resp, err
+}
+
+// volumeParameters returns the parameters stored for a volume which
+// exists on this node.
+func (ve *volumeEvents) volumeParameters(volumeID string) map[string]string {
+	if ve.cs == nil {
+		return nil
+	}
+	ve.cs.mutex.Lock()
+	defer ve.cs.mutex.Unlock()
+	if vol, ok := ve.cs.pmemVolumes[volumeID]; ok {
+		return vol.Params
+	}
+	return nil
+}
+
+// claimRef references the PVC of a volume or, if unknown, its PV.
+// The names are only known when the external-provisioner passes them
+// (--extra-create-metadata).
+func claimRef(params map[string]string) *v1.ObjectReference {
+	if name, namespace := params[parameters.PVCName], params[parameters.PVCNamespace]; name != "" && namespace != "" {
+		return &v1.ObjectReference{
+			Kind:       "PersistentVolumeClaim",
+			APIVersion: "v1",
+			Namespace:  namespace,
+			Name:       name,
+		}
+	}
+	if name := params[parameters.PVName]; name != "" {
+		return &v1.ObjectReference{
+			Kind:       "PersistentVolume",
+			APIVersion: "v1",
+			Name:       name,
+		}
+	}
+	return nil
+}
+
+// podRef references the pod from the volume context of
+// NodePublishVolume, if the CSIDriver enables podInfoOnMount.
+func podRef(volumeContext map[string]string) *v1.ObjectReference {
+	name, namespace := volumeContext[parameters.PodName], volumeContext[parameters.PodNamespace]
+	if name == "" || namespace == "" {
+		return nil
+	}
+	return &v1.ObjectReference{
+		Kind:       "Pod",
+		APIVersion: "v1",
+		Namespace:  namespace,
+		Name:       name,
+		UID:        k8stypes.UID(volumeContext[parameters.PodUID]),
+	}
+}
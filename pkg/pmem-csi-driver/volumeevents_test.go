@@ -0,0 +1,84 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestVolumeEvents(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	recorder := record.NewFakeRecorder(10)
+	recorder.IncludeObject = true
+	ve := &volumeEvents{
+		recorder: recorder,
+		cs: &nodeControllerServer{
+			pmemVolumes: map[string]*nodeVolume{
+				"vol-pvc": {
+					ID: "vol-pvc",
+					Params: map[string]string{
+						parameters.PVName:       "pv-a",
+						parameters.PVCNamespace: "default",
+						parameters.PVCName:      "pvc-a",
+					},
+				},
+				"vol-pv": {
+					ID:     "vol-pv",
+					Params: map[string]string{parameters.PVName: "pv-b"},
+				},
+			},
+		},
+	}
+	call := func(req interface{}, err error) {
+		_, _ = ve.intercept(ctx, req, &grpc.UnaryServerInfo{}, func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, err
+		})
+	}
+	next := func() string {
+		select {
+		case event := <-recorder.Events:
+			return event
+		default:
+			return ""
+		}
+	}
+
+	call(&csi.CreateVolumeRequest{
+		Name:       "pvc-c",
+		Parameters: map[string]string{parameters.PVCName: "pvc-c", parameters.PVCNamespace: "test"},
+	}, status.Error(codes.ResourceExhausted, "not enough space"))
+	assert.Equal(t, "Warning CreateVolumeFailed not enough space involvedObject{kind=PersistentVolumeClaim,apiVersion=v1}", next(), "create")
+
+	call(&csi.NodeStageVolumeRequest{VolumeId: "vol-pvc"}, status.Error(codes.Internal, "mkfs failed"))
+	assert.Equal(t, "Warning NodeStageVolumeFailed mkfs failed involvedObject{kind=PersistentVolumeClaim,apiVersion=v1}", next(), "stage")
+
+	call(&csi.NodePublishVolumeRequest{VolumeId: "vol-pv"}, status.Error(codes.Internal, "mount failed"))
+	assert.Equal(t, "Warning NodePublishVolumeFailed mount failed involvedObject{kind=PersistentVolume,apiVersion=v1}", next(), "publish without PVC")
+
+	call(&csi.NodePublishVolumeRequest{
+		VolumeId:      "vol-ephemeral",
+		VolumeContext: map[string]string{parameters.PodName: "app", parameters.PodNamespace: "default", parameters.Ephemeral: "true"},
+	}, status.Error(codes.Internal, "mount failed"))
+	assert.Equal(t, "Warning NodePublishVolumeFailed mount failed involvedObject{kind=Pod,apiVersion=v1}", next(), "ephemeral publish")
+
+	call(&csi.NodeStageVolumeRequest{VolumeId: "vol-pvc"}, status.Error(codes.Aborted, "in progress"))
+	call(&csi.NodeStageVolumeRequest{VolumeId: "vol-unknown"}, status.Error(codes.NotFound, "no such volume"))
+	call(&csi.NodeUnpublishVolumeRequest{VolumeId: "vol-pvc"}, status.Error(codes.Internal, "unmount failed"))
+	call(&csi.NodeStageVolumeRequest{VolumeId: "vol-pvc"}, nil)
+	assert.Empty(t, next(), "no other events")
+}
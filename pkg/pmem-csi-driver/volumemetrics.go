@@ -0,0 +1,161 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+)
+
+// Labels of per-volume metrics. The PV and PVC are only known when
+// the external-provisioner runs with --extra-create-metadata, the
+// labels are empty otherwise.
+const (
+	volumeIDLabel = "volume_id"
+	pvLabel       = "persistentvolume"
+	pvcLabel      = "persistentvolumeclaim"
+)
+
+var (
+	volumeLabels = []string{volumeIDLabel, pvLabel, NamespaceLabel, pvcLabel}
+
+	volumeSizeDesc = prometheus.NewDesc(
+		"pmem_volume_size_bytes",
+		"Size of a PMEM volume on the host.",
+		volumeLabels, nil,
+	)
+
+	// The filesystem usage is the one from the most recent
+	// NodeGetVolumeStats call, which kubelet makes about once per
+	// minute for mounted volumes.
+	volumeCapacityBytesDesc = prometheus.NewDesc(
+		"pmem_volume_capacity_bytes",
+		"Size of the filesystem on a PMEM volume.",
+		volumeLabels, nil,
+	)
+	volumeUsedBytesDesc = prometheus.NewDesc(
+		"pmem_volume_used_bytes",
+		"Bytes used in the filesystem on a PMEM volume.",
+		volumeLabels, nil,
+	)
+	volumeAvailableBytesDesc = prometheus.NewDesc(
+		"pmem_volume_available_bytes",
+		"Bytes available to unprivileged users in the filesystem on a PMEM volume.",
+		volumeLabels, nil,
+	)
+	volumeInodesDesc = prometheus.NewDesc(
+		"pmem_volume_inodes",
+		"Total number of inodes in the filesystem on a PMEM volume.",
+		volumeLabels, nil,
+	)
+	volumeInodesUsedDesc = prometheus.NewDesc(
+		"pmem_volume_inodes_used",
+		"Number of used inodes in the filesystem on a PMEM volume.",
+		volumeLabels, nil,
+	)
+	volumeInodesFreeDesc = prometheus.NewDesc(
+		"pmem_volume_inodes_free",
+		"Number of free inodes in the filesystem on a PMEM volume.",
+		volumeLabels, nil,
+	)
+)
+
+// volumeUsage remembers the usage reported by NodeGetVolumeStats.
+type volumeUsage struct {
+	mutex sync.Mutex
+	usage map[string][]*csi.VolumeUsage
+}
+
+func (vu *volumeUsage) set(volumeID string, usage []*csi.VolumeUsage) {
+	vu.mutex.Lock()
+	defer vu.mutex.Unlock()
+	if vu.usage == nil {
+		vu.usage = map[string][]*csi.VolumeUsage{}
+	}
+	vu.usage[volumeID] = usage
+}
+
+func (vu *volumeUsage) get(volumeID string) []*csi.VolumeUsage {
+	vu.mutex.Lock()
+	defer vu.mutex.Unlock()
+	return vu.usage[volumeID]
+}
+
+func (vu *volumeUsage) forget(volumeID string) {
+	vu.mutex.Lock()
+	defer vu.mutex.Unlock()
+	delete(vu.usage, volumeID)
+}
+
+// volumeCollector turns the volumes of the node into per-volume
+// metrics data.
+type volumeCollector struct {
+	cs *nodeControllerServer
+}
+
+// MustRegister adds the collector to the registry, using labels to tag each sample with node and driver name.
+func (vc volumeCollector) MustRegister(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		pmdmanager.NodeLabel: nodeName,
+		"driver_name":        driverName, // same label name as in csi-lib-utils for CSI gRPC calls
+	}
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(vc)
+}
+
+// Describe implements prometheus.Collector.Describe.
+func (vc volumeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- volumeSizeDesc
+	ch <- volumeCapacityBytesDesc
+	ch <- volumeUsedBytesDesc
+	ch <- volumeAvailableBytesDesc
+	ch <- volumeInodesDesc
+	ch <- volumeInodesUsedDesc
+	ch <- volumeInodesFreeDesc
+}
+
+// Collect implements prometheus.Collector.Collect.
+func (vc volumeCollector) Collect(ch chan<- prometheus.Metric) {
+	vc.cs.mutex.Lock()
+	defer vc.cs.mutex.Unlock()
+
+	for id, vol := range vc.cs.pmemVolumes {
+		// Volumes with invalid parameters are still reported,
+		// just without PV and PVC.
+		p, _ := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+		labels := []string{id, stringValue(p.PVName), stringValue(p.PVCNamespace), stringValue(p.PVCName)}
+		gauge := func(desc *prometheus.Desc, value int64) {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(value), labels...)
+		}
+		gauge(volumeSizeDesc, vol.Size)
+		for _, usage := range vc.cs.usage.get(id) {
+			switch usage.Unit {
+			case csi.VolumeUsage_BYTES:
+				gauge(volumeCapacityBytesDesc, usage.Total)
+				gauge(volumeUsedBytesDesc, usage.Used)
+				gauge(volumeAvailableBytesDesc, usage.Available)
+			case csi.VolumeUsage_INODES:
+				gauge(volumeInodesDesc, usage.Total)
+				gauge(volumeInodesUsedDesc, usage.Used)
+				gauge(volumeInodesFreeDesc, usage.Available)
+			}
+		}
+	}
+}
+
+func stringValue(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
+
+var _ prometheus.Collector = volumeCollector{}
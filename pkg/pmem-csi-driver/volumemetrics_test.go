@@ -0,0 +1,60 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestVolumeUsageMetrics(t *testing.T) {
+	cs := &nodeControllerServer{
+		pmemVolumes: map[string]*nodeVolume{
+			"vol-a": {
+				ID:   "vol-a",
+				Size: 4096,
+				Params: map[string]string{
+					parameters.PVName:       "pv-a",
+					parameters.PVCNamespace: "default",
+					parameters.PVCName:      "pvc-a",
+				},
+			},
+			"vol-b": {
+				ID:   "vol-b",
+				Size: 8192,
+			},
+		},
+	}
+	reg := prometheus.NewPedanticRegistry()
+	volumeCollector{cs: cs}.MustRegister(reg, "worker", "pmem-csi.intel.com")
+	names := []string{"pmem_volume_used_bytes", "pmem_volume_inodes_free"}
+
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(""), names...), "no usage yet")
+
+	cs.usage.set("vol-a", []*csi.VolumeUsage{
+		{Unit: csi.VolumeUsage_BYTES, Total: 4000, Used: 1000, Available: 2900},
+		{Unit: csi.VolumeUsage_INODES, Total: 100, Used: 10, Available: 90},
+	})
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP pmem_volume_inodes_free Number of free inodes in the filesystem on a PMEM volume.
+# TYPE pmem_volume_inodes_free gauge
+pmem_volume_inodes_free{driver_name="pmem-csi.intel.com",namespace="default",node="worker",persistentvolume="pv-a",persistentvolumeclaim="pvc-a",volume_id="vol-a"} 90
+# HELP pmem_volume_used_bytes Bytes used in the filesystem on a PMEM volume.
+# TYPE pmem_volume_used_bytes gauge
+pmem_volume_used_bytes{driver_name="pmem-csi.intel.com",namespace="default",node="worker",persistentvolume="pv-a",persistentvolumeclaim="pvc-a",volume_id="vol-a"} 1000
+`), names...), "with usage")
+
+	cs.usage.forget("vol-a")
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(""), names...), "usage forgotten")
+}
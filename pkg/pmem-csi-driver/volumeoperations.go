@@ -0,0 +1,124 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2"
+)
+
+// volumePhase describes which operation is currently running for a
+// volume.
+type volumePhase string
+
+const (
+	phaseCreating    volumePhase = "creating"
+	phaseDeleting    volumePhase = "deleting"
+	phaseStaging     volumePhase = "staging"
+	phaseUnstaging   volumePhase = "unstaging"
+	phaseExpanding   volumePhase = "expanding"
+	phaseExpandingFS volumePhase = "expanding filesystem"
+	phaseCloning     volumePhase = "cloning"
+)
+
+// volumeOperations tracks the operations which modify a volume. With
+// WaitForFirstConsumer provisioning, Kubernetes may ask for an
+// expansion while the volume is still getting created or staged. Such
+// operations get queued here instead of failing with errors that
+// depend on how far the other operation got.
+//
+// Callers may already hold the per-volume key mutexes when calling
+// begin, but must not lock any of them while an operation is active.
+// The key mutexes are hashed, so doing that could deadlock.
+type volumeOperations struct {
+	mutex      sync.Mutex
+	operations map[string]*volumeOperation
+	// durations has the moving average per phase for estimating
+	// how long queued operations have to wait.
+	durations map[volumePhase]time.Duration
+}
+
+type volumeOperation struct {
+	phase   volumePhase
+	start   time.Time
+	waiting int
+	done    chan struct{}
+}
+
+func newVolumeOperations() *volumeOperations {
+	return &volumeOperations{
+		operations: map[string]*volumeOperation{},
+		durations:  map[volumePhase]time.Duration{},
+	}
+}
+
+// begin waits until no other operation is active for the volume,
+// then records the new one. The returned function must be called
+// when the operation is done. If the context gets canceled while
+// waiting, an Aborted status error is returned, which is what CSI
+// expects when an operation is pending for a volume. The progress of
+// the call gets updated while waiting.
+func (ops *volumeOperations) begin(ctx context.Context, volumeID string, phase volumePhase) (func(), error) {
+	logger := klog.FromContext(ctx)
+	progress := progressFromContext(ctx)
+	for {
+		ops.mutex.Lock()
+		other, busy := ops.operations[volumeID]
+		if !busy {
+			op := &volumeOperation{
+				phase: phase,
+				start: time.Now(),
+				done:  make(chan struct{}),
+			}
+			ops.operations[volumeID] = op
+			ops.mutex.Unlock()
+			progress.setStage(string(phase))
+			return func() {
+				ops.mutex.Lock()
+				defer ops.mutex.Unlock()
+				ops.recordDuration(phase, time.Since(op.start))
+				delete(ops.operations, volumeID)
+				close(op.done)
+			}, nil
+		}
+		// All waiting operations compete for the volume once the
+		// active one is done, so the position is only a hint.
+		other.waiting++
+		position := other.waiting
+		estimatedWait := ops.durations[other.phase] - time.Since(other.start)
+		if estimatedWait < 0 {
+			estimatedWait = 0
+		}
+		ops.mutex.Unlock()
+		progress.queued("waiting for "+string(other.phase), position, estimatedWait)
+
+		logger.V(3).Info("Waiting for other volume operation", "volume-id", volumeID, "phase", phase, "pending-phase", other.phase, "queue-position", position)
+		select {
+		case <-other.done:
+		case <-ctx.Done():
+			ops.mutex.Lock()
+			other.waiting--
+			ops.mutex.Unlock()
+			return nil, status.Errorf(codes.Aborted, "volume %q is busy %s, cannot start %s: %v", volumeID, other.phase, phase, ctx.Err())
+		}
+	}
+}
+
+// recordDuration must be called while holding the mutex.
+func (ops *volumeOperations) recordDuration(phase volumePhase, duration time.Duration) {
+	average, ok := ops.durations[phase]
+	if !ok {
+		ops.durations[phase] = duration
+		return
+	}
+	ops.durations[phase] = (3*average + duration) / 4
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestVolumeOperations(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	ops := newVolumeOperations()
+
+	end, err := ops.begin(ctx, "vol-1", phaseCreating)
+	require.NoError(t, err, "begin creating")
+
+	// A different volume is independent.
+	endOther, err := ops.begin(ctx, "vol-2", phaseExpanding)
+	require.NoError(t, err, "begin other volume")
+	endOther()
+
+	// Waiting gets aborted when the context is canceled.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = ops.begin(timeoutCtx, "vol-1", phaseExpanding)
+	assert.Equal(t, codes.Aborted, status.Code(err), "timeout while waiting: %v", err)
+
+	// The expansion gets queued until creation is done.
+	started := make(chan struct{})
+	go func() {
+		defer close(started)
+		end, err := ops.begin(ctx, "vol-1", phaseExpanding)
+		if assert.NoError(t, err, "begin expanding") {
+			end()
+		}
+	}()
+	select {
+	case <-started:
+		t.Fatal("expansion started while volume is being created")
+	case <-time.After(10 * time.Millisecond):
+	}
+	end()
+	<-started
+}
+
+func TestExpandVolume(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+	require.NoError(t, err, "create fake device manager")
+	sm, err := pmemstate.NewFileState(t.TempDir())
+	require.NoError(t, err, "create volume state")
+	cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+
+	vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+		Name: "vol",
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		}},
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+	})
+	require.NoError(t, err, "create volume")
+	volumeID := vol.Volume.VolumeId
+
+	_, err = cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      "no-such-volume",
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024},
+	})
+	assert.Equal(t, codes.NotFound, status.Code(err), "unknown volume: %v", err)
+
+	// Simulate staging which is still in progress when the
+	// expansion request comes in.
+	end, err := cs.operations.begin(ctx, volumeID, phaseStaging)
+	require.NoError(t, err, "begin staging")
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		end()
+	}()
+	resp, err := cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 2 * 1024 * 1024},
+	})
+	require.NoError(t, err, "expand volume")
+	assert.Equal(t, int64(2*1024*1024), resp.CapacityBytes, "expanded size")
+	assert.True(t, resp.NodeExpansionRequired, "filesystem must be grown")
+
+	device, err := dm.GetDevice(ctx, volumeID)
+	require.NoError(t, err, "get device")
+	assert.Equal(t, uint64(2*1024*1024), device.Size, "device size")
+	stored := &nodeVolume{}
+	require.NoError(t, sm.Get(volumeID, stored), "get state")
+	assert.Equal(t, int64(2*1024*1024), stored.Size, "size in state")
+
+	resp, err = cs.ControllerExpandVolume(ctx, &csi.ControllerExpandVolumeRequest{
+		VolumeId:      volumeID,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024},
+	})
+	require.NoError(t, err, "expand volume again")
+	assert.Equal(t, int64(2*1024*1024), resp.CapacityBytes, "volume does not shrink")
+}
@@ -0,0 +1,116 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"k8s.io/klog/v2"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// SizeMismatchPolicy determines what the node driver does on startup
+// when the stored size of a volume differs from the size of its
+// device, for example after a manual lvextend or after restoring the
+// state directory from a backup.
+type SizeMismatchPolicy string
+
+const (
+	// Update the stored size.
+	TrustDevice SizeMismatchPolicy = "trust-device"
+	// Keep the stored size and grow devices which are too small.
+	TrustState SizeMismatchPolicy = "trust-state"
+	// Refuse to start.
+	FailOnMismatch SizeMismatchPolicy = "fail"
+)
+
+func (policy *SizeMismatchPolicy) Set(value string) error {
+	switch value {
+	case string(TrustDevice), string(TrustState), string(FailOnMismatch):
+		*policy = SizeMismatchPolicy(value)
+	default:
+		// The flag package will add the value to the final output, no need to do it here.
+		return errors.New("invalid size mismatch policy")
+	}
+	return nil
+}
+
+func (policy *SizeMismatchPolicy) String() string {
+	return string(*policy)
+}
+
+// reconcileVolumeSizes compares the size of all restored volumes
+// against their devices and applies the policy to those which differ.
+// It must be called before the server starts handling requests.
+func (cs *nodeControllerServer) reconcileVolumeSizes(ctx context.Context, policy SizeMismatchPolicy) error {
+	if cs.sm == nil {
+		return nil
+	}
+	logger := klog.FromContext(ctx).WithName("reconcileVolumeSizes")
+	var mismatches []string
+	for id, vol := range cs.pmemVolumes {
+		logger := logger.WithValues("volume-id", id)
+		p, err := parameters.Parse(parameters.NodeVolumeOrigin, vol.Params)
+		if err != nil {
+			// Already checked while restoring the volume.
+			continue
+		}
+		dm, err := cs.deviceManager(ctx, p.GetDeviceMode())
+		if err != nil {
+			logger.Error(err, "Failed to initialize device manager", "device-mode", p.GetDeviceMode())
+			continue
+		}
+		device, err := dm.GetDevice(ctx, id)
+		if err != nil {
+			logger.Error(err, "Failed to get device")
+			continue
+		}
+		deviceSize := int64(device.AllocatedSize)
+		if deviceSize == vol.Size {
+			continue
+		}
+		logger = logger.WithValues("state-size", pmemlog.CapacityRef(vol.Size), "device-size", pmemlog.CapacityRef(deviceSize))
+
+		switch policy {
+		case FailOnMismatch:
+			logger.Error(nil, "Volume size in state and device differ")
+			mismatches = append(mismatches, id)
+			continue
+		case TrustState:
+			if deviceSize > vol.Size {
+				// Devices cannot shrink, the additional space remains unused.
+				logger.Info("Device is larger than stored volume size, keeping it")
+				continue
+			}
+			actual, err := dm.ResizeDevice(ctx, id, uint64(vol.Size))
+			if err != nil {
+				logger.Error(err, "Failed to grow device to stored volume size")
+				continue
+			}
+			logger.Info("Grew device to stored volume size", "new-size", pmemlog.CapacityRef(int64(actual)))
+			if int64(actual) == vol.Size {
+				continue
+			}
+			vol.Size = int64(actual)
+		default:
+			logger.Info("Updating stored volume size to device size")
+			vol.Size = deviceSize
+		}
+		if err := cs.sm.Create(id, vol); err != nil {
+			return fmt.Errorf("update state of volume %q: %v", id, err)
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("stored size differs from device size for volume(s) %s", strings.Join(mismatches, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemcsidriver
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmdmanager "github.com/intel/pmem-csi/pkg/pmem-device-manager"
+	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
+)
+
+func TestReconcileVolumeSizes(t *testing.T) {
+	const size = 1024 * 1024
+
+	setup := func(t *testing.T) (pmdmanager.PmemDeviceManager, pmemstate.StateManager, string) {
+		_, ctx := ktesting.NewTestContext(t)
+		dm, err := pmdmanager.New(ctx, api.DeviceModeFake, 100, pmdmanager.Options{})
+		require.NoError(t, err, "create fake device manager")
+		sm, err := pmemstate.NewFileState(t.TempDir())
+		require.NoError(t, err, "create volume state")
+		cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+		vol, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name: "vol",
+			VolumeCapabilities: []*csi.VolumeCapability{{
+				AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			}},
+			CapacityRange: &csi.CapacityRange{RequiredBytes: size},
+		})
+		require.NoError(t, err, "create volume")
+		return dm, sm, vol.Volume.VolumeId
+	}
+
+	storedSize := func(t *testing.T, sm pmemstate.StateManager, volumeID string) int64 {
+		vol := &nodeVolume{}
+		require.NoError(t, sm.Get(volumeID, vol), "get state")
+		return vol.Size
+	}
+
+	deviceSize := func(t *testing.T, dm pmdmanager.PmemDeviceManager, volumeID string) uint64 {
+		_, ctx := ktesting.NewTestContext(t)
+		device, err := dm.GetDevice(ctx, volumeID)
+		require.NoError(t, err, "get device")
+		return device.AllocatedSize
+	}
+
+	t.Run("same-size", func(t *testing.T) {
+		_, ctx := ktesting.NewTestContext(t)
+		dm, sm, volumeID := setup(t)
+		cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+		require.NoError(t, cs.reconcileVolumeSizes(ctx, FailOnMismatch), "reconcile")
+		assert.Equal(t, int64(size), storedSize(t, sm, volumeID), "stored size")
+	})
+
+	for _, policy := range []SizeMismatchPolicy{TrustDevice, TrustState, FailOnMismatch} {
+		policy := policy
+		t.Run(string(policy)+"-larger-device", func(t *testing.T) {
+			_, ctx := ktesting.NewTestContext(t)
+			dm, sm, volumeID := setup(t)
+			_, err := dm.ResizeDevice(ctx, volumeID, 2*size)
+			require.NoError(t, err, "resize device")
+
+			cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+			err = cs.reconcileVolumeSizes(ctx, policy)
+			switch policy {
+			case TrustDevice:
+				require.NoError(t, err, "reconcile")
+				assert.Equal(t, int64(2*size), storedSize(t, sm, volumeID), "stored size")
+				assert.Equal(t, int64(2*size), cs.getVolumeByID(volumeID).Size, "volume size")
+			case TrustState:
+				require.NoError(t, err, "reconcile")
+				assert.Equal(t, int64(size), storedSize(t, sm, volumeID), "stored size")
+			case FailOnMismatch:
+				assert.Error(t, err, "reconcile")
+				assert.Equal(t, int64(size), storedSize(t, sm, volumeID), "stored size")
+			}
+		})
+	}
+
+	t.Run("trust-state-larger-state", func(t *testing.T) {
+		_, ctx := ktesting.NewTestContext(t)
+		dm, sm, volumeID := setup(t)
+		vol := &nodeVolume{}
+		require.NoError(t, sm.Get(volumeID, vol), "get state")
+		vol.Size = 2 * size
+		require.NoError(t, sm.Create(volumeID, vol), "update state")
+
+		cs := NewNodeControllerServer(ctx, "node", dm, sm, nil, "", pmdmanager.Options{})
+		require.NoError(t, cs.reconcileVolumeSizes(ctx, TrustState), "reconcile")
+		assert.Equal(t, uint64(2*size), deviceSize(t, dm, volumeID), "device size")
+		assert.Equal(t, int64(2*size), storedSize(t, sm, volumeID), "stored size")
+	})
+}
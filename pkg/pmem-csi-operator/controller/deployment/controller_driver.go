@@ -38,6 +38,7 @@ const (
 	controllerMetricsPort  = 10010
 	nodeMetricsPort        = 10010
 	provisionerMetricsPort = 10011
+	registrarHealthzPort   = 9809
 )
 
 func typeMeta(gv schema.GroupVersion, kind string) metav1.TypeMeta {
@@ -57,6 +58,7 @@ var currentObjects = []client.Object{
 	&rbacv1.ClusterRole{TypeMeta: typeMeta(rbacv1.SchemeGroupVersion, "ClusterRole")},
 	&rbacv1.ClusterRoleBinding{TypeMeta: typeMeta(rbacv1.SchemeGroupVersion, "ClusterRoleBinding")},
 	&storagev1.CSIDriver{TypeMeta: typeMeta(storagev1.SchemeGroupVersion, "CSIDriver")},
+	&storagev1.StorageClass{TypeMeta: typeMeta(storagev1.SchemeGroupVersion, "StorageClass")},
 	&appsv1.DaemonSet{TypeMeta: typeMeta(appsv1.SchemeGroupVersion, "DaemonSet")},
 	&rbacv1.Role{TypeMeta: typeMeta(rbacv1.SchemeGroupVersion, "Role")},
 	&rbacv1.RoleBinding{TypeMeta: typeMeta(rbacv1.SchemeGroupVersion, "RoleBinding")},
@@ -75,6 +77,8 @@ func cloneObject(from client.Object) (client.Object, error) {
 		return t.DeepCopyObject().(*rbacv1.ClusterRoleBinding), nil
 	case *storagev1.CSIDriver:
 		return t.DeepCopyObject().(*storagev1.CSIDriver), nil
+	case *storagev1.StorageClass:
+		return t.DeepCopyObject().(*storagev1.StorageClass), nil
 	case *appsv1.DaemonSet:
 		return t.DeepCopyObject().(*appsv1.DaemonSet), nil
 	case *rbacv1.Role:
@@ -100,7 +104,7 @@ func cloneObject(from client.Object) (client.Object, error) {
 
 func isNamespaced(kind string) bool {
 	switch kind {
-	case "ClusterRole", "ClusterRoleBinding", "CSIDriver", "MutatingWebhookConfiguration":
+	case "ClusterRole", "ClusterRoleBinding", "CSIDriver", "StorageClass", "MutatingWebhookConfiguration":
 		return false
 	default:
 		return true
@@ -423,6 +427,10 @@ var subObjectHandlers = map[string]redeployObject{
 			return nil
 		},
 	},
+	"fsdax-xfs storage class":  storageClassHandler(api.StorageClassFsdaxXFS),
+	"fsdax-ext4 storage class": storageClassHandler(api.StorageClassFsdaxExt4),
+	"devdax storage class":     storageClassHandler(api.StorageClassDevdax),
+	"sector storage class":     storageClassHandler(api.StorageClassSector),
 	"webhooks role": {
 		objType: reflect.TypeOf(&rbacv1.Role{}),
 		object: func(d *pmemCSIDeployment) client.Object {
@@ -621,6 +629,28 @@ var subObjectHandlers = map[string]redeployObject{
 	},
 }
 
+// storageClassHandler returns the handler for one of the optional
+// StorageClasses. The parameters of a StorageClass cannot be updated,
+// therefore it gets re-created when the spec changes.
+func storageClassHandler(t api.StorageClassType) redeployObject {
+	return redeployObject{
+		objType:   reflect.TypeOf(&storagev1.StorageClass{}),
+		immutable: true,
+		enabled: func(d *pmemCSIDeployment) bool {
+			return d.HasStorageClass(t)
+		},
+		object: func(d *pmemCSIDeployment) client.Object {
+			return &storagev1.StorageClass{
+				TypeMeta:   metav1.TypeMeta{Kind: "StorageClass", APIVersion: "storage.k8s.io/v1"},
+				ObjectMeta: d.getObjectMeta(d.StorageClassName(t), true),
+			}
+		},
+		modify: func(d *pmemCSIDeployment, o client.Object) error {
+			return d.getStorageClass(o.(*storagev1.StorageClass), t)
+		},
+	}
+}
+
 // HandleEvent handles the delete/update events received on sub-objects. It ensures that any undesirable change
 // is reverted.
 func (d *pmemCSIDeployment) handleEvent(ctx context.Context, metaData metav1.Object, obj apiruntime.Object, r *ReconcileDeployment) error {
@@ -733,6 +763,21 @@ func (d *pmemCSIDeployment) getCSIDriver(csiDriver *storagev1.CSIDriver) {
 		csiDriver.Spec.StorageCapacity = &storageCapacity
 	}
 
+	// NodeStageVolume and NodePublishVolume accept "-o context",
+	// so kubelet does not need to relabel the files on the volume.
+	// The field exists since Kubernetes 1.25.
+	if d.k8sVersion.Compare(1, 25) >= 0 {
+		seLinuxMount := true
+		csiDriver.Spec.SELinuxMount = &seLinuxMount
+	}
+
+	// Service account tokens of pods for NodePublishVolume,
+	// used when the node driver authorizes publishing. Beta and
+	// enabled by default since Kubernetes 1.21.
+	if d.k8sVersion.Compare(1, 21) >= 0 {
+		csiDriver.Spec.TokenRequests = []storagev1.TokenRequest{{Audience: d.CSIDriverName()}}
+	}
+
 	// Volume lifecycle modes are supported only after k8s v1.16
 	if d.k8sVersion.Compare(1, 16) >= 0 {
 		csiDriver.Spec.VolumeLifecycleModes = []storagev1.VolumeLifecycleMode{
@@ -742,6 +787,24 @@ func (d *pmemCSIDeployment) getCSIDriver(csiDriver *storagev1.CSIDriver) {
 	}
 }
 
+// getStorageClass fills in the parameters for a StorageClass of the
+// given type. Late binding is used because volumes are local to a node:
+// the volume then gets created on the node chosen for the pod.
+func (d *pmemCSIDeployment) getStorageClass(sc *storagev1.StorageClass, t api.StorageClassType) error {
+	parameters, err := t.Parameters()
+	if err != nil {
+		return err
+	}
+
+	reclaimPolicy := corev1.PersistentVolumeReclaimDelete
+	bindingMode := storagev1.VolumeBindingWaitForFirstConsumer
+	sc.Provisioner = d.CSIDriverName()
+	sc.Parameters = parameters
+	sc.ReclaimPolicy = &reclaimPolicy
+	sc.VolumeBindingMode = &bindingMode
+	return nil
+}
+
 func (d *pmemCSIDeployment) getService(service *corev1.Service, t corev1.ServiceType, port int32) {
 	service.Spec.Type = t
 	if service.Spec.Ports == nil {
@@ -1174,7 +1237,7 @@ func (d *pmemCSIDeployment) getControllerCommand() []string {
 }
 
 func (d *pmemCSIDeployment) getNodeDriverCommand() []string {
-	return []string{
+	args := []string{
 		"/usr/local/bin/pmem-csi-driver",
 		fmt.Sprintf("-deviceManager=%s", d.Spec.DeviceMode),
 		fmt.Sprintf("-v=%d", d.Spec.LogLevel),
@@ -1187,6 +1250,10 @@ func (d *pmemCSIDeployment) getNodeDriverCommand() []string {
 		fmt.Sprintf("-pmemPercentage=%d", d.Spec.PMEMPercentage),
 		fmt.Sprintf("-metricsListen=:%d", nodeMetricsPort),
 	}
+	if d.Spec.MaxVolumesPerNode > 0 {
+		args = append(args, fmt.Sprintf("-maxVolumesPerNode=%d", d.Spec.MaxVolumesPerNode))
+	}
+	return args
 }
 
 func (d *pmemCSIDeployment) getControllerContainer() corev1.Container {
@@ -1323,6 +1390,8 @@ func (d *pmemCSIDeployment) getProvisionerContainer() corev1.Container {
 			"--timeout=5m",
 			"--default-fstype=ext4",
 			"--worker-threads=5",
+			// PVC name and namespace for filesystem labels.
+			"--extra-create-metadata",
 		},
 		Env: []corev1.EnvVar{
 			{
@@ -1393,6 +1462,29 @@ func (d *pmemCSIDeployment) getNodeRegistrarContainer() corev1.Container {
 			"--kubelet-registration-path=" + d.Spec.KubeletDir + "/plugins/$(PMEM_CSI_DRIVER_NAME)/csi.sock",
 			"--csi-address=/csi/csi.sock",
 			"--timeout=10s",
+			fmt.Sprintf("--http-endpoint=:%d", registrarHealthzPort),
+		},
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          "healthz",
+				ContainerPort: registrarHealthzPort,
+				Protocol:      "TCP",
+			},
+		},
+		// Fails when the registration socket is gone. Restarting the
+		// container registers the driver again.
+		LivenessProbe: &corev1.Probe{
+			ProbeHandler: corev1.ProbeHandler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Scheme: "HTTP",
+					Path:   "/healthz",
+					Port:   intstr.FromString("healthz"),
+				},
+			},
+			SuccessThreshold: 1,
+			TimeoutSeconds:   5,
+			PeriodSeconds:    10,
+			FailureThreshold: 3,
 		},
 		SecurityContext: &corev1.SecurityContext{
 			ReadOnlyRootFilesystem: &true,
@@ -57,6 +57,7 @@ type pmemDeployment struct {
 	provisionerCPU, provisionerMemory                   string
 	nodeRegistarCPU, nodeRegistrarMemory                string
 	kubeletDir                                          string
+	storageClasses                                      []api.StorageClassType
 
 	objects []runtime.Object
 
@@ -125,6 +126,7 @@ func getDeployment(d *pmemDeployment) *api.PmemCSIDeployment {
 	if d.kubeletDir != "" {
 		spec.KubeletDir = d.kubeletDir
 	}
+	spec.StorageClasses = d.storageClasses
 
 	return dep
 }
@@ -333,6 +335,10 @@ func TestDeploymentController(t *testing.T) {
 				nodeMemory:         "500Mi",
 				kubeletDir:         "/some/directory",
 			},
+			"deployment with storage classes": {
+				name:           "test-deployment",
+				storageClasses: []api.StorageClassType{api.StorageClassFsdaxXFS, api.StorageClassFsdaxExt4, api.StorageClassDevdax, api.StorageClassSector},
+			},
 			"invalid device mode": {
 				name:          "test-driver-modes",
 				deviceMode:    "foobar",
@@ -586,6 +592,8 @@ func TestDeploymentController(t *testing.T) {
 
 				d := &pmemDeployment{
 					name: "test-panic-" + strings.ToLower(gvk.Kind),
+					// Enabled, otherwise no StorageClass gets created.
+					storageClasses: []api.StorageClassType{api.StorageClassFsdaxXFS},
 				}
 				dep := getDeployment(d)
 				err := tc.c.Create(tc.ctx, dep)
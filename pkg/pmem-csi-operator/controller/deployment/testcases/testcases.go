@@ -102,6 +102,12 @@ func UpdateTests() []UpdateTest {
 		"kubeletDir": func(d *api.PmemCSIDeployment) {
 			d.Spec.KubeletDir = "/foo/bar"
 		},
+		"maxVolumesPerNode": func(d *api.PmemCSIDeployment) {
+			d.Spec.MaxVolumesPerNode += 10
+		},
+		"storageClasses": func(d *api.PmemCSIDeployment) {
+			d.Spec.StorageClasses = append(d.Spec.StorageClasses, api.StorageClassFsdaxExt4)
+		},
 	}
 
 	full := api.PmemCSIDeployment{
@@ -118,10 +124,14 @@ func UpdateTests() []UpdateTest {
 			NodeSelector: map[string]string{
 				"no-such-label": "no-such-value",
 			},
-			PMEMPercentage: 50,
+			PMEMPercentage:    50,
+			MaxVolumesPerNode: 100,
 			Labels: map[string]string{
 				"a": "b",
 			},
+			StorageClasses: []api.StorageClassType{
+				api.StorageClassFsdaxXFS,
+			},
 			ControllerDriverResources: &corev1.ResourceRequirements{
 				Requests: corev1.ResourceList{
 					corev1.ResourceCPU:    resource.MustParse("20m"),
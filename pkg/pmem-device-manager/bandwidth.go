@@ -0,0 +1,223 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/sys/unix"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// Uncore memory controller events which count 64 byte
+	// transfers in the PMEM read and write pending queues. These
+	// are the same on all Xeon generations which support PMEM.
+	pmmReadEvent  = 0xe3 // UNC_M_PMM_RPQ_INSERTS
+	pmmWriteEvent = 0xe7 // UNC_M_PMM_WPQ_INSERTS
+
+	cacheLineSize = 64
+)
+
+var pmemBandwidthDesc = prometheus.NewDesc(
+	"pmem_bandwidth_bytes_total",
+	"Amount of data transferred from and to PMEM by all applications on the host, by socket and direction.",
+	[]string{"socket", "direction"}, nil,
+)
+
+// sysfsRoot can be changed for testing.
+var sysfsRoot = "/sys"
+
+// counter is a single perf event counter.
+type counter interface {
+	read() (uint64, error)
+	close() error
+}
+
+type perfCounter int
+
+func (fd perfCounter) read() (uint64, error) {
+	buffer := make([]byte, 8)
+	if _, err := unix.Read(int(fd), buffer); err != nil {
+		return 0, err
+	}
+	return binary.NativeEndian.Uint64(buffer), nil
+}
+
+func (fd perfCounter) close() error {
+	return unix.Close(int(fd))
+}
+
+// openCounter can be replaced for testing.
+var openCounter = func(pmuType uint32, event uint64, cpu int) (counter, error) {
+	attr := unix.PerfEventAttr{
+		Type:   pmuType,
+		Config: event,
+	}
+	attr.Size = uint32(unsafe.Sizeof(attr))
+	fd, err := unix.PerfEventOpen(&attr, -1, cpu, -1, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return perfCounter(fd), nil
+}
+
+type socketCounter struct {
+	socket    string
+	direction string
+	counter   counter
+}
+
+// BandwidthCollector samples the uncore memory controller counters
+// for PMEM traffic. It is meant for correlating application latency
+// with PMEM bandwidth saturation and therefore covers all PMEM
+// traffic, not just the one for PMEM-CSI volumes.
+type BandwidthCollector struct {
+	counters []socketCounter
+}
+
+var _ prometheus.Collector = &BandwidthCollector{}
+
+// NewBandwidthCollector opens the counters for all memory
+// controllers. This fails when the hardware does not have them or
+// when perf events are not permitted, which needs CAP_PERFMON or
+// a low enough kernel.perf_event_paranoid.
+func NewBandwidthCollector(ctx context.Context) (_ *BandwidthCollector, finalErr error) {
+	logger := klog.FromContext(ctx).WithName("NewBandwidthCollector")
+	pmus, err := filepath.Glob(filepath.Join(sysfsRoot, "bus/event_source/devices/uncore_imc_*"))
+	if err != nil {
+		return nil, err
+	}
+	if len(pmus) == 0 {
+		return nil, errors.New("no uncore memory controller found")
+	}
+
+	bc := &BandwidthCollector{}
+	defer func() {
+		if finalErr != nil {
+			bc.close()
+		}
+	}()
+	for _, pmu := range pmus {
+		pmuType, err := readUint(filepath.Join(pmu, "type"))
+		if err != nil {
+			return nil, err
+		}
+		cpus, err := readCPUMask(filepath.Join(pmu, "cpumask"))
+		if err != nil {
+			return nil, err
+		}
+		// Uncore PMUs list one CPU per socket.
+		for _, cpu := range cpus {
+			socket, err := os.ReadFile(filepath.Join(sysfsRoot, fmt.Sprintf("devices/system/cpu/cpu%d/topology/physical_package_id", cpu)))
+			if err != nil {
+				return nil, err
+			}
+			for direction, event := range map[string]uint64{"read": pmmReadEvent, "write": pmmWriteEvent} {
+				c, err := openCounter(uint32(pmuType), event, cpu)
+				if err != nil {
+					return nil, fmt.Errorf("open perf event for %s: %v", filepath.Base(pmu), err)
+				}
+				bc.counters = append(bc.counters, socketCounter{
+					socket:    strings.TrimSpace(string(socket)),
+					direction: direction,
+					counter:   c,
+				})
+			}
+		}
+		logger.V(3).Info("Opened counters", "pmu", filepath.Base(pmu), "cpus", cpus)
+	}
+	return bc, nil
+}
+
+func (bc *BandwidthCollector) close() {
+	for _, c := range bc.counters {
+		_ = c.counter.close()
+	}
+}
+
+// MustRegister adds the collector to the registry, using labels to tag each sample with node and driver name.
+func (bc *BandwidthCollector) MustRegister(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		NodeLabel:     nodeName,
+		"driver_name": driverName,
+	}
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(bc)
+}
+
+// Describe implements prometheus.Collector.Describe.
+func (bc *BandwidthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- pmemBandwidthDesc
+}
+
+// Collect implements prometheus.Collector.Collect.
+func (bc *BandwidthCollector) Collect(ch chan<- prometheus.Metric) {
+	type key struct {
+		socket, direction string
+	}
+	transfers := map[key]uint64{}
+	for _, c := range bc.counters {
+		value, err := c.counter.read()
+		if err != nil {
+			klog.Background().WithName("Prometheus Collect").Error(err, "Reading PMEM bandwidth counter failed", "socket", c.socket)
+			return
+		}
+		transfers[key{c.socket, c.direction}] += value
+	}
+	for k, value := range transfers {
+		ch <- prometheus.MustNewConstMetric(
+			pmemBandwidthDesc,
+			prometheus.CounterValue,
+			float64(value*cacheLineSize),
+			k.socket, k.direction,
+		)
+	}
+}
+
+func readUint(filename string) (uint64, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(data)), 10, 32)
+}
+
+// readCPUMask parses a list like "0,28" or "0-1".
+func readCPUMask(filename string) ([]int, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var cpus []int
+	for _, part := range strings.Split(strings.TrimSpace(string(data)), ",") {
+		from, to := part, part
+		if i := strings.Index(part, "-"); i >= 0 {
+			from, to = part[:i], part[i+1:]
+		}
+		start, err := strconv.Atoi(from)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		end, err := strconv.Atoi(to)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		for cpu := start; cpu <= end; cpu++ {
+			cpus = append(cpus, cpu)
+		}
+	}
+	return cpus, nil
+}
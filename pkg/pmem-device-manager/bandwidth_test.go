@@ -0,0 +1,97 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+)
+
+type fakeCounter struct {
+	value  uint64
+	closed *int
+}
+
+func (c fakeCounter) read() (uint64, error) {
+	return c.value, nil
+}
+
+func (c fakeCounter) close() error {
+	*c.closed++
+	return nil
+}
+
+func TestBandwidthCollector(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	root := t.TempDir()
+	writeFile := func(path, content string) {
+		path = filepath.Join(root, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0755), "create directory")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0644), "write file")
+	}
+	oldRoot, oldOpen := sysfsRoot, openCounter
+	defer func() {
+		sysfsRoot, openCounter = oldRoot, oldOpen
+	}()
+	sysfsRoot = root
+
+	_, err := NewBandwidthCollector(ctx)
+	assert.Error(t, err, "no memory controller")
+
+	for _, imc := range []string{"uncore_imc_0", "uncore_imc_1"} {
+		writeFile("bus/event_source/devices/"+imc+"/type", "13\n")
+		writeFile("bus/event_source/devices/"+imc+"/cpumask", "0,28\n")
+	}
+	writeFile("devices/system/cpu/cpu0/topology/physical_package_id", "0\n")
+	writeFile("devices/system/cpu/cpu28/topology/physical_package_id", "1\n")
+
+	closed := 0
+	openCounter = func(pmuType uint32, event uint64, cpu int) (counter, error) {
+		assert.Equal(t, uint32(13), pmuType, "PMU type")
+		value := uint64(cpu + 1)
+		if event == pmmWriteEvent {
+			value *= 10
+		}
+		return fakeCounter{value: value, closed: &closed}, nil
+	}
+	bc, err := NewBandwidthCollector(ctx)
+	require.NoError(t, err, "create collector")
+
+	// Two memory controllers per socket.
+	expected := `
+# HELP pmem_bandwidth_bytes_total Amount of data transferred from and to PMEM by all applications on the host, by socket and direction.
+# TYPE pmem_bandwidth_bytes_total counter
+pmem_bandwidth_bytes_total{direction="read",driver_name="pmem-csi.intel.com",node="worker",socket="0"} 128
+pmem_bandwidth_bytes_total{direction="read",driver_name="pmem-csi.intel.com",node="worker",socket="1"} 3712
+pmem_bandwidth_bytes_total{direction="write",driver_name="pmem-csi.intel.com",node="worker",socket="0"} 1280
+pmem_bandwidth_bytes_total{direction="write",driver_name="pmem-csi.intel.com",node="worker",socket="1"} 37120
+`
+	registry := prometheus.NewPedanticRegistry()
+	bc.MustRegister(registry, "worker", "pmem-csi.intel.com")
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(expected)), "metrics data")
+
+	// Counters get closed when opening fails.
+	openCounter = func(pmuType uint32, event uint64, cpu int) (counter, error) {
+		if cpu == 28 {
+			return nil, errors.New("permission denied")
+		}
+		return fakeCounter{closed: &closed}, nil
+	}
+	closed = 0
+	_, err = NewBandwidthCollector(ctx)
+	assert.Error(t, err, "open failure")
+	assert.Equal(t, 2, closed, "closed counters")
+}
@@ -0,0 +1,179 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/klog/v2"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// FreeSpace describes the unused PMEM in one region (direct and
+// devdax mode) or volume group (LVM mode).
+type FreeSpace struct {
+	// Pool is the name of the region or volume group.
+	Pool string
+	// LargestExtent is the size of the largest contiguous free
+	// extent, zero if there is none.
+	LargestExtent uint64
+	// Extents is the number of free extents.
+	Extents int
+}
+
+// Fragmentation is implemented by device managers which can tell how
+// the free PMEM is split up. It explains why volumes larger than the
+// largest extent cannot be created although there is more free PMEM
+// in total. Use As to find it behind wrappers.
+type Fragmentation interface {
+	// GetFreeSpace returns information about each region or
+	// volume group that is used for volumes.
+	GetFreeSpace(ctx context.Context) ([]FreeSpace, error)
+}
+
+func newFreeSpace(pool string, extents []uint64) FreeSpace {
+	space := FreeSpace{Pool: pool, Extents: len(extents)}
+	for _, extent := range extents {
+		if extent > space.LargestExtent {
+			space.LargestExtent = extent
+		}
+	}
+	return space
+}
+
+var _ Fragmentation = &pmemNdctl{}
+
+func (pmem *pmemNdctl) GetFreeSpace(ctx context.Context) ([]FreeSpace, error) {
+	ndctlMutex.Lock()
+	defer ndctlMutex.Unlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return nil, err
+	}
+	defer ndctx.Free()
+
+	var spaces []FreeSpace
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			if r.Type() != ndctl.PmemRegion || !pmem.regions.Selected(r.DeviceName()) {
+				continue
+			}
+			spaces = append(spaces, newFreeSpace(r.DeviceName(), r.FreeExtents()))
+		}
+	}
+	return spaces, nil
+}
+
+// pvs lists one line per physical volume segment. Unused segments
+// have the "free" segment type. Segment sizes are counted in extents.
+var pvsSegmentArgs = []string{"--noheadings", "--nosuffix", "--segments", "-o", "vg_name,vg_extent_size,pvseg_size,segtype", "--units", "B"}
+
+var _ Fragmentation = &pmemLvm{}
+
+func (lvm *pmemLvm) GetFreeSpace(ctx context.Context) ([]FreeSpace, error) {
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	args := append(pvsSegmentArgs, lvm.volumeGroups...)
+	output, err := runCommand(ctx, "pvs", args...)
+	if err != nil {
+		return nil, fmt.Errorf("pvs failure: %v", err)
+	}
+	extents, err := parsePVSSegments(output)
+	if err != nil {
+		return nil, err
+	}
+	var spaces []FreeSpace
+	for _, vg := range lvm.volumeGroups {
+		spaces = append(spaces, newFreeSpace(vg, extents[vg]))
+	}
+	return spaces, nil
+}
+
+// parsePVSSegments returns the sizes of the free segments in each
+// volume group. Segments on different physical volumes are never
+// contiguous.
+func parsePVSSegments(output string) (map[string][]uint64, error) {
+	extents := map[string][]uint64{}
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("failed to parse pvs output: %q", line)
+		}
+		if fields[3] != "free" {
+			continue
+		}
+		extentSize, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("extent size in pvs output %q: %v", line, err)
+		}
+		count, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("segment size in pvs output %q: %v", line, err)
+		}
+		extents[fields[0]] = append(extents[fields[0]], count*extentSize)
+	}
+	return extents, nil
+}
+
+var (
+	freeExtentMaxDesc = prometheus.NewDesc(
+		"pmem_free_extent_max_bytes",
+		"Size of the largest contiguous free extent in a region or volume group.",
+		[]string{"pool"}, nil,
+	)
+	freeExtentsDesc = prometheus.NewDesc(
+		"pmem_free_extents",
+		"Number of free extents in a region or volume group.",
+		[]string{"pool"}, nil,
+	)
+)
+
+// FragmentationCollector turns GetFreeSpace values into metrics data.
+type FragmentationCollector struct {
+	Fragmentation
+}
+
+// MustRegister adds the collector to the registry, with the same labels as a CapacityCollector.
+func (fc FragmentationCollector) MustRegister(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		NodeLabel:     nodeName,
+		"driver_name": driverName,
+	}
+	prometheus.WrapRegistererWith(labels, reg).MustRegister(fc)
+}
+
+// Describe implements prometheus.Collector.Describe.
+func (fc FragmentationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- freeExtentMaxDesc
+	ch <- freeExtentsDesc
+}
+
+// Collect implements prometheus.Collector.Collect.
+func (fc FragmentationCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.TODO()
+	spaces, err := fc.GetFreeSpace(ctx)
+	if err != nil {
+		klog.FromContext(ctx).Error(err, "Collecting free space failed")
+		return
+	}
+	for _, space := range spaces {
+		ch <- prometheus.MustNewConstMetric(freeExtentMaxDesc, prometheus.GaugeValue, float64(space.LargestExtent), space.Pool)
+		ch <- prometheus.MustNewConstMetric(freeExtentsDesc, prometheus.GaugeValue, float64(space.Extents), space.Pool)
+	}
+}
+
+var _ prometheus.Collector = FragmentationCollector{}
@@ -0,0 +1,54 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePVSSegments(t *testing.T) {
+	output := `  ndbus0region0fsdax 4194304  100 linear
+  ndbus0region0fsdax 4194304   20 free
+  ndbus0region0fsdax 4194304   50 linear
+  ndbus0region0fsdax 4194304   30 free
+  ndbus0region1fsdax 4194304  200 linear
+`
+	extents, err := parsePVSSegments(output)
+	require.NoError(t, err, "parse")
+	assert.Equal(t, map[string][]uint64{"ndbus0region0fsdax": {20 * 4194304, 30 * 4194304}}, extents, "extents")
+	assert.Equal(t, FreeSpace{Pool: "vg", LargestExtent: 30 * 4194304, Extents: 2}, newFreeSpace("vg", extents["ndbus0region0fsdax"]), "free space")
+	assert.Equal(t, FreeSpace{Pool: "vg"}, newFreeSpace("vg", extents["ndbus0region1fsdax"]), "no free space")
+
+	_, err = parsePVSSegments("vg 4194304 free\n")
+	assert.Error(t, err, "missing field")
+}
+
+type fixedFreeSpace []FreeSpace
+
+func (f fixedFreeSpace) GetFreeSpace(ctx context.Context) ([]FreeSpace, error) {
+	return f, nil
+}
+
+func TestFragmentationCollector(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	FragmentationCollector{Fragmentation: fixedFreeSpace{{Pool: "region0", LargestExtent: 1024, Extents: 3}}}.MustRegister(reg, "node", "driver")
+	assert.NoError(t, testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP pmem_free_extent_max_bytes Size of the largest contiguous free extent in a region or volume group.
+# TYPE pmem_free_extent_max_bytes gauge
+pmem_free_extent_max_bytes{driver_name="driver",node="node",pool="region0"} 1024
+# HELP pmem_free_extents Number of free extents in a region or volume group.
+# TYPE pmem_free_extents gauge
+pmem_free_extents{driver_name="driver",node="node",pool="region0"} 3
+`)), "metrics")
+}
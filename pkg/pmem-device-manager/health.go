@@ -0,0 +1,57 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// HealthChecker is implemented by device managers which can check
+// that the tools or libraries they depend on still respond. The check
+// must not wait for operations that are in progress, because those
+// can take a long time without anything being wrong. Use As to find
+// it behind wrappers.
+type HealthChecker interface {
+	// CheckHealth returns an error if the device manager is not
+	// usable anymore.
+	CheckHealth(ctx context.Context) error
+}
+
+var _ HealthChecker = &pmemNdctl{}
+
+// CheckHealth creates a new libndctl context without ndctlMutex,
+// which reads the current state of the hardware from sysfs.
+func (pmem *pmemNdctl) CheckHealth(ctx context.Context) error {
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return err
+	}
+	defer ndctx.Free()
+
+	for _, bus := range ndctx.GetBuses() {
+		_ = bus.ActiveRegions()
+	}
+	return nil
+}
+
+var _ HealthChecker = &pmemLvm{}
+
+// CheckHealth runs vgs without lvmMutex. --readonly reads the
+// metadata without taking LVM locks, so it does not have to wait for
+// a running lvcreate or lvremove either.
+func (lvm *pmemLvm) CheckHealth(ctx context.Context) error {
+	args := append([]string{"--readonly", "--noheadings", "-o", "vg_name"}, lvm.volumeGroups...)
+	if _, err := pmemexec.Run(ctx, exec.CommandContext(ctx, "vgs", args...)); err != nil {
+		return fmt.Errorf("vgs failure: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+const (
+	ConvertToSystemRAMLabel = "convert-to-system-ram"
+	ConvertToSystemRAMValue = "force"
+	// SystemRAMLabel gets set on nodes where PMEM was added to the
+	// memory of the kernel, so workloads which want memory tiering
+	// can select those nodes.
+	SystemRAMLabel = "system-ram"
+)
+
+// daxDevicesPath contains the devdax devices and their current
+// driver. Can be replaced for testing.
+var daxDevicesPath = "/sys/bus/dax/devices"
+
+// ConvertToSystemRAM reconfigures the selected namespaces such that
+// the kernel uses them as normal memory in a separate NUMA node
+// ("kmem"), then modifies the node labels such that this special
+// one-time operation does not run again. Raw namespaces get converted
+// to devdax first. Without selection, all raw namespaces and all
+// devdax namespaces without name are used. Namespaces with a name
+// are left alone because PMEM-CSI names the namespaces of its volumes.
+func ConvertToSystemRAM(ctx context.Context, client kubernetes.Interface, driverName string, namespaces []string, nodeName string) (finalErr error) {
+	ctx, _ = pmemlog.WithName(ctx, "ConvertToSystemRAM")
+	defer func() {
+		if finalErr == nil {
+			return
+		}
+
+		// Gather some information and append it.
+		finalErr = fmt.Errorf("%w\n%s\n%s",
+			finalErr,
+			exec.CmdResult("ndctl", "list", "-NRi"),
+			exec.CmdResult("daxctl", "list", "-D"),
+		)
+	}()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return fmt.Errorf("ndctl: %v", err)
+	}
+
+	numConverted, err := convertToSystemRAM(ctx, ndctx, namespaces)
+	if err != nil {
+		return err
+	}
+	if numConverted == 0 {
+		return errors.New("no suitable namespace found")
+	}
+
+	if err := labelSystemRAM(ctx, client, driverName, nodeName); err != nil {
+		return fmt.Errorf("relabel node %s: %v", nodeName, err)
+	}
+	return nil
+}
+
+func convertToSystemRAM(ctx context.Context, ndctx ndctl.Context, namespaces []string) (numConverted int, finalErr error) {
+	ctx, logger := pmemlog.WithName(ctx, "convert")
+	defer func() {
+		if finalErr != nil {
+			logger.Error(finalErr, "failed", "converted", numConverted)
+		} else {
+			logger.V(3).Info("successful", "converted", numConverted)
+		}
+	}()
+
+	selected := func(namespace ndctl.Namespace) bool {
+		if len(namespaces) == 0 {
+			return namespace.Mode() == ndctl.RawMode || namespace.Name() == ""
+		}
+		for _, name := range namespaces {
+			if name == namespace.DeviceName() || name == namespace.Name() {
+				return true
+			}
+		}
+		return false
+	}
+
+	logger.V(3).Info("checking for namespaces")
+	for _, bus := range ndctx.GetBuses() {
+		logger.V(3).Info("checking", "bus", bus)
+		for _, region := range bus.ActiveRegions() {
+			logger.V(3).Info("checking", "region", region)
+			if region.Readonly() {
+				logger.V(3).Info("skipped because read-only")
+				continue
+			}
+			for _, namespace := range region.AllNamespaces() {
+				logger.V(3).Info("checking", "namespace", namespace)
+				if namespace.Size() <= 0 {
+					logger.V(3).Info("skipped because size is zero")
+					continue
+				}
+				if !selected(namespace) {
+					logger.V(3).Info("skipped because not selected")
+					continue
+				}
+
+				daxDevice := namespace.CharDeviceName()
+				switch namespace.Mode() {
+				case ndctl.RawMode:
+					logger.V(2).Info("converting raw namespace", "namespace", namespace)
+					output, err := exec.RunCommand(ctx, "ndctl", "create-namespace",
+						"--force", "--mode", "devdax",
+						"--bus", bus.DeviceName(),
+						"--region", region.DeviceName(),
+						"--reconfig", namespace.DeviceName(),
+					)
+					if err != nil {
+						finalErr = err
+						return
+					}
+					// The dax device only exists now, ndctl
+					// describes the new namespace.
+					var created struct {
+						CharDev string `json:"chardev"`
+					}
+					if err := json.Unmarshal([]byte(output), &created); err != nil || created.CharDev == "" {
+						finalErr = fmt.Errorf("unexpected output of ndctl create-namespace for %s: %q", namespace.DeviceName(), output)
+						return
+					}
+					daxDevice = created.CharDev
+					fallthrough
+				case ndctl.DaxMode:
+					driver, _ := os.Readlink(filepath.Join(daxDevicesPath, daxDevice, "driver"))
+					if filepath.Base(driver) == "kmem" {
+						logger.V(2).Info("already used as system RAM", "namespace", namespace, "dax", daxDevice)
+					} else {
+						logger.V(2).Info("reconfiguring devdax device", "namespace", namespace, "dax", daxDevice)
+						if _, err := exec.RunCommand(ctx, "daxctl", "reconfigure-device",
+							"--mode", "system-ram",
+							daxDevice,
+						); err != nil {
+							finalErr = err
+							return
+						}
+						logger.V(2).Info("converted to system RAM", "namespace", namespace, "dax", daxDevice)
+					}
+					numConverted++
+				default:
+					logger.V(3).Info("ignoring namespace because of mode", "mode", namespace.Mode())
+				}
+			}
+		}
+	}
+
+	return
+}
+
+func labelSystemRAM(ctx context.Context, client kubernetes.Interface, driverName string, nodeName string) error {
+	ctx, logger := pmemlog.WithName(ctx, "relabel")
+
+	// Remove "force" label, add the label for workloads.
+	patch := fmt.Sprintf(`{"metadata":{"labels":{"%s/%s": null, "%s/%s": "true"}}}`,
+		driverName, ConvertToSystemRAMLabel,
+		driverName, SystemRAMLabel,
+	)
+	logger.V(5).Info("Node", "patch", patch)
+	if _, err := client.CoreV1().Nodes().Patch(ctx, nodeName, k8stypes.MergePatchType, []byte(patch), metav1.PatchOptions{}, ""); err != nil {
+		return fmt.Errorf("failed to patch node: %v", err)
+	}
+	logger.V(3).Info("Change node labels", "node", nodeName, "patch", patch)
+	return nil
+}
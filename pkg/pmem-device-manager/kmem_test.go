@@ -0,0 +1,204 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestConvertToSystemRAM(t *testing.T) {
+	createDevdax := `#!/bin/sh
+cat <<EOF
+{
+  "dev":"namespace0.0",
+  "mode":"devdax",
+  "map":"dev",
+  "size":67643637760,
+  "uuid":"f4afa860-b590-451f-8d64-3e2eb228d366",
+  "chardev":"dax0.0",
+  "align":2097152
+}
+EOF
+`
+	reconfigureOkay := `#!/bin/sh
+case "$*" in
+    reconfigure-device\ --mode\ system-ram\ dax0.*)
+       exit 0
+       ;;
+    *)
+       echo >&2 "unexpected invocation: $*"
+       exit 1
+       ;;
+esac
+`
+	failure := `#!/bin/sh
+echo "$@: fake error"
+exit 1
+`
+
+	devdaxNamespace := func(name string) *ndctlfake.Context {
+		hardware := makeRawNamespace()
+		ns := hardware.Buses[0].(*ndctlfake.Bus).Regions_[0].(*ndctlfake.Region).Namespaces_[0].(*ndctlfake.Namespace)
+		ns.Mode_ = ndctl.DaxMode
+		ns.Name_ = name
+		ns.BlockDeviceName_ = ""
+		ns.CharDeviceName_ = "dax0.0"
+		return hardware
+	}
+
+	testcases := map[string]struct {
+		hardware    ndctl.Context
+		namespaces  []string
+		kmem        bool
+		scripts     map[string]string
+		expectError bool
+		expectNum   int
+	}{
+		"nop": {
+			hardware: ndctlfake.NewContext(&ndctlfake.Context{}),
+		},
+		"readonly-region": {
+			hardware: func() ndctl.Context {
+				hardware := makeRawNamespace()
+				hardware.Buses[0].(*ndctlfake.Bus).Regions_[0].(*ndctlfake.Region).Readonly_ = true
+				return hardware
+			}(),
+		},
+		"fsdax-namespace": {
+			hardware: func() ndctl.Context {
+				hardware := makeRawNamespace()
+				hardware.Buses[0].(*ndctlfake.Bus).Regions_[0].(*ndctlfake.Region).Namespaces_[0].(*ndctlfake.Namespace).Mode_ = ndctl.FsdaxMode
+				return hardware
+			}(),
+		},
+		"convert-raw": {
+			hardware: makeRawNamespace(),
+			scripts: map[string]string{
+				"ndctl":  createDevdax,
+				"daxctl": reconfigureOkay,
+			},
+			expectNum: 1,
+		},
+		"convert-devdax": {
+			hardware: devdaxNamespace(""),
+			scripts: map[string]string{
+				"daxctl": reconfigureOkay,
+			},
+			expectNum: 1,
+		},
+		"already-kmem": {
+			hardware:  devdaxNamespace(""),
+			kmem:      true,
+			expectNum: 1,
+		},
+		"volume-namespace": {
+			// Created by PMEM-CSI in devdax mode.
+			hardware: devdaxNamespace("pvc-1234"),
+		},
+		"not-selected": {
+			hardware:   devdaxNamespace(""),
+			namespaces: []string{"namespace1.0"},
+		},
+		"selected-by-device-name": {
+			hardware:   devdaxNamespace(""),
+			namespaces: []string{"namespace0.0"},
+			scripts: map[string]string{
+				"daxctl": reconfigureOkay,
+			},
+			expectNum: 1,
+		},
+		"selected-by-name": {
+			hardware:   devdaxNamespace("tiering"),
+			namespaces: []string{"tiering"},
+			scripts: map[string]string{
+				"daxctl": reconfigureOkay,
+			},
+			expectNum: 1,
+		},
+		"convert-failure": {
+			hardware: makeRawNamespace(),
+			scripts: map[string]string{
+				"daxctl": reconfigureOkay,
+			},
+			expectError: true,
+		},
+		"reconfigure-failure": {
+			hardware:    devdaxNamespace(""),
+			expectError: true,
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			path := os.Getenv("PATH")
+			defer os.Setenv("PATH", path)
+			tmp := t.TempDir()
+
+			// Create fake commands, backfilling with a
+			// version which fails if called.
+			for _, script := range []string{"ndctl", "daxctl"} {
+				content, ok := tc.scripts[script]
+				if !ok {
+					content = failure
+				}
+				err := os.WriteFile(tmp+"/"+script, []byte(content), 0700)
+				require.NoError(t, err)
+			}
+			os.Setenv("PATH", tmp+":"+path)
+
+			oldDaxDevicesPath := daxDevicesPath
+			defer func() {
+				daxDevicesPath = oldDaxDevicesPath
+			}()
+			daxDevicesPath = filepath.Join(tmp, "devices")
+			if tc.kmem {
+				require.NoError(t, os.MkdirAll(filepath.Join(daxDevicesPath, "dax0.0"), 0700))
+				require.NoError(t, os.Symlink("../../../bus/dax/drivers/kmem", filepath.Join(daxDevicesPath, "dax0.0", "driver")))
+			}
+
+			_, ctx := ktesting.NewTestContext(t)
+
+			numConverted, err := convertToSystemRAM(ctx, tc.hardware, tc.namespaces)
+			if tc.expectError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectNum, numConverted)
+		})
+	}
+}
+
+func TestLabelSystemRAM(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	client := fake.NewSimpleClientset(makeNode("worker", map[string]string{
+		"pmem-csi/convert-to-system-ram":  "force",
+		"pmem-csi2/convert-to-system-ram": "force",
+		"foo":                             "bar",
+	}))
+	require.NoError(t, labelSystemRAM(ctx, client, "pmem-csi", "worker"))
+	node, err := client.CoreV1().Nodes().Get(ctx, "worker", metav1.GetOptions{})
+	require.NoError(t, err, "get node")
+	assert.Equal(t, map[string]string{
+		"pmem-csi/system-ram":             "true",
+		"pmem-csi2/convert-to-system-ram": "force",
+		"foo":                             "bar",
+	}, node.Labels)
+
+	require.Error(t, labelSystemRAM(ctx, client, "pmem-csi", "no-such-node"))
+}
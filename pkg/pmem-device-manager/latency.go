@@ -0,0 +1,128 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+	"github.com/intel/pmem-csi/pkg/tracing"
+)
+
+// latencyBuckets cover the range from a quick GetCapacity (a few
+// milliseconds) to erasing a large volume (minutes).
+var latencyBuckets = prometheus.ExponentialBuckets(0.001, 4, 11)
+
+var (
+	operationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pmem_device_manager_operation_duration_seconds",
+			Help:    "Duration of device manager operations, by device mode, operation and result.",
+			Buckets: latencyBuckets,
+		},
+		[]string{"mode", "operation", "result"},
+	)
+	commandDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pmem_device_manager_command_duration_seconds",
+			Help:    "Duration of the external commands and libndctl calls that device managers depend on, by command and result.",
+			Buckets: latencyBuckets,
+		},
+		[]string{"command", "result"},
+	)
+)
+
+// MustRegisterLatencyMetrics adds the histograms for all device
+// managers to the registry, with the same labels as a
+// CapacityCollector.
+func MustRegisterLatencyMetrics(reg prometheus.Registerer, nodeName, driverName string) {
+	labels := prometheus.Labels{
+		NodeLabel:     nodeName,
+		"driver_name": driverName,
+	}
+	reg = prometheus.WrapRegistererWith(labels, reg)
+	reg.MustRegister(operationDuration)
+	reg.MustRegister(commandDuration)
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "error"
+	}
+	return "success"
+}
+
+func observe(histogram *prometheus.HistogramVec, start time.Time, err error, labels ...string) {
+	histogram.WithLabelValues(append(labels, resultLabel(err))...).Observe(time.Since(start).Seconds())
+}
+
+// runCommand is pmemexec.RunCommand with the duration recorded under
+// the name of the command, for example to make LVM lock contention
+// visible.
+func runCommand(ctx context.Context, cmd string, args ...string) (string, error) {
+	start := time.Now()
+	output, err := pmemexec.RunCommand(ctx, cmd, args...)
+	observe(commandDuration, start, err, cmd)
+	return output, err
+}
+
+// timeNdctl records the duration of a libndctl call under a name
+// that matches the corresponding ndctl command and traces it like
+// an external command.
+func timeNdctl(ctx context.Context, command string, call func() error) error {
+	_, span := tracing.Start(ctx, "ndctl "+command)
+	start := time.Now()
+	err := call()
+	observe(commandDuration, start, err, "ndctl "+command)
+	tracing.End(span, err)
+	return err
+}
+
+// instrumentedDM records the duration of the operations which are
+// called for CreateVolume, DeleteVolume and GetCapacity and traces
+// them.
+type instrumentedDM struct {
+	PmemDeviceManager
+	mode api.DeviceMode
+}
+
+// Unwrap returns the device manager which does the actual work.
+func (dm instrumentedDM) Unwrap() PmemDeviceManager {
+	return dm.PmemDeviceManager
+}
+
+func (dm instrumentedDM) GetCapacity(ctx context.Context) (Capacity, error) {
+	ctx, span := tracing.Start(ctx, "GetCapacity")
+	start := time.Now()
+	capacity, err := dm.PmemDeviceManager.GetCapacity(ctx)
+	observe(operationDuration, start, err, string(dm.mode), "GetCapacity")
+	tracing.End(span, err)
+	return capacity, err
+}
+
+func (dm instrumentedDM) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage, sectorSize uint64, numaNodes NUMANodes) (uint64, error) {
+	ctx, span := tracing.Start(ctx, "CreateDevice", tracing.VolumeID(volumeId))
+	start := time.Now()
+	actual, err := dm.PmemDeviceManager.CreateDevice(ctx, volumeId, size, usage, sectorSize, numaNodes)
+	observe(operationDuration, start, err, string(dm.mode), "CreateDevice")
+	tracing.End(span, err)
+	return actual, err
+}
+
+func (dm instrumentedDM) DeleteDevice(ctx context.Context, volumeId string, flush bool) error {
+	ctx, span := tracing.Start(ctx, "DeleteDevice", tracing.VolumeID(volumeId))
+	start := time.Now()
+	err := dm.PmemDeviceManager.DeleteDevice(ctx, volumeId, flush)
+	observe(operationDuration, start, err, string(dm.mode), "DeleteDevice")
+	tracing.End(span, err)
+	return err
+}
@@ -0,0 +1,45 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestLatencyMetrics(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := New(ctx, api.DeviceModeFake, 100, Options{})
+	require.NoError(t, err, "create fake device manager")
+	// Other tests also use device managers.
+	operationDuration.Reset()
+
+	count := func(operation, result string) uint64 {
+		var m dto.Metric
+		require.NoError(t, operationDuration.WithLabelValues(string(api.DeviceModeFake), operation, result).(prometheus.Histogram).Write(&m), "write histogram")
+		return m.GetHistogram().GetSampleCount()
+	}
+	_, err = dm.GetCapacity(ctx)
+	require.NoError(t, err, "get capacity")
+	assert.Equal(t, uint64(1), count("GetCapacity", "success"), "GetCapacity")
+	_, err = dm.CreateDevice(ctx, "vol", 1024*1024, parameters.UsageAppDirect, 0, nil)
+	require.NoError(t, err, "create device")
+	_, err = dm.CreateDevice(ctx, "vol", 1024*1024, parameters.UsageAppDirect, 0, nil)
+	require.Error(t, err, "create device again")
+	assert.Equal(t, uint64(1), count("CreateDevice", "success"), "CreateDevice")
+	assert.Equal(t, uint64(1), count("CreateDevice", "error"), "failed CreateDevice")
+	require.NoError(t, dm.DeleteDevice(ctx, "vol", false), "delete device")
+	assert.Equal(t, uint64(1), count("DeleteDevice", "success"), "DeleteDevice")
+}
@@ -25,6 +25,16 @@ var (
 		"Remaining amount of PMEM on the host that can be used for new volumes.",
 		nil, nil,
 	)
+	pmemPhysicalAvailableDesc = prometheus.NewDesc(
+		"pmem_amount_physical_available",
+		"Remaining amount of PMEM on the host that is not used yet. Smaller than pmem_amount_available when thin provisioning over-commits PMEM.",
+		nil, nil,
+	)
+	pmemProvisionedDesc = prometheus.NewDesc(
+		"pmem_amount_provisioned",
+		"Sum of the sizes of all PMEM volumes on the host.",
+		nil, nil,
+	)
 	pmemManagedDesc = prometheus.NewDesc(
 		"pmem_amount_managed",
 		"Amount of PMEM on the host that is managed by PMEM-CSI.",
@@ -81,6 +91,16 @@ func (cc CapacityCollector) Collect(ch chan<- prometheus.Metric) {
 		prometheus.GaugeValue,
 		float64(capacity.Available),
 	)
+	ch <- prometheus.MustNewConstMetric(
+		pmemPhysicalAvailableDesc,
+		prometheus.GaugeValue,
+		float64(capacity.PhysicalAvailable),
+	)
+	ch <- prometheus.MustNewConstMetric(
+		pmemProvisionedDesc,
+		prometheus.GaugeValue,
+		float64(capacity.Provisioned),
+	)
 	ch <- prometheus.MustNewConstMetric(
 		pmemManagedDesc,
 		prometheus.GaugeValue,
@@ -0,0 +1,50 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"sort"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// NUMANodes restricts CreateDevice to PMEM which is local to the
+// CPUs of certain NUMA nodes. Empty allows all PMEM.
+type NUMANodes []int
+
+// Allowed returns true if PMEM on the given NUMA node may be used.
+func (nodes NUMANodes) Allowed(node int) bool {
+	if len(nodes) == 0 {
+		return true
+	}
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+// regionNUMANodes returns the sorted NUMA nodes of the selected
+// active regions. Regions without NUMA node are ignored.
+func regionNUMANodes(ndctx ndctl.Context, regions RegionSelection) NUMANodes {
+	seen := map[int]bool{}
+	var nodes NUMANodes
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			if !regions.Selected(r.DeviceName()) {
+				continue
+			}
+			if node := r.NumaNode(); node >= 0 && !seen[node] {
+				seen[node] = true
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	sort.Ints(nodes)
+	return nodes
+}
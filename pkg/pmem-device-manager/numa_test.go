@@ -0,0 +1,37 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestNUMANodes(t *testing.T) {
+	assert.True(t, NUMANodes{}.Allowed(1), "no restriction")
+	assert.True(t, NUMANodes{0, 1}.Allowed(1), "allowed")
+	assert.False(t, NUMANodes{0}.Allowed(1), "not allowed")
+
+	hardware := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{
+			&ndctlfake.Bus{
+				Regions_: []ndctl.Region{
+					&ndctlfake.Region{DeviceName_: "region0", Enabled_: true, NumaNode_: 1},
+					&ndctlfake.Region{DeviceName_: "region1", Enabled_: true, NumaNode_: 0},
+					&ndctlfake.Region{DeviceName_: "region2", Enabled_: true, NumaNode_: 1},
+					&ndctlfake.Region{DeviceName_: "region3", Enabled_: true, NumaNode_: -1},
+					&ndctlfake.Region{DeviceName_: "region4", Enabled_: true, NumaNode_: 2},
+				},
+			},
+		},
+	})
+	assert.Equal(t, NUMANodes{0, 1}, regionNUMANodes(hardware, RegionSelection{Deny: []string{"region4"}}), "NUMA nodes of regions")
+}
@@ -28,6 +28,9 @@ var _ PmemDeviceManager = &fakeDM{}
 
 const totalCapacity uint64 = 1024 * 1024 * 1024 * 1024
 
+// fakeNUMANode is where all of the fake PMEM is.
+const fakeNUMANode = 0
+
 // NewFake instantiates a fake PMEM device manager. The overall capacity
 // is hard-coded as 1TB. Usable capacity can be configured via the
 // percentage. Space is assumed to be contiguous with no fragmentation
@@ -60,17 +63,23 @@ func (dm *fakeDM) getCapacity() Capacity {
 		remaining -= dev.Size
 	}
 	return Capacity{
-		Available:     remaining,
-		MaxVolumeSize: remaining,
-		Managed:       dm.capacity,
-		Total:         totalCapacity,
+		Available:         remaining,
+		PhysicalAvailable: remaining,
+		Provisioned:       dm.capacity - remaining,
+		MaxVolumeSize:     remaining,
+		Managed:           dm.capacity,
+		Total:             totalCapacity,
 	}
 }
 
-func (dm *fakeDM) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage) (uint64, error) {
+func (dm *fakeDM) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage, sectorSize uint64, numaNodes NUMANodes) (uint64, error) {
 	dm.mutex.Lock()
 	defer dm.mutex.Unlock()
 
+	if !numaNodes.Allowed(fakeNUMANode) {
+		return 0, pmemerr.NotEnoughSpace
+	}
+
 	_, ok := dm.devices[volumeId]
 	if ok {
 		return 0, pmemerr.DeviceExists
@@ -81,9 +90,10 @@ func (dm *fakeDM) CreateDevice(ctx context.Context, volumeId string, size uint64
 	}
 
 	dm.devices[volumeId] = &PmemDeviceInfo{
-		VolumeId: volumeId,
-		Size:     size,
-		Path:     FakeDevicePathPrefix + volumeId,
+		VolumeId:      volumeId,
+		Size:          size,
+		AllocatedSize: size,
+		Path:          FakeDevicePathPrefix + volumeId,
 	}
 	return size, nil
 }
@@ -98,6 +108,43 @@ func (dm *fakeDM) DeleteDevice(ctx context.Context, volumeId string, flush bool)
 	return nil
 }
 
+func (dm *fakeDM) ResizeDevice(ctx context.Context, volumeId string, size uint64) (uint64, error) {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	dev, ok := dm.devices[volumeId]
+	if !ok {
+		return 0, pmemerr.DeviceNotFound
+	}
+	if size <= dev.Size {
+		return dev.Size, nil
+	}
+	if size-dev.Size > dm.getCapacity().MaxVolumeSize {
+		return 0, pmemerr.NotEnoughSpace
+	}
+	dev.Size = size
+	dev.AllocatedSize = size
+	return size, nil
+}
+
+func (dm *fakeDM) RenameDevice(ctx context.Context, volumeId, newName string) error {
+	dm.mutex.Lock()
+	defer dm.mutex.Unlock()
+
+	dev, ok := dm.devices[volumeId]
+	if !ok {
+		return pmemerr.DeviceNotFound
+	}
+	if _, ok := dm.devices[newName]; ok {
+		return pmemerr.DeviceExists
+	}
+	delete(dm.devices, volumeId)
+	dev.VolumeId = newName
+	dev.Path = FakeDevicePathPrefix + newName
+	dm.devices[newName] = dev
+	return nil
+}
+
 func (dm *fakeDM) ListDevices(ctx context.Context) ([]*PmemDeviceInfo, error) {
 	dm.mutex.Lock()
 	defer dm.mutex.Unlock()
@@ -120,3 +167,7 @@ func (dm *fakeDM) GetDevice(ctx context.Context, volumeId string) (*PmemDeviceIn
 	}
 	return dev, nil
 }
+
+func (dm *fakeDM) GetNUMANodes(ctx context.Context) (NUMANodes, error) {
+	return NUMANodes{fakeNUMANode}, nil
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -12,7 +13,6 @@ import (
 
 	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
 	pmemerr "github.com/intel/pmem-csi/pkg/errors"
-	pmemexec "github.com/intel/pmem-csi/pkg/exec"
 	pmemlog "github.com/intel/pmem-csi/pkg/logger"
 	"github.com/intel/pmem-csi/pkg/ndctl"
 	pmemcommon "github.com/intel/pmem-csi/pkg/pmem-common"
@@ -30,6 +30,17 @@ const (
 type pmemLvm struct {
 	volumeGroups []string
 	devices      map[string]*PmemDeviceInfo
+	// numaNodes has the NUMA node of the region of each volume
+	// group, if known.
+	numaNodes map[string]int
+	// overcommit is the over-commit percentage of the thin pools,
+	// zero if volumes are not thin volumes.
+	overcommit uint
+	// stripes has the parts of each striped volume, in the order
+	// in which they are used by the striped device.
+	stripes map[string][]*PmemDeviceInfo
+	// readOnly prevents re-creating striped devices while starting.
+	readOnly bool
 }
 
 var _ PmemDeviceManager = &pmemLvm{}
@@ -44,12 +55,15 @@ var vgsArgs = []string{"--noheadings", "--nosuffix", "-o", "vg_name,vg_size,vg_f
 var lvmMutex = &sync.Mutex{}
 
 // NewPmemDeviceManagerLVM Instantiates a new LVM based pmem device manager
-func newPmemDeviceManagerLVM(ctx context.Context, pmemPercentage uint) (PmemDeviceManager, error) {
+func newPmemDeviceManagerLVM(ctx context.Context, pmemPercentage uint, opts Options) (PmemDeviceManager, error) {
 	ctx, logger := pmemlog.WithName(ctx, "LVM-New")
 
 	if pmemPercentage > 100 {
 		return nil, fmt.Errorf("invalid pmemPercentage '%d'. Value must be 0..100", pmemPercentage)
 	}
+	if opts.ThinProvisioning.Enabled() && opts.ThinProvisioning.Overcommit < 100 {
+		return nil, fmt.Errorf("invalid thin pool over-commit '%d'. Value must be at least 100", opts.ThinProvisioning.Overcommit)
+	}
 	lvmMutex.Lock()
 	defer lvmMutex.Unlock()
 
@@ -60,45 +74,71 @@ func newPmemDeviceManagerLVM(ctx context.Context, pmemPercentage uint) (PmemDevi
 	defer ndctx.Free()
 
 	volumeGroups := []string{}
+	numaNodes := map[string]int{}
 	for _, bus := range ndctx.GetBuses() {
 		for _, r := range bus.ActiveRegions() {
 			vgName := pmemcommon.VgName(bus, r)
+			if !opts.Regions.Selected(r.DeviceName()) {
+				logger.V(3).Info("Region not selected, skipping it", "id", r.ID(), "device", r.DeviceName())
+				continue
+			}
 			if r.Type() != ndctl.PmemRegion {
 				logger.Info("Region is not suitable for fsdax, skipping it", "id", r.ID(), "device", r.DeviceName())
 				continue
 			}
 
-			if err := setupNS(ctx, r, pmemPercentage); err != nil {
-				return nil, err
-			}
-			if err := setupVG(ctx, r, vgName); err != nil {
-				return nil, err
+			if !opts.ReadOnly {
+				if err := setupNS(ctx, r, pmemPercentage); err != nil {
+					return nil, err
+				}
+				if err := setupVG(ctx, r, vgName); err != nil {
+					return nil, err
+				}
 			}
-			if _, err := pmemexec.RunCommand(ctx, "vgs", vgName); err != nil {
+			if _, err := runCommand(ctx, "vgs", vgName); err != nil {
 				logger.V(5).Info("Volume group non-existent, skipping it", "vg", vgName)
 			} else {
+				if opts.ThinProvisioning.Enabled() && !opts.ReadOnly {
+					if err := setupThinPool(ctx, vgName); err != nil {
+						return nil, err
+					}
+				}
 				volumeGroups = append(volumeGroups, vgName)
+				if node := r.NumaNode(); node >= 0 {
+					numaNodes[vgName] = node
+				}
 			}
 		}
 	}
 
-	return newPmemDeviceManagerLVMForVGs(ctx, volumeGroups)
+	dm, err := newPmemDeviceManagerLVMForVGs(ctx, volumeGroups, opts.ReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	dm.numaNodes = numaNodes
+	dm.overcommit = opts.ThinProvisioning.Overcommit
+	return dm, nil
 }
 
 func (pmem *pmemLvm) GetMode() api.DeviceMode {
 	return api.DeviceModeLVM
 }
 
-func newPmemDeviceManagerLVMForVGs(ctx context.Context, volumeGroups []string) (PmemDeviceManager, error) {
+func newPmemDeviceManagerLVMForVGs(ctx context.Context, volumeGroups []string, readOnly bool) (*pmemLvm, error) {
 	devices, err := listDevices(ctx, volumeGroups...)
 	if err != nil {
 		return nil, err
 	}
 
-	return &pmemLvm{
+	lvm := &pmemLvm{
 		volumeGroups: volumeGroups,
 		devices:      devices,
-	}, nil
+		numaNodes:    map[string]int{},
+		stripes:      map[string][]*PmemDeviceInfo{},
+		readOnly:     readOnly,
+	}
+	lvm.assembleStripes(ctx)
+	return lvm, nil
 }
 
 type vgInfo struct {
@@ -119,24 +159,54 @@ func (lvm *pmemLvm) GetCapacity(ctx context.Context) (capacity Capacity, err err
 	if err != nil {
 		return
 	}
+	pools, err := lvm.getThinPools(ctx)
+	if err != nil {
+		return
+	}
 
 	for _, vg := range vgs {
-		if vg.free > capacity.MaxVolumeSize {
-			capacity.MaxVolumeSize = vg.free / lvmAlign * lvmAlign
+		free := vg.free
+		if pool, ok := pools[vg.name]; ok {
+			// Only the pool can be used for new volumes.
+			free = pool.available(lvm.overcommit)
+			capacity.PhysicalAvailable += pool.size - pool.used()
+			capacity.Provisioned += pool.provisioned
+		} else {
+			capacity.PhysicalAvailable += vg.free
+		}
+		if free > capacity.MaxVolumeSize {
+			capacity.MaxVolumeSize = free / lvmAlign * lvmAlign
 		}
-		capacity.Available += vg.free
+		capacity.Available += free
 		capacity.Managed += vg.size
 		capacity.Total, err = totalSize()
 		if err != nil {
 			return
 		}
 	}
+	for _, device := range lvm.devices {
+		if !pools.isThin(device.VolumeId) {
+			capacity.Provisioned += device.Size
+		}
+	}
 
 	return capacity, nil
 }
 
-func (lvm *pmemLvm) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage) (uint64, error) {
+// getThinPools returns nothing when thin provisioning is disabled.
+func (lvm *pmemLvm) getThinPools(ctx context.Context) (thinPools, error) {
+	if lvm.overcommit == 0 {
+		return nil, nil
+	}
+	return getThinPools(ctx, lvm.volumeGroups)
+}
+
+func (lvm *pmemLvm) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage, sectorSize uint64, numaNodes NUMANodes) (uint64, error) {
 	ctx, logger := pmemlog.WithName(ctx, "LVM-CreateDevice")
+	if sectorSize != 0 {
+		// The volume groups are always on top of fsdax namespaces.
+		return 0, fmt.Errorf("sector size %d: %w", sectorSize, pmemerr.NotSupported)
+	}
 
 	lvmMutex.Lock()
 	defer lvmMutex.Unlock()
@@ -164,14 +234,32 @@ func (lvm *pmemLvm) CreateDevice(ctx context.Context, volumeId string, size uint
 			"alignment", pmemlog.CapacityRef(int64(lvmAlign)))
 	}
 	strSz := strconv.FormatUint(actual, 10) + "B"
+	pools, err := lvm.getThinPools(ctx)
+	if err != nil {
+		return 0, err
+	}
 
 	for _, vg := range vgs {
+		if node, ok := lvm.numaNodes[vg.name]; len(numaNodes) > 0 && (!ok || !numaNodes.Allowed(node)) {
+			logger.V(5).Info("Volume group not on requested NUMA nodes", "vg", vg.name, "numa-nodes", numaNodes)
+			continue
+		}
+		// In some container environments clearing device fails with race condition.
+		// So, we ask lvm not to clear(-Zn) the newly created device, instead we do ourself in later stage.
+		// lvcreate takes size in MBytes if no unit
+		free := vg.free
+		args := []string{"-Zn", "-L", strSz, "-n", volumeId, vg.name}
+		if lvm.overcommit > 0 {
+			pool, ok := pools[vg.name]
+			if !ok {
+				continue
+			}
+			free = pool.available(lvm.overcommit)
+			args = []string{"-V", strSz, "-T", vg.name + "/" + thinPoolName, "-n", volumeId}
+		}
 		// use first Vgroup with enough available space
-		if vg.free >= actual {
-			// In some container environments clearing device fails with race condition.
-			// So, we ask lvm not to clear(-Zn) the newly created device, instead we do ourself in later stage.
-			// lvcreate takes size in MBytes if no unit
-			if _, err := pmemexec.RunCommand(ctx, "lvcreate", "-Zn", "-L", strSz, "-n", volumeId, vg.name); err != nil {
+		if free >= actual {
+			if _, err := runCommand(ctx, "lvcreate", args...); err != nil {
 				logger.V(3).Info("lvcreate failed with error, trying next free region", "error", err)
 			} else {
 				// clear start of device to avoid old data being recognized as file system
@@ -210,6 +298,16 @@ func (lvm *pmemLvm) DeleteDevice(ctx context.Context, volumeId string, flush boo
 		}
 		return err
 	}
+	pools, err := lvm.getThinPools(ctx)
+	if err != nil {
+		return err
+	}
+	if flush && pools.isThin(volumeId) {
+		// Zeroing would allocate all blocks of the volume. Not
+		// necessary either, because the pool zeroes blocks
+		// before giving them to some other volume.
+		flush = false
+	}
 	if err := clearDevice(ctx, device, flush); err != nil {
 		if errors.Is(err, pmemerr.DeviceNotFound) {
 			// Remove device from cache
@@ -219,7 +317,11 @@ func (lvm *pmemLvm) DeleteDevice(ctx context.Context, volumeId string, flush boo
 		return err
 	}
 
-	if _, err := pmemexec.RunCommand(ctx, "lvremove", "-fy", device.Path); err != nil {
+	if _, ok := lvm.stripes[volumeId]; ok {
+		if err := lvm.deleteStripes(ctx, volumeId); err != nil {
+			return err
+		}
+	} else if _, err := runCommand(ctx, "lvremove", "-fy", device.Path); err != nil {
 		return err
 	}
 
@@ -229,6 +331,93 @@ func (lvm *pmemLvm) DeleteDevice(ctx context.Context, volumeId string, flush boo
 	return nil
 }
 
+func (lvm *pmemLvm) ResizeDevice(ctx context.Context, volumeId string, size uint64) (uint64, error) {
+	ctx, logger := pmemlog.WithName(ctx, "LVM-ResizeDevice")
+
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	device, err := lvm.getDevice(volumeId)
+	if err != nil {
+		return 0, err
+	}
+	actual := (size + lvmAlign - 1) / lvmAlign * lvmAlign
+	if actual <= device.Size {
+		return device.Size, nil
+	}
+	if _, ok := lvm.stripes[volumeId]; ok {
+		return 0, fmt.Errorf("resize striped volume: %w", pmemerr.NotSupported)
+	}
+	vgs, err := getVolumeGroups(ctx, lvm.volumeGroups)
+	if err != nil {
+		return 0, err
+	}
+	pools, err := lvm.getThinPools(ctx)
+	if err != nil {
+		return 0, err
+	}
+	// A logical volume can only grow inside its own volume group.
+	for _, vg := range vgs {
+		if !strings.HasPrefix(device.Path, "/dev/"+vg.name+"/") {
+			continue
+		}
+		free := vg.free
+		if pool, ok := pools[vg.name]; ok && pool.volumes[volumeId] {
+			free = pool.available(lvm.overcommit)
+		}
+		if free < actual-device.Size {
+			return 0, pmemerr.NotEnoughSpace
+		}
+		logger.V(3).Info("Extending logical volume",
+			"old-size", pmemlog.CapacityRef(int64(device.Size)),
+			"new-size", pmemlog.CapacityRef(int64(actual)))
+		if _, err := runCommand(ctx, "lvextend", "-L", strconv.FormatUint(actual, 10)+"B", device.Path); err != nil {
+			return 0, err
+		}
+		device, err := getUncachedDevice(ctx, volumeId, vg.name)
+		if err != nil {
+			return 0, err
+		}
+		lvm.devices[device.VolumeId] = device
+		return device.Size, nil
+	}
+	return 0, fmt.Errorf("volume group of %s not found", device.Path)
+}
+
+func (lvm *pmemLvm) RenameDevice(ctx context.Context, volumeId, newName string) error {
+	ctx, _ = pmemlog.WithName(ctx, "LVM-RenameDevice")
+
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	device, err := lvm.getDevice(volumeId)
+	if err != nil {
+		return err
+	}
+	if _, err := lvm.getDevice(newName); err == nil {
+		return pmemerr.DeviceExists
+	}
+	if _, ok := lvm.stripes[volumeId]; ok {
+		return lvm.renameStripes(ctx, volumeId, newName)
+	}
+	for _, vg := range lvm.volumeGroups {
+		if !strings.HasPrefix(device.Path, "/dev/"+vg+"/") {
+			continue
+		}
+		if _, err := runCommand(ctx, "lvrename", vg, volumeId, newName); err != nil {
+			return err
+		}
+		delete(lvm.devices, volumeId)
+		device, err := getUncachedDevice(ctx, newName, vg)
+		if err != nil {
+			return err
+		}
+		lvm.devices[newName] = device
+		return nil
+	}
+	return fmt.Errorf("volume group of %s not found", device.Path)
+}
+
 func (lvm *pmemLvm) ListDevices(ctx context.Context) ([]*PmemDeviceInfo, error) {
 	lvmMutex.Lock()
 	defer lvmMutex.Unlock()
@@ -241,6 +430,19 @@ func (lvm *pmemLvm) ListDevices(ctx context.Context) ([]*PmemDeviceInfo, error)
 	return devices, nil
 }
 
+func (lvm *pmemLvm) GetNUMANodes(ctx context.Context) (NUMANodes, error) {
+	seen := map[int]bool{}
+	var nodes NUMANodes
+	for _, node := range lvm.numaNodes {
+		if !seen[node] {
+			seen[node] = true
+			nodes = append(nodes, node)
+		}
+	}
+	sort.Ints(nodes)
+	return nodes, nil
+}
+
 func (lvm *pmemLvm) GetDevice(ctx context.Context, volumeId string) (*PmemDeviceInfo, error) {
 	lvmMutex.Lock()
 	defer lvmMutex.Unlock()
@@ -272,7 +474,7 @@ func getUncachedDevice(ctx context.Context, volumeId string, volumeGroup string)
 // listDevices Lists available logical devices in given volume groups
 func listDevices(ctx context.Context, volumeGroups ...string) (map[string]*PmemDeviceInfo, error) {
 	args := append(lvsArgs, volumeGroups...)
-	output, err := pmemexec.RunCommand(ctx, "lvs", args...)
+	output, err := runCommand(ctx, "lvs", args...)
 	if err != nil {
 		return nil, fmt.Errorf("lvs failure : %v", err)
 	}
@@ -289,10 +491,15 @@ func parseLVSOutput(output string) (map[string]*PmemDeviceInfo, error) {
 			continue
 		}
 
+		if fields[0] == thinPoolName {
+			continue
+		}
+
 		dev := &PmemDeviceInfo{}
 		dev.VolumeId = fields[0]
 		dev.Path = fields[1]
 		dev.Size, _ = strconv.ParseUint(fields[2], 10, 64)
+		dev.AllocatedSize = dev.Size
 
 		devices[dev.VolumeId] = dev
 	}
@@ -305,7 +512,7 @@ func getVolumeGroups(ctx context.Context, groups []string) ([]vgInfo, error) {
 
 	vgs := []vgInfo{}
 	args := append(vgsArgs, groups...)
-	output, err := pmemexec.RunCommand(ctx, "vgs", args...)
+	output, err := runCommand(ctx, "vgs", args...)
 	if err != nil {
 		return vgs, fmt.Errorf("vgs failure: %v", err)
 	}
@@ -380,7 +587,7 @@ func setupNS(ctx context.Context, r ndctl.Region, percentage uint) error {
 		// duplicate volume groups when accidentally restoring a namespace that existed
 		// before and was used in a volume group. This is not idempotent, but hopefully
 		// it'll never fail or if it does, can be skipped when the driver tries again.
-		if _, err := pmemexec.RunCommand(ctx, "wipefs", "--all", "--force", "/dev/"+ns.BlockDeviceName()); err != nil {
+		if _, err := runCommand(ctx, "wipefs", "--all", "--force", "/dev/"+ns.BlockDeviceName()); err != nil {
 			return fmt.Errorf("failed to wipe new namespace: %v", err)
 		}
 	}
@@ -420,7 +627,7 @@ func setupVGForNamespaces(ctx context.Context, vgName string, devNames ...string
 	for _, devName := range devNames {
 		// check if this pv is already part of a group, if yes ignore
 		// this pv if not add to arg list
-		output, err := pmemexec.RunCommand(ctx, "pvs", "--noheadings", "-o", "vg_name", devName)
+		output, err := runCommand(ctx, "pvs", "--noheadings", "-o", "vg_name", devName)
 		output = strings.TrimSpace(output)
 		if err != nil || len(output) == 0 {
 			unusedDevNames = append(unusedDevNames, devName)
@@ -434,7 +641,7 @@ func setupVGForNamespaces(ctx context.Context, vgName string, devNames ...string
 	}
 
 	cmd := ""
-	if _, err := pmemexec.RunCommand(ctx, "vgdisplay", vgName); err != nil {
+	if _, err := runCommand(ctx, "vgdisplay", vgName); err != nil {
 		logger.V(3).Info("Creating new volume group", "vg", vgName)
 		cmd = "vgcreate"
 	} else {
@@ -444,7 +651,7 @@ func setupVGForNamespaces(ctx context.Context, vgName string, devNames ...string
 
 	cmdArgs := []string{"--force", vgName}
 	cmdArgs = append(cmdArgs, unusedDevNames...)
-	_, err := pmemexec.RunCommand(ctx, cmd, cmdArgs...) //nolint gosec
+	_, err := runCommand(ctx, cmd, cmdArgs...) //nolint gosec
 	if err != nil {
 		return fmt.Errorf("failed to create/extend volume group '%s': %v", vgName, err)
 	}
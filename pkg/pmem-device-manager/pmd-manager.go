@@ -21,13 +21,19 @@ type PmemDeviceInfo struct {
 	// and NodePublishVolume.
 	VolumeId string
 
-	// Path is the actual device path (for example, /dev/pmem0.1).
+	// Path is the actual device path (for example, /dev/pmem0.1
+	// or /dev/dax0.1 for a character device in devdax mode).
 	// As a special case, if the path starts with FakeDevicePathPrefix,
 	// then the volume doesn't have a backing store.
 	Path string
 
 	// Size allocated for block device in bytes.
 	Size uint64
+
+	// AllocatedSize is the amount of PMEM used for the device,
+	// as returned by CreateDevice and ResizeDevice. It can be
+	// larger than Size because of metadata.
+	AllocatedSize uint64
 }
 
 // Capacity contains information about PMEM. All sizes count bytes.
@@ -37,8 +43,14 @@ type Capacity struct {
 	// fragmentation.
 	MaxVolumeSize uint64
 	// Available is the sum of all PMEM that could be used for
-	// volumes.
+	// volumes. With thin provisioning, this is based on the
+	// provisioned sizes of the volumes and can be larger than
+	// PhysicalAvailable.
 	Available uint64
+	// PhysicalAvailable is the PMEM which is not used yet.
+	PhysicalAvailable uint64
+	// Provisioned is the sum of the sizes of all volumes.
+	Provisioned uint64
 	// Managed is all PMEM that is managed by the driver.
 	Managed uint64
 	// Total is all PMEM found by the driver.
@@ -50,9 +62,11 @@ func (c Capacity) GetCapacity(ctx context.Context) (Capacity, error) {
 }
 
 func (c Capacity) String() string {
-	return fmt.Sprintf("%s maximum volume size, %s available, %s managed, %s total",
+	return fmt.Sprintf("%s maximum volume size, %s available, %s physically available, %s provisioned, %s managed, %s total",
 		prettyPrintSize(c.MaxVolumeSize),
 		prettyPrintSize(c.Available),
+		prettyPrintSize(c.PhysicalAvailable),
+		prettyPrintSize(c.Provisioned),
 		prettyPrintSize(c.Managed),
 		prettyPrintSize(c.Total),
 	)
@@ -79,9 +93,11 @@ type PmemDeviceManager interface {
 	GetMode() api.DeviceMode
 
 	// CreateDevice creates a new block device with give name, size and namespace mode.
+	// A non-zero sector size selects the sector size of namespaces in sector mode.
 	// It returns the actual volume size which will always be at least as large as requested.
-	// Possible errors: ErrNotEnoughSpace, ErrDeviceExists
-	CreateDevice(ctx context.Context, name string, size uint64, usage parameters.Usage) (uint64, error)
+	// Non-empty NUMA nodes restrict the PMEM that may be used.
+	// Possible errors: ErrNotEnoughSpace, ErrDeviceExists, ErrNotSupported
+	CreateDevice(ctx context.Context, name string, size uint64, usage parameters.Usage, sectorSize uint64, numaNodes NUMANodes) (uint64, error)
 
 	// GetDevice returns the block device information for given name
 	// Possible errors: ErrDeviceNotFound
@@ -92,20 +108,87 @@ type PmemDeviceManager interface {
 	// Possible errors: ErrDeviceInUse
 	DeleteDevice(ctx context.Context, name string, flush bool) error
 
+	// ResizeDevice grows an existing block device. It returns the actual
+	// size, which will always be at least as large as requested.
+	// Possible errors: ErrDeviceNotFound, ErrNotEnoughSpace, ErrNotSupported
+	ResizeDevice(ctx context.Context, name string, size uint64) (uint64, error)
+
+	// RenameDevice gives an existing block device a new name without
+	// touching its content.
+	// Possible errors: ErrDeviceNotFound, ErrDeviceExists, ErrNotSupported
+	RenameDevice(ctx context.Context, name, newName string) error
+
 	// ListDevices returns all the block devices information that was created by this device manager
 	ListDevices(ctx context.Context) ([]*PmemDeviceInfo, error)
+
+	// GetNUMANodes returns the sorted NUMA nodes of the PMEM that is
+	// used for devices. Empty if unknown.
+	GetNUMANodes(ctx context.Context) (NUMANodes, error)
+}
+
+// Unwrap returns the device manager which is wrapped by dm, for
+// example by NewSimulation, or nil if dm does not wrap another one.
+func Unwrap(dm PmemDeviceManager) PmemDeviceManager {
+	if u, ok := dm.(interface{ Unwrap() PmemDeviceManager }); ok {
+		return u.Unwrap()
+	}
+	return nil
+}
+
+// As returns the first device manager in the chain of wrapped device
+// managers which implements the optional interface T, like ThinPools
+// or StripedDevices. Wrappers which need to intercept the methods of
+// such an interface must implement it themselves.
+func As[T any](dm PmemDeviceManager) (T, bool) {
+	for dm != nil {
+		if t, ok := dm.(T); ok {
+			return t, true
+		}
+		dm = Unwrap(dm)
+	}
+	var t T
+	return t, false
+}
+
+// Options influence how device managers get created by New. The same
+// options must be used for all device managers of a driver instance
+// because they share the PMEM of the node.
+type Options struct {
+	// ReadOnly device managers neither prepare PMEM while
+	// starting (no namespaces, volume groups or thin pools get
+	// created) nor modify devices later. Everything which only
+	// reads works as usual.
+	ReadOnly bool
+
+	// ThinProvisioning is used by LVM mode.
+	ThinProvisioning ThinProvisioning
+
+	// Regions restricts which regions get used. It applies to
+	// all device modes because regions are owned by the driver
+	// regardless of the device mode of the volumes in them.
+	Regions RegionSelection
+}
+
+// New creates a new device manager for the given mode and percentage,
+// using the factory registered for the mode.
+func New(ctx context.Context, mode api.DeviceMode, pmemPercentage uint, opts Options) (PmemDeviceManager, error) {
+	dm, err := newDeviceManager(ctx, mode, pmemPercentage, opts)
+	if err != nil {
+		return nil, err
+	}
+	dm = instrumentedDM{PmemDeviceManager: dm, mode: mode}
+	if opts.ReadOnly {
+		return readOnlyDM{dm}, nil
+	}
+	return dm, nil
 }
 
-// New creates a new device manager for the given mode and percentage.
-func New(ctx context.Context, mode api.DeviceMode, pmemPercentage uint) (PmemDeviceManager, error) {
-	switch mode {
-	case api.DeviceModeFake:
-		return newFake(pmemPercentage)
-	case api.DeviceModeLVM:
-		return newPmemDeviceManagerLVM(ctx, pmemPercentage)
-	case api.DeviceModeDirect:
-		return newPmemDeviceManagerNdctl(ctx, pmemPercentage)
-	default:
+func newDeviceManager(ctx context.Context, mode api.DeviceMode, pmemPercentage uint, opts Options) (PmemDeviceManager, error) {
+	factoriesMutex.RLock()
+	factory, ok := factories[mode]
+	factoriesMutex.RUnlock()
+	if !ok {
 		return nil, fmt.Errorf("unsupported device mode %q", mode)
 	}
+	return factory(ctx, pmemPercentage, opts)
 }
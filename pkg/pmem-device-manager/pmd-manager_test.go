@@ -63,9 +63,9 @@ func runTests(mode string) {
 			vg, err = createTestVGS(vgname, vgsize)
 			Expect(err).Should(BeNil(), "Failed to create volume group")
 
-			dm, err = newPmemDeviceManagerLVMForVGs(ctx, []string{vg.name})
+			dm, err = newPmemDeviceManagerLVMForVGs(ctx, []string{vg.name}, false)
 		} else {
-			dm, err = newPmemDeviceManagerNdctl(ctx, 100)
+			dm, err = newPmemDeviceManagerNdctl(ctx, 100, false, Options{})
 			if err != nil && strings.Contains(err.Error(), "/sys mounted read-only") {
 				Skip("/sys mounted read-only, cannot test direct mode")
 			}
@@ -91,7 +91,7 @@ func runTests(mode string) {
 	It("Should create a new device", func() {
 		name := "test-dev-new"
 		size := uint64(2) * 1024 * 1024 // 2Mb
-		actual, err := dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect)
+		actual, err := dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect, 0, nil)
 		Expect(err).Should(BeNil(), "Failed to create new device")
 		Expect(actual).Should(BeNumerically(">=", size), "device at least as large as requested")
 
@@ -107,7 +107,7 @@ func runTests(mode string) {
 	It("Should support recreating a device", func() {
 		name := "test-dev"
 		size := uint64(2) * 1024 * 1024 // 2Mb
-		actual, err := dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect)
+		actual, err := dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect, 0, nil)
 		Expect(err).Should(BeNil(), "Failed to create new device")
 		Expect(actual).Should(BeNumerically(">=", size), "device at least as large as requested")
 
@@ -123,7 +123,7 @@ func runTests(mode string) {
 		Expect(err).Should(BeNil(), "Failed to delete device")
 		cleanupList[name] = false
 
-		actual, err = dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect)
+		actual, err = dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect, 0, nil)
 		Expect(err).Should(BeNil(), "Failed to recreate the same device")
 		Expect(actual).Should(BeNumerically(">=", size), "device at least as large as requested")
 		cleanupList[name] = true
@@ -152,7 +152,7 @@ func runTests(mode string) {
 		for i := 1; i <= max_devices; i++ {
 			name := fmt.Sprintf("list-dev-%d", i)
 			sizes[name] = uint64(rand.Intn(15)+1) * 1024 * 1024
-			actual, err := dm.CreateDevice(ctx, name, sizes[name], parameters.UsageAppDirect)
+			actual, err := dm.CreateDevice(ctx, name, sizes[name], parameters.UsageAppDirect, 0, nil)
 			Expect(err).Should(BeNil(), "Failed to create new device")
 			Expect(actual).Should(BeNumerically(">=", sizes[name]), "device at least as large as requested")
 			cleanupList[name] = true
@@ -196,7 +196,7 @@ func runTests(mode string) {
 	It("Should delete devices", func() {
 		name := "delete-dev"
 		size := uint64(2) * 1024 * 1024 // 2Mb
-		actual, err := dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect)
+		actual, err := dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect, 0, nil)
 		Expect(err).Should(BeNil(), "Failed to create new device")
 		Expect(actual).Should(BeNumerically(">=", size), "device at least as large as requested")
 		cleanupList[name] = true
@@ -236,6 +236,34 @@ func runTests(mode string) {
 		err = dm.DeleteDevice(ctx, name, true)
 		Expect(err).Should(BeNil(), "DeleteDevice() is not idempotent")
 	})
+
+	It("Should rename devices", func() {
+		name := "rename-dev"
+		newName := "renamed-dev"
+		size := uint64(2) * 1024 * 1024 // 2Mb
+		_, err := dm.CreateDevice(ctx, name, size, parameters.UsageAppDirect, 0, nil)
+		Expect(err).Should(BeNil(), "Failed to create new device")
+		cleanupList[name] = true
+
+		err = dm.RenameDevice(ctx, name, newName)
+		if mode == ModeDirect {
+			Expect(errors.Is(err, pmemerr.NotSupported)).Should(BeTrue(), "expected error is NotSupported: %v", err)
+			return
+		}
+		Expect(err).Should(BeNil(), "Failed to rename device")
+		cleanupList[name] = false
+		cleanupList[newName] = true
+
+		dev, err := dm.GetDevice(ctx, newName)
+		Expect(err).Should(BeNil(), "Failed to retrieve renamed device info")
+		Expect(dev.VolumeId).Should(Equal(newName), "Name mismatch")
+		Expect(dev.Size).Should(BeNumerically(">=", size), "Size mismatch")
+		_, err = dm.GetDevice(ctx, name)
+		Expect(errors.Is(err, pmemerr.DeviceNotFound)).Should(BeTrue(), "old name should be gone: %v", err)
+
+		err = dm.RenameDevice(ctx, name, newName)
+		Expect(errors.Is(err, pmemerr.DeviceNotFound)).Should(BeTrue(), "expected error is DeviceNotFound: %v", err)
+	})
 }
 
 func precheck() {
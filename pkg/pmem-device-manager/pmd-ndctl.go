@@ -15,11 +15,17 @@ import (
 	"github.com/intel/pmem-csi/pkg/ndctl"
 	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
 
-	"k8s.io/utils/mount"
+	"k8s.io/mount-utils"
 )
 
 type pmemNdctl struct {
 	pmemPercentage uint
+	// devdax selects namespaces in devdax mode instead of
+	// fsdax or sector mode.
+	devdax bool
+	// regions restricts where namespaces get created and which
+	// ones are listed.
+	regions RegionSelection
 }
 
 var _ PmemDeviceManager = &pmemNdctl{}
@@ -32,7 +38,7 @@ var ndctlMutex = &sync.Mutex{}
 
 // NewPmemDeviceManagerNdctl Instantiates a new ndctl based pmem device manager
 // FIXME(avalluri): consider pmemPercentage while calculating available space
-func newPmemDeviceManagerNdctl(ctx context.Context, pmemPercentage uint) (PmemDeviceManager, error) {
+func newPmemDeviceManagerNdctl(ctx context.Context, pmemPercentage uint, devdax bool, opts Options) (PmemDeviceManager, error) {
 	ctx, _ = pmemlog.WithName(ctx, "ndctl-New")
 	if pmemPercentage > 100 {
 		return nil, fmt.Errorf("invalid pmemPercentage '%d'. Value must be 0..100", pmemPercentage)
@@ -43,7 +49,8 @@ func newPmemDeviceManagerNdctl(ctx context.Context, pmemPercentage uint) (PmemDe
 		return nil, fmt.Errorf("check for writable /sys: %v", err)
 	}
 
-	if !writable {
+	// Reading works with a read-only /sys.
+	if !writable && !opts.ReadOnly {
 		// If /host-sys exists, then bind mount it to /sys.  This is a
 		// workaround for /sys being read-only on OpenShift 4.5
 		// (https://github.com/intel/pmem-csi/issues/786 =
@@ -71,7 +78,7 @@ func newPmemDeviceManagerNdctl(ctx context.Context, pmemPercentage uint) (PmemDe
 		}
 	}
 
-	return &pmemNdctl{pmemPercentage: pmemPercentage}, nil
+	return &pmemNdctl{pmemPercentage: pmemPercentage, devdax: devdax, regions: opts.Regions}, nil
 }
 
 // sysIsWritable returns true if any of the /sys mounts is writable.
@@ -99,6 +106,9 @@ func sysIsWritable(ctx context.Context) (bool, error) {
 }
 
 func (pmem *pmemNdctl) GetMode() api.DeviceMode {
+	if pmem.devdax {
+		return api.DeviceModeDevdax
+	}
 	return api.DeviceModeDirect
 }
 
@@ -118,7 +128,7 @@ func (pmem *pmemNdctl) GetCapacity(ctx context.Context) (capacity Capacity, err
 		for _, r := range bus.AllRegions() {
 			capacity.Total += r.Size()
 			// TODO: check type?!
-			if !r.Enabled() {
+			if !r.Enabled() || !pmem.regions.Selected(r.DeviceName()) {
 				continue
 			}
 
@@ -138,6 +148,8 @@ func (pmem *pmemNdctl) GetCapacity(ctx context.Context) (capacity Capacity, err
 				capacity.MaxVolumeSize = maxVolumeSize
 			}
 			capacity.Available += available / align * align
+			capacity.PhysicalAvailable += available / align * align
+			capacity.Provisioned += size - available
 			capacity.Managed += size
 		}
 	}
@@ -146,7 +158,7 @@ func (pmem *pmemNdctl) GetCapacity(ctx context.Context) (capacity Capacity, err
 	return capacity, nil
 }
 
-func (pmem *pmemNdctl) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage) (uint64, error) {
+func (pmem *pmemNdctl) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage, sectorSize uint64, numaNodes NUMANodes) (uint64, error) {
 	ctx, _ = pmemlog.WithName(ctx, "ndctl-CreateDevice")
 	ndctlMutex.Lock()
 	defer ndctlMutex.Unlock()
@@ -162,31 +174,39 @@ func (pmem *pmemNdctl) CreateDevice(ctx context.Context, volumeId string, size u
 	// this function is asked to create new devices repeatedly, forcing running out of space.
 	// Avoid device filling with garbage entries by returning error.
 	// Overall, no point having more than one namespace with same name.
-	if _, err := getDevice(ndctx, volumeId); err == nil {
+	if _, err := ndctl.GetNamespaceByName(ndctx, volumeId); err == nil {
 		return 0, pmemerr.DeviceExists
 	}
 
 	opts := ndctl.CreateNamespaceOpts{
-		Name: volumeId,
-		Size: size,
+		Name:       volumeId,
+		Size:       size,
+		SectorSize: sectorSize,
 	}
-	switch usage {
-	case parameters.UsageAppDirect:
+	switch {
+	case pmem.devdax && usage == parameters.UsageAppDirect:
+		opts.Mode = ndctl.DaxMode
+	case pmem.devdax:
+		return 0, fmt.Errorf("unsupported usage %s for devdax mode", usage)
+	case usage == parameters.UsageAppDirect:
 		opts.Mode = ndctl.FsdaxMode
-	case parameters.UsageFileIO:
+	case usage == parameters.UsageFileIO:
 		opts.Mode = ndctl.SectorMode
 	default:
 		return 0, fmt.Errorf("unsupported usage %s for direct mode", usage)
 	}
+	if sectorSize != 0 && opts.Mode != ndctl.SectorMode {
+		return 0, fmt.Errorf("sector size %d for namespace mode %s: %w", sectorSize, opts.Mode, pmemerr.NotSupported)
+	}
 
-	ns, err := ndctl.CreateNamespace(ctx, ndctx, opts)
+	ns, err := pmem.createNamespace(ctx, ndctx, opts, numaNodes)
 	if err != nil {
 		return 0, err
 	}
 	actual := ns.RawSize()
 
 	// clear start of device to avoid old data being recognized as file system
-	device, err := getDevice(ndctx, volumeId)
+	device, err := pmem.getDevice(ndctx, volumeId)
 	if err != nil {
 		return 0, err
 	}
@@ -208,7 +228,7 @@ func (pmem *pmemNdctl) DeleteDevice(ctx context.Context, volumeId string, flush
 	}
 	defer ndctx.Free()
 
-	device, err := getDevice(ndctx, volumeId)
+	device, err := pmem.getDevice(ndctx, volumeId)
 	if err != nil {
 		if errors.Is(err, pmemerr.DeviceNotFound) {
 			return nil
@@ -221,7 +241,9 @@ func (pmem *pmemNdctl) DeleteDevice(ctx context.Context, volumeId string, flush
 		}
 		return err
 	}
-	return ndctl.DestroyNamespaceByName(ndctx, volumeId)
+	return timeNdctl(ctx, "destroy-namespace", func() error {
+		return ndctl.DestroyNamespaceByName(ndctx, volumeId)
+	})
 }
 
 func (pmem *pmemNdctl) GetDevice(ctx context.Context, volumeId string) (*PmemDeviceInfo, error) {
@@ -234,7 +256,19 @@ func (pmem *pmemNdctl) GetDevice(ctx context.Context, volumeId string) (*PmemDev
 	}
 	defer ndctx.Free()
 
-	return getDevice(ndctx, volumeId)
+	return pmem.getDevice(ndctx, volumeId)
+}
+
+func (pmem *pmemNdctl) ResizeDevice(ctx context.Context, volumeId string, size uint64) (uint64, error) {
+	// Namespaces cannot be resized while they are in use and
+	// growing one may need space which is not adjacent.
+	return 0, fmt.Errorf("resize namespace %q: %w", volumeId, pmemerr.NotSupported)
+}
+
+func (pmem *pmemNdctl) RenameDevice(ctx context.Context, volumeId, newName string) error {
+	// The kernel only allows changing the name of a namespace
+	// which is not claimed by fsdax or devdax.
+	return fmt.Errorf("rename namespace %q: %w", volumeId, pmemerr.NotSupported)
 }
 
 func (pmem *pmemNdctl) ListDevices(ctx context.Context) ([]*PmemDeviceInfo, error) {
@@ -249,25 +283,79 @@ func (pmem *pmemNdctl) ListDevices(ctx context.Context) ([]*PmemDeviceInfo, erro
 
 	devices := []*PmemDeviceInfo{}
 	for _, ns := range ndctl.GetAllNamespaces(ndctx) {
+		// Direct and devdax mode share the same regions, each
+		// one only lists its own namespaces.
+		if (ns.Mode() == ndctl.DaxMode) != pmem.devdax ||
+			!pmem.regions.Selected(ns.Region().DeviceName()) {
+			continue
+		}
 		devices = append(devices, namespaceToPmemInfo(ns))
 	}
 	return devices, nil
 }
 
-func getDevice(ndctx ndctl.Context, volumeId string) (*PmemDeviceInfo, error) {
+func (pmem *pmemNdctl) getDevice(ndctx ndctl.Context, volumeId string) (*PmemDeviceInfo, error) {
 	ns, err := ndctl.GetNamespaceByName(ndctx, volumeId)
 	if err != nil {
 		return nil, fmt.Errorf("error getting device %q: %w", volumeId, err)
 	}
+	if (ns.Mode() == ndctl.DaxMode) != pmem.devdax {
+		return nil, fmt.Errorf("namespace %q has mode %s: %w", volumeId, ns.Mode(), pmemerr.DeviceNotFound)
+	}
+	if region := ns.Region().DeviceName(); !pmem.regions.Selected(region) {
+		return nil, fmt.Errorf("namespace %q is in region %s, which is not selected: %w", volumeId, region, pmemerr.DeviceNotFound)
+	}
 
 	return namespaceToPmemInfo(ns), nil
 }
 
+// createNamespace does the same as ndctl.CreateNamespace, just
+// limited to the selected regions.
+func (pmem *pmemNdctl) createNamespace(ctx context.Context, ndctx ndctl.Context, opts ndctl.CreateNamespaceOpts, numaNodes NUMANodes) (ndctl.Namespace, error) {
+	err := fmt.Errorf("no active region selected: %w", pmemerr.NotEnoughSpace)
+	for _, bus := range ndctx.GetBuses() {
+		for _, r := range bus.ActiveRegions() {
+			if !pmem.regions.Selected(r.DeviceName()) {
+				continue
+			}
+			if len(numaNodes) > 0 && !numaNodes.Allowed(r.NumaNode()) {
+				continue
+			}
+			var ns ndctl.Namespace
+			err = timeNdctl(ctx, "create-namespace", func() (err error) {
+				ns, err = r.CreateNamespace(ctx, opts)
+				return
+			})
+			if err == nil {
+				return ns, nil
+			}
+		}
+	}
+	return nil, err
+}
+
+func (pmem *pmemNdctl) GetNUMANodes(ctx context.Context) (NUMANodes, error) {
+	ndctlMutex.Lock()
+	defer ndctlMutex.Unlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return nil, err
+	}
+	defer ndctx.Free()
+	return regionNUMANodes(ndctx, pmem.regions), nil
+}
+
 func namespaceToPmemInfo(ns ndctl.Namespace) *PmemDeviceInfo {
+	path := "/dev/" + ns.BlockDeviceName()
+	if ns.Mode() == ndctl.DaxMode {
+		path = "/dev/" + ns.CharDeviceName()
+	}
 	return &PmemDeviceInfo{
-		VolumeId: ns.Name(),
-		Path:     "/dev/" + ns.BlockDeviceName(),
-		Size:     ns.Size(),
+		VolumeId:      ns.Name(),
+		Path:          path,
+		Size:          ns.Size(),
+		AllocatedSize: ns.RawSize(),
 	}
 }
 
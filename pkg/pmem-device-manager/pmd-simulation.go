@@ -0,0 +1,152 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+
+	"k8s.io/klog/v2"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// Simulation describes artificial limits that get applied on top of
+// the real PMEM. It is meant for failure injection exercises and
+// must not be used otherwise.
+type Simulation struct {
+	// MaxCapacity, if non-zero, limits the amount of PMEM that
+	// is managed by the driver. Volumes which would exceed that
+	// limit cannot be created.
+	MaxCapacity uint64
+
+	// CreateFailurePercentage is the percentage of CreateDevice
+	// calls which fail as if the node had run out of space.
+	CreateFailurePercentage uint
+}
+
+// Enabled returns true if the simulation changes the behavior of a
+// device manager.
+func (s Simulation) Enabled() bool {
+	return s.MaxCapacity > 0 || s.CreateFailurePercentage > 0
+}
+
+type simulatedDM struct {
+	PmemDeviceManager
+	sim Simulation
+}
+
+var _ PmemDeviceManager = &simulatedDM{}
+var _ StripedDevices = &simulatedDM{}
+
+// NewSimulation wraps a device manager such that it behaves
+// according to the simulation settings.
+func NewSimulation(dm PmemDeviceManager, sim Simulation) (PmemDeviceManager, error) {
+	if sim.CreateFailurePercentage > 100 {
+		return nil, fmt.Errorf("invalid create failure percentage %d. Value must be 0..100", sim.CreateFailurePercentage)
+	}
+	return &simulatedDM{
+		PmemDeviceManager: dm,
+		sim:               sim,
+	}, nil
+}
+
+// Unwrap returns the real device manager. Optional interfaces other
+// than StripedDevices are not affected by the simulation.
+func (dm *simulatedDM) Unwrap() PmemDeviceManager {
+	return dm.PmemDeviceManager
+}
+
+func (dm *simulatedDM) GetCapacity(ctx context.Context) (Capacity, error) {
+	capacity, err := dm.PmemDeviceManager.GetCapacity(ctx)
+	if err != nil {
+		return capacity, err
+	}
+	return dm.limit(capacity), nil
+}
+
+func (dm *simulatedDM) limit(capacity Capacity) Capacity {
+	if dm.sim.MaxCapacity == 0 || capacity.Managed <= dm.sim.MaxCapacity {
+		return capacity
+	}
+	// With thin provisioning, Available may be larger than Managed.
+	used := capacity.Managed - capacity.PhysicalAvailable
+	capacity.Managed = dm.sim.MaxCapacity
+	if used >= capacity.Managed {
+		capacity.Available = 0
+		capacity.PhysicalAvailable = 0
+	} else {
+		if capacity.Managed-used < capacity.Available {
+			capacity.Available = capacity.Managed - used
+		}
+		if capacity.Managed-used < capacity.PhysicalAvailable {
+			capacity.PhysicalAvailable = capacity.Managed - used
+		}
+	}
+	if capacity.MaxVolumeSize > capacity.Available {
+		capacity.MaxVolumeSize = capacity.Available
+	}
+	return capacity
+}
+
+func (dm *simulatedDM) ResizeDevice(ctx context.Context, volumeId string, size uint64) (uint64, error) {
+	if dm.sim.MaxCapacity > 0 {
+		device, err := dm.GetDevice(ctx, volumeId)
+		if err != nil {
+			return 0, err
+		}
+		capacity, err := dm.GetCapacity(ctx)
+		if err != nil {
+			return 0, err
+		}
+		if size > device.Size && size-device.Size > capacity.Available {
+			return 0, fmt.Errorf("simulated capacity %s: %w", capacity, pmemerr.NotEnoughSpace)
+		}
+	}
+	return dm.PmemDeviceManager.ResizeDevice(ctx, volumeId, size)
+}
+
+func (dm *simulatedDM) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage, sectorSize uint64, numaNodes NUMANodes) (uint64, error) {
+	if err := dm.simulateCreate(ctx, volumeId, size); err != nil {
+		return 0, err
+	}
+	return dm.PmemDeviceManager.CreateDevice(ctx, volumeId, size, usage, sectorSize, numaNodes)
+}
+
+func (dm *simulatedDM) CreateStripedDevice(ctx context.Context, volumeId string, size uint64, stripes int, numaNodes NUMANodes) (uint64, error) {
+	sd, ok := As[StripedDevices](dm.PmemDeviceManager)
+	if !ok {
+		return 0, fmt.Errorf("device mode %q cannot stripe volumes: %w", dm.GetMode(), pmemerr.NotSupported)
+	}
+	if err := dm.simulateCreate(ctx, volumeId, size); err != nil {
+		return 0, err
+	}
+	return sd.CreateStripedDevice(ctx, volumeId, size, stripes, numaNodes)
+}
+
+// simulateCreate returns an error if creating a device should fail.
+func (dm *simulatedDM) simulateCreate(ctx context.Context, volumeId string, size uint64) error {
+	logger := klog.FromContext(ctx).WithName("simulation")
+	if dm.sim.CreateFailurePercentage > 0 &&
+		uint(rand.Intn(100)) < dm.sim.CreateFailurePercentage {
+		logger.V(3).Info("Injecting failure", "volume-id", volumeId)
+		return fmt.Errorf("simulated failure: %w", pmemerr.NotEnoughSpace)
+	}
+	if dm.sim.MaxCapacity > 0 {
+		capacity, err := dm.GetCapacity(ctx)
+		if err != nil {
+			return err
+		}
+		if size > capacity.MaxVolumeSize {
+			logger.V(3).Info("Volume exceeds simulated capacity", "volume-id", volumeId, "capacity", capacity)
+			return fmt.Errorf("simulated capacity %s: %w", capacity, pmemerr.NotEnoughSpace)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+type thinPoolsDM struct {
+	PmemDeviceManager
+}
+
+func (thinPoolsDM) GetThinPoolUsage(ctx context.Context) (map[string]float64, error) {
+	return nil, nil
+}
+
+func (thinPoolsDM) IsThinDevice(ctx context.Context, name string) (bool, error) {
+	return false, nil
+}
+
+func TestSimulation(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	const gig = 1024 * 1024 * 1024
+
+	t.Run("max-capacity", func(t *testing.T) {
+		fake, err := newFake(100)
+		require.NoError(t, err, "create fake device manager")
+		dm, err := NewSimulation(fake, Simulation{MaxCapacity: 10 * gig})
+		require.NoError(t, err, "create simulation")
+
+		capacity, err := dm.GetCapacity(ctx)
+		require.NoError(t, err, "get capacity")
+		assert.Equal(t, uint64(10*gig), capacity.Managed, "managed")
+		assert.Equal(t, uint64(10*gig), capacity.Available, "available")
+		assert.Equal(t, uint64(10*gig), capacity.MaxVolumeSize, "max volume size")
+
+		_, err = dm.CreateDevice(ctx, "vol-1", 8*gig, parameters.UsageAppDirect, 0, nil)
+		require.NoError(t, err, "first volume")
+		capacity, err = dm.GetCapacity(ctx)
+		require.NoError(t, err, "get capacity")
+		assert.Equal(t, uint64(2*gig), capacity.Available, "available after first volume")
+
+		_, err = dm.CreateDevice(ctx, "vol-2", 4*gig, parameters.UsageAppDirect, 0, nil)
+		assert.True(t, errors.Is(err, pmemerr.NotEnoughSpace), "second volume should fail, got: %v", err)
+	})
+
+	t.Run("failures", func(t *testing.T) {
+		fake, err := newFake(100)
+		require.NoError(t, err, "create fake device manager")
+		dm, err := NewSimulation(fake, Simulation{CreateFailurePercentage: 100})
+		require.NoError(t, err, "create simulation")
+
+		_, err = dm.CreateDevice(ctx, "vol-1", gig, parameters.UsageAppDirect, 0, nil)
+		assert.True(t, errors.Is(err, pmemerr.NotEnoughSpace), "volume creation should fail, got: %v", err)
+	})
+
+	t.Run("optional-interfaces", func(t *testing.T) {
+		fake, err := newFake(100)
+		require.NoError(t, err, "create fake device manager")
+		pools := thinPoolsDM{fake}
+		dm, err := NewSimulation(pools, Simulation{CreateFailurePercentage: 100})
+		require.NoError(t, err, "create simulation")
+
+		found, ok := As[ThinPools](dm)
+		if assert.True(t, ok, "ThinPools of wrapped device manager") {
+			assert.Equal(t, pools, found, "ThinPools")
+		}
+		sd, ok := As[StripedDevices](dm)
+		require.True(t, ok, "StripedDevices of simulation")
+		_, err = sd.CreateStripedDevice(ctx, "vol-1", gig, 2, nil)
+		assert.True(t, errors.Is(err, pmemerr.NotSupported), "fake cannot stripe, got: %v", err)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		fake, err := newFake(100)
+		require.NoError(t, err, "create fake device manager")
+		_, err = NewSimulation(fake, Simulation{CreateFailurePercentage: 101})
+		assert.Error(t, err, "invalid percentage")
+	})
+}
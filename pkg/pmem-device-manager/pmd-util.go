@@ -10,7 +10,6 @@ import (
 	"k8s.io/klog/v2"
 
 	pmemerr "github.com/intel/pmem-csi/pkg/errors"
-	pmemexec "github.com/intel/pmem-csi/pkg/exec"
 	"golang.org/x/sys/unix"
 )
 
@@ -44,6 +43,10 @@ func clearDevice(ctx context.Context, dev *PmemDeviceInfo, flush bool) error {
 		return fmt.Errorf("%s is not device", dev.Path)
 	}
 
+	if (fileinfo.Mode() & os.ModeCharDevice) != 0 {
+		return clearDaxDevice(ctx, dev, blocks)
+	}
+
 	fd, err := unix.Open(dev.Path, unix.O_RDONLY|unix.O_EXCL|unix.O_CLOEXEC, 0)
 	defer unix.Close(fd)
 
@@ -57,7 +60,7 @@ func clearDevice(ctx context.Context, dev *PmemDeviceInfo, flush bool) error {
 		// For faster operation, and because we consider zeroing enough for
 		// reasonable clearing in case of a memory device, we force zero iterations
 		// with random data, followed by one pass writing zeroes.
-		if _, err := pmemexec.RunCommand(ctx, "shred", "-n", "0", "-z", dev.Path); err != nil {
+		if _, err := runCommand(ctx, "shred", "-n", "0", "-z", dev.Path); err != nil {
 			return fmt.Errorf("device shred failure: %v", err.Error())
 		}
 	} else {
@@ -68,13 +71,61 @@ func clearDevice(ctx context.Context, dev *PmemDeviceInfo, flush bool) error {
 			blocks = dev.Size / 1024
 		}
 		count := "count=" + strconv.FormatUint(blocks, 10)
-		if _, err := pmemexec.RunCommand(ctx, "dd", "if=/dev/zero", of, "bs=1024", count); err != nil {
+		if _, err := runCommand(ctx, "dd", "if=/dev/zero", of, "bs=1024", count); err != nil {
 			return fmt.Errorf("device zeroing failure: %v", err.Error())
 		}
 	}
 	return nil
 }
 
+// daxClearChunk is how much of a devdax device gets mapped at once
+// while clearing it. It is a multiple of all supported alignments.
+const daxClearChunk = 1024 * 1024 * 1024
+
+// clearDaxDevice zeroes a devdax character device. Those only
+// support mmap, not read or write, so dd and shred cannot be
+// used. Zero blocks clears the entire device.
+func clearDaxDevice(ctx context.Context, dev *PmemDeviceInfo, blocks uint64) error {
+	logger := klog.FromContext(ctx)
+	fd, err := unix.Open(dev.Path, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("open %s: %v", dev.Path, err)
+	}
+	defer unix.Close(fd)
+
+	size := dev.Size
+	if blocks != 0 && blocks*1024 < size {
+		size = blocks * 1024
+	}
+	logger.V(5).Info("Zeroing devdax device", "bytes", size, "dev-size", dev.Size)
+	for offset := uint64(0); offset < size; offset += daxClearChunk {
+		// The mapping itself must cover whole pages of the
+		// device, so round up to the end of the device or the
+		// chunk.
+		length := dev.Size - offset
+		if length > daxClearChunk {
+			length = daxClearChunk
+		}
+		data, err := unix.Mmap(fd, int64(offset), int(length), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+		if err != nil {
+			return fmt.Errorf("map %s at offset %d: %v", dev.Path, offset, err)
+		}
+		end := size - offset
+		if end > length {
+			end = length
+		}
+		clear(data[:end])
+		err = unix.Msync(data, unix.MS_SYNC)
+		if unmapErr := unix.Munmap(data); err == nil {
+			err = unmapErr
+		}
+		if err != nil {
+			return fmt.Errorf("zero %s at offset %d: %v", dev.Path, offset, err)
+		}
+	}
+	return nil
+}
+
 func waitDeviceAppears(ctx context.Context, dev *PmemDeviceInfo) error {
 	logger := klog.FromContext(ctx).WithName("waitDeviceAppears").WithValues("device", dev.Path)
 	for i := 0; i < 10; i++ {
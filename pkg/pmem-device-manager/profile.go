@@ -0,0 +1,229 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+
+	"github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// ProfileDefaultKey is the key in the profile ConfigMap which is used
+// for nodes that have no entry of their own.
+const ProfileDefaultKey = "default"
+
+// Profile describes the namespaces that a node is meant to have.
+type Profile struct {
+	Namespaces []ProfileNamespaces `json:"namespaces"`
+}
+
+// ProfileNamespaces describes namespaces that each of the regions
+// is meant to have.
+type ProfileNamespaces struct {
+	// Regions lists regions (like "region0"). Empty means all
+	// regions.
+	Regions []string `json:"regions,omitempty"`
+	// Mode is "fsdax", "devdax" or "sector".
+	Mode string `json:"mode"`
+	// Name is the name of the namespaces. "pmem-csi" makes them
+	// usable for the LVM mode of the driver.
+	Name string `json:"name,omitempty"`
+	// Size of each namespace. Without it, the namespaces share the
+	// space that is available when they get created.
+	Size *resource.Quantity `json:"size,omitempty"`
+	// Count is the number of namespaces, default 1.
+	Count *int `json:"count,omitempty"`
+}
+
+var profileModes = map[string]ndctl.NamespaceMode{
+	"fsdax":  ndctl.FsdaxMode,
+	"devdax": ndctl.DaxMode,
+	"sector": ndctl.SectorMode,
+}
+
+// ParseProfile picks the profile for the node from the ConfigMap
+// data. It returns nil if there is none.
+func ParseProfile(data map[string]string, nodeName string) (*Profile, error) {
+	key := nodeName
+	content, ok := data[key]
+	if !ok {
+		key = ProfileDefaultKey
+		content, ok = data[key]
+	}
+	if !ok {
+		return nil, nil
+	}
+	var profile Profile
+	if err := yaml.UnmarshalStrict([]byte(content), &profile); err != nil {
+		return nil, fmt.Errorf("%s: %v", key, err)
+	}
+	for i, entry := range profile.Namespaces {
+		if _, ok := profileModes[entry.Mode]; !ok {
+			return nil, fmt.Errorf("%s: namespaces #%d: unsupported mode %q", key, i, entry.Mode)
+		}
+		if entry.Size != nil && entry.Size.Sign() <= 0 {
+			return nil, fmt.Errorf("%s: namespaces #%d: size must be positive", key, i)
+		}
+		if entry.Count != nil && *entry.Count < 0 {
+			return nil, fmt.Errorf("%s: namespaces #%d: count must not be negative", key, i)
+		}
+	}
+	return &profile, nil
+}
+
+// ApplyProfile reads the profile of the node from the ConfigMap and
+// creates the namespaces that are missing. Applying the same profile
+// again does nothing unless namespaces were removed in the
+// meantime. Namespaces are never deleted or reconfigured because
+// that would destroy data.
+func ApplyProfile(ctx context.Context, client kubernetes.Interface, configMapNamespace, configMapName, nodeName string) (finalErr error) {
+	ctx, logger := pmemlog.WithName(ctx, "ApplyProfile")
+	defer func() {
+		if finalErr == nil {
+			return
+		}
+
+		// Gather some information and append it.
+		finalErr = fmt.Errorf("%w\n%s",
+			finalErr,
+			exec.CmdResult("ndctl", "list", "-NRi"),
+		)
+	}()
+
+	configMap, err := client.CoreV1().ConfigMaps(configMapNamespace).Get(ctx, configMapName, metav1.GetOptions{})
+	if err != nil {
+		return fmt.Errorf("get profile: %v", err)
+	}
+	profile, err := ParseProfile(configMap.Data, nodeName)
+	if err != nil {
+		return fmt.Errorf("parse profile %s/%s: %v", configMapNamespace, configMapName, err)
+	}
+	if profile == nil {
+		logger.Info("No profile for node", "node", nodeName)
+		return nil
+	}
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return fmt.Errorf("ndctl: %v", err)
+	}
+	defer ndctx.Free()
+
+	numCreated, err := applyProfile(ctx, ndctx, profile)
+	if err != nil {
+		return err
+	}
+	logger.Info("Profile applied", "node", nodeName, "created", numCreated)
+	return nil
+}
+
+func applyProfile(ctx context.Context, ndctx ndctl.Context, profile *Profile) (numCreated int, finalErr error) {
+	ctx, logger := pmemlog.WithName(ctx, "apply")
+	defer func() {
+		if finalErr != nil {
+			logger.Error(finalErr, "failed", "created", numCreated)
+		} else {
+			logger.V(3).Info("successful", "created", numCreated)
+		}
+	}()
+
+	selected := func(entry ProfileNamespaces, region ndctl.Region) bool {
+		if len(entry.Regions) == 0 {
+			return true
+		}
+		for _, name := range entry.Regions {
+			if name == region.DeviceName() {
+				return true
+			}
+		}
+		return false
+	}
+
+	matched := false
+	for _, bus := range ndctx.GetBuses() {
+		for _, region := range bus.ActiveRegions() {
+			logger := logger.WithValues("region", region.DeviceName())
+			// Each existing namespace counts only for one entry.
+			claimed := map[ndctl.Namespace]bool{}
+			for i, entry := range profile.Namespaces {
+				if !selected(entry, region) {
+					continue
+				}
+				logger := logger.WithValues("entry", i)
+				matched = true
+				if region.Readonly() {
+					finalErr = fmt.Errorf("region %s is read-only", region.DeviceName())
+					return
+				}
+				mode := profileModes[entry.Mode]
+				count := 1
+				if entry.Count != nil {
+					count = *entry.Count
+				}
+				for _, namespace := range region.ActiveNamespaces() {
+					if count > 0 &&
+						!claimed[namespace] &&
+						namespace.Mode() == mode &&
+						namespace.Name() == entry.Name {
+						logger.V(3).Info("Namespace exists", "namespace", namespace.DeviceName())
+						claimed[namespace] = true
+						count--
+					}
+				}
+				if count == 0 {
+					continue
+				}
+
+				var size uint64
+				if entry.Size != nil {
+					size = uint64(entry.Size.Value())
+				} else {
+					align, _ := ndctl.CalculateAlignment(region)
+					size = region.MaxAvailableExtent() / uint64(count) / align * align
+					if size == 0 {
+						finalErr = fmt.Errorf("region %s: not enough space for %d more %s namespaces", region.DeviceName(), count, entry.Mode)
+						return
+					}
+				}
+				for ; count > 0; count-- {
+					logger.V(2).Info("Creating namespace", "mode", entry.Mode, "name", entry.Name, "size", pmemlog.CapacityRef(int64(size)))
+					namespace, err := region.CreateNamespace(ctx, ndctl.CreateNamespaceOpts{
+						Name: entry.Name,
+						Mode: mode,
+						Size: size,
+					})
+					if err != nil {
+						finalErr = fmt.Errorf("region %s: create %s namespace: %w", region.DeviceName(), entry.Mode, err)
+						return
+					}
+					claimed[namespace] = true
+					numCreated++
+					// Same reason for wiping as in setupNS.
+					if device := namespace.BlockDeviceName(); device != "" {
+						if _, err := exec.RunCommand(ctx, "wipefs", "--all", "--force", "/dev/"+device); err != nil {
+							finalErr = fmt.Errorf("wipe new namespace: %v", err)
+							return
+						}
+					}
+				}
+			}
+		}
+	}
+	if len(profile.Namespaces) > 0 && !matched {
+		finalErr = errors.New("no active region matches the profile")
+	}
+	return
+}
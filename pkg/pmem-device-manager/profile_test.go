@@ -0,0 +1,134 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestParseProfile(t *testing.T) {
+	data := map[string]string{
+		"default": `
+namespaces:
+- mode: fsdax
+  name: pmem-csi
+`,
+		"worker-1": `
+namespaces:
+- regions: [region1]
+  mode: devdax
+  size: 4Gi
+  count: 2
+`,
+		"bad-mode": `
+namespaces:
+- mode: raw
+`,
+		"bad-size": `
+namespaces:
+- mode: fsdax
+  size: 0
+`,
+		"bad-field": `
+namespaces:
+- mode: fsdax
+  sizes: 1Gi
+`,
+	}
+
+	profile, err := ParseProfile(data, "worker-0")
+	require.NoError(t, err, "default profile")
+	require.Len(t, profile.Namespaces, 1, "default namespaces")
+	assert.Equal(t, "pmem-csi", profile.Namespaces[0].Name, "default name")
+
+	profile, err = ParseProfile(data, "worker-1")
+	require.NoError(t, err, "node profile")
+	require.Len(t, profile.Namespaces, 1, "node namespaces")
+	assert.Equal(t, []string{"region1"}, profile.Namespaces[0].Regions, "regions")
+	assert.Equal(t, int64(4*1024*1024*1024), profile.Namespaces[0].Size.Value(), "size")
+	assert.Equal(t, 2, *profile.Namespaces[0].Count, "count")
+
+	for _, node := range []string{"bad-mode", "bad-size", "bad-field"} {
+		_, err := ParseProfile(data, node)
+		assert.Error(t, err, node)
+	}
+
+	profile, err = ParseProfile(map[string]string{}, "worker-0")
+	require.NoError(t, err, "no profile")
+	assert.Nil(t, profile, "no profile")
+}
+
+func TestApplyProfile(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	gig := uint64(1024 * 1024 * 1024)
+	region := func(name string) *ndctlfake.Region {
+		return &ndctlfake.Region{
+			DeviceName_:         name,
+			Type_:               ndctl.PmemRegion,
+			Enabled_:            true,
+			Size_:               64 * gig,
+			AvailableSize_:      64 * gig,
+			MaxAvailableExtent_: 64 * gig,
+			InterleaveWays_:     1,
+			RegionAlign_:        16 * 1024 * 1024,
+		}
+	}
+	region0, region1 := region("region0"), region("region1")
+	region1.Namespaces_ = []ndctl.Namespace{
+		&ndctlfake.Namespace{
+			DeviceName_: "namespace1.0",
+			Name_:       "app",
+			Mode_:       ndctl.DaxMode,
+			Size_:       4 * gig,
+			Enabled_:    true,
+			Active_:     true,
+		},
+	}
+	hardware := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{
+			&ndctlfake.Bus{
+				DeviceName_: "bus0",
+				Regions_:    []ndctl.Region{region0, region1},
+			},
+		},
+	})
+	profile, err := ParseProfile(map[string]string{"default": `
+namespaces:
+- regions: [region1]
+  mode: devdax
+  name: app
+  size: 4Gi
+  count: 2
+- mode: fsdax
+  name: pmem-csi
+`}, "worker")
+	require.NoError(t, err, "parse profile")
+
+	numCreated, err := applyProfile(ctx, hardware, profile)
+	require.NoError(t, err, "apply profile")
+	assert.Equal(t, 3, numCreated, "one devdax namespace in region1, one fsdax namespace per region")
+	require.Len(t, region0.Namespaces_, 1, "region0")
+	assert.Equal(t, ndctl.FsdaxMode, region0.Namespaces_[0].Mode(), "region0 mode")
+	assert.Equal(t, "pmem-csi", region0.Namespaces_[0].Name(), "region0 name")
+	assert.Equal(t, 64*gig, region0.Namespaces_[0].Size(), "region0 size")
+	require.Len(t, region1.Namespaces_, 3, "region1")
+	assert.Equal(t, 4*gig, region1.Namespaces_[1].Size(), "region1 devdax size")
+
+	numCreated, err = applyProfile(ctx, hardware, profile)
+	require.NoError(t, err, "apply profile again")
+	assert.Equal(t, 0, numCreated, "nothing to do")
+
+	_, err = applyProfile(ctx, hardware, &Profile{Namespaces: []ProfileNamespaces{{Regions: []string{"region2"}, Mode: "fsdax"}}})
+	assert.Error(t, err, "no matching region")
+}
@@ -0,0 +1,49 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+// readOnlyDM rejects all modifications with pmemerr.ReadOnly. It
+// implements StripedDevices, so that As does not find the method of
+// the wrapped device manager.
+type readOnlyDM struct {
+	PmemDeviceManager
+}
+
+var _ StripedDevices = readOnlyDM{}
+
+// Unwrap returns the device manager which does the actual work.
+func (dm readOnlyDM) Unwrap() PmemDeviceManager {
+	return dm.PmemDeviceManager
+}
+
+func (dm readOnlyDM) CreateStripedDevice(ctx context.Context, volumeId string, size uint64, stripes int, numaNodes NUMANodes) (uint64, error) {
+	return 0, fmt.Errorf("create striped device %s: %w", volumeId, pmemerr.ReadOnly)
+}
+
+func (dm readOnlyDM) CreateDevice(ctx context.Context, volumeId string, size uint64, usage parameters.Usage, sectorSize uint64, numaNodes NUMANodes) (uint64, error) {
+	return 0, fmt.Errorf("create device %s: %w", volumeId, pmemerr.ReadOnly)
+}
+
+func (dm readOnlyDM) DeleteDevice(ctx context.Context, volumeId string, flush bool) error {
+	return fmt.Errorf("delete device %s: %w", volumeId, pmemerr.ReadOnly)
+}
+
+func (dm readOnlyDM) ResizeDevice(ctx context.Context, volumeId string, size uint64) (uint64, error) {
+	return 0, fmt.Errorf("resize device %s: %w", volumeId, pmemerr.ReadOnly)
+}
+
+func (dm readOnlyDM) RenameDevice(ctx context.Context, volumeId, newName string) error {
+	return fmt.Errorf("rename device %s: %w", volumeId, pmemerr.ReadOnly)
+}
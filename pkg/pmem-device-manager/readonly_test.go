@@ -0,0 +1,45 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	"github.com/intel/pmem-csi/pkg/pmem-csi-driver/parameters"
+)
+
+func TestReadOnly(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	dm, err := New(ctx, api.DeviceModeFake, 100, Options{ReadOnly: true})
+	require.NoError(t, err, "create fake device manager")
+
+	_, err = dm.CreateDevice(ctx, "vol", 1024*1024, parameters.UsageAppDirect, 0, nil)
+	assert.True(t, errors.Is(err, pmemerr.ReadOnly), "create device, got: %v", err)
+	assert.True(t, errors.Is(dm.DeleteDevice(ctx, "vol", false), pmemerr.ReadOnly), "delete device")
+	_, err = dm.ResizeDevice(ctx, "vol", 2*1024*1024)
+	assert.True(t, errors.Is(err, pmemerr.ReadOnly), "resize device, got: %v", err)
+	assert.True(t, errors.Is(dm.RenameDevice(ctx, "vol", "vol2"), pmemerr.ReadOnly), "rename device")
+	sd, ok := As[StripedDevices](dm)
+	require.True(t, ok, "StripedDevices")
+	_, err = sd.CreateStripedDevice(ctx, "vol", 1024*1024, 2, nil)
+	assert.True(t, errors.Is(err, pmemerr.ReadOnly), "create striped device, got: %v", err)
+	assert.NotNil(t, Unwrap(dm), "wrapped device manager")
+
+	devices, err := dm.ListDevices(ctx)
+	require.NoError(t, err, "list devices")
+	assert.Empty(t, devices, "devices")
+	capacity, err := dm.GetCapacity(ctx)
+	require.NoError(t, err, "get capacity")
+	assert.Equal(t, totalCapacity, capacity.Available, "available")
+}
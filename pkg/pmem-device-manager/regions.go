@@ -0,0 +1,37 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+// RegionSelection restricts which PMEM regions the device managers
+// use, so that other tooling can own the remaining regions.
+type RegionSelection struct {
+	// Allow lists the regions (like "region0") which may be
+	// used. Empty allows all regions.
+	Allow []string
+	// Deny lists regions which must not be used, even when they
+	// are also allowed.
+	Deny []string
+}
+
+// Selected returns true if the region with the given device name may
+// be used.
+func (rs RegionSelection) Selected(regionName string) bool {
+	for _, name := range rs.Deny {
+		if name == regionName {
+			return false
+		}
+	}
+	if len(rs.Allow) == 0 {
+		return true
+	}
+	for _, name := range rs.Allow {
+		if name == regionName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegionSelection(t *testing.T) {
+	testcases := map[string]struct {
+		selection RegionSelection
+		selected  []string
+		skipped   []string
+	}{
+		"all": {
+			selected: []string{"region0", "region1"},
+		},
+		"allow": {
+			selection: RegionSelection{Allow: []string{"region0", "region2"}},
+			selected:  []string{"region0", "region2"},
+			skipped:   []string{"region1"},
+		},
+		"deny": {
+			selection: RegionSelection{Deny: []string{"region1"}},
+			selected:  []string{"region0", "region2"},
+			skipped:   []string{"region1"},
+		},
+		"allow-and-deny": {
+			selection: RegionSelection{Allow: []string{"region0", "region1"}, Deny: []string{"region1"}},
+			selected:  []string{"region0"},
+			skipped:   []string{"region1", "region2"},
+		},
+	}
+
+	for name, tc := range testcases {
+		t.Run(name, func(t *testing.T) {
+			for _, region := range tc.selected {
+				assert.True(t, tc.selection.Selected(region), "%s selected", region)
+			}
+			for _, region := range tc.skipped {
+				assert.False(t, tc.selection.Selected(region), "%s skipped", region)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+)
+
+// Factory creates a device manager. Backends which manage PMEM
+// regions should only use the regions chosen with opts.Regions and
+// the given percentage of each region. Other backends may ignore
+// both. Backends must not modify anything when opts.ReadOnly is set,
+// New ensures that modifications of devices get rejected.
+type Factory func(ctx context.Context, pmemPercentage uint, opts Options) (PmemDeviceManager, error)
+
+var (
+	factories      = map[api.DeviceMode]Factory{}
+	factoriesMutex sync.RWMutex
+)
+
+// Register makes a device manager available to New under the given
+// name. Backends which are not part of PMEM-CSI call this in an init
+// function of their package, which then gets linked into a driver
+// binary that otherwise is the same as the normal one. The name then
+// can be used for the -deviceManager command line flag and the
+// deviceMode parameter. Register panics when the name is already
+// taken.
+func Register(mode api.DeviceMode, factory Factory) {
+	factoriesMutex.Lock()
+	defer factoriesMutex.Unlock()
+	if _, ok := factories[mode]; ok {
+		panic(fmt.Sprintf("device manager %q registered twice", mode))
+	}
+	factories[mode] = factory
+	api.RegisterCustomDeviceMode(mode)
+}
+
+// Registered returns the names of all device managers, sorted
+// alphabetically.
+func Registered() []api.DeviceMode {
+	factoriesMutex.RLock()
+	defer factoriesMutex.RUnlock()
+	var modes []api.DeviceMode
+	for mode := range factories {
+		modes = append(modes, mode)
+	}
+	sort.Slice(modes, func(i, j int) bool {
+		return modes[i] < modes[j]
+	})
+	return modes
+}
+
+func init() {
+	Register(api.DeviceModeFake, func(ctx context.Context, pmemPercentage uint, opts Options) (PmemDeviceManager, error) {
+		return newFake(pmemPercentage)
+	})
+	Register(api.DeviceModeLVM, func(ctx context.Context, pmemPercentage uint, opts Options) (PmemDeviceManager, error) {
+		return newPmemDeviceManagerLVM(ctx, pmemPercentage, opts)
+	})
+	Register(api.DeviceModeDirect, func(ctx context.Context, pmemPercentage uint, opts Options) (PmemDeviceManager, error) {
+		return newPmemDeviceManagerNdctl(ctx, pmemPercentage, false, opts)
+	})
+	Register(api.DeviceModeDevdax, func(ctx context.Context, pmemPercentage uint, opts Options) (PmemDeviceManager, error) {
+		return newPmemDeviceManagerNdctl(ctx, pmemPercentage, true, opts)
+	})
+}
@@ -0,0 +1,53 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	api "github.com/intel/pmem-csi/pkg/apis/pmemcsi/v1beta1"
+)
+
+func TestRegister(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	custom := api.DeviceMode("test-custom")
+	var mode api.DeviceMode
+	assert.Error(t, mode.Set(string(custom)), "unknown mode")
+	_, err := New(ctx, custom, 100, Options{})
+	assert.Error(t, err, "unknown device manager")
+
+	var percentage uint
+	var options Options
+	Register(custom, func(ctx context.Context, pmemPercentage uint, opts Options) (PmemDeviceManager, error) {
+		percentage = pmemPercentage
+		options = opts
+		return newFake(pmemPercentage)
+	})
+	defer func() {
+		factoriesMutex.Lock()
+		defer factoriesMutex.Unlock()
+		delete(factories, custom)
+	}()
+	assert.Contains(t, Registered(), custom, "registered")
+	assert.Contains(t, Registered(), api.DeviceModeLVM, "built-in")
+	assert.NoError(t, mode.Set(string(custom)), "registered mode")
+	assert.Equal(t, custom, mode, "mode")
+	dm, err := New(ctx, custom, 50, Options{ReadOnly: true})
+	require.NoError(t, err, "custom device manager")
+	assert.Equal(t, uint(50), percentage, "percentage")
+	assert.True(t, options.ReadOnly, "options")
+	assert.NotNil(t, dm, "device manager")
+
+	assert.Panics(t, func() {
+		Register(api.DeviceModeLVM, nil)
+	}, "duplicate registration")
+}
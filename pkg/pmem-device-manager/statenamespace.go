@@ -0,0 +1,105 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"k8s.io/klog/v2"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	"github.com/intel/pmem-csi/pkg/exec"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+)
+
+// StateNamespaceName is the name of the fsdax namespace which holds
+// the state directory of the node driver. The LVM mode ignores it
+// because it only uses namespaces called "pmem-csi" and direct mode
+// only knows it as a namespace without a volume.
+const StateNamespaceName = "pmem-csi-state"
+
+// EnsureStateNamespace returns the block device of the state
+// namespace, creating the namespace with the given size in the first
+// selected region which has enough space if it does not exist yet. An
+// existing namespace is used regardless of its size. This must be
+// called before the device managers get created, because those use
+// the space that is left in the regions.
+func EnsureStateNamespace(ctx context.Context, size uint64, regions RegionSelection) (device string, finalErr error) {
+	ctx, logger := pmemlog.WithName(ctx, "EnsureStateNamespace")
+	ndctlMutex.Lock()
+	defer ndctlMutex.Unlock()
+
+	ndctx, err := ndctl.NewContext()
+	if err != nil {
+		return "", fmt.Errorf("ndctl: %v", err)
+	}
+	defer ndctx.Free()
+
+	ns, created, err := ensureStateNamespace(ctx, ndctx, size, regions)
+	if err != nil {
+		return "", err
+	}
+	name := ns.BlockDeviceName()
+	if name == "" {
+		return "", fmt.Errorf("state namespace %s has no block device", ns.DeviceName())
+	}
+	device = "/dev/" + name
+	if created {
+		// Same reason for wiping as in setupNS.
+		if _, err := exec.RunCommand(ctx, "wipefs", "--all", "--force", device); err != nil {
+			return "", fmt.Errorf("wipe new state namespace: %v", err)
+		}
+	}
+	logger.V(3).Info("State namespace", "namespace", ns.DeviceName(), "device", device, "created", created)
+	return device, nil
+}
+
+func ensureStateNamespace(ctx context.Context, ndctx ndctl.Context, size uint64, regions RegionSelection) (ndctl.Namespace, bool, error) {
+	logger := klog.FromContext(ctx)
+	if ns, err := ndctl.GetNamespaceByName(ndctx, StateNamespaceName); err == nil {
+		if ns.Mode() != ndctl.FsdaxMode {
+			return nil, false, fmt.Errorf("state namespace %s has mode %s instead of %s", ns.DeviceName(), ns.Mode(), ndctl.FsdaxMode)
+		}
+		if region := ns.Region().DeviceName(); !regions.Selected(region) {
+			return nil, false, fmt.Errorf("state namespace %s is in region %s, which is not selected", ns.DeviceName(), region)
+		}
+		return ns, false, nil
+	} else if !errors.Is(err, pmemerr.DeviceNotFound) {
+		return nil, false, err
+	}
+
+	opts := ndctl.CreateNamespaceOpts{
+		Name: StateNamespaceName,
+		Mode: ndctl.FsdaxMode,
+		Size: size,
+	}
+	for _, bus := range ndctx.GetBuses() {
+		for _, region := range bus.ActiveRegions() {
+			if !regions.Selected(region.DeviceName()) || region.Readonly() {
+				continue
+			}
+			if region.MaxAvailableExtent() < size {
+				logger.V(3).Info("Not enough space for state namespace", "region", region.DeviceName(), "available", pmemlog.CapacityRef(int64(region.MaxAvailableExtent())))
+				continue
+			}
+			logger.V(2).Info("Creating state namespace", "region", region.DeviceName(), "size", pmemlog.CapacityRef(int64(size)))
+			var ns ndctl.Namespace
+			err := timeNdctl(ctx, "create-namespace", func() (err error) {
+				ns, err = region.CreateNamespace(ctx, opts)
+				return
+			})
+			if err != nil {
+				return nil, false, fmt.Errorf("region %s: create state namespace: %w", region.DeviceName(), err)
+			}
+			return ns, true, nil
+		}
+	}
+	return nil, false, fmt.Errorf("no selected region has %s for the state namespace: %w", pmemlog.CapacityRef(int64(size)), pmemerr.NotEnoughSpace)
+}
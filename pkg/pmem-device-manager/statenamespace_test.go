@@ -0,0 +1,66 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2/ktesting"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	"github.com/intel/pmem-csi/pkg/ndctl"
+	ndctlfake "github.com/intel/pmem-csi/pkg/ndctl/fake"
+)
+
+func TestEnsureStateNamespace(t *testing.T) {
+	_, ctx := ktesting.NewTestContext(t)
+	gig := uint64(1024 * 1024 * 1024)
+	region := func(name string, available uint64) *ndctlfake.Region {
+		return &ndctlfake.Region{
+			DeviceName_:         name,
+			Type_:               ndctl.PmemRegion,
+			Enabled_:            true,
+			Size_:               64 * gig,
+			AvailableSize_:      available,
+			MaxAvailableExtent_: available,
+			InterleaveWays_:     1,
+			RegionAlign_:        16 * 1024 * 1024,
+		}
+	}
+	region0, region1, region2 := region("region0", 64*gig), region("region1", 0), region("region2", 64*gig)
+	hardware := ndctlfake.NewContext(&ndctlfake.Context{
+		Buses: []ndctl.Bus{
+			&ndctlfake.Bus{
+				DeviceName_: "bus0",
+				Regions_:    []ndctl.Region{region0, region1, region2},
+			},
+		},
+	})
+	regions := RegionSelection{Deny: []string{"region0"}}
+
+	_, _, err := ensureStateNamespace(ctx, hardware, gig, RegionSelection{Allow: []string{"region1"}})
+	assert.ErrorIs(t, err, pmemerr.NotEnoughSpace, "region1 is full")
+
+	ns, created, err := ensureStateNamespace(ctx, hardware, gig, regions)
+	require.NoError(t, err, "create state namespace")
+	assert.True(t, created, "created")
+	assert.Equal(t, StateNamespaceName, ns.Name(), "name")
+	assert.Equal(t, ndctl.FsdaxMode, ns.Mode(), "mode")
+	assert.Empty(t, region0.Namespaces_, "region0 is not selected")
+	require.Len(t, region2.Namespaces_, 1, "region2")
+
+	existing, created, err := ensureStateNamespace(ctx, hardware, 2*gig, regions)
+	require.NoError(t, err, "state namespace exists")
+	assert.False(t, created, "created again")
+	assert.Same(t, ns, existing, "same namespace regardless of size")
+	assert.Len(t, region2.Namespaces_, 1, "region2 again")
+
+	_, _, err = ensureStateNamespace(ctx, hardware, gig, RegionSelection{Deny: []string{"region2"}})
+	assert.Error(t, err, "existing namespace not in selected regions")
+}
@@ -0,0 +1,278 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+// StripedDevices is implemented by device managers which can stripe
+// a device across several regions to aggregate their bandwidth. Use
+// As to find it behind wrappers like NewSimulation.
+type StripedDevices interface {
+	// CreateStripedDevice creates a device which is striped
+	// across the given number of regions. Otherwise it behaves
+	// like CreateDevice.
+	// Possible errors: ErrNotEnoughSpace, ErrDeviceExists, ErrNotSupported
+	CreateStripedDevice(ctx context.Context, name string, size uint64, stripes int, numaNodes NUMANodes) (uint64, error)
+}
+
+// stripeChunkSectors is the amount of data (2MiB in 512 byte
+// sectors) that is stored in one region before the striped device
+// continues in the next one. It is a multiple of the huge page size,
+// so a huge page is never split between regions.
+const stripeChunkSectors = 4096
+
+// stripeName is the name of the logical volume with the part of a
+// striped volume in one volume group. The number of stripes is part
+// of the name because it is needed to re-assemble the striped device
+// after a reboot.
+func stripeName(volumeId string, index, stripes int) string {
+	return fmt.Sprintf("%s_stripe%dof%d", volumeId, index, stripes)
+}
+
+var stripeNameRe = regexp.MustCompile(`^(.+)_stripe(\d+)of(\d+)$`)
+
+// parseStripeName is the reverse of stripeName.
+func parseStripeName(name string) (volumeId string, index, stripes int, ok bool) {
+	parts := stripeNameRe.FindStringSubmatch(name)
+	if parts == nil {
+		return "", 0, 0, false
+	}
+	index, _ = strconv.Atoi(parts[2])
+	stripes, _ = strconv.Atoi(parts[3])
+	if stripes < 2 || index >= stripes {
+		return "", 0, 0, false
+	}
+	return parts[1], index, stripes, true
+}
+
+// stripeTable returns the device mapper table which stripes across
+// the devices, which all have the same size.
+func stripeTable(devices []*PmemDeviceInfo) string {
+	table := fmt.Sprintf("0 %d striped %d %d", uint64(len(devices))*devices[0].Size/512, len(devices), stripeChunkSectors)
+	for _, device := range devices {
+		table += " " + device.Path + " 0"
+	}
+	return table
+}
+
+// stripedDevicePath is where device mapper creates the striped device.
+func stripedDevicePath(volumeId string) string {
+	return "/dev/mapper/" + volumeId
+}
+
+// assembleStripes replaces the parts of each striped volume with one
+// device for the entire volume and creates the device mapper device
+// if necessary. Incomplete volumes are skipped.
+func (lvm *pmemLvm) assembleStripes(ctx context.Context) {
+	ctx, logger := pmemlog.WithName(ctx, "assembleStripes")
+	parts := map[string][]*PmemDeviceInfo{}
+	for name, device := range lvm.devices {
+		volumeId, index, stripes, ok := parseStripeName(name)
+		if !ok {
+			continue
+		}
+		delete(lvm.devices, name)
+		if parts[volumeId] == nil {
+			parts[volumeId] = make([]*PmemDeviceInfo, stripes)
+		}
+		if len(parts[volumeId]) == stripes {
+			parts[volumeId][index] = device
+		}
+	}
+	for volumeId, devices := range parts {
+		complete := true
+		for index, device := range devices {
+			if device == nil || device.Size != devices[0].Size {
+				logger.Error(nil, "Striped volume is incomplete, skipping it", "volume-id", volumeId, "stripe", index)
+				complete = false
+				break
+			}
+		}
+		if !complete {
+			continue
+		}
+		device := &PmemDeviceInfo{
+			VolumeId:      volumeId,
+			Path:          stripedDevicePath(volumeId),
+			Size:          uint64(len(devices)) * devices[0].Size,
+			AllocatedSize: uint64(len(devices)) * devices[0].Size,
+		}
+		if _, err := runCommand(ctx, "dmsetup", "info", volumeId); err != nil && !lvm.readOnly {
+			// Device mapper devices do not survive a reboot.
+			logger.V(3).Info("Creating striped device", "volume-id", volumeId, "stripes", len(devices))
+			if _, err := runCommand(ctx, "dmsetup", "create", volumeId, "--table", stripeTable(devices)); err != nil {
+				logger.Error(err, "Creating striped device failed, skipping it", "volume-id", volumeId)
+				continue
+			}
+		}
+		lvm.devices[volumeId] = device
+		lvm.stripes[volumeId] = devices
+	}
+}
+
+func (lvm *pmemLvm) CreateStripedDevice(ctx context.Context, volumeId string, size uint64, stripes int, numaNodes NUMANodes) (uint64, error) {
+	ctx, logger := pmemlog.WithName(ctx, "LVM-CreateStripedDevice")
+	if stripes < 2 {
+		return 0, fmt.Errorf("need at least two stripes, got %d: %w", stripes, pmemerr.NotSupported)
+	}
+	if lvm.overcommit > 0 {
+		return 0, fmt.Errorf("striped volumes with thin provisioning: %w", pmemerr.NotSupported)
+	}
+
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+	if _, err := lvm.getDevice(volumeId); err == nil {
+		return 0, pmemerr.DeviceExists
+	}
+	vgs, err := getVolumeGroups(ctx, lvm.volumeGroups)
+	if err != nil {
+		return 0, err
+	}
+	if len(vgs) < stripes {
+		return 0, fmt.Errorf("%d stripes, only %d volume groups: %w", stripes, len(vgs), pmemerr.NotSupported)
+	}
+
+	// Each part gets aligned, so the volume may become larger than
+	// requested.
+	part := (size + uint64(stripes)*lvmAlign - 1) / (uint64(stripes) * lvmAlign) * lvmAlign
+	if part == 0 {
+		part = lvmAlign
+	}
+	actual := part * uint64(stripes)
+	if actual != size {
+		logger.V(3).Info("Increased size to satisfy LVM alignment",
+			"old-size", pmemlog.CapacityRef(int64(size)),
+			"new-size", pmemlog.CapacityRef(int64(actual)),
+			"alignment", pmemlog.CapacityRef(int64(lvmAlign)),
+			"stripes", stripes)
+	}
+
+	// Use the volume groups with most free space.
+	var candidates []vgInfo
+	for _, vg := range vgs {
+		if node, ok := lvm.numaNodes[vg.name]; len(numaNodes) > 0 && (!ok || !numaNodes.Allowed(node)) {
+			logger.V(5).Info("Volume group not on requested NUMA nodes", "vg", vg.name, "numa-nodes", numaNodes)
+			continue
+		}
+		if vg.free >= part {
+			candidates = append(candidates, vg)
+		}
+	}
+	if len(candidates) < stripes {
+		return 0, pmemerr.NotEnoughSpace
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].free > candidates[j].free
+	})
+
+	var devices []*PmemDeviceInfo
+	cleanup := func() {
+		for _, device := range devices {
+			if _, err := runCommand(ctx, "lvremove", "-fy", device.Path); err != nil {
+				logger.Error(err, "Removing part of striped volume failed", "device", device.Path)
+			}
+		}
+	}
+	strSz := strconv.FormatUint(part, 10) + "B"
+	for index, vg := range candidates[:stripes] {
+		name := stripeName(volumeId, index, stripes)
+		if _, err := runCommand(ctx, "lvcreate", "-Zn", "-L", strSz, "-n", name, vg.name); err != nil {
+			cleanup()
+			return 0, fmt.Errorf("create part %d of striped volume: %v", index, err)
+		}
+		device, err := getUncachedDevice(ctx, name, vg.name)
+		if err == nil {
+			devices = append(devices, device)
+			err = waitDeviceAppears(ctx, device)
+		}
+		if err != nil {
+			cleanup()
+			return 0, fmt.Errorf("part %d of striped volume: %v", index, err)
+		}
+	}
+	if _, err := runCommand(ctx, "dmsetup", "create", volumeId, "--table", stripeTable(devices)); err != nil {
+		cleanup()
+		return 0, fmt.Errorf("create striped device: %v", err)
+	}
+	device := &PmemDeviceInfo{
+		VolumeId:      volumeId,
+		Path:          stripedDevicePath(volumeId),
+		Size:          actual,
+		AllocatedSize: actual,
+	}
+	if err := waitDeviceAppears(ctx, device); err != nil {
+		return 0, err
+	}
+	// clear start of device to avoid old data being recognized as file system
+	if err := clearDevice(ctx, device, false); err != nil {
+		return 0, fmt.Errorf("clear device %q: %v", volumeId, err)
+	}
+	lvm.devices[volumeId] = device
+	lvm.stripes[volumeId] = devices
+	return actual, nil
+}
+
+// deleteStripes removes the device mapper device and the parts of
+// the volume.
+func (lvm *pmemLvm) deleteStripes(ctx context.Context, volumeId string) error {
+	if _, err := runCommand(ctx, "dmsetup", "remove", volumeId); err != nil {
+		return err
+	}
+	for _, device := range lvm.stripes[volumeId] {
+		if _, err := runCommand(ctx, "lvremove", "-fy", device.Path); err != nil {
+			return err
+		}
+	}
+	delete(lvm.stripes, volumeId)
+	return nil
+}
+
+// renameStripes renames the device mapper device and the parts of
+// the volume.
+func (lvm *pmemLvm) renameStripes(ctx context.Context, volumeId, newName string) error {
+	devices := lvm.stripes[volumeId]
+	renamed := make([]*PmemDeviceInfo, 0, len(devices))
+	for index, device := range devices {
+		// The path is /dev/<vg>/<lv>.
+		vg := strings.Split(device.Path, "/")[2]
+		name := stripeName(newName, index, len(devices))
+		if _, err := runCommand(ctx, "lvrename", vg, device.VolumeId, name); err != nil {
+			return err
+		}
+		device, err := getUncachedDevice(ctx, name, vg)
+		if err != nil {
+			return err
+		}
+		renamed = append(renamed, device)
+	}
+	if _, err := runCommand(ctx, "dmsetup", "rename", volumeId, newName); err != nil {
+		return err
+	}
+	delete(lvm.stripes, volumeId)
+	lvm.stripes[newName] = renamed
+	size := lvm.devices[volumeId].Size
+	delete(lvm.devices, volumeId)
+	lvm.devices[newName] = &PmemDeviceInfo{
+		VolumeId:      newName,
+		Path:          stripedDevicePath(newName),
+		Size:          size,
+		AllocatedSize: size,
+	}
+	return nil
+}
+
+var _ StripedDevices = &pmemLvm{}
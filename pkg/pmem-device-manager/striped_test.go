@@ -0,0 +1,36 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStripeNames(t *testing.T) {
+	name := stripeName("pmem-csi-vol_1", 1, 3)
+	assert.Equal(t, "pmem-csi-vol_1_stripe1of3", name, "name")
+	volumeId, index, stripes, ok := parseStripeName(name)
+	assert.True(t, ok, "parse")
+	assert.Equal(t, "pmem-csi-vol_1", volumeId, "volume ID")
+	assert.Equal(t, 1, index, "index")
+	assert.Equal(t, 3, stripes, "stripes")
+
+	for _, name := range []string{"pmem-csi-vol", "vol_stripe3of3", "vol_stripe0of1", "_stripe0of2", "vol_stripeXof2"} {
+		_, _, _, ok := parseStripeName(name)
+		assert.False(t, ok, name)
+	}
+}
+
+func TestStripeTable(t *testing.T) {
+	devices := []*PmemDeviceInfo{
+		{Path: "/dev/vg0/vol_stripe0of2", Size: 8 * 1024 * 1024},
+		{Path: "/dev/vg1/vol_stripe1of2", Size: 8 * 1024 * 1024},
+	}
+	assert.Equal(t, "0 32768 striped 2 4096 /dev/vg0/vol_stripe0of2 0 /dev/vg1/vol_stripe1of2 0", stripeTable(devices))
+}
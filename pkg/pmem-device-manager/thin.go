@@ -0,0 +1,199 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	pmemlog "github.com/intel/pmem-csi/pkg/logger"
+)
+
+// ThinProvisioning configures thin provisioning in LVM mode.
+type ThinProvisioning struct {
+	// Overcommit is the percentage of the thin pool size which
+	// may be provisioned for volumes, for example 200 for twice
+	// the size of the pool. Zero disables thin provisioning.
+	Overcommit uint
+}
+
+// Enabled returns true if volumes are meant to be thin volumes.
+func (tp ThinProvisioning) Enabled() bool {
+	return tp.Overcommit > 0
+}
+
+// ThinPools is implemented by device managers which provision
+// volumes from thin pools. Use As to find it behind wrappers like
+// NewSimulation.
+type ThinPools interface {
+	// GetThinPoolUsage returns the percentage (0 to 100) of the
+	// data in each thin pool which is in use, indexed by volume
+	// group.
+	GetThinPoolUsage(ctx context.Context) (map[string]float64, error)
+
+	// IsThinDevice returns true if the device is a thin volume.
+	// Those must not be zeroed because that would allocate all
+	// of their blocks.
+	IsThinDevice(ctx context.Context, name string) (bool, error)
+}
+
+// thinPoolName is the name of the thin pool in each volume group.
+const thinPoolName = "pmem-csi-pool"
+
+// The separator is needed because some fields are empty for some
+// logical volumes.
+var thinPoolArgs = []string{"--noheadings", "--nosuffix", "--separator", ";", "-o", "lv_name,vg_name,lv_size,data_percent,pool_lv", "--units", "B"}
+
+type thinPoolInfo struct {
+	// size of the data in the pool.
+	size uint64
+	// dataPercent is the percentage of the data in use.
+	dataPercent float64
+	// provisioned is the sum of the sizes of all thin volumes in
+	// the pool.
+	provisioned uint64
+	// volumes are the names of the thin volumes.
+	volumes map[string]bool
+}
+
+// used returns the amount of data in use.
+func (pool *thinPoolInfo) used() uint64 {
+	return uint64(pool.dataPercent * float64(pool.size) / 100)
+}
+
+// available returns how much more may be provisioned from the pool.
+func (pool *thinPoolInfo) available(overcommit uint) uint64 {
+	limit := pool.size * uint64(overcommit) / 100
+	if pool.provisioned >= limit {
+		return 0
+	}
+	return (limit - pool.provisioned) / lvmAlign * lvmAlign
+}
+
+// setupThinPool ensures that the volume group has a thin pool. A new
+// pool gets all space that is left in the volume group.
+func setupThinPool(ctx context.Context, vgName string) error {
+	ctx, logger := pmemlog.WithName(ctx, "setupThinPool")
+	if _, err := runCommand(ctx, "lvs", vgName+"/"+thinPoolName); err == nil {
+		logger.V(5).Info("Thin pool exists", "vg", vgName)
+		return nil
+	}
+	logger.V(3).Info("Creating thin pool", "vg", vgName)
+	// Newly provisioned blocks get zeroed, so old data of deleted
+	// volumes never shows up in new volumes.
+	if _, err := runCommand(ctx, "lvcreate", "--type", "thin-pool", "--extents", "100%FREE", "--zero", "y", "--name", thinPoolName, vgName); err != nil {
+		return fmt.Errorf("create thin pool in volume group %s: %v", vgName, err)
+	}
+	return nil
+}
+
+// thinPools are indexed by volume group.
+type thinPools map[string]*thinPoolInfo
+
+// isThin returns true if the volume is in one of the pools.
+func (pools thinPools) isThin(volumeId string) bool {
+	for _, pool := range pools {
+		if pool.volumes[volumeId] {
+			return true
+		}
+	}
+	return false
+}
+
+// getThinPools returns the thin pools of the volume groups.
+func getThinPools(ctx context.Context, volumeGroups []string) (thinPools, error) {
+	args := append(thinPoolArgs, volumeGroups...)
+	output, err := runCommand(ctx, "lvs", args...)
+	if err != nil {
+		return nil, fmt.Errorf("lvs failure: %v", err)
+	}
+	return parseThinPoolOutput(output)
+}
+
+// lvs options "lv_name,vg_name,lv_size,data_percent,pool_lv"
+func parseThinPoolOutput(output string) (thinPools, error) {
+	pools := thinPools{}
+	pool := func(vgName string) *thinPoolInfo {
+		if pools[vgName] == nil {
+			pools[vgName] = &thinPoolInfo{volumes: map[string]bool{}}
+		}
+		return pools[vgName]
+	}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, ";")
+		if len(fields) != 5 {
+			return nil, fmt.Errorf("failed to parse lvs output: %q", line)
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		size, err := strconv.ParseUint(fields[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse lvs output: %q: %v", line, err)
+		}
+		switch {
+		case fields[0] == thinPoolName:
+			p := pool(fields[1])
+			p.size = size
+			if fields[3] != "" {
+				p.dataPercent, err = strconv.ParseFloat(fields[3], 64)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse lvs output: %q: %v", line, err)
+				}
+			}
+		case fields[4] == thinPoolName:
+			p := pool(fields[1])
+			p.provisioned += size
+			p.volumes[fields[0]] = true
+		}
+	}
+	for vgName, p := range pools {
+		if p.size == 0 {
+			// Thin volumes without a pool should not happen.
+			delete(pools, vgName)
+		}
+	}
+	return pools, nil
+}
+
+func (lvm *pmemLvm) GetThinPoolUsage(ctx context.Context) (map[string]float64, error) {
+	ctx, _ = pmemlog.WithName(ctx, "LVM-GetThinPoolUsage")
+
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	pools, err := lvm.getThinPools(ctx)
+	if err != nil {
+		return nil, err
+	}
+	usage := map[string]float64{}
+	for vgName, pool := range pools {
+		usage[vgName] = pool.dataPercent
+	}
+	return usage, nil
+}
+
+func (lvm *pmemLvm) IsThinDevice(ctx context.Context, name string) (bool, error) {
+	ctx, _ = pmemlog.WithName(ctx, "LVM-IsThinDevice")
+
+	lvmMutex.Lock()
+	defer lvmMutex.Unlock()
+
+	pools, err := lvm.getThinPools(ctx)
+	if err != nil {
+		return false, err
+	}
+	return pools.isThin(name), nil
+}
+
+var _ ThinPools = &pmemLvm{}
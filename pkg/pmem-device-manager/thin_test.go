@@ -0,0 +1,45 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmdmanager
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseThinPoolOutput(t *testing.T) {
+	const gig = 1024 * 1024 * 1024
+	output := `  pmem-csi-pool;ndbus0region0fsdax;68719476736;25.00;
+  vol-1;ndbus0region0fsdax;68719476736;37.50;pmem-csi-pool
+  vol-2;ndbus0region0fsdax;34359738368;0.00;pmem-csi-pool
+  vol-3;ndbus0region0fsdax;4294967296;;
+  pmem-csi-pool;ndbus0region1fsdax;34359738368;;
+`
+	pools, err := parseThinPoolOutput(output)
+	require.NoError(t, err, "parse")
+	require.Len(t, pools, 2, "pools")
+
+	pool := pools["ndbus0region0fsdax"]
+	require.NotNil(t, pool, "region0 pool")
+	assert.Equal(t, uint64(64*gig), pool.size, "size")
+	assert.Equal(t, uint64(16*gig), pool.used(), "used")
+	assert.Equal(t, uint64(96*gig), pool.provisioned, "provisioned")
+	assert.Equal(t, uint64(32*gig), pool.available(200), "available with 200% over-commit")
+	assert.Equal(t, uint64(0), pool.available(100), "available without over-commit")
+	assert.True(t, pools.isThin("vol-1"), "vol-1")
+	assert.False(t, pools.isThin("vol-3"), "vol-3")
+
+	pool = pools["ndbus0region1fsdax"]
+	require.NotNil(t, pool, "region1 pool")
+	assert.Equal(t, uint64(0), pool.used(), "empty pool")
+	assert.Equal(t, uint64(32*gig), pool.available(100), "empty pool available")
+
+	_, err = parseThinPoolOutput("vol;vg\n")
+	assert.Error(t, err, "invalid output")
+}
@@ -2,8 +2,10 @@ package pmemgrpc
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
@@ -19,6 +21,7 @@ import (
 	"google.golang.org/grpc/backoff"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/resolver"
 	"google.golang.org/grpc/status"
 	"k8s.io/klog/v2"
@@ -29,11 +32,61 @@ import (
 // grpcRequestCounter is used to assign a unique ID to all incoming gRPC requests.
 var grpcRequestCounter uint64
 
+// CorrelationIDKey is the gRPC metadata key for the ID which gets
+// added to all log output of a call. Clients can set it to find their
+// calls in the driver log, otherwise the server generates an ID. The
+// server returns the ID in the response header.
+const CorrelationIDKey = "x-correlation-id"
+
+// maxCorrelationIDLen limits IDs chosen by clients, longer ones
+// get replaced.
+const maxCorrelationIDLen = 64
+
+// correlationID returns the ID from the incoming metadata or a new
+// random one.
+func correlationID(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(CorrelationIDKey); len(ids) > 0 && validCorrelationID(ids[0]) {
+			return ids[0]
+		}
+	}
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		// Unique per process is better than nothing.
+		return fmt.Sprintf("%016x", atomic.LoadUint64(&grpcRequestCounter))
+	}
+	return hex.EncodeToString(id)
+}
+
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > maxCorrelationIDLen {
+		return false
+	}
+	for _, r := range id {
+		if r < '!' || r > '~' {
+			return false
+		}
+	}
+	return true
+}
+
 func unixDialer(ctx context.Context, addr string) (net.Conn, error) {
 	dialer := net.Dialer{}
 	return dialer.DialContext(ctx, "unix", addr)
 }
 
+// ClientKeepalive is used by Connect unless the dial options
+// contain different keepalive parameters. The client pings the
+// server every ten seconds, the minimum supported by gRPC, also
+// while there are no calls, and closes the connection when the
+// server does not respond in time. It ensures that gRPC detects a
+// dead connection in a timely manner.
+var ClientKeepalive = keepalive.ClientParameters{
+	Time:                10 * time.Second,
+	Timeout:             20 * time.Second,
+	PermitWithoutStream: true,
+}
+
 // Connect is a helper function to initiate a grpc client connection to server running at endpoint using tlsConfig
 func Connect(endpoint string, tlsConfig *tls.Config, dialOptions ...grpc.DialOption) (*grpc.ClientConn, error) {
 	proto, address, err := parseEndpoint(endpoint)
@@ -41,6 +94,12 @@ func Connect(endpoint string, tlsConfig *tls.Config, dialOptions ...grpc.DialOpt
 		return nil, err
 	}
 
+	// This is necessary when connecting via TCP and does not hurt
+	// when using Unix domain sockets. Options from the caller come
+	// later and thus take precedence.
+	// Originally lifted from https://github.com/kubernetes-csi/csi-test/commit/6b8830bf5959a1c51c6e98fe514b22818b51eeeb
+	dialOptions = append([]grpc.DialOption{grpc.WithKeepaliveParams(ClientKeepalive)}, dialOptions...)
+
 	connectParams := grpc.ConnectParams{
 		Backoff: backoff.DefaultConfig,
 	}
@@ -57,44 +116,39 @@ func Connect(endpoint string, tlsConfig *tls.Config, dialOptions ...grpc.DialOpt
 	} else if proto == "unix" {
 		dialOptions = append(dialOptions, grpc.WithContextDialer(unixDialer))
 	}
-	// This is necessary when connecting via TCP and does not hurt
-	// when using Unix domain sockets. It ensures that gRPC detects a dead connection
-	// in a timely manner.
-	// Code lifted from https://github.com/kubernetes-csi/csi-test/commit/6b8830bf5959a1c51c6e98fe514b22818b51eeeb
-	dialOptions = append(dialOptions, grpc.WithKeepaliveParams(keepalive.ClientParameters{PermitWithoutStream: true}))
-
 	return grpc.Dial(address, dialOptions...)
 }
 
 // NewServer is a helper function to start a grpc server at the given endpoint.
 // The error prefix is added to all error messages if not empty.
+// An endpoint with the pmemcommon.SystemdPrefix uses a socket
+// from systemd socket activation.
 func NewServer(endpoint, errorPrefix string, tlsConfig *tls.Config, csiMetricsManager metrics.CSIMetricsManager, opts ...grpc.ServerOption) (*grpc.Server, net.Listener, error) {
-	proto, addr, err := parseEndpoint(endpoint)
+	listener, err := Listen(endpoint)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	if proto == "unix" {
-		if err = os.Remove(addr); err != nil && !os.IsNotExist(err) {
-			return nil, nil, err
+	// Prepare a logger instance which always adds GRPC as prefix and a unique
+	// counter. This makes it possible to determine which log messages belong
+	// to which request and which are unrelated to gRPC. Outermost, so that
+	// also the interceptors from the options use it.
+	contextLogger := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		logger := klog.FromContext(ctx)
+		methodName := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
+		counter := atomic.AddUint64(&grpcRequestCounter, 1)
+		id := correlationID(ctx)
+		logger = logger.WithName(methodName).WithValues("request-counter", counter, "correlation-id", id)
+		ctx = klog.NewContext(ctx, logger)
+		if err := grpc.SetHeader(ctx, metadata.Pairs(CorrelationIDKey, id)); err != nil {
+			logger.V(5).Info("Returning the correlation ID failed", "err", err)
 		}
+		return handler(ctx, req)
 	}
-
-	listener, err := net.Listen(proto, addr)
-	if err != nil {
-		return nil, nil, err
-	}
+	opts = append([]grpc.ServerOption{grpc.ChainUnaryInterceptor(contextLogger)}, opts...)
 
 	interceptors := []grpc.UnaryServerInterceptor{
 		func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-			// Prepare a logger instance which always adds GRPC as prefix and a unique
-			// counter. This makes it possible to determine which log messages belong
-			// to which request and which are unrelated to gRPC.
-			logger := klog.FromContext(ctx)
-			methodName := info.FullMethod[strings.LastIndex(info.FullMethod, "/")+1:]
-			logger = logger.WithName(methodName).WithValues("request-counter", atomic.AddUint64(&grpcRequestCounter, 1))
-			ctx = klog.NewContext(ctx, logger)
-
 			resp, err := handler(ctx, req)
 			if errorPrefix != "" && err != nil {
 				// We loose any additional details here that might be attached
@@ -113,7 +167,10 @@ func NewServer(endpoint, errorPrefix string, tlsConfig *tls.Config, csiMetricsMa
 		interceptors = append(interceptors,
 			connection.ExtendedCSIMetricsManager{CSIMetricsManager: csiMetricsManager}.RecordMetricsServerInterceptor)
 	}
-	opts = append(opts, grpc.ChainUnaryInterceptor(interceptors...))
+	// Innermost, so that the resulting error gets logged and
+	// counted like any other.
+	interceptors = append(interceptors, pmemcommon.RecoverGRPCServer)
+	opts = append(opts, grpc.ChainUnaryInterceptor(interceptors...), grpc.ChainStreamInterceptor(pmemcommon.RecoverGRPCServerStream))
 	if tlsConfig != nil {
 		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
 	}
@@ -283,6 +340,40 @@ func loadCertificate(caFile, certFile, keyFile string) (certPool *x509.CertPool,
 	return
 }
 
+// Listen creates a listener for the endpoint. A Unix domain socket
+// which already exists gets replaced.
+func Listen(endpoint string) (net.Listener, error) {
+	if pmemcommon.IsSystemdAddress(endpoint) {
+		return pmemcommon.SystemdListener(endpoint)
+	}
+
+	proto, addr, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	if proto == "unix" {
+		if err = os.Remove(addr); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	return net.Listen(proto, addr)
+}
+
+// SocketPath returns the path of the Unix domain socket for the
+// endpoint, or an empty string for other endpoints.
+func SocketPath(endpoint string) string {
+	if pmemcommon.IsSystemdAddress(endpoint) {
+		return ""
+	}
+	proto, addr, err := parseEndpoint(endpoint)
+	if err != nil || proto != "unix" {
+		return ""
+	}
+	return addr
+}
+
 func parseEndpoint(ep string) (string, string, error) {
 	if strings.HasPrefix(strings.ToLower(ep), "unix://") || strings.HasPrefix(strings.ToLower(ep), "tcp://") {
 		s := strings.SplitN(ep, "://", 2)
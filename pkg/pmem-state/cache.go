@@ -0,0 +1,153 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemstate
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// rawLoader is implemented by state managers which can read all
+// entries at once.
+type rawLoader interface {
+	getAllRaw() (map[string]json.RawMessage, error)
+}
+
+// cachedState keeps the JSON encoding of entries in memory. Reads are
+// served from the cache once an entry was read or written; writes go
+// to the underlying state manager first and then update the cache.
+type cachedState struct {
+	sm StateManager
+	// mutex protects the cache and serializes writes, so the
+	// cache never has an entry which was not stored.
+	mutex   sync.Mutex
+	entries map[string]json.RawMessage
+	// complete is true when entries contains all IDs.
+	complete bool
+}
+
+var _ StateManager = &cachedState{}
+var _ Compactor = &cachedState{}
+
+// NewCached wraps a state manager with an in-memory cache. The state
+// must not be modified by anything else while the cache is in use,
+// for example by other processes.
+func NewCached(sm StateManager) StateManager {
+	return &cachedState{
+		sm:      sm,
+		entries: map[string]json.RawMessage{},
+	}
+}
+
+func (cs *cachedState) Create(id string, data interface{}) error {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	if err := cs.sm.Create(id, json.RawMessage(value)); err != nil {
+		// The entry might have been written partially.
+		delete(cs.entries, id)
+		cs.complete = false
+		return err
+	}
+	cs.entries[id] = value
+	return nil
+}
+
+func (cs *cachedState) Delete(id string) error {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	delete(cs.entries, id)
+	if err := cs.sm.Delete(id); err != nil {
+		cs.complete = false
+		return err
+	}
+	return nil
+}
+
+func (cs *cachedState) Get(id string, dataPtr interface{}) error {
+	cs.mutex.Lock()
+	value, ok := cs.entries[id]
+	if !ok {
+		if err := cs.sm.Get(id, &value); err != nil {
+			cs.mutex.Unlock()
+			return err
+		}
+		cs.entries[id] = value
+	}
+	cs.mutex.Unlock()
+
+	// Each caller gets its own copy.
+	if err := json.Unmarshal(value, dataPtr); err != nil {
+		return fmt.Errorf("failed to decode metadata of state entry %q: %w", id, err)
+	}
+	return nil
+}
+
+// GetAll reads all entries into the cache the first time it is called,
+// in one go if the underlying state manager supports that.
+func (cs *cachedState) GetAll() ([]string, error) {
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+
+	if !cs.complete {
+		if loader, ok := cs.sm.(rawLoader); ok {
+			entries, err := loader.getAllRaw()
+			if err != nil {
+				return nil, err
+			}
+			cs.entries = entries
+			cs.complete = true
+		} else {
+			ids, err := cs.sm.GetAll()
+			if err != nil {
+				return nil, err
+			}
+			entries := make(map[string]json.RawMessage, len(ids))
+			failed := false
+			for _, id := range ids {
+				var value json.RawMessage
+				if err := cs.sm.Get(id, &value); err != nil {
+					// Get reports the error again
+					// when the caller asks for the entry.
+					failed = true
+					continue
+				}
+				entries[id] = value
+			}
+			cs.entries = entries
+			if failed {
+				return ids, nil
+			}
+			cs.complete = true
+		}
+	}
+
+	ids := make([]string, 0, len(cs.entries))
+	for id := range cs.entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// Compact compacts the underlying state manager if it supports that.
+// The cache remains valid because the entries do not change.
+func (cs *cachedState) Compact() error {
+	compactor, ok := cs.sm.(Compactor)
+	if !ok {
+		return nil
+	}
+	cs.mutex.Lock()
+	defer cs.mutex.Unlock()
+	return compactor.Compact()
+}
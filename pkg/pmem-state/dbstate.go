@@ -0,0 +1,330 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemstate
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DBFile is the name of the database inside the state directory.
+const DBFile = "state.db"
+
+// MigratedSuffix gets appended to the .json files of older releases
+// after moving their content into the database.
+const MigratedSuffix = ".migrated"
+
+// dbOpenTimeout limits how long opening the database waits for
+// another process which has it open.
+const dbOpenTimeout = 10 * time.Second
+
+// compactTxMaxSize limits how much gets copied per transaction while
+// compacting, same as the default of "bbolt compact".
+const compactTxMaxSize = 64 * 1024
+
+var entriesBucket = []byte("entries")
+
+// dbState persists the state information in a bbolt database. Each
+// entry is stored as JSON, the same way as in a file.
+//
+// The database gets opened only for each transaction. bbolt locks
+// the file while it is open, and other modes of the driver (for
+// example, undelete-volume) must be able to access the state while
+// the node driver is running.
+type dbState struct {
+	file string
+	// lock serializes transactions inside the process, which is
+	// faster than waiting for the file lock.
+	lock sync.RWMutex
+}
+
+var _ StateManager = &dbState{}
+var _ rawLoader = &dbState{}
+var _ Compactor = &dbState{}
+
+// Compactor is implemented by state managers which can give back the
+// space of deleted entries. The database file never shrinks otherwise.
+type Compactor interface {
+	Compact() error
+}
+
+// NewDBState instantiates the database state manager for the given
+// directory. It ensures the directory and the database exist.
+// Entries which are stored as .json files in that directory get moved
+// into the database, then the files get renamed to .json.migrated.
+// Those are a backup for rolling back, they are never read. Other directory
+// content is ignored, which makes it possible to use the directory
+// also for other state information.
+func NewDBState(directory string) (StateManager, error) {
+	if err := ensureLocation(directory); err != nil {
+		return nil, err
+	}
+
+	ds := &dbState{
+		file: filepath.Join(directory, DBFile),
+	}
+	_, err := os.Stat(ds.file)
+	created := os.IsNotExist(err)
+	if err := ds.migrate(directory); err != nil {
+		return nil, fmt.Errorf("migrate state files in %q: %w", directory, err)
+	}
+	if created {
+		// bbolt syncs the file on each commit, but not the
+		// directory entry of a new database.
+		if err := syncDir(directory); err != nil {
+			return nil, err
+		}
+	}
+	return ds, nil
+}
+
+// OpenReadOnly returns a state manager which rejects modifications,
+// like NewReadOnly. It does not migrate files, so a directory which is
+// still in use by an older driver remains as it is.
+func OpenReadOnly(directory string) (StateManager, error) {
+	file := filepath.Join(directory, DBFile)
+	if _, err := os.Stat(file); os.IsNotExist(err) {
+		fs, err := NewFileState(directory)
+		if err != nil {
+			return nil, err
+		}
+		return NewReadOnly(fs), nil
+	}
+	return NewReadOnly(&dbState{file: file}), nil
+}
+
+// Create stores the JSON encoding of the data, overwriting any
+// existing entry with the same ID.
+func (ds *dbState) Create(id string, data interface{}) error {
+	value, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	return ds.update(func(bucket *bolt.Bucket) error {
+		if err := bucket.Put([]byte(id), value); err != nil {
+			return fmt.Errorf("failed to store state entry %q: %w", id, err)
+		}
+		return nil
+	})
+}
+
+// Delete removes the entry with the ID. Deleting an entry which does
+// not exist is not an error.
+func (ds *dbState) Delete(id string) error {
+	return ds.update(func(bucket *bolt.Bucket) error {
+		if err := bucket.Delete([]byte(id)); err != nil {
+			return fmt.Errorf("failed to delete state entry %q: %w", id, err)
+		}
+		return nil
+	})
+}
+
+// Get retrieves the entry with the ID into the location pointed to by
+// dataPtr. The error wraps os.ErrNotExist when there is no such
+// entry.
+func (ds *dbState) Get(id string, dataPtr interface{}) error {
+	return ds.view(func(bucket *bolt.Bucket) error {
+		value := bucket.Get([]byte(id))
+		if value == nil {
+			return fmt.Errorf("state entry %q: %w", id, os.ErrNotExist)
+		}
+		// value is only valid during the transaction, which is
+		// okay because decoding copies the data.
+		if err := json.NewDecoder(bytes.NewReader(value)).Decode(dataPtr); err != nil {
+			return fmt.Errorf("failed to decode metadata of state entry %q: %w", id, err)
+		}
+		return nil
+	})
+}
+
+// GetAll retrieves the IDs of all entries in the database.
+func (ds *dbState) GetAll() ([]string, error) {
+	ids := []string{}
+	err := ds.view(func(bucket *bolt.Bucket) error {
+		return bucket.ForEach(func(key, value []byte) error {
+			ids = append(ids, string(key))
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// getAllRaw reads all entries in one transaction.
+func (ds *dbState) getAllRaw() (map[string]json.RawMessage, error) {
+	entries := map[string]json.RawMessage{}
+	err := ds.view(func(bucket *bolt.Bucket) error {
+		return bucket.ForEach(func(key, value []byte) error {
+			// value is only valid during the transaction.
+			entries[string(key)] = append(json.RawMessage(nil), value...)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// migrate imports all .json files in one transaction and renames them
+// once that transaction is committed. They must not be imported again
+// later because they would overwrite newer entries. When the driver
+// gets killed before renaming all files, the next start imports the
+// remaining ones again, which then overwrites the entries with the
+// same data.
+// Temporary files of interrupted writes get removed without importing
+// them.
+func (ds *dbState) migrate(directory string) error {
+	files := &fileState{location: directory}
+	ids, err := files.GetAll()
+	if err != nil {
+		return err
+	}
+	tmpFiles, err := filepath.Glob(filepath.Join(directory, "*.json.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, file := range tmpFiles {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove temporary state file: %w", err)
+		}
+	}
+	err = ds.update(func(bucket *bolt.Bucket) error {
+		for _, id := range ids {
+			var value json.RawMessage
+			if err := files.Get(id, &value); err != nil {
+				return err
+			}
+			if err := bucket.Put([]byte(id), value); err != nil {
+				return fmt.Errorf("failed to store state entry %q: %w", id, err)
+			}
+		}
+		return nil
+	})
+	if err != nil || len(ids)+len(tmpFiles) == 0 {
+		return err
+	}
+	for _, id := range ids {
+		file := filepath.Join(directory, id+".json")
+		if err := os.Rename(file, file+MigratedSuffix); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rename migrated state file: %w", err)
+		}
+	}
+	return files.syncStateDir()
+}
+
+// Compact copies all entries into a new database file which then
+// replaces the current one. Other processes wait for that because the
+// current file stays open and locked until it got replaced.
+func (ds *dbState) Compact() error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	src, err := ds.open(false)
+	if err != nil {
+		return err
+	}
+	defer src.Close() //nolint: errcheck
+
+	tmp := ds.file + ".compact"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old compacted state database: %w", err)
+	}
+	dst, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: dbOpenTimeout})
+	if err != nil {
+		return fmt.Errorf("failed to create compacted state database: %w", err)
+	}
+	if err := bolt.Compact(dst, src, compactTxMaxSize); err != nil {
+		dst.Close()    //nolint: errcheck
+		os.Remove(tmp) //nolint: errcheck
+		return fmt.Errorf("failed to compact state database: %w", err)
+	}
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp) //nolint: errcheck
+		return fmt.Errorf("failed to close compacted state database: %w", err)
+	}
+	if err := os.Rename(tmp, ds.file); err != nil {
+		os.Remove(tmp) //nolint: errcheck
+		return fmt.Errorf("failed to replace state database: %w", err)
+	}
+	return syncDir(filepath.Dir(ds.file))
+}
+
+// open opens the database file. A process which was waiting for the
+// lock while the file got replaced by Compact has the old file open
+// and must try again. That is the case when the file has changed
+// since before opening it.
+func (ds *dbState) open(readOnly bool) (*bolt.DB, error) {
+	for {
+		before, statErr := os.Stat(ds.file)
+		db, err := bolt.Open(ds.file, 0600, &bolt.Options{Timeout: dbOpenTimeout, ReadOnly: readOnly})
+		if err != nil {
+			return nil, fmt.Errorf("failed to open state database: %w", err)
+		}
+		if statErr != nil {
+			// Created just now.
+			return db, nil
+		}
+		after, err := os.Stat(ds.file)
+		if err == nil && os.SameFile(before, after) {
+			return db, nil
+		}
+		db.Close() //nolint: errcheck
+	}
+}
+
+// update runs a read-write transaction. The database and the bucket
+// get created if necessary.
+func (ds *dbState) update(fn func(bucket *bolt.Bucket) error) error {
+	ds.lock.Lock()
+	defer ds.lock.Unlock()
+
+	db, err := ds.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close() //nolint: errcheck
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(entriesBucket)
+		if err != nil {
+			return fmt.Errorf("failed to create bucket in state database: %w", err)
+		}
+		return fn(bucket)
+	})
+}
+
+// view runs a read-only transaction. The database gets opened in
+// read-only mode, so several readers can use it at the same time.
+// NewDBState has created the database and the bucket.
+func (ds *dbState) view(fn func(bucket *bolt.Bucket) error) error {
+	ds.lock.RLock()
+	defer ds.lock.RUnlock()
+
+	db, err := ds.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close() //nolint: errcheck
+
+	return db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(entriesBucket)
+		if bucket == nil {
+			return fmt.Errorf("state database %q has no %s bucket", ds.file, entriesBucket)
+		}
+		return fn(bucket)
+	})
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package pmemstate
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// latencyBuckets cover the range from a cached read (much less than
+// a millisecond) to a sync on a disk which hangs (tens of seconds).
+var latencyBuckets = prometheus.ExponentialBuckets(0.0001, 4, 10)
+
+var (
+	operations = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmem_state_operations_total",
+			Help: "Number of state operations, by store and operation.",
+		},
+		[]string{"store", "operation"},
+	)
+	operationErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "pmem_state_operation_errors_total",
+			Help: "Number of state operations which failed, by store and operation. Get for an entry which does not exist is not an error.",
+		},
+		[]string{"store", "operation"},
+	)
+	operationDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "pmem_state_operation_duration_seconds",
+			Help:    "Duration of state operations, by store and operation.",
+			Buckets: latencyBuckets,
+		},
+		[]string{"store", "operation"},
+	)
+)
+
+// MustRegisterMetrics adds the metrics of all instrumented state
+// managers to the registry. The caller adds labels like the node name
+// by wrapping the registry.
+func MustRegisterMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(operations)
+	reg.MustRegister(operationErrors)
+	reg.MustRegister(operationDuration)
+}
+
+// instrumentedState records the number of calls, failures and the
+// duration of the operations of a state manager.
+type instrumentedState struct {
+	sm    StateManager
+	store string
+}
+
+var _ StateManager = &instrumentedState{}
+var _ rawLoader = &instrumentedState{}
+var _ Compactor = &instrumentedState{}
+
+// NewInstrumented wraps a state manager such that its operations show
+// up in the metrics under the store name (like "volumes"). It must be
+// below a cache to measure the actual I/O.
+func NewInstrumented(sm StateManager, store string) StateManager {
+	return &instrumentedState{sm: sm, store: store}
+}
+
+func (is *instrumentedState) observe(operation string, start time.Time, err error) {
+	operations.WithLabelValues(is.store, operation).Inc()
+	operationDuration.WithLabelValues(is.store, operation).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		operationErrors.WithLabelValues(is.store, operation).Inc()
+	}
+}
+
+func (is *instrumentedState) Create(id string, data interface{}) error {
+	start := time.Now()
+	err := is.sm.Create(id, data)
+	is.observe("Create", start, err)
+	return err
+}
+
+func (is *instrumentedState) Delete(id string) error {
+	start := time.Now()
+	err := is.sm.Delete(id)
+	is.observe("Delete", start, err)
+	return err
+}
+
+func (is *instrumentedState) Get(id string, dataPtr interface{}) error {
+	start := time.Now()
+	err := is.sm.Get(id, dataPtr)
+	is.observe("Get", start, err)
+	return err
+}
+
+func (is *instrumentedState) GetAll() ([]string, error) {
+	start := time.Now()
+	ids, err := is.sm.GetAll()
+	is.observe("GetAll", start, err)
+	return ids, err
+}
+
+// getAllRaw reads all entries at once if the underlying state manager
+// supports that, otherwise one after the other.
+func (is *instrumentedState) getAllRaw() (map[string]json.RawMessage, error) {
+	loader, ok := is.sm.(rawLoader)
+	if !ok {
+		ids, err := is.GetAll()
+		if err != nil {
+			return nil, err
+		}
+		entries := make(map[string]json.RawMessage, len(ids))
+		for _, id := range ids {
+			var value json.RawMessage
+			if err := is.Get(id, &value); err != nil {
+				return nil, err
+			}
+			entries[id] = value
+		}
+		return entries, nil
+	}
+	start := time.Now()
+	entries, err := loader.getAllRaw()
+	is.observe("GetAll", start, err)
+	return entries, err
+}
+
+func (is *instrumentedState) Compact() error {
+	compactor, ok := is.sm.(Compactor)
+	if !ok {
+		return nil
+	}
+	start := time.Now()
+	err := compactor.Compact()
+	is.observe("Compact", start, err)
+	return err
+}
@@ -11,8 +11,11 @@ import (
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"sync"
+
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
 )
 
 // StateManager manages the driver persistent state, i.e, volumes information
@@ -63,8 +66,9 @@ func (fs *fileState) Create(id string, data interface{}) error {
 
 	suffix := ".tmp"
 	file := path.Join(fs.location, id+".json"+suffix)
-	// Create new file for synchronous writes
-	fp, err := os.OpenFile(file, os.O_WRONLY|os.O_SYNC|os.O_CREATE|os.O_EXCL, 0600)
+	// Create new file for synchronous writes. A file left behind by
+	// an interrupted write gets replaced, it never was a valid entry.
+	fp, err := os.OpenFile(file, os.O_WRONLY|os.O_SYNC|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
 		return fmt.Errorf("failed to create state file: %w", err)
 	}
@@ -127,11 +131,35 @@ func (fs *fileState) GetAll() ([]string, error) {
 	return ids, nil
 }
 
+// readOnlyState rejects all modifications.
+type readOnlyState struct {
+	StateManager
+}
+
+// NewReadOnly wraps a state manager such that Create and Delete fail
+// with pmemerr.ReadOnly.
+func NewReadOnly(sm StateManager) StateManager {
+	return readOnlyState{sm}
+}
+
+func (readOnlyState) Create(id string, data interface{}) error {
+	return fmt.Errorf("create state entry %q: %w", id, pmemerr.ReadOnly)
+}
+
+func (readOnlyState) Delete(id string) error {
+	return fmt.Errorf("delete state entry %q: %w", id, pmemerr.ReadOnly)
+}
+
 func ensureLocation(directory string) error {
 	info, err := os.Stat(directory)
 	if err != nil {
 		if os.IsNotExist(err) {
 			err = os.Mkdir(directory, 0750)
+			if err == nil {
+				// The new directory must survive a power
+				// failure together with its content.
+				err = syncDir(filepath.Dir(filepath.Clean(directory)))
+			}
 		}
 	} else if !info.IsDir() {
 		err = fmt.Errorf("state location %q must be a directory", directory)
@@ -158,11 +186,17 @@ func (fs *fileState) readFileData(file string, dataPtr interface{}) error {
 }
 
 func (fs *fileState) syncStateDir() error {
-	var rErr error
 	fs.stateDirLock.Lock()
 	defer fs.stateDirLock.Unlock()
 
-	if fp, err := os.Open(fs.location); err != nil {
+	return syncDir(fs.location)
+}
+
+// syncDir flushes the directory entries, which is necessary after
+// creating, renaming or removing a file in the directory.
+func syncDir(directory string) error {
+	var rErr error
+	if fp, err := os.Open(directory); err != nil {
 		rErr = fmt.Errorf("failed to open state directory for syncing: %w", err)
 	} else if err := fp.Sync(); err != nil {
 		fp.Close() //nolint: errcheck
@@ -6,6 +6,7 @@ SPDX-License-Identifier: Apache-2.0
 package pmemstate_test
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
@@ -15,9 +16,12 @@ import (
 	"testing"
 	"time"
 
+	pmemerr "github.com/intel/pmem-csi/pkg/errors"
 	pmemstate "github.com/intel/pmem-csi/pkg/pmem-state"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type testData struct {
@@ -48,6 +52,22 @@ func (td *testData) IsEqual(other testData) bool {
 	return true
 }
 
+// countingState counts the reads of the underlying state manager.
+type countingState struct {
+	pmemstate.StateManager
+	gets, getAlls int
+}
+
+func (cs *countingState) Get(id string, dataPtr interface{}) error {
+	cs.gets++
+	return cs.StateManager.Get(id, dataPtr)
+}
+
+func (cs *countingState) GetAll() ([]string, error) {
+	cs.getAlls++
+	return cs.StateManager.GetAll()
+}
+
 func TestPmemState(t *testing.T) {
 	RegisterFailHandler(Fail)
 	RunSpecs(t, "PMEM State Suite")
@@ -329,6 +349,27 @@ var _ = Describe("pmem state", func() {
 			Expect(err).To(HaveOccurred())
 		})
 
+		It("torn write", func() {
+			data := testData{Id: "one", Name: "after power failure"}
+
+			// A power failure while writing the temporary
+			// file leaves it behind, truncated.
+			tmpFile := path.Join(stateDir, data.Id+".json.tmp")
+			Expect(os.WriteFile(tmpFile, []byte(`{"Id": "one", "Na`), 0600)).NotTo(HaveOccurred())
+
+			fs, err := pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			ids, err := fs.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(BeEmpty(), "torn write is not an entry")
+
+			Expect(fs.Create(data.Id, data)).NotTo(HaveOccurred(), "create after torn write")
+			Expect(tmpFile).NotTo(BeAnExistingFile(), "temporary file")
+			rData := testData{}
+			Expect(fs.Get(data.Id, &rData)).NotTo(HaveOccurred())
+			Expect(rData.Name).To(Equal(data.Name), "record data")
+		})
+
 		It("able to read/write with different parameters", func() {
 			data := []testData{
 				testData{
@@ -374,5 +415,279 @@ var _ = Describe("pmem state", func() {
 				Expect(data).Should(ContainElement(rData), "records data shold match")
 			}
 		})
+
+		It("read-only", func() {
+			data := testData{Id: "one", Name: "read-only"}
+			fs, err := pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fs.Create(data.Id, data)).NotTo(HaveOccurred())
+
+			ro := pmemstate.NewReadOnly(fs)
+			Expect(errors.Is(ro.Create("two", data), pmemerr.ReadOnly)).To(BeTrue(), "create")
+			Expect(errors.Is(ro.Delete(data.Id), pmemerr.ReadOnly)).To(BeTrue(), "delete")
+			ids, err := ro.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]string{data.Id}), "records")
+			rData := testData{}
+			Expect(ro.Get(data.Id, &rData)).NotTo(HaveOccurred())
+			Expect(rData.Name).To(Equal(data.Name), "record data")
+		})
+	})
+
+	Context("Database", func() {
+		data := []testData{
+			{
+				Id:     "one",
+				Name:   "test-data1",
+				Params: map[string]string{"key1": "val1"},
+			},
+			{
+				Id:     "two",
+				Name:   "test-data2",
+				Params: map[string]string{},
+			},
+		}
+
+		It("create, get and delete", func() {
+			_, err := pmemstate.NewDBState("/unknown/base/directory/")
+			Expect(err).To(HaveOccurred())
+
+			ds, err := pmemstate.NewDBState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			ids, err := ds.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(BeEmpty(), "new database")
+
+			for _, d := range data {
+				Expect(ds.Create(d.Id, d)).NotTo(HaveOccurred())
+			}
+			ids, err = ds.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(ConsistOf("one", "two"), "records")
+			for _, d := range data {
+				rData := testData{}
+				Expect(ds.Get(d.Id, &rData)).NotTo(HaveOccurred())
+				Expect(d.IsEqual(rData)).To(BeTrue(), "record %s", d.Id)
+			}
+
+			Expect(ds.Delete("one")).NotTo(HaveOccurred())
+			Expect(ds.Delete("one")).NotTo(HaveOccurred(), "delete again")
+			err = ds.Get("one", &testData{})
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue(), "get deleted record: %v", err)
+
+			// A new instance sees the same content.
+			ds, err = pmemstate.NewDBState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			ids, err = ds.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]string{"two"}), "records after reopening")
+		})
+
+		It("migrate files", func() {
+			fs, err := pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			for _, d := range data {
+				Expect(fs.Create(d.Id, d)).NotTo(HaveOccurred())
+			}
+			Expect(os.Mkdir(path.Join(stateDir, "other"), 0750)).NotTo(HaveOccurred())
+
+			// Read-only access must not migrate.
+			ro, err := pmemstate.OpenReadOnly(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			ids, err := ro.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(ConsistOf("one", "two"), "read-only records")
+			Expect(path.Join(stateDir, pmemstate.DBFile)).NotTo(BeAnExistingFile(), "database")
+
+			ds, err := pmemstate.NewDBState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			for _, d := range data {
+				Expect(path.Join(stateDir, d.Id+".json")).NotTo(BeAnExistingFile(), "migrated file")
+				Expect(path.Join(stateDir, d.Id+".json"+pmemstate.MigratedSuffix)).To(BeAnExistingFile(), "backup of migrated file")
+				rData := testData{}
+				Expect(ds.Get(d.Id, &rData)).NotTo(HaveOccurred())
+				Expect(d.IsEqual(rData)).To(BeTrue(), "record %s", d.Id)
+			}
+			Expect(path.Join(stateDir, "other")).To(BeADirectory(), "other content")
+
+			ro, err = pmemstate.OpenReadOnly(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			ids, err = ro.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(ConsistOf("one", "two"), "read-only records after migration")
+			Expect(errors.Is(ro.Delete("one"), pmemerr.ReadOnly)).To(BeTrue(), "delete")
+
+			// The backups do not get imported again.
+			Expect(ds.Delete("one")).NotTo(HaveOccurred())
+			ds, err = pmemstate.NewDBState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			ids, err = ds.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(ConsistOf("two"), "records after restart")
+		})
+
+		It("torn write before migration", func() {
+			fs, err := pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fs.Create(data[0].Id, data[0])).NotTo(HaveOccurred())
+			tmpFile := path.Join(stateDir, data[1].Id+".json.tmp")
+			Expect(os.WriteFile(tmpFile, []byte(`{"Id": "two", "Na`), 0600)).NotTo(HaveOccurred())
+
+			ds, err := pmemstate.NewDBState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			ids, err := ds.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]string{data[0].Id}), "records")
+			Expect(tmpFile).NotTo(BeAnExistingFile(), "temporary file")
+		})
+
+		It("new sub-directory", func() {
+			subDir := path.Join(stateDir, "snapshots")
+			ds, err := pmemstate.NewDBState(subDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(path.Join(subDir, pmemstate.DBFile)).To(BeAnExistingFile(), "database")
+			Expect(ds.Create(data[0].Id, data[0])).NotTo(HaveOccurred())
+		})
+
+		It("compact", func() {
+			ds, err := pmemstate.NewDBState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			// A second instance, like the one of another process.
+			other, err := pmemstate.NewDBState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			payload := strings.Repeat("x", 64*1024)
+			for i := 0; i < 100; i++ {
+				d := testData{Id: fmt.Sprintf("vol-%d", i), Name: payload}
+				Expect(ds.Create(d.Id, d)).NotTo(HaveOccurred())
+			}
+			for i := 1; i < 100; i++ {
+				Expect(ds.Delete(fmt.Sprintf("vol-%d", i))).NotTo(HaveOccurred())
+			}
+			dbFile := path.Join(stateDir, pmemstate.DBFile)
+			before, err := os.Stat(dbFile)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(ds.(pmemstate.Compactor).Compact()).NotTo(HaveOccurred())
+			after, err := os.Stat(dbFile)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(after.Size()).To(BeNumerically("<", before.Size()/10), "database size")
+			Expect(path.Join(stateDir, pmemstate.DBFile+".compact")).NotTo(BeAnExistingFile(), "temporary database")
+
+			for _, sm := range []pmemstate.StateManager{ds, other} {
+				ids, err := sm.GetAll()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ids).To(Equal([]string{"vol-0"}), "records after compaction")
+			}
+			Expect(other.Create(data[0].Id, data[0])).NotTo(HaveOccurred())
+			ids, err := ds.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(ConsistOf("one", "vol-0"), "record written by the other instance")
+
+			// The cache forwards compaction.
+			cached := pmemstate.NewCached(ds)
+			Expect(cached.(pmemstate.Compactor).Compact()).NotTo(HaveOccurred())
+			ids, err = cached.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]string{"one", "vol-0"}), "cached records after compaction")
+		})
+
+		It("cache", func() {
+			ds, err := pmemstate.NewDBState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ds.Create(data[0].Id, data[0])).NotTo(HaveOccurred())
+			Expect(ds.Create(data[1].Id, data[1])).NotTo(HaveOccurred())
+
+			// All entries get loaded in one transaction.
+			cached := pmemstate.NewCached(ds)
+			ids, err := cached.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]string{"one", "two"}), "records")
+			Expect(ds.Delete("one")).NotTo(HaveOccurred(), "delete behind the back of the cache")
+			rData := testData{}
+			Expect(cached.Get("one", &rData)).NotTo(HaveOccurred(), "cached record")
+			Expect(data[0].IsEqual(rData)).To(BeTrue(), "cached record data")
+
+			// Callers get copies.
+			rData.Params["key1"] = "modified"
+			rData = testData{}
+			Expect(cached.Get("one", &rData)).NotTo(HaveOccurred(), "cached record")
+			Expect(rData.Params["key1"]).To(Equal("val1"), "cached record data")
+
+			// Writes go through the cache.
+			three := testData{Id: "three", Name: "test-data3"}
+			Expect(cached.Create(three.Id, three)).NotTo(HaveOccurred())
+			Expect(cached.Delete("two")).NotTo(HaveOccurred())
+			ids, err = cached.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]string{"one", "three"}), "cached records")
+			ids, err = ds.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(ids).To(Equal([]string{"three"}), "stored records")
+			err = cached.Get("two", &rData)
+			Expect(errors.Is(err, os.ErrNotExist)).To(BeTrue(), "get deleted record: %v", err)
+		})
+
+		It("cache with read-through", func() {
+			fs, err := pmemstate.NewFileState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(fs.Create(data[0].Id, data[0])).NotTo(HaveOccurred())
+			counting := &countingState{StateManager: fs}
+			cached := pmemstate.NewCached(counting)
+
+			rData := testData{}
+			Expect(cached.Get("one", &rData)).NotTo(HaveOccurred())
+			Expect(cached.Get("one", &rData)).NotTo(HaveOccurred())
+			Expect(counting.gets).To(Equal(1), "reads of an entry")
+			Expect(cached.Create(data[1].Id, data[1])).NotTo(HaveOccurred())
+			rData = testData{}
+			Expect(cached.Get("two", &rData)).NotTo(HaveOccurred())
+			Expect(counting.gets).To(Equal(1), "reads of a new entry")
+			Expect(data[1].IsEqual(rData)).To(BeTrue(), "new record data")
+
+			for i := 0; i < 2; i++ {
+				ids, err := cached.GetAll()
+				Expect(err).NotTo(HaveOccurred())
+				Expect(ids).To(Equal([]string{"one", "two"}), "records")
+			}
+			Expect(counting.getAlls).To(Equal(1), "listing entries")
+		})
+
+		It("metrics", func() {
+			reg := prometheus.NewPedanticRegistry()
+			pmemstate.MustRegisterMetrics(reg)
+			ds, err := pmemstate.NewDBState(stateDir)
+			Expect(err).NotTo(HaveOccurred())
+			instrumented := pmemstate.NewInstrumented(ds, "volumes")
+			cached := pmemstate.NewCached(instrumented)
+
+			Expect(cached.Create(data[0].Id, data[0])).NotTo(HaveOccurred())
+			rData := testData{}
+			Expect(cached.Get(data[0].Id, &rData)).NotTo(HaveOccurred(), "cached record")
+			Expect(errors.Is(cached.Get("unknown", &rData), os.ErrNotExist)).To(BeTrue(), "unknown record")
+			_, err = cached.GetAll()
+			Expect(err).NotTo(HaveOccurred())
+			Expect(cached.Delete(data[0].Id)).NotTo(HaveOccurred())
+			Expect(instrumented.Create("bad", func() {})).To(HaveOccurred(), "encoding error")
+
+			Expect(testutil.GatherAndCompare(reg, strings.NewReader(`
+# HELP pmem_state_operation_errors_total Number of state operations which failed, by store and operation. Get for an entry which does not exist is not an error.
+# TYPE pmem_state_operation_errors_total counter
+pmem_state_operation_errors_total{operation="Create",store="volumes"} 1
+# HELP pmem_state_operations_total Number of state operations, by store and operation.
+# TYPE pmem_state_operations_total counter
+pmem_state_operations_total{operation="Create",store="volumes"} 2
+pmem_state_operations_total{operation="Delete",store="volumes"} 1
+pmem_state_operations_total{operation="Get",store="volumes"} 1
+pmem_state_operations_total{operation="GetAll",store="volumes"} 1
+`), "pmem_state_operations_total", "pmem_state_operation_errors_total")).NotTo(HaveOccurred(), "operations")
+			Expect(testutil.CollectAndCount(reg, "pmem_state_operation_duration_seconds")).To(Equal(4), "histograms")
+		})
+
+		It("corrupted file", func() {
+			Expect(os.WriteFile(path.Join(stateDir, "one.json"), []byte(`{"Id": "one", "Na`), 0600)).NotTo(HaveOccurred())
+			_, err := pmemstate.NewDBState(stateDir)
+			Expect(err).To(HaveOccurred(), "corrupted files must not get dropped silently")
+			Expect(path.Join(stateDir, "one.json")).To(BeAnExistingFile(), "corrupted file")
+		})
 	})
 })
@@ -0,0 +1,43 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+// Package tracing creates OpenTelemetry spans for the work done
+// inside a traced gRPC call.
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationScope = "github.com/intel/pmem-csi"
+
+// VolumeIDKey is the attribute which identifies the volume that a
+// span is about.
+const VolumeIDKey = attribute.Key("pmem-csi.volume-id")
+
+// VolumeID returns the attribute for a volume ID.
+func VolumeID(volumeID string) attribute.KeyValue {
+	return VolumeIDKey.String(volumeID)
+}
+
+// Start creates a child of the span in the context. Without a span,
+// for example when tracing is disabled, the new span is a noop.
+func Start(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(instrumentationScope).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// End marks the span as failed if there was an error and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
@@ -23,8 +23,8 @@ import (
 	"os"
 	"path/filepath"
 
+	"k8s.io/mount-utils"
 	"k8s.io/utils/exec"
-	"k8s.io/utils/mount"
 
 	"k8s.io/apimachinery/pkg/types"
 
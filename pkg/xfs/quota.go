@@ -0,0 +1,38 @@
+/*
+Copyright 2021 Intel Corporation.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package xfs
+
+import (
+	"context"
+	"fmt"
+
+	pmemexec "github.com/intel/pmem-csi/pkg/exec"
+)
+
+// MountOption enables project quotas. It must be used when mounting
+// a filesystem for LimitSize, quotas cannot be enabled by remounting.
+const MountOption = "prjquota"
+
+// projectID is used for the project quota of a volume. The quota
+// covers the entire filesystem and merely caps it at the requested
+// size when the device is larger. It does not isolate several users
+// of the same filesystem from each other. PMEM-CSI never puts more
+// than one volume into a filesystem, so a single ID is enough.
+const projectID = 1
+
+// LimitSize ensures that at most size bytes can be stored in the XFS
+// filesystem mounted at path, regardless of the size of the underlying
+// device. It is idempotent and also updates the limit.
+func LimitSize(ctx context.Context, path string, size int64) error {
+	if _, err := pmemexec.RunCommand(ctx, "xfs_quota", "-x",
+		"-c", fmt.Sprintf("project -s -p %s %d", path, projectID),
+		"-c", fmt.Sprintf("limit -p bhard=%d %d", size, projectID),
+		path); err != nil {
+		return fmt.Errorf("set project quota for %q: %v", path, err)
+	}
+	return nil
+}
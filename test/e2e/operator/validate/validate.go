@@ -366,6 +366,7 @@ CSIDriver:
     storageCapacity: false
     fsGroupPolicy: ignore # currently PMEM-CSI driver does not support fsGroupPolicy
     requiresRepublish: false
+    seLinuxMount: ignore # set by the operator for Kubernetes >= 1.25, dropped by the apiserver unless the SELinuxMountReadWriteOncePod feature gate is enabled
 MutatingWebhookConfiguration:
   webhooks:
     clientConfig:
@@ -545,7 +546,7 @@ func listAllDeployedObjects(ctx context.Context, c client.Client, deployment api
 		// Test client does not support differentiating cluster-scoped objects
 		// and the query fails when fetch those object by setting the namespace-
 		switch list.GetKind() {
-		case "CSIDriverList", "ClusterRoleList", "ClusterRoleBindingList", "MutatingWebhookConfigurationList":
+		case "CSIDriverList", "StorageClassList", "ClusterRoleList", "ClusterRoleBindingList", "MutatingWebhookConfigurationList":
 			opts = &client.ListOptions{}
 		}
 		// Filtering by owner doesn't work, so we have to use brute-force and look at all